@@ -3,8 +3,13 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"maps"
 	"os"
+	"regexp"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -38,20 +43,51 @@ type opt struct {
 const (
 	// positional param one - the image url
 	imageOpt optName = "image"
-	// positional param two - the tarball to save the image to
+	// positional param two - the tarball (or for extract, the directory) to save the image to
 	destOpt optName = "dest"
+	// positional param - the second image url for the diff and copy commands
+	toImageOpt optName = "to-image"
+	// positional param - an image list file for the bundle command
+	imageListOpt optName = "image-list"
+	// positional param - a bundle archive
+	archiveOpt optName = "archive"
+	// positional param - a registry to push to, e.g. my.registry.io:5000
+	registryOpt optName = "registry"
+	// positional param - the directory that the daemon command pulls tarballs to, or
+	// that the layout command writes the image to
+	destDirOpt optName = "dest-dir"
+	// positional param - the tarball or OCI image layout directory for the push command
+	srcOpt optName = "src"
+	// positional param - the shell for the completion command
+	shellOpt optName = "shell"
 	// e.g. --os linux
 	osOpt optName = "os"
 	// e.g. --arch amd64
 	archOpt optName = "arch"
+	// e.g. --os-version 10.0.17763
+	osVersionOpt optName = "os-version"
+	// e.g. --os-features win32k
+	osFeaturesOpt optName = "os-features"
 	// e.g. --ns docker.io
 	namespaceOpt optName = "namespace"
+	// e.g. --base-path /artifactory/api/docker/docker-local
+	basePathOpt optName = "base-path"
+	// e.g. --registry-override 10.0.0.5:8443
+	registryOverrideOpt optName = "registry-override"
+	// e.g. --proxy socks5://127.0.0.1:1080
+	proxyOpt optName = "proxy"
+	// e.g. --ssh-jump jqpubli@bastion:2222
+	sshJumpOpt optName = "ssh-jump"
 	// e.g. --user jqpubli
 	usernameOpt optName = "user"
 	// e.g. --password mypassword
 	passwordOpt optName = "password"
+	// e.g. --password-stdin
+	passwordStdinOpt optName = "password-stdin"
 	// e.g. --token some-external-token
 	tokenOpt optName = "token"
+	// e.g. --bearer-token $GITHUB_TOKEN
+	bearerTokenOpt optName = "bearer-token"
 	// e.g. --scheme [http | https]
 	schemeOpt optName = "scheme"
 	// e.g. --cert /path/to/client-cert.pem
@@ -60,16 +96,90 @@ const (
 	keyOpt optName = "key"
 	// e.g. --cacert /path/to/ca.pem
 	caOpt optName = "cacert"
+	// e.g. --cacert-dir /etc/docker/certs.d/my.registry
+	caDirOpt optName = "cacert-dir"
+	// e.g. --system-cas
+	systemCasOpt optName = "system-cas"
 	// e.g. --insecure
 	insecureOpt optName = "insecure"
+	// e.g. --insecure-registries my.registry:5000,10.0.0.0/8
+	insecureRegistriesOpt optName = "insecure-registries"
+	// e.g. --insecure-hosts my.registry:5000,10.0.0.0/8
+	insecureHostsOpt optName = "insecure-hosts"
+	// e.g. --media-type-check strict
+	mediaTypeCheckOpt optName = "media-type-check"
+	// e.g. --debug
+	debugOpt optName = "debug"
+	// e.g. --config ~/.imgpull/config.yaml
+	configOpt optName = "config"
+	// e.g. --unix-socket /run/registry.sock
+	unixSocketOpt optName = "unix-socket"
 	// e.g. --manifest [list | image]
 	manifestOpt optName = "manifest"
+	// e.g. --platform-digest
+	platformDigestOpt optName = "platform-digest"
+	// e.g. --platform linux/amd64,linux/arm64
+	platformOpt optName = "platform"
+	// e.g. --all-platforms
+	allPlatformsOpt optName = "all-platforms"
+	// e.g. --layer 3
+	layerOpt optName = "layer"
+	// e.g. --filter '^v1\.2\.'
+	filterOpt optName = "filter"
+	// e.g. --limit 10
+	limitOpt optName = "limit"
+	// e.g. --from-file images.txt
+	fromFileOpt optName = "from-file"
+	// e.g. --concurrency 4
+	concurrencyOpt optName = "concurrency"
+	// e.g. --listen 127.0.0.1:8080
+	listenOpt optName = "listen"
+	// e.g. --max-image-bytes 104857600
+	maxImageBytesOpt optName = "max-image-bytes"
+	// e.g. --allowed-registries quay.io,my.registry.io:5000
+	allowedRegistriesOpt optName = "allowed-registries"
+	// e.g. --require-digest
+	requireDigestOpt optName = "require-digest"
+	// e.g. --verify-diff-ids
+	verifyDiffIdsOpt optName = "verify-diff-ids"
+	// e.g. --work-dir /var/tmp
+	workDirOpt optName = "work-dir"
+	// e.g. --sidecar json
+	sidecarOpt optName = "sidecar"
+	// e.g. --signing-key /etc/pki/signing-key.pem
+	signingKeyOpt optName = "signing-key"
+	// e.g. --decryption-keys /etc/pki/layer-key.pem
+	decryptionKeysOpt optName = "decryption-keys"
+	// e.g. --file-mode 0644
+	fileModeOpt optName = "file-mode"
+	// e.g. --file-owner 1000:1000
+	fileOwnerOpt optName = "file-owner"
+	// e.g. --fsync
+	fsyncOpt optName = "fsync"
+	// e.g. --reproducible
+	reproducibleOpt optName = "reproducible"
+	// e.g. --oci-layout
+	ociLayoutOpt optName = "oci-layout"
+	// e.g. --repo-tags docker.io/hello-world:latest,hello-world:v1
+	repoTagsOpt optName = "repo-tags"
+	// e.g. --no-repo-tags
+	noRepoTagsOpt optName = "no-repo-tags"
+	// e.g. --dry-run
+	dryRunOpt optName = "dry-run"
+	// e.g. --uncompressed
+	uncompressedOpt optName = "uncompressed"
+	// e.g. --history
+	historyOpt optName = "history"
+	// e.g. --format [json | pretty | yaml | go template]
+	formatOpt optName = "format"
 	// e.g. --version
 	versionOpt optName = "version"
 	// e.g. --help
 	helpOpt optName = "help"
 	// e.g. --parsed
 	parsedOpt optName = "parsed"
+	// e.g. --quiet
+	quietOpt optName = "quiet"
 )
 
 // optMap holds the parsed command line
@@ -78,61 +188,205 @@ type optMap map[optName]opt
 var usageText = `
 Usage:
 
-imgpull <image ref> <tar file> [-o|--os os] [-a|--arch arch] [-n|--ns namespace]
- [-u|--user username] [-p|--password password] [-t|--token tokenval] [-s|--scheme scheme]
- [-c|--cert tls cert] [-k|--key tls key] [-x|--cacert tls ca cert] [-i|--insecure]
- [-m|--manifest type] [-v|--version] [-h|--help] [--parsed]
+imgpull <command> [command args and options]
+imgpull <image ref> <tar file> [pull options]
 
-The image ref is required. Tar file is required if pulling a tarball. Everything else is
-optional. The OS and architecture default to your system's values.
+Commands:
+
+%s
+Run 'imgpull <command> --help' for the arguments and options supported by
+each command. If the first argument is an image ref rather than a command then
+'pull' is assumed, which supports the original form of the CLI.
 
 Example 1:
 
-imgpull docker.io/hello-world:latest ./hello-world.latest.tar
+imgpull pull docker.io/hello-world:latest ./hello-world.latest.tar
 
 The example pulls the image to hello-world.latest.tar in the working directory using the
 operating system and architecture of the current system.
 
 Example 2:
 
-imgpull docker.io/hello-world:latest --manifest list
+imgpull manifest docker.io/hello-world:latest --manifest list
 
 The example pulls the manifest list for hello-world:latest and displays it to the console.
 `
 
-// parseArgs parses and validates the command line parameters and options, returning them in a map.
-// Only validations within the scope of the command line are validated. For example whether or not
-// the URL is valid is not done here - that is determined by the Puller.
-func parseArgs() (optMap, error) {
-	opts := optMap{
-		imageOpt:     {Name: imageOpt},
-		destOpt:      {Name: destOpt},
-		osOpt:        {Name: osOpt, Short: "o", Long: "os", Dflt: runtime.GOOS},
-		archOpt:      {Name: archOpt, Short: "a", Long: "arch", Dflt: runtime.GOARCH},
-		namespaceOpt: {Name: namespaceOpt, Short: "n", Long: "ns"},
-		usernameOpt:  {Name: usernameOpt, Short: "u", Long: "user"},
-		passwordOpt:  {Name: passwordOpt, Short: "p", Long: "password"},
-		tokenOpt:     {Name: tokenOpt, Short: "t", Long: "token"},
-		schemeOpt:    {Name: schemeOpt, Short: "s", Long: "scheme", Dflt: "https"},
-		certOpt:      {Name: certOpt, Short: "c", Long: "cert"},
-		keyOpt:       {Name: keyOpt, Short: "k", Long: "key"},
-		caOpt:        {Name: caOpt, Short: "x", Long: "cacert"},
-		insecureOpt:  {Name: insecureOpt, Short: "i", Long: "insecure", IsSwitch: true, Dflt: "false"},
-		manifestOpt:  {Name: manifestOpt, Short: "m", Long: "manifest"},
-		versionOpt:   {Name: versionOpt, Short: "v", Long: "version", IsSwitch: true, Func: showVersionAndExit},
-		helpOpt:      {Name: helpOpt, Short: "h", Long: "help", IsSwitch: true, Func: showUsageAndExit},
-		parsedOpt:    {Name: parsedOpt, Long: "parsed", IsSwitch: true, Func: showParsedAndExit},
-	}
-	for i := 1; i < len(os.Args); i++ {
+// connectUsage documents the options shared by all commands that talk to a registry.
+var connectUsage = `
+Connection options:
+
+ -o|--os os               Operating system of the image. Defaults to your system's value.
+ -a|--arch arch           Architecture of the image. Defaults to your system's value.
+ --os-version version     OS version of the image, e.g. 10.0.17763 to select the
+                          Windows Server 2019 image from an image list.
+ --os-features features   Comma-separated OS features the image must have.
+ -n|--ns namespace        Namespace for pulling through a mirror or pull-through registry.
+ --base-path path         Path that the registry serves the v2 API under, e.g.
+                          /artifactory/api/docker/docker-local for Artifactory.
+ --registry-override addr Host or IP, with an optional port, to connect to in place
+                          of the registry, like curl --resolve. TLS still verifies
+                          the registry host.
+ --proxy url              Proxy url with scheme http, https, socks5, or socks5h.
+ --ssh-jump host          SSH jump host, like user@bastion:2222, to tunnel through.
+ -u|--user username       Username for basic auth.
+ -p|--password password   Password for basic auth.
+ --password-stdin         Read the password for basic auth from stdin.
+ -t|--token tokenval      Externally provided token the upstream will accept.
+ --bearer-token tokenval  Pre-issued bearer token, e.g. a CI token, to send without
+                          the auth handshake.
+ -s|--scheme scheme       http or https. Defaults to https unless the config file
+                          has a scheme for the registry.
+ -c|--cert tls cert       Client cert for mTLS.
+ -k|--key tls key         Client key for mTLS.
+ -x|--cacert tls ca cert  CA cert to verify the server cert.
+ --cacert-dir dir         Directory of .crt or .pem CA certs to verify the server cert.
+ --system-cas             Add the CA certs to the system truststore rather than replacing it.
+ -i|--insecure            Don't verify the server cert.
+ --insecure-registries r  Comma-separated registries or CIDRs that may fall back from
+                          https to http.
+ --insecure-hosts h       Comma-separated hosts or CIDRs whose server certs aren't
+                          verified. Other hosts, like the token server, are verified.
+ --unix-socket path       Connect to the registry over a unix socket.
+ --media-type-check mode  What to do when a manifest's Content-Type doesn't match
+                          its mediaType or the image list descriptor: 'warn' to
+                          print a warning, or 'strict' to fail.
+ -d|--debug               Print the method, url, status, and time of each request to
+                          the registry to stderr, e.g. to diagnose auth failures.
+ --config file            Config file with per-registry settings. Defaults to
+                          ~/.imgpull/config.yaml if it exists. Options on the
+                          command line take precedence over the config file.
+
+If no credentials are provided on the command line then they are read from the
+IMGPULL_USERNAME, IMGPULL_PASSWORD, and IMGPULL_TOKEN environment variables, or
+from per-registry variants that take precedence, which have the registry in upper
+case with non-alphanumerics replaced by underscores. E.g. for my.registry.io:5000:
+IMGPULL_MY_REGISTRY_IO_5000_USERNAME.
+`
+
+// globalUsage documents the options supported by every command.
+var globalUsage = `
+Other options:
+
+ -v|--version             Show the version and exit.
+ -h|--help                Show this help and exit.
+ --parsed                 Show the parsed command line and exit.
+ -q|--quiet               Don't print anything except errors.
+
+Exit codes: 0 success, 1 other failure, 2 image or blob not found, 3 authentication
+failure, 4 network failure, 5 digest mismatch, 64 invalid command line.
+`
+
+// globalOpts returns the options that are supported by every command.
+func globalOpts() optMap {
+	return optMap{
+		versionOpt: {Name: versionOpt, Short: "v", Long: "version", IsSwitch: true, Func: showVersionAndExit},
+		parsedOpt:  {Name: parsedOpt, Long: "parsed", IsSwitch: true, Func: showParsedAndExit},
+		quietOpt:   {Name: quietOpt, Short: "q", Long: "quiet", IsSwitch: true, Dflt: "false"},
+	}
+}
+
+// fileUsage is the usage of the options returned by 'fileOpts'.
+var fileUsage = ` --file-mode mode         Octal permissions of the written files, e.g. 0644,
+                          regardless of the umask.
+ --file-owner uid:gid     Numeric owner of the written files, like chown.
+ --fsync                  Flush the written files to storage before exiting.
+`
+
+// fileOpts returns the options that configure the files written by a command.
+func fileOpts() optMap {
+	return optMap{
+		fileModeOpt:  {Name: fileModeOpt, Long: "file-mode"},
+		fileOwnerOpt: {Name: fileOwnerOpt, Long: "file-owner"},
+		fsyncOpt:     {Name: fsyncOpt, Long: "fsync", IsSwitch: true, Dflt: "false"},
+	}
+}
+
+// validateFileMode returns an error if the --file-mode option isn't octal permissions.
+func validateFileMode(opts optMap) error {
+	if mode := opts.getVal(fileModeOpt); mode != "" {
+		if m, err := strconv.ParseUint(mode, 8, 32); err != nil || m > 0777 {
+			return fmt.Errorf("invalid value %q for --file-mode arg", mode)
+		}
+	}
+	return nil
+}
+
+// connectOpts returns the options that configure how a command connects to the
+// upstream registry, and what platform it selects.
+func connectOpts() optMap {
+	return optMap{
+		osOpt:                 {Name: osOpt, Short: "o", Long: "os", Dflt: runtime.GOOS},
+		archOpt:               {Name: archOpt, Short: "a", Long: "arch", Dflt: runtime.GOARCH},
+		osVersionOpt:          {Name: osVersionOpt, Long: "os-version"},
+		osFeaturesOpt:         {Name: osFeaturesOpt, Long: "os-features"},
+		namespaceOpt:          {Name: namespaceOpt, Short: "n", Long: "ns"},
+		basePathOpt:           {Name: basePathOpt, Long: "base-path"},
+		registryOverrideOpt:   {Name: registryOverrideOpt, Long: "registry-override"},
+		proxyOpt:              {Name: proxyOpt, Long: "proxy"},
+		sshJumpOpt:            {Name: sshJumpOpt, Long: "ssh-jump"},
+		usernameOpt:           {Name: usernameOpt, Short: "u", Long: "user"},
+		passwordOpt:           {Name: passwordOpt, Short: "p", Long: "password"},
+		passwordStdinOpt:      {Name: passwordStdinOpt, Long: "password-stdin", IsSwitch: true, Dflt: "false"},
+		tokenOpt:              {Name: tokenOpt, Short: "t", Long: "token"},
+		bearerTokenOpt:        {Name: bearerTokenOpt, Long: "bearer-token"},
+		schemeOpt:             {Name: schemeOpt, Short: "s", Long: "scheme"},
+		certOpt:               {Name: certOpt, Short: "c", Long: "cert"},
+		keyOpt:                {Name: keyOpt, Short: "k", Long: "key"},
+		caOpt:                 {Name: caOpt, Short: "x", Long: "cacert"},
+		insecureOpt:           {Name: insecureOpt, Short: "i", Long: "insecure", IsSwitch: true, Dflt: "false"},
+		insecureRegistriesOpt: {Name: insecureRegistriesOpt, Long: "insecure-registries"},
+		insecureHostsOpt:      {Name: insecureHostsOpt, Long: "insecure-hosts"},
+		unixSocketOpt:         {Name: unixSocketOpt, Long: "unix-socket"},
+		mediaTypeCheckOpt:     {Name: mediaTypeCheckOpt, Long: "media-type-check"},
+		debugOpt:              {Name: debugOpt, Short: "d", Long: "debug", IsSwitch: true, Dflt: "false"},
+		configOpt:             {Name: configOpt, Long: "config"},
+	}
+}
+
+// parseArgs parses and validates the passed command line args (which should not
+// include the program name.) The first arg selects the command. If the first arg
+// is an image ref rather than a command name then the 'pull' command is assumed -
+// or the 'manifest' command if the --manifest option is present - which supports
+// the original non-subcommand form of the CLI. The parsed options are returned in a map along
+// with the selected command. Only validations within the scope of the command
+// line are validated. For example whether or not the URL is valid is not done
+// here - that is determined by the Puller.
+func parseArgs(args []string) (*command, optMap, error) {
+	if len(args) == 0 {
+		return nil, nil, errors.New("command line is missing a command")
+	}
+	cmd, found := commands[args[0]]
+	if found {
+		args = args[1:]
+	} else if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		if len(args) > 1 && commands[args[1]] != nil {
+			showCommandUsageAndExit(commands[args[1]])
+		}
+		showUsageAndExit(nil)
+	} else if !looksLikeImageRef(args[0]) {
+		return nil, nil, fmt.Errorf("unknown command %q", args[0])
+	} else {
+		cmd = commands["pull"]
+		for _, arg := range args {
+			// only the option itself, not an option value that starts with -m
+			if arg == "-m" || arg == "--manifest" || strings.HasPrefix(arg, "-m=") || strings.HasPrefix(arg, "--manifest=") {
+				cmd = commands["manifest"]
+				break
+			}
+		}
+	}
+	opts := cmd.optMap()
+	for i := 0; i < len(args); i++ {
 		parsed := false
 		for _, option := range opts {
-			val, newi := getOptVal(option.Short, option.Long, option.IsSwitch, os.Args, i)
+			val, newi := getOptVal(option.Short, option.Long, option.IsSwitch, args, i)
 			if val != "" {
 				if option.Func != nil {
 					option.Func(opts)
 				}
 				if option.Value != "" {
-					return opts, fmt.Errorf("option was specified more than once: %s", option.Name)
+					return cmd, opts, fmt.Errorf("option was specified more than once: %s", option.Name)
 				}
 				opts.setVal(option.Name, val)
 				i = newi
@@ -142,28 +396,20 @@ func parseArgs() (optMap, error) {
 		}
 		// handle positional params left to right
 		if !parsed {
-			if opts[imageOpt].Value == "" {
-				opts.setVal(imageOpt, os.Args[i])
-			} else if opts[destOpt].Value == "" {
-				opts.setVal(destOpt, os.Args[i])
-			} else {
-				return opts, fmt.Errorf("unable to parse command line option: %s", os.Args[i])
+			if err := opts.setPositional(cmd.positional, args[i]); err != nil {
+				return cmd, opts, err
 			}
 		}
 	}
-	if opts[manifestOpt].Value != "" {
-		opts.setVal(manifestOpt, strings.ToLower(opts[manifestOpt].Value))
-		if opts[manifestOpt].Value != "image" && opts[manifestOpt].Value != "list" {
-			return opts, fmt.Errorf("invalid value %q for --manifest arg", opts[manifestOpt].Value)
+	if cmd.validate != nil {
+		if err := cmd.validate(opts); err != nil {
+			return cmd, opts, err
 		}
 	}
-	// need the image to pull
-	if opts[imageOpt].Value == "" {
-		return opts, errors.New("command line is missing image reference")
-	}
-	// maybe need the tarball to save it to
-	if opts[destOpt].Value == "" && opts[manifestOpt].Value == "" {
-		return opts, errors.New("command line is missing tarball to save to")
+	for _, name := range cmd.positional[:cmd.required] {
+		if opts[name].Value == "" {
+			return cmd, opts, fmt.Errorf("command line is missing %s", positionalDesc[name])
+		}
 	}
 	// apply any defaults if an override was not provided on the cmdline
 	for _, option := range opts {
@@ -171,27 +417,248 @@ func parseArgs() (optMap, error) {
 			opts.setVal(option.Name, option.Dflt)
 		}
 	}
-	return opts, nil
+	return cmd, opts, nil
+}
+
+// looksLikeImageRef returns true if the passed arg could be an image reference
+// rather than a mistyped command or an option, e.g. docker.io/hello-world:latest.
+// Image refs always have a registry so they have at least one slash.
+func looksLikeImageRef(arg string) bool {
+	return !strings.HasPrefix(arg, "-") && strings.Contains(arg, "/")
+}
+
+// positionalDesc describes positional params for error messages.
+var positionalDesc = map[optName]string{
+	imageOpt:     "image reference",
+	destOpt:      "tarball to save to",
+	imageListOpt: "image list file",
+	archiveOpt:   "bundle archive",
+	registryOpt:  "registry",
+	shellOpt:     "shell",
+	destDirOpt:   "directory to save to",
+	srcOpt:       "tarball or layout directory to push",
+}
+
+// setPositional sets the passed value into the first positional param in the passed
+// list that does not yet have a value. If all positional params are already set then
+// an error is returned.
+func (m *optMap) setPositional(positional []optName, value string) error {
+	for _, name := range positional {
+		if (*m)[name].Value == "" {
+			m.setVal(name, value)
+			return nil
+		}
+	}
+	return fmt.Errorf("unable to parse command line option: %s", value)
+}
+
+// optMap builds the option map for the receiver by merging the global options, the
+// connection options (if the command connects to a registry), the command-specific
+// options, and the positional params.
+func (cmd *command) optMap() optMap {
+	opts := globalOpts()
+	opts[helpOpt] = opt{Name: helpOpt, Short: "h", Long: "help", IsSwitch: true, Func: func(optMap) {
+		showCommandUsageAndExit(cmd)
+	}}
+	if cmd.connects {
+		maps.Copy(opts, connectOpts())
+	}
+	if cmd.options != nil {
+		maps.Copy(opts, cmd.options())
+	}
+	for _, name := range cmd.positional {
+		opts[name] = opt{Name: name}
+	}
+	return opts
+}
+
+// regConfig is the config file loaded by 'loadConfig'.
+var regConfig *imgpull.Config
+
+// setupConnect prepares the options of a command that connects to a registry: it reads
+// the password from stdin if --password-stdin was specified, and loads the config file.
+func setupConnect(opts optMap) error {
+	if err := readPasswordStdin(opts, os.Stdin); err != nil {
+		return err
+	}
+	return loadConfig(opts)
+}
+
+// validateMaxImageBytes returns an error if the --max-image-bytes option is not a
+// positive number of bytes.
+func validateMaxImageBytes(opts optMap) error {
+	if m := opts[maxImageBytesOpt].Value; m != "" {
+		if n, err := strconv.ParseInt(m, 10, 64); err != nil || n < 1 {
+			return fmt.Errorf("invalid value %q for --max-image-bytes arg", m)
+		}
+	}
+	return nil
+}
+
+// readPasswordStdin reads the password from the passed reader into the --password option
+// if --password-stdin was specified. Trailing newlines are removed.
+func readPasswordStdin(opts optMap, r io.Reader) error {
+	if stdin, _ := strconv.ParseBool(opts.getVal(passwordStdinOpt)); !stdin {
+		return nil
+	}
+	if opts.getVal(passwordOpt) != "" {
+		return errors.New("--password and --password-stdin cannot both be specified")
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("unable to read the password from stdin: %w", err)
+	}
+	password := strings.TrimRight(string(b), "\r\n")
+	if password == "" {
+		return errors.New("no password was provided on stdin")
+	}
+	opts.setVal(passwordOpt, password)
+	return nil
+}
+
+// loadConfig loads the config file from the --config option, or the default config file
+// if the option was not provided, so that its settings are applied to the puller options.
+func loadConfig(opts optMap) error {
+	cfg, err := imgpull.LoadConfig(opts.getVal(configOpt))
+	if err != nil {
+		return err
+	}
+	regConfig = &cfg
+	return nil
 }
 
 // pullerOptsFrom returns the passed map containing parsed args as a
 // 'PullerOpts' struct.
 func pullerOptsFrom(opts optMap) imgpull.PullerOpts {
 	insecure, _ := strconv.ParseBool(opts.getVal(insecureOpt))
-	return imgpull.PullerOpts{
-		Url:       opts.getVal(imageOpt),
-		Scheme:    opts.getVal(schemeOpt),
-		OStype:    opts.getVal(osOpt),
-		ArchType:  opts.getVal(archOpt),
-		Namespace: opts.getVal(namespaceOpt),
-		Username:  opts.getVal(usernameOpt),
-		Password:  opts.getVal(passwordOpt),
-		Token:     opts.getVal(tokenOpt),
-		TlsCert:   opts.getVal(certOpt),
-		TlsKey:    opts.getVal(keyOpt),
-		CaCert:    opts.getVal(caOpt),
-		Insecure:  insecure,
+	verifyDiffIds, _ := strconv.ParseBool(opts.getVal(verifyDiffIdsOpt))
+	reproducible, _ := strconv.ParseBool(opts.getVal(reproducibleOpt))
+	ociLayout, _ := strconv.ParseBool(opts.getVal(ociLayoutOpt))
+	noRepoTags, _ := strconv.ParseBool(opts.getVal(noRepoTagsOpt))
+	fsync, _ := strconv.ParseBool(opts.getVal(fsyncOpt))
+	fileMode, _ := strconv.ParseUint(opts.getVal(fileModeOpt), 8, 32)
+	maxImageBytes, _ := strconv.ParseInt(opts.getVal(maxImageBytesOpt), 10, 64)
+	requireDigest, _ := strconv.ParseBool(opts.getVal(requireDigestOpt))
+	var allowedRegistries []string
+	if regs := opts.getVal(allowedRegistriesOpt); regs != "" {
+		allowedRegistries = strings.Split(regs, ",")
+	}
+	var repoTags []string
+	if tags := opts.getVal(repoTagsOpt); tags != "" {
+		repoTags = strings.Split(tags, ",")
+	}
+	var decryptionKeys []string
+	if keys := opts.getVal(decryptionKeysOpt); keys != "" {
+		decryptionKeys = strings.Split(keys, ",")
+	}
+	var osFeatures []string
+	if features := opts.getVal(osFeaturesOpt); features != "" {
+		osFeatures = strings.Split(features, ",")
+	}
+	systemCas, _ := strconv.ParseBool(opts.getVal(systemCasOpt))
+	var insecureRegistries []string
+	if regs := opts.getVal(insecureRegistriesOpt); regs != "" {
+		insecureRegistries = strings.Split(regs, ",")
+	}
+	var insecureHosts []string
+	if hosts := opts.getVal(insecureHostsOpt); hosts != "" {
+		insecureHosts = strings.Split(hosts, ",")
+	}
+	url := opts.getVal(imageOpt)
+	if url == "" {
+		url = opts.getVal(registryOpt)
+	}
+	username, password, token := credentialsFrom(opts, url)
+	po := imgpull.PullerOpts{
+		Url:                opts.getVal(imageOpt),
+		Scheme:             opts.getVal(schemeOpt),
+		OStype:             opts.getVal(osOpt),
+		ArchType:           opts.getVal(archOpt),
+		OSVersion:          opts.getVal(osVersionOpt),
+		OSFeatures:         osFeatures,
+		Namespace:          opts.getVal(namespaceOpt),
+		BasePath:           opts.getVal(basePathOpt),
+		RegistryOverride:   opts.getVal(registryOverrideOpt),
+		Proxy:              opts.getVal(proxyOpt),
+		SSHJump:            opts.getVal(sshJumpOpt),
+		Username:           username,
+		Password:           password,
+		Token:              token,
+		BearerToken:        opts.getVal(bearerTokenOpt),
+		TlsCert:            opts.getVal(certOpt),
+		TlsKey:             opts.getVal(keyOpt),
+		CaCert:             opts.getVal(caOpt),
+		CaDir:              opts.getVal(caDirOpt),
+		AppendSystemCAs:    systemCas,
+		Insecure:           insecure,
+		InsecureRegistries: insecureRegistries,
+		InsecureHosts:      insecureHosts,
+		VerifyDiffIDs:      verifyDiffIds,
+		WorkDir:            opts.getVal(workDirOpt),
+		Sidecar:            imgpull.SidecarType(opts.getVal(sidecarOpt)),
+		SigningKey:         opts.getVal(signingKeyOpt),
+		DecryptionKeys:     decryptionKeys,
+		FileMode:           os.FileMode(fileMode),
+		FileOwner:          opts.getVal(fileOwnerOpt),
+		Fsync:              fsync,
+		Reproducible:       reproducible,
+		OCILayout:          ociLayout,
+		RepoTags:           repoTags,
+		NoRepoTags:         noRepoTags,
+		Config:             regConfig,
+		MediaTypeCheck:     imgpull.MediaTypeCheck(opts.getVal(mediaTypeCheckOpt)),
+		MaxImageBytes:      maxImageBytes,
+		AllowedRegistries:  allowedRegistries,
+		RequireDigest:      requireDigest,
 	}
+	if quiet, _ := strconv.ParseBool(opts.getVal(quietOpt)); !quiet && po.MediaTypeCheck == imgpull.MediaTypeCheckWarn {
+		po.OnEvent = func(e imgpull.Event) {
+			if e.Type == imgpull.MediaTypeMismatch {
+				fmt.Fprintf(os.Stderr, "warning: %s\n", e.Err)
+			}
+		}
+	}
+	if debug, _ := strconv.ParseBool(opts.getVal(debugOpt)); debug {
+		po.Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+	if socket := opts.getVal(unixSocketOpt); socket != "" {
+		po.DialContext = imgpull.UnixSocketDialer(socket)
+	}
+	return po
+}
+
+// envPrefix is the prefix of the environment variables that have credentials.
+const envPrefix = "IMGPULL_"
+
+// envNameRe matches the characters in a registry that are replaced with underscores in
+// the names of per-registry environment variables.
+var envNameRe = regexp.MustCompile(`[^A-Z0-9]`)
+
+// credentialsFrom returns the username, password, and token for the image or registry
+// in the passed url. If any are on the command line then those are returned. Otherwise if
+// any of the per-registry environment variables like 'IMGPULL_QUAY_IO_USERNAME' are set
+// then those are returned, else the values of 'IMGPULL_USERNAME', 'IMGPULL_PASSWORD',
+// and 'IMGPULL_TOKEN'. This keeps secrets out of process listings.
+func credentialsFrom(opts optMap, url string) (string, string, string) {
+	username, password, token := opts.getVal(usernameOpt), opts.getVal(passwordOpt), opts.getVal(tokenOpt)
+	if username != "" || password != "" || token != "" || opts.getVal(bearerTokenOpt) != "" {
+		return username, password, token
+	}
+	prefixes := []string{envPrefix}
+	registry, _, _ := strings.Cut(url, "/")
+	if ref, err := imgpull.ParseRef(url); err == nil {
+		registry = ref.Registry
+	}
+	if registry != "" {
+		prefixes = slices.Insert(prefixes, 0, envPrefix+envNameRe.ReplaceAllString(strings.ToUpper(registry), "_")+"_")
+	}
+	for _, prefix := range prefixes {
+		username, password, token = os.Getenv(prefix+"USERNAME"), os.Getenv(prefix+"PASSWORD"), os.Getenv(prefix+"TOKEN")
+		if username != "" || password != "" || token != "" {
+			break
+		}
+	}
+	return username, password, token
 }
 
 // getOptVal gets an option value from a command line param. Several forms are supported:
@@ -265,10 +732,36 @@ func (m *optMap) getVal(name optName) string {
 // showUsageAndExit prints usage instructions and terminates the program
 // with a zero error code (will not return.)
 func showUsageAndExit(opts optMap) {
-	fmt.Println(usageText)
+	printUsage(os.Stdout)
+	os.Exit(0)
+}
+
+// showCommandUsageAndExit prints usage instructions for the passed command and
+// terminates the program with a zero error code (will not return.)
+func showCommandUsageAndExit(cmd *command) {
+	printCommandUsage(os.Stdout, cmd)
 	os.Exit(0)
 }
 
+// printUsage prints usage instructions to the passed writer.
+func printUsage(w io.Writer) {
+	summaries := ""
+	for _, name := range commandOrder {
+		summaries += fmt.Sprintf("  %-10s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintf(w, usageText, summaries)
+}
+
+// printCommandUsage prints usage instructions for the passed command to the
+// passed writer.
+func printCommandUsage(w io.Writer, cmd *command) {
+	fmt.Fprint(w, cmd.usage)
+	if cmd.connects {
+		fmt.Fprint(w, connectUsage)
+	}
+	fmt.Fprint(w, globalUsage)
+}
+
 // showVersionAndExit prints version info and exits with a zero
 // error code.
 func showVersionAndExit(opts optMap) {
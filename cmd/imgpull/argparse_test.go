@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Tests parsing the command line into a command and its options, including the legacy
+// form with no command, which is a pull unless the --manifest option is given.
+func TestParseArgs(t *testing.T) {
+	const ref = "docker.io/hello-world:latest"
+	for i, tc := range []struct {
+		args []string
+		cmd  string
+		vals map[optName]string
+		ok   bool
+	}{
+		{[]string{"pull", ref, "hello.tar"}, "pull", map[optName]string{imageOpt: ref, destOpt: "hello.tar"}, true},
+		{[]string{ref, "hello.tar", "--os", "linux"}, "pull", map[optName]string{destOpt: "hello.tar", osOpt: "linux"}, true},
+		{[]string{ref, "hello.tar", "-p", "-mySecret"}, "pull", map[optName]string{passwordOpt: "-mySecret"}, true},
+		{[]string{ref, "hello.tar", "--password=-mySecret"}, "pull", map[optName]string{passwordOpt: "-mySecret"}, true},
+		{[]string{ref, "-m", "list"}, "manifest", map[optName]string{imageOpt: ref, manifestOpt: "list"}, true},
+		{[]string{ref, "--manifest", "list"}, "manifest", map[optName]string{manifestOpt: "list"}, true},
+		{[]string{ref, "--manifest=LIST"}, "manifest", map[optName]string{manifestOpt: "list"}, true},
+		{[]string{"manifest", ref}, "manifest", map[optName]string{manifestOpt: "image"}, true},
+		{[]string{"push", "hello.tar", "my.registry.io/hello-world:latest"}, "push", map[optName]string{srcOpt: "hello.tar", imageOpt: "my.registry.io/hello-world:latest"}, true},
+		{[]string{"layout", ref, "hello"}, "layout", map[optName]string{destDirOpt: "hello"}, true},
+		{[]string{"pull", ref}, "pull", nil, false},
+		{[]string{"pull", ref, "hello.tar", "extra"}, "pull", nil, false},
+		{[]string{"pull", ref, "hello.tar", "--os", "linux", "--os", "linux"}, "pull", nil, false},
+		{[]string{"pull", ref, "hello.tar", "--frobozz"}, "pull", nil, false},
+		{[]string{"manifest", ref, "-m", "frobozz"}, "manifest", nil, false},
+		{[]string{"pul", ref, "hello.tar"}, "", nil, false},
+		{[]string{"hello.tar"}, "", nil, false},
+		{[]string{}, "", nil, false},
+	} {
+		cmd, opts, err := parseArgs(tc.args)
+		if (err == nil) != tc.ok {
+			t.Errorf("%d: unexpected error state for %v: %v", i, tc.args, err)
+			continue
+		}
+		if name := cmdName(cmd); name != tc.cmd {
+			t.Errorf("%d: expected command %q, got %q", i, tc.cmd, name)
+		}
+		for name, val := range tc.vals {
+			if got := opts.getVal(name); got != val {
+				t.Errorf("%d: expected %s=%q, got %q", i, name, val, got)
+			}
+		}
+	}
+}
+
+// cmdName returns the name of the passed command, or the empty string if it is nil.
+func cmdName(cmd *command) string {
+	if cmd == nil {
+		return ""
+	}
+	return cmd.name
+}
+
+// Tests reading the password from stdin, and that it can't be combined with --password.
+func TestReadPasswordStdin(t *testing.T) {
+	for i, tc := range []struct {
+		args  []string
+		stdin string
+		pw    string
+		ok    bool
+	}{
+		{[]string{"--password-stdin"}, "frobozz\n", "frobozz", true},
+		{[]string{"--password-stdin"}, "frobozz\r\n", "frobozz", true},
+		{[]string{"--password", "xyzzy"}, "frobozz\n", "xyzzy", true},
+		{[]string{"--password-stdin"}, "\n", "", false},
+		{[]string{"--password-stdin", "--password", "xyzzy"}, "frobozz\n", "", false},
+	} {
+		_, opts, err := parseArgs(append([]string{"pull", "docker.io/hello-world:latest", "hello.tar"}, tc.args...))
+		if err != nil {
+			t.Fatalf("%d: unexpected error %v", i, err)
+		}
+		err = readPasswordStdin(opts, strings.NewReader(tc.stdin))
+		if (err == nil) != tc.ok {
+			t.Errorf("%d: unexpected error state: %v", i, err)
+		} else if tc.ok && opts.getVal(passwordOpt) != tc.pw {
+			t.Errorf("%d: expected password %q, got %q", i, tc.pw, opts.getVal(passwordOpt))
+		}
+	}
+}
+
+// Tests that credentials on the command line win over the environment, and that the
+// per-registry environment variables win over the IMGPULL_* variables.
+func TestCredentialsFrom(t *testing.T) {
+	t.Setenv("IMGPULL_USERNAME", "user")
+	t.Setenv("IMGPULL_PASSWORD", "pass")
+	t.Setenv("IMGPULL_QUAY_IO_USERNAME", "quayuser")
+	t.Setenv("IMGPULL_QUAY_IO_PASSWORD", "quaypass")
+	t.Setenv("IMGPULL_MY_REGISTRY_IO_5000_TOKEN", "token")
+	for i, tc := range []struct {
+		args     []string
+		url      string
+		username string
+		password string
+		token    string
+	}{
+		{nil, "docker.io/hello-world:latest", "user", "pass", ""},
+		{nil, "quay.io/foo/bar:latest", "quayuser", "quaypass", ""},
+		{nil, "my.registry.io:5000/hello-world:latest", "", "", "token"},
+		{[]string{"-u", "cmduser", "-p", "cmdpass"}, "quay.io/foo/bar:latest", "cmduser", "cmdpass", ""},
+		{[]string{"--bearer-token", "bearer"}, "quay.io/foo/bar:latest", "", "", ""},
+	} {
+		_, opts, err := parseArgs(append([]string{"pull", tc.url, "hello.tar"}, tc.args...))
+		if err != nil {
+			t.Fatalf("%d: unexpected error %v", i, err)
+		}
+		username, password, token := credentialsFrom(opts, tc.url)
+		if username != tc.username || password != tc.password || token != tc.token {
+			t.Errorf("%d: unexpected credentials %q %q %q", i, username, password, token)
+		}
+	}
+}
@@ -0,0 +1,1267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aceeric/imgpull/pkg/imgpull"
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+)
+
+// command defines a CLI subcommand. The 'positional' array lists the positional
+// params supported by the command in the order they are parsed, and 'required' is
+// how many of those (from left to right) must be provided. If 'connects' is true
+// then the command talks to an upstream registry and so supports all of the
+// connection options.
+type command struct {
+	name       string
+	summary    string
+	usage      string
+	positional []optName
+	required   int
+	connects   bool
+	options    func() optMap
+	validate   func(optMap) error
+	run        func(optMap) error
+}
+
+// commandOrder is the order in which commands are listed in the help.
+var commandOrder = []string{"pull", "manifest", "digest", "tags", "inspect", "history", "size", "diff", "copy", "push", "extract", "layout", "bundle", "unbundle", "daemon", "login", "logout", "completion"}
+
+// commands has all the supported subcommands keyed by name.
+var commands = map[string]*command{
+	"pull": {
+		name:    "pull",
+		summary: "Pull an image to a tarball",
+		// positional params are checked by 'validate' since they depend on --from-file
+		positional: []optName{imageOpt, destOpt},
+		connects:   true,
+		run:        runPull,
+		usage: `
+Usage:
+
+imgpull pull <image ref> <tar file> [options]
+imgpull pull --from-file <image list file> <directory> [options]
+imgpull pull --dry-run <image ref> [options]
+imgpull pull --dry-run --from-file <image list file> [options]
+
+Pulls the image for the selected OS and architecture to a tarball that
+can be loaded with 'docker load'. In the second form, pulls every image
+listed in the image list file to a tarball in the passed directory. The
+file has one image ref per line, optionally followed by an os/arch
+platform that overrides the --os and --arch options for that image. Blank
+lines and lines beginning with '#' are ignored. E.g.:
+
+  # images for the air-gapped cluster
+  docker.io/hello-world:latest
+  quay.io/curl/curl:8.10.1 linux/arm64
+
+With --dry-run, the blobs that would be pulled and their total size are
+shown but nothing is downloaded. No tar file or directory is needed.
+
+Pull options:
+
+ --from-file file         Pull all the images listed in the file.
+ --concurrency count      How many images to pull in parallel with --from-file.
+                          Defaults to 3.
+ --verify-diff-ids        Decompress each layer and verify it against the diff_ids
+                          in the image config.
+ --max-image-bytes count  Fail without downloading an image whose layers and config
+                          total more than count bytes.
+ --allowed-registries regs
+                          Comma-separated registries that images can be pulled
+                          from. Images from other registries are rejected.
+ --require-digest         Reject images referenced by tag rather than by digest.
+ --work-dir dir           Directory for temp files while pulling. Defaults to the
+                          system temp directory.
+ --reproducible           Write a byte-identical tarball for the same image digest.
+ --oci-layout             Write the tarball with the OCI image layout used by newer
+                          versions of docker save, preserving the manifest digest.
+ --repo-tags tags         Comma-separated tags for the image in the tarball, rather
+                          than the image reference that was pulled.
+ --no-repo-tags           Write the tarball with no tags.
+ --sidecar type           Write a sidecar file next to each tarball to verify it:
+                          'sha256' for <tar file>.sha256 in sha256sum format, or
+                          'json' for <tar file>.json with the tarball, image, and
+                          layer digests.
+ --signing-key file       PEM RSA or ECDSA private key to sign each tarball with.
+                          The detached signature is written to <tar file>.sig.
+ --decryption-keys files  Comma-separated PEM RSA or ECDSA private keys to decrypt
+                          layers encrypted with OCIcrypt (+encrypted media types).
+ --dry-run                Show the blobs that would be pulled and their total size
+                          without pulling them.
+` + fileUsage,
+		options: func() optMap {
+			opts := fileOpts()
+			maps.Copy(opts, optMap{
+				fromFileOpt:          {Name: fromFileOpt, Long: "from-file"},
+				concurrencyOpt:       {Name: concurrencyOpt, Long: "concurrency", Dflt: "3"},
+				verifyDiffIdsOpt:     {Name: verifyDiffIdsOpt, Long: "verify-diff-ids", IsSwitch: true, Dflt: "false"},
+				maxImageBytesOpt:     {Name: maxImageBytesOpt, Long: "max-image-bytes"},
+				allowedRegistriesOpt: {Name: allowedRegistriesOpt, Long: "allowed-registries"},
+				requireDigestOpt:     {Name: requireDigestOpt, Long: "require-digest", IsSwitch: true, Dflt: "false"},
+				workDirOpt:           {Name: workDirOpt, Long: "work-dir"},
+				reproducibleOpt:      {Name: reproducibleOpt, Long: "reproducible", IsSwitch: true, Dflt: "false"},
+				ociLayoutOpt:         {Name: ociLayoutOpt, Long: "oci-layout", IsSwitch: true, Dflt: "false"},
+				repoTagsOpt:          {Name: repoTagsOpt, Long: "repo-tags"},
+				noRepoTagsOpt:        {Name: noRepoTagsOpt, Long: "no-repo-tags", IsSwitch: true, Dflt: "false"},
+				sidecarOpt:           {Name: sidecarOpt, Long: "sidecar"},
+				signingKeyOpt:        {Name: signingKeyOpt, Long: "signing-key"},
+				decryptionKeysOpt:    {Name: decryptionKeysOpt, Long: "decryption-keys"},
+				dryRunOpt:            {Name: dryRunOpt, Long: "dry-run", IsSwitch: true, Dflt: "false"},
+			})
+			return opts
+		},
+		validate: func(opts optMap) error {
+			if err := validateFileMode(opts); err != nil {
+				return err
+			}
+			if err := validateMaxImageBytes(opts); err != nil {
+				return err
+			}
+			if s := opts[sidecarOpt].Value; s != "" && s != string(imgpull.Sha256Sidecar) && s != string(imgpull.JSONSidecar) {
+				return fmt.Errorf("invalid value %q for --sidecar arg", s)
+			}
+			dryRun, _ := strconv.ParseBool(opts[dryRunOpt].Value)
+			if opts[fromFileOpt].Value == "" {
+				if opts[imageOpt].Value == "" {
+					return errors.New("command line is missing image reference")
+				} else if opts[destOpt].Value == "" && !dryRun {
+					return errors.New("command line is missing tarball to save to")
+				}
+				return nil
+			}
+			// with --from-file there is only one positional param: the directory
+			if opts[destOpt].Value != "" {
+				return fmt.Errorf("unable to parse command line option: %s", opts[destOpt].Value)
+			}
+			if opts[imageOpt].Value == "" && !dryRun {
+				return errors.New("command line is missing directory to save to")
+			}
+			opts.setVal(destOpt, opts[imageOpt].Value)
+			opts.setVal(imageOpt, "")
+			if c := opts[concurrencyOpt].Value; c != "" {
+				if n, err := strconv.Atoi(c); err != nil || n < 1 {
+					return fmt.Errorf("invalid value %q for --concurrency arg", c)
+				}
+			}
+			return nil
+		},
+	},
+	"manifest": {
+		name:       "manifest",
+		summary:    "Show an image manifest or image list manifest",
+		positional: []optName{imageOpt},
+		required:   1,
+		connects:   true,
+		run:        runManifest,
+		usage: `
+Usage:
+
+imgpull manifest <image ref> [-m|--manifest type] [options]
+
+Shows a manifest on the console. The type is 'list' for the image list
+manifest, or 'image' (the default) for the image manifest matching the
+selected OS and architecture.
+
+Manifest options:
+
+ -m|--manifest type       'list' or 'image'. Defaults to 'image'.
+` + formatUsage,
+		options: func() optMap {
+			return optMap{
+				manifestOpt: {Name: manifestOpt, Short: "m", Long: "manifest", Dflt: "image"},
+				formatOpt:   {Name: formatOpt, Short: "f", Long: "format"},
+			}
+		},
+		validate: func(opts optMap) error {
+			if opts[manifestOpt].Value != "" {
+				opts.setVal(manifestOpt, strings.ToLower(opts[manifestOpt].Value))
+				if opts[manifestOpt].Value != "image" && opts[manifestOpt].Value != "list" {
+					return fmt.Errorf("invalid value %q for --manifest arg", opts[manifestOpt].Value)
+				}
+			}
+			return nil
+		},
+	},
+	"digest": {
+		name:       "digest",
+		summary:    "Show the manifest digest that an image ref resolves to",
+		positional: []optName{imageOpt},
+		required:   1,
+		connects:   true,
+		run:        runDigest,
+		usage: `
+Usage:
+
+imgpull digest <image ref> [--platform-digest] [options]
+
+Shows only the digest of the manifest that the image ref resolves to, like
+'crane digest'. For a multi-platform image this is the digest of the image
+list manifest. The digest is obtained with a HEAD request so no manifest is
+downloaded.
+
+Digest options:
+
+ --platform-digest        Show the digest of the image manifest matching the
+                          selected OS and architecture instead.
+`,
+		options: func() optMap {
+			return optMap{
+				platformDigestOpt: {Name: platformDigestOpt, Long: "platform-digest", IsSwitch: true, Dflt: "false"},
+			}
+		},
+	},
+	"tags": {
+		name:       "tags",
+		summary:    "List the tags in a repository",
+		positional: []optName{imageOpt},
+		required:   1,
+		connects:   true,
+		run:        runTags,
+		usage: `
+Usage:
+
+imgpull tags <repository> [--filter regex] [--limit count] [options]
+
+Lists the tags in the repository, one per line, following the registry's
+pagination. A tag or digest in the repository ref is ignored. E.g.:
+
+  imgpull tags docker.io/hello-world --filter '^nanoserver'
+
+Tags options:
+
+ --filter regex           Only list the tags that match the regular expression,
+                          which is not anchored.
+ --limit count            List at most this many tags.
+` + formatUsage,
+		options: func() optMap {
+			return optMap{
+				filterOpt: {Name: filterOpt, Long: "filter"},
+				limitOpt:  {Name: limitOpt, Long: "limit"},
+				formatOpt: {Name: formatOpt, Short: "f", Long: "format"},
+			}
+		},
+		validate: func(opts optMap) error {
+			if l := opts[limitOpt].Value; l != "" {
+				if n, err := strconv.Atoi(l); err != nil || n < 1 {
+					return fmt.Errorf("invalid value %q for --limit arg", l)
+				}
+			}
+			return nil
+		},
+	},
+	"inspect": {
+		name:       "inspect",
+		summary:    "Show a summary of an image: digests, annotations, platforms, and layers",
+		positional: []optName{imageOpt},
+		required:   1,
+		connects:   true,
+		run:        runInspect,
+		usage: `
+Usage:
+
+imgpull inspect <image ref> [--history] [options]
+
+Shows the manifest digest, media type, and annotations of the image ref. If
+the ref is a multi-platform image then the platforms are listed. The image
+annotations, config, and layers of the image matching the selected OS and
+architecture are then listed.
+
+Inspect options:
+
+ --history                Also download the image config and show the history
+                          of the image, like the 'history' command.
+` + formatUsage,
+		options: func() optMap {
+			return optMap{
+				historyOpt: {Name: historyOpt, Long: "history", IsSwitch: true, Dflt: "false"},
+				formatOpt:  {Name: formatOpt, Short: "f", Long: "format"},
+			}
+		},
+	},
+	"history": {
+		name:       "history",
+		summary:    "Show the history of an image from its config",
+		positional: []optName{imageOpt},
+		required:   1,
+		connects:   true,
+		run:        runHistory,
+		usage: `
+Usage:
+
+imgpull history <image ref> [options]
+
+Shows the history of the image matching the selected OS and architecture
+from the history in its image config, oldest step first: when each step
+was run, the size of the layer it created, and the Dockerfile-like
+instruction reconstructed from the command that the step ran, like
+'docker history'. Only the manifests and the image config are downloaded.
+
+History options:
+
+` + formatUsage,
+		options: func() optMap {
+			return optMap{
+				formatOpt: {Name: formatOpt, Short: "f", Long: "format"},
+			}
+		},
+	},
+	"size": {
+		name:       "size",
+		summary:    "Show the size of each layer of an image and the total download size",
+		positional: []optName{imageOpt},
+		required:   1,
+		connects:   true,
+		run:        runSize,
+		usage: `
+Usage:
+
+imgpull size <image ref> [--uncompressed] [options]
+
+Shows the compressed size of each layer of the image matching the selected
+OS and architecture, the total layer size, and the total download size,
+which counts the config and counts a layer only once if the image has it
+more than once. Nothing is downloaded except the manifests unless the
+--uncompressed option is used.
+
+Size options:
+
+ --uncompressed           Download and decompress the layers to also show the
+                          uncompressed size of each layer and the total.
+ --work-dir dir           Directory for temp files with --uncompressed. Defaults to
+                          the system temp directory.
+` + formatUsage,
+		options: func() optMap {
+			return optMap{
+				uncompressedOpt: {Name: uncompressedOpt, Long: "uncompressed", IsSwitch: true, Dflt: "false"},
+				workDirOpt:      {Name: workDirOpt, Long: "work-dir"},
+				formatOpt:       {Name: formatOpt, Short: "f", Long: "format"},
+			}
+		},
+	},
+	"diff": {
+		name:       "diff",
+		summary:    "Compare the layers and config of two images",
+		positional: []optName{imageOpt, toImageOpt},
+		required:   2,
+		connects:   true,
+		run:        runDiff,
+		usage: `
+Usage:
+
+imgpull diff <image ref> <image ref> [options]
+
+Compares the images matching the selected OS and architecture and shows
+the layers that were added, removed, or changed from the first image to
+the second, and the differences in their environment variables, labels,
+entrypoint, and command. Layers are compared by position from the bottom
+layer. Only the manifests and the image configs are downloaded. The images
+can be in different registries.
+
+Diff options:
+
+` + formatUsage,
+		options: func() optMap {
+			return optMap{
+				formatOpt: {Name: formatOpt, Short: "f", Long: "format"},
+			}
+		},
+	},
+	"copy": {
+		name:       "copy",
+		summary:    "Copy an image from one registry to another",
+		positional: []optName{imageOpt, toImageOpt},
+		required:   2,
+		connects:   true,
+		run:        runCopy,
+		usage: `
+Usage:
+
+imgpull copy <source image ref> <dest image ref> [--all-platforms | --platform list] [options]
+
+Copies an image from one registry to another without creating a tarball,
+like 'skopeo copy'. Blobs that already exist in the destination repository
+are not pushed. A 'docker://' prefix on either image ref is ignored so that
+simple skopeo commands can be reused. E.g.:
+
+  imgpull copy docker://quay.io/curl/curl:8.10.1 docker://my.registry.io:5000/curl/curl:8.10.1
+
+If the source is a multi-platform image then by default only the image
+matching the selected OS and architecture is copied. The connection options
+apply to both registries.
+
+Copy options:
+
+ --platform list          A comma-separated list of os/arch platforms to copy
+                          instead of the selected OS and architecture. If more
+                          than one, a new image list manifest is pushed.
+ --all-platforms          Copy the image list manifest unchanged along with
+                          every platform, so the digest is preserved.
+`,
+		options: func() optMap {
+			return optMap{
+				platformOpt:     {Name: platformOpt, Long: "platform"},
+				allPlatformsOpt: {Name: allPlatformsOpt, Long: "all-platforms", IsSwitch: true, Dflt: "false"},
+			}
+		},
+		validate: func(opts optMap) error {
+			all, _ := strconv.ParseBool(opts[allPlatformsOpt].Value)
+			if all && opts[platformOpt].Value != "" {
+				return errors.New("--platform and --all-platforms are mutually exclusive")
+			}
+			if p := opts[platformOpt].Value; p != "" {
+				for platform := range strings.SplitSeq(p, ",") {
+					if os, arch, found := strings.Cut(platform, "/"); !found || os == "" || arch == "" {
+						return fmt.Errorf("invalid value %q for --platform arg", platform)
+					}
+				}
+			}
+			for _, name := range []optName{imageOpt, toImageOpt} {
+				opts.setVal(name, strings.TrimPrefix(opts[name].Value, "docker://"))
+			}
+			return nil
+		},
+	},
+	"push": {
+		name:       "push",
+		summary:    "Push an image tarball or OCI image layout to a registry",
+		positional: []optName{srcOpt, imageOpt},
+		required:   2,
+		connects:   true,
+		run:        runPush,
+		usage: `
+Usage:
+
+imgpull push <tar file or layout directory> <image ref> [options]
+
+Pushes the image in a tarball created by the 'pull' command, or in an OCI
+image layout directory created by the 'layout' command, to the image ref.
+Blobs that already exist in the destination repository are not pushed. If
+the tarball was pulled with --oci-layout, or the source is a layout
+directory, then the image manifest is pushed unchanged so the digest is
+preserved. Otherwise a new OCI image manifest is created from the tarball
+and the digest changes.
+
+Push options:
+
+ --work-dir dir           Directory to extract the tarball to while pushing.
+                          Defaults to the system temp directory.
+`,
+		options: func() optMap {
+			return optMap{
+				workDirOpt: {Name: workDirOpt, Long: "work-dir"},
+			}
+		},
+	},
+	"extract": {
+		name:       "extract",
+		summary:    "Extract the flattened filesystem of an image into a directory",
+		positional: []optName{imageOpt, destOpt},
+		required:   2,
+		connects:   true,
+		run:        runExtract,
+		usage: `
+Usage:
+
+imgpull extract <image ref> <directory> [--layer layer] [options]
+
+Pulls the image matching the selected OS and architecture and applies its
+layers in order, honoring whiteouts, to produce the flattened root filesystem
+of the image in the directory. Each layer is verified against the diff_ids in
+the image config.
+
+Extract options:
+
+ --layer layer            Only pull and extract one layer, selected by its digest
+                          or its position counting from 1 for the bottom layer.
+ --work-dir dir           Directory for temp files while pulling. Defaults to the
+                          system temp directory.
+`,
+		options: func() optMap {
+			return optMap{
+				layerOpt:   {Name: layerOpt, Long: "layer"},
+				workDirOpt: {Name: workDirOpt, Long: "work-dir"},
+			}
+		},
+	},
+	"layout": {
+		name:       "layout",
+		summary:    "Pull an image to an OCI image layout directory",
+		positional: []optName{imageOpt, destDirOpt},
+		required:   2,
+		connects:   true,
+		run:        runLayout,
+		usage: `
+Usage:
+
+imgpull layout <image ref> <directory> [options]
+
+Pulls the image matching the selected OS and architecture to an OCI image
+layout in the directory: the blobs in blobs/sha256, an index.json that
+references the image manifest, and an oci-layout file. The image manifest
+is unchanged, so the directory can be pushed with the 'push' command without
+changing the digest of the image. Unlike a tarball, a layout can't have a
+sidecar file or a signature.
+
+Layout options:
+
+ --work-dir dir           Directory for temp files while pulling. Defaults to the
+                          system temp directory.
+`,
+		options: func() optMap {
+			return optMap{
+				workDirOpt: {Name: workDirOpt, Long: "work-dir"},
+			}
+		},
+	},
+	"bundle": {
+		name:       "bundle",
+		summary:    "Pull a list of images into a single bundle archive",
+		positional: []optName{imageListOpt, archiveOpt},
+		required:   2,
+		connects:   true,
+		run:        runBundle,
+		usage: `
+Usage:
+
+imgpull bundle <image list file> <archive> [options]
+
+Pulls every image listed in the image list file into a single tar archive
+with an index (bundle.json) listing the images, their digests, and their
+platforms. Blobs shared by more than one image are only stored once. The
+image list file has the same format as for 'pull --from-file'. Listing the
+same image more than once with different platforms bundles each platform.
+
+Bundle options:
+
+` + fileUsage,
+		options:  fileOpts,
+		validate: validateFileMode,
+	},
+	"unbundle": {
+		name:       "unbundle",
+		summary:    "Push all the images in a bundle archive to a registry",
+		positional: []optName{archiveOpt, registryOpt},
+		required:   2,
+		connects:   true,
+		run:        runUnbundle,
+		usage: `
+Usage:
+
+imgpull unbundle <archive> <registry> [options]
+
+Pushes every image in a bundle archive created by the 'bundle' command to
+the registry, e.g. my.registry.io:5000. Each image is pushed to the same
+repository and tag that it was pulled from, but on the passed registry. The
+--os and --arch options are ignored.
+`,
+	},
+	"daemon": {
+		name:       "daemon",
+		summary:    "Serve pulls to other processes over a local REST API",
+		positional: []optName{destDirOpt},
+		required:   1,
+		connects:   true,
+		run:        runDaemon,
+		usage: `
+Usage:
+
+imgpull daemon <directory> [--listen addr] [--concurrency count] [options]
+
+Runs until interrupted, pulling images to tarballs in the directory when
+other processes on the host request them over a small REST API. All the
+pulls share one blob cache, one token cache, one manifest cache, and one
+session per registry. The connection options apply to every pull. The API
+is:
+
+  POST /v1/pulls       Pull an image. The body is JSON like:
+                       {"url": "docker.io/hello-world:latest",
+                        "os": "linux", "arch": "amd64", "tarFile": "hello.tar"}
+                       where os, arch, and tarFile are optional. Returns the
+                       pull, with its id, while it runs in the background.
+  GET  /v1/pulls       List the pulls.
+  GET  /v1/pulls/{id}  Show a pull. With ?wait=true, waits for it to finish.
+  GET  /v1/stats       Show the pull counts and the shared cache usage.
+
+E.g.:
+
+  curl -d '{"url": "docker.io/hello-world:latest"}' localhost:8080/v1/pulls
+  curl localhost:8080/v1/pulls/1?wait=true
+
+Daemon options:
+
+ --listen addr            Address to serve the API on, as host:port, or
+                          unix:path for a unix socket. Defaults to
+                          127.0.0.1:8080.
+ --concurrency count      How many images to pull in parallel. Defaults to 3.
+ --max-image-bytes count  Fail the pull of an image whose layers and config total
+                          more than count bytes, without downloading it.
+ --allowed-registries regs
+                          Comma-separated registries that images can be pulled
+                          from. Pulls from other registries are rejected.
+ --require-digest         Reject pulls of images referenced by tag rather than by
+                          digest.
+`,
+		options: func() optMap {
+			return optMap{
+				listenOpt:            {Name: listenOpt, Long: "listen", Dflt: "127.0.0.1:8080"},
+				concurrencyOpt:       {Name: concurrencyOpt, Long: "concurrency", Dflt: "3"},
+				maxImageBytesOpt:     {Name: maxImageBytesOpt, Long: "max-image-bytes"},
+				allowedRegistriesOpt: {Name: allowedRegistriesOpt, Long: "allowed-registries"},
+				requireDigestOpt:     {Name: requireDigestOpt, Long: "require-digest", IsSwitch: true, Dflt: "false"},
+			}
+		},
+		validate: func(opts optMap) error {
+			if err := validateMaxImageBytes(opts); err != nil {
+				return err
+			}
+			if c := opts[concurrencyOpt].Value; c != "" {
+				if n, err := strconv.Atoi(c); err != nil || n < 1 {
+					return fmt.Errorf("invalid value %q for --concurrency arg", c)
+				}
+			}
+			return nil
+		},
+	},
+	"login": {
+		name:       "login",
+		summary:    "Store credentials for a registry in the config file",
+		positional: []optName{registryOpt},
+		required:   1,
+		run:        runLogin,
+		usage: `
+Usage:
+
+imgpull login <registry> -u|--user username [-p|--password password | --password-stdin] [--config file]
+
+Stores the username and password for the registry, e.g. my.registry.io:5000,
+in the config file so that later commands for images in the registry use
+them without having to pass credentials. The password is written to a file
+that only the current user can read in the 'credentials' directory next to
+the config file, and the config file references it. If the registry has a
+credential helper in the config file, e.g.:
+
+  registries:
+    ghcr.io:
+      credentials:
+        helper: pass
+
+then the credentials are stored with the helper (docker-credential-pass)
+instead. The credentials are not verified with the registry.
+
+Login options:
+
+ -u|--user username       Username.
+ -p|--password password   Password.
+ --password-stdin         Read the password from stdin.
+ --config file            Config file. Defaults to ~/.imgpull/config.yaml.
+`,
+		options: func() optMap {
+			return optMap{
+				usernameOpt:      {Name: usernameOpt, Short: "u", Long: "user"},
+				passwordOpt:      {Name: passwordOpt, Short: "p", Long: "password"},
+				passwordStdinOpt: {Name: passwordStdinOpt, Long: "password-stdin", IsSwitch: true, Dflt: "false"},
+				configOpt:        {Name: configOpt, Long: "config"},
+			}
+		},
+		validate: func(opts optMap) error {
+			if opts[usernameOpt].Value == "" {
+				return errors.New("command line is missing the --user option")
+			}
+			return nil
+		},
+	},
+	"logout": {
+		name:       "logout",
+		summary:    "Remove the credentials for a registry from the config file",
+		positional: []optName{registryOpt},
+		required:   1,
+		run:        runLogout,
+		usage: `
+Usage:
+
+imgpull logout <registry> [--config file]
+
+Removes the credentials for the registry that were stored by the 'login'
+command, or erases them from the credential helper of the registry.
+
+Logout options:
+
+ --config file            Config file. Defaults to ~/.imgpull/config.yaml.
+`,
+		options: func() optMap {
+			return optMap{
+				configOpt: {Name: configOpt, Long: "config"},
+			}
+		},
+	},
+}
+
+// runPull implements the 'pull' command.
+func runPull(opts optMap) error {
+	dryRun, _ := strconv.ParseBool(opts.getVal(dryRunOpt))
+	if opts.getVal(fromFileOpt) != "" {
+		if dryRun {
+			return planFromFile(opts)
+		}
+		return pullFromFile(opts)
+	}
+	po := pullerOptsFrom(opts)
+	if dryRun {
+		plan, err := planOne(po)
+		if err != nil {
+			return err
+		}
+		printPlan(plan)
+		return nil
+	}
+	tarFile := opts.getVal(destOpt)
+	start := time.Now()
+	stats, err := pullOne(po, tarFile)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, savedMessage(po.Url, tarFile, time.Since(start), stats))
+	return nil
+}
+
+// printPlan prints the passed pull plan.
+func printPlan(plan imgpull.PullPlan) {
+	fmt.Fprintf(stdout, "IMAGE URL: %s\nPLATFORM: %s\nMANIFEST DIGEST: %s\nBLOBS:\n", plan.ImageUrl, plan.Platform, plan.Digest)
+	for _, blob := range plan.Blobs {
+		fmt.Fprintf(stdout, "  %s %10d %s\n", blob.Digest, blob.Size, blob.MediaType)
+	}
+	fmt.Fprintf(stdout, "TOTAL BLOB SIZE: %d\n", plan.TotalBytes)
+}
+
+// manifestOutput is the output of the 'manifest' command when rendered with
+// the --format option.
+type manifestOutput struct {
+	ImageUrl  string `json:"imageUrl"`
+	Digest    string `json:"digest"`
+	MediaType string `json:"mediaType"`
+	Manifest  any    `json:"manifest"`
+}
+
+// runManifest implements the 'manifest' command.
+func runManifest(opts optMap) error {
+	puller, err := imgpull.NewPullerWith(pullerOptsFrom(opts))
+	if err != nil {
+		return err
+	}
+	mt := imgpull.ManifestPullTypeFrom[opts.getVal(manifestOpt)]
+	mh, err := puller.GetManifestByType(mt)
+	if err != nil {
+		return err
+	}
+	manifest, err := mh.ToString()
+	if err != nil {
+		return err
+	}
+	out := manifestOutput{
+		ImageUrl:  mh.ImageUrl,
+		Digest:    mh.Digest,
+		MediaType: mh.MediaType(),
+	}
+	if err := json.Unmarshal([]byte(manifest), &out.Manifest); err != nil {
+		return err
+	}
+	return render(out, opts.getVal(formatOpt), func() {
+		fmt.Fprintf(stdout, "MANIFEST:\n%s\nMANIFEST DIGEST: %s\nIMAGE URL: %s\n", manifest, mh.Digest, mh.ImageUrl)
+	})
+}
+
+// runDigest implements the 'digest' command.
+func runDigest(opts optMap) error {
+	puller, err := imgpull.NewPullerWith(pullerOptsFrom(opts))
+	if err != nil {
+		return err
+	}
+	if platform, _ := strconv.ParseBool(opts.getVal(platformDigestOpt)); platform {
+		mh, err := puller.GetManifestByType(imgpull.Image)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, "sha256:"+mh.Digest)
+		return nil
+	}
+	md, err := puller.HeadManifest()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, md.Digest)
+	return nil
+}
+
+// runTags implements the 'tags' command.
+func runTags(opts optMap) error {
+	puller, err := imgpull.NewPullerWith(pullerOptsFrom(opts))
+	if err != nil {
+		return err
+	}
+	tags, err := puller.ListTags()
+	if err != nil {
+		return err
+	}
+	if filter := opts.getVal(filterOpt); filter != "" {
+		if tags, err = imgpull.FilterTags(tags, filter); err != nil {
+			return err
+		}
+	}
+	if limit, err := strconv.Atoi(opts.getVal(limitOpt)); err == nil && limit < len(tags) {
+		tags = tags[:limit]
+	}
+	return render(tags, opts.getVal(formatOpt), func() {
+		for _, tag := range tags {
+			fmt.Fprintln(stdout, tag)
+		}
+	})
+}
+
+// platformOutput describes one platform in an image list manifest.
+type platformOutput struct {
+	Platform string `json:"platform"`
+	Digest   string `json:"digest"`
+}
+
+// inspectOutput is the output of the 'inspect' command.
+type inspectOutput struct {
+	ImageUrl         string                 `json:"imageUrl"`
+	Digest           string                 `json:"digest"`
+	MediaType        string                 `json:"mediaType"`
+	Annotations      map[string]string      `json:"annotations,omitempty"`
+	Platforms        []platformOutput       `json:"platforms,omitempty"`
+	ImageDigest      string                 `json:"imageDigest"`
+	ImageAnnotations map[string]string      `json:"imageAnnotations,omitempty"`
+	Config           types.Layer            `json:"config"`
+	Layers           []types.Layer          `json:"layers"`
+	TotalSize        int                    `json:"totalSize"`
+	History          []imgpull.HistoryEntry `json:"history,omitempty"`
+}
+
+// printAnnotations prints the passed heading and annotations sorted by key, if
+// there are any annotations.
+func printAnnotations(heading string, annotations map[string]string) {
+	if len(annotations) == 0 {
+		return
+	}
+	fmt.Fprintln(stdout, heading)
+	for _, key := range slices.Sorted(maps.Keys(annotations)) {
+		fmt.Fprintf(stdout, "  %s=%s\n", key, annotations[key])
+	}
+}
+
+// runInspect implements the 'inspect' command.
+func runInspect(opts optMap) error {
+	puller, err := imgpull.NewPullerWith(pullerOptsFrom(opts))
+	if err != nil {
+		return err
+	}
+	mh, err := puller.GetManifest()
+	if err != nil {
+		return err
+	}
+	out := inspectOutput{
+		ImageUrl:    mh.ImageUrl,
+		Digest:      mh.Digest,
+		MediaType:   mh.MediaType(),
+		Annotations: mh.Annotations(),
+	}
+	if mh.IsManifestList() {
+		switch mh.Type {
+		case imgpull.V2dockerManifestList:
+			for _, m := range mh.V2dockerManifestList.Manifests {
+				if m.Platform != nil {
+					out.Platforms = append(out.Platforms, platformOutput{m.Platform.OS + "/" + m.Platform.Architecture, m.Digest})
+				}
+			}
+		case imgpull.V1ociIndex:
+			for _, m := range mh.V1ociIndex.Manifests {
+				if m.Platform != nil {
+					out.Platforms = append(out.Platforms, platformOutput{m.Platform.Os + "/" + m.Platform.Architecture, m.Digest})
+				}
+			}
+		}
+		if mh, err = puller.GetManifestByType(imgpull.Image); err != nil {
+			return err
+		}
+	}
+	out.ImageDigest = mh.Digest
+	if len(out.Platforms) != 0 {
+		out.ImageAnnotations = mh.Annotations()
+	}
+	// the config is always the last element returned by Layers except for schema 1
+	// manifests which don't have a config
+	if mh.Type == imgpull.V1dockerManifest {
+		out.Layers = mh.Layers()
+	} else if layers := mh.Layers(); len(layers) != 0 {
+		out.Config = layers[len(layers)-1]
+		out.Layers = layers[:len(layers)-1]
+		for _, layer := range out.Layers {
+			out.TotalSize += layer.Size
+		}
+	}
+	if history, _ := strconv.ParseBool(opts.getVal(historyOpt)); history {
+		config, err := puller.GetConfig(mh)
+		if err != nil {
+			return err
+		}
+		out.History = imgpull.History(mh, config)
+	}
+	return render(out, opts.getVal(formatOpt), func() {
+		fmt.Fprintf(stdout, "IMAGE URL: %s\nMANIFEST DIGEST: %s\nMEDIA TYPE: %s\n", out.ImageUrl, out.Digest, out.MediaType)
+		printAnnotations("ANNOTATIONS:", out.Annotations)
+		if len(out.Platforms) != 0 {
+			fmt.Fprintln(stdout, "PLATFORMS:")
+			for _, p := range out.Platforms {
+				fmt.Fprintf(stdout, "  %-20s %s\n", p.Platform, p.Digest)
+			}
+			fmt.Fprintf(stdout, "IMAGE MANIFEST DIGEST: %s\n", out.ImageDigest)
+			printAnnotations("IMAGE ANNOTATIONS:", out.ImageAnnotations)
+		}
+		fmt.Fprintf(stdout, "CONFIG: %s %d\nLAYERS:\n", out.Config.Digest, out.Config.Size)
+		for _, layer := range out.Layers {
+			fmt.Fprintf(stdout, "  %s %10d %s\n", layer.Digest, layer.Size, layer.MediaType)
+		}
+		fmt.Fprintf(stdout, "TOTAL LAYER SIZE: %d\n", out.TotalSize)
+		if len(out.History) != 0 {
+			fmt.Fprintln(stdout, "HISTORY:")
+			printHistory(out.History)
+		}
+	})
+}
+
+// historyOutput is the output of the 'history' command.
+type historyOutput struct {
+	ImageUrl string                 `json:"imageUrl"`
+	Digest   string                 `json:"digest"`
+	History  []imgpull.HistoryEntry `json:"history"`
+}
+
+// runHistory implements the 'history' command.
+func runHistory(opts optMap) error {
+	puller, err := imgpull.NewPullerWith(pullerOptsFrom(opts))
+	if err != nil {
+		return err
+	}
+	defer puller.Close()
+	mh, err := puller.GetManifestByType(imgpull.Image)
+	if err != nil {
+		return err
+	}
+	config, err := puller.GetConfig(mh)
+	if err != nil {
+		return err
+	}
+	out := historyOutput{
+		ImageUrl: mh.ImageUrl,
+		Digest:   "sha256:" + mh.Digest,
+		History:  imgpull.History(mh, config),
+	}
+	return render(out, opts.getVal(formatOpt), func() {
+		fmt.Fprintf(stdout, "IMAGE URL: %s\nMANIFEST DIGEST: %s\nHISTORY:\n", out.ImageUrl, out.Digest)
+		printHistory(out.History)
+	})
+}
+
+// printHistory prints the passed history entries: when each step was run, the size
+// of the layer it created, and the step.
+func printHistory(history []imgpull.HistoryEntry) {
+	for _, entry := range history {
+		created := "-"
+		if entry.Created != nil {
+			created = entry.Created.UTC().Format(time.RFC3339)
+		}
+		size := "-"
+		if entry.Layer != nil {
+			size = strconv.Itoa(entry.Layer.Size)
+		}
+		fmt.Fprintf(stdout, "  %-20s %10s %s\n", created, size, entry.Step)
+	}
+}
+
+// runSize implements the 'size' command.
+func runSize(opts optMap) error {
+	puller, err := imgpull.NewPullerWith(pullerOptsFrom(opts))
+	if err != nil {
+		return err
+	}
+	defer puller.Close()
+	uncompressed, _ := strconv.ParseBool(opts.getVal(uncompressedOpt))
+	size, err := puller.Size(uncompressed)
+	if err != nil {
+		return err
+	}
+	return render(size, opts.getVal(formatOpt), func() {
+		fmt.Fprintf(stdout, "IMAGE URL: %s\nMANIFEST DIGEST: %s\nPLATFORM: %s\nLAYERS:\n", size.ImageUrl, size.Digest, size.Platform)
+		for _, layer := range size.Layers {
+			if uncompressed {
+				fmt.Fprintf(stdout, "  %s %10d %10d %s\n", layer.Digest, layer.Size, layer.UncompressedSize, layer.MediaType)
+			} else {
+				fmt.Fprintf(stdout, "  %s %10d %s\n", layer.Digest, layer.Size, layer.MediaType)
+			}
+		}
+		fmt.Fprintf(stdout, "CONFIG: %s %d\nTOTAL LAYER SIZE: %d\nTOTAL DOWNLOAD SIZE: %d\n", size.Config.Digest, size.Config.Size, size.CompressedBytes, size.DownloadBytes)
+		if uncompressed {
+			fmt.Fprintf(stdout, "TOTAL UNCOMPRESSED SIZE: %d\n", size.UncompressedBytes)
+		}
+	})
+}
+
+// runDiff implements the 'diff' command.
+func runDiff(opts optMap) error {
+	from, err := imgpull.NewPullerWith(pullerOptsFrom(opts))
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+	po := pullerOptsFrom(opts)
+	po.Url = opts.getVal(toImageOpt)
+	po.Username, po.Password, po.Token = credentialsFrom(opts, po.Url)
+	to, err := imgpull.NewPullerWith(po)
+	if err != nil {
+		return err
+	}
+	defer to.Close()
+	diff, err := imgpull.Diff(from, to)
+	if err != nil {
+		return err
+	}
+	return render(diff, opts.getVal(formatOpt), func() {
+		fmt.Fprintf(stdout, "FROM: %s %d\nTO: %s %d\n", diff.From, diff.FromSize, diff.To, diff.ToSize)
+		if diff.Identical() {
+			fmt.Fprintln(stdout, "NO DIFFERENCES")
+			return
+		}
+		fmt.Fprintf(stdout, "LAYERS: %d shared\n", diff.SharedLayers)
+		for _, lc := range diff.Layers {
+			switch lc.Change {
+			case imgpull.DiffAdded:
+				fmt.Fprintf(stdout, "  + %d %s %d\n", lc.Index, lc.To.Digest, lc.To.Size)
+			case imgpull.DiffRemoved:
+				fmt.Fprintf(stdout, "  - %d %s %d\n", lc.Index, lc.From.Digest, lc.From.Size)
+			default:
+				fmt.Fprintf(stdout, "  ~ %d %s %d -> %s %d\n", lc.Index, lc.From.Digest, lc.From.Size, lc.To.Digest, lc.To.Size)
+			}
+		}
+		printValueChanges("ENV:", diff.Env)
+		printValueChanges("LABELS:", diff.Labels)
+		for _, ac := range []struct {
+			heading string
+			change  *imgpull.ArgsChange
+		}{{"ENTRYPOINT:", diff.Entrypoint}, {"CMD:", diff.Cmd}} {
+			if ac.change != nil {
+				fmt.Fprintf(stdout, "%s\n  - %q\n  + %q\n", ac.heading, ac.change.From, ac.change.To)
+			}
+		}
+	})
+}
+
+// printValueChanges prints the passed heading and changes, if there are any changes.
+func printValueChanges(heading string, changes []imgpull.ValueChange) {
+	if len(changes) == 0 {
+		return
+	}
+	fmt.Fprintln(stdout, heading)
+	for _, vc := range changes {
+		switch vc.Change {
+		case imgpull.DiffAdded:
+			fmt.Fprintf(stdout, "  + %s=%s\n", vc.Key, vc.To)
+		case imgpull.DiffRemoved:
+			fmt.Fprintf(stdout, "  - %s=%s\n", vc.Key, vc.From)
+		default:
+			fmt.Fprintf(stdout, "  ~ %s=%s -> %s\n", vc.Key, vc.From, vc.To)
+		}
+	}
+}
+
+// runCopy implements the 'copy' command.
+func runCopy(opts optMap) error {
+	co := imgpull.CopyOpts{}
+	co.AllPlatforms, _ = strconv.ParseBool(opts.getVal(allPlatformsOpt))
+	if platforms := opts.getVal(platformOpt); platforms != "" {
+		co.Platforms = strings.Split(platforms, ",")
+	}
+	start := time.Now()
+	digest, err := imgpull.Copy(opts.getVal(imageOpt), opts.getVal(toImageOpt), co, pullerOptsFrom(opts))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "image %q copied to %q with digest %s in %s\n", opts.getVal(imageOpt), opts.getVal(toImageOpt), digest, time.Since(start))
+	return nil
+}
+
+// runPush implements the 'push' command.
+func runPush(opts optMap) error {
+	start := time.Now()
+	digest, err := imgpull.PushTar(opts.getVal(srcOpt), pullerOptsFrom(opts))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%q pushed to %q with digest %s in %s\n", opts.getVal(srcOpt), opts.getVal(imageOpt), digest, time.Since(start))
+	return nil
+}
+
+// runExtract implements the 'extract' command.
+func runExtract(opts optMap) error {
+	puller, err := imgpull.NewPullerWith(pullerOptsFrom(opts))
+	if err != nil {
+		return err
+	}
+	defer puller.Close()
+	start := time.Now()
+	if layer := opts.getVal(layerOpt); layer != "" {
+		err = puller.PullLayer(layer, opts.getVal(destOpt))
+	} else {
+		err = puller.PullRootfs(opts.getVal(destOpt))
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "image %q extracted to %q in %s\n", puller.GetUrl(), opts.getVal(destOpt), time.Since(start))
+	return nil
+}
+
+// runLayout implements the 'layout' command.
+func runLayout(opts optMap) error {
+	puller, err := imgpull.NewPullerWith(pullerOptsFrom(opts))
+	if err != nil {
+		return err
+	}
+	defer puller.Close()
+	start := time.Now()
+	stats, err := puller.PullLayout(opts.getVal(destDirOpt))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, savedMessage(puller.GetUrl(), opts.getVal(destDirOpt), time.Since(start), stats))
+	return nil
+}
+
+// runDaemon implements the 'daemon' command. It serves the daemon API until it gets
+// SIGINT or SIGTERM, and then waits for the pulls in progress to finish.
+func runDaemon(opts optMap) error {
+	concurrency, _ := strconv.Atoi(opts.getVal(concurrencyOpt))
+	daemon, err := imgpull.NewDaemon(imgpull.DaemonOpts{
+		PullerOpts:  pullerOptsFrom(opts),
+		DestDir:     opts.getVal(destDirOpt),
+		Concurrency: concurrency,
+	})
+	if err != nil {
+		return err
+	}
+	defer daemon.Close()
+	network, addr := "tcp", opts.getVal(listenOpt)
+	if path, found := strings.CutPrefix(addr, "unix:"); found {
+		network, addr = "unix", path
+		// remove the socket left by a daemon that didn't shut down
+		if fi, err := os.Stat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr)
+		}
+	}
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	server := &http.Server{Handler: daemon}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(ln) }()
+	fmt.Fprintf(stdout, "serving pulls to %q on %s\n", opts.getVal(destDirOpt), opts.getVal(listenOpt))
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+		fmt.Fprintln(stdout, "shutting down")
+		return server.Shutdown(context.Background())
+	}
+}
+
+// runLogin implements the 'login' command.
+func runLogin(opts optMap) error {
+	if err := readPasswordStdin(opts, os.Stdin); err != nil {
+		return err
+	}
+	if opts.getVal(passwordOpt) == "" {
+		return errors.New("a password is required with --password or --password-stdin")
+	}
+	if err := imgpull.Login(opts.getVal(configOpt), opts.getVal(registryOpt), opts.getVal(usernameOpt), opts.getVal(passwordOpt)); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "credentials for %q saved\n", opts.getVal(registryOpt))
+	return nil
+}
+
+// runLogout implements the 'logout' command.
+func runLogout(opts optMap) error {
+	if err := imgpull.Logout(opts.getVal(configOpt), opts.getVal(registryOpt)); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "credentials for %q removed\n", opts.getVal(registryOpt))
+	return nil
+}
+
+// runBundle implements the 'bundle' command.
+func runBundle(opts optMap) error {
+	f, err := os.Open(opts.getVal(imageListOpt))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	entries, err := parseImageList(f)
+	if err != nil {
+		return err
+	}
+	images := []imgpull.BundleImage{}
+	pos := map[string]int{}
+	for _, entry := range entries {
+		platform := opts.getVal(osOpt) + "/" + opts.getVal(archOpt)
+		if entry.os != "" {
+			platform = entry.os + "/" + entry.arch
+		}
+		if i, found := pos[entry.url]; found {
+			images[i].Platforms = append(images[i].Platforms, platform)
+		} else {
+			pos[entry.url] = len(images)
+			images = append(images, imgpull.BundleImage{Url: entry.url, Platforms: []string{platform}})
+		}
+	}
+	start := time.Now()
+	idx, err := imgpull.CreateBundle(images, opts.getVal(archiveOpt), pullerOptsFrom(opts))
+	if err != nil {
+		return err
+	}
+	for _, image := range idx.Images {
+		fmt.Fprintf(stdout, "image %q bundled with digest %s\n", image.Url, image.Digest)
+	}
+	fmt.Fprintf(stdout, "%d images saved to %q in %s\n", len(idx.Images), opts.getVal(archiveOpt), time.Since(start))
+	return nil
+}
+
+// runUnbundle implements the 'unbundle' command.
+func runUnbundle(opts optMap) error {
+	start := time.Now()
+	idx, err := imgpull.PushBundle(opts.getVal(archiveOpt), opts.getVal(registryOpt), pullerOptsFrom(opts))
+	if err != nil {
+		return err
+	}
+	for _, image := range idx.Images {
+		fmt.Fprintf(stdout, "image %q pushed to %q\n", image.Url, opts.getVal(registryOpt))
+	}
+	fmt.Fprintf(stdout, "%d images pushed in %s\n", len(idx.Images), time.Since(start))
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// completionShells are the shells that the completion command generates scripts for.
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// the completion command is registered here rather than in the 'commands' map literal
+// because it generates its output from the 'commands' map, which would otherwise be an
+// initialization cycle.
+func init() {
+	commands["completion"] = &command{
+		name:       "completion",
+		summary:    "Generate a shell completion script for bash, zsh, or fish",
+		positional: []optName{shellOpt},
+		required:   1,
+		run:        runCompletion,
+		usage: `
+Usage:
+
+imgpull completion <bash | zsh | fish>
+
+Writes a script to stdout that completes the imgpull commands and the options
+of each command in the passed shell. E.g.:
+
+  # bash - current shell, or add to ~/.bashrc
+  source <(imgpull completion bash)
+  # zsh - current shell, or add to ~/.zshrc after compinit
+  source <(imgpull completion zsh)
+  # fish
+  imgpull completion fish > ~/.config/fish/completions/imgpull.fish
+`,
+		validate: func(opts optMap) error {
+			if shell := opts[shellOpt].Value; shell != "" && !slices.Contains(completionShells, shell) {
+				return fmt.Errorf("unsupported shell %q: expected one of %s", shell, strings.Join(completionShells, ", "))
+			}
+			return nil
+		},
+	}
+}
+
+// runCompletion implements the 'completion' command.
+func runCompletion(opts optMap) error {
+	switch opts.getVal(shellOpt) {
+	case "bash":
+		fmt.Fprint(stdout, bashCompletion())
+	case "zsh":
+		fmt.Fprint(stdout, zshCompletion())
+	case "fish":
+		fmt.Fprint(stdout, fishCompletion())
+	}
+	return nil
+}
+
+// completionOpts returns the options of the passed command that can be completed,
+// sorted by long name. Positional params are excluded.
+func completionOpts(cmd *command) []opt {
+	opts := []opt{}
+	for _, option := range cmd.optMap() {
+		if option.Long != "" {
+			opts = append(opts, option)
+		}
+	}
+	slices.SortFunc(opts, func(a, b opt) int { return strings.Compare(a.Long, b.Long) })
+	return opts
+}
+
+// completionFlags returns the short and long flags of the passed command, like
+// "-o --os", separated by spaces.
+func completionFlags(cmd *command) string {
+	flags := []string{}
+	for _, option := range completionOpts(cmd) {
+		if option.Short != "" {
+			flags = append(flags, "-"+option.Short)
+		}
+		flags = append(flags, "--"+option.Long)
+	}
+	return strings.Join(flags, " ")
+}
+
+// bashCompletion returns the bash completion script. Positional params fall back to
+// the default file name completion.
+func bashCompletion() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `_imgpull() {
+    local cur="${COMP_WORDS[COMP_CWORD]}"
+    if [[ $COMP_CWORD -eq 1 ]]; then
+        COMPREPLY=($(compgen -W "%s help" -- "$cur"))
+        return
+    fi
+    if [[ "$cur" != -* ]]; then
+        return
+    fi
+    case "${COMP_WORDS[1]}" in
+`, strings.Join(commandOrder, " "))
+	for _, name := range commandOrder {
+		fmt.Fprintf(&sb, "        %s) COMPREPLY=($(compgen -W \"%s\" -- \"$cur\")) ;;\n", name, completionFlags(commands[name]))
+	}
+	sb.WriteString(`    esac
+}
+complete -o default -F _imgpull imgpull
+`)
+	return sb.String()
+}
+
+// zshCompletion returns the zsh completion script. Positional params complete file names.
+func zshCompletion() string {
+	var sb strings.Builder
+	sb.WriteString(`_imgpull() {
+    local -a commands
+    commands=(
+`)
+	for _, name := range commandOrder {
+		fmt.Fprintf(&sb, "        '%s:%s'\n", name, commands[name].summary)
+	}
+	sb.WriteString(`    )
+    if (( CURRENT == 2 )); then
+        _describe 'command' commands
+        return
+    fi
+    if [[ $PREFIX != -* ]]; then
+        _files
+        return
+    fi
+    case $words[2] in
+`)
+	for _, name := range commandOrder {
+		fmt.Fprintf(&sb, "        %s) compadd -- %s ;;\n", name, completionFlags(commands[name]))
+	}
+	sb.WriteString(`    esac
+}
+compdef _imgpull imgpull
+`)
+	return sb.String()
+}
+
+// fishCompletion returns the fish completion script. Options that take a value are
+// marked as requiring one so that fish completes file names for the value.
+func fishCompletion() string {
+	var sb strings.Builder
+	for _, name := range commandOrder {
+		fmt.Fprintf(&sb, "complete -c imgpull -n __fish_use_subcommand -a %s -d '%s'\n", name, commands[name].summary)
+	}
+	for _, name := range commandOrder {
+		for _, option := range completionOpts(commands[name]) {
+			fmt.Fprintf(&sb, "complete -c imgpull -n '__fish_seen_subcommand_from %s'", name)
+			if option.Short != "" {
+				fmt.Fprintf(&sb, " -s %s", option.Short)
+			}
+			fmt.Fprintf(&sb, " -l %s", option.Long)
+			if !option.IsSwitch {
+				sb.WriteString(" -r")
+			}
+			sb.WriteString("\n")
+		}
+	}
+	return sb.String()
+}
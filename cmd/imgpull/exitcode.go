@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+)
+
+// Exit codes of the CLI, so that scripts can branch on the cause of a failure.
+const (
+	// exitFailure is any failure that doesn't have a more specific exit code.
+	exitFailure = 1
+	// exitNotFound is a 404 for an image, manifest, blob, or repository.
+	exitNotFound = 2
+	// exitAuthFailure is a 401 or 403 from the registry or the token server.
+	exitAuthFailure = 3
+	// exitNetworkFailure is a failure to connect to or talk to a server, including TLS
+	// failures.
+	exitNetworkFailure = 4
+	// exitDigestMismatch is content that doesn't match its digest.
+	exitDigestMismatch = 5
+	// exitUsage is an invalid command line. The value is EX_USAGE from sysexits.h.
+	exitUsage = 64
+)
+
+// exitCode returns the exit code for the passed error. If the error wraps more than one
+// error, e.g. for the images that failed with --from-file, then the first of the causes
+// in the order of the cases below determines the exit code.
+func exitCode(err error) int {
+	var se *types.ErrStatus
+	var dme *types.ErrDigestMismatch
+	var nwe *types.ErrNetwork
+	var ne net.Error
+	switch {
+	case errors.As(err, &dme):
+		return exitDigestMismatch
+	case errors.As(err, &se) && se.StatusCode == http.StatusNotFound:
+		return exitNotFound
+	case errors.As(err, &se) && (se.StatusCode == http.StatusUnauthorized || se.StatusCode == http.StatusForbidden):
+		return exitAuthFailure
+	case errors.As(err, &nwe), errors.As(err, &ne):
+		return exitNetworkFailure
+	}
+	return exitFailure
+}
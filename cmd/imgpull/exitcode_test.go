@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+)
+
+// Tests the exit code for each kind of error, including the errors of the images in an
+// image list, where the first cause in the order of the exit codes wins.
+func TestExitCode(t *testing.T) {
+	notFound := &types.ErrStatus{Op: "get manifests", StatusCode: http.StatusNotFound}
+	unauthorized := &types.ErrStatus{Op: "get manifests", StatusCode: http.StatusUnauthorized}
+	forbidden := &types.ErrStatus{Op: "get manifests", StatusCode: http.StatusForbidden}
+	mismatch := &types.ErrDigestMismatch{Expected: "sha256:abc", Actual: "sha256:def"}
+	network := &types.ErrNetwork{Category: types.ErrTransient, Err: errors.New("connection refused")}
+	for i, tc := range []struct {
+		err  error
+		code int
+	}{
+		{errors.New("frobozz"), exitFailure},
+		{&types.ErrStatus{StatusCode: http.StatusInternalServerError}, exitFailure},
+		{notFound, exitNotFound},
+		{fmt.Errorf("pull failed: %w", notFound), exitNotFound},
+		{unauthorized, exitAuthFailure},
+		{forbidden, exitAuthFailure},
+		{network, exitNetworkFailure},
+		{mismatch, exitDigestMismatch},
+		{newListError("pull", []error{nil, notFound, nil}), exitNotFound},
+		{newListError("pull", []error{network, unauthorized}), exitAuthFailure},
+		{newListError("pull", []error{notFound, mismatch}), exitDigestMismatch},
+		{newListError("plan", []error{errors.New("frobozz"), network}), exitNetworkFailure},
+	} {
+		if code := exitCode(tc.err); code != tc.code {
+			t.Errorf("%d: expected exit code %d for %v, got %d", i, tc.code, tc.err, code)
+		}
+	}
+	if err := newListError("pull", []error{nil, nil}); err != nil {
+		t.Errorf("expected no error when no image failed, got %v", err)
+	}
+	if err := newListError("pull", []error{nil, notFound, network}); err.Error() != "2 of 3 images failed to pull" {
+		t.Errorf("unexpected error message %q", err)
+	}
+}
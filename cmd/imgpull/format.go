@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Supported values for the --format option. Any other value is interpreted as
+// a Go template, e.g.: --format '{{.Digest}}'.
+const (
+	jsonFormat   = "json"
+	prettyFormat = "pretty"
+	yamlFormat   = "yaml"
+)
+
+// formatUsage documents the --format option for the commands that support it.
+var formatUsage = ` -f|--format format       Render the output as 'json' (compact), 'pretty' (indented JSON),
+                          'yaml', or a Go template like '{{.Digest}}'. If omitted, output
+                          is rendered as human-readable text.
+`
+
+// render writes the passed value to stdout in the passed format. If the format
+// is empty then the passed 'text' function is called to render the value as
+// human-readable text.
+func render(v any, format string, text func()) error {
+	switch format {
+	case "":
+		text()
+		return nil
+	case jsonFormat:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, string(b))
+	case prettyFormat:
+		b, err := json.MarshalIndent(v, "", "   ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, string(b))
+	case yamlFormat:
+		// round trip through JSON so the YAML keys match the JSON field tags
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		var generic any
+		if err := json.Unmarshal(b, &generic); err != nil {
+			return err
+		}
+		b, err = yaml.Marshal(generic)
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(stdout, string(b))
+	default:
+		tmpl, err := template.New("format").Parse(format)
+		if err != nil {
+			return fmt.Errorf("invalid --format template: %w", err)
+		}
+		if err := tmpl.Execute(stdout, v); err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout)
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aceeric/imgpull/pkg/imgpull"
+)
+
+// imageListEntry is one line from an image list file: an image ref and
+// an optional platform.
+type imageListEntry struct {
+	url  string
+	os   string
+	arch string
+}
+
+// tarNameReplacer replaces the characters in an image ref that are replaced when
+// generating a tarball name from the ref.
+var tarNameReplacer = strings.NewReplacer("/", "-", ":", "-", "@", "-")
+
+// listError is returned when some of the images in an image list failed. It unwraps to
+// the error of each image that failed, in the order of the list, so that 'exitCode' can
+// tell why they failed.
+type listError struct {
+	action string
+	total  int
+	errs   []error
+}
+
+func (e *listError) Error() string {
+	return fmt.Sprintf("%d of %d images failed to %s", len(e.errs), e.total, e.action)
+}
+
+func (e *listError) Unwrap() []error {
+	return e.errs
+}
+
+// newListError returns a '*listError' for the passed image errors, which are indexed
+// like the image list and are nil for the images that didn't fail, or nil if no image
+// failed.
+func newListError(action string, errs []error) error {
+	failed := []error{}
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return &listError{action: action, total: len(errs), errs: failed}
+}
+
+// pullFromFile implements the 'pull' command with the --from-file option. Each
+// image in the file is pulled to a tarball in the destination directory. Up to
+// --concurrency images are pulled in parallel. All images are attempted even
+// if some fail, and an error that wraps the error of each image that failed is
+// returned if any image failed.
+func pullFromFile(opts optMap) error {
+	f, err := os.Open(opts.getVal(fromFileOpt))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	entries, err := parseImageList(f)
+	if err != nil {
+		return err
+	}
+	destDir := opts.getVal(destOpt)
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
+	sessions, err := sessionsFor(entries, pullerOptsFrom(opts))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, s := range sessions {
+			s.Close()
+		}
+	}()
+	concurrency, _ := strconv.Atoi(opts.getVal(concurrencyOpt))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	errs := make([]error, len(entries))
+	for i, entry := range entries {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			po := entryOpts(opts, entry, sessions)
+			tarName := entry.url
+			if entry.os != "" {
+				// the same image may be listed for more than one platform
+				tarName = strings.Join([]string{tarName, entry.os, entry.arch}, "-")
+			}
+			tarFile := filepath.Join(destDir, tarNameReplacer.Replace(tarName)+".tar")
+			start := time.Now()
+			stats, err := pullOne(po, tarFile)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[i] = err
+				fmt.Fprintf(os.Stderr, "image %q failed: %s\n", entry.url, err)
+			} else {
+				fmt.Fprintln(stdout, savedMessage(entry.url, tarFile, time.Since(start), stats))
+			}
+		}()
+	}
+	wg.Wait()
+	return newListError("pull", errs)
+}
+
+// planFromFile implements the 'pull' command with the --from-file and --dry-run
+// options. The pull of each image in the file is planned and the blobs are shown,
+// followed by the total size of the blobs of all the images. A blob shared by images
+// is only counted once in the total.
+func planFromFile(opts optMap) error {
+	f, err := os.Open(opts.getVal(fromFileOpt))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	entries, err := parseImageList(f)
+	if err != nil {
+		return err
+	}
+	sessions, err := sessionsFor(entries, pullerOptsFrom(opts))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, s := range sessions {
+			s.Close()
+		}
+	}()
+	blobs := map[string]int{}
+	errs := make([]error, len(entries))
+	failed := 0
+	for i, entry := range entries {
+		plan, err := planOne(entryOpts(opts, entry, sessions))
+		if err != nil {
+			errs[i] = err
+			failed++
+			fmt.Fprintf(os.Stderr, "image %q failed: %s\n", entry.url, err)
+			continue
+		}
+		printPlan(plan)
+		for _, blob := range plan.Blobs {
+			blobs[blob.Digest] = blob.Size
+		}
+	}
+	var total int64
+	for _, size := range blobs {
+		total += int64(size)
+	}
+	fmt.Fprintf(stdout, "TOTAL: %d images, %d blobs, %d bytes\n", len(entries)-failed, len(blobs), total)
+	return newListError("plan", errs)
+}
+
+// planOne plans the pull of one image with the passed options.
+func planOne(po imgpull.PullerOpts) (imgpull.PullPlan, error) {
+	puller, err := imgpull.NewPullerWith(po)
+	if err != nil {
+		return imgpull.PullPlan{}, err
+	}
+	defer puller.Close()
+	return puller.Plan()
+}
+
+// entryOpts returns the puller options for the passed image list entry: the options from
+// the command line with the image ref and platform from the entry, the credentials for the
+// registry of the image, and the session for the registry.
+func entryOpts(opts optMap, entry imageListEntry, sessions map[string]*imgpull.RegistrySession) imgpull.PullerOpts {
+	po := pullerOptsFrom(opts)
+	po.Url = entry.url
+	po.Username, po.Password, po.Token = credentialsFrom(opts, entry.url)
+	if ref, err := imgpull.ParseRef(entry.url); err == nil {
+		po.Session = sessions[ref.Registry]
+	}
+	if entry.os != "" {
+		po.OStype, po.ArchType = entry.os, entry.arch
+	}
+	return po
+}
+
+// sessionsFor returns a registry session for each registry in the passed entries so that
+// all the images from a registry share connections and auth. Entries with invalid image
+// refs are skipped since they will fail when pulled.
+func sessionsFor(entries []imageListEntry, po imgpull.PullerOpts) (map[string]*imgpull.RegistrySession, error) {
+	sessions := map[string]*imgpull.RegistrySession{}
+	for _, entry := range entries {
+		ref, err := imgpull.ParseRef(entry.url)
+		if err != nil || sessions[ref.Registry] != nil {
+			continue
+		}
+		if sessions[ref.Registry], err = imgpull.NewRegistrySession(ref.Registry, po); err != nil {
+			return nil, err
+		}
+	}
+	return sessions, nil
+}
+
+// pullOne pulls one image tarball with the passed options. The mirrors in the config
+// file for the registry of the image are tried first, in order, and then the registry.
+// The stats of the pull that succeeded are returned.
+func pullOne(po imgpull.PullerOpts, tarFile string) (imgpull.PullStats, error) {
+	mirrors, err := regConfig.Mirrors(po)
+	if err != nil {
+		return imgpull.PullStats{}, err
+	}
+	for _, mo := range mirrors {
+		stats, err := pullTar(mo, tarFile)
+		if err == nil {
+			return stats, nil
+		}
+		fmt.Fprintf(os.Stderr, "unable to pull %q from mirror: %s\n", mo.Url, err)
+	}
+	return pullTar(po, tarFile)
+}
+
+// pullTar pulls one image tarball with the passed options.
+func pullTar(po imgpull.PullerOpts, tarFile string) (imgpull.PullStats, error) {
+	puller, err := imgpull.NewPullerWith(po)
+	if err != nil {
+		return imgpull.PullStats{}, err
+	}
+	defer puller.Close()
+	return puller.PullTar(tarFile)
+}
+
+// savedMessage returns the message shown when an image is saved to a tarball, with the
+// stats of the pull.
+func savedMessage(url string, tarFile string, elapsed time.Duration, stats imgpull.PullStats) string {
+	return fmt.Sprintf("image %q saved to %q in %s (%d layers, %d bytes downloaded, %d bytes reused)",
+		url, tarFile, elapsed, stats.Layers, stats.BytesDownloaded, stats.BytesReused)
+}
+
+// parseImageList parses an image list from the passed reader. Each line has an
+// image ref, optionally followed by whitespace and an os/arch platform. Blank lines
+// and lines beginning with '#' are ignored.
+func parseImageList(r io.Reader) ([]imageListEntry, error) {
+	entries := []imageListEntry{}
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		entry := imageListEntry{url: fields[0]}
+		switch len(fields) {
+		case 1:
+		case 2:
+			os, arch, found := strings.Cut(fields[1], "/")
+			if !found || os == "" || arch == "" {
+				return nil, fmt.Errorf("invalid platform %q on line %d: expected os/arch", fields[1], lineNum)
+			}
+			entry.os, entry.arch = os, arch
+		default:
+			return nil, fmt.Errorf("unable to parse line %d: %q", lineNum, line)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no images found in the image list")
+	}
+	return entries, nil
+}
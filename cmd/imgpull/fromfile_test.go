@@ -0,0 +1,35 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Tests parsing an image list, with and without a platform on each line.
+func TestParseImageList(t *testing.T) {
+	for i, tc := range []struct {
+		list    string
+		entries []imageListEntry
+		ok      bool
+	}{
+		{
+			"# images\n\ndocker.io/hello-world:latest\n  quay.io/foo/bar:1.0 linux/arm64  \n",
+			[]imageListEntry{{url: "docker.io/hello-world:latest"}, {url: "quay.io/foo/bar:1.0", os: "linux", arch: "arm64"}},
+			true,
+		},
+		{"docker.io/hello-world:latest\tlinux/amd64", []imageListEntry{{url: "docker.io/hello-world:latest", os: "linux", arch: "amd64"}}, true},
+		{"docker.io/hello-world:latest linux", nil, false},
+		{"docker.io/hello-world:latest /amd64", nil, false},
+		{"docker.io/hello-world:latest linux/amd64 extra", nil, false},
+		{"# nothing here\n\n", nil, false},
+		{"", nil, false},
+	} {
+		entries, err := parseImageList(strings.NewReader(tc.list))
+		if (err == nil) != tc.ok {
+			t.Errorf("%d: unexpected error state: %v", i, err)
+		} else if !slices.Equal(entries, tc.entries) {
+			t.Errorf("%d: expected %+v, got %+v", i, tc.entries, entries)
+		}
+	}
+}
@@ -2,50 +2,37 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
-	"time"
-
-	"github.com/aceeric/imgpull/pkg/imgpull"
+	"strconv"
 )
 
+// stdout is where commands write their output. It discards the output if the --quiet
+// option is specified. Errors are always printed, to stderr.
+var stdout io.Writer = os.Stdout
+
 func main() {
-	cmdline, err := parseArgs()
+	cmd, cmdline, err := parseArgs(os.Args[1:])
 	if err != nil {
-		fmt.Println(err)
-		showUsageAndExit(nil)
-	}
-	puller, err := imgpull.NewPullerWith(pullerOptsFrom(cmdline))
-	if err == nil {
-		if cmdline.getVal(manifestOpt) != "" {
-			err = showManifest(puller, cmdline.getVal(manifestOpt))
+		fmt.Fprintln(os.Stderr, err)
+		if cmd != nil {
+			printCommandUsage(os.Stderr, cmd)
 		} else {
-			err = pullTar(puller, cmdline.getVal(destOpt))
+			printUsage(os.Stderr)
 		}
+		os.Exit(exitUsage)
 	}
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	if quiet, _ := strconv.ParseBool(cmdline.getVal(quietOpt)); quiet {
+		stdout = io.Discard
 	}
-}
-
-func showManifest(puller imgpull.Puller, manifestType string) error {
-	mt := imgpull.ManifestPullTypeFrom[manifestType]
-	if mh, err := puller.GetManifestByType(mt); err != nil {
-		return err
-	} else if manifest, err := mh.ToString(); err != nil {
-		return err
-	} else {
-		fmt.Printf("MANIFEST:\n%s\nMANIFEST DIGEST: %s\nIMAGE URL: %s\n", manifest, mh.Digest, mh.ImageUrl)
+	if cmd.connects {
+		if err := setupConnect(cmdline); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitCode(err))
+		}
 	}
-	return nil
-}
-
-func pullTar(puller imgpull.Puller, tarFile string) error {
-	start := time.Now()
-	if err := puller.PullTar(tarFile); err != nil {
-		return err
-	} else {
-		fmt.Printf("image %q saved to %q in %s\n", puller.GetUrl(), tarFile, time.Since(start))
+	if err := cmd.run(cmdline); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitCode(err))
 	}
-	return nil
 }
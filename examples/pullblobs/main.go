@@ -40,7 +40,7 @@ func main() {
 		}
 	}
 	// get all the image blobs to the current working directory
-	err = puller.PullBlobs(mh, "./")
+	_, err = puller.PullBlobs(mh, "./")
 	if err != nil {
 		fmt.Println(err)
 	}
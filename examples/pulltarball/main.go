@@ -16,7 +16,7 @@ func main() {
 		fmt.Println(err)
 		os.Exit(1)
 	} else {
-		if err = puller.PullTar(tarfile); err != nil {
+		if _, err = puller.PullTar(tarfile); err != nil {
 			fmt.Println(err)
 		} else {
 			fmt.Printf("Successfully pulled %q to %q\n", imageref, tarfile)
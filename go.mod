@@ -2,4 +2,9 @@ module github.com/aceeric/imgpull
 
 go 1.25.4
 
-require github.com/opencontainers/go-digest v1.0.0
+require (
+	github.com/klauspost/compress v1.20.1
+	github.com/opencontainers/go-digest v1.0.0
+	github.com/opencontainers/image-spec v1.1.1
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -2,111 +2,452 @@ package blobsync
 
 import (
 	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
 	"sync"
 	"time"
+
+	"github.com/opencontainers/go-digest"
 )
 
-// EnqueueResult represents the result of enqueing a blob pull.
-type EnqueueResult bool
+// blobCall is a blob pull in progress, or completed. The done channel is closed
+// when the pull is complete, at which point err has the result of the pull. For a
+// sync-only syncer, path is the file the blob is pulled into.
+type blobCall struct {
+	done chan struct{}
+	err  error
+	path string
+}
 
-// IsEnqueued means that another goroutine already requested a blob for a
-// given digest.
-const IsEnqueued EnqueueResult = true
+// BlobSyncer supports multiple goroutines attempting to pull the same blob concurrently.
+// Blobs are pulled into a content-addressed staging directory owned by the syncer. The
+// calls struct member is a map of digests to pulls in progress: the first goroutine to
+// request a digest pulls the blob into the staging directory and the others wait for it
+// to finish. Then every goroutine links (or copies) the staged blob into its own
+// destination, so goroutines can request the same blob at different paths. Only
+// goroutines using the same BlobSyncer are synchronized with each other.
+type BlobSyncer struct {
+	mu    sync.Mutex
+	calls map[string]*blobCall
+	// staged is a map of digests to the blobs in the staging directory.
+	staged map[string]*stagedBlob
+	// dir is the staging directory. It is created on first use.
+	dir string
+	// timeout specifies how long to wait for another goroutine to finish pulling
+	// a blob.
+	timeout time.Duration
+	// policy is applied each time a blob is staged.
+	policy GCPolicy
+	// verify causes staged blobs to be re-hashed each time they are used.
+	verify bool
+	// syncOnly means blobs are not staged. See 'SetConcurrentBlobs'.
+	syncOnly bool
+}
 
-// NotEnqueued means no other goroutine has requested a blob with a given
-// digest and so the caller must pull it.
-const NotEnqueued EnqueueResult = false
+// stagedBlob is a blob in the staging directory. The refs member is the number of
+// goroutines linking or copying the blob, which prevents it from being removed.
+type stagedBlob struct {
+	path     string
+	size     int64
+	lastUsed time.Time
+	refs     int
+}
 
-// SyncObj has a channel created by an enqueueing action, and the
-// result of the enqueueing.
-type SyncObj struct {
-	Ch     chan bool
-	Result EnqueueResult
+// GCPolicy specifies which staged blobs are removed by 'GC'. Blobs not used for longer
+// than 'MaxAge' are removed, and then if the staged blobs are larger in total than
+// 'MaxSize' bytes, the least recently used blobs are removed until they aren't. A zero
+// value for either means no limit.
+type GCPolicy struct {
+	MaxSize int64
+	MaxAge  time.Duration
 }
 
-// pullMap supports multiple threads attempting to pull the same blob concurrently.
-// The pullMap struct member is a map of digests, each having 1+ channel(s) waiting
-// for the blob for that digest to finish pulling. The goroutine doing the pulling
-// also has a channel in that map.
-type pullMap struct {
-	mu      sync.Mutex
-	pullMap map[string][]chan bool
+// GCResult has the number of blobs and bytes removed by 'GC'.
+type GCResult struct {
+	Blobs int
+	Bytes int64
 }
 
+// defaultSyncer is the process-wide sync-only syncer configured by SetConcurrentBlobs.
+// It is nil - meaning concurrency blob pull synchronization is off - by default.
 var (
-	// concurrency blob pull synchronization is off by default.
-	ConcurrentBlobs = false
-	// blobTimeoutSec specifies - for the concurrent write syncer - how long
-	// to wait to be signaled when the blob is done pulling. It is ignored
-	// unless concurrency is enabled.
-	blobTimeoutSec = 0
-	// blobPulls is the synchronized maps of pulls in progress. It is ignored
-	// unless concurrency is enabled.
-	blobPulls = pullMap{}
+	defaultMu     sync.Mutex
+	defaultSyncer *BlobSyncer
 )
 
-// SetConcurrentBlobs enables concurrency management for pulling blobs. The function
-// is intended to be used when the package is used as a library as an initialization
-// step by the code that uses the library. The 'timeoutSec' arg indicate how many
-// seconds an enqueued goroutine will wait for a blob download before erroring.
+// NewBlobSyncer returns a BlobSyncer. The 'timeoutSec' arg indicates how many seconds
+// a waiting goroutine will wait for a blob download before erroring.
+func NewBlobSyncer(timeoutSec int) *BlobSyncer {
+	return &BlobSyncer{
+		calls:   make(map[string]*blobCall),
+		staged:  make(map[string]*stagedBlob),
+		timeout: time.Duration(timeoutSec) * time.Second,
+	}
+}
+
+// SetConcurrentBlobs enables process-wide concurrency management for pulling blobs
+// by configuring a default syncer. The function is intended to be used when the
+// package is used as a library as an initialization step by the code that uses the
+// library. The 'timeoutSec' arg indicate how many seconds a waiting goroutine will
+// wait for a blob download before erroring.
+//
+// Since the default syncer can't be closed, it is sync-only: it doesn't stage blobs.
+// The first goroutine pulls the blob directly into its destination, and the goroutines
+// waiting for it link (or copy) the blob from there, or pull it themselves if it's gone.
 func SetConcurrentBlobs(timeoutSec int) {
-	blobTimeoutSec = timeoutSec
-	blobPulls.pullMap = make(map[string][]chan bool)
-	ConcurrentBlobs = true
-}
-
-// EnqueueGet enqueues a pull for a blob using the passed digest. If there are
-// no other requesters, then the function returns 'notEnqueued' - meaning the caller
-// is the first requester and therefore will have to actually pull the blob. If a
-// request was previously enqueued for the blob then 'isEnqueued' is returned meaning
-// the caller should simply wait for a signal on the channel in the returned syncObj
-// struct and let the first goroutine complete the pull and signal all waiters.
-func EnqueueGet(digest string) SyncObj {
-	so := SyncObj{
-		Ch:     make(chan bool),
-		Result: NotEnqueued,
-	}
-	blobPulls.mu.Lock()
-	chans, exists := blobPulls.pullMap[digest]
-	if exists {
-		blobPulls.pullMap[digest] = append(chans, so.Ch)
-		so.Result = IsEnqueued
-	} else {
-		blobPulls.pullMap[digest] = []chan bool{so.Ch}
-	}
-	blobPulls.mu.Unlock()
-	return so
-}
-
-// DoneGet signals all waiters that are associated with the digest in arg 1.
-func DoneGet(digest string) {
-	blobPulls.mu.Lock()
-	chans, exists := blobPulls.pullMap[digest]
-	if exists {
-		for _, ch := range chans {
-			// signal in a func so that if we write on a closed channel we can
-			// recover and keep looping
-			func() {
-				defer func() {
-					if err := recover(); err != nil {
-						// nop
-					}
-				}()
-				ch <- true
-			}()
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultSyncer = NewBlobSyncer(timeoutSec)
+	defaultSyncer.syncOnly = true
+}
+
+// Default returns the syncer configured by SetConcurrentBlobs, or nil if process-wide
+// concurrency management has not been enabled.
+func Default() *BlobSyncer {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	return defaultSyncer
+}
+
+// Get gets the blob with the passed digest into the file specified by 'toFile'. If the
+// blob is not already staged, and no other goroutine is pulling it, then the passed
+// 'pull' function is called to pull the blob into the file passed to it, and the file
+// is then staged if it matches the digest. If another goroutine is pulling the blob then
+// the function waits for that pull to finish and gets the result of that pull, or times
+// out. In all cases if the blob is staged then it is hard-linked to 'toFile', or copied
+// if it can't be linked.
+func (bs *BlobSyncer) Get(dgst string, toFile string, pull func(string) error) error {
+	if bs.syncOnly {
+		return bs.getSyncOnly(dgst, toFile, pull)
+	}
+	staged, err := bs.stagedPath(dgst)
+	if err != nil {
+		return err
+	}
+	for {
+		bs.mu.Lock()
+		if sb, exists := bs.staged[dgst]; exists {
+			sb.refs++
+			sb.lastUsed = time.Now()
+			verify := bs.verify
+			bs.mu.Unlock()
+			if verify && verifyFile(sb.path, dgst) != nil {
+				// the corrupted blob is evicted and pulled again
+				bs.evict(dgst, sb)
+				continue
+			}
+			return bs.link(sb, toFile)
+		}
+		if c, exists := bs.calls[dgst]; exists {
+			bs.mu.Unlock()
+			select {
+			case <-c.done:
+				if c.err != nil {
+					return c.err
+				}
+			case <-time.After(bs.timeout):
+				return errors.New("timeout exceeded pulling image")
+			}
+			// the blob could have been removed by GC before it was linked, in which
+			// case it is pulled again
+			continue
+		}
+		c := &blobCall{done: make(chan struct{})}
+		bs.calls[dgst] = c
+		bs.mu.Unlock()
+
+		c.err = stage(staged, dgst, pull)
+		bs.mu.Lock()
+		delete(bs.calls, dgst)
+		var sb *stagedBlob
+		if c.err == nil {
+			sb = &stagedBlob{path: staged, lastUsed: time.Now(), refs: 1}
+			if info, err := os.Stat(staged); err == nil {
+				sb.size = info.Size()
+			}
+			bs.staged[dgst] = sb
+			bs.gc(bs.policy)
+		}
+		close(c.done)
+		bs.mu.Unlock()
+		if c.err != nil {
+			return c.err
+		}
+		return bs.link(sb, toFile)
+	}
+}
+
+// getSyncOnly implements 'Get' for a sync-only syncer. The first goroutine to request a
+// digest pulls the blob into 'toFile', and the others wait for it to finish and then link
+// or copy its file. If the file was already removed then the waiting goroutine pulls the
+// blob itself.
+func (bs *BlobSyncer) getSyncOnly(dgst string, toFile string, pull func(string) error) error {
+	for {
+		bs.mu.Lock()
+		if c, exists := bs.calls[dgst]; exists {
+			bs.mu.Unlock()
+			select {
+			case <-c.done:
+				if c.err != nil {
+					return c.err
+				}
+			case <-time.After(bs.timeout):
+				return errors.New("timeout exceeded pulling image")
+			}
+			if c.path == toFile || linkOrCopy(c.path, toFile) == nil {
+				return nil
+			}
+			continue
+		}
+		c := &blobCall{done: make(chan struct{}), path: toFile}
+		bs.calls[dgst] = c
+		bs.mu.Unlock()
+
+		c.err = pull(toFile)
+		bs.mu.Lock()
+		delete(bs.calls, dgst)
+		close(c.done)
+		bs.mu.Unlock()
+		return c.err
+	}
+}
+
+// SetVerify enables or disables re-hashing staged blobs each time they are used. If a
+// staged blob doesn't match its digest then it is removed and pulled again. This
+// protects a long-lived syncer from corruption of the staging directory, at the cost
+// of reading each blob every time it is used.
+func (bs *BlobSyncer) SetVerify(verify bool) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.verify = verify
+}
+
+// Scrub re-hashes all the staged blobs and removes the ones that don't match their
+// digest, so they are pulled again the next time they are requested. It returns the
+// digests of the removed blobs. Blobs that are being linked or copied are not checked.
+// Scrub is intended to be called periodically, e.g. from a goroutine with a ticker,
+// as an alternative to 'SetVerify'.
+func (bs *BlobSyncer) Scrub() []string {
+	bs.mu.Lock()
+	digests := slices.Sorted(maps.Keys(bs.staged))
+	bs.mu.Unlock()
+	evicted := []string{}
+	for _, dgst := range digests {
+		bs.mu.Lock()
+		sb, exists := bs.staged[dgst]
+		if !exists || sb.refs != 0 {
+			bs.mu.Unlock()
+			continue
+		}
+		sb.refs++
+		bs.mu.Unlock()
+		if verifyFile(sb.path, dgst) != nil {
+			bs.evict(dgst, sb)
+			evicted = append(evicted, dgst)
+			continue
+		}
+		bs.mu.Lock()
+		sb.refs--
+		bs.mu.Unlock()
+	}
+	return evicted
+}
+
+// SetGCPolicy sets a policy that is applied each time a blob is staged, so that the
+// staging directory doesn't grow without limit when the receiver is long-lived. The
+// policy is also applied immediately.
+func (bs *BlobSyncer) SetGCPolicy(policy GCPolicy) GCResult {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.policy = policy
+	return bs.gc(policy)
+}
+
+// GC removes staged blobs according to the passed policy and returns the number of
+// blobs and bytes removed. Blobs that are being linked or copied are not removed. A
+// removed blob is pulled again the next time it is requested.
+func (bs *BlobSyncer) GC(policy GCPolicy) GCResult {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return bs.gc(policy)
+}
+
+// Size returns the number of staged blobs and their total size in bytes.
+func (bs *BlobSyncer) Size() (int, int64) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	var size int64
+	for _, sb := range bs.staged {
+		size += sb.size
+	}
+	return len(bs.staged), size
+}
+
+// Close removes the staging directory of the receiver. Files that were linked or copied
+// from the staging directory are not affected.
+func (bs *BlobSyncer) Close() error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if bs.dir == "" {
+		return nil
+	}
+	err := os.RemoveAll(bs.dir)
+	bs.dir = ""
+	clear(bs.staged)
+	return err
+}
+
+// gc implements 'GC'. The caller must hold the lock.
+func (bs *BlobSyncer) gc(policy GCPolicy) GCResult {
+	result := GCResult{}
+	if policy.MaxAge == 0 && policy.MaxSize == 0 {
+		return result
+	}
+	// least recently used first
+	lru := slices.SortedFunc(maps.Keys(bs.staged), func(a, b string) int {
+		return bs.staged[a].lastUsed.Compare(bs.staged[b].lastUsed)
+	})
+	var size int64
+	for _, sb := range bs.staged {
+		size += sb.size
+	}
+	cutoff := time.Now().Add(-policy.MaxAge)
+	for _, dgst := range lru {
+		sb := bs.staged[dgst]
+		expired := policy.MaxAge != 0 && sb.lastUsed.Before(cutoff)
+		tooBig := policy.MaxSize != 0 && size > policy.MaxSize
+		if !expired && !tooBig {
+			break
+		}
+		if sb.refs != 0 {
+			continue
 		}
-		delete(blobPulls.pullMap, digest)
+		if err := os.Remove(sb.path); err != nil && !os.IsNotExist(err) {
+			continue
+		}
+		delete(bs.staged, dgst)
+		size -= sb.size
+		result.Blobs++
+		result.Bytes += sb.size
+	}
+	return result
+}
+
+// evict removes the passed staged blob from the receiver and releases the reference to
+// the blob taken by the caller. The file is only removed if no other goroutine has a
+// reference to it. Otherwise it is left for them to finish with, and will be replaced
+// when the blob is staged again.
+func (bs *BlobSyncer) evict(dgst string, sb *stagedBlob) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	sb.refs--
+	if bs.staged[dgst] == sb {
+		delete(bs.staged, dgst)
+	}
+	if sb.refs == 0 {
+		os.Remove(sb.path)
 	}
-	blobPulls.mu.Unlock()
 }
 
-// Wait waits to be signaled on the channel in the passed syncObj, or times out
-// based on the value of the package blobTimeoutSec variable.
-func Wait(so SyncObj) error {
-	select {
-	case <-so.Ch:
+// link links or copies the passed staged blob to 'toFile' and then releases the
+// reference to the blob taken by the caller.
+func (bs *BlobSyncer) link(sb *stagedBlob, toFile string) error {
+	defer func() {
+		bs.mu.Lock()
+		sb.refs--
+		bs.mu.Unlock()
+	}()
+	return linkOrCopy(sb.path, toFile)
+}
+
+// stagedPath returns the path in the staging directory for the passed digest, creating
+// the staging directory if it does not exist. The digest is validated so that it can
+// safely be used as a path.
+func (bs *BlobSyncer) stagedPath(dgst string) (string, error) {
+	d, err := digest.Parse(dgst)
+	if err != nil {
+		return "", fmt.Errorf("invalid blob digest %q: %w", dgst, err)
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if bs.dir == "" {
+		if bs.dir, err = os.MkdirTemp("", "imgpull.blobs."); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(bs.dir, d.Algorithm().String()+"-"+d.Encoded()), nil
+}
+
+// stage calls the passed 'pull' function to pull a blob into a temp file next to the
+// passed staged path, verifies the temp file against the passed digest, and then renames
+// the temp file to the staged path so that a partially pulled blob, or a blob that doesn't
+// match its digest, is never staged.
+func stage(staged string, dgst string, pull func(string) error) error {
+	tmp := staged + ".partial"
+	err := pull(tmp)
+	if err == nil {
+		err = verifyFile(tmp, dgst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, staged)
+}
+
+// verifyFile returns an error if the content of the passed file doesn't match the
+// passed digest.
+func verifyFile(path string, dgst string) error {
+	d, err := digest.Parse(dgst)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	verifier := d.Verifier()
+	if _, err := io.Copy(verifier, f); err != nil {
+		return err
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("blob %q doesn't match its digest", dgst)
+	}
+	return nil
+}
+
+// linkOrCopy hard-links the passed staged file to 'toFile', replacing 'toFile' if it
+// exists. If the files are on different file systems (or the file system doesn't support
+// links) then the staged file is copied instead. A partial copy is removed.
+func linkOrCopy(staged string, toFile string) (err error) {
+	if err := os.Remove(toFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if os.Link(staged, toFile) == nil {
 		return nil
-	case <-time.After(time.Duration(blobTimeoutSec) * time.Second):
-		return errors.New("timeout exceeded pulling image")
 	}
+	in, err := os.Open(staged)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(toFile)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		out.Close()
+		if err != nil {
+			os.Remove(toFile)
+		}
+	}()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Close()
 }
@@ -1,41 +1,92 @@
 package blobsync
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/opencontainers/go-digest"
 )
 
+const testDigest = "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+
 func TestSetConcur(t *testing.T) {
+	if Default() != nil {
+		t.Fail()
+	}
 	SetConcurrentBlobs(42)
-	if blobTimeoutSec != 42 || blobPulls.pullMap == nil {
+	bs := Default()
+	if bs == nil || bs.timeout != 42*time.Second || bs.calls == nil || !bs.syncOnly {
 		t.Fail()
 	}
 }
 
-// Tests that concurrent requests for the same digest will result in
-// only one goroutine executing the pull logic, simulated here with
-// incrementing a counter.
+// Tests that a sync-only syncer pulls once for concurrent requests, gives every
+// goroutine the blob at its own path, and doesn't stage anything.
+func TestSyncOnly(t *testing.T) {
+	var counter atomic.Uint64
+	var wg sync.WaitGroup
+	bs := NewBlobSyncer(10)
+	bs.syncOnly = true
+	d := t.TempDir()
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := bs.Get(testDigest, filepath.Join(d, fmt.Sprintf("blob%d", i)), func(toFile string) error {
+				counter.Add(1)
+				time.Sleep(500 * time.Millisecond)
+				return os.WriteFile(toFile, []byte("foo"), 0644)
+			})
+			if err != nil {
+				t.Fail()
+			}
+		}()
+	}
+	wg.Wait()
+	if counter.Load() != 1 || bs.dir != "" {
+		t.Errorf("expected one pull and no staging directory, got %d pulls and %q", counter.Load(), bs.dir)
+	}
+	for i := 0; i < 3; i++ {
+		if b, err := os.ReadFile(filepath.Join(d, fmt.Sprintf("blob%d", i))); err != nil || string(b) != "foo" {
+			t.Fail()
+		}
+	}
+	// nothing is staged so the next request pulls again
+	if bs.Get(testDigest, filepath.Join(d, "blob"), func(toFile string) error {
+		counter.Add(1)
+		return os.WriteFile(toFile, []byte("foo"), 0644)
+	}) != nil || counter.Load() != 2 {
+		t.Errorf("expected the blob to be pulled again")
+	}
+}
+
+// Tests that concurrent requests for the same digest will result in only one
+// goroutine executing the pull logic, simulated here with incrementing a counter,
+// and that every goroutine gets the blob at its own path.
 func TestQueue(t *testing.T) {
 	var counter atomic.Uint64
 	var wg sync.WaitGroup
-	digest := "frobozz"
-	SetConcurrentBlobs(10)
+	bs := NewBlobSyncer(10)
+	defer bs.Close()
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
 
 	for i := 0; i < 5; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			so := EnqueueGet(digest)
-			go func() {
-				if so.Result == NotEnqueued {
-					counter.Add(1)
-					time.Sleep(1 * time.Second)
-					DoneGet(digest)
-				}
-			}()
-			if Wait(so) != nil {
+			err := bs.Get(testDigest, filepath.Join(d, fmt.Sprintf("blob%d", i)), func(toFile string) error {
+				counter.Add(1)
+				time.Sleep(1 * time.Second)
+				return os.WriteFile(toFile, []byte("foo"), 0644)
+			})
+			if err != nil {
 				t.Fail()
 			}
 		}()
@@ -44,4 +95,239 @@ func TestQueue(t *testing.T) {
 	if counter.Load() != 1 {
 		t.Fail()
 	}
+	for i := 0; i < 5; i++ {
+		if b, err := os.ReadFile(filepath.Join(d, fmt.Sprintf("blob%d", i))); err != nil || string(b) != "foo" {
+			t.Fail()
+		}
+	}
+}
+
+// Tests that once a blob is staged, later requests are satisfied from the staging
+// directory without pulling.
+func TestStaged(t *testing.T) {
+	bs := NewBlobSyncer(10)
+	defer bs.Close()
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+	pulls := 0
+	pull := func(toFile string) error {
+		pulls++
+		return os.WriteFile(toFile, []byte("foo"), 0644)
+	}
+	for _, f := range []string{"a", "b", "a"} {
+		if bs.Get(testDigest, filepath.Join(d, f), pull) != nil {
+			t.FailNow()
+		}
+	}
+	if pulls != 1 {
+		t.Fail()
+	}
+	if bs.Close() != nil {
+		t.FailNow()
+	}
+	if b, err := os.ReadFile(filepath.Join(d, "b")); err != nil || string(b) != "foo" {
+		t.Fail()
+	}
+}
+
+// Tests that if the pull fails then every goroutine waiting on the pull gets the
+// error, nothing is staged, and the next request pulls again.
+func TestPullErr(t *testing.T) {
+	var wg sync.WaitGroup
+	var errCnt atomic.Uint64
+	bs := NewBlobSyncer(10)
+	defer bs.Close()
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := bs.Get(testDigest, filepath.Join(d, fmt.Sprintf("blob%d", i)), func(toFile string) error {
+				os.WriteFile(toFile, []byte("fo"), 0644)
+				time.Sleep(500 * time.Millisecond)
+				return errors.New("frobozz")
+			})
+			if err != nil && err.Error() == "frobozz" {
+				errCnt.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if errCnt.Load() != 3 {
+		t.Fail()
+	}
+	if entries, _ := os.ReadDir(d); len(entries) != 0 {
+		t.Fail()
+	}
+	pulled := false
+	err := bs.Get(testDigest, filepath.Join(d, "blob"), func(toFile string) error {
+		pulled = true
+		return os.WriteFile(toFile, []byte("foo"), 0644)
+	})
+	if err != nil || !pulled {
+		t.Fail()
+	}
+}
+
+// Tests that a pulled blob that doesn't match its digest is not staged, and that the
+// next request pulls again.
+func TestPullMismatch(t *testing.T) {
+	bs := NewBlobSyncer(10)
+	defer bs.Close()
+	d := t.TempDir()
+	content := "fo0"
+	pull := func(toFile string) error {
+		return os.WriteFile(toFile, []byte(content), 0644)
+	}
+	if err := bs.Get(testDigest, filepath.Join(d, "a"), pull); err == nil {
+		t.Errorf("expected a digest mismatch")
+	}
+	if blobs, _ := bs.Size(); blobs != 0 {
+		t.Errorf("expected nothing staged, got %d blobs", blobs)
+	}
+	if _, err := os.Stat(filepath.Join(d, "a")); !os.IsNotExist(err) {
+		t.Errorf("expected no blob file")
+	}
+	content = "foo"
+	if err := bs.Get(testDigest, filepath.Join(d, "a"), pull); err != nil {
+		t.Errorf("expected the blob to be pulled again: %s", err)
+	}
+}
+
+// Tests that syncers are independent of each other: the first requester on
+// each syncer pulls, and a timeout on one syncer doesn't affect the other.
+func TestIndependentSyncers(t *testing.T) {
+	bs1 := NewBlobSyncer(0)
+	defer bs1.Close()
+	bs2 := NewBlobSyncer(10)
+	defer bs2.Close()
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+	pulling := make(chan struct{})
+	release := make(chan struct{})
+	go bs1.Get(testDigest, filepath.Join(d, "a"), func(toFile string) error {
+		close(pulling)
+		<-release
+		return os.WriteFile(toFile, []byte("foo"), 0644)
+	})
+	<-pulling
+	if bs1.Get(testDigest, filepath.Join(d, "b"), func(string) error { return nil }) == nil {
+		t.Fail()
+	}
+	pulled := false
+	err := bs2.Get(testDigest, filepath.Join(d, "c"), func(toFile string) error {
+		pulled = true
+		return os.WriteFile(toFile, []byte("foo"), 0644)
+	})
+	if err != nil || !pulled {
+		t.Fail()
+	}
+	close(release)
+}
+
+// Tests that an invalid digest is rejected rather than used as a path.
+func TestInvalidDigest(t *testing.T) {
+	bs := NewBlobSyncer(10)
+	defer bs.Close()
+	if bs.Get("sha256:../../etc/passwd", "foo", func(string) error { return nil }) == nil {
+		t.Fail()
+	}
+}
+
+// Tests that GC removes blobs by age and then least recently used by size, that a blob
+// in use is not removed, that a policy is applied when blobs are staged, and that a
+// removed blob is pulled again.
+func TestGC(t *testing.T) {
+	bs := NewBlobSyncer(10)
+	defer bs.Close()
+	d := t.TempDir()
+	pulls := 0
+	pull := func(content string) func(string) error {
+		return func(toFile string) error {
+			pulls++
+			return os.WriteFile(toFile, []byte(content), 0644)
+		}
+	}
+	digests := []string{}
+	for i := 0; i < 4; i++ {
+		dgst := digest.FromString(fmt.Sprint("fo", i)).String()
+		digests = append(digests, dgst)
+		if bs.Get(dgst, filepath.Join(d, fmt.Sprint(i)), pull(fmt.Sprint("fo", i))) != nil {
+			t.FailNow()
+		}
+		bs.staged[dgst].lastUsed = time.Now().Add(time.Duration(i-4) * time.Hour)
+	}
+	if blobs, size := bs.Size(); blobs != 4 || size != 12 {
+		t.Fatalf("expected 4 blobs and 12 bytes, got %d and %d", blobs, size)
+	}
+	// the oldest blob is expired but in use
+	bs.staged[digests[0]].refs++
+	if result := bs.GC(GCPolicy{MaxAge: 150 * time.Minute}); result.Blobs != 1 || result.Bytes != 3 {
+		t.Errorf("expected one blob removed by age, got %+v", result)
+	}
+	bs.staged[digests[0]].refs--
+	if _, found := bs.staged[digests[1]]; found {
+		t.Errorf("expected the expired blob to be removed")
+	}
+	if result := bs.GC(GCPolicy{MaxSize: 6}); result.Blobs != 1 || bs.staged[digests[0]] != nil {
+		t.Errorf("expected the least recently used blob removed by size, got %+v", result)
+	}
+	if _, size := bs.Size(); size != 6 {
+		t.Errorf("expected 6 bytes, got %d", size)
+	}
+	bs.SetGCPolicy(GCPolicy{MaxSize: 6})
+	if bs.Get(digests[0], filepath.Join(d, "again"), pull("fo0")) != nil || pulls != 5 {
+		t.Errorf("expected a removed blob to be pulled again")
+	}
+	if blobs, size := bs.Size(); blobs != 2 || size != 6 || bs.staged[digests[0]] == nil {
+		t.Errorf("expected the policy to be applied when staging, got %d blobs and %d bytes", blobs, size)
+	}
+	if b, err := os.ReadFile(filepath.Join(d, "0")); err != nil || string(b) != "fo0" {
+		t.Errorf("expected linked blobs to be unaffected by GC")
+	}
+}
+
+// Tests that a corrupted staged blob is pulled again when verification is enabled, and
+// that scrubbing removes a corrupted staged blob.
+func TestVerify(t *testing.T) {
+	bs := NewBlobSyncer(10)
+	defer bs.Close()
+	d := t.TempDir()
+	pulls := 0
+	pull := func(toFile string) error {
+		pulls++
+		return os.WriteFile(toFile, []byte("foo"), 0644)
+	}
+	corrupt := func() {
+		path := bs.staged[testDigest].path
+		// replace rather than overwrite so files linked to the staged blob are unaffected
+		if os.Remove(path) != nil || os.WriteFile(path, []byte("fo0"), 0644) != nil {
+			t.FailNow()
+		}
+	}
+	if bs.Get(testDigest, filepath.Join(d, "a"), pull) != nil {
+		t.FailNow()
+	}
+	corrupt()
+	if bs.Get(testDigest, filepath.Join(d, "b"), pull) != nil || pulls != 1 {
+		t.Errorf("expected the staged blob to be used without verification")
+	}
+	bs.SetVerify(true)
+	if bs.Get(testDigest, filepath.Join(d, "c"), pull) != nil || pulls != 2 {
+		t.Errorf("expected the corrupted blob to be pulled again")
+	}
+	if b, err := os.ReadFile(filepath.Join(d, "c")); err != nil || string(b) != "foo" {
+		t.Errorf("expected the pulled blob, got %q", string(b))
+	}
+	if evicted := bs.Scrub(); len(evicted) != 0 {
+		t.Errorf("expected nothing scrubbed, got %v", evicted)
+	}
+	corrupt()
+	if evicted := bs.Scrub(); len(evicted) != 1 || evicted[0] != testDigest {
+		t.Errorf("expected the corrupted blob to be scrubbed, got %v", evicted)
+	}
+	if blobs, _ := bs.Size(); blobs != 0 {
+		t.Errorf("expected no staged blobs")
+	}
 }
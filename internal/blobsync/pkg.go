@@ -1,13 +1,21 @@
 // Package blobsync supports using the library to concurrently pull blobs
 // from multiple goroutines. Rather than have multiple goroutines attempt to
-// pull the same blob at the same time, duplicate concurrent blob pulls are
-// enqueued and only the first one in does the pull - the other goroutines
-// wait and simply use the blob pulled by the first goroutine.
+// pull the same blob at the same time, only the first one in does the pull -
+// into a content-addressed staging directory - and the other goroutines wait
+// and simply use the blob pulled by the first goroutine. Each goroutine gets a
+// link to (or copy of) the staged blob at the path it requested.
 //
-// Concurrency is not enabled in the library by default, which supports using
-// the project as a CLI to simply pull image tarballs. To enable blob
-// concurrency with a sixty second timeout on all blob pulls:
+// Synchronization happens within a BlobSyncer, so goroutines are only
+// synchronized with other goroutines using the same syncer. Concurrency is not
+// enabled in the library by default, which supports using the project as a CLI
+// to simply pull image tarballs. To get a syncer with a sixty second timeout on
+// all blob pulls:
 //
 //	sixtySeconds := 60
+//	bs := blobsync.NewBlobSyncer(sixtySeconds)
+//
+// Or, to enable a process-wide syncer that is returned by 'Default', which only
+// synchronizes pulls and doesn't stage blobs:
+//
 //	blobsync.SetConcurrentBlobs(sixtySeconds)
 package blobsync
@@ -2,11 +2,14 @@ package imgref
 
 import (
 	"fmt"
+	"net"
 	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/aceeric/imgpull/internal/util"
+	"github.com/opencontainers/go-digest"
 )
 
 // imgPullType specifies whether pulling my tag or digest
@@ -47,48 +50,95 @@ type ImageRef struct {
 	// like when docker.io/hello-world is requested then have
 	// to talk to docker api with .../library/hello-world/...
 	library bool
+	// basePath is the path that the v2 API is under for registries like
+	// Artifactory, e.g. '/artifactory/api/docker/docker-local'. Empty for
+	// registries that serve the v2 API from the root.
+	basePath string
 }
 
+// maxNameLength is the maximum length of the registry and repository together
+const maxNameLength = 255
+
+// domainComponent is one dot-separated component of a registry hostname
+const domainComponent = `(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])`
+
+// These implement the reference grammar of the OCI distribution spec and
+// github.com/distribution/reference.
 var (
-	digestRe   = regexp.MustCompile(`(.*)@(sha256:[a-f0-9]{64})\b`)
-	tagRe      = regexp.MustCompile(`(.*):(.*)\b`)
-	dockerRegs = []string{"docker.io", "index.docker.io"}
+	domainRe        = regexp.MustCompile(`^` + domainComponent + `(?:\.` + domainComponent + `)*(?::([0-9]+))?$`)
+	ipv6Re          = regexp.MustCompile(`^\[([0-9a-fA-F:.]+)\](?::([0-9]+))?$`)
+	pathComponentRe = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]+)[a-z0-9]+)*$`)
+	tagRe           = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	// dockerHubServers are the hosts that serve the DockerHub API. The host that
+	// Docker uses has changed over time, so if one fails the other is tried.
+	dockerHubServers = []string{"index.docker.io", "registry-1.docker.io"}
 )
 
+// DockerHub is the registry name of DockerHub. Image urls with any of the DockerHub
+// API hosts as the registry are normalized to this name.
+const DockerHub = "docker.io"
+
+// NormalizeRegistry returns 'docker.io' if the passed registry is 'docker.io' or one of
+// the DockerHub API hosts, else the passed registry unchanged. This is how registries are
+// matched to sessions and config.
+func NormalizeRegistry(registry string) string {
+	if slices.Contains(dockerHubServers, registry) {
+		return DockerHub
+	}
+	return registry
+}
+
 // NewImageRef parses the passed image url (e.g. docker.io/hello-world:latest) into
 // an 'imageRef' struct. The url MUST begin with a registry hostname (e.g. quay.io or
-// localhost:8080) - it is not (and cannot be) inferred.
+// localhost:8080) - it is not (and cannot be) inferred. The registry, repository, tag,
+// and digest are validated against the distribution reference grammar.
 func NewImageRef(url, scheme, namespace string) (ImageRef, error) {
 	ir := ImageRef{
 		scheme:    scheme,
 		namespace: namespace,
 	}
+	if namespace != "" {
+		if err := validateHost(namespace); err != nil {
+			return ImageRef{}, fmt.Errorf("invalid namespace %q: %w", namespace, err)
+		}
+	}
 	before, after, found := strings.Cut(url, "/")
 	if !found || after == "" {
 		return ImageRef{}, fmt.Errorf("unable to parse image url %q (at least two segments required)", url)
 	}
-	ir.registry = before
-	ir.server = ir.registry
-	if ir.server == "docker.io" {
-		ir.server = "index.docker.io"
+	if err := validateHost(before); err != nil {
+		return ImageRef{}, fmt.Errorf("unable to parse image url %q (invalid registry %q: %w)", url, before, err)
+	}
+	ir.registry = NormalizeRegistry(before)
+	ir.server = before
+	if ir.server == DockerHub {
+		ir.server = dockerHubServers[0]
 	}
 	// check for in-path namespace
 	ns, remainder, found := strings.Cut(after, "/")
-	if found && strings.Contains(ns, ".") {
+	if found && (strings.Contains(ns, ".") || strings.HasPrefix(ns, "[")) {
+		if err := validateHost(ns); err != nil {
+			return ImageRef{}, fmt.Errorf("unable to parse image url %q (invalid namespace %q: %w)", url, ns, err)
+		}
 		ir.namespace = ns
 		after = remainder
 		ir.nsInPath = true
 	}
-	remainder, ref, pullType := parseAfterReg(after)
+	remainder, ref, pullType, err := parseAfterReg(after)
+	if err != nil {
+		return ImageRef{}, fmt.Errorf("unable to parse image url %q (%w)", url, err)
+	}
 	ir.pullType = pullType
 	ir.ref = ref
 	ir.repository = remainder
-	if strings.Contains(ir.repository, ".") {
-		return ImageRef{}, fmt.Errorf("unable to parse image url %q (period in repository not allowed)", url)
-
+	if err := validateRepository(ir.repository); err != nil {
+		return ImageRef{}, fmt.Errorf("unable to parse image url %q (%w)", url, err)
+	}
+	if len(ir.registry)+1+len(ir.repository) > maxNameLength {
+		return ImageRef{}, fmt.Errorf("unable to parse image url %q (name exceeds %d characters)", url, maxNameLength)
 	}
 	_, _, found = strings.Cut(ir.repository, "/")
-	if !found && slices.Contains(dockerRegs, ir.server) {
+	if !found && ir.registry == DockerHub {
 		// pulling from dockerhub without bare repo like "hello-world" and
 		// without "library/" in the repository name
 		ir.library = true
@@ -150,23 +200,126 @@ func (ir *ImageRef) UrlWithDigest(digest string) string {
 }
 
 // ServerUrl handles the case where an image is pulled from docker.io but the package
-// has to access the DockerHub API on host index.docker.io so the receiver would have
-// a 'Registry' value of docker.io and a 'Server' value of index.docker.io. This function
-// is used whenver API calls are made - to return 'Server'. This seems to be unique to
-// DockerHub.
+// has to access the DockerHub API on host index.docker.io (or registry-1.docker.io) so
+// the receiver would have a 'Registry' value of docker.io and a 'Server' value of
+// index.docker.io. This function is used whenver API calls are made - to return 'Server'.
+// This seems to be unique to DockerHub.
+//
+// If the receiver has a base path then it is appended, since the API calls are all
+// under the base path.
 func (ir *ImageRef) ServerUrl() string {
-	return fmt.Sprintf("%s://%s", ir.scheme, ir.server)
+	return fmt.Sprintf("%s://%s%s", ir.scheme, ir.server, ir.basePath)
+}
+
+// FallbackServer returns a copy of the receiver that uses the next DockerHub API host
+// after the one in the receiver, and true. If the receiver isn't for DockerHub, or all
+// the hosts have been tried, then the receiver is returned with false.
+func (ir ImageRef) FallbackServer() (ImageRef, bool) {
+	if ir.registry != DockerHub {
+		return ir, false
+	}
+	i := slices.Index(dockerHubServers, ir.server)
+	if i < 0 || i == len(dockerHubServers)-1 {
+		return ir, false
+	}
+	ir.server = dockerHubServers[i+1]
+	return ir, true
+}
+
+// Server returns the host that API calls are made to, which is the registry except
+// for DockerHub. See 'ServerUrl'.
+func (ir *ImageRef) Server() string {
+	return ir.server
+}
+
+// WithServer returns a copy of the receiver that makes API calls to the passed host.
+func (ir ImageRef) WithServer(server string) ImageRef {
+	ir.server = server
+	return ir
+}
+
+// WithBasePath returns a copy of the receiver that makes API calls under the passed path,
+// like '/artifactory/api/docker/docker-local'. A leading slash is added and a trailing
+// slash is removed if needed. An empty path means the v2 API is at the root.
+func (ir ImageRef) WithBasePath(basePath string) ImageRef {
+	basePath = strings.TrimRight(basePath, "/")
+	if basePath != "" && !strings.HasPrefix(basePath, "/") {
+		basePath = "/" + basePath
+	}
+	ir.basePath = basePath
+	return ir
+}
+
+// WithScheme returns a copy of the receiver with the passed scheme.
+func (ir ImageRef) WithScheme(scheme string) ImageRef {
+	ir.scheme = scheme
+	return ir
+}
+
+// ByDigest returns true if the image is referenced by digest rather than by tag.
+func (ir *ImageRef) ByDigest() bool {
+	return ir.pullType == byDigest
+}
+
+// parseAfterReg parses the passed string into the repository and either a digest
+// reference or a tag reference. If neither then it is treated as by tag with tag
+// "latest". If there is both a tag and a digest then the digest is used. The tag
+// and digest are validated, the repository is not.
+func parseAfterReg(urlPart string) (string, string, imgPullType, error) {
+	name, dgst, byDgst := strings.Cut(urlPart, "@")
+	if byDgst {
+		if _, err := digest.Parse(dgst); err != nil {
+			return "", "", undefinedPullType, fmt.Errorf("invalid digest %q: %w", dgst, err)
+		}
+	}
+	tag := ""
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		name, tag = name[:i], name[i+1:]
+		if !tagRe.MatchString(tag) {
+			return "", "", undefinedPullType, fmt.Errorf("invalid tag %q: must be up to 128 word characters, periods, and dashes not starting with a period or dash", tag)
+		}
+	}
+	if byDgst {
+		return name, dgst, byDigest, nil
+	} else if tag != "" {
+		return name, tag, byTag, nil
+	}
+	return name, "latest", byTag, nil
+}
+
+// validateHost validates the passed registry host, which is a hostname like 'quay.io', or
+// a bracketed IPv6 address like '[::1]', with an optional port. IPv4 addresses are valid
+// hostnames. The port must be a number from 1 to 65535 with no leading zeros.
+func validateHost(host string) error {
+	port := ""
+	if m := ipv6Re.FindStringSubmatch(host); m != nil {
+		if ip := net.ParseIP(m[1]); ip == nil || !strings.Contains(m[1], ":") {
+			return fmt.Errorf("%q is not an IPv6 address", m[1])
+		}
+		port = m[2]
+	} else if m := domainRe.FindStringSubmatch(host); m != nil {
+		port = m[1]
+	} else if strings.HasPrefix(host, "[") {
+		return fmt.Errorf("must be a bracketed IPv6 address with an optional port")
+	} else {
+		return fmt.Errorf("must be a hostname with an optional port")
+	}
+	if port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 || port[0] == '0' {
+			return fmt.Errorf("invalid port %q: must be a number from 1 to 65535", port)
+		}
+	}
+	return nil
 }
 
-// parseAfterReg tries to parse the passed string as having either a digest reference or
-// a tag reference. If neither then it is treated as by tag with tag "latest".
-func parseAfterReg(urlPart string) (string, string, imgPullType) {
-	if result := digestRe.FindStringSubmatch(urlPart); len(result) == 3 {
-		return result[1], result[2], byDigest
-	} else if result := tagRe.FindStringSubmatch(urlPart); len(result) == 3 {
-		return result[1], result[2], byTag
+// validateRepository validates each slash-separated component of the passed repository.
+func validateRepository(repository string) error {
+	for component := range strings.SplitSeq(repository, "/") {
+		if !pathComponentRe.MatchString(component) {
+			return fmt.Errorf("invalid repository %q: component %q must be lowercase alphanumerics separated by periods, underscores, or dashes", repository, component)
+		}
 	}
-	return urlPart, "latest", byTag
+	return nil
 }
 
 // makeUrl does the actual work for 'ImageUrl', 'UrlWithNs', and
@@ -177,7 +330,7 @@ func (ir *ImageRef) makeUrl(sha string, withNs bool) string {
 		regToUse = ir.namespace
 	}
 	var refToUse string
-	if strings.HasPrefix(ir.ref, "sha256:") {
+	if ir.pullType == byDigest {
 		refToUse = "@" + ir.ref
 	} else if sha != "" {
 		refToUse = "@sha256:" + util.DigestFrom(sha)
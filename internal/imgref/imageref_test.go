@@ -2,6 +2,7 @@ package imgref
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -50,10 +51,49 @@ var testCases = []testCase{
 	{30, "docker.io/foo:v1.2.3", "https", "xyz.io", false, ImageRef{registry: "docker.io", pullType: byTag, server: "index.docker.io", repository: "foo", ref: "v1.2.3", scheme: "https", namespace: "xyz.io", nsInPath: false, library: true}},
 	{31, "docker.io/foo@sha256:" + sha, "https", "xyz.io", false, ImageRef{registry: "docker.io", pullType: byDigest, server: "index.docker.io", repository: "foo", ref: "sha256:" + sha, scheme: "https", namespace: "xyz.io", nsInPath: false, library: true}},
 	{32, "invalid-ref", "https", "", true, ImageRef{}},
-	{33, "docker.io/frobozz.io:v1.1.1", "https", "", true, ImageRef{}},
-	{34, "docker.io/frobozz.io@sha256:" + sha, "https", "", true, ImageRef{}},
+	{33, "docker.io/frobozz.io:v1.1.1", "https", "", false, ImageRef{registry: "docker.io", pullType: byTag, server: "index.docker.io", repository: "frobozz.io", ref: "v1.1.1", scheme: "https", namespace: "", nsInPath: false, library: true}},
+	{34, "docker.io/frobozz.io@sha256:" + sha, "https", "", false, ImageRef{registry: "docker.io", pullType: byDigest, server: "index.docker.io", repository: "frobozz.io", ref: "sha256:" + sha, scheme: "https", namespace: "", nsInPath: false, library: true}},
 	{35, "docker.io/frobozz.io:8888:v1.1.1", "https", "", true, ImageRef{}},
-	{36, "docker.io/frobozz.io:8888@sha256:" + sha, "https", "", true, ImageRef{}},
+	{36, "docker.io/frobozz.io:8888@sha256:" + sha, "https", "", false, ImageRef{registry: "docker.io", pullType: byDigest, server: "index.docker.io", repository: "frobozz.io", ref: "sha256:" + sha, scheme: "https", namespace: "", nsInPath: false, library: true}},
+	{37, "docker.io/foo/bar:v1@sha256:" + sha, "https", "", false, ImageRef{registry: "docker.io", pullType: byDigest, server: "index.docker.io", repository: "foo/bar", ref: "sha256:" + sha, scheme: "https", namespace: "", nsInPath: false, library: false}},
+	{38, "quay.io/foo/bar_baz-1:1.0_rc", "https", "", false, ImageRef{registry: "quay.io", pullType: byTag, server: "quay.io", repository: "foo/bar_baz-1", ref: "1.0_rc", scheme: "https", namespace: "", nsInPath: false, library: false}},
+	{39, "docker.io/Foo", "https", "", true, ImageRef{}},
+	{40, "docker.io/foo:", "https", "", true, ImageRef{}},
+	{41, "docker.io/foo:-v1", "https", "", true, ImageRef{}},
+	{42, "docker.io/foo@sha256:abc", "https", "", true, ImageRef{}},
+	{43, "docker.io/foo@sha256:" + strings.ToUpper(sha[:60]) + "ABCD", "https", "", true, ImageRef{}},
+	{44, "docker.io/foo//bar", "https", "", true, ImageRef{}},
+	{45, "docker.io/foo/bar-", "https", "", true, ImageRef{}},
+	{46, "-docker.io/foo", "https", "", true, ImageRef{}},
+	{47, "docker.io:port/foo", "https", "", true, ImageRef{}},
+	{48, "docker.io/" + strings.Repeat("a", 250), "https", "", true, ImageRef{}},
+	{49, "localhost:8888/foo:v1", "https", "not a host", true, ImageRef{}},
+	{50, "index.docker.io/foo", "https", "", false, ImageRef{registry: "docker.io", pullType: byTag, server: "index.docker.io", repository: "foo", ref: "latest", scheme: "https", namespace: "", nsInPath: false, library: true}},
+	{51, "registry-1.docker.io/foo/bar:v1", "https", "", false, ImageRef{registry: "docker.io", pullType: byTag, server: "registry-1.docker.io", repository: "foo/bar", ref: "v1", scheme: "https", namespace: "", nsInPath: false, library: false}},
+	{52, "[::1]:5000/foo:v1", "https", "", false, ImageRef{registry: "[::1]:5000", pullType: byTag, server: "[::1]:5000", repository: "foo", ref: "v1", scheme: "https", namespace: "", nsInPath: false, library: false}},
+	{53, "[::1]/foo", "https", "", false, ImageRef{registry: "[::1]", pullType: byTag, server: "[::1]", repository: "foo", ref: "latest", scheme: "https", namespace: "", nsInPath: false, library: false}},
+	{54, "[2001:db8::1]:5000/foo/bar@sha256:" + sha, "https", "", false, ImageRef{registry: "[2001:db8::1]:5000", pullType: byDigest, server: "[2001:db8::1]:5000", repository: "foo/bar", ref: "sha256:" + sha, scheme: "https", namespace: "", nsInPath: false, library: false}},
+	{55, "[::ffff:192.0.2.1]:443/foo:v1", "https", "", false, ImageRef{registry: "[::ffff:192.0.2.1]:443", pullType: byTag, server: "[::ffff:192.0.2.1]:443", repository: "foo", ref: "v1", scheme: "https", namespace: "", nsInPath: false, library: false}},
+	{56, "localhost:8888/[::1]:5000/foo:v1", "https", "", false, ImageRef{registry: "localhost:8888", pullType: byTag, server: "localhost:8888", repository: "foo", ref: "v1", scheme: "https", namespace: "[::1]:5000", nsInPath: true, library: false}},
+	{57, "[::1]:5000/foo:v1", "https", "[fe80::1]", false, ImageRef{registry: "[::1]:5000", pullType: byTag, server: "[::1]:5000", repository: "foo", ref: "v1", scheme: "https", namespace: "[fe80::1]", nsInPath: false, library: false}},
+	{58, "192.168.1.10:5000/foo:v1", "https", "", false, ImageRef{registry: "192.168.1.10:5000", pullType: byTag, server: "192.168.1.10:5000", repository: "foo", ref: "v1", scheme: "https", namespace: "", nsInPath: false, library: false}},
+	{59, "localhost:65535/foo", "https", "", false, ImageRef{registry: "localhost:65535", pullType: byTag, server: "localhost:65535", repository: "foo", ref: "latest", scheme: "https", namespace: "", nsInPath: false, library: false}},
+	{60, "::1:5000/foo:v1", "https", "", true, ImageRef{}},
+	{61, "[::1:5000/foo:v1", "https", "", true, ImageRef{}},
+	{62, "::1]:5000/foo:v1", "https", "", true, ImageRef{}},
+	{63, "[::1]:/foo", "https", "", true, ImageRef{}},
+	{64, "[::1]5000/foo", "https", "", true, ImageRef{}},
+	{65, "[127.0.0.1]:5000/foo", "https", "", true, ImageRef{}},
+	{66, "[::g]:5000/foo", "https", "", true, ImageRef{}},
+	{67, "[]:5000/foo", "https", "", true, ImageRef{}},
+	{68, "localhost:0/foo", "https", "", true, ImageRef{}},
+	{69, "localhost:65536/foo", "https", "", true, ImageRef{}},
+	{70, "localhost:05000/foo", "https", "", true, ImageRef{}},
+	{71, "localhost:/foo", "https", "", true, ImageRef{}},
+	{72, "localhost:5000:6000/foo", "https", "", true, ImageRef{}},
+	{73, "localhost:99999999999999999999/foo", "https", "", true, ImageRef{}},
+	{74, "localhost:8888/[::1:5000/foo", "https", "", true, ImageRef{}},
+	{75, "localhost:8888/foo:v1", "https", "[::1]:0", true, ImageRef{}},
 }
 
 func Test_UrlParse(t *testing.T) {
@@ -72,3 +112,20 @@ func Test_UrlParse(t *testing.T) {
 		}
 	}
 }
+
+// Tests falling back through the DockerHub API hosts, and that other registries
+// don't fall back.
+func Test_FallbackServer(t *testing.T) {
+	ir, _ := NewImageRef("docker.io/foo", "https", "")
+	ir, found := ir.FallbackServer()
+	if !found || ir.ServerUrl() != "https://registry-1.docker.io" || ir.Url() != "docker.io/foo:latest" {
+		t.Errorf("expected registry-1.docker.io, got %q", ir.ServerUrl())
+	}
+	if _, found := ir.FallbackServer(); found {
+		t.Errorf("expected no more fallback servers")
+	}
+	ir, _ = NewImageRef("quay.io/foo", "https", "")
+	if _, found := ir.FallbackServer(); found {
+		t.Errorf("expected no fallback for quay.io")
+	}
+}
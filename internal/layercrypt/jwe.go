@@ -0,0 +1,373 @@
+package layercrypt
+
+import (
+	"cmp"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// JWE algorithms used by OCIcrypt
+const (
+	algRSAOAEP    = "RSA-OAEP"
+	algRSAOAEP256 = "RSA-OAEP-256"
+	algECDHES     = "ECDH-ES+A256KW"
+	encA256GCM    = "A256GCM"
+)
+
+// jwe is a JWE in the JSON serialization - either general with 'recipients', or
+// flattened with a single 'header' and 'encrypted_key'.
+type jwe struct {
+	Protected    string      `json:"protected,omitempty"`
+	Unprotected  *jweHeader  `json:"unprotected,omitempty"`
+	Header       *jweHeader  `json:"header,omitempty"`
+	EncryptedKey string      `json:"encrypted_key,omitempty"`
+	Recipients   []recipient `json:"recipients,omitempty"`
+	IV           string      `json:"iv"`
+	Ciphertext   string      `json:"ciphertext"`
+	Tag          string      `json:"tag"`
+	AAD          string      `json:"aad,omitempty"`
+}
+
+type recipient struct {
+	Header       *jweHeader `json:"header,omitempty"`
+	EncryptedKey string     `json:"encrypted_key,omitempty"`
+}
+
+// jweHeader has the JWE header parameters that OCIcrypt uses.
+type jweHeader struct {
+	Alg string `json:"alg,omitempty"`
+	Enc string `json:"enc,omitempty"`
+	Zip string `json:"zip,omitempty"`
+	Epk *jwk   `json:"epk,omitempty"`
+	Apu string `json:"apu,omitempty"`
+	Apv string `json:"apv,omitempty"`
+}
+
+// jwk is an EC public key.
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+var b64 = base64.RawURLEncoding
+
+// decryptJWE decrypts the passed JWE with the first of the passed keys that is one of its
+// recipients. If none of the keys is a recipient then ErrNoKey is returned.
+func decryptJWE(b []byte, keys []crypto.PrivateKey) ([]byte, error) {
+	msg := jwe{}
+	if err := json.Unmarshal(b, &msg); err != nil {
+		return nil, fmt.Errorf("unable to parse JWE, error: %w", err)
+	}
+	protected := &jweHeader{}
+	if msg.Protected != "" {
+		hb, err := b64.DecodeString(msg.Protected)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWE protected header, error: %w", err)
+		}
+		if err := json.Unmarshal(hb, protected); err != nil {
+			return nil, fmt.Errorf("unable to parse JWE protected header, error: %w", err)
+		}
+	}
+	recipients := msg.Recipients
+	if len(recipients) == 0 {
+		recipients = []recipient{{Header: msg.Header, EncryptedKey: msg.EncryptedKey}}
+	}
+	iv, err1 := b64.DecodeString(msg.IV)
+	ciphertext, err2 := b64.DecodeString(msg.Ciphertext)
+	tag, err3 := b64.DecodeString(msg.Tag)
+	if err := errors.Join(err1, err2, err3); err != nil {
+		return nil, fmt.Errorf("invalid JWE, error: %w", err)
+	}
+	aad := []byte(msg.Protected)
+	if msg.AAD != "" {
+		aad = append(aad, '.')
+		aad = append(aad, msg.AAD...)
+	}
+	for _, r := range recipients {
+		hdr := mergeHeaders(protected, msg.Unprotected, r.Header)
+		if hdr.Enc != encA256GCM {
+			return nil, fmt.Errorf("unsupported JWE content encryption %q", hdr.Enc)
+		}
+		if hdr.Zip != "" {
+			return nil, fmt.Errorf("unsupported JWE compression %q", hdr.Zip)
+		}
+		encryptedKey, err := b64.DecodeString(r.EncryptedKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWE encrypted key, error: %w", err)
+		}
+		for _, key := range keys {
+			cek, err := unwrapKey(hdr, encryptedKey, key)
+			if err != nil {
+				continue
+			}
+			if plaintext, err := gcmOpen(cek, iv, slices.Concat(ciphertext, tag), aad); err == nil {
+				return plaintext, nil
+			}
+		}
+	}
+	return nil, ErrNoKey
+}
+
+// mergeHeaders returns the union of the passed headers. The JWE spec doesn't allow a
+// parameter to be in more than one, so the first one wins.
+func mergeHeaders(headers ...*jweHeader) jweHeader {
+	m := jweHeader{}
+	for _, h := range headers {
+		if h == nil {
+			continue
+		}
+		m.Alg = cmp.Or(m.Alg, h.Alg)
+		m.Enc = cmp.Or(m.Enc, h.Enc)
+		m.Zip = cmp.Or(m.Zip, h.Zip)
+		m.Apu = cmp.Or(m.Apu, h.Apu)
+		m.Apv = cmp.Or(m.Apv, h.Apv)
+		if m.Epk == nil {
+			m.Epk = h.Epk
+		}
+	}
+	return m
+}
+
+// unwrapKey returns the content encryption key wrapped in 'encryptedKey' for the passed
+// key, according to the 'alg' in the passed header.
+func unwrapKey(hdr jweHeader, encryptedKey []byte, key crypto.PrivateKey) ([]byte, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		switch hdr.Alg {
+		case algRSAOAEP:
+			return rsa.DecryptOAEP(sha1.New(), nil, k, encryptedKey, nil)
+		case algRSAOAEP256:
+			return rsa.DecryptOAEP(sha256.New(), nil, k, encryptedKey, nil)
+		}
+	case *ecdsa.PrivateKey:
+		if hdr.Alg != algECDHES || hdr.Epk == nil {
+			break
+		}
+		priv, err := k.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		pub, err := hdr.Epk.publicKey(priv.Curve())
+		if err != nil {
+			return nil, err
+		}
+		z, err := priv.ECDH(pub)
+		if err != nil {
+			return nil, err
+		}
+		apu, err1 := b64.DecodeString(hdr.Apu)
+		apv, err2 := b64.DecodeString(hdr.Apv)
+		if err := errors.Join(err1, err2); err != nil {
+			return nil, err
+		}
+		return aesKeyUnwrap(concatKDF(z, algECDHES, apu, apv, 32), encryptedKey)
+	}
+	return nil, fmt.Errorf("key type %T can't be used with JWE algorithm %q", key, hdr.Alg)
+}
+
+// curves maps the JWK curve names to the curves
+var curves = map[string]ecdh.Curve{
+	"P-256": ecdh.P256(),
+	"P-384": ecdh.P384(),
+	"P-521": ecdh.P521(),
+}
+
+// publicKey returns the receiver as an ECDH public key, which must be on the passed curve.
+func (k *jwk) publicKey(curve ecdh.Curve) (*ecdh.PublicKey, error) {
+	if k.Kty != "EC" || curves[k.Crv] != curve {
+		return nil, fmt.Errorf("ephemeral key %s/%s doesn't match the decryption key", k.Kty, k.Crv)
+	}
+	x, err1 := b64.DecodeString(k.X)
+	y, err2 := b64.DecodeString(k.Y)
+	if err := errors.Join(err1, err2); err != nil {
+		return nil, err
+	}
+	return curve.NewPublicKey(slices.Concat([]byte{4}, x, y))
+}
+
+// concatKDF derives a key of 'keyLen' bytes from the shared secret 'z' with the Concat
+// KDF from NIST SP 800-56A using SHA-256, as specified for ECDH-ES by RFC 7518.
+func concatKDF(z []byte, alg string, apu []byte, apv []byte, keyLen int) []byte {
+	h := sha256.New()
+	out := []byte{}
+	for counter := uint32(1); len(out) < keyLen; counter++ {
+		h.Reset()
+		h.Write(binary.BigEndian.AppendUint32(nil, counter))
+		h.Write(z)
+		for _, b := range [][]byte{[]byte(alg), apu, apv} {
+			h.Write(binary.BigEndian.AppendUint32(nil, uint32(len(b))))
+			h.Write(b)
+		}
+		h.Write(binary.BigEndian.AppendUint32(nil, uint32(keyLen*8)))
+		out = h.Sum(out)
+	}
+	return out[:keyLen]
+}
+
+// keyWrapIV is the initial value of the RFC 3394 key wrap.
+var keyWrapIV = []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+
+// aesKeyUnwrap unwraps the passed key with the passed key encryption key per RFC 3394.
+func aesKeyUnwrap(kek []byte, wrapped []byte) ([]byte, error) {
+	if len(wrapped)%8 != 0 || len(wrapped) < 24 {
+		return nil, fmt.Errorf("invalid wrapped key length %d", len(wrapped))
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	n := len(wrapped)/8 - 1
+	a := slices.Clone(wrapped[:8])
+	r := slices.Clone(wrapped[8:])
+	buf := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			binary.BigEndian.PutUint64(buf, binary.BigEndian.Uint64(a)^uint64(n*j+i))
+			copy(buf[8:], r[(i-1)*8:i*8])
+			block.Decrypt(buf, buf)
+			copy(a, buf[:8])
+			copy(r[(i-1)*8:], buf[8:])
+		}
+	}
+	if subtle.ConstantTimeCompare(a, keyWrapIV) != 1 {
+		return nil, errors.New("key unwrap integrity check failed")
+	}
+	return r, nil
+}
+
+// aesKeyWrap is the inverse of aesKeyUnwrap.
+func aesKeyWrap(kek []byte, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	n := len(key) / 8
+	a := slices.Clone(keyWrapIV)
+	r := slices.Clone(key)
+	buf := make([]byte, 16)
+	for j := 0; j <= 5; j++ {
+		for i := 1; i <= n; i++ {
+			copy(buf, a)
+			copy(buf[8:], r[(i-1)*8:i*8])
+			block.Encrypt(buf, buf)
+			binary.BigEndian.PutUint64(a, binary.BigEndian.Uint64(buf[:8])^uint64(n*j+i))
+			copy(r[(i-1)*8:], buf[8:])
+		}
+	}
+	return slices.Concat(a, r), nil
+}
+
+// gcmTagSize is the size of the A256GCM authentication tag
+const gcmTagSize = 16
+
+// gcmOpen decrypts and authenticates the passed ciphertext, which has the tag appended.
+func gcmOpen(key []byte, iv []byte, ciphertext []byte, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key, iv)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, iv, ciphertext, aad)
+}
+
+// gcmSeal is the inverse of gcmOpen.
+func gcmSeal(key []byte, iv []byte, plaintext []byte, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key, iv)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nil, iv, plaintext, aad), nil
+}
+
+func newGCM(key []byte, iv []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != gcm.NonceSize() {
+		return nil, fmt.Errorf("invalid JWE iv length %d", len(iv))
+	}
+	return gcm, nil
+}
+
+// encryptJWE encrypts the passed plaintext for the passed RSA or ECDSA public keys into a
+// JWE in the general JSON serialization, with one recipient for each key.
+func encryptJWE(plaintext []byte, keys []crypto.PublicKey) ([]byte, error) {
+	cek := make([]byte, 32)
+	iv := make([]byte, 12)
+	if _, err := rand.Read(cek); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	hb, err := json.Marshal(jweHeader{Enc: encA256GCM})
+	if err != nil {
+		return nil, err
+	}
+	msg := jwe{Protected: b64.EncodeToString(hb), IV: b64.EncodeToString(iv)}
+	for _, key := range keys {
+		var hdr jweHeader
+		var encryptedKey []byte
+		switch k := key.(type) {
+		case *rsa.PublicKey:
+			hdr.Alg = algRSAOAEP
+			if encryptedKey, err = rsa.EncryptOAEP(sha1.New(), rand.Reader, k, cek, nil); err != nil {
+				return nil, err
+			}
+		case *ecdsa.PublicKey:
+			pub, err := k.ECDH()
+			if err != nil {
+				return nil, err
+			}
+			eph, err := pub.Curve().GenerateKey(rand.Reader)
+			if err != nil {
+				return nil, err
+			}
+			z, err := eph.ECDH(pub)
+			if err != nil {
+				return nil, err
+			}
+			if encryptedKey, err = aesKeyWrap(concatKDF(z, algECDHES, nil, nil, 32), cek); err != nil {
+				return nil, err
+			}
+			point := eph.PublicKey().Bytes()[1:]
+			hdr.Alg = algECDHES
+			hdr.Epk = &jwk{
+				Kty: "EC",
+				Crv: k.Curve.Params().Name,
+				X:   b64.EncodeToString(point[:len(point)/2]),
+				Y:   b64.EncodeToString(point[len(point)/2:]),
+			}
+		default:
+			return nil, fmt.Errorf("unsupported public key type %T: must be RSA or ECDSA", key)
+		}
+		msg.Recipients = append(msg.Recipients, recipient{Header: &hdr, EncryptedKey: b64.EncodeToString(encryptedKey)})
+	}
+	sealed, err := gcmSeal(cek, iv, plaintext, []byte(msg.Protected))
+	if err != nil {
+		return nil, err
+	}
+	msg.Ciphertext = b64.EncodeToString(sealed[:len(sealed)-gcmTagSize])
+	msg.Tag = b64.EncodeToString(sealed[len(sealed)-gcmTagSize:])
+	return json.Marshal(msg)
+}
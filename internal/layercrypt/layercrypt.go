@@ -0,0 +1,212 @@
+package layercrypt
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// PubOptsAnnotation is the layer descriptor annotation with the base64 encoded JSON
+	// public cipher options of an encrypted layer.
+	PubOptsAnnotation = "org.opencontainers.image.enc.pubopts"
+	// JWEKeysAnnotation is the layer descriptor annotation with the comma-separated base64
+	// encoded JWE messages that wrap the private cipher options of an encrypted layer.
+	JWEKeysAnnotation = "org.opencontainers.image.enc.keys.jwe"
+	// keysAnnotationPrefix is the prefix of the annotations of all key wrapping schemes
+	keysAnnotationPrefix = "org.opencontainers.image.enc.keys."
+	// aesCtrHmac is the only layer cipher defined by OCIcrypt
+	aesCtrHmac = "AES_256_CTR_HMAC_SHA256"
+	// EncryptedSuffix is appended to the media type of a layer when it is encrypted
+	EncryptedSuffix = "+encrypted"
+)
+
+// ErrNoKey is returned by 'Decrypt' if none of the passed keys is a recipient of the layer.
+var ErrNoKey = errors.New("no decryption key can decrypt the layer")
+
+// publicOpts are the cipher options of an encrypted layer that are stored in the clear.
+type publicOpts struct {
+	Cipher        string            `json:"cipher"`
+	Hmac          []byte            `json:"hmac"`
+	CipherOptions map[string][]byte `json:"cipheroptions"`
+}
+
+// privateOpts are the cipher options of an encrypted layer that are wrapped for each
+// recipient. The digest is the digest of the layer before it was encrypted.
+type privateOpts struct {
+	SymmetricKey  []byte            `json:"symkey"`
+	Digest        digest.Digest     `json:"digest"`
+	CipherOptions map[string][]byte `json:"cipheroptions"`
+}
+
+// Decrypt decrypts the encrypted layer in 'src' into 'dst' using the passed layer
+// descriptor annotations and the first of the passed RSA or ECDSA private keys that is a
+// recipient of the layer. The HMAC of the encrypted layer, and the digest of the
+// decrypted layer are verified. The digest (like 'sha256:abc...') and size of the
+// decrypted layer are returned. If there is an error then 'dst' is removed.
+func Decrypt(src string, dst string, annotations map[string]string, keys []crypto.PrivateKey) (string, int64, error) {
+	pub, priv, err := unwrapOpts(annotations, keys)
+	if err != nil {
+		return "", 0, err
+	}
+	if pub.Cipher != aesCtrHmac {
+		return "", 0, fmt.Errorf("unsupported layer cipher %q", pub.Cipher)
+	}
+	if err := priv.Digest.Validate(); err != nil {
+		return "", 0, fmt.Errorf("invalid layer digest in cipher options: %w", err)
+	}
+	nonce, ok := priv.CipherOptions["nonce"]
+	if !ok {
+		nonce = pub.CipherOptions["nonce"]
+	}
+	stream, mac, err := newCipher(priv.SymmetricKey, nonce)
+	if err != nil {
+		return "", 0, err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return "", 0, err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return "", 0, err
+	}
+	digester := priv.Digest.Algorithm().Digester()
+	r := cipher.StreamReader{S: stream, R: io.TeeReader(in, mac)}
+	size, err := io.Copy(io.MultiWriter(out, digester.Hash()), r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && !hmac.Equal(mac.Sum(nil), pub.Hmac) {
+		err = errors.New("HMAC of the encrypted layer doesn't match")
+	} else if err == nil && digester.Digest() != priv.Digest {
+		err = fmt.Errorf("digest of the decrypted layer is %q, expected %q", digester.Digest(), priv.Digest)
+	}
+	if err != nil {
+		os.Remove(dst)
+		return "", 0, err
+	}
+	return string(priv.Digest), size, nil
+}
+
+// Encrypt is the inverse of Decrypt. It encrypts the passed layer for the passed RSA or
+// ECDSA public keys and returns the encrypted layer and the annotations to add to its
+// descriptor. The library doesn't push encrypted images, so this is for testing.
+func Encrypt(layer []byte, keys []crypto.PublicKey) ([]byte, map[string]string, error) {
+	symKey := make([]byte, 32)
+	nonce := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(symKey); err != nil {
+		return nil, nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	stream, mac, err := newCipher(symKey, nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	encrypted := make([]byte, len(layer))
+	stream.XORKeyStream(encrypted, layer)
+	mac.Write(encrypted)
+	priv, err := json.Marshal(privateOpts{
+		SymmetricKey:  symKey,
+		Digest:        digest.FromBytes(layer),
+		CipherOptions: map[string][]byte{"nonce": nonce},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	pub, err := json.Marshal(publicOpts{
+		Cipher:        aesCtrHmac,
+		Hmac:          mac.Sum(nil),
+		CipherOptions: map[string][]byte{},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	jwe, err := encryptJWE(priv, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	return encrypted, map[string]string{
+		PubOptsAnnotation: base64.StdEncoding.EncodeToString(pub),
+		JWEKeysAnnotation: base64.StdEncoding.EncodeToString(jwe),
+	}, nil
+}
+
+// newCipher returns the AES-256-CTR stream and the HMAC-SHA256 for the passed key and nonce.
+func newCipher(symKey []byte, nonce []byte) (cipher.Stream, hash.Hash, error) {
+	if len(symKey) != 32 {
+		return nil, nil, fmt.Errorf("invalid symmetric key length %d, expected 32", len(symKey))
+	}
+	if len(nonce) != aes.BlockSize {
+		return nil, nil, fmt.Errorf("invalid nonce length %d, expected %d", len(nonce), aes.BlockSize)
+	}
+	block, err := aes.NewCipher(symKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cipher.NewCTR(block, nonce), hmac.New(sha256.New, symKey), nil
+}
+
+// unwrapOpts returns the public and private cipher options of an encrypted layer from the
+// passed annotations, unwrapping the private options with one of the passed keys.
+func unwrapOpts(annotations map[string]string, keys []crypto.PrivateKey) (publicOpts, privateOpts, error) {
+	pub := publicOpts{}
+	b, err := base64.StdEncoding.DecodeString(annotations[PubOptsAnnotation])
+	if err != nil || len(b) == 0 {
+		return pub, privateOpts{}, fmt.Errorf("missing or invalid %q annotation", PubOptsAnnotation)
+	}
+	if err := json.Unmarshal(b, &pub); err != nil {
+		return pub, privateOpts{}, fmt.Errorf("unable to parse %q annotation, error: %w", PubOptsAnnotation, err)
+	}
+	jwes, ok := annotations[JWEKeysAnnotation]
+	if !ok {
+		return pub, privateOpts{}, fmt.Errorf("unsupported key wrapping scheme(s) %v, only jwe is supported", schemes(annotations))
+	}
+	for _, enc := range strings.Split(jwes, ",") {
+		jwe, err := base64.StdEncoding.DecodeString(enc)
+		if err != nil {
+			return pub, privateOpts{}, fmt.Errorf("invalid %q annotation, error: %w", JWEKeysAnnotation, err)
+		}
+		b, err := decryptJWE(jwe, keys)
+		if errors.Is(err, ErrNoKey) {
+			continue
+		} else if err != nil {
+			return pub, privateOpts{}, err
+		}
+		priv := privateOpts{}
+		if err := json.Unmarshal(b, &priv); err != nil {
+			return pub, privateOpts{}, fmt.Errorf("unable to parse private cipher options, error: %w", err)
+		}
+		return pub, priv, nil
+	}
+	return pub, privateOpts{}, ErrNoKey
+}
+
+// schemes returns the key wrapping schemes in the passed annotations, like "pgp".
+func schemes(annotations map[string]string) []string {
+	s := []string{}
+	for k := range annotations {
+		if strings.HasPrefix(k, keysAnnotationPrefix) {
+			s = append(s, strings.TrimPrefix(k, keysAnnotationPrefix))
+		}
+	}
+	sort.Strings(s)
+	return s
+}
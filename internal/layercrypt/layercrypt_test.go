@@ -0,0 +1,124 @@
+package layercrypt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// RFC 3394 section 4.6 - wrap 256 bits of key data with a 256-bit KEK
+func TestAESKeyWrap(t *testing.T) {
+	kek, _ := hex.DecodeString("000102030405060708090A0B0C0D0E0F101112131415161718191A1B1C1D1E1F")
+	key, _ := hex.DecodeString("00112233445566778899AABBCCDDEEFF000102030405060708090A0B0C0D0E0F")
+	expected, _ := hex.DecodeString("28C9F404C4B810F4CBCCB35CFB87F8263F5786E2D80ED326CBC7F0E71A99F43BFB988B9B7A02DD21")
+	wrapped, err := aesKeyWrap(kek, key)
+	if err != nil || !bytes.Equal(wrapped, expected) {
+		t.Fatalf("unexpected wrapped key %x", wrapped)
+	}
+	unwrapped, err := aesKeyUnwrap(kek, wrapped)
+	if err != nil || !bytes.Equal(unwrapped, key) {
+		t.Fatalf("unexpected unwrapped key %x", unwrapped)
+	}
+	wrapped[0] ^= 1
+	if _, err := aesKeyUnwrap(kek, wrapped); err == nil {
+		t.Errorf("expected an integrity error")
+	}
+}
+
+func TestDecrypt(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	p256Key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	layer := bytes.Repeat([]byte("layer content "), 1000)
+	encrypted, annotations, err := Encrypt(layer, []crypto.PublicKey{&rsaKey.PublicKey, &p256Key.PublicKey, &p384Key.PublicKey})
+	if err != nil {
+		t.Fatalf("encrypt: %s", err)
+	}
+	if bytes.Equal(encrypted, layer) {
+		t.Fatalf("layer was not encrypted")
+	}
+	d := t.TempDir()
+	src := filepath.Join(d, "encrypted")
+	os.WriteFile(src, encrypted, 0644)
+	for _, key := range []crypto.PrivateKey{rsaKey, p256Key, p384Key} {
+		dst := filepath.Join(d, "decrypted")
+		dgst, size, err := Decrypt(src, dst, annotations, []crypto.PrivateKey{otherKey, key})
+		if err != nil {
+			t.Fatalf("decrypt with %T: %s", key, err)
+		}
+		if dgst != digest.FromBytes(layer).String() || size != int64(len(layer)) {
+			t.Errorf("unexpected digest %q or size %d", dgst, size)
+		}
+		if b, _ := os.ReadFile(dst); !bytes.Equal(b, layer) {
+			t.Errorf("decrypted layer doesn't match")
+		}
+	}
+	dst := filepath.Join(d, "nokey")
+	if _, _, err := Decrypt(src, dst, annotations, []crypto.PrivateKey{otherKey}); !errors.Is(err, ErrNoKey) {
+		t.Errorf("expected ErrNoKey, got %v", err)
+	}
+	encrypted[100] ^= 1
+	os.WriteFile(src, encrypted, 0644)
+	if _, _, err := Decrypt(src, dst, annotations, []crypto.PrivateKey{rsaKey}); err == nil {
+		t.Errorf("expected an HMAC error")
+	} else if _, err := os.Stat(dst); err == nil {
+		t.Errorf("expected the decrypted layer to be removed")
+	}
+	if _, _, err := Decrypt(src, dst, map[string]string{
+		PubOptsAnnotation:                       annotations[PubOptsAnnotation],
+		"org.opencontainers.image.enc.keys.pgp": "Zm9v",
+	}, []crypto.PrivateKey{rsaKey}); err == nil {
+		t.Errorf("expected an unsupported scheme error")
+	}
+}
+
+// TestDecryptFlattened tests a JWE in the flattened JSON serialization with the recipient
+// header parameters in the protected header, which is how go-jose serializes a JWE with a
+// single recipient.
+func TestDecryptFlattened(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	general, err := encryptJWE([]byte("private options"), []crypto.PublicKey{&key.PublicKey})
+	if err != nil {
+		t.Fatalf("encrypt: %s", err)
+	}
+	msg := jwe{}
+	json.Unmarshal(general, &msg)
+	// moving the header into the protected header changes the AAD so unwrap the CEK
+	// and seal the content again
+	hdr := *msg.Recipients[0].Header
+	hdr.Enc = encA256GCM
+	hb, _ := json.Marshal(hdr)
+	flat := jwe{
+		Protected:    b64.EncodeToString(hb),
+		EncryptedKey: msg.Recipients[0].EncryptedKey,
+		IV:           msg.IV,
+	}
+	priv, _ := key.ECDH()
+	pub, _ := hdr.Epk.publicKey(priv.Curve())
+	z, _ := priv.ECDH(pub)
+	ek, _ := b64.DecodeString(flat.EncryptedKey)
+	cek, err := aesKeyUnwrap(concatKDF(z, algECDHES, nil, nil, 32), ek)
+	if err != nil {
+		t.Fatalf("unwrap: %s", err)
+	}
+	iv, _ := b64.DecodeString(flat.IV)
+	sealed, _ := gcmSeal(cek, iv, []byte("private options"), []byte(flat.Protected))
+	flat.Ciphertext = b64.EncodeToString(sealed[:len(sealed)-gcmTagSize])
+	flat.Tag = b64.EncodeToString(sealed[len(sealed)-gcmTagSize:])
+	b, _ := json.Marshal(flat)
+	if plaintext, err := decryptJWE(b, []crypto.PrivateKey{key}); err != nil || string(plaintext) != "private options" {
+		t.Errorf("unexpected result %q, %v", plaintext, err)
+	}
+}
@@ -0,0 +1,8 @@
+// Package layercrypt decrypts image layers that were encrypted with OCIcrypt, i.e. layers
+// with a '+encrypted' media type like those pushed by 'skopeo copy --encryption-key' or
+// 'nerdctl image encrypt'. The layer is encrypted with AES-256-CTR and authenticated with
+// HMAC-SHA256 using a random symmetric key. The symmetric key is wrapped for each recipient
+// and carried in the layer descriptor annotations. Only the JWE key wrapping scheme is
+// supported, with RSA-OAEP for RSA keys and ECDH-ES+A256KW for EC keys, and the content
+// encrypted with A256GCM. These are the algorithms OCIcrypt uses for JWE.
+package layercrypt
@@ -1,12 +1,24 @@
 package methods
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/aceeric/imgpull/internal/blobsync"
 	"github.com/aceeric/imgpull/internal/imgref"
@@ -16,10 +28,18 @@ import (
 	"github.com/opencontainers/go-digest"
 )
 
-const (
-	maxManifestBytes = 25 * 1024
-	maxBlobBytes     = 10 * 1024 * 1024
-)
+// DefaultMaxManifestBytes is the largest manifest that is accepted if the RegClient doesn't
+// specify a limit. It is the minimum manifest size that the OCI distribution spec recommends
+// registries support.
+const DefaultMaxManifestBytes = 4 * 1024 * 1024
+
+// DefaultMaxRetryAfter is the longest wait for a Retry-After header if the RegClient doesn't
+// specify a limit.
+const DefaultMaxRetryAfter = 30 * time.Second
+
+// maxRetryAfterRetries is how many times a request is retried when the server asks for
+// it with a Retry-After header before the response is returned to the caller.
+const maxRetryAfterRetries = 3
 
 // AuthHeader is a key/value struct that supports creating and setting an auth
 // header for the supported auth type (basic, bearer).
@@ -37,6 +57,38 @@ type RegClient struct {
 	Client *http.Client
 	// AuthHdr supports the various auth types (basic, bearer)
 	AuthHdr AuthHeader
+	// Actions are the actions requested in the scope of a bearer token request,
+	// e.g. "pull" or "pull,push". If empty, then "pull" is requested.
+	Actions string
+	// Reauth, if not nil, is called with the rejected auth header when an authenticated
+	// request is rejected with a 401 to discard the rejected credential and negotiate a
+	// new one. The request is then retried once with the returned auth header.
+	Reauth func(AuthHeader) (AuthHeader, error)
+	// Syncer, if not nil, synchronizes concurrent pulls of the same blob so that only
+	// one goroutine pulls it and the others wait.
+	Syncer *blobsync.BlobSyncer
+	// MaxManifestBytes is the largest manifest that will be accepted from the server. If
+	// zero then DefaultMaxManifestBytes is used.
+	MaxManifestBytes int64
+	// MaxBlobBytes is the largest blob that will be accepted from the server. If zero then
+	// blobs of any size are accepted.
+	MaxBlobBytes int64
+	// ManifestCache, if not nil, caches manifest responses that have an ETag so that a
+	// manifest that hasn't changed isn't downloaded again.
+	ManifestCache types.ManifestCache
+	// AcceptTypes, if not empty, are the manifest media types in the Accept header of
+	// manifest requests rather than all the types this package supports.
+	AcceptTypes []types.MediaType
+	// Files configures the permissions, ownership, and syncing of pulled blobs.
+	Files util.FileOpts
+	// Ctx, if not nil, is the context of every request made with the client, so that
+	// cancelling it aborts the requests, including blob downloads in progress.
+	Ctx context.Context
+	// MaxRetryAfter caps the wait when the server responds to a request with a 429 or a 503
+	// and a Retry-After header. The request is retried after the wait indicated by the
+	// header or MaxRetryAfter, whichever is shorter. If zero then DefaultMaxRetryAfter is
+	// used. If negative then the response is returned to the caller without a retry.
+	MaxRetryAfter time.Duration
 }
 
 // ManifestGetResult is returned by the 'V2Manifests' function in this
@@ -55,14 +107,37 @@ var allManifestTypes []types.MediaType = []types.MediaType{
 	types.V2dockerManifestMt,
 	types.V1ociIndexMt,
 	types.V1ociManifestMt,
+	types.V1ociArtifactMt,
+	types.V1dockerSignedMt,
+	types.V1dockerManifestMt,
 }
 
 // allManifestTypesStr concats all the manifest types supported to be pulled
 // into a comma-separated string.
 func allManifestTypesStr() string {
-	toReturn := string(allManifestTypes[0])
-	for i := 1; i < len(allManifestTypes); i++ {
-		toReturn = fmt.Sprintf("%s,%s", toReturn, allManifestTypes[i])
+	return mediaTypesStr(allManifestTypes)
+}
+
+// IsManifestType returns true if the passed media type is one of the manifest types that
+// this package operates on.
+func IsManifestType(mediaType types.MediaType) bool {
+	return slices.Contains(allManifestTypes, mediaType)
+}
+
+// acceptTypes returns the manifest types in the receiver if there are any, else all
+// the manifest types that this package supports.
+func (rc RegClient) acceptTypes() []types.MediaType {
+	if len(rc.AcceptTypes) != 0 {
+		return rc.AcceptTypes
+	}
+	return allManifestTypes
+}
+
+// mediaTypesStr concats the passed media types into a comma-separated string.
+func mediaTypesStr(mediaTypes []types.MediaType) string {
+	toReturn := string(mediaTypes[0])
+	for i := 1; i < len(mediaTypes); i++ {
+		toReturn = fmt.Sprintf("%s,%s", toReturn, mediaTypes[i])
 	}
 	return toReturn
 }
@@ -77,7 +152,7 @@ func (rc RegClient) V2ManifestsAuth() (int, []string, error) {
 		defer resp.Body.Close()
 	}
 	if err != nil {
-		return 0, nil, err
+		return 0, nil, networkError(err)
 	}
 	auth := getWwwAuthenticateHdrs(resp)
 	return resp.StatusCode, auth, err
@@ -95,10 +170,10 @@ func (rc RegClient) V2Basic(encoded string) (types.BasicAuth, error) {
 		defer resp.Body.Close()
 	}
 	if err != nil {
-		return types.BasicAuth{}, err
+		return types.BasicAuth{}, networkError(err)
 	}
 	if resp.StatusCode != http.StatusOK {
-		return types.BasicAuth{}, fmt.Errorf("basic auth returned status code %d", resp.StatusCode)
+		return types.BasicAuth{}, &types.ErrStatus{Op: "basic auth", Url: url, StatusCode: resp.StatusCode}
 	}
 	return types.BasicAuth{Encoded: encoded}, nil
 }
@@ -108,7 +183,7 @@ func (rc RegClient) V2Basic(encoded string) (types.BasicAuth, error) {
 // than the server that we have been requested to pull from.  If successful, the
 // bearer token is returned to the caller for use on subsequent calls.
 func (rc RegClient) V2Auth(ba types.BearerAuth, encoded string) (types.BearerToken, error) {
-	url := fmt.Sprintf("%s?scope=repository:%s:pull&service=%s", ba.Realm, rc.ImgRef.Repository(), ba.Service)
+	url := fmt.Sprintf("%s?scope=%s&service=%s", ba.Realm, rc.Scope(), ba.Service)
 	req, _ := http.NewRequest(http.MethodGet, url, nil)
 	if encoded != "" {
 		req.Header.Set("Authorization", "Basic "+encoded)
@@ -118,10 +193,10 @@ func (rc RegClient) V2Auth(ba types.BearerAuth, encoded string) (types.BearerTok
 		defer resp.Body.Close()
 	}
 	if err != nil {
-		return types.BearerToken{}, err
+		return types.BearerToken{}, networkError(err)
 	}
 	if resp.StatusCode != http.StatusOK {
-		return types.BearerToken{}, fmt.Errorf("auth attempt failed. Status: %d", resp.StatusCode)
+		return types.BearerToken{}, &types.ErrStatus{Op: "token request", Url: ba.Realm, StatusCode: resp.StatusCode}
 	}
 	var token types.BearerToken
 	decoder := json.NewDecoder(resp.Body)
@@ -129,39 +204,70 @@ func (rc RegClient) V2Auth(ba types.BearerAuth, encoded string) (types.BearerTok
 	if err != nil {
 		return types.BearerToken{}, err
 	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	token.SetExpiry(time.Now())
 	return token, nil
 }
 
-// V2Blobs wraps a call to 'v2BlobsInternal' in concurrency handling if needed.
-// This supports using the package as a library by synchronizing multiple goroutines
-// pulling the same blob.
+// Scope returns the scope of a bearer token request for the repository and actions in
+// the receiver, e.g. 'repository:library/hello-world:pull'.
+func (rc RegClient) Scope() string {
+	actions := rc.Actions
+	if actions == "" {
+		actions = "pull"
+	}
+	return fmt.Sprintf("repository:%s:%s", rc.ImgRef.Repository(), actions)
+}
+
+// V2Blobs wraps a call to 'v2BlobsInternal' in concurrency handling if the receiver
+// has a syncer. This supports using the package as a library by synchronizing multiple
+// goroutines pulling the same blob. Once the blob is pulled, the file options in the
+// receiver are applied to it.
 func (rc RegClient) V2Blobs(layer types.Layer, toFile string) error {
-	if f, err := os.Stat(toFile); err == nil && f.Size() == int64(layer.Size) {
+	_, err := rc.V2BlobsFetch(layer, toFile)
+	return err
+}
+
+// V2BlobsFetch is like 'V2Blobs' except it also returns true if the blob was downloaded
+// from the registry by this call, or false if the blob was already in 'toFile' or was
+// provided by the syncer, e.g. because another goroutine downloaded it.
+func (rc RegClient) V2BlobsFetch(layer types.Layer, toFile string) (bool, error) {
+	if f, err := os.Stat(toFile); err == nil && layer.Size != 0 && f.Size() == int64(layer.Size) {
 		// already exists on the file system
-		return nil
+		return false, nil
 	}
-	if !blobsync.ConcurrentBlobs {
-		return rc.V2BlobsInternal(layer, toFile)
-	}
-	so := blobsync.EnqueueGet(layer.Digest)
 	var err error
-	go func() {
-		if so.Result == blobsync.NotEnqueued {
-			defer blobsync.DoneGet(layer.Digest)
-			err = rc.V2BlobsInternal(layer, toFile)
-		}
-	}()
-	waitResult := blobsync.Wait(so)
+	downloaded := false
+	if rc.Syncer == nil {
+		err = rc.V2BlobsInternal(layer, toFile)
+		downloaded = true
+	} else {
+		err = rc.Syncer.Get(layer.Digest, toFile, func(stagingFile string) error {
+			downloaded = true
+			return rc.V2BlobsInternal(layer, stagingFile)
+		})
+	}
 	if err != nil {
-		// blob pull err
-		return err
+		return false, err
 	}
-	return waitResult
+	return downloaded, rc.Files.Apply(toFile)
 }
 
 // V2BlobsInternal calls the 'v2/<repository>/blobs' endpoint to get a blob by the digest in the
-// passed 'layer' arg. The blob is stored in the location specified by 'toFile'.
-func (rc RegClient) V2BlobsInternal(layer types.Layer, toFile string) error {
+// passed 'layer' arg. The blob is stored in the location specified by 'toFile'. The digest of
+// the blob is always verified, and so is the size unless the layer size is zero, meaning the
+// size is unknown (e.g. schema 1 manifests don't have layer sizes.) If the blob can't be fully
+// pulled, or doesn't match its digest, then the partial blob file is removed.
+func (rc RegClient) V2BlobsInternal(layer types.Layer, toFile string) (err error) {
+	if rc.MaxBlobBytes != 0 && int64(layer.Size) > rc.MaxBlobBytes {
+		return fmt.Errorf("blob %q size %d exceeds the maximum of %d bytes", layer.Digest, layer.Size, rc.MaxBlobBytes)
+	}
+	dgst, err := digest.Parse(layer.Digest)
+	if err != nil {
+		return fmt.Errorf("invalid blob digest %q: %w", layer.Digest, err)
+	}
 	url := ""
 	if rc.ImgRef.NsInPath() {
 		url = fmt.Sprintf("%s/v2/%s/%s/blobs/%s", rc.ImgRef.ServerUrl(), rc.ImgRef.Namespace(), rc.ImgRef.Repository(), layer.Digest)
@@ -169,8 +275,8 @@ func (rc RegClient) V2BlobsInternal(layer types.Layer, toFile string) error {
 		url = fmt.Sprintf("%s/v2/%s/blobs/%s%s", rc.ImgRef.ServerUrl(), rc.ImgRef.Repository(), layer.Digest, rc.nsQueryParm())
 	}
 	req, _ := http.NewRequest(http.MethodGet, url, nil)
-	rc.setAuthHdr(req)
-	resp, err := rc.Client.Do(req)
+	acceptIdentity(req)
+	resp, err := rc.do(req)
 	if resp != nil {
 		defer resp.Body.Close()
 	}
@@ -178,67 +284,146 @@ func (rc RegClient) V2BlobsInternal(layer types.Layer, toFile string) error {
 		return err
 	}
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("404 from server for blob digest %q", layer.Digest)
+		return &types.ErrStatus{Op: "get blob", Url: url, StatusCode: resp.StatusCode}
+	}
+	respBody, err := decodedBody(resp)
+	if err != nil {
+		return err
 	}
 	blobFile, err := os.Create(toFile)
 	if err != nil {
 		return err
 	}
-	defer blobFile.Close()
-
-	bytesRead := 0
-	for {
-		part, err := io.ReadAll(io.LimitReader(resp.Body, maxBlobBytes))
+	defer func() {
+		blobFile.Close()
 		if err != nil {
-			return err
-		}
-		if len(part) == 0 {
-			break
+			os.Remove(toFile)
 		}
-		bytesRead += len(part)
-		blobFile.Write(part)
+	}()
+
+	// stream the blob to the file so that a blob of any size can be pulled without
+	// holding it in memory
+	digester := dgst.Algorithm().Digester()
+	body := respBody
+	if rc.MaxBlobBytes != 0 {
+		body = io.LimitReader(respBody, rc.MaxBlobBytes+1)
+	}
+	bytesRead, err := io.Copy(io.MultiWriter(blobFile, digester.Hash()), body)
+	if err != nil {
+		return networkError(err)
 	}
-	if bytesRead != layer.Size {
+	if rc.MaxBlobBytes != 0 && bytesRead > rc.MaxBlobBytes {
+		return fmt.Errorf("blob %q exceeds the maximum of %d bytes", layer.Digest, rc.MaxBlobBytes)
+	}
+	if layer.Size != 0 && bytesRead != int64(layer.Size) {
 		return fmt.Errorf("error getting blob - expected %d bytes, got %d bytes instead", layer.Size, bytesRead)
 	}
+	if digester.Digest() != dgst {
+		return &types.ErrDigestMismatch{Url: url, Expected: layer.Digest, Actual: digester.Digest().String()}
+	}
 	return nil
 }
 
 // V2Manifests calls the 'v2/<repository>/manifests' endpoint. The resulting manifest is returned in
-// a ManifestHolder struct and could be any one of the types defined in the 'allManifestTypes' array.
+// a ManifestHolder struct and could be any one of the types defined in the 'allManifestTypes' array,
+// or the accept types in the receiver if it has any.
 // If you pass an empty string in 'sha', then the GET will use the image url that was used to initialize
 // the Puller. (Probably a tag.) If you provide a digest in 'sha', the digest will override the tag.
 //
 // Generally speaking: pull by tag returns an image list from the registry if one is available and pull
 // by digest (SHA) returns an image manifest. But this might not be true all the time.
 func (rc RegClient) V2Manifests(sha string) (ManifestGetResult, error) {
-	url := rc.makeManifestUrl(sha)
+	return rc.V2ManifestsAccept(sha, rc.acceptTypes())
+}
+
+// V2ManifestsAccept is like 'V2Manifests' except the Accept header of the request has the passed
+// media types rather than the types this package supports, and 'ref' can be a tag or a digest. The
+// manifest is returned as provided by the server so the caller can handle media types this package
+// doesn't model. If 'accept' is empty, then the accept types in the receiver are accepted, or if it
+// has none then the types this package supports.
+func (rc RegClient) V2ManifestsAccept(ref string, accept []types.MediaType) (ManifestGetResult, error) {
+	if len(accept) == 0 {
+		accept = rc.acceptTypes()
+	}
+	url := rc.makeManifestUrl(ref)
 	req, _ := http.NewRequest(http.MethodGet, url, nil)
-	req.Header.Set("Accept", allManifestTypesStr())
-	rc.setAuthHdr(req)
-	resp, err := rc.Client.Do(req)
+	req.Header.Set("Accept", mediaTypesStr(accept))
+	acceptGzip(req)
+	cacheKey := url + " " + req.Header.Get("Accept")
+	var cached types.CachedManifest
+	var isCached bool
+	if rc.ManifestCache != nil {
+		if cached, isCached = rc.ManifestCache.Get(cacheKey); isCached {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+	}
+	resp, err := rc.do(req)
 	if resp != nil {
 		defer resp.Body.Close()
 	}
 	if err != nil {
 		return ManifestGetResult{}, err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return ManifestGetResult{}, fmt.Errorf("get manifests attempt failed. Status: %d", resp.StatusCode)
+	var mediaType, manifestDigest string
+	var manifestBytes []byte
+	if resp.StatusCode == http.StatusNotModified && isCached {
+		mediaType, manifestDigest, manifestBytes = string(cached.MediaType), cached.Digest, cached.Bytes
+	} else if resp.StatusCode != http.StatusOK {
+		return ManifestGetResult{}, &types.ErrStatus{Op: "get manifests", Url: url, StatusCode: resp.StatusCode}
+	} else {
+		mediaType = resp.Header.Get("Content-Type")
+		manifestDigest = resp.Header.Get("Docker-Content-Digest")
+		maxBytes := rc.MaxManifestBytes
+		if maxBytes == 0 {
+			maxBytes = DefaultMaxManifestBytes
+		}
+		body, err := decodedBody(resp)
+		if err != nil {
+			return ManifestGetResult{}, err
+		}
+		manifestBytes, err = io.ReadAll(io.LimitReader(body, maxBytes+1))
+		if err != nil {
+			return ManifestGetResult{}, networkError(err)
+		}
+		if int64(len(manifestBytes)) > maxBytes {
+			return ManifestGetResult{}, fmt.Errorf("manifest exceeds the maximum of %d bytes", maxBytes)
+		}
 	}
-	mediaType := resp.Header.Get("Content-Type")
-	manifestBytes, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestBytes))
-	if err != nil {
-		return ManifestGetResult{}, err
+	content := manifestBytes
+	if types.MediaType(mediaType) == types.V1dockerSignedMt {
+		// the digest of a signed schema 1 manifest excludes the signatures
+		if content, err = schema1Payload(manifestBytes); err != nil {
+			return ManifestGetResult{}, err
+		}
+	}
+	computedDigest := digest.FromBytes(content).Hex()
+	// if the manifest was requested by digest then the content has to have that digest,
+	// regardless of what the server says the digest is
+	if ref == "" {
+		ref = rc.ImgRef.Ref()
+	}
+	if requested, err := digest.Parse(ref); err == nil && requested.Algorithm().Available() {
+		if actual := requested.Algorithm().FromBytes(content); actual != requested {
+			return ManifestGetResult{}, &types.ErrDigestMismatch{Url: url, Expected: requested.String(), Actual: actual.String()}
+		}
 	}
-	manifestDigest := resp.Header.Get("Docker-Content-Digest")
-	computedDigest := digest.FromBytes(manifestBytes).Hex()
 	if manifestDigest == "" {
 		manifestDigest = computedDigest
 	} else {
 		manifestDigest = util.DigestFrom(manifestDigest)
 		if computedDigest != manifestDigest {
-			return ManifestGetResult{}, fmt.Errorf("digest mismatch for %q", url)
+			return ManifestGetResult{}, &types.ErrDigestMismatch{Url: url, Expected: "sha256:" + manifestDigest, Actual: "sha256:" + computedDigest}
+		}
+	}
+	// only content that passed the digest checks is cached
+	if rc.ManifestCache != nil && resp.StatusCode == http.StatusOK {
+		if etag := etagFrom(resp); etag != "" {
+			rc.ManifestCache.Put(cacheKey, types.CachedManifest{
+				ETag:      etag,
+				MediaType: types.MediaType(mediaType),
+				Digest:    resp.Header.Get("Docker-Content-Digest"),
+				Bytes:     manifestBytes,
+			})
 		}
 	}
 	return ManifestGetResult{
@@ -248,15 +433,27 @@ func (rc RegClient) V2Manifests(sha string) (ManifestGetResult, error) {
 	}, nil
 }
 
+// etagFrom returns the ETag header of the passed response. If the response doesn't have
+// an ETag but has a Docker-Content-Digest header, then the quoted digest is returned, which
+// is what registries that set ETags use.
+func etagFrom(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		return etag
+	}
+	if dgst := resp.Header.Get("Docker-Content-Digest"); dgst != "" {
+		return `"` + dgst + `"`
+	}
+	return ""
+}
+
 // V2ManifestsHead is like V2Manifests but does a HEAD request. The result is returned in a
 // smaller struct with only media type, digest, and size (of manifest). We don't allow overriding
 // the ref becuase the use case for this method is to HEAD the manifest list.
 func (rc RegClient) V2ManifestsHead() (types.ManifestDescriptor, error) {
 	url := rc.makeManifestUrl("")
 	req, _ := http.NewRequest(http.MethodHead, url, nil)
-	req.Header.Set("Accept", allManifestTypesStr())
-	rc.setAuthHdr(req)
-	resp, err := rc.Client.Do(req)
+	req.Header.Set("Accept", mediaTypesStr(rc.acceptTypes()))
+	resp, err := rc.do(req)
 	if resp != nil {
 		defer resp.Body.Close()
 	}
@@ -264,7 +461,7 @@ func (rc RegClient) V2ManifestsHead() (types.ManifestDescriptor, error) {
 		return types.ManifestDescriptor{}, err
 	}
 	if resp.StatusCode != http.StatusOK {
-		return types.ManifestDescriptor{}, fmt.Errorf("head manifests for %q failed with status %d", url, resp.StatusCode)
+		return types.ManifestDescriptor{}, &types.ErrStatus{Op: "head manifests", Url: url, StatusCode: resp.StatusCode}
 	}
 	mediaType := resp.Header.Get("Content-Type")
 	if mediaType == "" {
@@ -296,6 +493,167 @@ func (rc RegClient) makeManifestUrl(sha string) string {
 	}
 }
 
+// do sends the passed request with 'doAuth'. If the upstream rejects the request with a 429
+// or a 503 and a Retry-After header, then the request is retried after the indicated wait,
+// up to 'maxRetryAfterRetries' times, unless the request has a body that can't be re-read.
+func (rc RegClient) do(req *http.Request) (*http.Response, error) {
+	if rc.Ctx != nil {
+		req = req.WithContext(rc.Ctx)
+	}
+	for retries := 0; ; retries++ {
+		resp, err := rc.doAuth(req)
+		if err != nil || retries == maxRetryAfterRetries || req.Body != nil && req.GetBody == nil {
+			return resp, err
+		}
+		wait, ok := rc.retryAfter(resp)
+		if !ok {
+			return resp, err
+		}
+		resp.Body.Close()
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+		req = req.Clone(req.Context())
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// doAuth sets the auth header on the passed request and sends it. If the upstream rejects the
+// request with a 401 and the receiver has a Reauth function then the request is retried once
+// with the new auth header, unless the request has a body that can't be re-read. The new
+// header is kept in the receiver so that a later retry by 'do' sends it too.
+func (rc *RegClient) doAuth(req *http.Request) (*http.Response, error) {
+	rc.setAuthHdr(req)
+	resp, err := rc.Client.Do(req)
+	if err != nil {
+		return nil, networkError(err)
+	}
+	if resp.StatusCode != http.StatusUnauthorized || rc.Reauth == nil || rc.AuthHdr == (AuthHeader{}) {
+		return resp, err
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return resp, err
+	}
+	hdr, reauthErr := rc.Reauth(rc.AuthHdr)
+	if reauthErr != nil {
+		// the original 401 is returned to the caller
+		return resp, err
+	}
+	resp.Body.Close()
+	rc.AuthHdr = hdr
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	retry.Header.Set(hdr.Key, hdr.Value)
+	if resp, err = rc.Client.Do(retry); err != nil {
+		return nil, networkError(err)
+	}
+	return resp, nil
+}
+
+// retryAfter returns how long to wait before retrying a request that got the passed
+// response, and true, if the response is a 429 or a 503 with a Retry-After header in
+// seconds or as an HTTP date. The wait is capped by the 'MaxRetryAfter' of the receiver.
+func (rc RegClient) retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable || rc.MaxRetryAfter < 0 {
+		return 0, false
+	}
+	hdr := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	var wait time.Duration
+	if secs, err := strconv.Atoi(hdr); err == nil && secs >= 0 {
+		wait = time.Duration(secs) * time.Second
+	} else if when, err := http.ParseTime(hdr); err == nil {
+		wait = max(time.Until(when), 0)
+	} else {
+		return 0, false
+	}
+	maxWait := rc.MaxRetryAfter
+	if maxWait == 0 {
+		maxWait = DefaultMaxRetryAfter
+	}
+	return min(wait, maxWait), true
+}
+
+// networkError wraps the passed error from sending a request or reading a response in a
+// 'types.ErrNetwork' if it is a TLS, DNS, connection, or timeout error, so callers can tell
+// if retrying makes sense. Other errors, including a cancelled context and errors writing
+// to the file system, are returned as is.
+func networkError(err error) error {
+	var (
+		dnsErr     *net.DNSError
+		verifyErr  *tls.CertificateVerificationError
+		recordErr  tls.RecordHeaderError
+		alertErr   tls.AlertError
+		authErr    x509.UnknownAuthorityError
+		hostErr    x509.HostnameError
+		invalidErr x509.CertificateInvalidError
+		ne         net.Error
+	)
+	category := types.ErrTransient
+	switch {
+	case err == nil || errors.Is(err, context.Canceled):
+		return err
+	case errors.As(err, &verifyErr), errors.As(err, &recordErr), errors.As(err, &alertErr),
+		errors.As(err, &authErr), errors.As(err, &hostErr), errors.As(err, &invalidErr):
+		category = types.ErrPermanent
+	case errors.As(err, &dnsErr):
+		if dnsErr.IsNotFound {
+			category = types.ErrPermanent
+		}
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNABORTED),
+		errors.Is(err, syscall.EPIPE), errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH),
+		errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+	case errors.As(err, &ne) && ne.Timeout():
+	default:
+		return err
+	}
+	return &types.ErrNetwork{Category: category, Err: err}
+}
+
+// acceptGzip asks for the response to the passed request to be gzip compressed, for the
+// manifest and tag list requests whose JSON responses, like large image lists, compress
+// well. Since the header is set explicitly, the http transport doesn't decompress the
+// response, even if the transport has compression disabled, so the body must be read
+// with 'decodedBody'. Servers that don't support compression ignore the header.
+func acceptGzip(req *http.Request) {
+	req.Header.Set("Accept-Encoding", "gzip")
+}
+
+// acceptIdentity asks for the response to the passed request not to be compressed in
+// transit. This is for blob requests: layers are usually already compressed, and the
+// http transport would otherwise ask for gzip and decompress the response, which spends
+// CPU for no gain. The body is still read with 'decodedBody' in case the server
+// compresses it anyway, so the bytes are the ones that the digest covers.
+func acceptIdentity(req *http.Request) {
+	req.Header.Set("Accept-Encoding", "identity")
+}
+
+// decodedBody returns a reader of the body of the passed response that decompresses the
+// body if the server compressed it with gzip. Closing the response body is still up to
+// the caller.
+func decodedBody(resp *http.Response) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return resp.Body, nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip response: %w", err)
+		}
+		return zr, nil
+	}
+	return nil, fmt.Errorf("unsupported content encoding %q", resp.Header.Get("Content-Encoding"))
+}
+
 // setAuthHdr sets an auth header (e.g. "Bearer", "Basic") on the passed request
 // if the receiver is configured with such a header.
 func (rc RegClient) setAuthHdr(req *http.Request) {
@@ -329,3 +687,351 @@ func getWwwAuthenticateHdrs(r *http.Response) []string {
 	}
 	return hdrs
 }
+
+// V2BlobsExists does a HEAD request for the blob with the passed digest and returns
+// true if the blob exists in the upstream, and false if the upstream returns 404.
+func (rc RegClient) V2BlobsExists(digest string) (bool, error) {
+	req, _ := http.NewRequest(http.MethodHead, rc.makeBlobUrl(digest), nil)
+	resp, err := rc.do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return false, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("head blob %q failed with status %d", digest, resp.StatusCode)
+}
+
+// V2BlobsUpload uploads the blob described by the passed 'layer' from the file 'fromFile'
+// using a monolithic upload: a POST to the 'v2/<repository>/blobs/uploads/' endpoint to
+// start the upload session, and then a single PUT of the blob content to the location
+// returned by the upstream.
+func (rc RegClient) V2BlobsUpload(layer types.Layer, fromFile string) error {
+	req, _ := http.NewRequest(http.MethodPost, rc.makeRepoUrl("blobs/uploads/"), nil)
+	resp, err := rc.do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("start blob upload for %q failed with status %d", layer.Digest, resp.StatusCode)
+	}
+	location, err := resp.Location()
+	if err != nil {
+		return fmt.Errorf("start blob upload for %q did not return a location: %w", layer.Digest, err)
+	}
+	q := location.Query()
+	q.Set("digest", layer.Digest)
+	location.RawQuery = q.Encode()
+
+	blobFile, err := os.Open(fromFile)
+	if err != nil {
+		return err
+	}
+	defer blobFile.Close()
+	req, _ = http.NewRequest(http.MethodPut, location.String(), blobFile)
+	req.ContentLength = int64(layer.Size)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	putResp, err := rc.do(req)
+	if putResp != nil {
+		defer putResp.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if putResp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("blob upload for %q failed with status %d", layer.Digest, putResp.StatusCode)
+	}
+	return nil
+}
+
+// V2ManifestsPut calls the 'v2/<repository>/manifests' endpoint with a PUT to upload the
+// passed manifest bytes. If 'ref' is empty then the ref in the receiver's image url is used,
+// otherwise 'ref' (a tag or a digest) overrides it.
+func (rc RegClient) V2ManifestsPut(ref string, mediaType types.MediaType, manifest []byte) error {
+	url := rc.makeManifestUrl(ref)
+	req, _ := http.NewRequest(http.MethodPut, url, bytes.NewReader(manifest))
+	req.Header.Set("Content-Type", string(mediaType))
+	resp, err := rc.do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("put manifest for %q failed with status %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+// V2ManifestsDelete calls the 'v2/<repository>/manifests' endpoint with a DELETE to delete
+// the manifest with the passed 'ref'. If 'ref' is empty then the ref in the receiver's image
+// url is used. The distribution spec deletes manifests by digest, and some registries also
+// support deleting a tag.
+func (rc RegClient) V2ManifestsDelete(ref string) error {
+	return rc.v2Delete("manifest", rc.makeManifestUrl(ref))
+}
+
+// V2BlobsDelete calls the 'v2/<repository>/blobs' endpoint with a DELETE to delete the blob
+// with the passed digest.
+func (rc RegClient) V2BlobsDelete(digest string) error {
+	return rc.v2Delete("blob", rc.makeBlobUrl(digest))
+}
+
+// v2Delete sends a DELETE to the passed url. Registries respond 202 if the content was
+// deleted, and registries that have deletes disabled respond 405.
+func (rc RegClient) v2Delete(kind string, url string) error {
+	req, _ := http.NewRequest(http.MethodDelete, url, nil)
+	resp, err := rc.do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusAccepted, http.StatusOK:
+		return nil
+	case http.StatusMethodNotAllowed:
+		return fmt.Errorf("delete %s for %q failed: deletes are not enabled in the registry", kind, url)
+	}
+	return fmt.Errorf("delete %s for %q failed with status %d", kind, url, resp.StatusCode)
+}
+
+// V2Tags calls the 'v2/<repository>/tags/list' endpoint and returns the tags in the
+// repository. Registries that paginate the tag list return the url of the next page in
+// a 'Link' header, and the pages are followed until there are no more.
+func (rc RegClient) V2Tags() ([]string, error) {
+	tags := []string{}
+	visited := map[string]bool{}
+	for next := rc.makeRepoUrl("tags/list"); next != ""; {
+		if visited[next] {
+			return nil, fmt.Errorf("tag list pagination loops at %q", next)
+		}
+		visited[next] = true
+		page, link, err := rc.v2TagsPage(next)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, page...)
+		next = link
+	}
+	return tags, nil
+}
+
+// v2TagsPage gets one page of the tag list from the passed url. It returns the tags
+// in the page and the url of the next page, or the empty string if it is the last page.
+func (rc RegClient) v2TagsPage(pageUrl string) ([]string, string, error) {
+	req, _ := http.NewRequest(http.MethodGet, pageUrl, nil)
+	acceptGzip(req)
+	resp, err := rc.do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", &types.ErrStatus{Op: "get tags", Url: pageUrl, StatusCode: resp.StatusCode}
+	}
+	body, err := decodedBody(resp)
+	if err != nil {
+		return nil, "", err
+	}
+	tl := struct {
+		Tags []string `json:"tags"`
+	}{}
+	if err := json.NewDecoder(io.LimitReader(body, DefaultMaxManifestBytes)).Decode(&tl); err != nil {
+		return nil, "", fmt.Errorf("invalid tag list from %q: %w", pageUrl, err)
+	}
+	next, err := nextPageUrl(resp)
+	return tl.Tags, next, err
+}
+
+// nextPageUrl returns the absolute url of the next page from the 'Link' header of the
+// passed response, like '</v2/foo/tags/list?n=100&last=v1>; rel="next"', or the empty
+// string if there is no next page.
+func nextPageUrl(resp *http.Response) (string, error) {
+	for _, link := range resp.Header.Values("Link") {
+		target, params, _ := strings.Cut(link, ";")
+		target = strings.TrimSpace(target)
+		if !strings.Contains(params, `rel="next"`) || !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+			continue
+		}
+		next, err := resp.Request.URL.Parse(strings.Trim(target, "<>"))
+		if err != nil {
+			return "", fmt.Errorf("invalid link header %q: %w", link, err)
+		}
+		// keep the namespace query param if the registry didn't
+		if ns := resp.Request.URL.Query().Get("ns"); ns != "" && !next.Query().Has("ns") {
+			q := next.Query()
+			q.Set("ns", ns)
+			next.RawQuery = q.Encode()
+		}
+		return next.String(), nil
+	}
+	return "", nil
+}
+
+// V2Version calls the 'v2/' endpoint of the server and returns the value of the
+// 'Docker-Distribution-API-Version' header, like 'registry/2.0', or the empty string if
+// the server doesn't send it. An error is returned if the server doesn't implement the
+// endpoint, which means it isn't a v2 registry.
+func (rc RegClient) V2Version() (string, error) {
+	url := rc.ImgRef.ServerUrl() + "/v2/"
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	resp, err := rc.do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return "", err
+	}
+	// a registry that requires auth for the endpoint still sends the header with the 401
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
+		return "", fmt.Errorf("get %q failed with status %d", url, resp.StatusCode)
+	}
+	return resp.Header.Get("Docker-Distribution-API-Version"), nil
+}
+
+// V2ReferrersSupported calls the 'v2/<repository>/referrers/<digest>' endpoint with the
+// digest of empty content and returns true if the server implements the OCI referrers API.
+// A server that implements the API returns an empty index for a digest with no referrers,
+// and a server that doesn't returns 404 or another client error.
+func (rc RegClient) V2ReferrersSupported() (bool, error) {
+	req, _ := http.NewRequest(http.MethodGet, rc.makeRepoUrl("referrers/"+digest.FromBytes(nil).String()), nil)
+	req.Header.Set("Accept", string(types.V1ociIndexMt))
+	resp, err := rc.do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, nil
+	}
+	return strings.HasPrefix(resp.Header.Get("Content-Type"), string(types.V1ociIndexMt)), nil
+}
+
+// V2TagsPage calls the 'v2/<repository>/tags/list' endpoint asking for at most 'n' tags
+// and returns the number of tags in the response, and whether the response has a 'Link'
+// header with the url of the next page.
+func (rc RegClient) V2TagsPage(n int) (int, bool, error) {
+	pageUrl := rc.makeRepoUrl("tags/list")
+	if strings.Contains(pageUrl, "?") {
+		pageUrl += fmt.Sprintf("&n=%d", n)
+	} else {
+		pageUrl += fmt.Sprintf("?n=%d", n)
+	}
+	tags, next, err := rc.v2TagsPage(pageUrl)
+	if err != nil {
+		return 0, false, err
+	}
+	return len(tags), next != "", nil
+}
+
+// UploadCapabilities describes the blob upload session started by 'V2BlobsUploadProbe'.
+type UploadCapabilities struct {
+	// Chunked is true if the server indicated that it accepts chunked (PATCH) uploads
+	Chunked bool
+	// ChunkMinLength is the smallest chunk the server accepts, from the
+	// 'OCI-Chunk-Min-Length' header, or zero if the server didn't send it.
+	ChunkMinLength int64
+}
+
+// V2BlobsUploadProbe starts a blob upload session with a POST to the
+// 'v2/<repository>/blobs/uploads/' endpoint and then cancels it with a DELETE. A server
+// that accepts chunked uploads returns a 'Range' header with the bytes received so far or
+// an 'OCI-Chunk-Min-Length' header when the session is started. The caller must have
+// push access to the repository.
+func (rc RegClient) V2BlobsUploadProbe() (UploadCapabilities, error) {
+	req, _ := http.NewRequest(http.MethodPost, rc.makeRepoUrl("blobs/uploads/"), nil)
+	resp, err := rc.do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return UploadCapabilities{}, err
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		return UploadCapabilities{}, fmt.Errorf("start blob upload failed with status %d", resp.StatusCode)
+	}
+	uc := UploadCapabilities{}
+	if minLength := resp.Header.Get("OCI-Chunk-Min-Length"); minLength != "" {
+		uc.ChunkMinLength, _ = strconv.ParseInt(minLength, 10, 64)
+		uc.Chunked = true
+	}
+	if resp.Header.Get("Range") != "" {
+		uc.Chunked = true
+	}
+	// cancel the session - a server that doesn't support cancelling lets it expire
+	if location, err := resp.Location(); err == nil {
+		req, _ := http.NewRequest(http.MethodDelete, location.String(), nil)
+		if cancelResp, err := rc.do(req); err == nil {
+			cancelResp.Body.Close()
+		}
+	}
+	return uc, nil
+}
+
+// makeBlobUrl forms the URL string for the v2/.../blobs API call for the passed
+// digest.
+func (rc RegClient) makeBlobUrl(digest string) string {
+	return rc.makeRepoUrl("blobs/" + digest)
+}
+
+// makeRepoUrl forms a URL for the passed path under the receiver's repository, e.g.
+// passing "blobs/uploads/" returns a URL like 'https://foo.io/v2/bar/blobs/uploads/'. Like
+// 'makeManifestUrl', it takes into account whether the image ref in the receiver is
+// namespaced, and whether the namespace is path-based or parameter based.
+func (rc RegClient) makeRepoUrl(path string) string {
+	if rc.ImgRef.NsInPath() {
+		return fmt.Sprintf("%s/v2/%s/%s/%s", rc.ImgRef.ServerUrl(), rc.ImgRef.Namespace(), rc.ImgRef.Repository(), path)
+	} else {
+		return fmt.Sprintf("%s/v2/%s/%s%s", rc.ImgRef.ServerUrl(), rc.ImgRef.Repository(), path, rc.nsQueryParm())
+	}
+}
+
+// schema1Payload returns the JWS payload of a signed schema 1 manifest, which is
+// what the manifest digest is computed from. The payload is the manifest up to the
+// 'formatLength' in the protected header of the first signature, followed by the
+// 'formatTail' from the same header.
+func schema1Payload(manifest []byte) ([]byte, error) {
+	m := struct {
+		Signatures []struct {
+			Protected string `json:"protected"`
+		} `json:"signatures"`
+	}{}
+	if err := json.Unmarshal(manifest, &m); err != nil {
+		return nil, err
+	}
+	if len(m.Signatures) == 0 {
+		return manifest, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(m.Signatures[0].Protected, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema 1 manifest signature: %w", err)
+	}
+	protected := struct {
+		FormatLength int    `json:"formatLength"`
+		FormatTail   string `json:"formatTail"`
+	}{}
+	if err := json.Unmarshal(b, &protected); err != nil {
+		return nil, fmt.Errorf("invalid schema 1 manifest signature: %w", err)
+	}
+	tail, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(protected.FormatTail, "="))
+	if err != nil || protected.FormatLength > len(manifest) || protected.FormatLength < 0 {
+		return nil, fmt.Errorf("invalid schema 1 manifest signature format")
+	}
+	return append(append([]byte{}, manifest[:protected.FormatLength]...), tail...), nil
+}
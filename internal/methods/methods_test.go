@@ -1,11 +1,18 @@
 package methods
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -18,6 +25,8 @@ import (
 	"github.com/aceeric/imgpull/internal/testhelpers"
 	"github.com/aceeric/imgpull/mock"
 	"github.com/aceeric/imgpull/pkg/imgpull/types"
+
+	"github.com/opencontainers/go-digest"
 )
 
 // Tests bearer auth
@@ -88,12 +97,286 @@ func TestV2BlobsSimple(t *testing.T) {
 	}
 }
 
+// Tests that a blob that doesn't match the expected size is not left behind.
+func TestV2BlobsPartial(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	rc, err := newRegClient("hello-world:latest", url, "")
+	if err != nil {
+		t.Fail()
+	}
+	defer server.Close()
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+
+	digest := "sha256:d2c94e258dcb3c5ac2798d32e1249e42ef01cba4841c2234249495f87264ac5a"
+	blobFile := filepath.Join(d, digest)
+
+	layer := types.Layer{
+		MediaType: types.V2dockerLayerGzipMt,
+		Digest:    digest,
+		Size:      582,
+	}
+	if rc.V2Blobs(layer, blobFile) == nil {
+		t.Fail()
+	}
+	if _, err := os.Stat(blobFile); !os.IsNotExist(err) {
+		t.Fail()
+	}
+}
+
+// Tests that blobs larger than the maximum blob size are rejected, before pulling if
+// the size is known, and while pulling if not.
+func TestV2BlobsMaxSize(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	rc, err := newRegClient("hello-world:latest", url, "")
+	if err != nil {
+		t.Fail()
+	}
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+
+	digest := "sha256:d2c94e258dcb3c5ac2798d32e1249e42ef01cba4841c2234249495f87264ac5a"
+	blobFile := filepath.Join(d, digest)
+	for _, tc := range []struct {
+		max     int64
+		size    int
+		success bool
+	}{
+		{max: 581, size: 581, success: true},
+		{max: 580, size: 581, success: false},
+		{max: 580, size: 0, success: false},
+		{max: 581, size: 0, success: true},
+	} {
+		os.Remove(blobFile)
+		rc.MaxBlobBytes = tc.max
+		layer := types.Layer{
+			MediaType: types.V2dockerLayerGzipMt,
+			Digest:    digest,
+			Size:      tc.size,
+		}
+		if err := rc.V2Blobs(layer, blobFile); (err == nil) != tc.success {
+			t.Fail()
+		}
+	}
+}
+
+// Tests that manifests larger than the maximum manifest size are rejected rather
+// than truncated.
+func TestV2ManifestsMaxSize(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	rc, err := newRegClient("hello-world:latest", url, "")
+	if err != nil {
+		t.Fail()
+	}
+	mr, err := rc.V2Manifests("")
+	if err != nil {
+		t.FailNow()
+	}
+	rc.MaxManifestBytes = int64(len(mr.ManifestBytes))
+	if _, err := rc.V2Manifests(""); err != nil {
+		t.Fail()
+	}
+	rc.MaxManifestBytes--
+	if _, err := rc.V2Manifests(""); err == nil {
+		t.Fail()
+	}
+}
+
+// Tests that the caller-supplied media types are sent in the Accept header, and that
+// the manifest is returned as provided by the server even if its type isn't modeled.
+func TestV2ManifestsAccept(t *testing.T) {
+	mediaType := "application/vnd.example.manifest.v9+json"
+	manifest := []byte(`{"schemaVersion":9}`)
+	var accept string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept = r.Header.Get("Accept")
+		w.Header().Set("Content-Type", mediaType)
+		w.Write(manifest)
+	}))
+	defer server.Close()
+	rc, err := newRegClient("hello-world:latest", strings.TrimPrefix(server.URL, "http://"), "")
+	if err != nil {
+		t.FailNow()
+	}
+	for _, tc := range []struct {
+		accept   []types.MediaType
+		expected string
+	}{
+		{[]types.MediaType{types.MediaType(mediaType)}, mediaType},
+		{[]types.MediaType{types.MediaType(mediaType), types.V1ociIndexMt}, mediaType + "," + string(types.V1ociIndexMt)},
+		{nil, allManifestTypesStr()},
+	} {
+		mr, err := rc.V2ManifestsAccept("v9", tc.accept)
+		if err != nil {
+			t.Fatalf("get manifest: %s", err)
+		}
+		if accept != tc.expected {
+			t.Errorf("expected accept %q, got %q", tc.expected, accept)
+		}
+		if string(mr.MediaType) != mediaType || !bytes.Equal(mr.ManifestBytes, manifest) || mr.ManifestDigest != digest.FromBytes(manifest).Encoded() {
+			t.Errorf("unexpected manifest %+v", mr)
+		}
+	}
+	// the accept types in the client are the default
+	rc.AcceptTypes = []types.MediaType{types.V1ociIndexMt, types.V1ociManifestMt}
+	ociOnly := string(types.V1ociIndexMt) + "," + string(types.V1ociManifestMt)
+	if _, err := rc.V2Manifests(""); err != nil || accept != ociOnly {
+		t.Errorf("expected accept %q, got %q %v", ociOnly, accept, err)
+	}
+	if _, err := rc.V2ManifestsAccept("v9", nil); err != nil || accept != ociOnly {
+		t.Errorf("expected accept %q, got %q %v", ociOnly, accept, err)
+	}
+}
+
+// Tests following the 'Link' header to get all the pages of a tag list, resolving a
+// relative link and keeping the namespace query param.
+func TestV2Tags(t *testing.T) {
+	pages := map[string]string{
+		"":  `{"name":"hello-world","tags":["a","b"]}`,
+		"b": `{"name":"hello-world","tags":["c","d"]}`,
+		"d": `{"name":"hello-world","tags":["e"]}`,
+	}
+	var namespaces []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/hello-world/tags/list" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		namespaces = append(namespaces, r.URL.Query().Get("ns"))
+		last := r.URL.Query().Get("last")
+		switch last {
+		case "":
+			w.Header().Set("Link", `</v2/hello-world/tags/list?n=2&last=b>; rel="next"`)
+		case "b":
+			w.Header().Set("Link", `<list?n=2&last=d>; rel="next"`)
+		}
+		w.Write([]byte(pages[last]))
+	}))
+	defer server.Close()
+	rc, err := newRegClient("hello-world:latest", strings.TrimPrefix(server.URL, "http://"), "docker.io")
+	if err != nil {
+		t.FailNow()
+	}
+	tags, err := rc.V2Tags()
+	if err != nil {
+		t.Fatalf("get tags: %s", err)
+	}
+	if strings.Join(tags, ",") != "a,b,c,d,e" {
+		t.Errorf("unexpected tags %v", tags)
+	}
+	if strings.Join(namespaces, ",") != "docker.io,docker.io,docker.io" {
+		t.Errorf("expected the namespace in each request, got %v", namespaces)
+	}
+	rc, _ = newRegClient("frobozz:latest", strings.TrimPrefix(server.URL, "http://"), "")
+	if _, err := rc.V2Tags(); err == nil {
+		t.Error("expected an error for a missing repository")
+	}
+}
+
+// Tests that a manifest requested by digest must have that digest even if the
+// Docker-Content-Digest header matches the content, and that a header that doesn't
+// match the content is a mismatch.
+func TestV2ManifestsDigestMismatch(t *testing.T) {
+	manifest := []byte(`{"schemaVersion":2}`)
+	var hdrDigest string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", string(types.V1ociManifestMt))
+		w.Header().Set("Docker-Content-Digest", hdrDigest)
+		w.Write(manifest)
+	}))
+	defer server.Close()
+	actual := digest.FromBytes(manifest).String()
+	requested := digest.FromString("frobozz").String()
+	for _, tc := range []struct {
+		image     string
+		ref       string
+		hdrDigest string
+		expected  string
+	}{
+		{"hello-world:latest", requested, actual, requested},
+		{"hello-world@" + requested, "", actual, requested},
+		{"hello-world:latest", "latest", requested, requested},
+		{"hello-world:latest", "", "", ""},
+		{"hello-world:latest", actual, actual, ""},
+	} {
+		hdrDigest = tc.hdrDigest
+		rc, err := newRegClient(tc.image, strings.TrimPrefix(server.URL, "http://"), "")
+		if err != nil {
+			t.FailNow()
+		}
+		_, err = rc.V2Manifests(tc.ref)
+		var dme *types.ErrDigestMismatch
+		if tc.expected == "" && err != nil {
+			t.Errorf("image %s ref %q: unexpected error %s", tc.image, tc.ref, err)
+		} else if tc.expected != "" && (!errors.As(err, &dme) || dme.Expected != tc.expected || dme.Actual != actual) {
+			t.Errorf("image %s ref %q: expected a digest mismatch, got %v", tc.image, tc.ref, err)
+		}
+	}
+}
+
+// mapCache is a 'types.ManifestCache' for tests
+type mapCache map[string]types.CachedManifest
+
+func (mc mapCache) Get(key string) (types.CachedManifest, bool) {
+	cm, found := mc[key]
+	return cm, found
+}
+
+func (mc mapCache) Put(key string, cm types.CachedManifest) {
+	mc[key] = cm
+}
+
+// Tests that a cached manifest is fetched with If-None-Match, and that the cached manifest
+// is returned when the server responds 304 Not Modified.
+func TestV2ManifestsCache(t *testing.T) {
+	manifest := []byte(`{"schemaVersion":2}`)
+	etag := `"` + digest.FromBytes(manifest).String() + `"`
+	var ifNoneMatch []string
+	var sent int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifNoneMatch = append(ifNoneMatch, r.Header.Get("If-None-Match"))
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", string(types.V1ociManifestMt))
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(manifest).String())
+		w.Header().Set("ETag", etag)
+		sent++
+		w.Write(manifest)
+	}))
+	defer server.Close()
+	rc, err := newRegClient("hello-world:latest", strings.TrimPrefix(server.URL, "http://"), "")
+	if err != nil {
+		t.FailNow()
+	}
+	cache := mapCache{}
+	rc.ManifestCache = cache
+	for i := 0; i < 3; i++ {
+		mr, err := rc.V2Manifests("")
+		if err != nil {
+			t.Fatalf("get manifest: %s", err)
+		}
+		if mr.MediaType != types.V1ociManifestMt || !bytes.Equal(mr.ManifestBytes, manifest) || mr.ManifestDigest != digest.FromBytes(manifest).Encoded() {
+			t.Errorf("unexpected manifest %+v", mr)
+		}
+	}
+	if sent != 1 || len(cache) != 1 {
+		t.Errorf("expected the manifest to be sent once and cached, sent %d cached %d", sent, len(cache))
+	}
+	if strings.Join(ifNoneMatch, ",") != ","+etag+","+etag {
+		t.Errorf("unexpected If-None-Match headers %v", ifNoneMatch)
+	}
+}
+
 // Tests concurrent blob fetch. Spins up multiple goroutines to get the
 // same blob and verifies that only one goroutine actually called the
 // v2/blobs endpoint. (The others were therefore enqueued.)
 func TestV2BlobsConcur(t *testing.T) {
 	blob := "zzzz"
-	digest := testhelpers.MakeDigest()
+	digest := digest.FromString(blob).Encoded()
 
 	var httpMethodCnt atomic.Uint64
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -114,7 +397,8 @@ func TestV2BlobsConcur(t *testing.T) {
 	d, _ := os.MkdirTemp("", "")
 	defer os.RemoveAll(d)
 
-	blobsync.SetConcurrentBlobs(10)
+	bs := blobsync.NewBlobSyncer(10)
+	defer bs.Close()
 
 	var wg sync.WaitGroup
 	blobPullerCnt := 6
@@ -131,7 +415,9 @@ func TestV2BlobsConcur(t *testing.T) {
 			if err != nil {
 				t.Fail()
 			}
-			if rc.V2Blobs(layer, filepath.Join(d, digest)) != nil {
+			rc.Syncer = bs
+			os.MkdirAll(filepath.Join(d, strconv.Itoa(i)), 0755)
+			if rc.V2Blobs(layer, filepath.Join(d, strconv.Itoa(i), digest)) != nil {
 				t.Fail()
 			}
 		}()
@@ -141,11 +427,17 @@ func TestV2BlobsConcur(t *testing.T) {
 	if int(httpMethodCnt.Load()) != 1 {
 		t.Fail()
 	}
+	// every goroutine has the blob at its own path
+	for i := 0; i < blobPullerCnt; i++ {
+		if b, err := os.ReadFile(filepath.Join(d, strconv.Itoa(i), digest)); err != nil || string(b) != blob {
+			t.Fail()
+		}
+	}
 }
 
 // Test namespace query param for pull-through / mirror support
 func TestNs(t *testing.T) {
-	rc, err := newRegClient("hello-world:latest", "", "frobozz.io")
+	rc, err := newRegClient("hello-world:latest", "localhost:8080", "frobozz.io")
 	if err != nil {
 		t.Fail()
 	}
@@ -245,6 +537,7 @@ func TestV2Manifests(t *testing.T) {
 	if err != nil {
 		t.Fail()
 	}
+	rc.AuthHdr = AuthHeader{Key: "Authorization", Value: "Bearer FROBOZZ"}
 	mr, err := rc.V2Manifests("")
 	if err != nil {
 		t.Fail()
@@ -306,3 +599,272 @@ func newRegClient(image string, url string, namespace string) (RegClient, error)
 		AuthHdr: AuthHeader{},
 	}, nil
 }
+
+// Tests pushing a blob and a manifest, and checking blob existence.
+func TestV2Push(t *testing.T) {
+	pr, server, url := testhelpers.NewPushRegistry()
+	defer server.Close()
+	rc, err := newRegClient("hello-world:latest", url, "")
+	if err != nil {
+		t.FailNow()
+	}
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+	blob := []byte("frobozz")
+	blobFile := filepath.Join(d, "blob")
+	if os.WriteFile(blobFile, blob, 0644) != nil {
+		t.FailNow()
+	}
+	layer := types.Layer{
+		MediaType: types.V1ociLayerGzipMt,
+		Digest:    digest.FromBytes(blob).String(),
+		Size:      len(blob),
+	}
+	if exists, err := rc.V2BlobsExists(layer.Digest); err != nil || exists {
+		t.Fail()
+	}
+	if rc.V2BlobsUpload(layer, blobFile) != nil {
+		t.Fail()
+	}
+	if exists, err := rc.V2BlobsExists(layer.Digest); err != nil || !exists {
+		t.Fail()
+	}
+	manifest := []byte(`{"schemaVersion":2}`)
+	if rc.V2ManifestsPut("", types.V1ociManifestMt, manifest) != nil {
+		t.Fail()
+	}
+	if _, mt, found := pr.Manifest("hello-world", "latest"); !found || mt != string(types.V1ociManifestMt) {
+		t.Fail()
+	}
+}
+
+// Tests deleting a manifest by tag and by digest, deleting a blob, and the error from
+// a registry that has deletes disabled.
+func TestV2Delete(t *testing.T) {
+	pr, server, url := testhelpers.NewPushRegistry()
+	defer server.Close()
+	rc, err := newRegClient("hello-world:latest", url, "")
+	if err != nil {
+		t.FailNow()
+	}
+	manifest := []byte(`{"schemaVersion":2}`)
+	dgst := digest.FromBytes(manifest).String()
+	for _, tag := range []string{"latest", "v1", "v2"} {
+		if rc.V2ManifestsPut(tag, types.V1ociManifestMt, manifest) != nil {
+			t.FailNow()
+		}
+	}
+	if rc.V2ManifestsDelete("v1") != nil {
+		t.Error("expected deleting a tag to succeed")
+	}
+	if _, _, found := pr.Manifest("hello-world", "v1"); found {
+		t.Error("expected tag v1 to be deleted")
+	}
+	if _, _, found := pr.Manifest("hello-world", "v2"); !found {
+		t.Error("expected tag v2 to remain")
+	}
+	// deleting by digest removes the remaining tags
+	if rc.V2ManifestsDelete(dgst) != nil {
+		t.Error("expected deleting a digest to succeed")
+	}
+	for _, ref := range []string{"latest", "v2", dgst} {
+		if _, _, found := pr.Manifest("hello-world", ref); found {
+			t.Errorf("expected %s to be deleted", ref)
+		}
+	}
+	if err := rc.V2ManifestsDelete(dgst); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected 404 deleting a missing manifest, got %v", err)
+	}
+	blob := []byte("frobozz")
+	blobDigest := digest.FromBytes(blob).String()
+	pr.Blobs["hello-world"] = map[string][]byte{blobDigest: blob}
+	pr.DisableDeletes = true
+	if err := rc.V2BlobsDelete(blobDigest); err == nil || !strings.Contains(err.Error(), "not enabled") {
+		t.Errorf("expected deletes not enabled, got %v", err)
+	}
+	pr.DisableDeletes = false
+	if rc.V2BlobsDelete(blobDigest) != nil {
+		t.Error("expected deleting a blob to succeed")
+	}
+	if _, found := pr.Blob("hello-world", blobDigest); found {
+		t.Error("expected the blob to be deleted")
+	}
+}
+
+func TestSchema1Payload(t *testing.T) {
+	payload := []byte("{\n   \"schemaVersion\": 1,\n   \"name\": \"hello\"\n}")
+	formatLength := len(payload) - 2
+	protected, _ := json.Marshal(map[string]any{
+		"formatLength": formatLength,
+		"formatTail":   base64.RawURLEncoding.EncodeToString(payload[formatLength:]),
+	})
+	signed := fmt.Sprintf("%s,\n   \"signatures\": [{\"signature\": \"x\", \"protected\": %q}]\n}",
+		payload[:formatLength], base64.RawURLEncoding.EncodeToString(protected))
+	actual, err := schema1Payload([]byte(signed))
+	if err != nil || !bytes.Equal(actual, payload) {
+		t.Fail()
+	}
+	if actual, err := schema1Payload(payload); err != nil || !bytes.Equal(actual, payload) {
+		t.Fail()
+	}
+}
+
+// Tests that manifest and tag list requests ask for gzip compression and decompress the
+// response, and that blob requests ask for no compression but are still decompressed if
+// the server compresses them anyway.
+func TestTransportCompression(t *testing.T) {
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`)
+	blob := []byte("frobozz")
+	encodings := map[string]string{}
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kind := "manifests"
+		body := manifest
+		if strings.Contains(r.URL.Path, "/tags/") {
+			kind, body = "tags", []byte(`{"name":"hello-world","tags":["v1","v2"]}`)
+		} else if strings.Contains(r.URL.Path, "/blobs/") {
+			kind, body = "blobs", blob
+		}
+		mu.Lock()
+		encodings[kind] = r.Header.Get("Accept-Encoding")
+		mu.Unlock()
+		w.Header().Set("Content-Type", string(types.V1ociIndexMt))
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		zw.Write(body)
+		zw.Close()
+	}))
+	defer server.Close()
+	rc, err := newRegClient("hello-world:latest", strings.TrimPrefix(server.URL, "http://"), "")
+	if err != nil {
+		t.FailNow()
+	}
+	mr, err := rc.V2Manifests("")
+	if err != nil || !bytes.Equal(mr.ManifestBytes, manifest) || mr.ManifestDigest != digest.FromBytes(manifest).Encoded() {
+		t.Errorf("unexpected manifest %+v %v", mr, err)
+	}
+	if tags, err := rc.V2Tags(); err != nil || len(tags) != 2 {
+		t.Errorf("unexpected tags %v %v", tags, err)
+	}
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+	layer := types.Layer{Digest: digest.FromBytes(blob).String(), Size: len(blob)}
+	if err := rc.V2Blobs(layer, filepath.Join(d, "blob")); err != nil {
+		t.Errorf("get blob: %s", err)
+	}
+	if encodings["manifests"] != "gzip" || encodings["tags"] != "gzip" || encodings["blobs"] != "identity" {
+		t.Errorf("unexpected accept encodings %v", encodings)
+	}
+}
+
+// Tests that a 429 or a 503 with a Retry-After header is retried after the wait, capped by
+// MaxRetryAfter, and that a negative MaxRetryAfter returns the response without a retry.
+func TestRetryAfter(t *testing.T) {
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`)
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch requests {
+		case 1:
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			w.Header().Set("Retry-After", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat))
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Header().Set("Content-Type", string(types.V1ociIndexMt))
+			w.Write(manifest)
+		}
+	}))
+	defer server.Close()
+	rc, err := newRegClient("hello-world:latest", strings.TrimPrefix(server.URL, "http://"), "")
+	if err != nil {
+		t.FailNow()
+	}
+	rc.MaxRetryAfter = 10 * time.Millisecond
+	start := time.Now()
+	if mr, err := rc.V2Manifests(""); err != nil || !bytes.Equal(mr.ManifestBytes, manifest) {
+		t.Errorf("unexpected manifest %+v %v", mr, err)
+	}
+	if requests != 3 || time.Since(start) > 10*time.Second {
+		t.Errorf("unexpected requests %d in %s", requests, time.Since(start))
+	}
+	requests = 0
+	rc.MaxRetryAfter = -1
+	if _, err := rc.V2Manifests(""); err == nil || requests != 1 {
+		t.Errorf("expected an error without a retry, got %d requests", requests)
+	}
+}
+
+// Tests that the auth header from a reauth on a 401 is sent on a retry after a 429,
+// rather than the rejected header.
+func TestRetryAfterReauth(t *testing.T) {
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`)
+	auths := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auths = append(auths, r.Header.Get("Authorization"))
+		switch len(auths) {
+		case 1:
+			w.WriteHeader(http.StatusUnauthorized)
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.Header().Set("Content-Type", string(types.V1ociIndexMt))
+			w.Write(manifest)
+		}
+	}))
+	defer server.Close()
+	rc, err := newRegClient("hello-world:latest", strings.TrimPrefix(server.URL, "http://"), "")
+	if err != nil {
+		t.FailNow()
+	}
+	rc.AuthHdr = AuthHeader{Key: "Authorization", Value: "Bearer expired"}
+	reauths := 0
+	rc.Reauth = func(AuthHeader) (AuthHeader, error) {
+		reauths++
+		return AuthHeader{Key: "Authorization", Value: "Bearer fresh"}, nil
+	}
+	if _, err := rc.V2Manifests(""); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if reauths != 1 || !slices.Equal(auths, []string{"Bearer expired", "Bearer fresh", "Bearer fresh"}) {
+		t.Errorf("unexpected reauths %d and auth headers %v", reauths, auths)
+	}
+}
+
+// Tests that a refused connection is a transient network error, that a server certificate
+// that isn't trusted is a permanent one, and that DNS errors are categorized by whether
+// the host was found.
+func TestNetworkError(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	addr := strings.TrimPrefix(server.URL, "http://")
+	server.Close()
+	rc, err := newRegClient("hello-world:latest", addr, "")
+	if err != nil {
+		t.FailNow()
+	}
+	_, err = rc.V2Manifests("")
+	var ne net.Error
+	if !errors.Is(err, types.ErrTransient) || errors.Is(err, types.ErrPermanent) || !errors.As(err, &ne) {
+		t.Errorf("expected a transient network error, got %v", err)
+	}
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsServer.Close()
+	if rc, err = newRegClient("hello-world:latest", strings.TrimPrefix(tlsServer.URL, "https://"), ""); err != nil {
+		t.FailNow()
+	}
+	rc.ImgRef = rc.ImgRef.WithScheme("https")
+	if _, err = rc.V2Manifests(""); !errors.Is(err, types.ErrPermanent) {
+		t.Errorf("expected a permanent network error, got %v", err)
+	}
+	if err := networkError(&net.DNSError{Name: "frobozz.invalid", IsNotFound: true}); !errors.Is(err, types.ErrPermanent) {
+		t.Errorf("expected a permanent network error, got %v", err)
+	}
+	if err := networkError(&net.DNSError{Name: "frobozz.invalid", IsTimeout: true}); !errors.Is(err, types.ErrTransient) {
+		t.Errorf("expected a transient network error, got %v", err)
+	}
+	if err := networkError(os.ErrPermission); err != os.ErrPermission {
+		t.Errorf("expected the error to be returned as is, got %v", err)
+	}
+}
@@ -0,0 +1,237 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// layerEntry identifies an entry in a specific layer.
+type layerEntry struct {
+	layer int
+	name  string
+}
+
+// FlattenToTar writes a single uncompressed tarball to 'tarfile' with the flattened
+// content of the passed layers, which are ordered from the base layer to the top layer.
+// Unlike ApplyLayers, the layers are streamed from one tarball to the other so ownership
+// and special files are preserved regardless of the privileges of the current process.
+// Whiteout entries are not included in the output. If the tarball can't be written then
+// the partial tarball is removed.
+func FlattenToTar(layers []Layer, tarfile string) (err error) {
+	survivors, needed, err := survivingEntries(layers)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(tarfile)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		if err != nil {
+			os.Remove(tarfile)
+		}
+	}()
+	tw := tar.NewWriter(f)
+	for i, layer := range layers {
+		if err := copyLayer(i, layer.File, tw, survivors, needed); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// survivingEntries reads the passed layers from the top layer to the base layer and
+// determines which entries in each layer are visible in the flattened file system. It
+// returns the visible entries, as well as the entries that are not visible but are the
+// target of a visible hard link in the same layer and so their content is needed. The
+// diff_id of each layer is verified along the way.
+func survivingEntries(layers []Layer) (map[layerEntry]bool, map[layerEntry]bool, error) {
+	survivors := map[layerEntry]bool{}
+	needed := map[layerEntry]bool{}
+	// value is true for directories
+	seen := map[string]bool{}
+	whiteouts := map[string]bool{}
+	opaques := map[string]bool{}
+	for i := len(layers) - 1; i >= 0; i-- {
+		tr, err := openLayer(layers[i].File)
+		if err != nil {
+			return nil, nil, err
+		}
+		// whiteouts in a layer only apply to the layers below it
+		layerWhiteouts := map[string]bool{}
+		layerOpaques := map[string]bool{}
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				tr.Close()
+				return nil, nil, err
+			}
+			name := cleanName(hdr.Name)
+			if name == "" {
+				continue
+			}
+			parent, base := path.Split(name)
+			if base == opaqueWhiteout {
+				layerOpaques[cleanName(parent)] = true
+				continue
+			} else if strings.HasPrefix(base, whiteoutPrefix) {
+				layerWhiteouts[path.Join(cleanName(parent), base[len(whiteoutPrefix):])] = true
+				continue
+			}
+			if hidden(name, seen, whiteouts, opaques) {
+				continue
+			}
+			survivors[layerEntry{i, name}] = true
+			seen[name] = hdr.Typeflag == tar.TypeDir
+			if hdr.Typeflag == tar.TypeLink {
+				target := layerEntry{i, cleanName(hdr.Linkname)}
+				if !survivors[target] {
+					needed[target] = true
+				}
+			}
+		}
+		err = tr.verify(layers[i].DiffID)
+		tr.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading layer %q: %w", filepath.Base(layers[i].File), err)
+		}
+		for name := range layerWhiteouts {
+			whiteouts[name] = true
+		}
+		for name := range layerOpaques {
+			opaques[name] = true
+		}
+	}
+	return survivors, needed, nil
+}
+
+// hidden returns true if the passed name is hidden by a higher layer: because the
+// higher layer has the same name, or a whiteout for the name or one of its parents,
+// or an opaque whiteout in one of its parents, or has a non-directory in place of
+// one of its parents.
+func hidden(name string, seen, whiteouts, opaques map[string]bool) bool {
+	if _, found := seen[name]; found || whiteouts[name] {
+		return true
+	}
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		isDir, found := seen[dir]
+		if whiteouts[dir] || opaques[dir] || (found && !isDir) {
+			return true
+		}
+	}
+	return opaques[""]
+}
+
+// copyLayer copies the surviving entries from the passed layer to the passed tar writer.
+// Hard links whose target did not survive are written as regular files with the content
+// of the target, and any further links to the same target link to that file.
+func copyLayer(layer int, layerFile string, tw *tar.Writer, survivors, needed map[layerEntry]bool) error {
+	tr, err := openLayer(layerFile)
+	if err != nil {
+		return err
+	}
+	defer tr.Close()
+	// content of needed entries, and where the content was first written
+	neededFiles := map[string]string{}
+	relinked := map[string]string{}
+	defer func() {
+		for _, tmp := range neededFiles {
+			os.Remove(tmp)
+		}
+	}()
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name := cleanName(hdr.Name)
+		entry := layerEntry{layer, name}
+		if needed[entry] {
+			tmp, err := saveContent(tr.Reader)
+			if err != nil {
+				return err
+			}
+			neededFiles[name] = tmp
+		}
+		if !survivors[entry] {
+			continue
+		}
+		hdr.Name = name
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Name += "/"
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			target := cleanName(hdr.Linkname)
+			hdr.Linkname = target
+			if !survivors[layerEntry{layer, target}] {
+				if linkTo, found := relinked[target]; found {
+					hdr.Linkname = linkTo
+				} else if tmp, found := neededFiles[target]; found {
+					if err := writeFrom(tw, hdr, tmp); err != nil {
+						return err
+					}
+					relinked[target] = name
+					continue
+				}
+			}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := io.Copy(tw, tr); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// saveContent saves the content of the current entry in the passed tar reader to a
+// temp file and returns the path of the temp file.
+func saveContent(tr *tar.Reader) (string, error) {
+	f, err := os.CreateTemp("", "imgpull.")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, tr); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// writeFrom writes the passed hard link header to the passed tar writer as a regular
+// file with the content of the passed file.
+func writeFrom(tw *tar.Writer, hdr *tar.Header, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr.Typeflag = tar.TypeReg
+	hdr.Linkname = ""
+	hdr.Size = fi.Size()
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
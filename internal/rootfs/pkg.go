@@ -0,0 +1,6 @@
+// Package rootfs applies image layers in order to produce a flattened root
+// filesystem - either as a directory or as a single tarball. OCI whiteouts are
+// honored: a '.wh.<name>' entry in a layer deletes '<name>' from the layers below
+// it, and a '.wh..wh..opq' entry in a directory hides everything in that directory
+// from the layers below it.
+package rootfs
@@ -0,0 +1,371 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// whiteoutPrefix prefixes a file name to indicate the file was deleted
+	whiteoutPrefix = ".wh."
+	// opaqueWhiteout indicates that all lower-layer content in its directory is hidden
+	opaqueWhiteout = ".wh..wh..opq"
+	// maxLinkDepth limits how many symlinks are followed resolving a path
+	maxLinkDepth = 255
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Layer is a layer blob file to apply. If DiffID is not the empty string then
+// the digest of the uncompressed layer must match it.
+type Layer struct {
+	File   string
+	DiffID string
+}
+
+// ApplyLayers extracts the passed layers into the 'dir' directory in order, from the
+// base layer to the top layer, honoring whiteouts. Layers can be uncompressed, gzip, or
+// zstd-compressed tar files. Directories, regular files, symlinks and hard links are
+// extracted. Device files and fifos are skipped since they generally cannot be created
+// without elevated privileges. Ownership is only applied if running as root.
+func ApplyLayers(layers []Layer, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, layer := range layers {
+		if err := applyLayer(layer, dir); err != nil {
+			return fmt.Errorf("error applying layer %q: %w", filepath.Base(layer.File), err)
+		}
+	}
+	return nil
+}
+
+// applyLayer extracts one layer into 'dir'.
+func applyLayer(layer Layer, dir string) error {
+	tr, err := openLayer(layer.File)
+	if err != nil {
+		return err
+	}
+	defer tr.Close()
+	// every path written by this layer, and their parents, so that an opaque
+	// whiteout only removes content from lower layers
+	layerPaths := map[string]bool{}
+	type dirTime struct {
+		path  string
+		mtime time.Time
+	}
+	dirTimes := []dirTime{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		name := cleanName(hdr.Name)
+		if name == "" {
+			continue
+		}
+		parent, base := path.Split(name)
+		if base == opaqueWhiteout {
+			if err := removeLower(dir, parent, layerPaths); err != nil {
+				return err
+			}
+			continue
+		} else if strings.HasPrefix(base, whiteoutPrefix) {
+			target, err := resolveInRoot(dir, path.Join(parent, base[len(whiteoutPrefix):]))
+			if err != nil {
+				return err
+			}
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+			continue
+		}
+		for p := name; p != "." && p != "/"; p = path.Dir(p) {
+			layerPaths[p] = true
+		}
+		target, err := resolveInRoot(dir, name)
+		if err != nil {
+			return err
+		}
+		if err := extractEntry(tr.Reader, hdr, dir, target); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirTimes = append(dirTimes, dirTime{target, hdr.ModTime})
+		}
+	}
+	// directory mtimes are set last since extracting children changes them
+	for _, dt := range dirTimes {
+		os.Chtimes(dt.path, dt.mtime, dt.mtime)
+	}
+	return tr.verify(layer.DiffID)
+}
+
+// extractEntry extracts the current entry in the passed tar reader to 'target'
+// which the caller has resolved within 'root'.
+func extractEntry(tr *tar.Reader, hdr *tar.Header, root, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	// anything other than a directory replacing a directory replaces it
+	// entirely, and anything replacing a non-directory replaces it
+	if fi, err := os.Lstat(target); err == nil {
+		if !fi.IsDir() || hdr.Typeflag != tar.TypeDir {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+	}
+	mode := os.FileMode(hdr.Mode).Perm()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		if err := os.Chmod(target, mode); err != nil {
+			return err
+		}
+	case tar.TypeReg:
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(target, mode); err != nil {
+			return err
+		}
+		os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		source, err := resolveInRoot(root, cleanName(hdr.Linkname))
+		if err != nil {
+			return err
+		}
+		if err := os.Link(source, target); err != nil {
+			return err
+		}
+	default:
+		// devices, fifos, etc.
+		return nil
+	}
+	if os.Geteuid() == 0 {
+		os.Lchown(target, hdr.Uid, hdr.Gid)
+	}
+	return nil
+}
+
+// removeLower removes everything in the 'dir' directory under 'root' that was not
+// written by the current layer, as recorded in 'layerPaths'.
+func removeLower(root, dir string, layerPaths map[string]bool) error {
+	target, err := resolveInRoot(root, path.Join(dir, "x"))
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(filepath.Dir(target))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !layerPaths[path.Join(cleanName(dir), entry.Name())] {
+			if err := os.RemoveAll(filepath.Join(filepath.Dir(target), entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resolveInRoot returns the file system path for the passed slash-separated 'name'
+// relative to 'root'. Any symlinks in the parent directories of 'name' are followed
+// as though 'root' were the root of the file system, so the returned path can never
+// be outside of 'root'. The last path element is not resolved.
+func resolveInRoot(root, name string) (string, error) {
+	parent, base := path.Split(path.Clean("/" + name))
+	resolved, err := resolveDir(root, parent, 0)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, filepath.FromSlash(resolved), base), nil
+}
+
+// resolveDir resolves all the symlinks in the passed rooted slash-separated directory
+// 'dir' within 'root', returning a rooted slash-separated path.
+func resolveDir(root, dir string, depth int) (string, error) {
+	if depth > maxLinkDepth {
+		return "", fmt.Errorf("too many levels of symbolic links resolving %q", dir)
+	}
+	parts := strings.Split(strings.Trim(path.Clean(dir), "/"), "/")
+	cur := "/"
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		next := path.Join(cur, part)
+		fi, err := os.Lstat(filepath.Join(root, filepath.FromSlash(next)))
+		if err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			link, err := os.Readlink(filepath.Join(root, filepath.FromSlash(next)))
+			if err != nil {
+				return "", err
+			}
+			if !path.IsAbs(link) {
+				link = path.Join(cur, link)
+			}
+			return resolveDir(root, path.Join("/", link, strings.Join(parts[i+1:], "/")), depth+1)
+		}
+		cur = next
+	}
+	return cur, nil
+}
+
+// cleanName normalizes a path from a tarball to a relative slash-separated path
+// with no leading "./" or "/". The root directory is returned as the empty string.
+func cleanName(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	return name
+}
+
+// layerReader reads the tar stream of a possibly compressed layer blob, computing the
+// digest of the uncompressed stream (the layer diff_id) as it is read.
+type layerReader struct {
+	*tar.Reader
+	// r is the uncompressed stream which is also fed to the digester
+	r        io.Reader
+	digester digest.Digester
+	closers  []io.Closer
+}
+
+// Close closes the decompressor and the layer blob file.
+func (lr *layerReader) Close() error {
+	var errs []error
+	for _, c := range lr.closers {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// verify reads whatever remains in the uncompressed stream and then compares the digest
+// of the stream to the passed diff_id. If the passed diff_id is the empty string then
+// nothing is verified.
+func (lr *layerReader) verify(diffID string) error {
+	if diffID == "" {
+		return nil
+	}
+	if _, err := io.Copy(io.Discard, lr.r); err != nil {
+		return err
+	}
+	if actual := lr.digester.Digest().String(); actual != diffID {
+		return fmt.Errorf("layer diff_id mismatch: expected %q, got %q", diffID, actual)
+	}
+	return nil
+}
+
+// openLayer opens the passed layer blob file and returns a reader for its tar stream
+// that the caller must close. The compression (gzip, zstd, or none) is determined by
+// inspecting the leading bytes of the file rather than relying on the media type.
+func openLayer(layerFile string) (*layerReader, error) {
+	f, err := os.Open(layerFile)
+	if err != nil {
+		return nil, err
+	}
+	r, closer, err := decompress(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	digester := digest.Canonical.Digester()
+	r = io.TeeReader(r, digester.Hash())
+	return &layerReader{
+		Reader:   tar.NewReader(r),
+		r:        r,
+		digester: digester,
+		closers:  []io.Closer{closer, f},
+	}, nil
+}
+
+// DiffID returns the digest of the uncompressed content of the passed layer blob
+// file, e.g. "sha256:abc...". This is the value that an image config lists in its
+// 'rootfs.diff_ids'.
+func DiffID(layerFile string) (string, error) {
+	f, err := os.Open(layerFile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	r, closer, err := decompress(f)
+	if err != nil {
+		return "", err
+	}
+	defer closer.Close()
+	d, err := digest.Canonical.FromReader(r)
+	return d.String(), err
+}
+
+// UncompressedSize returns the size in bytes of the uncompressed content of the passed
+// layer blob file.
+func UncompressedSize(layerFile string) (int64, error) {
+	f, err := os.Open(layerFile)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r, closer, err := decompress(f)
+	if err != nil {
+		return 0, err
+	}
+	defer closer.Close()
+	return io.Copy(io.Discard, r)
+}
+
+// decompress returns a reader that decompresses the passed reader if it is gzip or
+// zstd compressed, and a closer for the decompressor.
+func decompress(r io.Reader) (io.Reader, io.Closer, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gr, gr, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, closerFunc(func() error { zr.Close(); return nil }), nil
+	}
+	return br, closerFunc(func() error { return nil }), nil
+}
+
+// closerFunc adapts a function to the io.Closer interface.
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
@@ -0,0 +1,248 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+)
+
+// entry is a tar entry to write into a test layer. If link is non-empty then the
+// entry is a symlink, or a hard link if hard is true.
+type entry struct {
+	name    string
+	content string
+	dir     bool
+	link    string
+	hard    bool
+}
+
+// makeLayer creates a tar layer in 'dir' named 'name' with the passed entries. The layer
+// is gzipped if the name ends with ".gz", and zstd compressed if the name ends with ".zst".
+// The returned Layer has the diff_id of the uncompressed layer.
+func makeLayer(t *testing.T, dir, name string, entries []entry) Layer {
+	buf := bytes.Buffer{}
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(e.content))}
+		if e.dir {
+			hdr = &tar.Header{Name: e.name, Mode: 0755, Typeflag: tar.TypeDir}
+		} else if e.link != "" && e.hard {
+			hdr = &tar.Header{Name: e.name, Typeflag: tar.TypeLink, Linkname: e.link}
+		} else if e.link != "" {
+			hdr = &tar.Header{Name: e.name, Mode: 0777, Typeflag: tar.TypeSymlink, Linkname: e.link}
+		}
+		if tw.WriteHeader(hdr) != nil {
+			t.FailNow()
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			tw.Write([]byte(e.content))
+		}
+	}
+	tw.Close()
+	layer := Layer{
+		File:   filepath.Join(dir, name),
+		DiffID: digest.FromBytes(buf.Bytes()).String(),
+	}
+	f, err := os.Create(layer.File)
+	if err != nil {
+		t.FailNow()
+	}
+	defer f.Close()
+	var w io.WriteCloser = f
+	if strings.HasSuffix(name, ".gz") {
+		w = gzip.NewWriter(f)
+	} else if strings.HasSuffix(name, ".zst") {
+		if w, err = zstd.NewWriter(f); err != nil {
+			t.FailNow()
+		}
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		t.FailNow()
+	}
+	if w.Close() != nil {
+		t.FailNow()
+	}
+	return layer
+}
+
+// testLayers creates three layers exercising whiteouts, opaque whiteouts, replacing a
+// directory with a file, and hard links. Each layer is compressed differently.
+func testLayers(t *testing.T, dir string) []Layer {
+	return []Layer{
+		makeLayer(t, dir, "layer1.gz", []entry{
+			{name: "etc/", dir: true},
+			{name: "etc/hosts", content: "hosts1"},
+			{name: "etc/passwd", content: "passwd1"},
+			{name: "opt/", dir: true},
+			{name: "opt/a", content: "a1"},
+			{name: "opt/b", content: "b1"},
+			{name: "var/", dir: true},
+			{name: "var/lib/", dir: true},
+			{name: "var/lib/x", content: "x1"},
+			{name: "bin/", dir: true},
+			{name: "bin/sh", content: "sh1"},
+			{name: "bin/ash", link: "bin/sh", hard: true},
+		}),
+		makeLayer(t, dir, "layer2.zst", []entry{
+			{name: "etc/.wh.passwd"},
+			{name: "etc/hosts", content: "hosts2"},
+			{name: "opt/", dir: true},
+			{name: "opt/.wh..wh..opq"},
+			{name: "opt/c", content: "c2"},
+			{name: "var", content: "var2"},
+			{name: "lib", link: "/usr/lib"},
+		}),
+		makeLayer(t, dir, "layer3.tar", []entry{
+			{name: "lib/libc.so", content: "libc3"},
+			{name: "bin/.wh.sh"},
+		}),
+	}
+}
+
+// expectedFiles is the flattened content of the test layers, with links shown
+// by their link name.
+var expectedFiles = map[string]string{
+	"bin/":            "",
+	"bin/ash":         "sh1",
+	"etc/":            "",
+	"etc/hosts":       "hosts2",
+	"lib":             "-> /usr/lib",
+	"opt/":            "",
+	"opt/c":           "c2",
+	"usr/":            "",
+	"usr/lib/":        "",
+	"usr/lib/libc.so": "libc3",
+	"var":             "var2",
+}
+
+func TestApplyLayers(t *testing.T) {
+	d, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(d)
+	rootDir := filepath.Join(d, "rootfs")
+	if err := ApplyLayers(testLayers(t, d), rootDir); err != nil {
+		t.FailNow()
+	}
+	actual := map[string]string{}
+	filepath.Walk(rootDir, func(p string, fi os.FileInfo, err error) error {
+		rel, _ := filepath.Rel(rootDir, p)
+		if rel == "." {
+			return nil
+		}
+		if fi.IsDir() {
+			actual[rel+"/"] = ""
+		} else if fi.Mode()&os.ModeSymlink != 0 {
+			link, _ := os.Readlink(p)
+			actual[rel] = "-> " + link
+		} else {
+			b, _ := os.ReadFile(p)
+			actual[rel] = string(b)
+		}
+		return nil
+	})
+	if !maps.Equal(expectedFiles, actual) {
+		t.Errorf("expected %v, got %v", expectedFiles, actual)
+	}
+}
+
+func TestFlattenToTar(t *testing.T) {
+	d, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(d)
+	tarfile := filepath.Join(d, "flat.tar")
+	if err := FlattenToTar(testLayers(t, d), tarfile); err != nil {
+		t.FailNow()
+	}
+	f, err := os.Open(tarfile)
+	if err != nil {
+		t.FailNow()
+	}
+	defer f.Close()
+	actual := map[string]string{}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.FailNow()
+		}
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			actual[hdr.Name] = "-> " + hdr.Linkname
+		default:
+			b, _ := io.ReadAll(tr)
+			actual[hdr.Name] = string(b)
+		}
+	}
+	// the tarball only has what was in the layers, and symlinks are not followed
+	expected := map[string]string{}
+	for name, content := range expectedFiles {
+		expected[name] = content
+	}
+	delete(expected, "usr/")
+	delete(expected, "usr/lib/")
+	delete(expected, "usr/lib/libc.so")
+	expected["lib/libc.so"] = "libc3"
+	if !maps.Equal(expected, actual) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
+
+func TestDiffIDMismatch(t *testing.T) {
+	d, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(d)
+	layers := testLayers(t, d)
+	if actual, err := DiffID(layers[1].File); err != nil || actual != layers[1].DiffID {
+		t.Fail()
+	}
+	layers[1].DiffID = digest.FromString("frobozz").String()
+	if ApplyLayers(layers, filepath.Join(d, "rootfs")) == nil {
+		t.Fail()
+	}
+	if FlattenToTar(layers, filepath.Join(d, "flat.tar")) == nil {
+		t.Fail()
+	}
+}
+
+func TestResolveInRoot(t *testing.T) {
+	d, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(d)
+	os.MkdirAll(filepath.Join(d, "usr", "lib"), 0755)
+	os.Symlink("/usr/lib", filepath.Join(d, "lib"))
+	os.Symlink("../../../../..", filepath.Join(d, "up"))
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"lib/libc.so", filepath.Join(d, "usr", "lib", "libc.so")},
+		{"up/etc/passwd", filepath.Join(d, "etc", "passwd")},
+		{"../../etc/passwd", filepath.Join(d, "etc", "passwd")},
+		{"lib", filepath.Join(d, "lib")},
+	}
+	for _, test := range tests {
+		actual, err := resolveInRoot(d, test.name)
+		if err != nil || actual != test.expected {
+			t.Errorf("resolving %q expected %q, got %q", test.name, test.expected, actual)
+		}
+	}
+}
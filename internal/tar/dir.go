@@ -0,0 +1,121 @@
+package tar
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TarDir writes all the directories and regular files under the passed 'dir' into
+// the tarball 'tarfile'. The paths in the tarball are relative to 'dir'. If the tarball
+// can't be written then the partial tarball is removed.
+func TarDir(dir, tarfile string) (err error) {
+	file, err := os.Create(tarfile)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		file.Close()
+		if err != nil {
+			os.Remove(tarfile)
+		}
+	}()
+	tw := tar.NewWriter(file)
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// UntarDir extracts the directories and regular files in the passed 'tarfile' into
+// 'dir'. An error is returned if any path in the tarball would be extracted outside
+// of 'dir'. Other kinds of tar entries (e.g. links) are ignored.
+func UntarDir(tarfile, dir string) error {
+	file, err := os.Open(tarfile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	tr := tar.NewReader(file)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, filepath.FromSlash(header.Name))
+		if target != filepath.Clean(dir) && !strings.HasPrefix(target, filepath.Clean(dir)+string(os.PathSeparator)) {
+			return fmt.Errorf("invalid path %q in tarball %q", header.Name, tarfile)
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := extractFile(tr, target); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// extractFile copies the current entry from the passed tar reader to the
+// file 'target'.
+func extractFile(tr *tar.Reader, target string) error {
+	f, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, tr)
+	return err
+}
@@ -0,0 +1,177 @@
+package tar
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aceeric/imgpull/internal/util"
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+	"github.com/aceeric/imgpull/pkg/imgpull/v1oci"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// blobsDir is the directory in an OCI image layout that has the blobs.
+	blobsDir = "blobs/sha256/"
+	// ociLayout is the content of the 'oci-layout' file in an OCI image layout.
+	ociLayout = `{"imageLayoutVersion":"1.0.0"}`
+	// the annotations that newer versions of 'docker save' put on the image manifest
+	// descriptor in 'index.json'
+	annotationImageName = "io.containerd.image.name"
+	annotationRefName   = "org.opencontainers.image.ref.name"
+	// dockerConfigMt is the media type of the config in a generated manifest.
+	dockerConfigMt = "application/vnd.docker.container.image.v1+json"
+)
+
+// toOCILayout writes the image tarball in the receiver to the passed writer with the
+// structure written by newer versions of 'docker save': the config, layers, and image
+// manifest in 'blobs/sha256', an 'index.json' referencing the image manifest, an
+// 'oci-layout' file, and a 'manifest.json' file for older engines.
+func (tb ImageTarball) toOCILayout(w io.Writer) (DockerTarManifest, error) {
+	manifest, manifestMt := tb.Manifest, tb.ManifestMediaType
+	if len(manifest) == 0 {
+		var err error
+		if manifest, err = tb.dockerManifest(); err != nil {
+			return DockerTarManifest{}, err
+		}
+		manifestMt = types.V2dockerManifestMt
+	}
+	manifestDigest := digest.FromBytes(manifest)
+	dtm := DockerTarManifest{
+		Config:      blobsDir + tb.ConfigDigest,
+		RepoTags:    tb.RepoTags,
+		Annotations: tb.Annotations,
+	}
+	tw := tar.NewWriter(w)
+	for _, dir := range []string{"blobs/", blobsDir} {
+		if err := addDir(tw, dir, tb.Reproducible); err != nil {
+			return DockerTarManifest{}, err
+		}
+	}
+	written := map[string]bool{}
+	for _, layer := range tb.Layers {
+		fname := util.DigestFrom(layer.Digest)
+		dtm.Layers = append(dtm.Layers, blobsDir+fname)
+		// an image can have the same layer more than once but a blob is written once
+		if written[fname] {
+			continue
+		}
+		written[fname] = true
+		if err := addFileAs(tw, filepath.Join(tb.SourceDir, fname), blobsDir+fname, tb.Reproducible); err != nil {
+			return DockerTarManifest{}, err
+		}
+	}
+	if !written[tb.ConfigDigest] {
+		if err := addFileAs(tw, filepath.Join(tb.SourceDir, tb.ConfigDigest), dtm.Config, tb.Reproducible); err != nil {
+			return DockerTarManifest{}, err
+		}
+	}
+	if err := addString(tw, string(manifest), blobsDir+manifestDigest.Encoded(), tb.Reproducible); err != nil {
+		return DockerTarManifest{}, err
+	}
+	// like 'docker save', there is a descriptor for each tag, or one without tag annotations
+	// if the image is untagged
+	index := v1oci.Index{
+		SchemaVersion: 2,
+		MediaType:     string(types.V1ociIndexMt),
+		Manifests:     []v1oci.Descriptor{},
+	}
+	desc := v1oci.Descriptor{
+		MediaType: string(manifestMt),
+		Digest:    manifestDigest.String(),
+		Size:      int64(len(manifest)),
+	}
+	for _, repoTag := range tb.RepoTags {
+		desc.Annotations = repoTagAnnotations(repoTag)
+		maps.Copy(desc.Annotations, tb.Annotations)
+		index.Manifests = append(index.Manifests, desc)
+	}
+	if len(tb.RepoTags) == 0 {
+		desc.Annotations = tb.Annotations
+		index.Manifests = append(index.Manifests, desc)
+	}
+	indexBytes, err := json.Marshal(index)
+	if err != nil {
+		return DockerTarManifest{}, err
+	}
+	if err := addString(tw, string(indexBytes), "index.json", tb.Reproducible); err != nil {
+		return DockerTarManifest{}, err
+	}
+	dtmBytes, err := dtm.toString()
+	if err != nil {
+		return DockerTarManifest{}, err
+	}
+	if err := addString(tw, string(dtmBytes), "manifest.json", tb.Reproducible); err != nil {
+		return DockerTarManifest{}, err
+	}
+	if err := addString(tw, ociLayout, "oci-layout", tb.Reproducible); err != nil {
+		return DockerTarManifest{}, err
+	}
+	return dtm, tw.Close()
+}
+
+// repoTagAnnotations returns the annotations for an image manifest descriptor in
+// 'index.json' for the passed repo tag: the image name and, if the repo tag has a
+// tag, the tag.
+func repoTagAnnotations(repoTag string) map[string]string {
+	annotations := map[string]string{annotationImageName: repoTag}
+	if i := strings.LastIndex(repoTag, ":"); i > strings.LastIndex(repoTag, "/") {
+		annotations[annotationRefName] = repoTag[i+1:]
+	}
+	return annotations
+}
+
+// dockerManifest generates a docker v2 image manifest for the config and layers in the
+// receiver. This is needed for schema 1 images, which have no v2 manifest. The sizes of
+// the blobs are from the files in the source directory.
+func (tb ImageTarball) dockerManifest() ([]byte, error) {
+	descriptor := func(mediaType string, dgst string) (v1oci.Descriptor, error) {
+		fname := util.DigestFrom(dgst)
+		info, err := os.Stat(filepath.Join(tb.SourceDir, fname))
+		if err != nil {
+			return v1oci.Descriptor{}, err
+		}
+		return v1oci.Descriptor{MediaType: mediaType, Digest: "sha256:" + fname, Size: info.Size()}, nil
+	}
+	config, err := descriptor(dockerConfigMt, tb.ConfigDigest)
+	if err != nil {
+		return nil, err
+	}
+	m := v1oci.Manifest{
+		SchemaVersion: 2,
+		MediaType:     string(types.V2dockerManifestMt),
+		Config:        config,
+		Layers:        []v1oci.Descriptor{},
+	}
+	for _, layer := range tb.Layers {
+		l, err := descriptor(string(layer.MediaType), layer.Digest)
+		if err != nil {
+			return nil, err
+		}
+		m.Layers = append(m.Layers, l)
+	}
+	return json.Marshal(m)
+}
+
+// addDir adds a directory entry to the tarball. If 'reproducible' is true then the
+// header doesn't depend on the current time.
+func addDir(tw *tar.Writer, name string, reproducible bool) error {
+	modTime := time.Now()
+	if reproducible {
+		modTime = epoch
+	}
+	return tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name,
+		Mode:     0755,
+		ModTime:  modTime,
+		Format:   tar.FormatPAX,
+	})
+}
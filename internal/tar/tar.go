@@ -22,44 +22,86 @@ type DockerTarManifest struct {
 	Config   string   `json:"config"`
 	RepoTags []string `json:"repoTags"`
 	Layers   []string `json:"layers"`
+	// Annotations is not in the manifest written by 'docker save' and is ignored by
+	// 'docker load'.
+	Annotations map[string]string `json:"annotations,omitempty"`
 }
 
 // ImageTarball is used to build an image tarball.
 type ImageTarball struct {
 	// SourceDir has the config digest blob and the layer blobs
 	SourceDir string
-	// ImageUrl is the image url, like docker.io/hello-world:latest
-	ImageUrl string
+	// RepoTags are the tags of the image in 'manifest.json', like docker.io/hello-world:latest.
+	// If empty then the image is untagged when the tarball is loaded.
+	RepoTags []string
 	// ConfigDigest is the digest of the image config layer
 	ConfigDigest string
 	// Layers is an array of blob Layers
 	Layers []types.Layer
+	// Reproducible causes the tarball to be byte-identical for the same image: every
+	// entry has the epoch as its timestamp and numeric 0:0 ownership with no user or
+	// group names, rather than the current time and user.
+	Reproducible bool
+	// OCILayout causes the tarball to have the OCI image layout structure written by
+	// newer versions of 'docker save', with the blobs in 'blobs/sha256'. The image
+	// manifest is written as a blob so that its digest is preserved when the tarball
+	// is loaded.
+	OCILayout bool
+	// Manifest is the image manifest, which is written into the tarball if 'OCILayout'
+	// is true. If it is empty then a docker v2 manifest is generated from the config
+	// and the layers.
+	Manifest []byte
+	// ManifestMediaType is the media type of 'Manifest'.
+	ManifestMediaType types.MediaType
+	// Annotations are added to the image in 'manifest.json' and, if 'OCILayout' is true,
+	// to the image manifest descriptor in 'index.json'.
+	Annotations map[string]string
 }
 
+// epoch is the timestamp of the entries in a reproducible tarball.
+var epoch = time.Unix(0, 0).UTC()
+
 // ToTar creates an image tarball as configured in the receiver and writes it
 // to the path/file specified in the 'tarfile' arg. The function returns a
 // 'DockerTarManifest' struct that looks exactly like the 'manifest.json' file
-// in the tarball.
-func (tb ImageTarball) ToTar(tarfile string) (DockerTarManifest, error) {
-	dtm := DockerTarManifest{
-		Config:   "sha256:" + tb.ConfigDigest,
-		RepoTags: []string{tb.ImageUrl},
-	}
+// in the tarball. If the tarball can't be written then the partial tarball is
+// removed.
+func (tb ImageTarball) ToTar(tarfile string) (dtm DockerTarManifest, err error) {
 	file, err := os.Create(tarfile)
 	if err != nil {
 		return DockerTarManifest{}, err
 	}
-	defer file.Close()
-	tw := tar.NewWriter(file)
-	defer tw.Close()
+	defer func() {
+		file.Close()
+		if err != nil {
+			os.Remove(tarfile)
+		}
+	}()
+	if dtm, err = tb.ToWriter(file); err != nil {
+		return DockerTarManifest{}, err
+	}
+	return dtm, file.Close()
+}
 
+// ToWriter is like 'ToTar' except the image tarball is written to the passed writer,
+// which supports streaming the tarball without an intermediate file.
+func (tb ImageTarball) ToWriter(w io.Writer) (DockerTarManifest, error) {
+	if tb.OCILayout {
+		return tb.toOCILayout(w)
+	}
+	dtm := DockerTarManifest{
+		Config:      "sha256:" + tb.ConfigDigest,
+		RepoTags:    tb.RepoTags,
+		Annotations: tb.Annotations,
+	}
+	tw := tar.NewWriter(w)
 	for _, layer := range tb.Layers {
 		if ext, err := extensionForLayer(layer.MediaType); err != nil {
 			return DockerTarManifest{}, err
 		} else {
 			fname := util.DigestFrom(layer.Digest)
 			dtm.Layers = append(dtm.Layers, fname+ext)
-			err = addFile(tw, filepath.Join(tb.SourceDir, fname), fname+ext)
+			err = addFile(tw, filepath.Join(tb.SourceDir, fname), fname+ext, tb.Reproducible)
 			if err != nil {
 				return DockerTarManifest{}, err
 			}
@@ -69,15 +111,15 @@ func (tb ImageTarball) ToTar(tarfile string) (DockerTarManifest, error) {
 	if err != nil {
 		return DockerTarManifest{}, err
 	}
-	err = addString(tw, string(manifest), "manifest.json")
+	err = addString(tw, string(manifest), "manifest.json", tb.Reproducible)
 	if err != nil {
 		return DockerTarManifest{}, err
 	}
-	err = addFile(tw, filepath.Join(tb.SourceDir, tb.ConfigDigest), dtm.Config)
+	err = addFile(tw, filepath.Join(tb.SourceDir, tb.ConfigDigest), dtm.Config, tb.Reproducible)
 	if err != nil {
 		return DockerTarManifest{}, err
 	}
-	return dtm, nil
+	return dtm, tw.Close()
 }
 
 // toString renders the docker tar manifest in the receiver as a JSON-formatted
@@ -93,8 +135,15 @@ func (dtm *DockerTarManifest) toString() ([]byte, error) {
 
 // addFile adds a file identified by the passed 'actualFile' to the
 // passed tar file. The 'fileNameInTar' arg allows to give the file in the
-// tarball a filename different from the file name on the file system.
-func addFile(tw *tar.Writer, actualFile, fileNameInTar string) error {
+// tarball a filename different from the file name on the file system. If
+// 'reproducible' is true then the header doesn't depend on the file system.
+func addFile(tw *tar.Writer, actualFile, fileNameInTar string, reproducible bool) error {
+	return addFileAs(tw, actualFile, filepath.Base(fileNameInTar), reproducible)
+}
+
+// addFileAs is like 'addFile' except the file is added with the passed path in the
+// tarball rather than at the root of the tarball.
+func addFileAs(tw *tar.Writer, actualFile, pathInTar string, reproducible bool) error {
 	file, err := os.Open(actualFile)
 	if err != nil {
 		return err
@@ -104,11 +153,16 @@ func addFile(tw *tar.Writer, actualFile, fileNameInTar string) error {
 	if err != nil {
 		return err
 	}
-	header, err := tar.FileInfoHeader(info, info.Name())
-	if err != nil {
-		return err
+	var header *tar.Header
+	if reproducible {
+		header = reproducibleHeader(pathInTar, info.Size())
+	} else {
+		header, err = tar.FileInfoHeader(info, info.Name())
+		if err != nil {
+			return err
+		}
+		header.Name = pathInTar
 	}
-	header.Name = filepath.Base(fileNameInTar)
 	err = tw.WriteHeader(header)
 	if err != nil {
 		return err
@@ -120,48 +174,55 @@ func addFile(tw *tar.Writer, actualFile, fileNameInTar string) error {
 // addString adds the passed string to the tarfile as though it were
 // a file. When you untar the file the extracted string behaves like
 // any other file in the tar file. The intended use case is to write
-// a manifest represented in a string as though it was a file.
-func addString(tw *tar.Writer, content, name string) error {
-	u, err := user.Current()
-	if err != nil {
-		return err
-	}
-	uid, err := strconv.Atoi(u.Uid)
-	if err != nil {
-		return err
-	}
-	gid, err := strconv.Atoi(u.Uid)
-	if err != nil {
-		return err
-	}
-	gname := ""
-	g, err := user.LookupGroupId(u.Gid)
-	if err != nil {
-		return err
+// a manifest represented in a string as though it was a file. If
+// 'reproducible' is true then the header doesn't depend on the current
+// time or user.
+func addString(tw *tar.Writer, content, name string, reproducible bool) error {
+	var header *tar.Header
+	if reproducible {
+		header = reproducibleHeader(name, int64(len(content)))
 	} else {
-		gname = g.Name
-	}
-	now := time.Now()
-	header := tar.Header{
-		Typeflag:   tar.TypeReg,
-		Name:       name,
-		Linkname:   "",
-		Size:       int64(len(content)),
-		Mode:       436,
-		Uid:        uid,
-		Gid:        gid,
-		Uname:      u.Username,
-		Gname:      gname,
-		ModTime:    now,
-		AccessTime: now,
-		ChangeTime: now,
-		Devmajor:   0,
-		Devminor:   0,
-		Xattrs:     nil,
-		PAXRecords: nil,
-		Format:     tar.FormatUnknown,
-	}
-	err = tw.WriteHeader(&header)
+		u, err := user.Current()
+		if err != nil {
+			return err
+		}
+		uid, err := strconv.Atoi(u.Uid)
+		if err != nil {
+			return err
+		}
+		gid, err := strconv.Atoi(u.Gid)
+		if err != nil {
+			return err
+		}
+		gname := ""
+		g, err := user.LookupGroupId(u.Gid)
+		if err != nil {
+			return err
+		} else {
+			gname = g.Name
+		}
+		now := time.Now()
+		header = &tar.Header{
+			Typeflag:   tar.TypeReg,
+			Name:       name,
+			Linkname:   "",
+			Size:       int64(len(content)),
+			Mode:       436,
+			Uid:        uid,
+			Gid:        gid,
+			Uname:      u.Username,
+			Gname:      gname,
+			ModTime:    now,
+			AccessTime: now,
+			ChangeTime: now,
+			Devmajor:   0,
+			Devminor:   0,
+			Xattrs:     nil,
+			PAXRecords: nil,
+			Format:     tar.FormatUnknown,
+		}
+	}
+	err := tw.WriteHeader(header)
 	if err != nil {
 		return err
 	}
@@ -169,6 +230,19 @@ func addString(tw *tar.Writer, content, name string) error {
 	return err
 }
 
+// reproducibleHeader returns a header for a regular file with the passed name and size
+// that has only fixed values otherwise, so the same content always has the same header.
+func reproducibleHeader(name string, size int64) *tar.Header {
+	return &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  epoch,
+		Format:   tar.FormatPAX,
+	}
+}
+
 // extensionForLayer returns '.tar', '.tar.gz', or '.tar.zstd' based on the
 // passed media type.
 func extensionForLayer(mediaType types.MediaType) (string, error) {
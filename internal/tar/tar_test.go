@@ -3,13 +3,19 @@ package tar
 import (
 	"archive/tar"
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/aceeric/imgpull/internal/testhelpers"
 	"github.com/aceeric/imgpull/pkg/imgpull/types"
+	"github.com/aceeric/imgpull/pkg/imgpull/v1oci"
+
+	"github.com/opencontainers/go-digest"
 )
 
 // TestWriteFiles tests writing a physical file and a string "file"
@@ -36,10 +42,10 @@ func TestWriteFiles(t *testing.T) {
 	defer tarfile.Close()
 	tw := tar.NewWriter(tarfile)
 	defer tw.Close()
-	if err := addFile(tw, foobar.Name(), foobar.Name()); err != nil {
+	if err := addFile(tw, foobar.Name(), foobar.Name(), false); err != nil {
 		t.Fail()
 	}
-	if err := addString(tw, "flathead", "flathead"); err != nil {
+	if err := addString(tw, "flathead", "flathead", false); err != nil {
 		t.Fail()
 	}
 	tw.Close()
@@ -96,7 +102,7 @@ func TestTarNew(t *testing.T) {
 	dtm, err := ImageTarball{
 		SourceDir:    d,
 		ConfigDigest: configDigest,
-		ImageUrl:     url,
+		RepoTags:     []string{url},
 		Layers:       layers,
 	}.ToTar(tarfile)
 	if err != nil {
@@ -132,3 +138,176 @@ func TestTarNew(t *testing.T) {
 		t.Fail()
 	}
 }
+
+// TestTarDir tars a directory tree and then untars it to make sure the
+// files were put in correctly.
+func TestTarDir(t *testing.T) {
+	d, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fail()
+	}
+	defer os.RemoveAll(d)
+	src := filepath.Join(d, "src")
+	if err := os.MkdirAll(filepath.Join(src, "foo", "bar"), 0755); err != nil {
+		t.Fail()
+	}
+	files := map[string]string{
+		"frobozz":                            "flathead",
+		filepath.Join("foo", "bar", "fizz"):  "bin",
+		filepath.Join("foo", "zorkmid.json"): "{}",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(content), 0644); err != nil {
+			t.Fail()
+		}
+	}
+	tarfile := filepath.Join(d, "test.tar")
+	if err := TarDir(src, tarfile); err != nil {
+		t.FailNow()
+	}
+	dst := filepath.Join(d, "dst")
+	if err := UntarDir(tarfile, dst); err != nil {
+		t.FailNow()
+	}
+	for name, content := range files {
+		b, err := os.ReadFile(filepath.Join(dst, name))
+		if err != nil || string(b) != content {
+			t.Fail()
+		}
+	}
+}
+
+// TestTarReproducible creates a reproducible image tarball twice, with the blobs
+// modified in between, and checks that the tarballs are byte-identical and that the
+// entries have fixed timestamps and ownership.
+func TestTarReproducible(t *testing.T) {
+	d := t.TempDir()
+	configDigest := testhelpers.MakeDigest()
+	layerDigest := testhelpers.MakeDigest()
+	for _, f := range []string{configDigest, layerDigest} {
+		if os.WriteFile(filepath.Join(d, f), []byte(f), 0600) != nil {
+			t.FailNow()
+		}
+	}
+	itb := ImageTarball{
+		SourceDir:    d,
+		ConfigDigest: configDigest,
+		RepoTags:     []string{"flathead.io/frobozz/fizzbin:v1.2.3"},
+		Layers:       []types.Layer{{MediaType: types.V2dockerLayerGzipMt, Digest: layerDigest, Size: 64}},
+		Reproducible: true,
+	}
+	var first, second bytes.Buffer
+	if _, err := itb.ToWriter(&first); err != nil {
+		t.FailNow()
+	}
+	later := time.Now().Add(time.Hour)
+	for _, f := range []string{configDigest, layerDigest} {
+		os.Chtimes(filepath.Join(d, f), later, later)
+		os.Chmod(filepath.Join(d, f), 0640)
+	}
+	if _, err := itb.ToWriter(&second); err != nil {
+		t.FailNow()
+	}
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Error("expected identical tarballs")
+	}
+	tr := tar.NewReader(&first)
+	entries := 0
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		entries++
+		if !hdr.ModTime.Equal(time.Unix(0, 0)) || hdr.Uid != 0 || hdr.Gid != 0 || hdr.Uname != "" || hdr.Gname != "" || hdr.Mode != 0644 {
+			t.Errorf("unexpected header %+v", hdr)
+		}
+	}
+	if entries != 3 {
+		t.Errorf("expected 3 entries, got %d", entries)
+	}
+}
+
+// readTar returns the content of the regular files in the passed tarball by name.
+func readTar(t *testing.T, b []byte) map[string][]byte {
+	files := map[string][]byte{}
+	tr := tar.NewReader(bytes.NewReader(b))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		} else if err != nil {
+			t.FailNow()
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			files[hdr.Name], _ = io.ReadAll(tr)
+		}
+	}
+}
+
+// TestTarOCILayout creates image tarballs with the OCI image layout, with a provided
+// manifest and with a generated manifest, and checks the structure of the tarballs.
+func TestTarOCILayout(t *testing.T) {
+	d := t.TempDir()
+	configDigest := testhelpers.MakeDigest()
+	layerDigest := testhelpers.MakeDigest()
+	for _, f := range []string{configDigest, layerDigest} {
+		if os.WriteFile(filepath.Join(d, f), []byte(f), 0644) != nil {
+			t.FailNow()
+		}
+	}
+	manifest := []byte(`{"schemaVersion":2}`)
+	for _, provided := range []bool{true, false} {
+		itb := ImageTarball{
+			SourceDir:    d,
+			ConfigDigest: configDigest,
+			RepoTags:     []string{"flathead.io/frobozz/fizzbin:v1.2.3"},
+			// the same layer twice is written once
+			Layers: []types.Layer{
+				{MediaType: types.V2dockerLayerGzipMt, Digest: "sha256:" + layerDigest, Size: 64},
+				{MediaType: types.V2dockerLayerGzipMt, Digest: "sha256:" + layerDigest, Size: 64},
+			},
+			OCILayout:   true,
+			Annotations: map[string]string{"frobozz": "fizzbin"},
+		}
+		if provided {
+			itb.Manifest, itb.ManifestMediaType = manifest, types.V1ociManifestMt
+		}
+		var buf bytes.Buffer
+		dtm, err := itb.ToWriter(&buf)
+		if err != nil {
+			t.Fatalf("write tarball: %s", err)
+		}
+		files := readTar(t, buf.Bytes())
+		if string(files["oci-layout"]) != ociLayout || len(files) != 6 {
+			t.Errorf("unexpected files in tarball")
+		}
+		if dtm.Config != "blobs/sha256/"+configDigest || len(dtm.Layers) != 2 || dtm.Layers[0] != "blobs/sha256/"+layerDigest || dtm.Annotations["frobozz"] != "fizzbin" {
+			t.Errorf("unexpected manifest.json %+v", dtm)
+		}
+		if string(files[dtm.Config]) != configDigest || string(files[dtm.Layers[0]]) != layerDigest {
+			t.Errorf("blobs missing from tarball")
+		}
+		index := v1oci.Index{}
+		if json.Unmarshal(files["index.json"], &index) != nil || len(index.Manifests) != 1 {
+			t.FailNow()
+		}
+		desc := index.Manifests[0]
+		if desc.Annotations[annotationImageName] != itb.RepoTags[0] || desc.Annotations[annotationRefName] != "v1.2.3" || desc.Annotations["frobozz"] != "fizzbin" {
+			t.Errorf("unexpected annotations %+v", desc.Annotations)
+		}
+		m := files["blobs/sha256/"+digest.Digest(desc.Digest).Encoded()]
+		if digest.FromBytes(m).String() != desc.Digest || int64(len(m)) != desc.Size {
+			t.Errorf("manifest blob doesn't match its descriptor")
+		}
+		if provided && (!bytes.Equal(m, manifest) || desc.MediaType != string(types.V1ociManifestMt)) {
+			t.Errorf("expected the provided manifest")
+		}
+		if !provided {
+			gm := v1oci.Manifest{}
+			if json.Unmarshal(m, &gm) != nil || gm.Config.Digest != "sha256:"+configDigest || len(gm.Layers) != 2 || gm.Layers[0].Size != 64 {
+				t.Errorf("unexpected generated manifest %s", string(m))
+			}
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package testhelpers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// PushRegistry is a minimal in-memory OCI distribution server that supports
+// pushing and pulling blobs and manifests with no auth. It supports testing
+// functionality that pushes to a registry.
+type PushRegistry struct {
+	mu sync.Mutex
+	// Blobs is keyed by repository, then by digest (e.g. sha256:abc...)
+	Blobs map[string]map[string][]byte
+	// Manifests is keyed by repository, then by ref (tag or digest)
+	Manifests map[string]map[string][]byte
+	// MediaTypes is keyed by repository, then by ref (tag or digest)
+	MediaTypes map[string]map[string]string
+	// DisableDeletes causes DELETE requests to be rejected with 405 like a registry
+	// that doesn't have deletes enabled.
+	DisableDeletes bool
+	// ChunkMinLength, if not zero, is returned in an 'OCI-Chunk-Min-Length' header when
+	// an upload is started, like a registry that accepts chunked uploads.
+	ChunkMinLength int64
+}
+
+var (
+	manifestPathRe = regexp.MustCompile(`^/v2/(.+)/manifests/([^/]+)$`)
+	blobPathRe     = regexp.MustCompile(`^/v2/(.+)/blobs/(sha256:[a-f0-9]{64})$`)
+	uploadPathRe   = regexp.MustCompile(`^/v2/(.+)/blobs/uploads/(.*)$`)
+)
+
+// NewPushRegistry starts a PushRegistry. It returns the registry, the server, and a
+// server url (without the scheme - like 'localhost:12345'.)
+func NewPushRegistry() (*PushRegistry, *httptest.Server, string) {
+	pr := &PushRegistry{
+		Blobs:      map[string]map[string][]byte{},
+		Manifests:  map[string]map[string][]byte{},
+		MediaTypes: map[string]map[string]string{},
+	}
+	server := httptest.NewServer(http.HandlerFunc(pr.handle))
+	return pr, server, strings.ReplaceAll(server.URL, "http://", "")
+}
+
+// Manifest returns the manifest bytes and media type for the passed repository and
+// ref, and true if found.
+func (pr *PushRegistry) Manifest(repo, ref string) ([]byte, string, bool) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	b, found := pr.Manifests[repo][ref]
+	return b, pr.MediaTypes[repo][ref], found
+}
+
+// Blob returns the blob bytes for the passed repository and digest, and true
+// if found.
+func (pr *PushRegistry) Blob(repo, digest string) ([]byte, bool) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	b, found := pr.Blobs[repo][digest]
+	return b, found
+}
+
+// handle is the http handler for the registry.
+func (pr *PushRegistry) handle(w http.ResponseWriter, r *http.Request) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	if m := uploadPathRe.FindStringSubmatch(r.URL.Path); m != nil {
+		pr.handleUpload(w, r, m[1], m[2])
+	} else if m := blobPathRe.FindStringSubmatch(r.URL.Path); m != nil {
+		b, found := pr.Blobs[m[1]][m[2]]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			if pr.DisableDeletes {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			delete(pr.Blobs[m[1]], m[2])
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(b)))
+		w.Header().Set("Docker-Content-Digest", m[2])
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(b)
+		}
+	} else if m := manifestPathRe.FindStringSubmatch(r.URL.Path); m != nil {
+		pr.handleManifest(w, r, m[1], m[2])
+	} else if r.URL.Path == "/v2/" {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// handleUpload handles starting, completing, and cancelling a monolithic blob upload.
+func (pr *PushRegistry) handleUpload(w http.ResponseWriter, r *http.Request, repo, id string) {
+	switch r.Method {
+	case http.MethodPost:
+		if pr.ChunkMinLength != 0 {
+			w.Header().Set("OCI-Chunk-Min-Length", fmt.Sprintf("%d", pr.ChunkMinLength))
+		}
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", repo, MakeDigest()))
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		b, err := io.ReadAll(r.Body)
+		if err != nil || id == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		dgst := r.URL.Query().Get("digest")
+		if digest.FromBytes(b).String() != dgst {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if pr.Blobs[repo] == nil {
+			pr.Blobs[repo] = map[string][]byte{}
+		}
+		pr.Blobs[repo][dgst] = b
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleManifest handles getting, putting, and deleting manifests. Deleting a manifest
+// by digest also deletes the tags that reference it.
+func (pr *PushRegistry) handleManifest(w http.ResponseWriter, r *http.Request, repo, ref string) {
+	switch r.Method {
+	case http.MethodPut:
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if pr.Manifests[repo] == nil {
+			pr.Manifests[repo] = map[string][]byte{}
+			pr.MediaTypes[repo] = map[string]string{}
+		}
+		dgst := digest.FromBytes(b).String()
+		if strings.HasPrefix(ref, "sha256:") && ref != dgst {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, key := range []string{ref, dgst} {
+			pr.Manifests[repo][key] = b
+			pr.MediaTypes[repo][key] = r.Header.Get("Content-Type")
+		}
+		w.Header().Set("Docker-Content-Digest", dgst)
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet, http.MethodHead:
+		b, found := pr.Manifests[repo][ref]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(b)))
+		w.Header().Set("Content-Type", pr.MediaTypes[repo][ref])
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(b).String())
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(b)
+		}
+	case http.MethodDelete:
+		b, found := pr.Manifests[repo][ref]
+		if pr.DisableDeletes {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		} else if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(pr.Manifests[repo], ref)
+		if dgst := digest.FromBytes(b).String(); ref == dgst {
+			for key, mb := range pr.Manifests[repo] {
+				if digest.FromBytes(mb).String() == dgst {
+					delete(pr.Manifests[repo], key)
+				}
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
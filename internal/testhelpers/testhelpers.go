@@ -3,11 +3,14 @@ package testhelpers
 import (
 	"archive/tar"
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"fmt"
 	"io"
 	"math/rand/v2"
 	"os"
 	"path/filepath"
+	"sort"
 
 	"github.com/opencontainers/go-digest"
 )
@@ -58,3 +61,24 @@ func UntarFile(tarfile string) error {
 	}
 	return nil
 }
+
+// MakeLayer returns a gzipped tar layer with the passed files, keyed by name with
+// the file content as the value. Files are added in name order so the same files
+// always produce the same layer.
+func MakeLayer(files map[string]string) []byte {
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf := bytes.Buffer{}
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, name := range names {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(files[name]))})
+		tw.Write([]byte(files[name]))
+	}
+	tw.Close()
+	gw.Close()
+	return buf.Bytes()
+}
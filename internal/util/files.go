@@ -0,0 +1,50 @@
+package util
+
+import (
+	"os"
+)
+
+// FileOpts configures the files written by a puller, like blobs and tarballs, for
+// operators writing into shared caches that are read by other processes. The zero
+// value leaves files as they were written.
+type FileOpts struct {
+	// Mode, if not zero, is the permissions that files are set to, regardless of the
+	// umask.
+	Mode os.FileMode
+	// Chown causes the owner of files to be set to 'Uid' and 'Gid'. Like os.Chown, a
+	// value of -1 leaves that id unchanged.
+	Chown bool
+	Uid   int
+	Gid   int
+	// Sync causes files to be flushed to stable storage so they are complete if the
+	// host fails after the pull.
+	Sync bool
+}
+
+// Apply syncs the passed file, and then sets its permissions and ownership, as
+// configured in the receiver. The file is synced first since changing the permissions
+// or the owner could prevent the file from being opened for writing.
+func (fo FileOpts) Apply(path string) error {
+	if fo.Sync {
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		err = f.Sync()
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if fo.Mode != 0 {
+		if err := os.Chmod(path, fo.Mode); err != nil {
+			return err
+		}
+	}
+	if fo.Chown {
+		return os.Chown(path, fo.Uid, fo.Gid)
+	}
+	return nil
+}
@@ -1,6 +1,9 @@
 package util
 
 import (
+	"os"
+	"path/filepath"
+	"runtime"
 	"testing"
 )
 
@@ -24,3 +27,23 @@ func TestDigestFrom(t *testing.T) {
 		}
 	}
 }
+
+func TestFileOptsApply(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blob")
+	if err := os.WriteFile(path, []byte("blob"), 0600); err != nil {
+		t.FailNow()
+	}
+	if err := (FileOpts{}).Apply(path); err != nil {
+		t.Fail()
+	}
+	fo := FileOpts{Mode: 0640, Sync: true, Chown: runtime.GOOS != "windows", Uid: -1, Gid: os.Getgid()}
+	if err := fo.Apply(path); err != nil {
+		t.Fatalf("apply: %s", err)
+	}
+	if info, err := os.Stat(path); err != nil || (runtime.GOOS != "windows" && info.Mode().Perm() != 0640) {
+		t.Errorf("expected mode 0640, got %v", info.Mode())
+	}
+	if (FileOpts{Sync: true}).Apply(filepath.Join(t.TempDir(), "nosuchfile")) == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
@@ -2,11 +2,14 @@ package mock
 
 import (
 	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/opencontainers/go-digest"
 )
@@ -52,3 +55,269 @@ func TestServer(t *testing.T) {
 		}
 	}
 }
+
+// Tests serving added content, including with the 'library/' prefix.
+func TestServerWith(t *testing.T) {
+	reg := NewRegistry()
+	config := []byte(`{"architecture":"amd64","os":"linux"}`)
+	layer := []byte("frobozz")
+	manifestDigest := reg.AddImage("my/image", "v1", config, layer)
+	server, url := ServerWith(NewMockParams(NONE, NOTLS, CertSetup{}), reg)
+	defer server.Close()
+
+	for _, tc := range []struct {
+		path   string
+		status int
+		digest string
+	}{
+		{"/v2/my/image/manifests/v1", http.StatusOK, manifestDigest},
+		{"/v2/my/image/manifests/" + manifestDigest, http.StatusOK, manifestDigest},
+		{"/v2/library/my/image/manifests/v1", http.StatusOK, manifestDigest},
+		{"/v2/my/image/blobs/" + digest.FromBytes(layer).String(), http.StatusOK, digest.FromBytes(layer).String()},
+		{"/v2/my/image/blobs/" + digest.FromBytes(config).String(), http.StatusOK, digest.FromBytes(config).String()},
+		{"/v2/my/image/manifests/v2", http.StatusNotFound, ""},
+		{"/v2/other/manifests/v1", http.StatusNotFound, ""},
+	} {
+		resp, err := http.Get(fmt.Sprintf("http://%s%s", url, tc.path))
+		if err != nil {
+			t.FailNow()
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Fail()
+		}
+		if tc.digest != "" && (resp.Header.Get("Docker-Content-Digest") != tc.digest || digest.FromBytes(body).String() != tc.digest) {
+			t.Fail()
+		}
+	}
+}
+
+// Tests fault injection.
+func TestFaults(t *testing.T) {
+	reg := NewHelloWorldRegistry()
+	server, url := ServerWith(NewMockParams(NONE, NOTLS, CertSetup{}), reg)
+	defer server.Close()
+	blobDigest := "sha256:d2c94e258dcb3c5ac2798d32e1249e42ef01cba4841c2234249495f87264ac5a"
+	blobUrl := fmt.Sprintf("http://%s/v2/hello-world/blobs/%s", url, blobDigest)
+	get := func() (int, string, time.Duration) {
+		start := time.Now()
+		resp, err := http.Get(blobUrl)
+		if err != nil {
+			t.FailNow()
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, digest.FromBytes(body).String(), time.Since(start)
+	}
+	reg.AddFault(Fault{Match: "/blobs/", Status: http.StatusInternalServerError, Count: 2})
+	for i := 0; i < 2; i++ {
+		if status, _, _ := get(); status != http.StatusInternalServerError {
+			t.Fail()
+		}
+	}
+	if status, d, _ := get(); status != http.StatusOK || d != blobDigest {
+		t.Fail()
+	}
+	reg.AddFault(Fault{Match: "/blobs/", Method: http.MethodHead, Status: http.StatusInternalServerError})
+	reg.AddFault(Fault{Match: "/blobs/", Corrupt: true, Delay: 200 * time.Millisecond})
+	if status, d, elapsed := get(); status != http.StatusOK || d == blobDigest || elapsed < 200*time.Millisecond {
+		t.Fail()
+	}
+	reg.ClearFaults()
+	if status, d, _ := get(); status != http.StatusOK || d != blobDigest {
+		t.Fail()
+	}
+}
+
+// Tests basic auth credential validation.
+func TestBasicAuth(t *testing.T) {
+	params := NewMockParams(BASIC, NOTLS, CertSetup{})
+	params.Username, params.Password = "foo", "bar"
+	server, url := Server(params)
+	defer server.Close()
+	for _, tc := range []struct {
+		user   string
+		pass   string
+		status int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"foo", "baz", http.StatusUnauthorized},
+		{"foo", "bar", http.StatusOK},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/v2/hello-world/manifests/latest", url), nil)
+		if tc.user != "" {
+			req.SetBasicAuth(tc.user, tc.pass)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.FailNow()
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Fail()
+		}
+		if tc.status == http.StatusUnauthorized && resp.Header.Get("Www-Authenticate") == "" {
+			t.Fail()
+		}
+	}
+}
+
+// Tests issuing expiring, scoped bearer tokens and revoking them.
+func TestBearerTokens(t *testing.T) {
+	reg := NewHelloWorldRegistry()
+	params := NewMockParams(BEARER, NOTLS, CertSetup{})
+	params.TokenTTL = time.Second
+	params.ValidateScope = true
+	server, url := ServerWith(params, reg)
+	defer server.Close()
+	getToken := func(scope string) (int, string) {
+		resp, err := http.Get(fmt.Sprintf("http://%s/v2/auth?scope=%s&service=registry.docker.io", url, scope))
+		if err != nil {
+			t.FailNow()
+		}
+		defer resp.Body.Close()
+		token := struct {
+			Token     string `json:"token"`
+			ExpiresIn int    `json:"expires_in"`
+		}{}
+		json.NewDecoder(resp.Body).Decode(&token)
+		if resp.StatusCode == http.StatusOK && token.ExpiresIn != 1 {
+			t.Fail()
+		}
+		return resp.StatusCode, token.Token
+	}
+	getManifest := func(repository, token string) int {
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/v2/%s/manifests/latest", url, repository), nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.FailNow()
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status, _ := getToken(""); status != http.StatusBadRequest {
+		t.Fail()
+	}
+	if status, _ := getToken("repository:hello-world:push"); status != http.StatusBadRequest {
+		t.Fail()
+	}
+	status, token := getToken("repository:library/hello-world:pull")
+	if status != http.StatusOK {
+		t.FailNow()
+	}
+	if getManifest("hello-world", token) != http.StatusOK || getManifest("library/hello-world", token) != http.StatusOK {
+		t.Fail()
+	}
+	if getManifest("hello-world", "FROBOZZ") != http.StatusUnauthorized {
+		t.Fail()
+	}
+	// token is only valid for the repository in its scope
+	_, other := getToken("repository:other:pull")
+	if getManifest("hello-world", other) != http.StatusUnauthorized {
+		t.Fail()
+	}
+	reg.RevokeTokens()
+	if getManifest("hello-world", token) != http.StatusUnauthorized {
+		t.Fail()
+	}
+	_, token = getToken("repository:hello-world:pull")
+	time.Sleep(1100 * time.Millisecond)
+	if getManifest("hello-world", token) != http.StatusUnauthorized {
+		t.Fail()
+	}
+	if reg.TokenRequests() != 5 {
+		t.Fail()
+	}
+}
+
+// Tests redirecting blob requests to the storage server.
+func TestStorageServer(t *testing.T) {
+	reg := NewHelloWorldRegistry()
+	server, url := ServerWith(NewMockParams(NONE, NOTLS, CertSetup{}), reg)
+	defer server.Close()
+	storage, storageUrl := StorageServer(reg)
+	defer storage.Close()
+	reg.RedirectBlobs(storageUrl)
+	blobDigest := "sha256:d2c94e258dcb3c5ac2798d32e1249e42ef01cba4841c2234249495f87264ac5a"
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(fmt.Sprintf("http://%s/v2/hello-world/blobs/%s", url, blobDigest))
+	if err != nil {
+		t.FailNow()
+	}
+	resp.Body.Close()
+	location := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusTemporaryRedirect || !strings.HasPrefix(location, storageUrl) {
+		t.FailNow()
+	}
+	for _, tc := range []struct {
+		url    string
+		auth   bool
+		status int
+	}{
+		{location, false, http.StatusOK},
+		{location, true, http.StatusBadRequest},
+		{strings.Split(location, "?")[0] + "?X-Signature=bad", false, http.StatusForbidden},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, tc.url, nil)
+		if tc.auth {
+			req.Header.Set("Authorization", "Bearer FROBOZZ")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.FailNow()
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Fail()
+		}
+		if tc.status == http.StatusOK && digest.FromBytes(body).String() != blobDigest {
+			t.Fail()
+		}
+	}
+}
+
+// Tests listing tags, with and without pagination.
+func TestTags(t *testing.T) {
+	reg := NewRegistry()
+	for _, tag := range []string{"v2", "v1", "latest"} {
+		reg.AddImage("frobozz", tag, []byte(`{"architecture":"`+tag+`"}`), []byte(tag))
+	}
+	server, url := ServerWith(NewMockParams(NONE, NOTLS, CertSetup{}), reg)
+	defer server.Close()
+	getTags := func(query string) ([]string, string) {
+		resp, err := http.Get(fmt.Sprintf("http://%s/v2/frobozz/tags/list%s", url, query))
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.FailNow()
+		}
+		defer resp.Body.Close()
+		tl := struct {
+			Tags []string `json:"tags"`
+		}{}
+		if json.NewDecoder(resp.Body).Decode(&tl) != nil {
+			t.FailNow()
+		}
+		return tl.Tags, resp.Header.Get("Link")
+	}
+	for _, tc := range []struct {
+		query string
+		tags  string
+		link  string
+	}{
+		{"", "latest,v1,v2", ""},
+		{"?n=2", "latest,v1", `</v2/frobozz/tags/list?n=2&last=v1>; rel="next"`},
+		{"?n=2&last=v1", "v2", ""},
+		{"?last=m", "v1,v2", ""},
+	} {
+		tags, link := getTags(tc.query)
+		if strings.Join(tags, ",") != tc.tags || link != tc.link {
+			t.Errorf("query %q: unexpected tags %v or link %q", tc.query, tags, link)
+		}
+	}
+	resp, err := http.Get(fmt.Sprintf("http://%s/v2/xyzzy/tags/list", url))
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Error("expected 404 for a missing repository")
+	}
+}
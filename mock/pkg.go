@@ -1,13 +1,29 @@
-// Package mock runs an OCI distribution server that only allows pulling and
-// only serves docker.io/hello-world:latest. The server supports getting both
-// docker.io/library/hello-world:latest as well as docker.io/hello-world:latest.
-// The server supports basic and bearer auth, 1-way TLS, and mTLS.
+// Package mock runs an OCI distribution server that only allows pulling. It is a
+// supported test fixture: downstream projects can use it to test against a registry
+// without running one.
 //
-// There are some things the mock server doesn't do because they don't really
-// enhance testing of the image puller and at the end of the day any server in the
-// wild will do this.
+// By default ('Server') the server only serves docker.io/hello-world:latest. The server
+// supports getting both docker.io/library/hello-world:latest as well as
+// docker.io/hello-world:latest. To serve other content, create a 'Registry', add
+// manifests, blobs, or whole images to it, and run the server with 'ServerWith':
 //
-//  1. Doesn't validate the bearer token
-//  2. Doesn't validate the basic auth credentials
+//	reg := mock.NewRegistry()
+//	reg.AddImage("my/image", "v1", config, layer)
+//	server, url := mock.ServerWith(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}), reg)
+//	defer server.Close()
+//
+// Failures can be injected with 'Registry.AddFault' to return error statuses, respond
+// slowly, or corrupt content so it doesn't match its digest. For bearer auth, the server
+// can issue expiring tokens ('MockParams.TokenTTL'), require and enforce token scopes
+// ('MockParams.ValidateScope'), and revoke all issued tokens ('Registry.RevokeTokens') to
+// simulate a 401 in the middle of a pull. The realm can also be a separate token server
+// ('TokenServer' and 'MockParams.Realm') that requires its own TLS and credentials.
+//
+// The server supports basic and bearer auth, 1-way TLS, and mTLS. There are some
+// things the mock server doesn't do because they don't really enhance testing of the
+// image puller and at the end of the day any server in the wild will do this.
+//
+//  1. Doesn't validate the bearer token unless 'MockParams' has a token TTL or scope validation
+//  2. Doesn't validate the basic auth credentials unless 'MockParams' has a username
 //  3. Doesn't validate the client certs in mTLS - only requests them
 package mock
@@ -0,0 +1,319 @@
+package mock
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// testFiles has the hello-world image served by the default registry. The files are
+// embedded so that the mock server can be used from any package, including packages
+// in other modules.
+//
+//go:embed testfiles
+var testFiles embed.FS
+
+// Manifest is a manifest served by the mock server.
+type Manifest struct {
+	MediaType string
+	Bytes     []byte
+	Digest    string
+}
+
+// Fault injects a failure into the responses of the mock server. A fault applies to
+// every request whose URL path contains 'Match' (and whose method is 'Method' if
+// 'Method' is not empty.) If 'Count' is greater than zero then the fault is removed
+// after it has been applied that many times.
+type Fault struct {
+	// Match is a substring of the request path, e.g. "/blobs/" or "/manifests/latest".
+	Match string
+	// Method, if not empty, limits the fault to requests with the method, e.g. "GET".
+	Method string
+	// Status, if not zero, is returned with an empty body rather than the content.
+	Status int
+	// Delay is how long to wait before responding.
+	Delay time.Duration
+	// Corrupt causes the content in the response to be modified so that it doesn't
+	// match its digest.
+	Corrupt bool
+	// Count is how many times the fault is applied. If zero, the fault is always applied.
+	Count int
+}
+
+// Registry has the content served by a mock server. Manifests and blobs can be added
+// to a registry, and faults can be injected, while the server is running. A Registry is
+// safe for concurrent use.
+type Registry struct {
+	mu        sync.Mutex
+	manifests map[string]map[string]Manifest
+	blobs     map[string]map[string][]byte
+	faults    []*Fault
+	// tokens are the bearer tokens issued by the server, if the server validates tokens.
+	tokens map[string]issuedToken
+	// tokenRequests is the number of requests to the token endpoint.
+	tokenRequests int
+	// redirectUrl, if not empty, is the url of the storage server that blob requests
+	// are redirected to.
+	redirectUrl string
+}
+
+// issuedToken is a bearer token issued by the server. The repository is the repository
+// in the scope the token was requested for, or empty if no scope was requested.
+type issuedToken struct {
+	repository string
+	expires    time.Time
+}
+
+// NewRegistry returns a registry with no content.
+func NewRegistry() *Registry {
+	return &Registry{
+		manifests: map[string]map[string]Manifest{},
+		blobs:     map[string]map[string][]byte{},
+		tokens:    map[string]issuedToken{},
+	}
+}
+
+// NewHelloWorldRegistry returns a registry that serves docker.io/hello-world:latest as
+// the repository 'hello-world'. This is the content served by 'Server'.
+func NewHelloWorldRegistry() *Registry {
+	reg := NewRegistry()
+	read := func(name string) []byte {
+		b, err := testFiles.ReadFile("testfiles/" + name)
+		if err != nil {
+			panic(err)
+		}
+		return b
+	}
+	// the manifest list is stored pretty-printed but was served compacted by the upstream
+	manifestList := regexp.MustCompile(`[\r\n\t ]{1}`).ReplaceAll(read("manifestList.json"), []byte{})
+	reg.AddManifest("hello-world", "latest", "application/vnd.oci.image.index.v1+json", manifestList)
+	reg.AddManifest("hello-world", "", "application/vnd.oci.image.manifest.v1+json", read("imageManifest.json"))
+	reg.AddBlob("hello-world", read("d2c9.json"))
+	reg.AddBlob("hello-world", read("c1ec31eb59444d78df06a974d155e597c894ab4cda84f08294145e845394988e.tar.gz"))
+	return reg
+}
+
+// AddManifest adds the passed manifest to the passed repository by its digest and,
+// if 'tag' is not empty, by the tag. The function returns the digest of the manifest,
+// like 'sha256:abc...'.
+func (reg *Registry) AddManifest(repository, tag, mediaType string, b []byte) string {
+	m := Manifest{
+		MediaType: mediaType,
+		Bytes:     b,
+		Digest:    digest.FromBytes(b).String(),
+	}
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.manifests[repository] == nil {
+		reg.manifests[repository] = map[string]Manifest{}
+	}
+	reg.manifests[repository][m.Digest] = m
+	if tag != "" {
+		reg.manifests[repository][tag] = m
+	}
+	return m.Digest
+}
+
+// AddBlob adds the passed blob to the passed repository and returns the digest of the
+// blob, like 'sha256:abc...'.
+func (reg *Registry) AddBlob(repository string, b []byte) string {
+	d := digest.FromBytes(b).String()
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.blobs[repository] == nil {
+		reg.blobs[repository] = map[string][]byte{}
+	}
+	reg.blobs[repository][d] = b
+	return d
+}
+
+// AddImage adds a single-platform OCI image to the passed repository with the passed
+// tag. The image config and layers are added as blobs, and an image manifest referencing
+// them is generated. The layers are stored as provided, and are described in the manifest
+// as gzipped tar layers. The function returns the digest of the image manifest.
+func (reg *Registry) AddImage(repository, tag string, config []byte, layers ...[]byte) string {
+	type descriptor struct {
+		MediaType string `json:"mediaType"`
+		Digest    string `json:"digest"`
+		Size      int    `json:"size"`
+	}
+	type manifest struct {
+		SchemaVersion int          `json:"schemaVersion"`
+		MediaType     string       `json:"mediaType"`
+		Config        descriptor   `json:"config"`
+		Layers        []descriptor `json:"layers"`
+	}
+	m := manifest{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.oci.image.manifest.v1+json",
+		Config: descriptor{
+			MediaType: "application/vnd.oci.image.config.v1+json",
+			Digest:    reg.AddBlob(repository, config),
+			Size:      len(config),
+		},
+		Layers: []descriptor{},
+	}
+	for _, layer := range layers {
+		m.Layers = append(m.Layers, descriptor{
+			MediaType: "application/vnd.oci.image.layer.v1.tar+gzip",
+			Digest:    reg.AddBlob(repository, layer),
+			Size:      len(layer),
+		})
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		panic(err)
+	}
+	return reg.AddManifest(repository, tag, m.MediaType, b)
+}
+
+// AddFault injects the passed fault. Faults are checked in the order they were added and
+// the first matching fault is applied.
+func (reg *Registry) AddFault(f Fault) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.faults = append(reg.faults, &f)
+}
+
+// ClearFaults removes all injected faults.
+func (reg *Registry) ClearFaults() {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.faults = nil
+}
+
+// manifest returns the manifest in the passed repository with the passed tag or digest.
+func (reg *Registry) manifest(repository, ref string) (Manifest, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	m, ok := reg.manifests[repository][ref]
+	return m, ok
+}
+
+// tags returns the tags in the passed repository, sorted, and true if the repository exists.
+func (reg *Registry) tags(repository string) ([]string, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	manifests, found := reg.manifests[repository]
+	if !found {
+		return nil, false
+	}
+	tags := []string{}
+	for ref := range manifests {
+		if _, err := digest.Parse(ref); err != nil {
+			tags = append(tags, ref)
+		}
+	}
+	slices.Sort(tags)
+	return tags, true
+}
+
+// blob returns the blob in the passed repository with the passed digest.
+func (reg *Registry) blob(repository, dgst string) ([]byte, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	b, ok := reg.blobs[repository][dgst]
+	return b, ok
+}
+
+// fault returns the first fault matching the passed method and path, or nil if none
+// matches. If the fault has a count, the count is decremented and the fault is removed
+// when the count reaches zero.
+func (reg *Registry) fault(method, path string) *Fault {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	for i, f := range reg.faults {
+		if !strings.Contains(path, f.Match) || (f.Method != "" && f.Method != method) {
+			continue
+		}
+		applied := *f
+		if f.Count > 0 {
+			if f.Count--; f.Count == 0 {
+				reg.faults = append(reg.faults[:i], reg.faults[i+1:]...)
+			}
+		}
+		return &applied
+	}
+	return nil
+}
+
+// RevokeTokens invalidates all bearer tokens issued by the server, so that subsequent
+// requests with those tokens get a 401. This supports testing a 401 in the middle of a
+// pull. It has no effect unless the server validates tokens.
+func (reg *Registry) RevokeTokens() {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.tokens = map[string]issuedToken{}
+}
+
+// TokenRequests returns the number of requests that have been made to the token endpoint.
+func (reg *Registry) TokenRequests() int {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.tokenRequests
+}
+
+// issueToken records and returns a new token for the passed repository that expires
+// after the passed ttl.
+func (reg *Registry) issueToken(repository string, ttl time.Duration) string {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	token := fmt.Sprintf("token-%d", reg.tokenRequests)
+	reg.tokens[token] = issuedToken{
+		repository: repository,
+		expires:    time.Now().Add(ttl),
+	}
+	return token
+}
+
+// validToken returns true if the passed token was issued by the server, has not expired
+// or been revoked, and - if 'checkScope' is true - was issued for the passed repository.
+func (reg *Registry) validToken(token, repository string, checkScope bool) bool {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	it, ok := reg.tokens[token]
+	if !ok || time.Now().After(it.expires) {
+		return false
+	}
+	return !checkScope || it.repository == repository
+}
+
+// countTokenRequest increments the number of token requests.
+func (reg *Registry) countTokenRequest() {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.tokenRequests++
+}
+
+// RedirectBlobs causes the server to redirect blob GET requests with a 307 to the passed
+// storage server url (e.g. 'http://localhost:12345') with a pre-signed URL, like registries
+// that keep blobs in S3 or GCS. Use 'StorageServer' to run the storage server. An empty
+// url stops redirecting.
+func (reg *Registry) RedirectBlobs(url string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.redirectUrl = url
+}
+
+// blobRedirect returns the url to redirect a request for the passed blob to, or the
+// empty string if blobs are not redirected.
+func (reg *Registry) blobRedirect(repository, dgst string) string {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.redirectUrl == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/storage/%s/%s?X-Signature=%s", reg.redirectUrl, repository, dgst, signature(repository, dgst))
+}
+
+// signature returns the signature of a pre-signed URL for the passed blob.
+func signature(repository, dgst string) string {
+	return digest.FromString("presigned:" + repository + "@" + dgst).Encoded()
+}
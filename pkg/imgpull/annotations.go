@@ -0,0 +1,67 @@
+package imgpull
+
+import (
+	"github.com/aceeric/imgpull/pkg/imgpull/v1oci"
+)
+
+// Annotations returns the annotations of the manifest in the receiver - not the
+// annotations of the descriptors within the manifest. These include the pre-defined
+// 'org.opencontainers.image.*' keys (see the v1oci package for constants) as well as
+// any arbitrary keys. Docker manifest lists and schema 1 manifests don't support
+// annotations. If the manifest has no annotations, nil is returned.
+func (mh *ManifestHolder) Annotations() map[string]string {
+	switch mh.Type {
+	case V1ociIndex:
+		return mh.V1ociIndex.Annotations
+	case V1ociManifest:
+		return mh.V1ociManifest.Annotations
+	case V1ociArtifactManifest:
+		return mh.V1ociArtifactManifest.Annotations
+	case V2dockerManifest:
+		return mh.V2dockerManifest.Annotations
+	}
+	return nil
+}
+
+// Annotation returns the value of the passed annotation key from the manifest in the
+// receiver, or the empty string if the manifest doesn't have the annotation.
+func (mh *ManifestHolder) Annotation(key string) string {
+	return mh.Annotations()[key]
+}
+
+// DescriptorAnnotations returns the annotations of the descriptor in the manifest in the
+// receiver that has the passed digest - which could be a manifest in an image list, the
+// config, or a layer. If no descriptor matches the digest, or the descriptor has no
+// annotations, nil is returned.
+func (mh *ManifestHolder) DescriptorAnnotations(digest string) map[string]string {
+	descs := []v1oci.Descriptor{}
+	switch mh.Type {
+	case V1ociIndex:
+		descs = mh.V1ociIndex.Manifests
+	case V1ociManifest:
+		descs = append([]v1oci.Descriptor{mh.V1ociManifest.Config}, mh.V1ociManifest.Layers...)
+	case V1ociArtifactManifest:
+		descs = mh.V1ociArtifactManifest.Blobs
+	case V2dockerManifestList:
+		for _, d := range mh.V2dockerManifestList.Manifests {
+			if d.Digest == digest {
+				return d.Annotations
+			}
+		}
+	case V2dockerManifest:
+		if mh.V2dockerManifest.Config.Digest == digest {
+			return mh.V2dockerManifest.Config.Annotations
+		}
+		for _, d := range mh.V2dockerManifest.Layers {
+			if d.Digest == digest {
+				return d.Annotations
+			}
+		}
+	}
+	for _, d := range descs {
+		if d.Digest == digest {
+			return d.Annotations
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package imgpull
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aceeric/imgpull/internal/util"
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+	"github.com/aceeric/imgpull/pkg/imgpull/v1oci"
+	"github.com/aceeric/imgpull/pkg/imgpull/v2docker"
+)
+
+// artifactFile is the name of the file written by 'PullArtifact' that describes
+// the pulled artifact.
+const artifactFile = "artifact.json"
+
+// Artifact describes an artifact pulled by 'PullArtifact'. It is written to the
+// 'artifact.json' file in the destination directory.
+type Artifact struct {
+	Url          string            `json:"url"`
+	Digest       string            `json:"digest"`
+	MediaType    string            `json:"mediaType"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	Blobs        []ArtifactBlob    `json:"blobs"`
+}
+
+// ArtifactBlob describes one blob of a pulled artifact. File is the name of the
+// file in the destination directory that the blob was written to.
+type ArtifactBlob struct {
+	File        string            `json:"file"`
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+func (p *puller) PullArtifact(destDir string) (err error) {
+	if destDir == "" {
+		return fmt.Errorf("no destination specified for pull of %q", p.Opts.Url)
+	}
+	finished := p.pullStarted()
+	defer func() { finished(err) }()
+	mh, err := p.GetManifest()
+	if err != nil {
+		return err
+	}
+	var list *ManifestHolder
+	if mh.IsManifestList() {
+		lmh := mh
+		list = &lmh
+		digest, err := mh.GetImageDigestForPlatform(p.Opts.platform())
+		if err != nil {
+			return err
+		}
+		if mh, err = p.GetManifestByDigest(digest); err != nil {
+			return err
+		}
+	}
+	p.manifestResolved(mh)
+	if err := p.prePull(mh, list); err != nil {
+		return err
+	}
+	art, err := newArtifact(mh)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return fmt.Errorf("unable to create directory %q, error: %q", destDir, err)
+	}
+	rc := p.regCliFrom()
+	used := map[string]bool{artifactFile: true}
+	for i, blob := range art.Blobs {
+		art.Blobs[i].File = artifactBlobFile(blob, used)
+		layer := types.NewLayer(types.MediaType(blob.MediaType), blob.Digest, blob.Size)
+		if _, err := p.pullBlob(rc, layer, filepath.Join(destDir, art.Blobs[i].File)); err != nil {
+			return err
+		}
+	}
+	b, err := json.MarshalIndent(art, "", "   ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(destDir, artifactFile), b, 0644); err != nil {
+		return err
+	}
+	return p.Opts.finishFile(filepath.Join(destDir, artifactFile))
+}
+
+// newArtifact creates an Artifact from the manifest in the passed ManifestHolder, which can
+// be an OCI artifact manifest, or an OCI or docker image manifest. For an image manifest,
+// the config blob is included with the layers unless it is the OCI empty descriptor, and the
+// artifact type is the config media type if the manifest doesn't have an artifact type.
+func newArtifact(mh ManifestHolder) (Artifact, error) {
+	art := Artifact{
+		Url:       mh.ImageUrl,
+		Digest:    "sha256:" + mh.Digest,
+		MediaType: mh.MediaType(),
+	}
+	descs := []v1oci.Descriptor{}
+	switch mh.Type {
+	case V1ociArtifactManifest:
+		art.ArtifactType = mh.ArtifactType()
+		art.Annotations = mh.V1ociArtifactManifest.Annotations
+		descs = mh.V1ociArtifactManifest.Blobs
+	case V1ociManifest:
+		m := mh.V1ociManifest
+		art.ArtifactType = mh.ArtifactType()
+		art.Annotations = m.Annotations
+		if m.Config.MediaType != string(types.V1ociEmptyMt) {
+			descs = append(descs, m.Config)
+		}
+		descs = append(descs, m.Layers...)
+	case V2dockerManifest:
+		m := mh.V2dockerManifest
+		art.ArtifactType = m.Config.MediaType
+		art.Annotations = m.Annotations
+		for _, d := range append([]v2docker.Descriptor{m.Config}, m.Layers...) {
+			descs = append(descs, v1oci.Descriptor{MediaType: d.MediaType, Digest: d.Digest, Size: d.Size, Annotations: d.Annotations})
+		}
+	default:
+		return Artifact{}, fmt.Errorf("can't pull an artifact from %q kind of manifest", manifestTypeToString[mh.Type])
+	}
+	for _, d := range descs {
+		art.Blobs = append(art.Blobs, ArtifactBlob{
+			MediaType:   d.MediaType,
+			Digest:      d.Digest,
+			Size:        d.Size,
+			Annotations: d.Annotations,
+		})
+	}
+	return art, nil
+}
+
+// artifactBlobFile returns the file name to write the passed blob to. The title annotation
+// is used if present - and not already used by another blob - otherwise the digest is used.
+// Only the base name of the title is used so a blob can't be written outside the directory.
+func artifactBlobFile(blob ArtifactBlob, used map[string]bool) string {
+	name := filepath.Base(filepath.Clean("/" + strings.ReplaceAll(blob.Annotations[v1oci.AnnotationTitle], "\\", "/")))
+	if name == "/" || name == "." || used[name] {
+		name = util.DigestFrom(blob.Digest)
+	}
+	used[name] = true
+	return name
+}
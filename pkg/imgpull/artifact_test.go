@@ -0,0 +1,119 @@
+package imgpull
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aceeric/imgpull/internal/testhelpers"
+	"github.com/aceeric/imgpull/internal/util"
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+	"github.com/aceeric/imgpull/pkg/imgpull/v1oci"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// putBlob adds the passed blob to the passed registry and returns a descriptor for it.
+func putBlob(pr *testhelpers.PushRegistry, repo string, mediaType string, b []byte, annotations map[string]string) v1oci.Descriptor {
+	if pr.Blobs[repo] == nil {
+		pr.Blobs[repo] = map[string][]byte{}
+	}
+	pr.Blobs[repo][digest.FromBytes(b).String()] = b
+	return v1oci.Descriptor{
+		MediaType:   mediaType,
+		Digest:      digest.FromBytes(b).String(),
+		Size:        int64(len(b)),
+		Annotations: annotations,
+	}
+}
+
+// putManifest adds the passed manifest to the passed registry with the passed tag.
+func putManifest(t *testing.T, pr *testhelpers.PushRegistry, repo, tag string, mediaType types.MediaType, manifest any) {
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		t.FailNow()
+	}
+	if pr.Manifests[repo] == nil {
+		pr.Manifests[repo] = map[string][]byte{}
+		pr.MediaTypes[repo] = map[string]string{}
+	}
+	pr.Manifests[repo][tag] = b
+	pr.MediaTypes[repo][tag] = string(mediaType)
+}
+
+func TestPullArtifact(t *testing.T) {
+	pr, server, url := testhelpers.NewPushRegistry()
+	defer server.Close()
+	readme := putBlob(pr, "art", "text/markdown", []byte("# frobozz"), map[string]string{v1oci.AnnotationTitle: "README.md"})
+	// a title that tries to escape the destination directory
+	wasm := putBlob(pr, "art", "application/wasm", []byte("wasm"), map[string]string{v1oci.AnnotationTitle: "../../module.wasm"})
+	untitled := putBlob(pr, "art", "application/octet-stream", []byte("untitled"), nil)
+	putManifest(t, pr, "art", "artifact", types.V1ociArtifactMt, v1oci.ArtifactManifest{
+		MediaType:    string(types.V1ociArtifactMt),
+		ArtifactType: "application/vnd.example.thing",
+		Blobs:        []v1oci.Descriptor{readme, wasm, untitled},
+		Annotations:  map[string]string{"org.opencontainers.image.created": "2024-01-01T00:00:00Z"},
+	})
+	empty := putBlob(pr, "art", string(types.V1ociEmptyMt), []byte("{}"), nil)
+	putManifest(t, pr, "art", "image", types.V1ociManifestMt, v1oci.Manifest{
+		SchemaVersion: 2,
+		MediaType:     string(types.V1ociManifestMt),
+		ArtifactType:  "application/vnd.example.thing",
+		Config:        empty,
+		Layers:        []v1oci.Descriptor{readme},
+	})
+	chartConfig := putBlob(pr, "art", "application/vnd.cncf.helm.config.v1+json", []byte(`{"name":"chart"}`), nil)
+	chart := putBlob(pr, "art", "application/vnd.cncf.helm.chart.content.v1.tar+gzip", []byte("chart"), nil)
+	putManifest(t, pr, "art", "chart", types.V1ociManifestMt, v1oci.Manifest{
+		SchemaVersion: 2,
+		MediaType:     string(types.V1ociManifestMt),
+		Config:        chartConfig,
+		Layers:        []v1oci.Descriptor{chart},
+	})
+	tests := []struct {
+		tag          string
+		artifactType string
+		files        []string
+	}{
+		{"artifact", "application/vnd.example.thing", []string{"README.md", "module.wasm", util.DigestFrom(untitled.Digest)}},
+		{"image", "application/vnd.example.thing", []string{"README.md"}},
+		{"chart", chartConfig.MediaType, []string{util.DigestFrom(chartConfig.Digest), util.DigestFrom(chart.Digest)}},
+	}
+	for _, test := range tests {
+		d, _ := os.MkdirTemp("", "")
+		defer os.RemoveAll(d)
+		p, err := NewPullerWith(PullerOpts{
+			Url:      fmt.Sprintf("%s/art:%s", url, test.tag),
+			OStype:   "linux",
+			ArchType: "amd64",
+			Scheme:   "http",
+		})
+		if err != nil {
+			t.FailNow()
+		}
+		dest := filepath.Join(d, "dest")
+		if err := p.PullArtifact(dest); err != nil {
+			t.Errorf("pull %q failed: %s", test.tag, err)
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dest, artifactFile))
+		if err != nil {
+			t.FailNow()
+		}
+		art := Artifact{}
+		if json.Unmarshal(b, &art) != nil || art.ArtifactType != test.artifactType || len(art.Blobs) != len(test.files) {
+			t.Errorf("unexpected artifact for %q: %s", test.tag, b)
+			continue
+		}
+		for i, file := range test.files {
+			if art.Blobs[i].File != file {
+				t.Errorf("expected file %q, got %q", file, art.Blobs[i].File)
+			}
+			if _, err := os.Stat(filepath.Join(dest, file)); err != nil {
+				t.Errorf("expected file %q to be pulled", file)
+			}
+		}
+	}
+}
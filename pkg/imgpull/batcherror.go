@@ -0,0 +1,61 @@
+package imgpull
+
+import (
+	"fmt"
+	"strings"
+)
+
+// BlobError is the error pulling one blob with 'PullBlobs'.
+type BlobError struct {
+	// Digest is the digest of the blob, like 'sha256:abc...'.
+	Digest string
+	Err    error
+}
+
+func (e *BlobError) Error() string {
+	return fmt.Sprintf("blob %s: %s", e.Digest, e.Err)
+}
+
+func (e *BlobError) Unwrap() error {
+	return e.Err
+}
+
+// ImageError is the error pulling one image with 'PullAll'.
+type ImageError struct {
+	// Url is the image url, as passed to 'PullAll'.
+	Url string
+	Err error
+}
+
+func (e *ImageError) Error() string {
+	return fmt.Sprintf("image %q: %s", e.Url, e.Err)
+}
+
+func (e *ImageError) Unwrap() error {
+	return e.Err
+}
+
+// BatchError is returned by 'PullBlobs' and 'PullAll' when some of the items in the
+// batch failed. Errs has a '*BlobError' or an '*ImageError' for each item that failed,
+// in the order of the items, so the caller can tell which digests or refs failed. Since
+// the receiver unwraps to all of them, errors.Is and errors.As match the errors of the
+// individual items, e.g. to check for 'context.Canceled'.
+type BatchError struct {
+	// Kind is what the items in the batch are, i.e. "blobs" or "images".
+	Kind string
+	// Total is the number of items in the batch.
+	Total int
+	Errs  []error
+}
+
+func (e *BatchError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d of %d %s failed to pull: %s", len(e.Errs), e.Total, e.Kind, strings.Join(msgs, "; "))
+}
+
+func (e *BatchError) Unwrap() []error {
+	return e.Errs
+}
@@ -0,0 +1,63 @@
+package imgpull
+
+import (
+	"slices"
+
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+)
+
+// BlobFilter selects the blobs that 'PullBlobs' pulls. It is called for each blob of the
+// image with the blob and whether the blob is the image config, and returns true if the
+// blob should be pulled. A blob is pulled only if all the filters passed to 'PullBlobs'
+// return true. The layers of an image are ordered from the bottom layer to the top layer,
+// so a caller that needs just the top layer can pass its digest to 'OnlyDigests'.
+type BlobFilter func(layer types.Layer, isConfig bool) bool
+
+// SkipDigests returns a filter that skips the blobs with the passed digests.
+func SkipDigests(digests ...string) BlobFilter {
+	return func(layer types.Layer, _ bool) bool {
+		return !slices.Contains(digests, layer.Digest)
+	}
+}
+
+// OnlyDigests returns a filter that only pulls the blobs with the passed digests.
+func OnlyDigests(digests ...string) BlobFilter {
+	return func(layer types.Layer, _ bool) bool {
+		return slices.Contains(digests, layer.Digest)
+	}
+}
+
+// SkipMediaTypes returns a filter that skips the blobs with the passed media types, e.g.
+// foreign layers that can't be pulled from the registry.
+func SkipMediaTypes(mediaTypes ...types.MediaType) BlobFilter {
+	return func(layer types.Layer, _ bool) bool {
+		return !slices.Contains(mediaTypes, layer.MediaType)
+	}
+}
+
+// OnlyConfig returns a filter that only pulls the image config, for callers like scanners
+// that only need the image metadata. Schema 1 manifests have no config, so nothing is pulled
+// for those.
+func OnlyConfig() BlobFilter {
+	return func(_ types.Layer, isConfig bool) bool {
+		return isConfig
+	}
+}
+
+// filterBlobs returns the blobs of the image manifest in the passed ManifestHolder that
+// are selected by all the passed filters, in the same order.
+func filterBlobs(mh ManifestHolder, filters []BlobFilter) []types.Layer {
+	layers := mh.Layers()
+	if len(filters) == 0 {
+		return layers
+	}
+	selected := []types.Layer{}
+	for i, layer := range layers {
+		// the config is the last layer
+		isConfig := mh.hasConfig() && i == len(layers)-1
+		if !slices.ContainsFunc(filters, func(f BlobFilter) bool { return !f(layer, isConfig) }) {
+			selected = append(selected, layer)
+		}
+	}
+	return selected
+}
@@ -0,0 +1,66 @@
+package imgpull
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/aceeric/imgpull/mock"
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+)
+
+// Tests pulling the blobs of an image with filters.
+func TestPullBlobsFiltered(t *testing.T) {
+	config := "d2c94e258dcb3c5ac2798d32e1249e42ef01cba4841c2234249495f87264ac5a"
+	layer := "c1ec31eb59444d78df06a974d155e597c894ab4cda84f08294145e845394988e"
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	p, err := NewPullerWith(PullerOpts{
+		Url:           fmt.Sprintf("%s/hello-world:latest", url),
+		OStype:        "linux",
+		ArchType:      "amd64",
+		Scheme:        "http",
+		VerifyDiffIDs: true,
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	mh, err := p.GetManifest()
+	if err != nil {
+		t.FailNow()
+	}
+	digest, err := mh.GetImageDigestFor("linux", "amd64")
+	if err != nil {
+		t.FailNow()
+	}
+	if mh, err = p.GetManifestByDigest(digest); err != nil {
+		t.FailNow()
+	}
+	for _, tc := range []struct {
+		filters  []BlobFilter
+		expected []string
+	}{
+		{nil, []string{config, layer}},
+		{[]BlobFilter{OnlyConfig()}, []string{config}},
+		{[]BlobFilter{OnlyDigests("sha256:" + layer)}, []string{layer}},
+		{[]BlobFilter{SkipDigests("sha256:" + layer)}, []string{config}},
+		{[]BlobFilter{SkipMediaTypes(types.V1ociLayerGzipMt)}, []string{config}},
+		{[]BlobFilter{OnlyConfig(), SkipDigests("sha256:" + config)}, []string{}},
+	} {
+		blobDir := t.TempDir()
+		if _, err := p.PullBlobs(mh, blobDir, tc.filters...); err != nil {
+			t.Fatalf("pull blobs: %s", err)
+		}
+		entries, _ := os.ReadDir(blobDir)
+		files := []string{}
+		for _, entry := range entries {
+			files = append(files, entry.Name())
+		}
+		slices.Sort(tc.expected)
+		if !slices.Equal(files, tc.expected) {
+			t.Errorf("expected %s, got %s", strings.Join(tc.expected, ","), strings.Join(files, ","))
+		}
+	}
+}
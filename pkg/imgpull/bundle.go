@@ -0,0 +1,328 @@
+package imgpull
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aceeric/imgpull/internal/imgref"
+	"github.com/aceeric/imgpull/internal/tar"
+	"github.com/aceeric/imgpull/internal/util"
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+	"github.com/aceeric/imgpull/pkg/imgpull/v1oci"
+	"github.com/aceeric/imgpull/pkg/imgpull/v2docker"
+)
+
+// bundleIndexFile is the name of the file in a bundle archive that has the
+// bundle index.
+const bundleIndexFile = "bundle.json"
+
+// bundleBlobDir is the directory in a bundle archive that has all the blobs
+// (including manifests) stored by digest.
+var bundleBlobDir = filepath.Join("blobs", "sha256")
+
+// BundleImage identifies an image to add to a bundle. Each platform is an
+// "os/arch" string like "linux/amd64". If the image is a multi-platform image
+// then the image manifest for each platform is added to the bundle.
+type BundleImage struct {
+	Url       string
+	Platforms []string
+}
+
+// BundleIndex is the index of a bundle archive. It is stored in the archive in
+// the 'bundle.json' file.
+type BundleIndex struct {
+	Created string             `json:"created"`
+	Images  []BundleIndexEntry `json:"images"`
+}
+
+// BundleIndexEntry describes one image in a bundle. The Digest and MediaType are
+// for the manifest that the upstream provided for the Url, which could be an image
+// list manifest. If it is an image list manifest, then it is in the bundle, and
+// AllPlatforms is true if every image manifest in the list is also in the bundle. The
+// Manifests are the image manifests in the bundle for the image.
+type BundleIndexEntry struct {
+	Url          string           `json:"url"`
+	Digest       string           `json:"digest"`
+	MediaType    string           `json:"mediaType"`
+	AllPlatforms bool             `json:"allPlatforms,omitempty"`
+	Manifests    []BundleManifest `json:"manifests"`
+}
+
+// BundleManifest describes an image manifest in a bundle. Platform is empty if the
+// upstream did not provide an image list manifest for the image.
+type BundleManifest struct {
+	Digest    string `json:"digest"`
+	MediaType string `json:"mediaType"`
+	Size      int    `json:"size"`
+	Platform  string `json:"platform,omitempty"`
+}
+
+// CreateBundle pulls all the passed images into a single tar archive specified by
+// the 'archive' arg. The archive has a 'bundle.json' index file, and a 'blobs/sha256'
+// directory holding every manifest and blob by digest, so blobs shared across images
+// are only stored once. The passed options are used to configure a Puller for each
+// image, with the Url of each image overriding the Url in the options. If an image has
+// no platforms then the OS and architecture in the options are used. The function
+// returns the bundle index.
+func CreateBundle(images []BundleImage, archive string, opts PullerOpts) (idx BundleIndex, err error) {
+	workDir, err := opts.newWorkDir()
+	if err != nil {
+		return BundleIndex{}, err
+	}
+	defer func() { err = removeWorkDir(workDir, err) }()
+	blobDir := filepath.Join(workDir, bundleBlobDir)
+	if err := os.MkdirAll(blobDir, 0755); err != nil {
+		return BundleIndex{}, err
+	}
+	idx = BundleIndex{
+		Created: time.Now().UTC().Format(time.RFC3339),
+	}
+	for _, image := range images {
+		entry, err := bundleImage(image, blobDir, opts)
+		if err != nil {
+			return BundleIndex{}, err
+		}
+		idx.Images = append(idx.Images, entry)
+	}
+	b, err := json.MarshalIndent(idx, "", "   ")
+	if err != nil {
+		return BundleIndex{}, err
+	}
+	if err := os.WriteFile(filepath.Join(workDir, bundleIndexFile), b, 0644); err != nil {
+		return BundleIndex{}, err
+	}
+	if err := tar.TarDir(workDir, archive); err != nil {
+		return BundleIndex{}, err
+	}
+	return idx, opts.finishFile(archive)
+}
+
+// bundleImage pulls the manifests and blobs for the passed image into the passed
+// blob directory, and returns a bundle index entry describing what was pulled.
+func bundleImage(image BundleImage, blobDir string, opts PullerOpts) (BundleIndexEntry, error) {
+	opts.Url = image.Url
+	p, err := NewPullerWith(opts)
+	if err != nil {
+		return BundleIndexEntry{}, err
+	}
+	defer p.Close()
+	mh, err := p.GetManifest()
+	if err != nil {
+		return BundleIndexEntry{}, err
+	}
+	entry := BundleIndexEntry{
+		Url:       p.GetUrl(),
+		Digest:    "sha256:" + mh.Digest,
+		MediaType: mh.MediaType(),
+	}
+	platforms := image.Platforms
+	if len(platforms) == 0 {
+		platforms = []string{opts.OStype + "/" + opts.ArchType}
+	}
+	type platformManifest struct {
+		platform string
+		mh       ManifestHolder
+	}
+	pms := []platformManifest{}
+	if mh.IsManifestList() {
+		for _, platform := range platforms {
+			os, arch, found := strings.Cut(platform, "/")
+			if !found {
+				return BundleIndexEntry{}, fmt.Errorf("invalid platform %q for %q: expected os/arch", platform, image.Url)
+			}
+			digest, err := mh.GetImageDigestFor(os, arch)
+			if err != nil {
+				return BundleIndexEntry{}, err
+			}
+			imh, err := p.GetManifestByDigest(digest)
+			if err != nil {
+				return BundleIndexEntry{}, err
+			}
+			pms = append(pms, platformManifest{platform, imh})
+		}
+		if err := os.WriteFile(filepath.Join(blobDir, mh.Digest), mh.Bytes, 0644); err != nil {
+			return BundleIndexEntry{}, err
+		}
+		entry.AllPlatforms = true
+		for _, digest := range mh.ImageManifestDigests() {
+			entry.AllPlatforms = entry.AllPlatforms && slices.ContainsFunc(pms, func(pm platformManifest) bool {
+				return "sha256:"+pm.mh.Digest == digest
+			})
+		}
+	} else {
+		pms = append(pms, platformManifest{"", mh})
+	}
+	for _, pm := range pms {
+		if err := os.WriteFile(filepath.Join(blobDir, pm.mh.Digest), pm.mh.Bytes, 0644); err != nil {
+			return BundleIndexEntry{}, err
+		}
+		if _, err := p.PullBlobs(pm.mh, blobDir); err != nil {
+			return BundleIndexEntry{}, err
+		}
+		entry.Manifests = append(entry.Manifests, BundleManifest{
+			Digest:    "sha256:" + pm.mh.Digest,
+			MediaType: pm.mh.MediaType(),
+			Size:      len(pm.mh.Bytes),
+			Platform:  pm.platform,
+		})
+	}
+	return entry, nil
+}
+
+// ReadBundleIndex extracts the passed bundle archive into the passed directory and
+// returns the bundle index from the archive.
+func ReadBundleIndex(archive string, dir string) (BundleIndex, error) {
+	if err := tar.UntarDir(archive, dir); err != nil {
+		return BundleIndex{}, err
+	}
+	b, err := os.ReadFile(filepath.Join(dir, bundleIndexFile))
+	if err != nil {
+		return BundleIndex{}, err
+	}
+	idx := BundleIndex{}
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return BundleIndex{}, fmt.Errorf("invalid bundle index in %q: %w", archive, err)
+	}
+	return idx, nil
+}
+
+// PushBundle pushes all the images in the passed bundle archive to the passed registry,
+// e.g. 'my.registry.io:5000'. Each image is pushed to the same repository and tag that
+// it was pulled from, but on the passed registry. E.g. 'quay.io/curl/curl:8.10.1' would be
+// pushed to 'my.registry.io:5000/curl/curl:8.10.1'. Each image manifest in the bundle is
+// pushed by digest. If every platform of an image list manifest is in the bundle then the
+// image list manifest is pushed unchanged, by digest and by tag, so the digest is the same
+// as the upstream. Otherwise, if the image was pulled by tag, then the tag is pushed with
+// the image manifest if the bundle has one platform for the image, or a new image list
+// manifest referencing all the image manifests if the bundle has more than one platform.
+// In that case the digest of the tag differs from the upstream, and an image pulled by the
+// digest of its image list manifest can only be pulled by the digests of its image
+// manifests. The passed options are used to configure a Pusher for each image. The
+// function returns the bundle index.
+func PushBundle(archive string, registry string, opts PullerOpts) (idx BundleIndex, err error) {
+	workDir, err := opts.newWorkDir()
+	if err != nil {
+		return BundleIndex{}, err
+	}
+	defer func() { err = removeWorkDir(workDir, err) }()
+	idx, err = ReadBundleIndex(archive, workDir)
+	if err != nil {
+		return BundleIndex{}, err
+	}
+	blobDir := filepath.Join(workDir, bundleBlobDir)
+	for _, entry := range idx.Images {
+		if err := pushBundleEntry(entry, blobDir, registry, opts); err != nil {
+			return BundleIndex{}, err
+		}
+	}
+	return idx, nil
+}
+
+// pushBundleEntry pushes the image described by the passed bundle index entry from
+// the passed blob directory to the passed registry.
+func pushBundleEntry(entry BundleIndexEntry, blobDir string, registry string, opts PullerOpts) error {
+	ir, err := imgref.NewImageRef(entry.Url, "", "")
+	if err != nil {
+		return err
+	}
+	tag := ""
+	if !ir.ByDigest() {
+		tag = ir.Ref()
+	}
+	opts.Url = fmt.Sprintf("%s/%s:%s", registry, ir.Repository(), tag)
+	if tag == "" {
+		opts.Url = fmt.Sprintf("%s/%s@%s", registry, ir.Repository(), ir.Ref())
+	}
+	p, err := NewPusherWith(opts)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	manifests := [][]byte{}
+	for _, m := range entry.Manifests {
+		b, err := os.ReadFile(filepath.Join(blobDir, util.DigestFrom(m.Digest)))
+		if err != nil {
+			return err
+		}
+		mh, err := NewManifestHolder(m.MediaType, b, util.DigestFrom(m.Digest), entry.Url)
+		if err != nil {
+			return err
+		}
+		for _, layer := range mh.Layers() {
+			if err := p.PushBlob(layer, filepath.Join(blobDir, util.DigestFrom(layer.Digest))); err != nil {
+				return err
+			}
+		}
+		if err := p.PushManifest(m.Digest, m.MediaType, b); err != nil {
+			return err
+		}
+		manifests = append(manifests, b)
+	}
+	if entry.AllPlatforms {
+		b, err := os.ReadFile(filepath.Join(blobDir, util.DigestFrom(entry.Digest)))
+		if err != nil {
+			return err
+		}
+		if err := p.PushManifest(entry.Digest, entry.MediaType, b); err != nil || tag == "" {
+			return err
+		}
+		return p.PushManifest(tag, entry.MediaType, b)
+	}
+	if tag == "" || len(entry.Manifests) == 0 {
+		return nil
+	} else if len(entry.Manifests) == 1 {
+		return p.PushManifest(tag, entry.Manifests[0].MediaType, manifests[0])
+	}
+	mediaType, b, err := newImageListFor(entry.Manifests)
+	if err != nil {
+		return err
+	}
+	return p.PushManifest(tag, mediaType, b)
+}
+
+// newImageListFor creates an image list manifest referencing the passed image manifests.
+// If all of the image manifests are docker manifests then a docker manifest list is created,
+// otherwise an OCI index. The function returns the media type and the serialized manifest.
+func newImageListFor(manifests []BundleManifest) (string, []byte, error) {
+	allDocker := true
+	for _, m := range manifests {
+		allDocker = allDocker && m.MediaType == string(types.V2dockerManifestMt)
+	}
+	if allDocker {
+		ml := v2docker.ManifestList{
+			SchemaVersion: 2,
+			MediaType:     string(types.V2dockerManifestListMt),
+		}
+		for _, m := range manifests {
+			os, arch, _ := strings.Cut(m.Platform, "/")
+			ml.Manifests = append(ml.Manifests, v2docker.Descriptor{
+				MediaType: m.MediaType,
+				Digest:    m.Digest,
+				Size:      int64(m.Size),
+				Platform:  &v2docker.Platform{OS: os, Architecture: arch},
+			})
+		}
+		b, err := json.Marshal(ml)
+		return ml.MediaType, b, err
+	}
+	idx := v1oci.Index{
+		SchemaVersion: 2,
+		MediaType:     string(types.V1ociIndexMt),
+	}
+	for _, m := range manifests {
+		os, arch, _ := strings.Cut(m.Platform, "/")
+		idx.Manifests = append(idx.Manifests, v1oci.Descriptor{
+			MediaType: m.MediaType,
+			Digest:    m.Digest,
+			Size:      int64(m.Size),
+			Platform:  &v1oci.Platform{Os: os, Architecture: arch},
+		})
+	}
+	b, err := json.Marshal(idx)
+	return idx.MediaType, b, err
+}
@@ -0,0 +1,150 @@
+package imgpull
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aceeric/imgpull/internal/testhelpers"
+	"github.com/aceeric/imgpull/mock"
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+	"github.com/aceeric/imgpull/pkg/imgpull/v1oci"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// TestBundle creates a bundle from the mock server and then pushes the
+// bundle to an in-memory registry.
+func TestBundle(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	pr, pushServer, pushUrl := testhelpers.NewPushRegistry()
+	defer pushServer.Close()
+
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+	archive := filepath.Join(d, "bundle.tar")
+	opts := PullerOpts{
+		Scheme:   "http",
+		OStype:   "linux",
+		ArchType: "amd64",
+	}
+	images := []BundleImage{{Url: fmt.Sprintf("%s/hello-world:latest", url)}}
+	idx, err := CreateBundle(images, archive, opts)
+	if err != nil {
+		t.FailNow()
+	}
+	if len(idx.Images) != 1 || len(idx.Images[0].Manifests) != 1 || idx.Images[0].Manifests[0].Platform != "linux/amd64" {
+		t.FailNow()
+	}
+	pushed, err := PushBundle(archive, pushUrl, opts)
+	if err != nil {
+		t.FailNow()
+	}
+	if len(pushed.Images) != 1 {
+		t.Fail()
+	}
+	if _, mt, found := pr.Manifest("hello-world", "latest"); !found || mt != string(types.V1ociManifestMt) {
+		t.Fail()
+	}
+	if _, _, found := pr.Manifest("hello-world", idx.Images[0].Manifests[0].Digest); !found {
+		t.Fail()
+	}
+	for _, digest := range []string{
+		"sha256:c1ec31eb59444d78df06a974d155e597c894ab4cda84f08294145e845394988e",
+		"sha256:d2c94e258dcb3c5ac2798d32e1249e42ef01cba4841c2234249495f87264ac5a",
+	} {
+		if _, found := pr.Blob("hello-world", digest); !found {
+			t.Fail()
+		}
+	}
+}
+
+// TestBundleImageList tests that an image list manifest with every platform in the
+// bundle is pushed unchanged, by tag and by digest.
+func TestBundleImageList(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	// seed a source registry with an image list that has only the one image the mock
+	// server has, and an annotation that a list created on push wouldn't have
+	src, srcServer, srcUrl := testhelpers.NewPushRegistry()
+	defer srcServer.Close()
+	d := t.TempDir()
+	opts := PullerOpts{Scheme: "http", OStype: "linux", ArchType: "amd64"}
+	archive := filepath.Join(d, "bundle.tar")
+	idx, err := CreateBundle([]BundleImage{{Url: fmt.Sprintf("%s/hello-world:latest", url)}}, archive, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PushBundle(archive, srcUrl, opts); err != nil {
+		t.Fatal(err)
+	}
+	m := idx.Images[0].Manifests[0]
+	list := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"manifests":[{"mediaType":%q,"digest":%q,"size":%d,"platform":{"os":"linux","architecture":"amd64","variant":"v8"}}],"annotations":{"frobozz":"true"}}`,
+		types.V1ociIndexMt, m.MediaType, m.Digest, m.Size))
+	listDigest := digest.FromBytes(list).String()
+	for _, ref := range []string{"multi", listDigest} {
+		src.Manifests["hello-world"][ref] = list
+		src.MediaTypes["hello-world"][ref] = string(types.V1ociIndexMt)
+	}
+
+	pr, pushServer, pushUrl := testhelpers.NewPushRegistry()
+	defer pushServer.Close()
+	for _, ref := range []string{":multi", "@" + listDigest} {
+		archive := filepath.Join(d, "list.tar")
+		idx, err := CreateBundle([]BundleImage{{Url: fmt.Sprintf("%s/hello-world%s", srcUrl, ref)}}, archive, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !idx.Images[0].AllPlatforms || idx.Images[0].Digest != listDigest {
+			t.Errorf("expected all platforms of %s, got %+v", listDigest, idx.Images[0])
+		}
+		if _, err := PushBundle(archive, pushUrl, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, ref := range []string{"multi", listDigest} {
+		if b, mt, found := pr.Manifest("hello-world", ref); !found || !bytes.Equal(b, list) || mt != string(types.V1ociIndexMt) {
+			t.Errorf("expected the image list to be pushed unchanged as %s", ref)
+		}
+	}
+}
+
+// TestBundleBadPlatform tests that a platform not in the image list is an error.
+func TestBundleBadPlatform(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+	opts := PullerOpts{Scheme: "http", OStype: "linux", ArchType: "amd64"}
+	images := []BundleImage{{Url: fmt.Sprintf("%s/hello-world:latest", url), Platforms: []string{"plan9/386"}}}
+	if _, err := CreateBundle(images, filepath.Join(d, "bundle.tar"), opts); err == nil {
+		t.Fail()
+	}
+}
+
+// TestNewImageListFor tests the image list manifest created when pushing more
+// than one platform for an image.
+func TestNewImageListFor(t *testing.T) {
+	manifests := []BundleManifest{
+		{Digest: "sha256:" + testhelpers.MakeDigest(), MediaType: string(types.V1ociManifestMt), Size: 10, Platform: "linux/amd64"},
+		{Digest: "sha256:" + testhelpers.MakeDigest(), MediaType: string(types.V1ociManifestMt), Size: 20, Platform: "linux/arm64"},
+	}
+	mt, b, err := newImageListFor(manifests)
+	if err != nil || mt != string(types.V1ociIndexMt) {
+		t.FailNow()
+	}
+	idx := v1oci.Index{}
+	if json.Unmarshal(b, &idx) != nil || len(idx.Manifests) != 2 || idx.Manifests[1].Platform.Architecture != "arm64" {
+		t.Fail()
+	}
+	for i := range manifests {
+		manifests[i].MediaType = string(types.V2dockerManifestMt)
+	}
+	if mt, _, err = newImageListFor(manifests); err != nil || mt != string(types.V2dockerManifestListMt) {
+		t.Fail()
+	}
+}
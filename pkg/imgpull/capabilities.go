@@ -0,0 +1,93 @@
+package imgpull
+
+import (
+	"strings"
+)
+
+// TagsPagination is how a registry paginates the tag list.
+type TagsPagination string
+
+const (
+	// TagsPaginationUnknown means the pagination style couldn't be determined, e.g.
+	// because the repository has fewer than two tags or the tag list request failed.
+	TagsPaginationUnknown TagsPagination = "unknown"
+	// TagsPaginationLink means the registry honors the 'n' query param and returns
+	// the url of the next page in a 'Link' header, like the distribution spec.
+	TagsPaginationLink TagsPagination = "link"
+	// TagsPaginationNone means the registry ignores the 'n' query param and returns
+	// all the tags in one response.
+	TagsPaginationNone TagsPagination = "none"
+)
+
+// apiVersionV2 is the 'Docker-Distribution-API-Version' header value of a v2 registry.
+const apiVersionV2 = "registry/2.0"
+
+// RegistryCapabilities has the optional features of the registry of a puller, as found
+// by 'Capabilities', so that higher-level features can choose code paths, e.g. listing
+// referrers with the referrers API or with the tag schema fallback.
+type RegistryCapabilities struct {
+	// APIVersion is the value of the 'Docker-Distribution-API-Version' header from
+	// the 'v2/' endpoint, like 'registry/2.0', or empty if the registry didn't send it.
+	APIVersion string `json:"apiVersion"`
+	// V2 is true if the API version is 'registry/2.0'. Registries that don't send the
+	// header (some OCI-only registries) also implement the v2 API, since the 'v2/'
+	// endpoint responded.
+	V2 bool `json:"v2"`
+	// Referrers is true if the registry implements the OCI referrers API.
+	Referrers bool `json:"referrers"`
+	// TagsPagination is how the registry paginates the tag list.
+	TagsPagination TagsPagination `json:"tagsPagination"`
+	// UploadProbed is true if the blob upload capabilities were probed, which is only
+	// done if the puller has push access, e.g. a Pusher. If false then 'ChunkedUpload'
+	// and 'ChunkMinLength' are unknown.
+	UploadProbed bool `json:"uploadProbed"`
+	// ChunkedUpload is true if the registry accepts chunked blob uploads.
+	ChunkedUpload bool `json:"chunkedUpload"`
+	// ChunkMinLength is the smallest upload chunk the registry accepts, or zero if the
+	// registry doesn't say.
+	ChunkMinLength int64 `json:"chunkMinLength,omitempty"`
+}
+
+func (p *puller) Capabilities() (RegistryCapabilities, error) {
+	if err := p.connect(); err != nil {
+		return RegistryCapabilities{}, err
+	}
+	p.mu.Lock()
+	caps := p.caps
+	p.mu.Unlock()
+	if caps != nil {
+		return *caps, nil
+	}
+	rc := p.regCliFrom()
+	version, err := rc.V2Version()
+	if err != nil {
+		return RegistryCapabilities{}, err
+	}
+	rcaps := RegistryCapabilities{
+		APIVersion:     version,
+		V2:             version == apiVersionV2 || version == "",
+		TagsPagination: TagsPaginationUnknown,
+	}
+	if rcaps.Referrers, err = rc.V2ReferrersSupported(); err != nil {
+		return RegistryCapabilities{}, err
+	}
+	// the repository needs at least two tags to tell whether 'n' is honored
+	if count, link, err := rc.V2TagsPage(1); err == nil {
+		if link {
+			rcaps.TagsPagination = TagsPaginationLink
+		} else if count > 1 {
+			rcaps.TagsPagination = TagsPaginationNone
+		}
+	}
+	if strings.Contains(p.Actions, "push") {
+		if uc, err := rc.V2BlobsUploadProbe(); err == nil {
+			rcaps.UploadProbed = true
+			rcaps.ChunkedUpload = uc.Chunked
+			rcaps.ChunkMinLength = uc.ChunkMinLength
+		}
+	}
+	p.mu.Lock()
+	p.caps = &rcaps
+	p.mu.Unlock()
+	return rcaps, nil
+}
@@ -0,0 +1,102 @@
+package imgpull
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aceeric/imgpull/internal/testhelpers"
+	"github.com/aceeric/imgpull/mock"
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+)
+
+// Tests probing a registry that paginates tags with a 'Link' header and doesn't
+// implement the referrers API, and that the result is cached.
+func TestCapabilities(t *testing.T) {
+	reg := mock.NewRegistry()
+	for _, tag := range []string{"v1", "v2"} {
+		reg.AddImage("frobozz", tag, []byte(`{"architecture":"amd64","os":"linux"}`), []byte(tag))
+	}
+	server, url := mock.ServerWith(mock.NewMockParams(mock.BEARER, mock.NOTLS, mock.CertSetup{}), reg)
+	defer server.Close()
+	p, err := NewPullerWith(PullerOpts{
+		Url:      fmt.Sprintf("%s/frobozz:v1", url),
+		OStype:   "linux",
+		ArchType: "amd64",
+		Scheme:   "http",
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	caps, err := p.Capabilities()
+	if err != nil {
+		t.Fatalf("capabilities: %s", err)
+	}
+	expected := RegistryCapabilities{APIVersion: "registry/2.0", V2: true, TagsPagination: TagsPaginationLink}
+	if caps != expected {
+		t.Errorf("expected %+v, got %+v", expected, caps)
+	}
+	server.Close()
+	if cached, err := p.Capabilities(); err != nil || cached != caps {
+		t.Errorf("expected the cached capabilities, got %+v %v", cached, err)
+	}
+}
+
+// Tests probing a registry that implements the referrers API, ignores the 'n' query
+// param of the tag list, and doesn't send the API version header.
+func TestCapabilitiesReferrers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case strings.Contains(r.URL.Path, "/referrers/"):
+			w.Header().Set("Content-Type", string(types.V1ociIndexMt))
+			w.Write([]byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`))
+		case strings.HasSuffix(r.URL.Path, "/tags/list"):
+			w.Write([]byte(`{"name":"frobozz","tags":["v1","v2","v3"]}`))
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer server.Close()
+	p, err := NewPullerWith(PullerOpts{
+		Url:      fmt.Sprintf("%s/frobozz:v1", strings.TrimPrefix(server.URL, "http://")),
+		OStype:   "linux",
+		ArchType: "amd64",
+		Scheme:   "http",
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	caps, err := p.Capabilities()
+	if err != nil {
+		t.Fatalf("capabilities: %s", err)
+	}
+	expected := RegistryCapabilities{V2: true, Referrers: true, TagsPagination: TagsPaginationNone}
+	if caps != expected {
+		t.Errorf("expected %+v, got %+v", expected, caps)
+	}
+}
+
+// Tests that a pusher probes for chunked uploads.
+func TestCapabilitiesChunkedUpload(t *testing.T) {
+	pr, server, url := testhelpers.NewPushRegistry()
+	defer server.Close()
+	pr.ChunkMinLength = 1024
+	p, err := NewPusherWith(PullerOpts{
+		Url:    fmt.Sprintf("%s/frobozz:v1", url),
+		Scheme: "http",
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	caps, err := p.Capabilities()
+	if err != nil {
+		t.Fatalf("capabilities: %s", err)
+	}
+	if !caps.UploadProbed || !caps.ChunkedUpload || caps.ChunkMinLength != 1024 || caps.TagsPagination != TagsPaginationUnknown {
+		t.Errorf("unexpected capabilities %+v", caps)
+	}
+}
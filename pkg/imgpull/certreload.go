@@ -0,0 +1,68 @@
+package imgpull
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader provides a client cert for mTLS from cert and key files, reloading
+// the cert whenever the modification time of either file changes.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	certMod  time.Time
+	keyMod   time.Time
+}
+
+// newCertReloader returns a certReloader for the passed cert and key files, or an
+// error if the files can't be loaded.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// getClientCertificate implements the 'tls.Config' function of the same name. If the
+// files have changed since they were last loaded then they are reloaded. If they can't
+// be reloaded then the previously loaded cert is returned.
+func (cr *certReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	certMod, keyMod := modTime(cr.certFile), modTime(cr.keyFile)
+	if !certMod.Equal(cr.certMod) || !keyMod.Equal(cr.keyMod) {
+		cr.reload()
+	}
+	return cr.cert, nil
+}
+
+// reload loads the cert and key files and records their modification times. The
+// caller must hold the lock except when initializing.
+func (cr *certReloader) reload() error {
+	certMod, keyMod := modTime(cr.certFile), modTime(cr.keyFile)
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.cert = &cert
+	cr.certMod = certMod
+	cr.keyMod = keyMod
+	return nil
+}
+
+// modTime returns the modification time of the passed file, or the zero time if the
+// file can't be stat'd.
+func modTime(file string) time.Time {
+	if fi, err := os.Stat(file); err == nil {
+		return fi.ModTime()
+	}
+	return time.Time{}
+}
@@ -0,0 +1,55 @@
+package imgpull
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aceeric/imgpull/mock"
+)
+
+func TestCertReloader(t *testing.T) {
+	cs1, err := mock.NewCertSetup()
+	if err != nil {
+		t.FailNow()
+	}
+	cs2, err := mock.NewCertSetup()
+	if err != nil {
+		t.FailNow()
+	}
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+	certFile := filepath.Join(d, "client.crt")
+	keyFile := filepath.Join(d, "client.key")
+	write := func(cs mock.CertSetup, mtime time.Time) {
+		os.WriteFile(certFile, cs.ClientCertPEM.Bytes(), 0600)
+		os.WriteFile(keyFile, cs.ClientCertPrivKeyPEM.Bytes(), 0600)
+		os.Chtimes(certFile, mtime, mtime)
+		os.Chtimes(keyFile, mtime, mtime)
+	}
+	now := time.Now()
+	write(cs1, now)
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.FailNow()
+	}
+	cert, _ := cr.getClientCertificate(nil)
+	if !bytes.Equal(cert.Certificate[0], cs1.ClientCert.Certificate[0]) {
+		t.FailNow()
+	}
+	// rotated
+	write(cs2, now.Add(time.Minute))
+	cert, _ = cr.getClientCertificate(nil)
+	if !bytes.Equal(cert.Certificate[0], cs2.ClientCert.Certificate[0]) {
+		t.FailNow()
+	}
+	// half-rotated: the previous cert continues to be used
+	os.WriteFile(certFile, cs1.ClientCertPEM.Bytes(), 0600)
+	os.Chtimes(certFile, now.Add(2*time.Minute), now.Add(2*time.Minute))
+	cert, _ = cr.getClientCertificate(nil)
+	if !bytes.Equal(cert.Certificate[0], cs2.ClientCert.Certificate[0]) {
+		t.FailNow()
+	}
+}
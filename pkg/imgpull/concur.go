@@ -2,6 +2,34 @@ package imgpull
 
 import "github.com/aceeric/imgpull/internal/blobsync"
 
+// BlobSyncer synchronizes concurrent blob pulls so that if multiple goroutines pull
+// the same blob concurrently, only one goroutine will actually pull and the others
+// will wait. This conserves network bandwidth. Blobs are pulled into a staging
+// directory owned by the syncer, and then linked (or copied) to the path each
+// goroutine requested, so pullers can pull the same blob to different directories.
+// A BlobSyncer is assigned to pullers with the 'BlobSyncer' field of PullerOpts, and
+// only pullers sharing a syncer are synchronized with each other. Call 'Close' when
+// the syncer is no longer needed to remove the staging directory.
+type BlobSyncer = blobsync.BlobSyncer
+
+// BlobGCPolicy specifies which staged blobs are removed by the 'GC' method of a
+// BlobSyncer: blobs not used for longer than 'MaxAge', and then the least recently
+// used blobs until the staged blobs total no more than 'MaxSize' bytes. A zero
+// value for either means no limit.
+type BlobGCPolicy = blobsync.GCPolicy
+
+// BlobGCResult has the number of blobs and bytes removed by the 'GC' method of a
+// BlobSyncer.
+type BlobGCResult = blobsync.GCResult
+
+// NewBlobSyncer returns a BlobSyncer. The 'timeoutSec' arg indicates how long a
+// waiting blob pull will wait for the goroutine actually pulling the blob before
+// timing out, and is intended to accommodate slow or degraded network connectivity
+// to the upstream.
+func NewBlobSyncer(timeoutSec int) *BlobSyncer {
+	return blobsync.NewBlobSyncer(timeoutSec)
+}
+
 // SetConcurrentBlobs exposes the ability to configure blob download concurrency
 // at the package level since this function is encapsulated within the 'blobsync'
 // internal package. The 'timeoutSec' arg indicates how long a blob pull will
@@ -10,7 +38,11 @@ import "github.com/aceeric/imgpull/internal/blobsync"
 //
 // If enabled, then if multiple goroutines pull the same blob concurrently, only
 // one goroutine will actually pull and the others will wait. This conserves
-// network bandwidth.
+// network bandwidth. The setting is process-wide and applies to every puller that
+// doesn't have its own 'BlobSyncer' in its options. Unlike a syncer from 'NewBlobSyncer',
+// the process-wide syncer doesn't stage blobs: the waiting goroutines link (or copy) the
+// blob from the destination of the goroutine that pulled it, so nothing is left behind
+// in a staging directory.
 func SetConcurrentBlobs(timeoutSec int) {
 	blobsync.SetConcurrentBlobs(timeoutSec)
 }
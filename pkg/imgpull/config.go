@@ -0,0 +1,278 @@
+package imgpull
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aceeric/imgpull/internal/imgref"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config has settings for registries that are applied to the puller options for images
+// in those registries, so the settings don't have to be provided for each pull. It is
+// loaded from a YAML file with 'LoadConfig'. For example:
+//
+//	registries:
+//	  my.registry.io:
+//	    credentials:
+//	      username: jqpubli
+//	      passwordFile: /run/secrets/registry-password
+//	    tls:
+//	      cacert: /etc/pki/my-ca.pem
+//	    timeout: 5m
+//	  ghcr.io:
+//	    credentials:
+//	      helper: pass
+//	  docker.io:
+//	    mirrors:
+//	    - localhost:5000
+//	  localhost:5000:
+//	    scheme: http
+//	  artifactory.corp.com:
+//	    basePath: /artifactory/api/docker/docker-local
+type Config struct {
+	// Registries has the settings for each registry by registry name like 'quay.io' or
+	// 'localhost:5000'. Docker Hub is 'docker.io'. 'LoadConfig' normalizes the names, so
+	// e.g. 'registry-1.docker.io' in the config file is 'docker.io'.
+	Registries map[string]RegistryConfig `yaml:"registries"`
+}
+
+// RegistryConfig has the settings for one registry in a 'Config'.
+type RegistryConfig struct {
+	// Scheme is 'http' or 'https'.
+	Scheme string `yaml:"scheme"`
+	// Credentials references the credentials for the registry.
+	Credentials CredentialsConfig `yaml:"credentials"`
+	// Mirrors are registries to try, in order, before the registry. An image is pulled
+	// from a mirror with the registry as the namespace. See 'Namespace' in PullerOpts.
+	Mirrors []string `yaml:"mirrors"`
+	// TLS has the TLS settings for the registry.
+	TLS TLSConfig `yaml:"tls"`
+	// Timeout is the time limit for each request to the registry, like '30s' or '5m'.
+	Timeout time.Duration `yaml:"timeout"`
+	// BasePath is the path that the registry serves the v2 API under. See 'BasePath'
+	// in PullerOpts.
+	BasePath string `yaml:"basePath"`
+	// RegistryOverride is the host or IP address that connections to the registry are
+	// made to. See 'RegistryOverride' in PullerOpts.
+	RegistryOverride string `yaml:"registryOverride"`
+	// Proxy is the url of the proxy that requests to the registry are made through. See
+	// 'Proxy' in PullerOpts.
+	Proxy string `yaml:"proxy"`
+	// SSHJump is the SSH jump host that connections to the registry are tunneled through.
+	// See 'SSHJump' in PullerOpts.
+	SSHJump string `yaml:"sshJump"`
+}
+
+// CredentialsConfig references the credentials for a registry. Passwords and tokens are
+// read from environment variables or files so that secrets are not kept in the config file,
+// or are delegated to a docker credential helper.
+type CredentialsConfig struct {
+	// Helper is the name of a docker credential helper like 'pass', 'secretservice', or
+	// 'osxkeychain' that has the username and password. The 'docker-credential-<helper>'
+	// program must be on the PATH. If set then the other credentials are ignored.
+	Helper string `yaml:"helper"`
+	// Username is the user name for basic auth.
+	Username string `yaml:"username"`
+	// PasswordEnv is the environment variable that has the password.
+	PasswordEnv string `yaml:"passwordEnv"`
+	// PasswordFile is the file that has the password.
+	PasswordFile string `yaml:"passwordFile"`
+	// TokenEnv is the environment variable that has an externally provided token.
+	TokenEnv string `yaml:"tokenEnv"`
+	// TokenFile is the file that has an externally provided token.
+	TokenFile string `yaml:"tokenFile"`
+}
+
+// TLSConfig has the TLS settings for a registry. They are the same as the TLS settings in
+// PullerOpts.
+type TLSConfig struct {
+	Cert      string `yaml:"cert"`
+	Key       string `yaml:"key"`
+	CaCert    string `yaml:"cacert"`
+	CaDir     string `yaml:"cacertDir"`
+	SystemCAs bool   `yaml:"systemCAs"`
+	Insecure  bool   `yaml:"insecure"`
+}
+
+// DefaultConfigPath returns the path of the default config file, which is
+// '.imgpull/config.yaml' in the home directory of the current user.
+func DefaultConfigPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".imgpull", "config.yaml"), nil
+}
+
+// LoadConfig loads the config file at the passed path. If the path is empty then the
+// default config file is loaded if it exists, and if it doesn't exist then an empty
+// config is returned.
+func LoadConfig(path string) (Config, error) {
+	optional := path == ""
+	if optional {
+		var err error
+		if path, err = DefaultConfigPath(); err != nil {
+			return Config{}, nil
+		}
+	}
+	b, err := os.ReadFile(path)
+	if optional && errors.Is(err, fs.ErrNotExist) {
+		return Config{}, nil
+	} else if err != nil {
+		return Config{}, err
+	}
+	cfg := Config{}
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return Config{}, fmt.Errorf("invalid config file %q: %w", path, err)
+	}
+	registries := make(map[string]RegistryConfig, len(cfg.Registries))
+	for registry, rc := range cfg.Registries {
+		name, err := normalizeRegistry(registry)
+		if err != nil {
+			return Config{}, fmt.Errorf("%w in config file %q", err, path)
+		}
+		if _, found := registries[name]; found {
+			return Config{}, fmt.Errorf("registry %q is in config file %q more than once", name, path)
+		}
+		if rc.Scheme != "" && rc.Scheme != "http" && rc.Scheme != "https" {
+			return Config{}, fmt.Errorf("invalid scheme %q for registry %q in config file %q", rc.Scheme, registry, path)
+		}
+		registries[name] = rc
+	}
+	if cfg.Registries != nil {
+		cfg.Registries = registries
+	}
+	return cfg, nil
+}
+
+// normalizeRegistry validates the passed registry from a config file or a login, which must
+// be a host with an optional port like 'my.registry.io:5000' rather than a url, and returns
+// it normalized the same way as the registry of an image url so that they match. E.g. the
+// DockerHub API hosts are normalized to 'docker.io'.
+func normalizeRegistry(registry string) (string, error) {
+	if strings.Contains(registry, "/") {
+		return "", fmt.Errorf("invalid registry %q: expected a host with an optional port, without a scheme or a path", registry)
+	}
+	ir, err := imgref.NewImageRef(registry+"/x", "", "")
+	if err != nil {
+		return "", fmt.Errorf("invalid registry %q: expected a host with an optional port", registry)
+	}
+	return ir.Registry(), nil
+}
+
+// Apply returns a copy of the passed options with the settings in the receiver for the
+// registry of the image url in the options. Only options that are not set are changed,
+// so options that are set take precedence over the config. The credentials are only
+// applied if the options have no credentials.
+func (c Config) Apply(o PullerOpts) (PullerOpts, error) {
+	r, err := ParseRef(o.Url)
+	if err != nil {
+		return o, err
+	}
+	return c.applyFor(r.Registry, o)
+}
+
+// applyFor is like 'Apply' but applies the settings for the passed registry.
+func (c Config) applyFor(registry string, o PullerOpts) (PullerOpts, error) {
+	rc, found := c.Registries[registry]
+	if !found {
+		return o, nil
+	}
+	var err error
+	setIfEmpty := func(opt *string, val string) {
+		if *opt == "" {
+			*opt = val
+		}
+	}
+	setIfEmpty(&o.Scheme, rc.Scheme)
+	setIfEmpty(&o.BasePath, rc.BasePath)
+	setIfEmpty(&o.RegistryOverride, rc.RegistryOverride)
+	setIfEmpty(&o.Proxy, rc.Proxy)
+	if o.DialContext == nil {
+		setIfEmpty(&o.SSHJump, rc.SSHJump)
+	}
+	setIfEmpty(&o.TlsCert, rc.TLS.Cert)
+	setIfEmpty(&o.TlsKey, rc.TLS.Key)
+	setIfEmpty(&o.CaCert, rc.TLS.CaCert)
+	setIfEmpty(&o.CaDir, rc.TLS.CaDir)
+	o.AppendSystemCAs = o.AppendSystemCAs || rc.TLS.SystemCAs
+	o.Insecure = o.Insecure || rc.TLS.Insecure
+	if o.Timeout == 0 {
+		o.Timeout = rc.Timeout
+	}
+	if o.Username != "" || o.Password != "" || o.Token != "" || o.BearerToken != "" || o.AuthHeader != "" {
+		return o, nil
+	}
+	if rc.Credentials.Helper != "" {
+		o.Username, o.Password, err = credHelperGet(rc.Credentials.Helper, registry)
+		return o, err
+	}
+	o.Username = rc.Credentials.Username
+	if o.Password, err = secretFrom(rc.Credentials.PasswordEnv, rc.Credentials.PasswordFile); err != nil {
+		return o, err
+	}
+	if o.Token, err = secretFrom(rc.Credentials.TokenEnv, rc.Credentials.TokenFile); err != nil {
+		return o, err
+	}
+	return o, nil
+}
+
+// Mirrors returns the options to pull the image url in the passed options from each
+// mirror of its registry in the receiver, in order. Each has the image url changed to the
+// mirror, the namespace set to the registry, the credentials and client cert of the
+// registry removed, and the settings for the mirror applied. If the image url has a tag
+// then it is the repo tag for image tarballs, unless the options have repo tags. If the
+// registry has no mirrors then an empty slice is returned.
+func (c Config) Mirrors(o PullerOpts) ([]PullerOpts, error) {
+	r, err := ParseRef(o.Url)
+	if err != nil {
+		return nil, err
+	}
+	mirrors := []PullerOpts{}
+	for _, mirror := range c.Registries[r.Registry].Mirrors {
+		mr := r
+		mr.Registry = mirror
+		mr.Namespace = ""
+		mo := o
+		mo.Url = mr.String()
+		mo.Namespace = r.Registry
+		// the base path and override of the registry don't apply to the mirror
+		mo.BasePath, mo.RegistryOverride = "", ""
+		mo.Session = nil
+		// the credentials and client cert for the registry are not sent to the mirror,
+		// which gets its own from the config
+		mo.Username, mo.Password, mo.Token, mo.BearerToken, mo.AuthHeader = "", "", "", "", ""
+		mo.TlsCert, mo.TlsKey, mo.TlsCertPEM, mo.TlsKeyPEM = "", "", nil, nil
+		if r.Tag != "" && len(mo.RepoTags) == 0 && !mo.NoRepoTags {
+			mo.RepoTags = []string{o.Url}
+		}
+		if mo, err = c.Apply(mo); err != nil {
+			return nil, err
+		}
+		mirrors = append(mirrors, mo)
+	}
+	return mirrors, nil
+}
+
+// secretFrom returns the value of the passed environment variable if it is not empty,
+// else the content of the passed file, with surrounding whitespace removed. If both are
+// empty then the empty string is returned.
+func secretFrom(env, file string) (string, error) {
+	if env != "" {
+		return os.Getenv(env), nil
+	} else if file == "" {
+		return "", nil
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
@@ -0,0 +1,147 @@
+package imgpull
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aceeric/imgpull/mock"
+)
+
+func TestLoadConfig(t *testing.T) {
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+	os.WriteFile(filepath.Join(d, "password"), []byte("frobozz\n"), 0600)
+	cfgFile := filepath.Join(d, "config.yaml")
+	os.WriteFile(cfgFile, []byte(fmt.Sprintf(`
+registries:
+  my.registry.io:
+    credentials:
+      username: jqpubli
+      passwordFile: %s
+    tls:
+      cacert: /etc/pki/my-ca.pem
+      insecure: true
+    timeout: 30s
+  docker.io:
+    mirrors:
+    - localhost:5000
+  localhost:5000:
+    scheme: http
+`, filepath.Join(d, "password"))), 0644)
+	cfg, err := LoadConfig(cfgFile)
+	if err != nil {
+		t.Fatalf("load config: %s", err)
+	}
+	o, err := cfg.Apply(PullerOpts{Url: "my.registry.io/foo:v1", Scheme: "https"})
+	if err != nil || o.Scheme != "https" || o.Username != "jqpubli" || o.Password != "frobozz" ||
+		o.CaCert != "/etc/pki/my-ca.pem" || !o.Insecure || o.Timeout != 30*time.Second {
+		t.Errorf("unexpected options %+v %v", o, err)
+	}
+	// options that are set take precedence
+	o, err = cfg.Apply(PullerOpts{Url: "my.registry.io/foo:v1", Token: "token", CaCert: "ca.pem"})
+	if err != nil || o.Username != "" || o.Password != "" || o.CaCert != "ca.pem" {
+		t.Errorf("unexpected options %+v %v", o, err)
+	}
+	mirrors, err := cfg.Mirrors(PullerOpts{Url: "docker.io/hello-world:latest"})
+	if err != nil || len(mirrors) != 1 {
+		t.Fatalf("unexpected mirrors %+v %v", mirrors, err)
+	}
+	if m := mirrors[0]; m.Url != "localhost:5000/library/hello-world:latest" || m.Namespace != "docker.io" ||
+		m.Scheme != "http" || len(m.RepoTags) != 1 || m.RepoTags[0] != "docker.io/hello-world:latest" {
+		t.Errorf("unexpected mirror %+v", m)
+	}
+	// the default config is optional but an explicit config isn't
+	if _, err := LoadConfig(filepath.Join(d, "frobozz.yaml")); err == nil {
+		t.Error("expected an error for a missing config file")
+	}
+	os.WriteFile(cfgFile, []byte("registries:\n  foo:\n    scheme: ftp\n"), 0644)
+	if _, err := LoadConfig(cfgFile); err == nil {
+		t.Error("expected an error for an invalid scheme")
+	}
+}
+
+// Tests that a puller applies the config for its registry.
+func TestPullerConfig(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	cfg := Config{Registries: map[string]RegistryConfig{url: {Scheme: "http"}}}
+	p, err := NewPullerWith(PullerOpts{
+		Url:      fmt.Sprintf("%s/hello-world:latest", url),
+		OStype:   "linux",
+		ArchType: "amd64",
+		Config:   &cfg,
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	if _, err := p.HeadManifest(); err != nil || p.GetOpts().Scheme != "http" {
+		t.Errorf("expected the scheme from the config, got %q %v", p.GetOpts().Scheme, err)
+	}
+	cfg = Config{}
+	if p, err = NewPullerWith(PullerOpts{Url: "quay.io/foo:v1", OStype: "linux", ArchType: "amd64", Config: &cfg}); err != nil || p.GetOpts().Scheme != "https" {
+		t.Errorf("expected https by default, got %v", err)
+	}
+}
+
+// Tests that a mirror gets its own credentials from the config, and never the credentials
+// or client cert passed for the registry it mirrors.
+func TestMirrorCredentials(t *testing.T) {
+	auths := []string{}
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hdr := r.Header.Get("Authorization"); hdr != "" {
+			auths = append(auths, hdr)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Www-Authenticate", `Basic realm="mirror"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer mirror.Close()
+	mirrorHost := strings.TrimPrefix(mirror.URL, "http://")
+	t.Setenv("MIRROR_PASSWORD", "mirrorpass")
+	cfg := Config{Registries: map[string]RegistryConfig{
+		"my.registry.io": {Mirrors: []string{mirrorHost}},
+		mirrorHost: {
+			Scheme:      "http",
+			Credentials: CredentialsConfig{Username: "mirroruser", PasswordEnv: "MIRROR_PASSWORD"},
+		},
+	}}
+	mirrors, err := cfg.Mirrors(PullerOpts{
+		Url:         "my.registry.io/hello-world:latest",
+		OStype:      "linux",
+		ArchType:    "amd64",
+		Username:    "srcuser",
+		Password:    "srcpass",
+		BearerToken: "srctoken",
+		TlsCert:     "/etc/pki/src-cert.pem",
+		TlsKey:      "/etc/pki/src-key.pem",
+	})
+	if err != nil || len(mirrors) != 1 {
+		t.Fatalf("unexpected mirrors %+v %v", mirrors, err)
+	}
+	m := mirrors[0]
+	if m.Username != "mirroruser" || m.Password != "mirrorpass" || m.BearerToken != "" || m.TlsCert != "" || m.TlsKey != "" {
+		t.Errorf("unexpected mirror options %+v", m)
+	}
+	p, err := NewPullerWith(m)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	p.HeadManifest()
+	mirrorAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte("mirroruser:mirrorpass"))
+	if len(auths) == 0 {
+		t.Error("expected the mirror to get credentials")
+	}
+	for _, auth := range auths {
+		if auth != mirrorAuth {
+			t.Errorf("unexpected credentials sent to the mirror %q", auth)
+		}
+	}
+}
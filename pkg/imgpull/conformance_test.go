@@ -0,0 +1,264 @@
+//go:build conformance
+
+// The conformance tests run the puller against a real registry to catch behavioral
+// differences that the mock server cannot, like chunked responses and redirects. They
+// only build with the 'conformance' tag. Run a registry, then run the tests, e.g.:
+//
+//	docker run -d -p 5000:5000 registry:2     # or: ghcr.io/project-zot/zot-linux-amd64
+//	IMGPULL_CONFORMANCE_REGISTRY=localhost:5000 go test -tags conformance -run Conformance ./pkg/imgpull
+//
+// The registry defaults to localhost:5000 over http. Set IMGPULL_CONFORMANCE_SCHEME to
+// https to use TLS. Each run pushes its own images into a new repository so the tests
+// don't depend on the registry content.
+package imgpull
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+	"github.com/aceeric/imgpull/pkg/imgpull/v1oci"
+	"github.com/opencontainers/go-digest"
+)
+
+// conformanceImage describes an image pushed to the registry for the conformance tests.
+type conformanceImage struct {
+	repository     string
+	manifestDigest string
+	indexDigest    string
+	layerDigests   []string
+}
+
+// conformanceOpts returns puller options for the passed image in the registry under test.
+func conformanceOpts(image string) PullerOpts {
+	registry := os.Getenv("IMGPULL_CONFORMANCE_REGISTRY")
+	if registry == "" {
+		registry = "localhost:5000"
+	}
+	scheme := os.Getenv("IMGPULL_CONFORMANCE_SCHEME")
+	if scheme == "" {
+		scheme = "http"
+	}
+	opts := NewPullerOpts(fmt.Sprintf("%s/%s", registry, image))
+	opts.Scheme, opts.OStype, opts.ArchType = scheme, "linux", "amd64"
+	return opts
+}
+
+// layerOf returns a gzipped tarball with one file of the passed size of random content,
+// and the digest of the uncompressed tarball.
+func layerOf(t *testing.T, size int) ([]byte, string) {
+	content := make([]byte, size)
+	rand.Read(content)
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	tw.WriteHeader(&tar.Header{Name: "file", Mode: 0644, Size: int64(size), Typeflag: tar.TypeReg})
+	tw.Write(content)
+	if tw.Close() != nil {
+		t.FailNow()
+	}
+	var gzBuf bytes.Buffer
+	gw := gzip.NewWriter(&gzBuf)
+	gw.Write(tarBuf.Bytes())
+	if gw.Close() != nil {
+		t.FailNow()
+	}
+	return gzBuf.Bytes(), digest.FromBytes(tarBuf.Bytes()).String()
+}
+
+// pushConformanceImage pushes an image with a small layer and a layer large enough to be
+// streamed in chunks, tagged 'v1', and an index referencing the image tagged 'multi'.
+func pushConformanceImage(t *testing.T) conformanceImage {
+	ci := conformanceImage{
+		repository: fmt.Sprintf("imgpull-conformance/%d", time.Now().UnixNano()),
+	}
+	p, err := NewPusherWith(conformanceOpts(ci.repository + ":v1"))
+	if err != nil {
+		t.FailNow()
+	}
+	defer p.Close()
+	d := t.TempDir()
+	push := func(b []byte, mediaType types.MediaType) v1oci.Descriptor {
+		desc := v1oci.Descriptor{
+			MediaType: string(mediaType),
+			Digest:    digest.FromBytes(b).String(),
+			Size:      int64(len(b)),
+		}
+		f := filepath.Join(d, digest.FromBytes(b).Encoded())
+		if os.WriteFile(f, b, 0644) != nil {
+			t.FailNow()
+		}
+		if err := p.PushBlob(types.Layer{MediaType: mediaType, Digest: desc.Digest, Size: len(b)}, f); err != nil {
+			t.Fatalf("push blob: %s", err)
+		}
+		return desc
+	}
+	small, smallDiffId := layerOf(t, 1024)
+	large, largeDiffId := layerOf(t, 8*1024*1024)
+	config, _ := json.Marshal(map[string]any{
+		"architecture": "amd64",
+		"os":           "linux",
+		"rootfs":       map[string]any{"type": "layers", "diff_ids": []string{smallDiffId, largeDiffId}},
+	})
+	m := v1oci.Manifest{
+		SchemaVersion: 2,
+		MediaType:     string(types.V1ociManifestMt),
+		Config:        push(config, "application/vnd.oci.image.config.v1+json"),
+		Layers:        []v1oci.Descriptor{push(small, types.V1ociLayerGzipMt), push(large, types.V1ociLayerGzipMt)},
+	}
+	for _, layer := range m.Layers {
+		ci.layerDigests = append(ci.layerDigests, layer.Digest)
+	}
+	mb, _ := json.Marshal(m)
+	ci.manifestDigest = digest.FromBytes(mb).String()
+	if err := p.PushManifest("v1", m.MediaType, mb); err != nil {
+		t.Fatalf("push manifest: %s", err)
+	}
+	idx := v1oci.Index{
+		SchemaVersion: 2,
+		MediaType:     string(types.V1ociIndexMt),
+		Manifests: []v1oci.Descriptor{{
+			MediaType: m.MediaType,
+			Digest:    ci.manifestDigest,
+			Size:      int64(len(mb)),
+			Platform:  &v1oci.Platform{Os: "linux", Architecture: "amd64"},
+		}},
+	}
+	ib, _ := json.Marshal(idx)
+	ci.indexDigest = digest.FromBytes(ib).String()
+	if err := p.PushManifest("multi", idx.MediaType, ib); err != nil {
+		t.Fatalf("push index: %s", err)
+	}
+	return ci
+}
+
+// Tests tag and digest resolution, by GET and by HEAD, for an image and an index.
+func TestConformanceDigestResolution(t *testing.T) {
+	ci := pushConformanceImage(t)
+	for _, tc := range []struct {
+		ref       string
+		mpt       ManifestPullType
+		digest    string
+		mediaType types.MediaType
+	}{
+		{":v1", Image, ci.manifestDigest, types.V1ociManifestMt},
+		{"@" + ci.manifestDigest, Image, ci.manifestDigest, types.V1ociManifestMt},
+		{":multi", ImageList, ci.indexDigest, types.V1ociIndexMt},
+		{":multi", Image, ci.manifestDigest, types.V1ociManifestMt},
+	} {
+		p, err := NewPullerWith(conformanceOpts(ci.repository + tc.ref))
+		if err != nil {
+			t.FailNow()
+		}
+		mh, err := p.GetManifestByType(tc.mpt)
+		if err != nil {
+			t.Fatalf("get manifest %s: %s", tc.ref, err)
+		}
+		if "sha256:"+mh.Digest != tc.digest || mh.MediaType() != string(tc.mediaType) {
+			t.Errorf("get manifest %s: got %s %s", tc.ref, mh.Digest, mh.MediaType())
+		}
+		if mh.Validate() != nil {
+			t.Errorf("validate manifest %s: %s", tc.ref, mh.Validate())
+		}
+		if tc.mpt == Image && tc.ref != ":multi" {
+			md, err := p.HeadManifest()
+			if err != nil || md.Digest != tc.digest || md.MediaType != tc.mediaType {
+				t.Errorf("head manifest %s: got %+v %v", tc.ref, md, err)
+			}
+		}
+		p.Close()
+	}
+	p, err := NewPullerWith(conformanceOpts(ci.repository + ":nosuchtag"))
+	if err != nil {
+		t.FailNow()
+	}
+	defer p.Close()
+	if _, err := p.GetManifest(); err == nil {
+		t.Error("expected an error for a tag that doesn't exist")
+	}
+}
+
+// Tests pulling blobs, including a large blob that the registry streams in chunks, with
+// diff_id verification, and pulling a tarball.
+func TestConformancePull(t *testing.T) {
+	ci := pushConformanceImage(t)
+	opts := conformanceOpts(ci.repository + ":v1")
+	opts.VerifyDiffIDs = true
+	p, err := NewPullerWith(opts)
+	if err != nil {
+		t.FailNow()
+	}
+	defer p.Close()
+	mh, err := p.GetManifestByType(Image)
+	if err != nil {
+		t.FailNow()
+	}
+	d := t.TempDir()
+	if _, err := p.PullBlobs(mh, d); err != nil {
+		t.Fatalf("pull blobs: %s", err)
+	}
+	for _, layerDigest := range ci.layerDigests {
+		b, err := os.ReadFile(filepath.Join(d, digest.Digest(layerDigest).Encoded()))
+		if err != nil || digest.FromBytes(b).String() != layerDigest {
+			t.Errorf("blob %s missing or corrupt", layerDigest)
+		}
+	}
+	if _, err := p.PullTar(filepath.Join(d, "image.tar")); err != nil {
+		t.Errorf("pull tar: %s", err)
+	}
+}
+
+// Tests that a referrer pushed with a subject round-trips through the registry.
+func TestConformanceReferrer(t *testing.T) {
+	ci := pushConformanceImage(t)
+	p, err := NewPusherWith(conformanceOpts(ci.repository + ":v1"))
+	if err != nil {
+		t.FailNow()
+	}
+	defer p.Close()
+	d := t.TempDir()
+	empty := []byte("{}")
+	f := filepath.Join(d, "empty")
+	os.WriteFile(f, empty, 0644)
+	emptyDigest := digest.FromBytes(empty).String()
+	if err := p.PushBlob(types.Layer{MediaType: types.V1ociEmptyMt, Digest: emptyDigest, Size: len(empty)}, f); err != nil {
+		t.Fatalf("push blob: %s", err)
+	}
+	subject := ci.manifestDigest
+	p2, err := NewPullerWith(conformanceOpts(ci.repository + "@" + subject))
+	if err != nil {
+		t.FailNow()
+	}
+	defer p2.Close()
+	smh, err := p2.GetManifest()
+	if err != nil {
+		t.FailNow()
+	}
+	m := v1oci.Manifest{
+		SchemaVersion: 2,
+		MediaType:     string(types.V1ociManifestMt),
+		ArtifactType:  "application/vnd.example.sbom",
+		Config:        v1oci.Descriptor{MediaType: string(types.V1ociEmptyMt), Digest: emptyDigest, Size: int64(len(empty))},
+		Layers:        []v1oci.Descriptor{{MediaType: string(types.V1ociEmptyMt), Digest: emptyDigest, Size: int64(len(empty))}},
+		Subject:       &v1oci.Descriptor{MediaType: smh.MediaType(), Digest: subject, Size: int64(len(smh.Bytes))},
+	}
+	mb, _ := json.Marshal(m)
+	referrer := digest.FromBytes(mb).String()
+	if err := p.PushManifest(referrer, m.MediaType, mb); err != nil {
+		t.Fatalf("push referrer: %s", err)
+	}
+	rmh, err := p2.GetManifestByDigest(referrer)
+	if err != nil {
+		t.Fatalf("get referrer: %s", err)
+	}
+	if !rmh.IsReferrer() || rmh.Subject().Digest != subject || rmh.ArtifactType() != m.ArtifactType {
+		t.Errorf("referrer did not round-trip: %s", string(rmh.Bytes))
+	}
+}
@@ -0,0 +1,138 @@
+package imgpull
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/aceeric/imgpull/internal/util"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ContentStore is the subset of a containerd content store and image service that
+// 'PullToContentStore' needs. The package doesn't depend on containerd, so a caller
+// implements the interface with the containerd client, e.g. 'Exists' with the 'Info'
+// function of the content store, 'Write' with 'content.WriteBlob' and 'content.WithLabels',
+// and 'SetImage' with the 'Create' and 'Update' functions of the image service.
+type ContentStore interface {
+	// Exists returns true if the store has the content with the passed digest.
+	Exists(ctx context.Context, dgst digest.Digest) (bool, error)
+	// Write writes the content described by 'desc' from 'r' into the store, with the
+	// passed labels.
+	Write(ctx context.Context, desc ocispec.Descriptor, r io.Reader, labels map[string]string) error
+	// SetImage creates the image with the passed name, or updates it if it exists, to
+	// reference the 'target' manifest.
+	SetImage(ctx context.Context, name string, target ocispec.Descriptor) error
+}
+
+// containerd garbage collection labels. Content that isn't referenced by an image, or by
+// these labels on content that is, is removed by the containerd garbage collector.
+const (
+	gcRefConfig   = "containerd.io/gc.ref.content.config"
+	gcRefLayer    = "containerd.io/gc.ref.content.l.%d"
+	gcRefManifest = "containerd.io/gc.ref.content.m.%d"
+)
+
+func (p *puller) PullToContentStore(ctx context.Context, store ContentStore) (desc ocispec.Descriptor, err error) {
+	r, err := ParseRef(p.GetUrl())
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	finished := p.pullStarted()
+	defer func() { finished(err) }()
+	mh, err := p.GetManifest()
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	var list *ManifestHolder
+	if mh.IsManifestList() {
+		lmh := mh
+		list = &lmh
+		digest, err := mh.GetImageDigestForPlatform(p.Opts.platform())
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		imh, err := p.GetManifestByDigest(digest)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		mh = imh
+	}
+	p.manifestResolved(mh)
+	if err := p.prePull(mh, list); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if !mh.hasConfig() {
+		return ocispec.Descriptor{}, fmt.Errorf("manifest type %s for %q can't be written to a content store", manifestTypeToString[mh.Type], mh.ImageUrl)
+	}
+	tmpDir, err := p.Opts.newWorkDir()
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer func() { err = removeWorkDir(tmpDir, err) }()
+	if err := p.connect(); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	rc := p.regCliFrom()
+	rc.Ctx = ctx
+	labels := map[string]string{}
+	layers := mh.Layers()
+	for i, layer := range layers {
+		// the config is the last layer
+		if i == len(layers)-1 {
+			labels[gcRefConfig] = layer.Digest
+		} else {
+			labels[fmt.Sprintf(gcRefLayer, i)] = layer.Digest
+		}
+		ld := LayerDescriptor(layer)
+		if exists, err := store.Exists(ctx, ld.Digest); err != nil {
+			return ocispec.Descriptor{}, err
+		} else if exists {
+			continue
+		}
+		blobFile := filepath.Join(tmpDir, util.DigestFrom(layer.Digest))
+		if _, err := p.pullBlob(rc, layer, blobFile); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		if err := writeFileToStore(ctx, store, ld, blobFile); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		// only one blob at a time is kept on the file system
+		if err := os.Remove(blobFile); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+	desc = mh.OCIDescriptor()
+	if err := store.Write(ctx, desc, bytes.NewReader(mh.Bytes), labels); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if list != nil {
+		labels = map[string]string{}
+		for i, digest := range list.ImageManifestDigests() {
+			labels[fmt.Sprintf(gcRefManifest, i)] = digest
+		}
+		desc = list.OCIDescriptor()
+		if err := store.Write(ctx, desc, bytes.NewReader(list.Bytes), labels); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+	if err := store.SetImage(ctx, r.String(), desc); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// writeFileToStore writes the content of the passed file to the store.
+func writeFileToStore(ctx context.Context, store ContentStore, desc ocispec.Descriptor, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return store.Write(ctx, desc, f, nil)
+}
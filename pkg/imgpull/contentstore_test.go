@@ -0,0 +1,103 @@
+package imgpull
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aceeric/imgpull/mock"
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// memStore is an in-memory ContentStore.
+type memStore struct {
+	content map[digest.Digest][]byte
+	labels  map[digest.Digest]map[string]string
+	images  map[string]ocispec.Descriptor
+	writes  int
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		content: map[digest.Digest][]byte{},
+		labels:  map[digest.Digest]map[string]string{},
+		images:  map[string]ocispec.Descriptor{},
+	}
+}
+
+func (s *memStore) Exists(ctx context.Context, dgst digest.Digest) (bool, error) {
+	_, ok := s.content[dgst]
+	return ok, nil
+}
+
+func (s *memStore) Write(ctx context.Context, desc ocispec.Descriptor, r io.Reader, labels map[string]string) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if digest.FromBytes(b) != desc.Digest || int64(len(b)) != desc.Size {
+		return fmt.Errorf("content does not match descriptor %+v", desc)
+	}
+	s.content[desc.Digest] = b
+	s.labels[desc.Digest] = labels
+	s.writes++
+	return nil
+}
+
+func (s *memStore) SetImage(ctx context.Context, name string, target ocispec.Descriptor) error {
+	s.images[name] = target
+	return nil
+}
+
+// Tests pulling an image list and the image for the platform into a content store,
+// and that a second pull doesn't write the blobs again.
+func TestPullToContentStore(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.BEARER, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	p, err := NewPullerWith(PullerOpts{
+		Url:      fmt.Sprintf("%s/hello-world:latest", url),
+		OStype:   "linux",
+		ArchType: "amd64",
+		Scheme:   "http",
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	store := newMemStore()
+	desc, err := p.PullToContentStore(context.Background(), store)
+	if err != nil {
+		t.Fatalf("pull to content store: %s", err)
+	}
+	if desc.MediaType != string(types.V1ociIndexMt) || store.images[url+"/hello-world:latest"].Digest != desc.Digest {
+		t.Errorf("unexpected image %+v: %+v", desc, store.images)
+	}
+	// index, image manifest, config, and layer
+	if len(store.content) != 4 || store.writes != 4 {
+		t.Errorf("expected 4 items in the store, got %d", len(store.content))
+	}
+	manifest := digest.Digest("sha256:e2fc4e5012d16e7fe466f5291c476431beaa1f9b90a5c2125b493ed28e2aba57")
+	if store.labels[desc.Digest]["containerd.io/gc.ref.content.m.0"] == "" {
+		t.Errorf("missing index labels %+v", store.labels[desc.Digest])
+	}
+	labels := store.labels[manifest]
+	if labels["containerd.io/gc.ref.content.config"] == "" || labels["containerd.io/gc.ref.content.l.0"] == "" {
+		t.Errorf("missing manifest labels %+v", labels)
+	}
+	for key, value := range labels {
+		if _, ok := store.content[digest.Digest(value)]; !ok && strings.HasPrefix(key, "containerd.io/gc.ref.content.") {
+			t.Errorf("label %s references content not in the store", key)
+		}
+	}
+	if _, err := p.PullToContentStore(context.Background(), store); err != nil {
+		t.Fatalf("pull to content store: %s", err)
+	}
+	// only the manifests are written again
+	if store.writes != 6 {
+		t.Errorf("expected 6 writes, got %d", store.writes)
+	}
+}
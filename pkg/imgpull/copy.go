@@ -0,0 +1,131 @@
+package imgpull
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/aceeric/imgpull/internal/util"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// CopyOpts selects what is copied by 'Copy' when the source is a multi-platform image.
+type CopyOpts struct {
+	// Platforms are the "os/arch" platforms to copy, like "linux/amd64". If empty then
+	// the OS and architecture in the puller options are used. If more than one platform
+	// is copied then a new image list manifest referencing the copied image manifests is
+	// pushed to the destination.
+	Platforms []string
+	// AllPlatforms copies the image list manifest unchanged along with every manifest
+	// that it references, so the destination has the same digest as the source. The
+	// Platforms are ignored if this is true.
+	AllPlatforms bool
+}
+
+// Copy copies the image at the 'src' image ref to the 'dst' image ref, e.g. from one
+// registry to another, like 'skopeo copy'. Blobs are pulled into a work directory and
+// then pushed, skipping any blobs that already exist in the destination repository. If
+// the source is an image manifest then the passed copy options are ignored. The passed
+// options are used to configure a Puller for the source and a Pusher for the destination,
+// with the passed refs overriding the Url in the options. The function returns the digest
+// of the manifest pushed to the destination ref.
+func Copy(src string, dst string, co CopyOpts, opts PullerOpts) (dgst string, err error) {
+	workDir, err := opts.newWorkDir()
+	if err != nil {
+		return "", err
+	}
+	defer func() { err = removeWorkDir(workDir, err) }()
+	opts.Url = src
+	p, err := NewPullerWith(opts)
+	if err != nil {
+		return "", err
+	}
+	defer p.Close()
+	opts.Url = dst
+	ps, err := NewPusherWith(opts)
+	if err != nil {
+		return "", err
+	}
+	defer ps.Close()
+	mh, err := p.GetManifest()
+	if err != nil {
+		return "", err
+	}
+	if !mh.IsManifestList() || co.AllPlatforms {
+		if err := copyManifest(p, ps, mh, workDir); err != nil {
+			return "", err
+		}
+		return "sha256:" + mh.Digest, ps.PushManifest("", mh.MediaType(), mh.Bytes)
+	}
+	platforms := co.Platforms
+	if len(platforms) == 0 {
+		platforms = []string{opts.OStype + "/" + opts.ArchType}
+	}
+	copied := []BundleManifest{}
+	var imh ManifestHolder
+	for _, platform := range platforms {
+		os, arch, found := strings.Cut(platform, "/")
+		if !found {
+			return "", fmt.Errorf("invalid platform %q for %q: expected os/arch", platform, src)
+		}
+		d, err := mh.GetImageDigestFor(os, arch)
+		if err != nil {
+			return "", err
+		}
+		if imh, err = p.GetManifestByDigest(d); err != nil {
+			return "", err
+		}
+		if err := copyManifest(p, ps, imh, workDir); err != nil {
+			return "", err
+		}
+		copied = append(copied, BundleManifest{
+			Digest:    "sha256:" + imh.Digest,
+			MediaType: imh.MediaType(),
+			Size:      len(imh.Bytes),
+			Platform:  platform,
+		})
+	}
+	if len(copied) == 1 {
+		return copied[0].Digest, ps.PushManifest("", imh.MediaType(), imh.Bytes)
+	}
+	mediaType, b, err := newImageListFor(copied)
+	if err != nil {
+		return "", err
+	}
+	if err := ps.PushManifest("", mediaType, b); err != nil {
+		return "", err
+	}
+	return digest.FromBytes(b).String(), nil
+}
+
+// copyManifest copies the blobs referenced by the passed manifest from the puller to
+// the pusher, using the passed directory to hold the blobs. If the manifest is an image
+// list manifest then every manifest that it references is copied and pushed by digest.
+// The passed manifest itself is not pushed.
+func copyManifest(p Puller, ps Pusher, mh ManifestHolder, blobDir string) error {
+	if mh.IsManifestList() {
+		for _, d := range mh.ImageManifestDigests() {
+			imh, err := p.GetManifestByDigest(d)
+			if err != nil {
+				return err
+			}
+			if err := copyManifest(p, ps, imh, blobDir); err != nil {
+				return err
+			}
+			if err := ps.PushManifest(d, imh.MediaType(), imh.Bytes); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if _, err := p.PullBlobs(mh, blobDir); err != nil {
+		return err
+	}
+	for _, layer := range mh.Layers() {
+		if err := ps.PushBlob(layer, filepath.Join(blobDir, util.DigestFrom(layer.Digest))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
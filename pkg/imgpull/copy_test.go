@@ -0,0 +1,83 @@
+package imgpull
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/aceeric/imgpull/internal/testhelpers"
+	"github.com/aceeric/imgpull/mock"
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// TestCopy copies the image for one platform from the mock server to an in-memory
+// registry, and then copies an image list manifest within the in-memory registry
+// with all of its platforms.
+func TestCopy(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	pr, pushServer, pushUrl := testhelpers.NewPushRegistry()
+	defer pushServer.Close()
+
+	opts := PullerOpts{
+		Scheme:   "http",
+		OStype:   "linux",
+		ArchType: "amd64",
+	}
+	src := fmt.Sprintf("%s/hello-world:latest", url)
+	dgst, err := Copy(src, fmt.Sprintf("%s/hello-world:amd64", pushUrl), CopyOpts{}, opts)
+	if err != nil {
+		t.FailNow()
+	}
+	b, mt, found := pr.Manifest("hello-world", "amd64")
+	if !found || mt != string(types.V1ociManifestMt) || digest.FromBytes(b).String() != dgst {
+		t.FailNow()
+	}
+	for _, blob := range []string{
+		"sha256:c1ec31eb59444d78df06a974d155e597c894ab4cda84f08294145e845394988e",
+		"sha256:d2c94e258dcb3c5ac2798d32e1249e42ef01cba4841c2234249495f87264ac5a",
+	} {
+		if _, found := pr.Blob("hello-world", blob); !found {
+			t.Fail()
+		}
+	}
+
+	mediaType, list, err := newImageListFor([]BundleManifest{{Digest: dgst, MediaType: mt, Size: len(b), Platform: "linux/amd64"}})
+	if err != nil {
+		t.FailNow()
+	}
+	listDigest := digest.FromBytes(list).String()
+	for _, ref := range []string{"multi", listDigest} {
+		pr.Manifests["hello-world"][ref] = list
+		pr.MediaTypes["hello-world"][ref] = mediaType
+	}
+	src = fmt.Sprintf("%s/hello-world:multi", pushUrl)
+	dgst, err = Copy(src, fmt.Sprintf("%s/copied:multi", pushUrl), CopyOpts{AllPlatforms: true}, opts)
+	if err != nil || dgst != listDigest {
+		t.FailNow()
+	}
+	if copied, _, found := pr.Manifest("copied", "multi"); !found || !bytes.Equal(copied, list) {
+		t.Fail()
+	}
+	if _, _, found := pr.Manifest("copied", digest.FromBytes(b).String()); !found {
+		t.Fail()
+	}
+	if _, found := pr.Blob("copied", "sha256:c1ec31eb59444d78df06a974d155e597c894ab4cda84f08294145e845394988e"); !found {
+		t.Fail()
+	}
+}
+
+// TestCopyBadPlatform tests that a platform not in the image list is an error.
+func TestCopyBadPlatform(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	_, pushServer, pushUrl := testhelpers.NewPushRegistry()
+	defer pushServer.Close()
+	opts := PullerOpts{Scheme: "http", OStype: "linux", ArchType: "amd64"}
+	co := CopyOpts{Platforms: []string{"plan9/386"}}
+	if _, err := Copy(fmt.Sprintf("%s/hello-world:latest", url), fmt.Sprintf("%s/hello-world:latest", pushUrl), co, opts); err == nil {
+		t.Fail()
+	}
+}
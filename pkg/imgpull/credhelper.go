@@ -0,0 +1,79 @@
+package imgpull
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// dockerHubServer is the server url that docker uses for Docker Hub credentials, so
+// credentials stored by 'docker login' are found by a credential helper.
+const dockerHubServer = "https://index.docker.io/v1/"
+
+// credHelperCreds is the JSON exchanged with a docker credential helper.
+type credHelperCreds struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// credHelperServer returns the server url that credentials for the passed registry are
+// stored under by a credential helper.
+func credHelperServer(registry string) string {
+	if registry == "docker.io" {
+		return dockerHubServer
+	}
+	return registry
+}
+
+// runCredHelper runs the passed action ('get', 'store', or 'erase') of the docker credential
+// helper 'docker-credential-<helper>' with the passed input on stdin, and returns stdout.
+func runCredHelper(helper string, action string, input []byte) ([]byte, error) {
+	cmd := exec.Command("docker-credential-"+helper, action)
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stdout.String() + stderr.String())
+		return stdout.Bytes(), fmt.Errorf("credential helper %q %s failed: %w: %s", helper, action, err, msg)
+	}
+	return stdout.Bytes(), nil
+}
+
+// credHelperGet returns the username and secret for the passed registry from the passed
+// credential helper. If the helper has no credentials for the registry then empty strings
+// are returned with no error.
+func credHelperGet(helper string, registry string) (string, string, error) {
+	out, err := runCredHelper(helper, "get", []byte(credHelperServer(registry)))
+	if err != nil {
+		if strings.Contains(string(out), "credentials not found") {
+			return "", "", nil
+		}
+		return "", "", err
+	}
+	creds := credHelperCreds{}
+	if err := json.Unmarshal(out, &creds); err != nil {
+		return "", "", fmt.Errorf("invalid output from credential helper %q: %w", helper, err)
+	}
+	return creds.Username, creds.Secret, nil
+}
+
+// credHelperStore stores the passed username and secret for the passed registry with the
+// passed credential helper.
+func credHelperStore(helper string, registry string, username string, secret string) error {
+	b, err := json.Marshal(credHelperCreds{ServerURL: credHelperServer(registry), Username: username, Secret: secret})
+	if err != nil {
+		return err
+	}
+	_, err = runCredHelper(helper, "store", b)
+	return err
+}
+
+// credHelperErase removes the credentials for the passed registry from the passed
+// credential helper.
+func credHelperErase(helper string, registry string) error {
+	_, err := runCredHelper(helper, "erase", []byte(credHelperServer(registry)))
+	return err
+}
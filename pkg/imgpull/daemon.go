@@ -0,0 +1,418 @@
+package imgpull
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// daemonBlobTimeoutSec is how long a pull in a 'Daemon' waits for another pull that is
+// pulling the same blob, if the options don't have a syncer.
+const daemonBlobTimeoutSec = 600
+
+// daemonManifestCacheSize is how many manifests a 'Daemon' caches if the options don't
+// have a manifest cache.
+const daemonManifestCacheSize = 1000
+
+// PullState is the state of a pull requested from a 'Daemon'.
+type PullState string
+
+const (
+	// PullQueued is a pull waiting for one of the concurrent pulls to finish.
+	PullQueued PullState = "queued"
+	// PullRunning is a pull in progress.
+	PullRunning PullState = "pulling"
+	// PullSucceeded is a pull that completed.
+	PullSucceeded PullState = "completed"
+	// PullErrored is a pull that failed.
+	PullErrored PullState = "failed"
+)
+
+// DaemonOpts configures a 'Daemon'.
+type DaemonOpts struct {
+	// PullerOpts are the options for the puller of each pull. The Url is ignored, and the
+	// OS and architecture are overridden by a pull request that has them. The token cache,
+	// manifest cache, and blob syncer in the options are shared by all the pulls, and are
+	// created by the daemon if nil. If the options have a session then it is used for the
+	// pulls from its registry.
+	PullerOpts PullerOpts
+	// DestDir is the directory that image tarballs are pulled into. It is created if it
+	// doesn't exist.
+	DestDir string
+	// Concurrency is how many pulls run in parallel. If less than one then one.
+	Concurrency int
+}
+
+// DaemonPullRequest is the body of a request to the daemon to pull an image.
+type DaemonPullRequest struct {
+	// Url is the image to pull, like 'docker.io/hello-world:latest'.
+	Url string `json:"url"`
+	// OS and Arch, if not empty, select the platform rather than the daemon options.
+	OS   string `json:"os,omitempty"`
+	Arch string `json:"arch,omitempty"`
+	// TarFile, if not empty, is the file name of the tarball in the daemon destination
+	// directory. It can't have a directory. If empty then the tarball is named from the url
+	// like 'PullAll' names it.
+	TarFile string `json:"tarFile,omitempty"`
+}
+
+// DaemonPull is the status of a pull requested from a 'Daemon'.
+type DaemonPull struct {
+	ID       string    `json:"id"`
+	Url      string    `json:"url"`
+	Platform string    `json:"platform"`
+	TarFile  string    `json:"tarFile"`
+	State    PullState `json:"state"`
+	// Digest is the digest of the image manifest once it is resolved.
+	Digest   string    `json:"digest,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Created  time.Time `json:"created"`
+	Finished time.Time `json:"finished,omitzero"`
+	// Stats are the stats of the pull once it is finished.
+	Stats *PullStats `json:"stats,omitempty"`
+}
+
+// DaemonStats has the number of pulls in each state and the usage of the caches shared
+// by the pulls of a 'Daemon'.
+type DaemonStats struct {
+	Pulls map[PullState]int `json:"pulls"`
+	// Blobs and BlobBytes are the number of blobs in the blob cache and their size.
+	Blobs     int   `json:"blobs"`
+	BlobBytes int64 `json:"blobBytes"`
+	// Manifests is the number of manifests in the manifest cache, if the daemon created it.
+	Manifests int `json:"manifests"`
+	// Sessions is the number of registries with a session.
+	Sessions int `json:"sessions"`
+}
+
+// Daemon pulls images on behalf of other processes, which request pulls with a small REST
+// API so that they share one blob cache, one token cache, one manifest cache, and one
+// session per registry instead of each linking the library. It implements 'http.Handler'
+// so the caller chooses how to serve it, e.g. on a localhost port or a unix socket. The API
+// is:
+//
+//	POST /v1/pulls      - Queues a pull from a 'DaemonPullRequest' body and returns a 'DaemonPull'
+//	GET  /v1/pulls      - Returns all the pulls
+//	GET  /v1/pulls/{id} - Returns one pull, and with '?wait=true' waits for it to finish
+//	GET  /v1/stats      - Returns 'DaemonStats'
+//
+// Errors are returned as JSON like '{"error": "..."}'. The daemon keeps the status of every
+// pull until it is closed.
+type Daemon struct {
+	opts     DaemonOpts
+	mux      *http.ServeMux
+	sem      chan struct{}
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	pulls    map[string]*DaemonPull
+	done     map[string]chan struct{}
+	order    []string
+	sessions map[string]*RegistrySession
+	closed   bool
+	// ownSyncer is true if the daemon created the blob syncer and so closes it.
+	ownSyncer bool
+	// manifests is the manifest cache if the daemon created it.
+	manifests *MemoryManifestCache
+}
+
+// NewDaemon returns a Daemon from the passed options.
+func NewDaemon(o DaemonOpts) (*Daemon, error) {
+	if err := os.MkdirAll(o.DestDir, 0755); err != nil {
+		return nil, err
+	}
+	if o.Concurrency < 1 {
+		o.Concurrency = 1
+	}
+	d := &Daemon{
+		sem:      make(chan struct{}, o.Concurrency),
+		pulls:    map[string]*DaemonPull{},
+		done:     map[string]chan struct{}{},
+		sessions: map[string]*RegistrySession{},
+	}
+	if o.PullerOpts.TokenCache == nil {
+		o.PullerOpts.TokenCache = NewTokenCache()
+	}
+	if o.PullerOpts.ManifestCache == nil {
+		d.manifests = NewManifestCache(daemonManifestCacheSize)
+		o.PullerOpts.ManifestCache = d.manifests
+	}
+	if o.PullerOpts.BlobSyncer == nil {
+		o.PullerOpts.BlobSyncer = NewBlobSyncer(daemonBlobTimeoutSec)
+		d.ownSyncer = true
+	}
+	if o.PullerOpts.Session != nil {
+		d.sessions[o.PullerOpts.Session.Registry()] = o.PullerOpts.Session
+	}
+	d.opts = o
+	d.mux = http.NewServeMux()
+	d.mux.HandleFunc("POST /v1/pulls", d.handlePull)
+	d.mux.HandleFunc("GET /v1/pulls", d.handleList)
+	d.mux.HandleFunc("GET /v1/pulls/{id}", d.handleGet)
+	d.mux.HandleFunc("GET /v1/stats", d.handleStats)
+	return d, nil
+}
+
+func (d *Daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mux.ServeHTTP(w, r)
+}
+
+// Pull queues a pull of the image in the passed request and returns its status. The pull
+// runs in the background, so the status is polled with 'Status' or 'Wait'. If a pull of the
+// same image and platform to the same tarball is queued or running then its status is
+// returned rather than queueing another pull. A pull of a different image or platform to
+// the tarball of a queued or running pull is rejected.
+func (d *Daemon) Pull(req DaemonPullRequest) (DaemonPull, error) {
+	if req.Url == "" {
+		return DaemonPull{}, errors.New("no image url in the pull request")
+	}
+	r, err := ParseRef(req.Url)
+	if err != nil {
+		return DaemonPull{}, err
+	}
+	tarFile := req.TarFile
+	if tarFile == "" {
+		tarFile = tarNameReplacer.Replace(req.Url) + ".tar"
+	} else if filepath.Base(tarFile) != tarFile || tarFile == "." || tarFile == ".." {
+		return DaemonPull{}, fmt.Errorf("invalid tar file %q: it can't have a directory", tarFile)
+	}
+	po := d.opts.PullerOpts
+	po.Url = req.Url
+	if req.OS != "" || req.Arch != "" {
+		po.OStype, po.ArchType = req.OS, req.Arch
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return DaemonPull{}, errors.New("the daemon is closed")
+	}
+	if po.Session = d.sessions[r.Registry]; po.Session == nil {
+		if po.Session, err = NewRegistrySession(r.Registry, po); err != nil {
+			return DaemonPull{}, err
+		}
+		d.sessions[r.Registry] = po.Session
+	}
+	pull := &DaemonPull{
+		ID:       strconv.Itoa(len(d.order) + 1),
+		Url:      req.Url,
+		Platform: po.OStype + "/" + po.ArchType,
+		TarFile:  filepath.Join(d.opts.DestDir, tarFile),
+		State:    PullQueued,
+		Created:  time.Now(),
+	}
+	for _, other := range d.pulls {
+		if other.TarFile != pull.TarFile || other.State != PullQueued && other.State != PullRunning {
+			continue
+		}
+		if other.Url == pull.Url && other.Platform == pull.Platform {
+			return *other, nil
+		}
+		return DaemonPull{}, fmt.Errorf("tar file %q is in use by pull %s of %q", tarFile, other.ID, other.Url)
+	}
+	d.pulls[pull.ID] = pull
+	d.done[pull.ID] = make(chan struct{})
+	d.order = append(d.order, pull.ID)
+	d.wg.Add(1)
+	go d.run(pull.ID, po)
+	return *pull, nil
+}
+
+// run runs the pull with the passed ID with the passed options once one of the concurrent
+// pulls is free.
+func (d *Daemon) run(id string, po PullerOpts) {
+	defer d.wg.Done()
+	d.sem <- struct{}{}
+	defer func() { <-d.sem }()
+	onEvent := po.OnEvent
+	po.OnEvent = func(e Event) {
+		if e.Type == ManifestResolved {
+			d.update(id, func(pull *DaemonPull) { pull.Digest = e.Digest })
+		}
+		if onEvent != nil {
+			onEvent(e)
+		}
+	}
+	var tarFile string
+	d.update(id, func(pull *DaemonPull) { pull.State, tarFile = PullRunning, pull.TarFile })
+	var stats PullStats
+	p, err := NewPullerWith(po)
+	if err == nil {
+		stats, err = d.pullTar(p, tarFile)
+		p.Close()
+	}
+	d.update(id, func(pull *DaemonPull) {
+		pull.State, pull.Finished, pull.Stats = PullSucceeded, time.Now(), &stats
+		if err != nil {
+			pull.State, pull.Error = PullErrored, err.Error()
+		}
+	})
+	d.mu.Lock()
+	close(d.done[id])
+	d.mu.Unlock()
+}
+
+// pullTar pulls the image in the passed puller to a temp directory in the destination
+// directory and then renames the tarball, and its sidecars if any, to the passed tar file,
+// so that a reader never sees a partial tarball and a failed pull doesn't remove the
+// tarball of an earlier pull.
+func (d *Daemon) pullTar(p Puller, tarFile string) (PullStats, error) {
+	tmpDir, err := os.MkdirTemp(d.opts.DestDir, ".pull-")
+	if err != nil {
+		return PullStats{}, err
+	}
+	defer os.RemoveAll(tmpDir)
+	tmpFile := filepath.Join(tmpDir, filepath.Base(tarFile))
+	stats, err := p.PullTar(tmpFile)
+	if err != nil {
+		return stats, err
+	}
+	// the tarball is renamed last so the sidecars are in place when it appears
+	pathFuncs := []func(string) string{
+		func(dest string) string { return sidecarPath(dest, Sha256Sidecar) },
+		func(dest string) string { return sidecarPath(dest, JSONSidecar) },
+		signaturePath,
+	}
+	for _, path := range pathFuncs {
+		if _, err := os.Stat(path(tmpFile)); err == nil {
+			if err := os.Rename(path(tmpFile), path(tarFile)); err != nil {
+				return stats, err
+			}
+		}
+	}
+	return stats, os.Rename(tmpFile, tarFile)
+}
+
+// update calls the passed function with the pull with the passed ID while holding the
+// lock of the receiver.
+func (d *Daemon) update(id string, f func(*DaemonPull)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f(d.pulls[id])
+}
+
+// Status returns the status of the pull with the passed ID, and false if there is no
+// such pull.
+func (d *Daemon) Status(id string) (DaemonPull, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	pull, found := d.pulls[id]
+	if !found {
+		return DaemonPull{}, false
+	}
+	return *pull, true
+}
+
+// Wait waits for the pull with the passed ID to finish, or for the passed channel to be
+// closed, and then returns its status. It returns false if there is no such pull.
+func (d *Daemon) Wait(id string, cancel <-chan struct{}) (DaemonPull, bool) {
+	d.mu.Lock()
+	done, found := d.done[id]
+	d.mu.Unlock()
+	if !found {
+		return DaemonPull{}, false
+	}
+	select {
+	case <-done:
+	case <-cancel:
+	}
+	return d.Status(id)
+}
+
+// Pulls returns the status of all the pulls in the order they were requested.
+func (d *Daemon) Pulls() []DaemonPull {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	pulls := make([]DaemonPull, 0, len(d.order))
+	for _, id := range d.order {
+		pulls = append(pulls, *d.pulls[id])
+	}
+	return pulls
+}
+
+// Stats returns the number of pulls in each state and the usage of the shared caches.
+func (d *Daemon) Stats() DaemonStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	stats := DaemonStats{
+		Pulls:    map[PullState]int{PullQueued: 0, PullRunning: 0, PullSucceeded: 0, PullErrored: 0},
+		Sessions: len(d.sessions),
+	}
+	for _, pull := range d.pulls {
+		stats.Pulls[pull.State]++
+	}
+	stats.Blobs, stats.BlobBytes = d.opts.PullerOpts.BlobSyncer.Size()
+	if d.manifests != nil {
+		stats.Manifests = d.manifests.Len()
+	}
+	return stats
+}
+
+// Close stops accepting pulls, waits for the pulls that were requested to finish, and
+// then closes the registry sessions and the blob syncer that the daemon created.
+func (d *Daemon) Close() {
+	d.mu.Lock()
+	d.closed = true
+	d.mu.Unlock()
+	d.wg.Wait()
+	for _, s := range d.sessions {
+		if s != d.opts.PullerOpts.Session {
+			s.Close()
+		}
+	}
+	if d.ownSyncer {
+		d.opts.PullerOpts.BlobSyncer.Close()
+	}
+}
+
+func (d *Daemon) handlePull(w http.ResponseWriter, r *http.Request) {
+	req := DaemonPullRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid pull request: %w", err))
+		return
+	}
+	pull, err := d.Pull(req)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, pull)
+}
+
+func (d *Daemon) handleList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, d.Pulls())
+}
+
+func (d *Daemon) handleGet(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	pull, found := d.Status(id)
+	if wait, _ := strconv.ParseBool(r.URL.Query().Get("wait")); wait && found {
+		pull, found = d.Wait(id, r.Context().Done())
+	}
+	if !found {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no pull with id %q", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, pull)
+}
+
+func (d *Daemon) handleStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, d.Stats())
+}
+
+// writeJSON writes the passed value as the JSON body of the response with the passed status.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONError writes the passed error as a JSON body like '{"error": "..."}' with the
+// passed status.
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
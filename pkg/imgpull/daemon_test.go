@@ -0,0 +1,159 @@
+package imgpull
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aceeric/imgpull/mock"
+)
+
+// Tests pulling an image through the daemon REST API, and that the status, the pull list,
+// and the stats reflect the pull.
+func TestDaemon(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+	daemon, err := NewDaemon(DaemonOpts{
+		PullerOpts:  PullerOpts{Scheme: "http", OStype: "linux", ArchType: "amd64"},
+		DestDir:     d,
+		Concurrency: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer daemon.Close()
+	api := httptest.NewServer(daemon)
+	defer api.Close()
+
+	body := fmt.Sprintf(`{"url": "%s/hello-world:latest", "tarFile": "hello.tar"}`, url)
+	resp, err := http.Post(api.URL+"/v1/pulls", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pull := DaemonPull{}
+	json.NewDecoder(resp.Body).Decode(&pull)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted || pull.ID == "" || pull.Platform != "linux/amd64" {
+		t.Fatalf("unexpected pull response %d %+v", resp.StatusCode, pull)
+	}
+	resp, err = http.Get(api.URL + "/v1/pulls/" + pull.ID + "?wait=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(resp.Body).Decode(&pull)
+	resp.Body.Close()
+	if pull.State != PullSucceeded || pull.Error != "" || pull.Finished.IsZero() {
+		t.Fatalf("unexpected pull status %+v", pull)
+	}
+	if pull.Digest != "sha256:e2fc4e5012d16e7fe466f5291c476431beaa1f9b90a5c2125b493ed28e2aba57" {
+		t.Errorf("unexpected digest %q", pull.Digest)
+	}
+	if _, err := os.Stat(filepath.Join(d, "hello.tar")); err != nil {
+		t.Errorf("expected a tarball: %s", err)
+	}
+	if pulls := daemon.Pulls(); len(pulls) != 1 || pulls[0].ID != pull.ID {
+		t.Errorf("unexpected pulls %+v", pulls)
+	}
+	resp, err = http.Get(api.URL + "/v1/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := DaemonStats{}
+	json.NewDecoder(resp.Body).Decode(&stats)
+	resp.Body.Close()
+	if stats.Pulls[PullSucceeded] != 1 || stats.Blobs != 2 || stats.Sessions != 1 || stats.Manifests == 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+// Tests that the daemon rejects invalid pull requests and unknown pulls.
+func TestDaemonErrors(t *testing.T) {
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+	daemon, err := NewDaemon(DaemonOpts{DestDir: d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := httptest.NewServer(daemon)
+	defer api.Close()
+	for _, body := range []string{
+		`{`,
+		`{"url": ""}`,
+		`{"url": "docker.io/hello-world:latest", "tarFile": "../hello.tar"}`,
+	} {
+		resp, err := http.Post(api.URL+"/v1/pulls", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected bad request for %s, got %d", body, resp.StatusCode)
+		}
+	}
+	resp, err := http.Get(api.URL + "/v1/pulls/42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected not found, got %d", resp.StatusCode)
+	}
+	daemon.Close()
+	if _, err := daemon.Pull(DaemonPullRequest{Url: "docker.io/hello-world:latest"}); err == nil {
+		t.Error("expected an error pulling after close")
+	}
+}
+
+// Tests that a pull to the tarball of a queued pull joins it if it is for the same image
+// and platform and is rejected otherwise, and that no temp files are left behind.
+func TestDaemonSameTarFile(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	d := t.TempDir()
+	daemon, err := NewDaemon(DaemonOpts{
+		PullerOpts:  PullerOpts{Scheme: "http", OStype: "linux", ArchType: "amd64"},
+		DestDir:     d,
+		Concurrency: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer daemon.Close()
+	// hold the only pull slot so the pulls stay queued
+	daemon.sem <- struct{}{}
+	req := DaemonPullRequest{Url: fmt.Sprintf("%s/hello-world:latest", url), TarFile: "hello.tar"}
+	first, err := daemon.Pull(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if joined, err := daemon.Pull(req); err != nil || joined.ID != first.ID {
+		t.Errorf("expected the pull to be joined, got %+v %v", joined, err)
+	}
+	other := req
+	other.Arch = "arm64"
+	other.OS = "linux"
+	if _, err := daemon.Pull(other); err == nil {
+		t.Errorf("expected a pull of another platform to the same tarball to be rejected")
+	}
+	<-daemon.sem
+	if pull, _ := daemon.Wait(first.ID, nil); pull.State != PullSucceeded {
+		t.Fatalf("unexpected pull status %+v", pull)
+	}
+	if entries, _ := os.ReadDir(d); len(entries) != 1 || entries[0].Name() != "hello.tar" {
+		t.Errorf("expected only the tarball in the destination, got %v", entries)
+	}
+	if len(daemon.Pulls()) != 1 {
+		t.Errorf("expected one pull, got %+v", daemon.Pulls())
+	}
+	// the pull is finished so the tarball can be pulled again
+	if again, err := daemon.Pull(other); err != nil || again.ID == first.ID {
+		t.Errorf("expected a new pull, got %+v %v", again, err)
+	}
+}
@@ -0,0 +1,64 @@
+package imgpull
+
+import (
+	"runtime"
+)
+
+// Deleter is the interface to the package for deleting manifests and blobs from a
+// registry. It supports tooling that prunes old images from private registries. Most
+// registries have to be configured to allow deletes, e.g. with the 'delete' storage
+// option of the CNCF distribution registry.
+type Deleter interface {
+	// DeleteManifest deletes the manifest with the passed 'ref' from the repository of
+	// the image url in the receiver. If 'ref' is empty then the ref from the image url
+	// in the receiver is used. Deleting by digest is supported by all registries that
+	// allow deletes and removes the manifest along with all of the tags that reference
+	// it. Some registries also support deleting just a tag by passing the tag.
+	DeleteManifest(ref string) error
+	// DeleteBlob deletes the blob with the passed digest from the repository of the
+	// image url in the receiver. Registries generally remove unreferenced blobs with
+	// garbage collection, so this is only needed by registries that don't.
+	DeleteBlob(digest string) error
+	// GetUrl returns the image ref from the receiver
+	GetUrl() string
+	// SetUrl supports reusing a deleter with a different image ref.
+	SetUrl(url string) error
+	// Close closes the deleter
+	Close()
+}
+
+// deleter implements the Deleter interface. It re-uses the puller's connection and
+// auth handling, requesting delete as well as pull access if the upstream requires
+// bearer auth.
+type deleter struct {
+	*puller
+}
+
+// NewDeleterWith initializes and returns a Deleter from the passed options. The options
+// are interpreted exactly as for 'NewPullerWith' except that the OS and architecture
+// are irrelevant and so default to the values for your system if not provided.
+func NewDeleterWith(o PullerOpts) (Deleter, error) {
+	if o.OStype == "" && o.ArchType == "" {
+		o.OStype, o.ArchType = runtime.GOOS, runtime.GOARCH
+	}
+	p, err := NewPullerWith(o)
+	if err != nil {
+		return &deleter{puller: &puller{}}, err
+	}
+	p.(*puller).Actions = "pull,delete"
+	return &deleter{puller: p.(*puller)}, nil
+}
+
+func (d *deleter) DeleteManifest(ref string) error {
+	if err := d.connect(); err != nil {
+		return err
+	}
+	return d.regCliFrom().V2ManifestsDelete(ref)
+}
+
+func (d *deleter) DeleteBlob(digest string) error {
+	if err := d.connect(); err != nil {
+		return err
+	}
+	return d.regCliFrom().V2BlobsDelete(digest)
+}
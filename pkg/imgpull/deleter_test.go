@@ -0,0 +1,43 @@
+package imgpull
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aceeric/imgpull/internal/testhelpers"
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Tests pruning a tag with a deleter, and that the deleter requests the delete scope.
+func TestDeleter(t *testing.T) {
+	pr, server, url := testhelpers.NewPushRegistry()
+	defer server.Close()
+	manifest := []byte(`{"schemaVersion":2}`)
+	pr.Manifests["frobozz"] = map[string][]byte{"v1": manifest, "v2": manifest}
+	pr.MediaTypes["frobozz"] = map[string]string{"v1": string(types.V1ociManifestMt), "v2": string(types.V1ociManifestMt)}
+	d, err := NewDeleterWith(PullerOpts{
+		Url:    fmt.Sprintf("%s/frobozz:v1", url),
+		Scheme: "http",
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	defer d.Close()
+	if d.(*deleter).regCliFrom().Scope() != "repository:frobozz:pull,delete" {
+		t.Errorf("unexpected scope %q", d.(*deleter).regCliFrom().Scope())
+	}
+	if err := d.DeleteManifest(""); err != nil {
+		t.Fatalf("delete manifest: %s", err)
+	}
+	if _, _, found := pr.Manifest("frobozz", "v1"); found {
+		t.Error("expected tag v1 to be deleted")
+	}
+	if _, _, found := pr.Manifest("frobozz", "v2"); !found {
+		t.Error("expected tag v2 to remain")
+	}
+	if err := d.DeleteBlob(digest.FromString("xyzzy").String()); err == nil {
+		t.Error("expected an error deleting a missing blob")
+	}
+}
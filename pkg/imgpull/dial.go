@@ -0,0 +1,191 @@
+package imgpull
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aceeric/imgpull/internal/imgref"
+)
+
+// dialFunc is the signature of 'DialContext' in 'PullerOpts' and 'http.Transport'.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// UnixSocketDialer returns a function for the 'DialContext' field of 'PullerOpts' that
+// connects to the passed unix socket regardless of the registry host in the image url. E.g.
+// to pull 'localhost/hello-world:latest' from a registry listening on '/run/registry.sock'.
+func UnixSocketDialer(socket string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", socket)
+	}
+}
+
+// proxyUrl parses the passed proxy url and returns an error if the scheme isn't one
+// that the transport supports or there is no host.
+func proxyUrl(proxy string) (*url.URL, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %w", proxy, err)
+	}
+	if !slices.Contains([]string{"http", "https", "socks5", "socks5h"}, u.Scheme) || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy %q: must be a url with scheme \"http\", \"https\", \"socks5\", or \"socks5h\"", proxy)
+	}
+	return u, nil
+}
+
+// sshCommand is the ssh client that 'SSHJumpDialer' runs. Tests replace it.
+var sshCommand = []string{"ssh"}
+
+// SSHJumpDialer returns a function for the 'DialContext' field of 'PullerOpts' that
+// tunnels each connection through the passed SSH jump host, like 'user@bastion' or
+// 'user@bastion:2222', by running 'ssh -W host:port' with the jump host. This is how
+// OpenSSH 'ProxyJump' works, so the ssh config, keys, known hosts, and agent of the
+// current user are used. Since there is nobody to answer prompts, ssh is run in batch
+// mode and the jump host must be in the known hosts and accept key auth. The ssh client
+// must be on the PATH.
+func SSHJumpDialer(jump string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, _, addr string) (net.Conn, error) {
+		args := append(slices.Clone(sshCommand[1:]), "-o", "BatchMode=yes", "-W", addr)
+		if host, port, err := net.SplitHostPort(jump); err == nil {
+			args = append(args, "-p", port, host)
+		} else {
+			args = append(args, jump)
+		}
+		return dialCommand(ctx, addr, sshCommand[0], args...)
+	}
+}
+
+// dialCommand starts the passed command and returns a connection that writes to its
+// stdin and reads from its stdout. Closing the connection stops the command.
+func dialCommand(ctx context.Context, addr, name string, args ...string) (net.Conn, error) {
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		inR.Close()
+		inW.Close()
+		return nil, err
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = inR, outW, os.Stderr
+	err = cmd.Start()
+	// the command has its own copies of its ends of the pipes
+	inR.Close()
+	outW.Close()
+	if err != nil {
+		inW.Close()
+		outR.Close()
+		return nil, fmt.Errorf("unable to run %q to connect to %q: %w", name, addr, err)
+	}
+	if ctx.Err() != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		inW.Close()
+		outR.Close()
+		return nil, ctx.Err()
+	}
+	return &cmdConn{cmd: cmd, in: inW, out: outR, addr: cmdAddr(addr)}, nil
+}
+
+// cmdConn is a net.Conn to the stdin and stdout of a command, like 'ssh -W'.
+type cmdConn struct {
+	cmd   *exec.Cmd
+	in    *os.File
+	out   *os.File
+	addr  cmdAddr
+	close sync.Once
+}
+
+func (c *cmdConn) Read(b []byte) (int, error)  { return c.out.Read(b) }
+func (c *cmdConn) Write(b []byte) (int, error) { return c.in.Write(b) }
+func (c *cmdConn) LocalAddr() net.Addr         { return cmdAddr("local") }
+func (c *cmdConn) RemoteAddr() net.Addr        { return c.addr }
+
+func (c *cmdConn) Close() error {
+	c.close.Do(func() {
+		c.in.Close()
+		c.out.Close()
+		c.cmd.Process.Kill()
+		c.cmd.Wait()
+	})
+	return nil
+}
+
+func (c *cmdConn) SetDeadline(t time.Time) error {
+	if err := c.in.SetWriteDeadline(t); err != nil {
+		return err
+	}
+	return c.out.SetReadDeadline(t)
+}
+
+func (c *cmdConn) SetReadDeadline(t time.Time) error  { return c.out.SetReadDeadline(t) }
+func (c *cmdConn) SetWriteDeadline(t time.Time) error { return c.in.SetWriteDeadline(t) }
+
+// cmdAddr is the address of a 'cmdConn', which is the address that the command
+// connects to.
+type cmdAddr string
+
+func (a cmdAddr) Network() string { return "cmd" }
+func (a cmdAddr) String() string  { return string(a) }
+
+// resolveDialer returns a dial function that connects to 'override' in place of the
+// passed registry, like curl --resolve, and dials every other address with 'dial'. If
+// the registry has a port then only that port is overridden. If the override has no port
+// then the port being dialed is kept. DockerHub API hosts match 'docker.io'.
+func resolveDialer(registry, override string, dial dialFunc) dialFunc {
+	regHost, regPort := splitHostPort(registry)
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port := splitHostPort(addr)
+		if imgref.NormalizeRegistry(host) == imgref.NormalizeRegistry(regHost) && (regPort == "" || regPort == port) {
+			if oHost, oPort := splitHostPort(override); oPort != "" {
+				addr = override
+			} else {
+				addr = net.JoinHostPort(strings.Trim(oHost, "[]"), port)
+			}
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// splitHostPort splits the passed address like 'foo.io:5000' or '[::1]' into the host
+// and the port, which is empty if the address has no port. IPv6 hosts keep their brackets.
+func splitHostPort(addr string) (string, string) {
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		return host, port
+	}
+	return addr, ""
+}
+
+// validOverride returns true if the passed registry override is a host or IP address with
+// an optional port from 1 to 65535.
+func validOverride(override string) bool {
+	host, port := splitHostPort(override)
+	if host == "" || strings.ContainsAny(host, "/@?# ") {
+		return false
+	} else if strings.HasPrefix(host, "[") {
+		if ip := net.ParseIP(strings.Trim(host, "[]")); ip == nil {
+			return false
+		}
+	} else if strings.Contains(host, ":") {
+		return false
+	}
+	if port == "" {
+		return true
+	}
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n <= 65535
+}
@@ -0,0 +1,382 @@
+package imgpull
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aceeric/imgpull/mock"
+)
+
+// Tests that the registry connection is made with the DialContext in the options.
+func TestDialContext(t *testing.T) {
+	server, addr := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	dialed := false
+	p, err := NewPullerWith(PullerOpts{
+		Url:      "registry.internal:5000/hello-world:latest",
+		Scheme:   "http",
+		OStype:   "linux",
+		ArchType: "amd64",
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			dialed = true
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	if _, err := p.GetManifestByType(Image); err != nil || !dialed {
+		t.Fail()
+	}
+}
+
+// Tests pulling from a registry listening on a unix socket.
+func TestUnixSocketDialer(t *testing.T) {
+	server, addr := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+	socket := filepath.Join(d, "registry.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.FailNow()
+	}
+	target, _ := url.Parse(fmt.Sprintf("http://%s", addr))
+	proxy := httptest.NewUnstartedServer(httputil.NewSingleHostReverseProxy(target))
+	proxy.Listener = l
+	proxy.Start()
+	defer proxy.Close()
+	p, err := NewPullerWith(PullerOpts{
+		Url:         "localhost/hello-world:latest",
+		Scheme:      "http",
+		OStype:      "linux",
+		ArchType:    "amd64",
+		DialContext: UnixSocketDialer(socket),
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	if _, err := p.GetManifestByType(Image); err != nil {
+		t.Fail()
+	}
+}
+
+// Tests that a caller-supplied transport is used as-is.
+func TestTransportOverride(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	rt := &countingTransport{}
+	p, err := NewPullerWith(PullerOpts{
+		Url:       fmt.Sprintf("%s/hello-world:latest", url),
+		Scheme:    "http",
+		OStype:    "linux",
+		ArchType:  "amd64",
+		Transport: rt,
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	if _, err := p.GetManifestByType(Image); err != nil || rt.count == 0 {
+		t.Fail()
+	}
+}
+
+// countingTransport counts round trips.
+type countingTransport struct {
+	count int
+}
+
+func (ct *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ct.count++
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// Tests pulling from a registry with a bracketed IPv6 address, so that the bracketed host
+// and port are what is dialed. The connection is sent to the mock server.
+func TestIPv6Registry(t *testing.T) {
+	server, addr := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	dialed := ""
+	p, err := NewPullerWith(PullerOpts{
+		Url:      "[::1]:5000/hello-world:latest",
+		Scheme:   "http",
+		OStype:   "linux",
+		ArchType: "amd64",
+		DialContext: func(ctx context.Context, network, a string) (net.Conn, error) {
+			dialed = a
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	})
+	if err != nil {
+		t.Fatalf("new puller: %s", err)
+	}
+	if _, err := p.GetManifestByType(Image); err != nil {
+		t.Fatalf("get manifest: %s", err)
+	}
+	if dialed != "[::1]:5000" {
+		t.Errorf("expected to dial [::1]:5000, dialed %q", dialed)
+	}
+}
+
+// Tests pulling from a registry that serves the v2 API under a base path, like
+// Artifactory, with the base path in the options and in the config.
+func TestBasePath(t *testing.T) {
+	server, addr := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	target, _ := url.Parse("http://" + addr)
+	basePath := "/artifactory/api/docker/docker-local"
+	proxy := httptest.NewServer(http.StripPrefix(basePath, httputil.NewSingleHostReverseProxy(target)))
+	defer proxy.Close()
+	proxyAddr := strings.TrimPrefix(proxy.URL, "http://")
+	for _, o := range []PullerOpts{
+		{BasePath: basePath + "/"},
+		{Config: &Config{Registries: map[string]RegistryConfig{proxyAddr: {BasePath: basePath}}}},
+	} {
+		o.Url = fmt.Sprintf("%s/hello-world:latest", proxyAddr)
+		o.Scheme, o.OStype, o.ArchType = "http", "linux", "amd64"
+		p, err := NewPullerWith(o)
+		if err != nil {
+			t.Fatalf("new puller: %s", err)
+		}
+		if _, err := p.PullTar(filepath.Join(t.TempDir(), "hello-world.tar")); err != nil {
+			t.Errorf("pull with base path: %s", err)
+		}
+	}
+	if _, err := NewPullerWith(PullerOpts{Url: proxyAddr + "/hello-world:latest", BasePath: basePath + "/v2", OStype: "linux", ArchType: "amd64"}); err == nil {
+		t.Errorf("expected an error for a base path with /v2")
+	}
+}
+
+// Tests pulling over TLS with connections to the registry sent to another address, and
+// that the registry certificate is verified against the registry host.
+func TestRegistryOverride(t *testing.T) {
+	server, addr := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	target, _ := url.Parse("http://" + addr)
+	// the httptest certificate is valid for example.com
+	tlsServer := httptest.NewTLSServer(httputil.NewSingleHostReverseProxy(target))
+	defer tlsServer.Close()
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsServer.Certificate().Raw})
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(tlsServer.URL, "https://"))
+	for _, tc := range []struct {
+		registry string
+		override string
+		ok       bool
+	}{
+		{"example.com", "127.0.0.1:" + port, true},
+		{"example.com:" + port, "127.0.0.1", true},
+		{"frobozz.com:" + port, "127.0.0.1", false},
+	} {
+		p, err := NewPullerWith(PullerOpts{
+			Url:              tc.registry + "/hello-world:latest",
+			Scheme:           "https",
+			OStype:           "linux",
+			ArchType:         "amd64",
+			CaCertPEM:        caPEM,
+			RegistryOverride: tc.override,
+		})
+		if err != nil {
+			t.Fatalf("new puller: %s", err)
+		}
+		if _, err := p.GetManifestByType(Image); (err == nil) != tc.ok {
+			t.Errorf("registry %q override %q: unexpected result %v", tc.registry, tc.override, err)
+		}
+	}
+}
+
+// Tests which addresses are overridden, and validating overrides.
+func TestResolveDialer(t *testing.T) {
+	dialed := ""
+	dial := resolveDialer("my.registry:5000", "10.0.0.5", func(_ context.Context, _, addr string) (net.Conn, error) {
+		dialed = addr
+		return nil, nil
+	})
+	for addr, expected := range map[string]string{
+		"my.registry:5000": "10.0.0.5:5000",
+		"my.registry:443":  "my.registry:443",
+		"auth.io:443":      "auth.io:443",
+	} {
+		dial(context.Background(), "tcp", addr)
+		if dialed != expected {
+			t.Errorf("dialing %q expected %q, got %q", addr, expected, dialed)
+		}
+	}
+	dial = resolveDialer("docker.io", "[::1]", func(_ context.Context, _, addr string) (net.Conn, error) {
+		dialed = addr
+		return nil, nil
+	})
+	if dial(context.Background(), "tcp", "index.docker.io:443"); dialed != "[::1]:443" {
+		t.Errorf("expected the DockerHub API host to be overridden, got %q", dialed)
+	}
+	for override, ok := range map[string]bool{
+		"10.0.0.5": true, "10.0.0.5:8443": true, "[::1]:5000": true, "my.host": true,
+		"::1": false, "10.0.0.5:0": false, "https://10.0.0.5": false, "10.0.0.5:port": false, "[::g]": false,
+	} {
+		if validOverride(override) != ok {
+			t.Errorf("override %q: expected valid %t", override, ok)
+		}
+	}
+}
+
+// Tests pulling through a SOCKS5 proxy that resolves the registry host.
+func TestSocksProxy(t *testing.T) {
+	server, addr := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.FailNow()
+	}
+	defer l.Close()
+	requested := make(chan string, 10)
+	go serveSocks(l, addr, requested)
+	p, err := NewPullerWith(PullerOpts{
+		Url:      "registry.internal:5000/hello-world:latest",
+		Scheme:   "http",
+		OStype:   "linux",
+		ArchType: "amd64",
+		Proxy:    "socks5h://" + l.Addr().String(),
+	})
+	if err != nil {
+		t.Fatalf("new puller: %s", err)
+	}
+	if _, err := p.GetManifestByType(Image); err != nil {
+		t.Fatalf("pull through proxy: %s", err)
+	}
+	if r := <-requested; r != "registry.internal:5000" {
+		t.Errorf("expected the proxy to be asked for the registry, got %q", r)
+	}
+}
+
+// serveSocks is a minimal no-auth SOCKS5 proxy that sends each address that it's
+// asked to connect to on the passed channel, and connects to 'target' instead.
+func serveSocks(l net.Listener, target string, requested chan<- string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			// greeting: version, method count, methods
+			hdr := make([]byte, 2)
+			if _, err := io.ReadFull(conn, hdr); err != nil {
+				return
+			}
+			if _, err := io.ReadFull(conn, make([]byte, hdr[1])); err != nil {
+				return
+			}
+			conn.Write([]byte{5, 0})
+			// request: version, connect, reserved, address type, address, port
+			req := make([]byte, 4)
+			if _, err := io.ReadFull(conn, req); err != nil {
+				return
+			}
+			var host string
+			switch req[3] {
+			case 1:
+				ip := make([]byte, 4)
+				io.ReadFull(conn, ip)
+				host = net.IP(ip).String()
+			case 3:
+				n := make([]byte, 1)
+				io.ReadFull(conn, n)
+				name := make([]byte, n[0])
+				io.ReadFull(conn, name)
+				host = string(name)
+			default:
+				return
+			}
+			port := make([]byte, 2)
+			if _, err := io.ReadFull(conn, port); err != nil {
+				return
+			}
+			requested <- net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+			upstream, err := net.Dial("tcp", target)
+			if err != nil {
+				conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+				return
+			}
+			defer upstream.Close()
+			conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+			go io.Copy(upstream, conn)
+			io.Copy(conn, upstream)
+		}()
+	}
+}
+
+// Tests tunneling through an SSH jump host. The test binary stands in for the ssh client
+// (see TestHelperSSH) so the test doesn't need an SSH server.
+func TestSSHJump(t *testing.T) {
+	server, addr := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	saved := sshCommand
+	defer func() { sshCommand = saved }()
+	sshCommand = []string{os.Args[0], "-test.run=^TestHelperSSH$", "--"}
+	t.Setenv("IMGPULL_HELPER_SSH", "1")
+	p, err := NewPullerWith(PullerOpts{
+		Url:      addr + "/hello-world:latest",
+		Scheme:   "http",
+		OStype:   "linux",
+		ArchType: "amd64",
+		SSHJump:  "jqpubli@bastion:2222",
+	})
+	if err != nil {
+		t.Fatalf("new puller: %s", err)
+	}
+	if _, err := p.GetManifestByType(Image); err != nil {
+		t.Fatalf("pull through jump host: %s", err)
+	}
+	p, _ = NewPullerWith(PullerOpts{
+		Url:      addr + "/hello-world:latest",
+		Scheme:   "http",
+		OStype:   "linux",
+		ArchType: "amd64",
+		SSHJump:  "jqpubli@frobozz",
+	})
+	if _, err := p.GetManifestByType(Image); err == nil {
+		t.Errorf("expected an error from an unreachable jump host")
+	}
+}
+
+// TestHelperSSH isn't a real test. It acts like 'ssh -W host:port' for TestSSHJump,
+// and fails unless the jump host is 'jqpubli@bastion' on port 2222.
+func TestHelperSSH(t *testing.T) {
+	if os.Getenv("IMGPULL_HELPER_SSH") != "1" {
+		return
+	}
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	args = args[1:]
+	addr := ""
+	for i := range args {
+		if args[i] == "-W" && i+1 < len(args) {
+			addr = args[i+1]
+		}
+	}
+	if addr == "" || !slices.Equal(args[len(args)-3:], []string{"-p", "2222", "jqpubli@bastion"}) {
+		os.Exit(255)
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		os.Exit(255)
+	}
+	go io.Copy(conn, os.Stdin)
+	io.Copy(os.Stdout, conn)
+	os.Exit(0)
+}
@@ -0,0 +1,184 @@
+package imgpull
+
+import (
+	"maps"
+	"slices"
+
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+)
+
+// DiffChange is the kind of a difference between two images.
+type DiffChange string
+
+const (
+	// DiffAdded means the item is only in the second image.
+	DiffAdded DiffChange = "added"
+	// DiffRemoved means the item is only in the first image.
+	DiffRemoved DiffChange = "removed"
+	// DiffChanged means the item is in both images with different values.
+	DiffChanged DiffChange = "changed"
+)
+
+// LayerChange is a layer that differs between two images. Layers are compared by
+// position from the bottom layer: a layer in the same position in both images with a
+// different digest is changed, and a layer past the end of the other image is added
+// or removed.
+type LayerChange struct {
+	Change DiffChange `json:"change"`
+	// Index is the position of the layer, where 0 is the bottom layer.
+	Index int `json:"index"`
+	// From is the layer in the first image. It is nil if the layer was added.
+	From *types.Layer `json:"from,omitempty"`
+	// To is the layer in the second image. It is nil if the layer was removed.
+	To *types.Layer `json:"to,omitempty"`
+}
+
+// ValueChange is an environment variable or label that differs between two images.
+type ValueChange struct {
+	Change DiffChange `json:"change"`
+	Key    string     `json:"key"`
+	From   string     `json:"from,omitempty"`
+	To     string     `json:"to,omitempty"`
+}
+
+// ArgsChange is an entrypoint or command that differs between two images.
+type ArgsChange struct {
+	From []string `json:"from"`
+	To   []string `json:"to"`
+}
+
+// ImageDiff has the differences between two images. It is returned by 'Diff'.
+type ImageDiff struct {
+	// From is the url of the image manifest of the first image. If the image url
+	// resolved to an image list then this has the digest of the selected image.
+	From string `json:"from"`
+	// To is the url of the image manifest of the second image.
+	To string `json:"to"`
+	// FromDigest and ToDigest are the digests of the image manifests, like 'sha256:abc...'.
+	FromDigest string `json:"fromDigest"`
+	ToDigest   string `json:"toDigest"`
+	// FromSize and ToSize are the sums of the sizes of the layers of each image.
+	FromSize int64 `json:"fromSize"`
+	ToSize   int64 `json:"toSize"`
+	// SharedLayers is the number of layers that are the same in both images.
+	SharedLayers int           `json:"sharedLayers"`
+	Layers       []LayerChange `json:"layers"`
+	Env          []ValueChange `json:"env"`
+	Labels       []ValueChange `json:"labels"`
+	// Entrypoint and Cmd are nil if they are the same in both images.
+	Entrypoint *ArgsChange `json:"entrypoint,omitempty"`
+	Cmd        *ArgsChange `json:"cmd,omitempty"`
+}
+
+// Identical returns true if the receiver has no differences.
+func (d ImageDiff) Identical() bool {
+	return len(d.Layers) == 0 && len(d.Env) == 0 && len(d.Labels) == 0 && d.Entrypoint == nil && d.Cmd == nil
+}
+
+// diffImage is an image manifest and config being compared by 'Diff'.
+type diffImage struct {
+	url        string
+	digest     string
+	layers     []types.Layer
+	env        map[string]string
+	labels     map[string]string
+	entrypoint []string
+	cmd        []string
+}
+
+// Diff compares the images of the passed pullers, selecting the platform from an image
+// list for each, and returns the differences in their layers, environment, labels,
+// entrypoint, and command. Only the manifests and the config blobs are downloaded. The
+// pullers can be for different registries.
+func Diff(from, to Puller) (ImageDiff, error) {
+	fi, err := diffImageFor(from)
+	if err != nil {
+		return ImageDiff{}, err
+	}
+	ti, err := diffImageFor(to)
+	if err != nil {
+		return ImageDiff{}, err
+	}
+	diff := ImageDiff{
+		From:       fi.url,
+		To:         ti.url,
+		FromDigest: fi.digest,
+		ToDigest:   ti.digest,
+		Layers:     []LayerChange{},
+		Env:        diffValues(fi.env, ti.env),
+		Labels:     diffValues(fi.labels, ti.labels),
+	}
+	for i := range max(len(fi.layers), len(ti.layers)) {
+		lc := LayerChange{Index: i}
+		if i < len(fi.layers) {
+			lc.From = &fi.layers[i]
+			diff.FromSize += int64(fi.layers[i].Size)
+		}
+		if i < len(ti.layers) {
+			lc.To = &ti.layers[i]
+			diff.ToSize += int64(ti.layers[i].Size)
+		}
+		switch {
+		case lc.To == nil:
+			lc.Change = DiffRemoved
+		case lc.From == nil:
+			lc.Change = DiffAdded
+		case lc.From.Digest != lc.To.Digest:
+			lc.Change = DiffChanged
+		default:
+			diff.SharedLayers++
+			continue
+		}
+		diff.Layers = append(diff.Layers, lc)
+	}
+	if !slices.Equal(fi.entrypoint, ti.entrypoint) {
+		diff.Entrypoint = &ArgsChange{From: fi.entrypoint, To: ti.entrypoint}
+	}
+	if !slices.Equal(fi.cmd, ti.cmd) {
+		diff.Cmd = &ArgsChange{From: fi.cmd, To: ti.cmd}
+	}
+	return diff, nil
+}
+
+// diffImageFor gets the image manifest and config of the image in the passed puller.
+func diffImageFor(p Puller) (diffImage, error) {
+	mh, err := p.GetManifestByType(Image)
+	if err != nil {
+		return diffImage{}, err
+	}
+	ic, err := p.GetImageConfig(mh)
+	if err != nil {
+		return diffImage{}, err
+	}
+	layers := mh.Layers()
+	return diffImage{
+		url:        mh.ImageUrl,
+		digest:     "sha256:" + mh.Digest,
+		layers:     layers[:len(layers)-1],
+		env:        ic.Env,
+		labels:     ic.Labels,
+		entrypoint: ic.Entrypoint,
+		cmd:        ic.Cmd,
+	}, nil
+}
+
+// diffValues returns the differences between the passed maps sorted by key.
+func diffValues(from, to map[string]string) []ValueChange {
+	changes := []ValueChange{}
+	all := map[string]string{}
+	maps.Copy(all, from)
+	maps.Copy(all, to)
+	for _, key := range slices.Sorted(maps.Keys(all)) {
+		fv, inFrom := from[key]
+		tv, inTo := to[key]
+		switch {
+		case !inTo:
+			changes = append(changes, ValueChange{Change: DiffRemoved, Key: key, From: fv})
+		case !inFrom:
+			changes = append(changes, ValueChange{Change: DiffAdded, Key: key, To: tv})
+		case fv != tv:
+			changes = append(changes, ValueChange{Change: DiffChanged, Key: key, From: fv, To: tv})
+		}
+	}
+	return changes
+}
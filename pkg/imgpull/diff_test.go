@@ -0,0 +1,68 @@
+package imgpull
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/aceeric/imgpull/mock"
+)
+
+// Tests the differences between two images in their layers, environment, labels,
+// entrypoint, and command, and that an image has no differences with itself.
+func TestDiff(t *testing.T) {
+	reg := mock.NewRegistry()
+	reg.AddImage("frobozz", "v1",
+		[]byte(`{"architecture":"amd64","os":"linux","config":{"Env":["PATH=/bin","FOO=1"],"Labels":{"version":"1"},"Entrypoint":["/app"],"Cmd":["run"]}}`),
+		[]byte("base"), []byte("app-v1"))
+	reg.AddImage("frobozz", "v2",
+		[]byte(`{"architecture":"amd64","os":"linux","config":{"Env":["PATH=/bin","FOO=2","BAR=x"],"Labels":{"version":"2"},"Entrypoint":["/app"],"Cmd":["serve"]}}`),
+		[]byte("base"), []byte("app-v2"), []byte("extra"))
+	server, url := mock.ServerWith(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}), reg)
+	defer server.Close()
+	pullerFor := func(tag string) Puller {
+		p, err := NewPullerWith(PullerOpts{
+			Url:      fmt.Sprintf("%s/frobozz:%s", url, tag),
+			OStype:   "linux",
+			ArchType: "amd64",
+			Scheme:   "http",
+		})
+		if err != nil {
+			t.FailNow()
+		}
+		return p
+	}
+	diff, err := Diff(pullerFor("v1"), pullerFor("v2"))
+	if err != nil {
+		t.Fatalf("diff: %s", err)
+	}
+	if diff.Identical() || diff.SharedLayers != 1 || len(diff.Layers) != 2 {
+		t.Fatalf("unexpected layer differences %+v", diff)
+	}
+	if lc := diff.Layers[0]; lc.Change != DiffChanged || lc.Index != 1 || lc.From.Size != len("app-v1") || lc.To.Size != len("app-v2") {
+		t.Errorf("expected a changed layer, got %+v", lc)
+	}
+	if lc := diff.Layers[1]; lc.Change != DiffAdded || lc.Index != 2 || lc.From != nil {
+		t.Errorf("expected an added layer, got %+v", lc)
+	}
+	if diff.FromSize != int64(len("base")+len("app-v1")) || diff.ToSize != int64(len("base")+len("app-v2")+len("extra")) {
+		t.Errorf("unexpected sizes %d and %d", diff.FromSize, diff.ToSize)
+	}
+	expectedEnv := []ValueChange{
+		{Change: DiffAdded, Key: "BAR", To: "x"},
+		{Change: DiffChanged, Key: "FOO", From: "1", To: "2"},
+	}
+	if !slices.Equal(diff.Env, expectedEnv) {
+		t.Errorf("expected env changes %+v, got %+v", expectedEnv, diff.Env)
+	}
+	if len(diff.Labels) != 1 || diff.Labels[0] != (ValueChange{Change: DiffChanged, Key: "version", From: "1", To: "2"}) {
+		t.Errorf("unexpected label changes %+v", diff.Labels)
+	}
+	if diff.Entrypoint != nil || diff.Cmd == nil || diff.Cmd.From[0] != "run" || diff.Cmd.To[0] != "serve" {
+		t.Errorf("unexpected entrypoint and cmd changes %+v %+v", diff.Entrypoint, diff.Cmd)
+	}
+	same, err := Diff(pullerFor("v1"), pullerFor("v1"))
+	if err != nil || !same.Identical() || same.SharedLayers != 2 {
+		t.Errorf("expected no differences, got %+v", same)
+	}
+}
@@ -0,0 +1,32 @@
+package imgpull
+
+import (
+	"fmt"
+
+	"github.com/aceeric/imgpull/internal/rootfs"
+)
+
+// VerifyDiffIDs decompresses each layer of the image manifest in the passed ManifestHolder,
+// computes its diff_id, and validates it against the 'rootfs.diff_ids' list in the image
+// config. The layer blobs and the config blob must already be in 'blobDir' (e.g. from a call
+// to 'PullBlobs'.) The digest of a blob only covers the compressed bytes that the manifest
+// references, while this checks the uncompressed content of each layer against the config,
+// so it catches a manifest and a config that don't agree on the content of the image. An
+// error is returned if the config has no diff_ids, or if any diff_id doesn't match.
+func VerifyDiffIDs(mh ManifestHolder, blobDir string) error {
+	layers, err := rootfsLayersFor(mh, blobDir)
+	if err != nil {
+		return err
+	}
+	for i, layer := range layers {
+		if layer.DiffID == "" {
+			return fmt.Errorf("image config for %q has no diff_ids", mh.ImageUrl)
+		}
+		if diffID, err := rootfs.DiffID(layer.File); err != nil {
+			return err
+		} else if diffID != layer.DiffID {
+			return fmt.Errorf("diff_id mismatch for layer %d of %q: expected %q, got %q", i, mh.ImageUrl, layer.DiffID, diffID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package imgpull
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+)
+
+// newWorkDir creates a temp directory for a pull in the work directory in the receiver, or
+// in the default directory for temporary files if the receiver doesn't have a work directory.
+func (o PullerOpts) newWorkDir() (string, error) {
+	if o.WorkDir != "" {
+		if err := os.MkdirAll(o.WorkDir, 0755); err != nil {
+			return "", fmt.Errorf("unable to create work directory %q, error: %w", o.WorkDir, err)
+		}
+	}
+	return os.MkdirTemp(o.WorkDir, "imgpull.")
+}
+
+// removeWorkDir removes the passed work directory and all its content. If the passed
+// error is nil then the error from the removal is returned, otherwise the passed error
+// is returned since it is the cause of the failure that the caller is reporting.
+func removeWorkDir(dir string, err error) error {
+	if rmErr := os.RemoveAll(dir); rmErr != nil && err == nil {
+		return fmt.Errorf("unable to remove work directory %q, error: %w", dir, rmErr)
+	}
+	return err
+}
+
+// layersSize returns the sum of the sizes of the passed layers. Schema 1 manifests don't
+// have layer sizes, so the result is zero for those.
+func layersSize(layers []types.Layer) uint64 {
+	var size uint64
+	for _, layer := range layers {
+		size += uint64(layer.Size)
+	}
+	return size
+}
+
+// checkDiskSpace returns an error if the file system holding the passed directory has less
+// than 'need' bytes available. If the available space can't be determined on the platform
+// then the check passes.
+func checkDiskSpace(dir string, need uint64) error {
+	if need == 0 {
+		return nil
+	}
+	avail, ok, err := availableBytes(dir)
+	if err != nil {
+		return err
+	}
+	if ok && avail < need {
+		return fmt.Errorf("insufficient disk space in %q: need %d bytes, %d bytes available", dir, need, avail)
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd)
+
+package imgpull
+
+// availableBytes returns false because the available space on a file system can't be
+// determined on this platform.
+func availableBytes(dir string) (uint64, bool, error) {
+	return 0, false, nil
+}
@@ -0,0 +1,100 @@
+package imgpull
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/aceeric/imgpull/mock"
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+)
+
+func TestLayersSize(t *testing.T) {
+	layers := []types.Layer{{Size: 1}, {Size: 2}, {Size: 3}}
+	if layersSize(layers) != 6 || layersSize(nil) != 0 {
+		t.Fail()
+	}
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+	if checkDiskSpace(d, 0) != nil || checkDiskSpace(d, 1) != nil {
+		t.Fail()
+	}
+	if _, ok, _ := availableBytes(d); ok && checkDiskSpace(d, math.MaxUint64) == nil {
+		t.Fail()
+	}
+	if runtime.GOOS == "linux" && checkDiskSpace(filepath.Join(d, "nosuchdir"), 1) == nil {
+		t.Fail()
+	}
+}
+
+// Tests that temp directories are created in the work directory and removed when
+// the pull is done.
+func TestPullTarWorkDir(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+	workDir := filepath.Join(d, "work")
+	for _, image := range []string{"hello-world:latest", "nosuch/image:v1.2.3"} {
+		opts := NewPullerOpts(fmt.Sprintf("%s/%s", url, image))
+		opts.Scheme = "http"
+		opts.OStype = "linux"
+		opts.ArchType = "amd64"
+		opts.WorkDir = workDir
+		p, err := NewPullerWith(opts)
+		if err != nil {
+			t.FailNow()
+		}
+		tarball := filepath.Join(d, "test.tar")
+		_, err = p.PullTar(tarball)
+		if image == "hello-world:latest" && err != nil {
+			t.Fail()
+		} else if image != "hello-world:latest" && err == nil {
+			t.Fail()
+		}
+		if entries, err := os.ReadDir(workDir); err != nil || len(entries) != 0 {
+			t.Fail()
+		}
+		os.Remove(tarball)
+	}
+}
+
+// Tests that when a pull fails after some blobs were pulled, neither the work directory
+// nor a partial tarball is left behind.
+func TestPullTarCleanup(t *testing.T) {
+	reg := mock.NewHelloWorldRegistry()
+	server, url := mock.ServerWith(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}), reg)
+	defer server.Close()
+	// the config is pulled after the layer
+	reg.AddFault(mock.Fault{Match: "c1ec31eb59444d78df06a974d155e597c894ab4cda84f08294145e845394988e", Status: http.StatusInternalServerError})
+	d := t.TempDir()
+	workDir := filepath.Join(d, "work")
+	tarball := filepath.Join(d, "test.tar")
+	p, err := NewPullerWith(PullerOpts{
+		Url:      fmt.Sprintf("%s/hello-world:latest", url),
+		Scheme:   "http",
+		OStype:   "linux",
+		ArchType: "amd64",
+		WorkDir:  workDir,
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	if _, err := p.PullTar(tarball); err == nil {
+		t.Fatalf("expected the pull to fail")
+	}
+	if entries, err := os.ReadDir(workDir); err != nil || len(entries) != 0 {
+		t.Errorf("expected the work directory to be empty, got %v", entries)
+	}
+	if _, err := os.Stat(tarball); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected no tarball")
+	}
+}
@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd
+
+package imgpull
+
+import "syscall"
+
+// availableBytes returns the number of bytes available to an unprivileged user on the
+// file system holding the passed directory.
+func availableBytes(dir string) (uint64, bool, error) {
+	st := syscall.Statfs_t{}
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, false, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), true, nil
+}
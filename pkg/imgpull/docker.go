@@ -0,0 +1,132 @@
+package imgpull
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// defaultDockerHost is the Docker Engine API endpoint if DOCKER_HOST is not set.
+const defaultDockerHost = "unix:///var/run/docker.sock"
+
+// DockerClient loads image tarballs into a Docker Engine. Use 'NewDockerClient' for a
+// client that calls the Docker Engine API directly, or implement the interface with the
+// 'ImageLoad' function of the Docker client.
+type DockerClient interface {
+	// LoadImage loads the image tarball in the format produced by 'docker save' from
+	// the passed reader.
+	LoadImage(ctx context.Context, tarball io.Reader) error
+}
+
+// dockerClient calls the Docker Engine API.
+type dockerClient struct {
+	client *http.Client
+	url    string
+}
+
+// dockerLoadMessage is one of the JSON messages streamed by the image load endpoint.
+type dockerLoadMessage struct {
+	Stream string `json:"stream"`
+	Error  string `json:"error"`
+}
+
+// NewDockerClient returns a client for the Docker Engine API at the passed host, like
+// 'unix:///var/run/docker.sock' or 'tcp://localhost:2375'. If the host is empty, then
+// the DOCKER_HOST environment variable is used if set, else the default Docker socket.
+// TLS to the Docker Engine is not supported.
+func NewDockerClient(host string) (DockerClient, error) {
+	if host == "" {
+		host = os.Getenv("DOCKER_HOST")
+	}
+	if host == "" {
+		host = defaultDockerHost
+	}
+	scheme, addr, ok := strings.Cut(host, "://")
+	if !ok || addr == "" {
+		return nil, fmt.Errorf("invalid docker host %q", host)
+	}
+	switch scheme {
+	case "unix":
+		dialer := net.Dialer{}
+		return dockerClient{
+			client: &http.Client{
+				Transport: &http.Transport{
+					DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+						return dialer.DialContext(ctx, "unix", addr)
+					},
+				},
+			},
+			// the host is ignored since the transport always dials the socket
+			url: "http://docker",
+		}, nil
+	case "tcp", "http":
+		return dockerClient{client: &http.Client{}, url: "http://" + addr}, nil
+	default:
+		return nil, fmt.Errorf("unsupported docker host scheme %q in %q", scheme, host)
+	}
+}
+
+// LoadImage posts the passed tarball to the image load endpoint of the Docker Engine.
+// The endpoint responds with a stream of JSON messages, and reports a failure to load
+// the image in a message rather than with the status code.
+func (dc dockerClient) LoadImage(ctx context.Context, tarball io.Reader) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dc.url+"/images/load?quiet=1", tarball)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-tar")
+	resp, err := dc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("docker image load failed. Status: %d, message: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		msg := dockerLoadMessage{}
+		if err := decoder.Decode(&msg); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("invalid response from docker image load: %w", err)
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("docker image load failed: %s", msg.Error)
+		}
+	}
+}
+
+func (p *puller) PullToDocker(ctx context.Context, client DockerClient) (err error) {
+	finished := p.pullStarted()
+	defer func() { finished(err) }()
+	tmpDir, err := p.Opts.newWorkDir()
+	if err != nil {
+		return err
+	}
+	defer func() { err = removeWorkDir(tmpDir, err) }()
+	itb, _, err := p.pull(ctx, tmpDir, &PullStats{})
+	if err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := itb.ToWriter(pw)
+		pw.CloseWithError(err)
+	}()
+	err = client.LoadImage(ctx, pr)
+	// unblock the writer if the client returned without reading the whole tarball, and
+	// wait for it so the work directory isn't removed while it is being read
+	pr.CloseWithError(errors.New("docker image load ended"))
+	<-done
+	return err
+}
@@ -0,0 +1,172 @@
+package imgpull
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aceeric/imgpull/mock"
+)
+
+// dockerEngine returns a handler for the image load endpoint that reads the tarball and
+// records the files in it. If 'loadErr' is not empty it is reported in the response.
+func dockerEngine(files *[]string, loadErr string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/images/load" || r.Header.Get("Content-Type") != "application/x-tar" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		tr := tar.NewReader(r.Body)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			*files = append(*files, hdr.Name)
+		}
+		enc := json.NewEncoder(w)
+		if loadErr != "" {
+			enc.Encode(map[string]string{"errorDetail": loadErr, "error": loadErr})
+		} else {
+			enc.Encode(map[string]string{"stream": "Loaded image: hello-world:latest\n"})
+		}
+	}
+}
+
+// Tests streaming an image into a docker engine over tcp and over a unix socket, and
+// that a load error in the response is returned.
+func TestPullToDocker(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	p, err := NewPullerWith(PullerOpts{
+		Url:      fmt.Sprintf("%s/hello-world:latest", url),
+		OStype:   "linux",
+		ArchType: "amd64",
+		Scheme:   "http",
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	var files []string
+	engine := httptest.NewServer(dockerEngine(&files, ""))
+	defer engine.Close()
+
+	sock := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.FailNow()
+	}
+	unixEngine := httptest.NewUnstartedServer(dockerEngine(&files, ""))
+	unixEngine.Listener = l
+	unixEngine.Start()
+	defer unixEngine.Close()
+
+	for _, host := range []string{strings.Replace(engine.URL, "http://", "tcp://", 1), "unix://" + sock} {
+		files = nil
+		dc, err := NewDockerClient(host)
+		if err != nil {
+			t.FailNow()
+		}
+		if err := p.PullToDocker(context.Background(), dc); err != nil {
+			t.Fatalf("pull to docker %s: %s", host, err)
+		}
+		if len(files) != 3 || !strings.Contains(strings.Join(files, ","), "manifest.json") {
+			t.Errorf("unexpected tarball content %v", files)
+		}
+	}
+
+	failing := httptest.NewServer(dockerEngine(&files, "no space left on device"))
+	defer failing.Close()
+	dc, _ := NewDockerClient(failing.URL)
+	if err := p.PullToDocker(context.Background(), dc); err == nil || !strings.Contains(err.Error(), "no space left") {
+		t.Errorf("expected the load error, got %v", err)
+	}
+
+	// an engine that responds without reading the tarball
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "rejected", http.StatusInternalServerError)
+	}))
+	defer rejecting.Close()
+	dc, _ = NewDockerClient(rejecting.URL)
+	if err := p.PullToDocker(context.Background(), dc); err == nil {
+		t.Error("expected an error from the engine")
+	}
+}
+
+// Tests parsing the docker host.
+func TestNewDockerClient(t *testing.T) {
+	for _, tc := range []struct {
+		host string
+		ok   bool
+	}{
+		{"unix:///var/run/docker.sock", true},
+		{"tcp://localhost:2375", true},
+		{"ssh://user@host", false},
+		{"localhost:2375", false},
+		{"tcp://", false},
+	} {
+		if _, err := NewDockerClient(tc.host); (err == nil) != tc.ok {
+			t.Errorf("host %q: unexpected result %v", tc.host, err)
+		}
+	}
+	t.Setenv("DOCKER_HOST", "tcp://localhost:2375")
+	if dc, err := NewDockerClient(""); err != nil || dc.(dockerClient).url != "http://localhost:2375" {
+		t.Errorf("expected the client to use DOCKER_HOST")
+	}
+}
+
+// Tests that cancelling the context aborts a blob download in progress and removes the
+// work directory.
+func TestPullToDockerCancel(t *testing.T) {
+	reg := mock.NewHelloWorldRegistry()
+	server, url := mock.ServerWith(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}), reg)
+	defer server.Close()
+	reg.AddFault(mock.Fault{Match: "/blobs/", Delay: time.Second})
+	workDir := t.TempDir()
+	p, err := NewPullerWith(PullerOpts{
+		Url:      fmt.Sprintf("%s/hello-world:latest", url),
+		OStype:   "linux",
+		ArchType: "amd64",
+		Scheme:   "http",
+		WorkDir:  workDir,
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	var files []string
+	engine := httptest.NewServer(dockerEngine(&files, ""))
+	defer engine.Close()
+	dc, err := NewDockerClient(strings.Replace(engine.URL, "http://", "tcp://", 1))
+	if err != nil {
+		t.FailNow()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := p.PullToDocker(ctx, dc); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the pull to be cancelled, got %v", err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("expected the blob download to be aborted")
+	}
+	if entries, err := os.ReadDir(workDir); err != nil || len(entries) != 0 {
+		t.Errorf("expected the work directory to be empty, got %v", entries)
+	}
+	if len(files) != 0 {
+		t.Errorf("expected nothing to be loaded")
+	}
+}
@@ -1,7 +1,9 @@
 package imgpull
 
 import (
+	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -9,12 +11,15 @@ import (
 	"regexp"
 	"slices"
 	"strings"
+	"time"
 
-	"github.com/aceeric/imgpull/internal/imgref"
+	"github.com/aceeric/imgpull/internal/blobsync"
 	"github.com/aceeric/imgpull/internal/methods"
 	"github.com/aceeric/imgpull/internal/tar"
 	"github.com/aceeric/imgpull/internal/util"
 	"github.com/aceeric/imgpull/pkg/imgpull/types"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 // Puller is the interface to the package for pulling images and manifests.
@@ -27,26 +32,138 @@ type Puller interface {
 	// upstream registry: if an image list manifest is available, it will be provided by
 	// the registry. If no image list manifest is available then an image manifest
 	// will be provided by the registry if available. Whatever the registry provides
-	// is returned in a 'ManifestHolder' which holds all four supported manifest types,
+	// is returned in a 'ManifestHolder' which holds all six supported manifest types,
 	// only one of which will be populated.
 	GetManifest() (ManifestHolder, error)
-	// GetManifestByDigest is like GetManifest except uses the passed digest
+	// GetManifestByDigest gets exactly the manifest with the passed digest from the
+	// repository in the receiver, with no platform resolution. This supports a caller that
+	// has inspected an image list manifest and wants a specific child manifest. The digest
+	// can be like 'sha256:abc...', or just the hex part in which case sha256 is assumed.
+	// The manifest returned by the registry must match the digest, else a
+	// '*types.ErrDigestMismatch' is returned.
 	GetManifestByDigest(digest string) (ManifestHolder, error)
+	// GetConfig pulls the config blob of the image manifest in the passed ManifestHolder
+	// and parses it, to get the environment, labels, entrypoint, history, etc. of the image.
+	// An error is returned if the manifest is not an image manifest with a config, e.g. a
+	// manifest list or a schema 1 manifest.
+	GetConfig(mh ManifestHolder) (ocispec.Image, error)
+	// GetImageConfig is like 'GetConfig' but returns the labels, environment variables,
+	// exposed ports, entrypoint, and command of the image in a form that is simpler to
+	// query. See 'ImageConfig'.
+	GetImageConfig(mh ManifestHolder) (ImageConfig, error)
+	// GetRawManifest gets the manifest with the passed tag or digest - or the image in the
+	// receiver if 'tagOrDigest' is empty - with the passed media types in the Accept header. The
+	// manifest is not parsed so this supports media types that the package doesn't model.
+	// If no media types are passed then the types supported by the package are accepted.
+	GetRawManifest(tagOrDigest string, accept ...types.MediaType) (types.RawManifest, error)
+	// Exists does the auth handshake and a HEAD request for the image in the receiver to
+	// check whether the image exists. If the registry responds 404 then the function returns
+	// false with no error. Any other failure, e.g. an auth or network error, is returned
+	// as an error since the existence of the image can't be determined. If the image exists
+	// then its 'ManifestDescriptor' is returned.
+	Exists() (bool, types.ManifestDescriptor, error)
 	// HeadManifest does a HEAD request for the image URL in the receiver. The
 	// 'ManifestDescriptor' returned to the caller contains the image digest,
 	// media type and manifest size, as provided by the upstream distribution
 	// server.
 	HeadManifest() (types.ManifestDescriptor, error)
-	// PullBlobs pulls the blobs for an image, writing them into 'blobDir'.
-	PullBlobs(mh ManifestHolder, blobDir string) error
+	// ListTags returns the tags in the repository of the image URL in the receiver. The tag
+	// and digest in the URL are ignored. If the registry paginates the tag list then all the
+	// pages are fetched. See 'FilterTags', 'SortTagsBySemver' and 'LatestTag' to select
+	// from the returned tags.
+	ListTags() ([]string, error)
+	// Capabilities checks the API version of the registry of the image URL in the receiver
+	// and probes it for optional features: the referrers API, how the tag list is paginated
+	// and, if the receiver has push access, chunked blob uploads. The result is cached in the
+	// receiver so the registry is only probed once. See 'RegistryCapabilities'.
+	Capabilities() (RegistryCapabilities, error)
+	// Watch does a HEAD request for the image URL in the receiver every 'interval' until
+	// the context is done, and calls 'callback' each time the digest changes. The first HEAD
+	// request establishes the current digest and doesn't call the callback. This supports
+	// controllers that update workloads when a tag is moved. Watch returns the context error
+	// when the context is done, or the first error from a HEAD request.
+	Watch(ctx context.Context, interval time.Duration, callback WatchFunc) error
+	// Plan resolves the image url in the receiver to an image manifest, selecting the
+	// platform from an image list, and returns the blobs that a pull would download and
+	// their total size, without downloading them. This supports estimating the size of an
+	// air-gap bundle and pre-flight checks.
+	Plan() (PullPlan, error)
+	// Size resolves the image url in the receiver to an image manifest, like 'Plan', and
+	// returns the compressed size of each layer and the total download size. If
+	// 'uncompressed' is true then the layers are pulled into a work directory and
+	// decompressed to also get their uncompressed sizes.
+	Size(uncompressed bool) (ImageSize, error)
+	// PullArtifact pulls a non-image artifact (e.g. a Helm chart, a WASM module, or any
+	// ORAS artifact) into 'destDir'. The manifest can be an OCI artifact manifest, or an
+	// image manifest with any artifactType or config media type. Each blob is written to
+	// a file named by its 'org.opencontainers.image.title' annotation if present, else by
+	// its digest, and an 'artifact.json' file describing the artifact and its blobs -
+	// including their annotations - is written with them. Like PullBlobs, if the pull fails
+	// then the completely pulled blobs are kept for resuming, and 'artifact.json' isn't written.
+	PullArtifact(destDir string) error
+	// PullBlobs pulls the blobs for an image, writing them into 'blobDir'. If filters are
+	// passed then only the blobs selected by all of the filters are pulled, e.g. 'OnlyConfig()'
+	// to pull just the image config. The diff_ids of a partial pull are not verified. If the
+	// pull fails then the blobs that were completely pulled are kept in 'blobDir', so calling
+	// the function again resumes the pull, but a partially written blob is never kept. All
+	// the blobs are attempted even if some fail, and the error is a '*BatchError' with the
+	// digest and error of each blob that failed. The stats of the pull are returned, with
+	// the blobs that were already in 'blobDir' counted as reused. Like the pulls, the image
+	// is checked against 'MaxImageBytes' and the 'PrePullHook' before any blob is pulled.
+	PullBlobs(mh ManifestHolder, blobDir string, filters ...BlobFilter) (PullStats, error)
 	// PullTar pulls an image tarball from a registry based on the configuration
 	// options in the receiver and writes it to the path/file name specified in the
-	// 'dest' arg.
-	PullTar(dest string) error
+	// 'dest' arg. If the pull fails then neither the tarball nor the work directory
+	// that the blobs were pulled into is left behind. If the options have a 'Sidecar'
+	// then a sidecar file with the digest of the tarball is written next to it, e.g.
+	// '<dest>.sha256', and if the options have a signing key or sign function then a
+	// detached signature of the tarball is written to '<dest>.sig'. The stats of the
+	// pull are returned, e.g. how many bytes were downloaded and how long each phase took.
+	PullTar(dest string) (PullStats, error)
+	// PullLayout is like PullTar except that the image is written as an OCI image layout
+	// directory in 'destDir' - with the blobs in 'blobs/sha256', an 'index.json' referencing
+	// the image manifest, and an 'oci-layout' file - rather than as a tarball. The image
+	// manifest is unchanged so the layout can be pushed with 'PushTar' without changing
+	// the digest of the image. Sidecars and signatures are not written for a layout, so it
+	// is an error if the options have a 'Sidecar', 'SigningKey', or 'Sign'.
+	PullLayout(destDir string) (PullStats, error)
+	// PullRootfs pulls an image and applies its layers in order, honoring whiteouts,
+	// to produce the flattened root filesystem of the image in the 'destDir' directory.
+	PullRootfs(destDir string) error
+	// PullLayer is like PullRootfs except that only the one layer selected by 'layer' is
+	// pulled and applied into 'destDir'. The 'layer' arg is either the digest of the layer
+	// or its position counting from 1 for the bottom layer.
+	PullLayer(layer string, destDir string) error
+	// PullFlatTar is like PullRootfs except the flattened root filesystem is written
+	// as a single uncompressed tarball to the path/file name specified in 'dest'.
+	PullFlatTar(dest string) error
+	// PullToContentStore pulls the image in the receiver into a containerd content store
+	// and image service, as implemented by the passed 'ContentStore'. The config, layers,
+	// image manifest, and image list manifest if there is one, are written with the labels
+	// containerd uses to retain content during garbage collection, and the image is created
+	// or updated to reference the top-level manifest, which is returned. Blobs already in
+	// the store are not pulled. Cancelling the context aborts the pull, including a blob
+	// download in progress, and removes the work directory. Blobs that were written to the
+	// store are kept, so pulling again resumes the pull.
+	PullToContentStore(ctx context.Context, store ContentStore) (ocispec.Descriptor, error)
+	// PullToDocker pulls the image in the receiver and streams it as a 'docker save'
+	// tarball into the Docker Engine using the passed client, without writing the tarball
+	// to the file system. Cancelling the context aborts the pull and removes the work
+	// directory.
+	PullToDocker(ctx context.Context, client DockerClient) error
 	// GetUrl returns the image ref from the receiver
 	GetUrl() string
-	// SetUrl supports reusing a puller with a different image ref.
+	// SetUrl supports reusing a puller with a different image ref. It must not be called
+	// while other goroutines are using the puller. Use WithRef for that. If the repository
+	// changes then a bearer token for the new repository is obtained on the next request.
 	SetUrl(url string) error
+	// Clone returns a copy of the puller, including its auth, that can be used
+	// independently of the receiver.
+	Clone() Puller
+	// WithRef returns a copy of the puller for a different image in the same registry.
+	// The auth in the receiver is kept if the image is in the same repository, so one
+	// authenticated puller can be fanned out across goroutines and images.
+	WithRef(url string) (Puller, error)
 	// GetOpts returns puller options
 	GetOpts() PullerOpts
 	// Close closes the puller
@@ -56,24 +173,49 @@ type Puller interface {
 // HTTP status codes that we will interpret as un-authorized
 var unauth = []int{http.StatusUnauthorized, http.StatusForbidden}
 
-func (p *puller) PullTar(dest string) error {
+func (p *puller) PullTar(dest string) (stats PullStats, err error) {
 	if dest == "" {
-		return fmt.Errorf("no destination specified for pull of %q", p.Opts.Url)
+		return stats, fmt.Errorf("no destination specified for pull of %q", p.Opts.Url)
 	}
-	tmpDir, err := os.MkdirTemp("/tmp", "imgpull.")
+	start := time.Now()
+	defer func() { stats.Duration = time.Since(start) }()
+	finished := p.pullStarted()
+	defer func() { finished(err) }()
+	sign, err := p.Opts.signer()
 	if err != nil {
-		return err
+		return stats, err
 	}
-	defer os.RemoveAll(tmpDir)
-	if itb, err := p.pull(tmpDir); err != nil {
-		return err
-	} else {
-		_, err := itb.ToTar(dest)
-		return err
+	tmpDir, err := p.Opts.newWorkDir()
+	if err != nil {
+		return stats, err
+	}
+	defer func() { err = removeWorkDir(tmpDir, err) }()
+	itb, mh, err := p.pull(context.Background(), tmpDir, &stats)
+	if err != nil {
+		return stats, err
+	}
+	if err := checkDiskSpace(filepath.Dir(dest), layersSize(itb.Layers)); err != nil {
+		return stats, err
+	}
+	writeStart := time.Now()
+	defer func() { stats.WriteDuration = time.Since(writeStart) }()
+	if _, err := itb.ToTar(dest); err != nil {
+		return stats, err
+	}
+	if err := p.Opts.finishFile(dest); err != nil {
+		return stats, err
 	}
+	if err := p.writeSidecars(dest, mh, itb, sign); err != nil {
+		os.Remove(dest)
+		return stats, err
+	}
+	return stats, nil
 }
 
 func (p *puller) GetManifestByType(mpt ManifestPullType) (ManifestHolder, error) {
+	if err := p.checkRef(); err != nil {
+		return ManifestHolder{}, err
+	}
 	if err := p.connect(); err != nil {
 		return ManifestHolder{}, err
 	}
@@ -82,7 +224,7 @@ func (p *puller) GetManifestByType(mpt ManifestPullType) (ManifestHolder, error)
 	if err != nil {
 		return ManifestHolder{}, err
 	}
-	mh, err := newManifestHolder(mr.MediaType, mr.ManifestBytes, mr.ManifestDigest, rc.ImgRef.Url())
+	mh, err := p.manifestHolderFrom(mr, rc.ImgRef.Url(), "")
 	if err != nil {
 		return ManifestHolder{}, err
 	}
@@ -90,7 +232,7 @@ func (p *puller) GetManifestByType(mpt ManifestPullType) (ManifestHolder, error)
 		if mpt == ImageList {
 			return mh, nil
 		}
-		digest, err := mh.GetImageDigestFor(p.Opts.OStype, p.Opts.ArchType)
+		digest, err := mh.GetImageDigestForPlatform(p.Opts.platform())
 		if err != nil {
 			return ManifestHolder{}, err
 		}
@@ -98,53 +240,166 @@ func (p *puller) GetManifestByType(mpt ManifestPullType) (ManifestHolder, error)
 		if err != nil {
 			return ManifestHolder{}, err
 		}
-		mh, err = newManifestHolder(mr.MediaType, mr.ManifestBytes, mr.ManifestDigest, rc.ImgRef.UrlWithDigest(digest))
+		imh, err := p.manifestHolderFrom(mr, rc.ImgRef.UrlWithDigest(digest), mh.descriptorMediaType(digest))
 		if err != nil {
 			return ManifestHolder{}, err
 		}
-		return mh, nil
+		imh.IndexDigest = mh.Digest
+		return imh, nil
 	}
 	// if we get here, then the registry did not have a manifest list and so
 	// it provided an image manifest
 	if mpt == Image {
 		return mh, nil
 	} else {
-		return ManifestHolder{}, fmt.Errorf("server did not provide a manifest for %q", p.ImgRef.Url())
+		return ManifestHolder{}, fmt.Errorf("server did not provide a manifest for %q", rc.ImgRef.Url())
 	}
 }
 
-func (p *puller) PullBlobs(mh ManifestHolder, blobDir string) error {
+func (p *puller) PullBlobs(mh ManifestHolder, blobDir string, filters ...BlobFilter) (PullStats, error) {
+	if err := p.checkRef(); err != nil {
+		return PullStats{}, err
+	}
+	if err := p.prePull(mh, nil); err != nil {
+		return PullStats{}, err
+	}
+	return p.pullBlobs(mh, blobDir, filters...)
+}
+
+// pullBlobs is 'PullBlobs' without the 'MaxImageBytes' and 'PrePullHook' checks, for the
+// methods that have already run them or that only pull the image config.
+func (p *puller) pullBlobs(mh ManifestHolder, blobDir string, filters ...BlobFilter) (stats PullStats, err error) {
+	start := time.Now()
+	defer func() { stats.Duration = time.Since(start) }()
+	if err := p.checkRef(); err != nil {
+		return stats, err
+	}
 	if err := p.connect(); err != nil {
-		return err
+		return stats, err
 	}
 	if err := os.MkdirAll(blobDir, 0755); err != nil {
-		return fmt.Errorf("unable to create directory %q, error: %q", blobDir, err)
+		return stats, fmt.Errorf("unable to create directory %q, error: %q", blobDir, err)
 	}
 	rc := p.regCliFrom()
-	for _, layer := range mh.Layers() {
-		if err := rc.V2Blobs(layer, filepath.Join(blobDir, util.DigestFrom(layer.Digest))); err != nil {
-			return err
+	layers := filterBlobs(mh, filters)
+	var errs []error
+	for _, layer := range layers {
+		toFile := filepath.Join(blobDir, util.DigestFrom(layer.Digest))
+		downloaded, err := p.pullBlob(rc, layer, toFile)
+		if err != nil {
+			errs = append(errs, &BlobError{Digest: layer.Digest, Err: err})
+			continue
 		}
+		stats.addBlob(mh, layer, toFile, downloaded)
 	}
-	return nil
+	stats.DownloadDuration = time.Since(start)
+	if len(errs) != 0 {
+		return stats, &BatchError{Kind: "blobs", Total: len(layers), Errs: errs}
+	}
+	if p.Opts.VerifyDiffIDs && mh.hasConfig() && len(layers) == len(mh.Layers()) {
+		return stats, VerifyDiffIDs(mh, blobDir)
+	}
+	return stats, nil
 }
 
 func (p *puller) HeadManifest() (types.ManifestDescriptor, error) {
+	if err := p.checkRef(); err != nil {
+		return types.ManifestDescriptor{}, err
+	}
 	if err := p.connect(); err != nil {
 		return types.ManifestDescriptor{}, err
 	}
 	return p.regCliFrom().V2ManifestsHead()
 }
 
+func (p *puller) Exists() (bool, types.ManifestDescriptor, error) {
+	if err := p.checkRef(); err != nil {
+		return false, types.ManifestDescriptor{}, err
+	}
+	if err := p.connect(); err != nil {
+		return false, types.ManifestDescriptor{}, err
+	}
+	md, err := p.regCliFrom().V2ManifestsHead()
+	var se *types.ErrStatus
+	if errors.As(err, &se) && se.StatusCode == http.StatusNotFound {
+		return false, types.ManifestDescriptor{}, nil
+	} else if err != nil {
+		return false, types.ManifestDescriptor{}, err
+	}
+	return true, md, nil
+}
+
+func (p *puller) ListTags() ([]string, error) {
+	if err := p.checkRef(); err != nil {
+		return nil, err
+	}
+	if err := p.connect(); err != nil {
+		return nil, err
+	}
+	return p.regCliFrom().V2Tags()
+}
+
 func (p *puller) GetManifest() (ManifestHolder, error) {
 	return p.internalGetManifest("")
 }
 
-func (p *puller) GetManifestByDigest(digest string) (ManifestHolder, error) {
-	return p.internalGetManifest(digest)
+func (p *puller) GetManifestByDigest(dgst string) (ManifestHolder, error) {
+	if !strings.Contains(dgst, ":") {
+		dgst = "sha256:" + dgst
+	}
+	d, err := digest.Parse(dgst)
+	if err != nil {
+		return ManifestHolder{}, fmt.Errorf("invalid digest %q: %w", dgst, err)
+	}
+	if err := p.checkRef(); err != nil {
+		return ManifestHolder{}, err
+	}
+	if err := p.connect(); err != nil {
+		return ManifestHolder{}, err
+	}
+	rc := p.regCliFrom()
+	mr, err := rc.V2Manifests(d.String())
+	if err != nil {
+		return ManifestHolder{}, err
+	}
+	return p.manifestHolderFrom(mr, rc.ImgRef.UrlWithDigest(d.String()), "")
+}
+
+func (p *puller) GetRawManifest(tagOrDigest string, accept ...types.MediaType) (types.RawManifest, error) {
+	if tagOrDigest != "" {
+		r, err := ParseRef(p.GetUrl())
+		if err == nil {
+			if strings.Contains(tagOrDigest, ":") {
+				_, err = r.WithDigest(tagOrDigest)
+			} else {
+				_, err = r.WithTag(tagOrDigest)
+			}
+		}
+		if err != nil {
+			return types.RawManifest{}, err
+		}
+	}
+	if err := p.checkRef(); err != nil {
+		return types.RawManifest{}, err
+	}
+	if err := p.connect(); err != nil {
+		return types.RawManifest{}, err
+	}
+	mr, err := p.regCliFrom().V2ManifestsAccept(tagOrDigest, accept)
+	if err != nil {
+		return types.RawManifest{}, err
+	}
+	return types.RawManifest{
+		MediaType: mr.MediaType,
+		Digest:    "sha256:" + mr.ManifestDigest,
+		Bytes:     mr.ManifestBytes,
+	}, nil
 }
 
 func (p *puller) internalGetManifest(digest string) (ManifestHolder, error) {
+	if err := p.checkRef(); err != nil {
+		return ManifestHolder{}, err
+	}
 	if err := p.connect(); err != nil {
 		return ManifestHolder{}, err
 	}
@@ -153,75 +408,156 @@ func (p *puller) internalGetManifest(digest string) (ManifestHolder, error) {
 	if err != nil {
 		return ManifestHolder{}, err
 	}
-	return newManifestHolder(mr.MediaType, mr.ManifestBytes, mr.ManifestDigest, rc.ImgRef.Url())
+	return p.manifestHolderFrom(mr, rc.ImgRef.Url(), "")
 }
 
 func (p *puller) GetUrl() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	return p.ImgRef.Url()
 }
 
 func (p *puller) SetUrl(url string) error {
-	if ir, err := imgref.NewImageRef(url, p.Opts.Scheme, p.Opts.Namespace); err != nil {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ir, err := p.Opts.imageRef(url); err != nil {
 		return err
 	} else if p.ImgRef.Registry() != ir.Registry() {
 		return fmt.Errorf("incoming registry %s must match existing %s", ir.Registry(), p.ImgRef.Registry())
 	} else {
+		if ir.Repository() != p.ImgRef.Repository() {
+			p.resetScopedAuth()
+		}
 		p.ImgRef = ir
 	}
 	return nil
 }
 
+func (p *puller) Clone() Puller {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.clone()
+}
+
+func (p *puller) WithRef(url string) (Puller, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ir, err := p.Opts.imageRef(url)
+	if err != nil {
+		return nil, err
+	} else if p.ImgRef.Registry() != ir.Registry() {
+		return nil, fmt.Errorf("incoming registry %s must match existing %s", ir.Registry(), p.ImgRef.Registry())
+	}
+	c := p.clone()
+	if ir.Repository() != p.ImgRef.Repository() {
+		c.resetScopedAuth()
+	}
+	c.ImgRef = ir
+	c.Opts.Url = url
+	return c, nil
+}
+
+// resetScopedAuth discards the bearer token in the receiver because bearer tokens are
+// scoped to a repository, so that the receiver connects again for a different repository,
+// getting the token for that repository from the token cache or the token server, rather
+// than sending a token that the registry will reject. The caller must hold the lock.
+func (p *puller) resetScopedAuth() {
+	p.Connected = false
+	p.Token = types.BearerToken{}
+	p.Challenge = types.BearerAuth{}
+}
+
+// clone returns a copy of the receiver. The caller must hold the lock.
+func (p *puller) clone() *puller {
+	return &puller{
+		Opts:      p.Opts,
+		ImgRef:    p.ImgRef,
+		Client:    p.Client,
+		Token:     p.Token,
+		Challenge: p.Challenge,
+		Basic:     p.Basic,
+		ExtToken:  p.ExtToken,
+		Connected: p.Connected,
+		Actions:   p.Actions,
+		caps:      p.caps,
+	}
+}
+
 func (p *puller) GetOpts() PullerOpts {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	return p.Opts
 }
 
 func (p *puller) Close() {
-	if p.Client != nil {
+	// a session's connections are closed by the session
+	if p.Client != nil && p.Opts.Session == nil {
 		p.Client.CloseIdleConnections()
 	}
 }
 
 // pull pulls the image specified in the receiver, saving blobs to the passed 'blobDir'.
-// An 'imageTarball' struct is returned that describes the pulled image. The directory
+// An 'imageTarball' struct is returned that describes the pulled image, along with the
+// image manifest that was pulled. The directory
 // specfied by 'blobDir' will be populated with:
 //
 //  1. The configuration blob
 //  2. The layer blobs.
 //
 // All blobs are saved into this directory with filenames consisting of 64-character digests.
-func (p *puller) pull(blobDir string) (tar.ImageTarball, error) {
+// The manifest and blob phases of the pull are added to the passed stats.
+func (p *puller) pull(ctx context.Context, blobDir string, stats *PullStats) (tar.ImageTarball, ManifestHolder, error) {
+	if err := p.checkRef(); err != nil {
+		return tar.ImageTarball{}, ManifestHolder{}, err
+	}
 	if err := p.connect(); err != nil {
-		return tar.ImageTarball{}, err
+		return tar.ImageTarball{}, ManifestHolder{}, err
 	}
 	rc := p.regCliFrom()
-	mr, err := rc.V2Manifests("")
+	rc.Ctx = ctx
+	start := time.Now()
+	mh, list, err := p.resolveImage(rc)
 	if err != nil {
-		return tar.ImageTarball{}, err
+		return tar.ImageTarball{}, ManifestHolder{}, err
 	}
-	mh, err := newManifestHolder(mr.MediaType, mr.ManifestBytes, mr.ManifestDigest, rc.ImgRef.Url())
-	if err != nil {
-		return tar.ImageTarball{}, err
+	stats.ResolveDuration = time.Since(start)
+	p.manifestResolved(mh)
+	if err := p.prePull(mh, list); err != nil {
+		return tar.ImageTarball{}, ManifestHolder{}, err
 	}
-	if mh.IsManifestList() {
-		digest, err := mh.GetImageDigestFor(p.Opts.OStype, p.Opts.ArchType)
-		if err != nil {
-			return tar.ImageTarball{}, err
-		}
-		mr, err := rc.V2Manifests(digest)
-		if err != nil {
-			return tar.ImageTarball{}, err
-		}
-		mh, err = newManifestHolder(mr.MediaType, mr.ManifestBytes, mr.ManifestDigest, rc.ImgRef.UrlWithDigest(digest))
+	if err := checkDiskSpace(blobDir, layersSize(mh.Layers())); err != nil {
+		return tar.ImageTarball{}, ManifestHolder{}, err
+	}
+	start = time.Now()
+	for _, layer := range mh.Layers() {
+		toFile := filepath.Join(blobDir, util.DigestFrom(layer.Digest))
+		downloaded, err := p.pullBlob(rc, layer, toFile)
 		if err != nil {
-			return tar.ImageTarball{}, err
+			return tar.ImageTarball{}, ManifestHolder{}, err
 		}
+		stats.addBlob(mh, layer, toFile, downloaded)
 	}
-	for _, layer := range mh.Layers() {
-		if err := rc.V2Blobs(layer, filepath.Join(blobDir, util.DigestFrom(layer.Digest))); err != nil {
-			return tar.ImageTarball{}, err
+	stats.DownloadDuration = time.Since(start)
+	if mh, err = p.decryptLayers(mh, blobDir); err != nil {
+		return tar.ImageTarball{}, ManifestHolder{}, err
+	}
+	if p.Opts.VerifyDiffIDs && mh.hasConfig() {
+		if err := VerifyDiffIDs(mh, blobDir); err != nil {
+			return tar.ImageTarball{}, ManifestHolder{}, err
 		}
 	}
-	return mh.newImageTarball(p.ImgRef, blobDir)
+	itb, err := mh.newImageTarball(rc.ImgRef, blobDir)
+	if err != nil {
+		return tar.ImageTarball{}, ManifestHolder{}, err
+	}
+	itb.Reproducible = p.Opts.Reproducible
+	itb.OCILayout = p.Opts.OCILayout
+	if p.Opts.NoRepoTags {
+		itb.RepoTags = nil
+	} else if len(p.Opts.RepoTags) != 0 {
+		itb.RepoTags = p.Opts.RepoTags
+	}
+	return itb, mh, nil
 }
 
 // connect calls the 'v2' endpoint and looks for an auth header. If an auth
@@ -232,18 +568,71 @@ func (p *puller) pull(blobDir string) (tar.ImageTarball, error) {
 // the receiver for all the other API methods to build an auth header with.
 //
 // If the function has already been called on the receiver, it immediately
-// returns taking no action.
+// returns taking no action. If the receiver has a session, and another puller
+// in the session has already authenticated to the same repository, then that
+// auth is used rather than negotiating it again.
 func (p *puller) connect() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	if p.Connected {
 		return nil
-	} else if p.Opts.Token != "" {
+	}
+	if p.Opts.Session == nil {
+		return p.negotiate()
+	}
+	if sa, found := p.Opts.Session.getAuth(p.sessionKey()); found && !sa.token.Expired() {
+		if sa.scheme != p.Opts.Scheme {
+			p.Opts.Scheme = sa.scheme
+			p.ImgRef = p.ImgRef.WithScheme(sa.scheme)
+		}
+		if sa.server != p.ImgRef.Server() {
+			p.ImgRef = p.ImgRef.WithServer(sa.server)
+		}
+		p.Token, p.Basic, p.ExtToken = sa.token, sa.basic, sa.extToken
+		p.Connected = true
+		return nil
+	}
+	if err := p.negotiate(); err != nil {
+		return err
+	}
+	p.saveSessionAuth()
+	return nil
+}
+
+// sessionKey returns the key of the auth for the receiver in its session.
+func (p *puller) sessionKey() sessionKey {
+	return sessionKey{repository: p.ImgRef.Repository(), actions: p.Actions}
+}
+
+// saveSessionAuth saves the auth in the receiver to its session.
+func (p *puller) saveSessionAuth() {
+	p.Opts.Session.setAuth(p.sessionKey(), sessionAuth{
+		scheme:   p.Opts.Scheme,
+		server:   p.ImgRef.Server(),
+		token:    p.Token,
+		basic:    p.Basic,
+		extToken: p.ExtToken,
+	})
+}
+
+// negotiate does the work for 'connect'.
+func (p *puller) negotiate() error {
+	if p.Opts.BearerToken != "" || p.Opts.AuthHeader != "" {
 		// if a token provided from an external source was provided then we
-		// will believe that token is valid and simply use it
-		p.ExtToken.Token = p.Opts.Token
+		// will believe that token is valid and simply use it. But the scheme
+		// still has to be determined for an insecure registry.
+		if p.canFallBack() {
+			if _, _, err := p.manifestsAuth(); err != nil {
+				return err
+			}
+		}
+		if p.Opts.BearerToken != "" {
+			p.Token = types.BearerToken{Token: p.Opts.BearerToken}
+		}
 		p.Connected = true
 		return nil
 	}
-	status, auth, err := p.regCliFrom().V2ManifestsAuth()
+	status, auth, err := p.manifestsAuth()
 	if err != nil {
 		return err
 	}
@@ -252,41 +641,70 @@ func (p *puller) connect() error {
 		if err != nil {
 			return err
 		}
+	} else if p.Opts.Token != "" {
+		p.ExtToken.Token = p.Opts.Token
 	}
 	p.Connected = true
 	return nil
 }
 
+// manifestsAuth makes the initial manifests HEAD request to the upstream. If the request
+// fails and the registry is in the insecure registry allowlist then the receiver is
+// switched to http and the request is retried. If the registry is DockerHub and the
+// request fails or the server responds with a 5xx status then the request is retried
+// with the other DockerHub API hosts, and the receiver keeps the first one that works.
+func (p *puller) manifestsAuth() (int, []string, error) {
+	status, auth, err := p.regClient().V2ManifestsAuth()
+	if err != nil && p.canFallBack() {
+		p.Opts.Scheme = "http"
+		p.ImgRef = p.ImgRef.WithScheme("http")
+		status, auth, err = p.regClient().V2ManifestsAuth()
+	}
+	for err != nil || status >= http.StatusInternalServerError {
+		ir, found := p.ImgRef.FallbackServer()
+		if !found {
+			break
+		}
+		p.ImgRef = ir
+		status, auth, err = p.regClient().V2ManifestsAuth()
+	}
+	return status, auth, err
+}
+
+// canFallBack returns true if the receiver is using https to talk to a registry in the
+// insecure registry allowlist, and so is allowed to fall back to http.
+func (p *puller) canFallBack() bool {
+	return p.Opts.Scheme == "https" && p.Opts.isInsecureRegistry(p.ImgRef.Registry())
+}
+
 // authenticate scans the passed list of auth headers received from a distribution
 // server and attempts to perform authentication for each in the following order:
 //
 //  1. bearer
-//  2. basic (using the user/pass that the puller receiver was initialized from)
+//  2. basic (using the token or user/pass that the puller receiver was initialized from)
 //
 // If successful then the receiver is initialized with the corresponding auth
 // struct so that it is available to be used for all subsequent API calls to the
 // distribution server. For example if 'bearer' then the token received from the
 // remote registry will be added to the receiver.
 func (p *puller) authenticate(auth []string) error {
-	rc := p.regCliFrom()
+	rc := p.regClient()
 	for _, hdr := range auth {
 		if strings.HasPrefix(strings.ToLower(hdr), "bearer") {
-			ba := parseBearer(hdr)
-			encoded := ""
-			if p.Opts.Username != "" && p.Opts.Password != "" {
-				delimited := fmt.Sprintf("%s:%s", p.Opts.Username, p.Opts.Password)
-				encoded = base64.StdEncoding.EncodeToString([]byte(delimited))
-			}
-			bt, err := rc.V2Auth(ba, encoded)
+			p.Challenge = parseBearer(hdr)
+			bt, err := p.bearerToken(rc, false)
 			if err != nil {
 				return err
 			}
 			p.Token = bt
 			return nil
 		} else if strings.HasPrefix(strings.ToLower(hdr), "basic") {
-			delimited := fmt.Sprintf("%s:%s", p.Opts.Username, p.Opts.Password)
-			encoded := base64.StdEncoding.EncodeToString([]byte(delimited))
-			ba, err := rc.V2Basic(encoded)
+			if p.Opts.Token != "" {
+				// an externally provided token is believed to be valid
+				p.ExtToken.Token = p.Opts.Token
+				return nil
+			}
+			ba, err := rc.V2Basic(p.basicCredentials())
 			if err != nil {
 				return err
 			}
@@ -297,6 +715,67 @@ func (p *puller) authenticate(auth []string) error {
 	return fmt.Errorf("unable to parse auth param: %v", auth)
 }
 
+// bearerToken gets a bearer token for the auth challenge in the receiver from the token
+// cache, or from the upstream if it isn't cached. If 'renew' is true then the cached
+// token has been rejected, so it is discarded and a new token is always obtained.
+func (p *puller) bearerToken(rc methods.RegClient, renew bool) (types.BearerToken, error) {
+	encoded := ""
+	if p.Opts.Token != "" || (p.Opts.Username != "" && p.Opts.Password != "") {
+		encoded = p.basicCredentials()
+	}
+	tc := p.Opts.TokenCache
+	if tc == nil {
+		tc = defaultTokenCache
+	}
+	key := newTokenKey(p.ImgRef.Registry(), p.Challenge, rc.Scope(), encoded)
+	if renew {
+		tc.remove(key)
+	} else if bt, found := tc.get(key); found {
+		return bt, nil
+	}
+	bt, err := rc.V2Auth(p.Challenge, encoded)
+	if err != nil {
+		return types.BearerToken{}, err
+	}
+	tc.put(key, bt)
+	return bt, nil
+}
+
+// basicCredentials returns the encoded basic auth credentials in the receiver's options,
+// which are the externally provided token if there is one, and otherwise the username
+// and password. These are sent to the registry for basic auth, and to the token server
+// for bearer auth.
+func (p *puller) basicCredentials() string {
+	if p.Opts.Token != "" {
+		return p.Opts.Token
+	}
+	delimited := fmt.Sprintf("%s:%s", p.Opts.Username, p.Opts.Password)
+	return base64.StdEncoding.EncodeToString([]byte(delimited))
+}
+
+// reauth is called when the upstream rejects the passed auth header for the bearer token
+// in the receiver, which may have expired or been revoked. A new token is obtained and the
+// auth header for the new token is returned. If the token in the receiver was already
+// renewed after the rejected header was created, then the header for the current token is
+// returned without renewing again.
+func (p *puller) reauth(rejected methods.AuthHeader) (methods.AuthHeader, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, v := p.authHdr(); k != "" && (methods.AuthHeader{Key: k, Value: v}) != rejected {
+		return methods.AuthHeader{Key: k, Value: v}, nil
+	}
+	bt, err := p.bearerToken(p.regClient(), true)
+	if err != nil {
+		return methods.AuthHeader{}, err
+	}
+	p.Token = bt
+	if p.Opts.Session != nil {
+		p.saveSessionAuth()
+	}
+	k, v := p.authHdr()
+	return methods.AuthHeader{Key: k, Value: v}, nil
+}
+
 // regCliFrom creates a 'RegClient' from the receiver, consisting of a subset of receiver
 // fields needed to interact with the OCI Distribution Server V2 REST API. It supports
 // a looser coupling of the Puller from actually interacting with the distribution server.
@@ -306,9 +785,23 @@ func (p *puller) authenticate(auth []string) error {
 // that the auth struct in the receiver is initialized by virtue of that call. The auth
 // struct is copied into the returned regClient struct which is used to set auth headers.
 func (p *puller) regCliFrom() methods.RegClient {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.regClient()
+}
+
+// regClient does the work for 'regCliFrom'. The caller must hold the lock.
+func (p *puller) regClient() methods.RegClient {
 	rc := methods.RegClient{
-		ImgRef: p.ImgRef,
-		Client: p.Client,
+		ImgRef:           p.ImgRef,
+		Client:           p.Client,
+		Actions:          p.Actions,
+		MaxManifestBytes: p.Opts.MaxManifestBytes,
+		MaxBlobBytes:     p.Opts.MaxBlobBytes,
+		ManifestCache:    p.Opts.ManifestCache,
+		AcceptTypes:      p.Opts.AcceptTypes,
+		Files:            p.Opts.fileOpts(),
+		MaxRetryAfter:    p.Opts.MaxRetryAfter,
 	}
 	if k, v := p.authHdr(); k != "" {
 		rc.AuthHdr = methods.AuthHeader{
@@ -316,6 +809,14 @@ func (p *puller) regCliFrom() methods.RegClient {
 			Value: v,
 		}
 	}
+	if p.Token != (types.BearerToken{}) && p.Opts.BearerToken == "" {
+		rc.Reauth = p.reauth
+	}
+	if p.Opts.BlobSyncer != nil {
+		rc.Syncer = p.Opts.BlobSyncer
+	} else {
+		rc.Syncer = blobsync.Default()
+	}
 	return rc
 }
 
@@ -1,19 +1,25 @@
 package imgpull
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
+	"runtime"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/aceeric/imgpull/internal/tar"
 	"github.com/aceeric/imgpull/internal/testhelpers"
@@ -246,7 +252,7 @@ func TestPullTarNotFound(t *testing.T) {
 	d, _ := os.MkdirTemp("", "")
 	defer os.RemoveAll(d)
 	tarball := filepath.Join(d, "test.tar")
-	if p.PullTar(tarball) == nil {
+	if _, err := p.PullTar(tarball); err == nil {
 		t.Fail()
 	}
 }
@@ -269,7 +275,7 @@ func TestPullTar(t *testing.T) {
 	d, _ := os.MkdirTemp("", "")
 	defer os.RemoveAll(d)
 	tarball := filepath.Join(d, "test.tar")
-	if p.PullTar(tarball) != nil {
+	if _, err := p.PullTar(tarball); err != nil {
 		t.Fail()
 	}
 	if testhelpers.UntarFile(tarball) != nil {
@@ -287,6 +293,10 @@ func TestPullTar(t *testing.T) {
 		Config:   "sha256:d2c94e258dcb3c5ac2798d32e1249e42ef01cba4841c2234249495f87264ac5a",
 		RepoTags: []string{imgUrl},
 		Layers:   []string{"c1ec31eb59444d78df06a974d155e597c894ab4cda84f08294145e845394988e.tar.gz"},
+		Annotations: map[string]string{
+			AnnotationIndexDigest:    "sha256:e4ccfd825622441dcee5123f9d4a48b2eb8787d858de346106a83f0c745cc255",
+			AnnotationManifestDigest: "sha256:e2fc4e5012d16e7fe466f5291c476431beaa1f9b90a5c2125b493ed28e2aba57",
+		},
 	}
 	if !reflect.DeepEqual(dtmExp, dtmActual[0]) {
 		t.Fail()
@@ -341,6 +351,415 @@ func TestHeadManifest(t *testing.T) {
 	}
 }
 
+// Tests that two reproducible pulls of the same image produce identical tarballs.
+// Tests that a bearer token in the options is sent without the auth handshake.
+func TestBearerTokenPassThrough(t *testing.T) {
+	tokenRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			tokenRequests++
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer frobozz" {
+			w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="test"`, r.Host))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", string(types.V1ociManifestMt))
+		w.Header().Set("Docker-Content-Digest", digest.FromString("frobozz").String())
+	}))
+	defer server.Close()
+	opts := PullerOpts{
+		Url:         fmt.Sprintf("%s/hello-world:latest", strings.TrimPrefix(server.URL, "http://")),
+		Scheme:      "http",
+		OStype:      "linux",
+		ArchType:    "amd64",
+		BearerToken: "frobozz",
+	}
+	p, err := NewPullerWith(opts)
+	if err != nil {
+		t.FailNow()
+	}
+	if _, err := p.HeadManifest(); err != nil || tokenRequests != 0 {
+		t.Errorf("expected the bearer token to be accepted without a token request, got %v", err)
+	}
+	// a rejected token is not renewed
+	opts.BearerToken = "xyzzy"
+	p, _ = NewPullerWith(opts)
+	if _, err := p.HeadManifest(); err == nil || tokenRequests != 0 {
+		t.Errorf("expected the bearer token to be rejected without a token request, got %v", err)
+	}
+	opts.Token = "frobozz"
+	if _, err := NewPullerWith(opts); err == nil {
+		t.Error("expected an error for a token and a bearer token")
+	}
+}
+
+// Tests that an auth header in the options is sent as is without the auth handshake.
+func TestAuthHeaderPassThrough(t *testing.T) {
+	var auth []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization"))
+		if r.Header.Get("Authorization") != "Proxy frobozz" {
+			w.Header().Set("Www-Authenticate", "Basic")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", string(types.V1ociManifestMt))
+		w.Header().Set("Docker-Content-Digest", digest.FromString("frobozz").String())
+	}))
+	defer server.Close()
+	p, err := NewPullerWith(PullerOpts{
+		Url:        fmt.Sprintf("%s/hello-world:latest", strings.TrimPrefix(server.URL, "http://")),
+		Scheme:     "http",
+		OStype:     "linux",
+		ArchType:   "amd64",
+		Username:   "jqpubli",
+		Password:   "xyzzy",
+		AuthHeader: "Proxy frobozz",
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	if _, err := p.HeadManifest(); err != nil || len(auth) != 1 {
+		t.Errorf("expected one request with the auth header, got %v %v", auth, err)
+	}
+}
+
+func TestPullTarReproducible(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	p, err := NewPullerWith(PullerOpts{
+		Url:          fmt.Sprintf("%s/hello-world:latest", url),
+		OStype:       "linux",
+		ArchType:     "amd64",
+		Scheme:       "http",
+		Reproducible: true,
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	d := t.TempDir()
+	var tarballs [][]byte
+	for i := range 2 {
+		tarball := filepath.Join(d, fmt.Sprintf("test%d.tar", i))
+		if _, err := p.PullTar(tarball); err != nil {
+			t.FailNow()
+		}
+		b, err := os.ReadFile(tarball)
+		if err != nil {
+			t.FailNow()
+		}
+		tarballs = append(tarballs, b)
+		if i == 0 {
+			// so that the blobs of the second pull have a different modification time
+			time.Sleep(time.Second)
+		}
+	}
+	if digest.FromBytes(tarballs[0]) != digest.FromBytes(tarballs[1]) {
+		t.Error("expected identical tarballs")
+	}
+}
+
+// Tests that a tarball with the OCI image layout has the pulled image manifest, so its
+// digest is preserved.
+func TestPullTarOCILayout(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	p, err := NewPullerWith(PullerOpts{
+		Url:       fmt.Sprintf("%s/hello-world:latest", url),
+		OStype:    "linux",
+		ArchType:  "amd64",
+		Scheme:    "http",
+		OCILayout: true,
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	d := t.TempDir()
+	tarball := filepath.Join(d, "test.tar")
+	if _, err := p.PullTar(tarball); err != nil {
+		t.Fatalf("pull tar: %s", err)
+	}
+	extracted := filepath.Join(d, "extracted")
+	if tar.UntarDir(tarball, extracted) != nil {
+		t.FailNow()
+	}
+	index, err := os.ReadFile(filepath.Join(extracted, "index.json"))
+	if err != nil {
+		t.FailNow()
+	}
+	manifestDigest := "sha256:e2fc4e5012d16e7fe466f5291c476431beaa1f9b90a5c2125b493ed28e2aba57"
+	if !strings.Contains(string(index), manifestDigest) {
+		t.Errorf("index.json doesn't reference the image manifest: %s", string(index))
+	}
+	manifest, err := os.ReadFile(filepath.Join(extracted, "blobs", "sha256", util.DigestFrom(manifestDigest)))
+	if err != nil || digest.FromBytes(manifest).String() != manifestDigest {
+		t.Errorf("image manifest missing from the tarball")
+	}
+}
+
+// Tests the repo tags in the tarball manifest for the default, overridden, and omitted
+// tags, and for a pull by digest.
+func TestPullTarRepoTags(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	byTag := fmt.Sprintf("%s/hello-world:latest", url)
+	byDigest := fmt.Sprintf("%s/hello-world@sha256:e2fc4e5012d16e7fe466f5291c476431beaa1f9b90a5c2125b493ed28e2aba57", url)
+	for _, tc := range []struct {
+		url        string
+		repoTags   []string
+		noRepoTags bool
+		expected   []string
+	}{
+		{byTag, nil, false, []string{byTag}},
+		{byTag, []string{"docker.io/hello-world:latest", "hello-world:v1"}, false, []string{"docker.io/hello-world:latest", "hello-world:v1"}},
+		{byTag, nil, true, nil},
+		{byDigest, nil, false, nil},
+		{byDigest, []string{"hello-world:v1"}, false, []string{"hello-world:v1"}},
+	} {
+		p, err := NewPullerWith(PullerOpts{
+			Url:        tc.url,
+			OStype:     "linux",
+			ArchType:   "amd64",
+			Scheme:     "http",
+			RepoTags:   tc.repoTags,
+			NoRepoTags: tc.noRepoTags,
+		})
+		if err != nil {
+			t.FailNow()
+		}
+		d := t.TempDir()
+		tarball := filepath.Join(d, "test.tar")
+		if _, err := p.PullTar(tarball); err != nil {
+			t.Fatalf("pull tar: %s", err)
+		}
+		if testhelpers.UntarFile(tarball) != nil {
+			t.FailNow()
+		}
+		manifest, err := os.ReadFile(filepath.Join(d, "manifest.json.extracted"))
+		if err != nil {
+			t.FailNow()
+		}
+		dtm := []tar.DockerTarManifest{}
+		if json.Unmarshal(manifest, &dtm) != nil || !reflect.DeepEqual(dtm[0].RepoTags, tc.expected) {
+			t.Errorf("expected repo tags %v, got %s", tc.expected, string(manifest))
+		}
+	}
+}
+
+// Tests that the digest of the manifest list an image is selected from is in the
+// manifest holder and in the tarball, and that an image pulled by digest has none.
+func TestPullTarIndexDigest(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	child := "sha256:e2fc4e5012d16e7fe466f5291c476431beaa1f9b90a5c2125b493ed28e2aba57"
+	p, err := NewPullerWith(PullerOpts{
+		Url:      fmt.Sprintf("%s/hello-world:latest", url),
+		OStype:   "linux",
+		ArchType: "amd64",
+		Scheme:   "http",
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	list, err := p.GetManifestByType(ImageList)
+	if err != nil {
+		t.FailNow()
+	}
+	mh, err := p.GetManifestByType(Image)
+	if err != nil || "sha256:"+mh.Digest != child || mh.IndexDigest != list.Digest {
+		t.Errorf("expected index digest %q, got %q", list.Digest, mh.IndexDigest)
+	}
+	for _, tc := range []struct {
+		url       string
+		ociLayout bool
+		expected  map[string]string
+	}{
+		{fmt.Sprintf("%s/hello-world:latest", url), false, map[string]string{AnnotationIndexDigest: "sha256:" + list.Digest, AnnotationManifestDigest: child}},
+		{fmt.Sprintf("%s/hello-world:latest", url), true, map[string]string{AnnotationIndexDigest: "sha256:" + list.Digest, AnnotationManifestDigest: child}},
+		{fmt.Sprintf("%s/hello-world@%s", url, child), false, nil},
+	} {
+		p, err := NewPullerWith(PullerOpts{
+			Url:       tc.url,
+			OStype:    "linux",
+			ArchType:  "amd64",
+			Scheme:    "http",
+			OCILayout: tc.ociLayout,
+		})
+		if err != nil {
+			t.FailNow()
+		}
+		d := t.TempDir()
+		tarball := filepath.Join(d, "test.tar")
+		if _, err := p.PullTar(tarball); err != nil {
+			t.Fatalf("pull tar: %s", err)
+		}
+		extracted := filepath.Join(d, "extracted")
+		if tar.UntarDir(tarball, extracted) != nil {
+			t.FailNow()
+		}
+		manifest, err := os.ReadFile(filepath.Join(extracted, "manifest.json"))
+		if err != nil {
+			t.FailNow()
+		}
+		dtm := []tar.DockerTarManifest{}
+		if json.Unmarshal(manifest, &dtm) != nil || !reflect.DeepEqual(dtm[0].Annotations, tc.expected) {
+			t.Errorf("expected annotations %v, got %s", tc.expected, string(manifest))
+		}
+		if !tc.ociLayout {
+			continue
+		}
+		index, err := os.ReadFile(filepath.Join(extracted, "index.json"))
+		if err != nil {
+			t.FailNow()
+		}
+		for key, val := range tc.expected {
+			if !strings.Contains(string(index), fmt.Sprintf("%q:%q", key, val)) {
+				t.Errorf("expected annotation %s=%s in index.json: %s", key, val, string(index))
+			}
+		}
+	}
+}
+
+// Tests getting a child manifest of an image list by digest, with and without the
+// digest algorithm, and that invalid digests and content that doesn't match the digest
+// are rejected.
+func TestGetManifestByDigest(t *testing.T) {
+	child := "e2fc4e5012d16e7fe466f5291c476431beaa1f9b90a5c2125b493ed28e2aba57"
+	reg := mock.NewHelloWorldRegistry()
+	mp := mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{})
+	server, url := mock.ServerWith(mp, reg)
+	defer server.Close()
+	p, err := NewPullerWith(PullerOpts{
+		Url:      fmt.Sprintf("%s/hello-world:latest", url),
+		OStype:   "linux",
+		ArchType: "arm64",
+		Scheme:   "http",
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	for _, dgst := range []string{"sha256:" + child, child} {
+		mh, err := p.GetManifestByDigest(dgst)
+		if err != nil {
+			t.Fatalf("get manifest %s: %s", dgst, err)
+		}
+		if mh.Type != V1ociManifest || mh.Digest != child {
+			t.Errorf("get manifest %s: got %s %s", dgst, mh.MediaType(), mh.Digest)
+		}
+		if mh.ImageUrl != fmt.Sprintf("%s/hello-world@sha256:%s", url, child) {
+			t.Errorf("unexpected image url %s", mh.ImageUrl)
+		}
+	}
+	for _, dgst := range []string{"sha256:frobozz", "sha256:"} {
+		if _, err := p.GetManifestByDigest(dgst); err == nil {
+			t.Errorf("expected an error for digest %q", dgst)
+		}
+	}
+	// serve other content under a digest the content doesn't have
+	wrong := strings.Repeat("a", 64)
+	reg.AddManifest("hello-world", "sha256:"+wrong, string(types.V1ociManifestMt), []byte(`{"schemaVersion":2}`))
+	var dme *types.ErrDigestMismatch
+	if _, err := p.GetManifestByDigest(wrong); !errors.As(err, &dme) || dme.Expected != "sha256:"+wrong {
+		t.Errorf("expected a digest mismatch for content that doesn't match the digest, got %v", err)
+	}
+	// and when the digest is in the image url
+	p, err = NewPullerWith(PullerOpts{
+		Url:      fmt.Sprintf("%s/hello-world@sha256:%s", url, wrong),
+		OStype:   "linux",
+		ArchType: "arm64",
+		Scheme:   "http",
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	if _, err := p.GetManifest(); !errors.As(err, &dme) {
+		t.Errorf("expected a digest mismatch pulling by digest, got %v", err)
+	}
+}
+
+// Tests getting manifests unparsed, including a media type the package doesn't model.
+func TestGetRawManifest(t *testing.T) {
+	mediaType := types.MediaType("application/vnd.example.manifest.v9+json")
+	reg := mock.NewHelloWorldRegistry()
+	manifest := []byte(`{"schemaVersion":9}`)
+	dgst := reg.AddManifest("hello-world", "v9", string(mediaType), manifest)
+	server, url := mock.ServerWith(mock.NewMockParams(mock.BEARER, mock.NOTLS, mock.CertSetup{}), reg)
+	defer server.Close()
+	opts := NewPullerOpts(fmt.Sprintf("%s/hello-world:latest", url))
+	opts.Scheme = "http"
+	p, err := NewPullerWith(opts)
+	if err != nil {
+		t.FailNow()
+	}
+	for _, ref := range []string{"v9", dgst} {
+		rm, err := p.GetRawManifest(ref, mediaType)
+		if err != nil {
+			t.Fatalf("get manifest %s: %s", ref, err)
+		}
+		if rm.MediaType != mediaType || rm.Digest != dgst || string(rm.Bytes) != string(manifest) {
+			t.Errorf("get manifest %s: unexpected manifest %+v", ref, rm)
+		}
+	}
+	rm, err := p.GetRawManifest("")
+	if err != nil || rm.MediaType != types.V1ociIndexMt {
+		t.Errorf("get manifest for the receiver: %+v %v", rm, err)
+	}
+	for _, ref := range []string{"sha256:frobozz", "../v9", "-v9"} {
+		if _, err := p.GetRawManifest(ref); err == nil {
+			t.Errorf("expected an error for %q", ref)
+		}
+	}
+}
+
+// Tests that Exists distinguishes an image that doesn't exist from auth and network errors.
+func TestExists(t *testing.T) {
+	mp := mock.NewMockParams(mock.BASIC, mock.NOTLS, mock.CertSetup{})
+	mp.Username, mp.Password = "foo", "bar"
+	server, url := mock.Server(mp)
+	defer server.Close()
+	for _, tc := range []struct {
+		image    string
+		password string
+		exists   bool
+		err      bool
+	}{
+		{"hello-world:latest", "bar", true, false},
+		{"hello-world@sha256:e2fc4e5012d16e7fe466f5291c476431beaa1f9b90a5c2125b493ed28e2aba57", "bar", true, false},
+		{"hello-world:nosuchtag", "bar", false, false},
+		{"hello-world:latest", "baz", false, true},
+	} {
+		p, err := NewPullerWith(PullerOpts{
+			Url:      fmt.Sprintf("%s/%s", url, tc.image),
+			OStype:   "linux",
+			ArchType: "amd64",
+			Scheme:   "http",
+			Username: "foo",
+			Password: tc.password,
+		})
+		if err != nil {
+			t.FailNow()
+		}
+		exists, md, err := p.Exists()
+		if exists != tc.exists || (err != nil) != tc.err {
+			t.Errorf("%s: expected exists %t and error %t, got %t and %v", tc.image, tc.exists, tc.err, exists, err)
+		}
+		if exists && md.Digest == "" {
+			t.Errorf("%s: expected a manifest descriptor", tc.image)
+		}
+	}
+	// a network error
+	server.Close()
+	p, err := NewPullerWith(PullerOpts{Url: fmt.Sprintf("%s/hello-world:latest", url), OStype: "linux", ArchType: "amd64", Scheme: "http"})
+	if err != nil {
+		t.FailNow()
+	}
+	if exists, _, err := p.Exists(); exists || err == nil {
+		t.Error("expected an error when the registry is unreachable")
+	}
+}
+
 // Tests the 'PullBlobs' function
 func TestPullBlobs(t *testing.T) {
 	mp := mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{})
@@ -375,3 +794,449 @@ func TestPullBlobs(t *testing.T) {
 		}
 	}
 }
+
+// Tests that the file options are applied to pulled blobs and tarballs.
+func TestPullFileOpts(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix permissions")
+	}
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	p, err := NewPullerWith(PullerOpts{
+		Url:       fmt.Sprintf("%s/hello-world:latest", url),
+		OStype:    "linux",
+		ArchType:  "amd64",
+		Scheme:    "http",
+		FileMode:  0640,
+		FileOwner: fmt.Sprintf(":%d", os.Getgid()),
+		Fsync:     true,
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	d := t.TempDir()
+	tarball := filepath.Join(d, "hello-world.tar")
+	if _, err := p.PullTar(tarball); err != nil {
+		t.Fatalf("pull tar: %s", err)
+	}
+	mh, err := p.GetManifestByType(Image)
+	if err != nil {
+		t.FailNow()
+	}
+	blobDir := filepath.Join(d, "blobs")
+	if _, err := p.PullBlobs(mh, blobDir); err != nil {
+		t.Fatalf("pull blobs: %s", err)
+	}
+	files := []string{tarball}
+	for _, layer := range mh.Layers() {
+		files = append(files, filepath.Join(blobDir, util.DigestFrom(layer.Digest)))
+	}
+	for _, file := range files {
+		if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0640 {
+			t.Errorf("expected %q to have mode 0640, got %v", file, info.Mode())
+		}
+	}
+}
+
+// Tests that when a blob download is cut short, the partial blob is removed and the
+// blobs that were completely pulled are kept, so pulling again only pulls the rest.
+func TestPullBlobsResume(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	layer := "d2c94e258dcb3c5ac2798d32e1249e42ef01cba4841c2234249495f87264ac5a"
+	config := "c1ec31eb59444d78df06a974d155e597c894ab4cda84f08294145e845394988e"
+	// the config is pulled before the layer
+	rt := &truncatingTransport{truncate: layer}
+	p, err := NewPullerWith(PullerOpts{
+		Url:       fmt.Sprintf("%s/hello-world:latest", url),
+		OStype:    "linux",
+		ArchType:  "amd64",
+		Scheme:    "http",
+		Transport: rt,
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	mh, err := p.GetManifestByType(Image)
+	if err != nil {
+		t.FailNow()
+	}
+	d := t.TempDir()
+	if _, err := p.PullBlobs(mh, d); err == nil {
+		t.Fatalf("expected the truncated blob to fail the pull")
+	}
+	if _, err := os.Stat(filepath.Join(d, config)); err != nil {
+		t.Errorf("expected the completely pulled blob to be kept")
+	}
+	if _, err := os.Stat(filepath.Join(d, layer)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the partial blob to be removed")
+	}
+	rt.truncate, rt.blobs = "", nil
+	if _, err := p.PullBlobs(mh, d); err != nil {
+		t.Fatalf("resume: %s", err)
+	}
+	if len(rt.blobs) != 1 || !strings.HasSuffix(rt.blobs[0], layer) {
+		t.Errorf("expected only the missing blob to be pulled, got %v", rt.blobs)
+	}
+}
+
+// Tests that all the blobs are attempted, and that the error identifies every blob
+// that failed.
+func TestPullBlobsErrors(t *testing.T) {
+	reg := mock.NewHelloWorldRegistry()
+	server, url := mock.ServerWith(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}), reg)
+	defer server.Close()
+	p, err := NewPullerWith(PullerOpts{
+		Url:      fmt.Sprintf("%s/hello-world:latest", url),
+		OStype:   "linux",
+		ArchType: "amd64",
+		Scheme:   "http",
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	mh, err := p.GetManifestByType(Image)
+	if err != nil {
+		t.FailNow()
+	}
+	reg.AddFault(mock.Fault{Match: "/blobs/", Status: http.StatusInternalServerError})
+	_, err = p.PullBlobs(mh, t.TempDir())
+	var be *BatchError
+	if !errors.As(err, &be) || be.Kind != "blobs" || be.Total != 2 || len(be.Errs) != 2 {
+		t.Fatalf("expected a batch error with two failed blobs, got %v", err)
+	}
+	for i, layer := range filterBlobs(mh, nil) {
+		var blobErr *BlobError
+		if !errors.As(be.Errs[i], &blobErr) || blobErr.Digest != layer.Digest {
+			t.Errorf("expected an error for blob %s, got %v", layer.Digest, be.Errs[i])
+		}
+	}
+}
+
+// truncatingTransport records the blob requests made through it, and cuts the body of
+// the blob with the 'truncate' digest in half.
+type truncatingTransport struct {
+	truncate string
+	blobs    []string
+}
+
+func (tt *truncatingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err != nil || !strings.Contains(r.URL.Path, "/blobs/") {
+		return resp, err
+	}
+	tt.blobs = append(tt.blobs, r.URL.Path)
+	if tt.truncate == "" || !strings.HasSuffix(r.URL.Path, tt.truncate) {
+		return resp, nil
+	}
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(b[:len(b)/2]))
+	return resp, nil
+}
+
+func TestPullRootfs(t *testing.T) {
+	mp := mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{})
+	server, url := mock.Server(mp)
+	defer server.Close()
+	p, err := NewPullerWith(PullerOpts{
+		Url:      fmt.Sprintf("%s/hello-world:latest", url),
+		OStype:   "linux",
+		ArchType: "amd64",
+		Scheme:   "http",
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+	if err := p.PullRootfs(filepath.Join(d, "rootfs")); err != nil {
+		t.FailNow()
+	}
+	if fi, err := os.Stat(filepath.Join(d, "rootfs", "hello")); err != nil || fi.Size() == 0 {
+		t.Fail()
+	}
+	if err := p.PullFlatTar(filepath.Join(d, "flat.tar")); err != nil {
+		t.FailNow()
+	}
+	if _, err := os.Stat(filepath.Join(d, "flat.tar")); err != nil {
+		t.Fail()
+	}
+}
+
+func TestPullLayer(t *testing.T) {
+	mp := mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{})
+	server, url := mock.Server(mp)
+	defer server.Close()
+	p, err := NewPullerWith(PullerOpts{
+		Url:      fmt.Sprintf("%s/hello-world:latest", url),
+		OStype:   "linux",
+		ArchType: "amd64",
+		Scheme:   "http",
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+	for i, tc := range []struct {
+		layer string
+		ok    bool
+	}{
+		{"1", true},
+		{"sha256:c1ec31eb59444d78df06a974d155e597c894ab4cda84f08294145e845394988e", true},
+		{"0", false},
+		{"2", false},
+		// the config is not a layer
+		{"sha256:d2c94e258dcb3c5ac2798d32e1249e42ef01cba4841c2234249495f87264ac5a", false},
+	} {
+		destDir := filepath.Join(d, strconv.Itoa(i))
+		if err := p.PullLayer(tc.layer, destDir); (err == nil) != tc.ok {
+			t.Errorf("layer %q: unexpected result %v", tc.layer, err)
+			continue
+		}
+		if !tc.ok {
+			continue
+		}
+		if fi, err := os.Stat(filepath.Join(destDir, "hello")); err != nil || fi.Size() == 0 {
+			t.Errorf("layer %q: expected the hello file to be extracted", tc.layer)
+		}
+	}
+}
+
+func TestVerifyDiffIDs(t *testing.T) {
+	mp := mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{})
+	server, url := mock.Server(mp)
+	defer server.Close()
+	p, err := NewPullerWith(PullerOpts{
+		Url:           fmt.Sprintf("%s/hello-world:latest", url),
+		OStype:        "linux",
+		ArchType:      "amd64",
+		Scheme:        "http",
+		VerifyDiffIDs: true,
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	mh, err := p.GetManifestByDigest("sha256:e2fc4e5012d16e7fe466f5291c476431beaa1f9b90a5c2125b493ed28e2aba57")
+	if err != nil {
+		t.FailNow()
+	}
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+	if _, err := p.PullBlobs(mh, d); err != nil {
+		t.FailNow()
+	}
+	// a layer with the same compressed digest can't be faked so simulate tampering
+	// after the pull by replacing the layer with different content
+	layer := filepath.Join(d, util.DigestFrom(mh.Layers()[0].Digest))
+	if err := os.WriteFile(layer, []byte("frobozz"), 0644); err != nil {
+		t.FailNow()
+	}
+	if VerifyDiffIDs(mh, d) == nil {
+		t.Fail()
+	}
+}
+
+// Tests that https falls back to http only for registries in the insecure registry
+// allowlist.
+func TestInsecureRegistryFallback(t *testing.T) {
+	for _, at := range []mock.AuthType{mock.NONE, mock.BEARER} {
+		server, url := mock.Server(mock.NewMockParams(at, mock.NOTLS, mock.CertSetup{}))
+		defer server.Close()
+		for _, allow := range []bool{false, true} {
+			opts := PullerOpts{
+				Url:      fmt.Sprintf("%s/hello-world:latest", url),
+				Scheme:   "https",
+				OStype:   "linux",
+				ArchType: "amd64",
+			}
+			if allow {
+				opts.InsecureRegistries = []string{url}
+			}
+			p, err := NewPullerWith(opts)
+			if err != nil {
+				t.FailNow()
+			}
+			_, err = p.GetManifestByType(Image)
+			if allow && (err != nil || p.GetOpts().Scheme != "http") {
+				t.Fail()
+			} else if !allow && err == nil {
+				t.Fail()
+			}
+		}
+	}
+}
+
+// Tests mTLS with the client cert, key, and CA provided as in-memory PEM.
+func TestPullManifestPEM(t *testing.T) {
+	certSetup, err := mock.NewCertSetup()
+	if err != nil {
+		t.FailNow()
+	}
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.MTLS_SECURE, certSetup))
+	defer server.Close()
+	p, err := NewPullerWith(PullerOpts{
+		Url:        fmt.Sprintf("%s/hello-world:latest", url),
+		Scheme:     "https",
+		OStype:     "linux",
+		ArchType:   "amd64",
+		TlsCertPEM: certSetup.ClientCertPEM.Bytes(),
+		TlsKeyPEM:  certSetup.ClientCertPrivKeyPEM.Bytes(),
+		CaCertPEM:  certSetup.CaPEM.Bytes(),
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	if _, err := p.GetManifestByType(Image); err != nil {
+		t.Fail()
+	}
+	_, err = NewPullerWith(PullerOpts{
+		Url:       fmt.Sprintf("%s/hello-world:latest", url),
+		Scheme:    "https",
+		OStype:    "linux",
+		ArchType:  "amd64",
+		CaCertPEM: []byte("not a cert"),
+	})
+	if err == nil {
+		t.Fail()
+	}
+}
+
+// Tests that a DockerHub pull falls back to the other DockerHub API host when the
+// first one fails, and that the host that worked is used for the rest of the pull.
+func TestDockerHubFallback(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	rt := &dockerHubTransport{mockHost: url, hosts: map[string]int{}}
+	p, err := NewPullerWith(PullerOpts{
+		Url:       "docker.io/hello-world:latest",
+		Scheme:    "http",
+		OStype:    "linux",
+		ArchType:  "amd64",
+		Transport: rt,
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	if _, err := p.GetManifestByType(Image); err != nil {
+		t.Fatalf("expected the pull to fall back: %s", err)
+	}
+	if rt.hosts["index.docker.io"] != 1 || rt.hosts["registry-1.docker.io"] < 2 {
+		t.Errorf("unexpected requests by host %v", rt.hosts)
+	}
+}
+
+// dockerHubTransport fails requests to index.docker.io and sends requests to
+// registry-1.docker.io to the mock server.
+type dockerHubTransport struct {
+	mockHost string
+	hosts    map[string]int
+}
+
+func (dt *dockerHubTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	dt.hosts[r.URL.Host]++
+	if r.URL.Host != "registry-1.docker.io" {
+		return nil, fmt.Errorf("connection refused")
+	}
+	r = r.Clone(r.Context())
+	r.URL.Host = dt.mockHost
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// TestExternalRealm pulls from registries whose bearer realm is a token server on another
+// host that requires mTLS and basic auth, to verify that the client cert and credentials
+// are sent to the realm, including when the registry itself is accessed over http.
+func TestExternalRealm(t *testing.T) {
+	certSetup, err := mock.NewCertSetup()
+	if err != nil {
+		t.FailNow()
+	}
+	d := t.TempDir()
+	tp := mock.NewMockParams(mock.BEARER, mock.MTLS_SECURE, certSetup)
+	tp.Username, tp.Password = "foobar", "frobozz"
+	tokenServer, tokenUrl := mock.TokenServer(tp)
+	defer tokenServer.Close()
+	for _, tt := range []mock.TlsType{mock.NOTLS, mock.ONEWAY_SECURE} {
+		mp := mock.NewMockParams(mock.BEARER, tt, certSetup)
+		mp.Realm = tokenUrl + "/token"
+		server, url := mock.Server(mp)
+		defer server.Close()
+		for _, tst := range []struct {
+			password string
+			cert     bool
+			succeed  bool
+		}{
+			{"frobozz", true, true},
+			{"xyzzy", true, false},
+			{"frobozz", false, false},
+		} {
+			opts := PullerOpts{
+				Url:      fmt.Sprintf("%s/hello-world:latest", url),
+				Scheme:   string(mp.Scheme),
+				OStype:   "linux",
+				ArchType: "amd64",
+				Username: "foobar",
+				Password: tst.password,
+				CaCert:   certSetup.CaToFile(d, "ca.crt"),
+				// don't get a token cached by a previous case
+				TokenCache: NewTokenCache(),
+			}
+			if tst.cert {
+				opts.TlsCert = certSetup.ClientCertToFile(d, "client.crt")
+				opts.TlsKey = certSetup.ClientCertPrivKeyToFile(d, "client.key")
+			}
+			p, err := NewPullerWith(opts)
+			if err != nil {
+				t.FailNow()
+			}
+			if _, err := p.GetManifest(); (err == nil) != tst.succeed {
+				t.Errorf("%s %+v: expected success %t, got %v", mp.Scheme, tst, tst.succeed, err)
+			}
+		}
+	}
+}
+
+// TestRealmCredentials verifies that the username and password, or an externally
+// provided token, are sent as basic auth on the bearer token request.
+func TestRealmCredentials(t *testing.T) {
+	tp := mock.NewMockParams(mock.BEARER, mock.NOTLS, mock.CertSetup{})
+	tp.Username, tp.Password = "foobar", "frobozz"
+	tokenServer, tokenUrl := mock.TokenServer(tp)
+	defer tokenServer.Close()
+	mp := mock.NewMockParams(mock.BEARER, mock.NOTLS, mock.CertSetup{})
+	mp.Realm = tokenUrl + "/token"
+	server, url := mock.Server(mp)
+	defer server.Close()
+	for _, tst := range []struct {
+		username string
+		password string
+		token    string
+		succeed  bool
+	}{
+		{"foobar", "frobozz", "", true},
+		{"", "", base64.StdEncoding.EncodeToString([]byte("foobar:frobozz")), true},
+		{"foobar", "xyzzy", "", false},
+		{"", "", "", false},
+	} {
+		p, err := NewPullerWith(PullerOpts{
+			Url:        fmt.Sprintf("%s/hello-world:latest", url),
+			Scheme:     "http",
+			OStype:     "linux",
+			ArchType:   "amd64",
+			Username:   tst.username,
+			Password:   tst.password,
+			Token:      tst.token,
+			TokenCache: NewTokenCache(),
+		})
+		if err != nil {
+			t.FailNow()
+		}
+		if _, err := p.GetManifest(); (err == nil) != tst.succeed {
+			t.Errorf("%+v: expected success %t, got %v", tst, tst.succeed, err)
+		}
+	}
+}
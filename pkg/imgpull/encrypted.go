@@ -0,0 +1,115 @@
+package imgpull
+
+import (
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/aceeric/imgpull/internal/layercrypt"
+	"github.com/aceeric/imgpull/internal/util"
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+	"github.com/opencontainers/go-digest"
+)
+
+// encAnnotationPrefix is the prefix of the OCIcrypt layer descriptor annotations
+const encAnnotationPrefix = "org.opencontainers.image.enc."
+
+// hasEncryptedLayers returns true if the image manifest in the receiver has any layers that
+// were encrypted with OCIcrypt.
+func (mh *ManifestHolder) hasEncryptedLayers() bool {
+	return slices.ContainsFunc(mh.Layers(), func(l types.Layer) bool {
+		return l.MediaType.IsEncrypted()
+	})
+}
+
+// decryptLayers decrypts the encrypted layers of the image manifest in the passed
+// ManifestHolder, which must already be in 'blobDir', with the decryption keys in the
+// receiver's options. The decrypted layers are written to 'blobDir' and a ManifestHolder
+// with a manifest that references the decrypted layers is returned. If the image has no
+// encrypted layers then the passed ManifestHolder is returned.
+func (p *puller) decryptLayers(mh ManifestHolder, blobDir string) (ManifestHolder, error) {
+	if !mh.hasEncryptedLayers() {
+		return mh, nil
+	}
+	if len(p.Opts.DecryptionKeys) == 0 {
+		return ManifestHolder{}, fmt.Errorf("image %q has encrypted layers and no decryption keys were provided", mh.ImageUrl)
+	}
+	keys := make([]crypto.PrivateKey, len(p.Opts.DecryptionKeys))
+	for i, path := range p.Opts.DecryptionKeys {
+		key, err := loadPrivateKey(path)
+		if err != nil {
+			return ManifestHolder{}, err
+		}
+		keys[i] = key
+	}
+	// decrypt decrypts one layer and updates its descriptor fields
+	decrypt := func(mediaType *string, dgst *string, size *int64, annotations *map[string]string) error {
+		if !types.MediaType(*mediaType).IsEncrypted() {
+			return nil
+		}
+		src := filepath.Join(blobDir, util.DigestFrom(*dgst))
+		tmp := src + ".decrypted"
+		decrypted, n, err := layercrypt.Decrypt(src, tmp, *annotations, keys)
+		if err != nil {
+			return fmt.Errorf("unable to decrypt layer %s of %q, error: %w", *dgst, mh.ImageUrl, err)
+		}
+		if err := p.Opts.finishFile(tmp); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, filepath.Join(blobDir, util.DigestFrom(decrypted))); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		*mediaType = strings.TrimSuffix(*mediaType, layercrypt.EncryptedSuffix)
+		*dgst, *size = decrypted, n
+		maps.DeleteFunc(*annotations, func(k string, _ string) bool {
+			return strings.HasPrefix(k, encAnnotationPrefix)
+		})
+		if len(*annotations) == 0 {
+			*annotations = nil
+		}
+		return nil
+	}
+	var b []byte
+	var err error
+	switch mh.Type {
+	case V1ociManifest:
+		m := mh.V1ociManifest
+		m.Layers = slices.Clone(m.Layers)
+		for i := range m.Layers {
+			l := &m.Layers[i]
+			l.Annotations = maps.Clone(l.Annotations)
+			if err := decrypt(&l.MediaType, &l.Digest, &l.Size, &l.Annotations); err != nil {
+				return ManifestHolder{}, err
+			}
+		}
+		b, err = json.Marshal(m)
+	case V2dockerManifest:
+		m := mh.V2dockerManifest
+		m.Layers = slices.Clone(m.Layers)
+		for i := range m.Layers {
+			l := &m.Layers[i]
+			l.Annotations = maps.Clone(l.Annotations)
+			if err := decrypt(&l.MediaType, &l.Digest, &l.Size, &l.Annotations); err != nil {
+				return ManifestHolder{}, err
+			}
+		}
+		b, err = json.Marshal(m)
+	default:
+		return ManifestHolder{}, fmt.Errorf("can't decrypt layers of %q kind of manifest", manifestTypeToString[mh.Type])
+	}
+	if err != nil {
+		return ManifestHolder{}, err
+	}
+	decrypted, err := newManifestHolder(types.MediaType(mh.MediaType()), b, digest.FromBytes(b).Encoded(), mh.ImageUrl)
+	if err != nil {
+		return ManifestHolder{}, err
+	}
+	decrypted.IndexDigest = mh.IndexDigest
+	return decrypted, nil
+}
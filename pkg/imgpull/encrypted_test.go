@@ -0,0 +1,120 @@
+package imgpull
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aceeric/imgpull/internal/layercrypt"
+	"github.com/aceeric/imgpull/internal/testhelpers"
+	"github.com/aceeric/imgpull/mock"
+	"github.com/aceeric/imgpull/pkg/imgpull/v1oci"
+	"github.com/opencontainers/go-digest"
+)
+
+// addEncryptedImage adds an image to the passed registry with a plain base layer and a
+// top layer encrypted for the passed keys.
+func addEncryptedImage(t *testing.T, reg *mock.Registry, keys ...crypto.PublicKey) {
+	base := testhelpers.MakeLayer(map[string]string{"etc/os-release": "frobozz"})
+	secret := testhelpers.MakeLayer(map[string]string{"secret": "xyzzy"})
+	encrypted, annotations, err := layercrypt.Encrypt(secret, keys)
+	if err != nil {
+		t.Fatalf("encrypt: %s", err)
+	}
+	diffIDs := []string{}
+	for _, layer := range [][]byte{base, secret} {
+		gr, _ := gzip.NewReader(bytes.NewReader(layer))
+		b, _ := io.ReadAll(gr)
+		diffIDs = append(diffIDs, digest.FromBytes(b).String())
+	}
+	config := fmt.Appendf(nil, `{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":["%s","%s"]}}`, diffIDs[0], diffIDs[1])
+	m := v1oci.Manifest{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.oci.image.manifest.v1+json",
+		Config: v1oci.Descriptor{
+			MediaType: "application/vnd.oci.image.config.v1+json",
+			Digest:    reg.AddBlob("frobozz", config),
+			Size:      int64(len(config)),
+		},
+		Layers: []v1oci.Descriptor{{
+			MediaType: "application/vnd.oci.image.layer.v1.tar+gzip",
+			Digest:    reg.AddBlob("frobozz", base),
+			Size:      int64(len(base)),
+		}, {
+			MediaType:   "application/vnd.oci.image.layer.v1.tar+gzip+encrypted",
+			Digest:      reg.AddBlob("frobozz", encrypted),
+			Size:        int64(len(encrypted)),
+			Annotations: annotations,
+		}},
+	}
+	b, _ := json.Marshal(m)
+	reg.AddManifest("frobozz", "encrypted", m.MediaType, b)
+}
+
+func TestPullEncrypted(t *testing.T) {
+	d := t.TempDir()
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaDER, _ := x509.MarshalPKCS8PrivateKey(rsaKey)
+	ecDER, _ := x509.MarshalECPrivateKey(ecKey)
+	otherDER, _ := x509.MarshalECPrivateKey(otherKey)
+	os.WriteFile(filepath.Join(d, "rsa.pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: rsaDER}), 0600)
+	os.WriteFile(filepath.Join(d, "ec.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}), 0600)
+	os.WriteFile(filepath.Join(d, "other.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: otherDER}), 0600)
+	reg := mock.NewRegistry()
+	addEncryptedImage(t, reg, &rsaKey.PublicKey, &ecKey.PublicKey)
+	server, url := mock.ServerWith(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}), reg)
+	defer server.Close()
+	newPuller := func(keys ...string) Puller {
+		p, err := NewPullerWith(PullerOpts{
+			Url:            fmt.Sprintf("%s/frobozz:encrypted", url),
+			OStype:         "linux",
+			ArchType:       "amd64",
+			Scheme:         "http",
+			VerifyDiffIDs:  true,
+			DecryptionKeys: keys,
+		})
+		if err != nil {
+			t.FailNow()
+		}
+		return p
+	}
+	for _, key := range []string{"rsa.pem", "ec.pem"} {
+		rootfs := filepath.Join(d, "rootfs-"+key)
+		if err := newPuller(filepath.Join(d, "other.pem"), filepath.Join(d, key)).PullRootfs(rootfs); err != nil {
+			t.Fatalf("pull with %s: %s", key, err)
+		}
+		for file, content := range map[string]string{"etc/os-release": "frobozz", "secret": "xyzzy"} {
+			if b, err := os.ReadFile(filepath.Join(rootfs, file)); err != nil || string(b) != content {
+				t.Errorf("unexpected content %q for %s", b, file)
+			}
+		}
+	}
+	tarball := filepath.Join(d, "frobozz.tar")
+	if _, err := newPuller(filepath.Join(d, "ec.pem")).PullTar(tarball); err != nil {
+		t.Fatalf("pull tar: %s", err)
+	}
+	if _, err := newPuller().PullTar(tarball); err == nil || !strings.Contains(err.Error(), "encrypted") {
+		t.Errorf("expected an error with no decryption keys, got %v", err)
+	}
+	if _, err := newPuller(filepath.Join(d, "other.pem")).PullTar(tarball); err == nil {
+		t.Errorf("expected an error with the wrong decryption key")
+	}
+	if _, err := newPuller(filepath.Join(d, "nosuch.pem")).PullTar(tarball); err == nil {
+		t.Errorf("expected an error with a missing decryption key")
+	}
+}
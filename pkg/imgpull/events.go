@@ -0,0 +1,94 @@
+package imgpull
+
+import (
+	"time"
+
+	"github.com/aceeric/imgpull/internal/methods"
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+)
+
+// EventType is the phase of a pull that an 'Event' reports.
+type EventType string
+
+const (
+	// PullStarted is emitted when a pull starts.
+	PullStarted EventType = "PullStarted"
+	// ManifestResolved is emitted when the image manifest to pull has been fetched, after
+	// selecting the platform from an image list if the url resolved to an image list.
+	ManifestResolved EventType = "ManifestResolved"
+	// BlobStarted is emitted before a blob is downloaded.
+	BlobStarted EventType = "BlobStarted"
+	// BlobFinished is emitted when a blob download ends, with an error if it failed.
+	BlobFinished EventType = "BlobFinished"
+	// PullCompleted is emitted when a pull succeeds.
+	PullCompleted EventType = "PullCompleted"
+	// PullFailed is emitted with the error when a pull fails.
+	PullFailed EventType = "PullFailed"
+	// MediaTypeMismatch is emitted with a '*types.ErrMediaTypeMismatch' when a manifest
+	// is served with an inconsistent media type and the 'MediaTypeCheck' option is
+	// 'MediaTypeCheckWarn'.
+	MediaTypeMismatch EventType = "MediaTypeMismatch"
+)
+
+// Event describes a phase of a pull. Events are passed to the 'OnEvent' function in
+// 'PullerOpts'.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// Url is the image url being pulled.
+	Url string
+	// Digest is the digest of the image manifest for ManifestResolved and MediaTypeMismatch,
+	// and the digest of the blob for the blob events.
+	Digest string
+	// MediaType is the media type of the image manifest or the blob.
+	MediaType types.MediaType
+	// Size is the size of the blob.
+	Size int64
+	// Duration is how long the blob download or the pull took, for BlobFinished,
+	// PullCompleted, and PullFailed.
+	Duration time.Duration
+	// Err is the error for PullFailed and MediaTypeMismatch, and for BlobFinished if the
+	// download failed.
+	Err error
+}
+
+// emit passes the passed event to the 'OnEvent' function in the receiver options, if
+// there is one, filling in the time and the image url.
+func (p *puller) emit(e Event) {
+	if p.Opts.OnEvent == nil {
+		return
+	}
+	e.Time = time.Now()
+	e.Url = p.GetUrl()
+	p.Opts.OnEvent(e)
+}
+
+// pullStarted emits a PullStarted event and returns a function for the caller to defer
+// that emits PullCompleted, or PullFailed if the passed error is not nil.
+func (p *puller) pullStarted() func(err error) {
+	start := time.Now()
+	p.emit(Event{Type: PullStarted})
+	return func(err error) {
+		if err != nil {
+			p.emit(Event{Type: PullFailed, Duration: time.Since(start), Err: err})
+		} else {
+			p.emit(Event{Type: PullCompleted, Duration: time.Since(start)})
+		}
+	}
+}
+
+// manifestResolved emits a ManifestResolved event for the passed image manifest.
+func (p *puller) manifestResolved(mh ManifestHolder) {
+	p.emit(Event{Type: ManifestResolved, Digest: "sha256:" + mh.Digest, MediaType: types.MediaType(mh.MediaType())})
+}
+
+// pullBlob pulls the passed blob to 'toFile' using the passed client, emitting the
+// BlobStarted and BlobFinished events. True is returned if the blob was downloaded from
+// the registry rather than already being in 'toFile' or provided by the blob syncer.
+func (p *puller) pullBlob(rc methods.RegClient, layer types.Layer, toFile string) (bool, error) {
+	start := time.Now()
+	p.emit(Event{Type: BlobStarted, Digest: layer.Digest, MediaType: layer.MediaType, Size: int64(layer.Size)})
+	downloaded, err := rc.V2BlobsFetch(layer, toFile)
+	p.emit(Event{Type: BlobFinished, Digest: layer.Digest, MediaType: layer.MediaType, Size: int64(layer.Size), Duration: time.Since(start), Err: err})
+	return downloaded, err
+}
@@ -0,0 +1,54 @@
+package imgpull
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aceeric/imgpull/mock"
+)
+
+// Tests the events emitted by a successful and a failed pull.
+func TestPullEvents(t *testing.T) {
+	mp := mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{})
+	server, url := mock.Server(mp)
+	defer server.Close()
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+	var events []Event
+	p, err := NewPullerWith(PullerOpts{
+		Url:      fmt.Sprintf("%s/hello-world:latest", url),
+		Scheme:   "http",
+		OStype:   "linux",
+		ArchType: "amd64",
+		OnEvent:  func(e Event) { events = append(events, e) },
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	if _, err := p.PullTar(filepath.Join(d, "hello-world.tar")); err != nil {
+		t.FailNow()
+	}
+	// hello-world has a config and one layer
+	expected := []EventType{PullStarted, ManifestResolved, BlobStarted, BlobFinished, BlobStarted, BlobFinished, PullCompleted}
+	if len(events) != len(expected) {
+		t.Fatalf("unexpected events %v", events)
+	}
+	for i, e := range events {
+		if e.Type != expected[i] || e.Url != p.GetUrl() || e.Time.IsZero() || e.Err != nil {
+			t.Errorf("unexpected event %+v", e)
+		}
+		if (e.Type == ManifestResolved || e.Type == BlobStarted || e.Type == BlobFinished) && e.Digest == "" {
+			t.Errorf("expected a digest in event %+v", e)
+		}
+	}
+	events = nil
+	if err := p.SetUrl(fmt.Sprintf("%s/frobozz:latest", url)); err != nil {
+		t.FailNow()
+	}
+	_, err = p.PullTar(filepath.Join(d, "frobozz.tar"))
+	if err == nil || len(events) != 2 || events[0].Type != PullStarted || events[1].Type != PullFailed || events[1].Err != err {
+		t.Errorf("unexpected events %v for a failed pull", events)
+	}
+}
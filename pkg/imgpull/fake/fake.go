@@ -0,0 +1,327 @@
+// Package fake has a fake implementation of the 'imgpull.Puller' interface so that
+// library consumers can unit test their code without a registry or the mock
+// distribution server. Each interface method calls the corresponding function field
+// of the fake if it is set, so a test programs only the responses it needs:
+//
+//	p := fake.NewPuller("docker.io/hello-world:latest")
+//	p.ListTagsFunc = func() ([]string, error) {
+//		return []string{"v1", "v2"}, nil
+//	}
+//	tags, _ := p.ListTags()
+//
+// A method with no function set returns the zero value and an error that wraps
+// 'ErrNotProgrammed', except for the methods that manage the url, options, and copies
+// of the puller, which behave like the real puller. Every call is recorded, and can be
+// checked with 'Calls'.
+package fake
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aceeric/imgpull/pkg/imgpull"
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ErrNotProgrammed is wrapped by the error returned by a method of the fake whose
+// function field is not set.
+var ErrNotProgrammed = errors.New("fake puller method not programmed")
+
+// Call is a call to a method of the fake puller.
+type Call struct {
+	// Method is the name of the interface method, e.g. "PullTar".
+	Method string
+	// Url is the url of the puller when the method was called.
+	Url string
+	// Args are the arguments passed to the method, excluding functions and contexts.
+	Args []any
+}
+
+// callLog is the calls to a puller and its copies.
+type callLog struct {
+	mu    sync.Mutex
+	calls []Call
+}
+
+// Puller is a fake 'imgpull.Puller'. It must be created with 'NewPuller'. The function
+// fields can be set any time before the corresponding method is called, but not while
+// other goroutines are using the puller.
+type Puller struct {
+	// Url is returned by GetUrl and set by SetUrl.
+	Url string
+	// Opts is returned by GetOpts.
+	Opts                    imgpull.PullerOpts
+	GetManifestByTypeFunc   func(mpt imgpull.ManifestPullType) (imgpull.ManifestHolder, error)
+	GetManifestFunc         func() (imgpull.ManifestHolder, error)
+	GetManifestByDigestFunc func(digest string) (imgpull.ManifestHolder, error)
+	GetConfigFunc           func(mh imgpull.ManifestHolder) (ocispec.Image, error)
+	GetImageConfigFunc      func(mh imgpull.ManifestHolder) (imgpull.ImageConfig, error)
+	GetRawManifestFunc      func(tagOrDigest string, accept ...types.MediaType) (types.RawManifest, error)
+	ExistsFunc              func() (bool, types.ManifestDescriptor, error)
+	HeadManifestFunc        func() (types.ManifestDescriptor, error)
+	ListTagsFunc            func() ([]string, error)
+	CapabilitiesFunc        func() (imgpull.RegistryCapabilities, error)
+	WatchFunc               func(ctx context.Context, interval time.Duration, callback imgpull.WatchFunc) error
+	PlanFunc                func() (imgpull.PullPlan, error)
+	SizeFunc                func(uncompressed bool) (imgpull.ImageSize, error)
+	PullArtifactFunc        func(destDir string) error
+	PullBlobsFunc           func(mh imgpull.ManifestHolder, blobDir string, filters ...imgpull.BlobFilter) (imgpull.PullStats, error)
+	PullTarFunc             func(dest string) (imgpull.PullStats, error)
+	PullLayoutFunc          func(destDir string) (imgpull.PullStats, error)
+	PullRootfsFunc          func(destDir string) error
+	PullLayerFunc           func(layer string, destDir string) error
+	PullFlatTarFunc         func(dest string) error
+	PullToContentStoreFunc  func(ctx context.Context, store imgpull.ContentStore) (ocispec.Descriptor, error)
+	PullToDockerFunc        func(ctx context.Context, client imgpull.DockerClient) error
+	// SetUrlFunc, if set, is called by SetUrl instead of setting Url, e.g. to fail an invalid url.
+	SetUrlFunc func(url string) error
+	// WithRefFunc, if set, is called by WithRef instead of copying the puller.
+	WithRefFunc func(url string) (imgpull.Puller, error)
+	// CloseFunc, if set, is called by Close.
+	CloseFunc func()
+	calls     *callLog
+}
+
+var _ imgpull.Puller = (*Puller)(nil)
+
+// NewPuller returns a fake puller for the passed url with no methods programmed.
+func NewPuller(url string) *Puller {
+	return &Puller{
+		Url:   url,
+		Opts:  imgpull.PullerOpts{Url: url},
+		calls: &callLog{},
+	}
+}
+
+// Calls returns the calls to the receiver, and to the copies of the receiver made with
+// Clone and WithRef, in the order they were made.
+func (p *Puller) Calls() []Call {
+	p.calls.mu.Lock()
+	defer p.calls.mu.Unlock()
+	return append([]Call{}, p.calls.calls...)
+}
+
+// CallsTo returns the calls to the passed method, like 'Calls'.
+func (p *Puller) CallsTo(method string) []Call {
+	calls := []Call{}
+	for _, c := range p.Calls() {
+		if c.Method == method {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+// record records a call to the passed method and returns the error for the method if
+// it isn't programmed.
+func (p *Puller) record(method string, programmed bool, args ...any) error {
+	p.calls.mu.Lock()
+	p.calls.calls = append(p.calls.calls, Call{Method: method, Url: p.Url, Args: args})
+	p.calls.mu.Unlock()
+	if !programmed {
+		return fmt.Errorf("%w: %s", ErrNotProgrammed, method)
+	}
+	return nil
+}
+
+func (p *Puller) GetManifestByType(mpt imgpull.ManifestPullType) (imgpull.ManifestHolder, error) {
+	if err := p.record("GetManifestByType", p.GetManifestByTypeFunc != nil, mpt); err != nil {
+		return imgpull.ManifestHolder{}, err
+	}
+	return p.GetManifestByTypeFunc(mpt)
+}
+
+func (p *Puller) GetManifest() (imgpull.ManifestHolder, error) {
+	if err := p.record("GetManifest", p.GetManifestFunc != nil); err != nil {
+		return imgpull.ManifestHolder{}, err
+	}
+	return p.GetManifestFunc()
+}
+
+func (p *Puller) GetManifestByDigest(digest string) (imgpull.ManifestHolder, error) {
+	if err := p.record("GetManifestByDigest", p.GetManifestByDigestFunc != nil, digest); err != nil {
+		return imgpull.ManifestHolder{}, err
+	}
+	return p.GetManifestByDigestFunc(digest)
+}
+
+func (p *Puller) GetConfig(mh imgpull.ManifestHolder) (ocispec.Image, error) {
+	if err := p.record("GetConfig", p.GetConfigFunc != nil, mh); err != nil {
+		return ocispec.Image{}, err
+	}
+	return p.GetConfigFunc(mh)
+}
+
+func (p *Puller) GetImageConfig(mh imgpull.ManifestHolder) (imgpull.ImageConfig, error) {
+	if err := p.record("GetImageConfig", p.GetImageConfigFunc != nil, mh); err != nil {
+		return imgpull.ImageConfig{}, err
+	}
+	return p.GetImageConfigFunc(mh)
+}
+
+func (p *Puller) GetRawManifest(tagOrDigest string, accept ...types.MediaType) (types.RawManifest, error) {
+	if err := p.record("GetRawManifest", p.GetRawManifestFunc != nil, tagOrDigest, accept); err != nil {
+		return types.RawManifest{}, err
+	}
+	return p.GetRawManifestFunc(tagOrDigest, accept...)
+}
+
+func (p *Puller) Exists() (bool, types.ManifestDescriptor, error) {
+	if err := p.record("Exists", p.ExistsFunc != nil); err != nil {
+		return false, types.ManifestDescriptor{}, err
+	}
+	return p.ExistsFunc()
+}
+
+func (p *Puller) HeadManifest() (types.ManifestDescriptor, error) {
+	if err := p.record("HeadManifest", p.HeadManifestFunc != nil); err != nil {
+		return types.ManifestDescriptor{}, err
+	}
+	return p.HeadManifestFunc()
+}
+
+func (p *Puller) ListTags() ([]string, error) {
+	if err := p.record("ListTags", p.ListTagsFunc != nil); err != nil {
+		return nil, err
+	}
+	return p.ListTagsFunc()
+}
+
+func (p *Puller) Capabilities() (imgpull.RegistryCapabilities, error) {
+	if err := p.record("Capabilities", p.CapabilitiesFunc != nil); err != nil {
+		return imgpull.RegistryCapabilities{}, err
+	}
+	return p.CapabilitiesFunc()
+}
+
+func (p *Puller) Watch(ctx context.Context, interval time.Duration, callback imgpull.WatchFunc) error {
+	if err := p.record("Watch", p.WatchFunc != nil, interval); err != nil {
+		return err
+	}
+	return p.WatchFunc(ctx, interval, callback)
+}
+
+func (p *Puller) Plan() (imgpull.PullPlan, error) {
+	if err := p.record("Plan", p.PlanFunc != nil); err != nil {
+		return imgpull.PullPlan{}, err
+	}
+	return p.PlanFunc()
+}
+
+func (p *Puller) Size(uncompressed bool) (imgpull.ImageSize, error) {
+	if err := p.record("Size", p.SizeFunc != nil, uncompressed); err != nil {
+		return imgpull.ImageSize{}, err
+	}
+	return p.SizeFunc(uncompressed)
+}
+
+func (p *Puller) PullArtifact(destDir string) error {
+	if err := p.record("PullArtifact", p.PullArtifactFunc != nil, destDir); err != nil {
+		return err
+	}
+	return p.PullArtifactFunc(destDir)
+}
+
+func (p *Puller) PullBlobs(mh imgpull.ManifestHolder, blobDir string, filters ...imgpull.BlobFilter) (imgpull.PullStats, error) {
+	if err := p.record("PullBlobs", p.PullBlobsFunc != nil, mh, blobDir); err != nil {
+		return imgpull.PullStats{}, err
+	}
+	return p.PullBlobsFunc(mh, blobDir, filters...)
+}
+
+func (p *Puller) PullTar(dest string) (imgpull.PullStats, error) {
+	if err := p.record("PullTar", p.PullTarFunc != nil, dest); err != nil {
+		return imgpull.PullStats{}, err
+	}
+	return p.PullTarFunc(dest)
+}
+
+func (p *Puller) PullLayout(destDir string) (imgpull.PullStats, error) {
+	if err := p.record("PullLayout", p.PullLayoutFunc != nil, destDir); err != nil {
+		return imgpull.PullStats{}, err
+	}
+	return p.PullLayoutFunc(destDir)
+}
+
+func (p *Puller) PullRootfs(destDir string) error {
+	if err := p.record("PullRootfs", p.PullRootfsFunc != nil, destDir); err != nil {
+		return err
+	}
+	return p.PullRootfsFunc(destDir)
+}
+
+func (p *Puller) PullLayer(layer string, destDir string) error {
+	if err := p.record("PullLayer", p.PullLayerFunc != nil, layer, destDir); err != nil {
+		return err
+	}
+	return p.PullLayerFunc(layer, destDir)
+}
+
+func (p *Puller) PullFlatTar(dest string) error {
+	if err := p.record("PullFlatTar", p.PullFlatTarFunc != nil, dest); err != nil {
+		return err
+	}
+	return p.PullFlatTarFunc(dest)
+}
+
+func (p *Puller) PullToContentStore(ctx context.Context, store imgpull.ContentStore) (ocispec.Descriptor, error) {
+	if err := p.record("PullToContentStore", p.PullToContentStoreFunc != nil); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return p.PullToContentStoreFunc(ctx, store)
+}
+
+func (p *Puller) PullToDocker(ctx context.Context, client imgpull.DockerClient) error {
+	if err := p.record("PullToDocker", p.PullToDockerFunc != nil); err != nil {
+		return err
+	}
+	return p.PullToDockerFunc(ctx, client)
+}
+
+func (p *Puller) GetUrl() string {
+	return p.Url
+}
+
+func (p *Puller) SetUrl(url string) error {
+	p.record("SetUrl", true, url)
+	if p.SetUrlFunc != nil {
+		return p.SetUrlFunc(url)
+	}
+	p.Url, p.Opts.Url = url, url
+	return nil
+}
+
+// Clone returns a copy of the receiver with the same programmed functions. Calls to the
+// copy are recorded with the calls to the receiver.
+func (p *Puller) Clone() imgpull.Puller {
+	p.record("Clone", true)
+	c := *p
+	return &c
+}
+
+// WithRef returns a copy of the receiver like Clone, but for the passed url, unless
+// WithRefFunc is set.
+func (p *Puller) WithRef(url string) (imgpull.Puller, error) {
+	p.record("WithRef", true, url)
+	if p.WithRefFunc != nil {
+		return p.WithRefFunc(url)
+	}
+	c := *p
+	c.Url, c.Opts.Url = url, url
+	return &c, nil
+}
+
+func (p *Puller) GetOpts() imgpull.PullerOpts {
+	return p.Opts
+}
+
+func (p *Puller) Close() {
+	p.record("Close", true)
+	if p.CloseFunc != nil {
+		p.CloseFunc()
+	}
+}
@@ -0,0 +1,79 @@
+package fake
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/aceeric/imgpull/pkg/imgpull"
+)
+
+// pullLatest is like consumer code under test that takes an 'imgpull.Puller'.
+func pullLatest(p imgpull.Puller, dir string) (string, error) {
+	tags, err := p.ListTags()
+	if err != nil {
+		return "", err
+	}
+	latest, err := p.WithRef(p.GetOpts().Url + ":" + tags[len(tags)-1])
+	if err != nil {
+		return "", err
+	}
+	dest := filepath.Join(dir, "latest.tar")
+	_, err = latest.PullTar(dest)
+	return dest, err
+}
+
+func TestFakePuller(t *testing.T) {
+	p := NewPuller("registry.corp/frobozz")
+	p.ListTagsFunc = func() ([]string, error) {
+		return []string{"v1", "v2"}, nil
+	}
+	p.PullTarFunc = func(dest string) (imgpull.PullStats, error) {
+		return imgpull.PullStats{Layers: 1}, os.WriteFile(dest, []byte("tarball"), 0644)
+	}
+	dest, err := pullLatest(p, t.TempDir())
+	if err != nil {
+		t.Fatalf("pull: %s", err)
+	}
+	if _, err := os.Stat(dest); err != nil {
+		t.Errorf("expected the programmed PullTar to write %s", dest)
+	}
+	methods := []string{}
+	for _, c := range p.Calls() {
+		methods = append(methods, c.Method)
+	}
+	if !slices.Equal(methods, []string{"ListTags", "WithRef", "PullTar"}) {
+		t.Errorf("unexpected calls %v", methods)
+	}
+	if c := p.CallsTo("PullTar"); len(c) != 1 || c[0].Url != "registry.corp/frobozz:v2" || c[0].Args[0] != dest {
+		t.Errorf("unexpected PullTar call %+v", c)
+	}
+	if p.GetUrl() != "registry.corp/frobozz" {
+		t.Errorf("expected WithRef not to change the receiver")
+	}
+}
+
+func TestFakePullerNotProgrammed(t *testing.T) {
+	p := NewPuller("registry.corp/frobozz:v1")
+	if _, err := p.GetManifest(); !errors.Is(err, ErrNotProgrammed) {
+		t.Errorf("expected ErrNotProgrammed, got %v", err)
+	}
+	if err := p.PullRootfs("rootfs"); !errors.Is(err, ErrNotProgrammed) {
+		t.Errorf("expected ErrNotProgrammed, got %v", err)
+	}
+	if err := p.SetUrl("registry.corp/frobozz:v2"); err != nil || p.GetUrl() != "registry.corp/frobozz:v2" || p.GetOpts().Url != "registry.corp/frobozz:v2" {
+		t.Errorf("expected SetUrl to set the url")
+	}
+	p.SetUrlFunc = func(string) error { return errors.New("invalid url") }
+	if err := p.SetUrl("x"); err == nil {
+		t.Errorf("expected the programmed SetUrl error")
+	}
+	closed := false
+	p.CloseFunc = func() { closed = true }
+	p.Clone().Close()
+	if !closed || len(p.CallsTo("Close")) != 1 {
+		t.Errorf("expected the clone to call the programmed Close and record the call")
+	}
+}
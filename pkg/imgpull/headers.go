@@ -0,0 +1,38 @@
+package imgpull
+
+import (
+	"net/http"
+)
+
+// DefaultUserAgent is the User-Agent header sent with every request to a registry,
+// unless it is overridden by 'ExtraHeaders' in PullerOpts.
+const DefaultUserAgent = "imgpull"
+
+// headerTransport adds headers to every request that doesn't already have them,
+// and then sends the request with the base transport.
+type headerTransport struct {
+	base    http.RoundTripper
+	headers http.Header
+}
+
+// newHeaderTransport returns a transport that sends the User-Agent header and the
+// passed extra headers with every request using the passed base transport.
+func newHeaderTransport(base http.RoundTripper, extra map[string]string) *headerTransport {
+	headers := http.Header{}
+	headers.Set("User-Agent", DefaultUserAgent)
+	for k, v := range extra {
+		headers.Set(k, v)
+	}
+	return &headerTransport{base: base, headers: headers}
+}
+
+func (ht *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the request
+	req = req.Clone(req.Context())
+	for k, v := range ht.headers {
+		if req.Header.Get(k) == "" {
+			req.Header[k] = v
+		}
+	}
+	return ht.base.RoundTrip(req)
+}
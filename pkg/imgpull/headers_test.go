@@ -0,0 +1,56 @@
+package imgpull
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+	"github.com/opencontainers/go-digest"
+)
+
+// Tests that the User-Agent and extra headers are sent with each request.
+func TestExtraHeaders(t *testing.T) {
+	var hdrs []http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hdrs = append(hdrs, r.Header)
+		w.Header().Set("Content-Type", string(types.V1ociManifestMt))
+		w.Header().Set("Docker-Content-Digest", digest.FromString("frobozz").String())
+	}))
+	defer server.Close()
+	opts := PullerOpts{
+		Url:      fmt.Sprintf("%s/hello-world:latest", strings.TrimPrefix(server.URL, "http://")),
+		Scheme:   "http",
+		OStype:   "linux",
+		ArchType: "amd64",
+	}
+	p, err := NewPullerWith(opts)
+	if err != nil {
+		t.FailNow()
+	}
+	if _, err := p.HeadManifest(); err != nil || len(hdrs) == 0 {
+		t.FailNow()
+	}
+	for _, hdr := range hdrs {
+		if hdr.Get("User-Agent") != DefaultUserAgent {
+			t.Errorf("expected the default user agent, got %q", hdr.Get("User-Agent"))
+		}
+	}
+	hdrs = nil
+	opts.ExtraHeaders = map[string]string{"User-Agent": "frobozz/1.0", "X-Forwarded-For": "10.0.0.1"}
+	p, _ = NewPullerWith(opts)
+	if _, err := p.HeadManifest(); err != nil || len(hdrs) == 0 {
+		t.FailNow()
+	}
+	for _, hdr := range hdrs {
+		if hdr.Get("User-Agent") != "frobozz/1.0" || hdr.Get("X-Forwarded-For") != "10.0.0.1" {
+			t.Errorf("unexpected headers %v", hdr)
+		}
+	}
+	opts.ExtraHeaders = map[string]string{"authorization": "Basic xyzzy"}
+	if _, err := NewPullerWith(opts); err == nil {
+		t.Error("expected an error for an Authorization extra header")
+	}
+}
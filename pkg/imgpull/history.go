@@ -0,0 +1,82 @@
+package imgpull
+
+import (
+	"strings"
+	"time"
+
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// HistoryEntry is one step of the history of an image, from the 'history' array in the
+// image config. It is returned by 'History'.
+type HistoryEntry struct {
+	// Created is when the step was run, if the config has it.
+	Created *time.Time `json:"created,omitempty"`
+	// CreatedBy is the command that the step ran, exactly as it is in the config.
+	CreatedBy string `json:"createdBy"`
+	// Step is the Dockerfile-like instruction reconstructed from 'CreatedBy', like
+	// 'RUN apt-get update' or 'CMD ["/hello"]'.
+	Step    string `json:"step"`
+	Comment string `json:"comment,omitempty"`
+	// EmptyLayer is true if the step didn't create a layer, e.g. an ENV instruction.
+	EmptyLayer bool `json:"emptyLayer"`
+	// Layer is the layer the step created. It is nil if the step didn't create a layer,
+	// or if the layers can't be matched to the history.
+	Layer *types.Layer `json:"layer,omitempty"`
+}
+
+// History returns the history of the image in the passed ManifestHolder from the passed
+// image config (see 'GetConfig'), oldest step first, with the layer created by each step.
+// Steps that created a layer are matched to the layers of the image in order, which is
+// only done if the number of those steps is the same as the number of layers.
+func History(mh ManifestHolder, config ocispec.Image) []HistoryEntry {
+	layers := mh.Layers()
+	if mh.hasConfig() && len(layers) != 0 {
+		layers = layers[:len(layers)-1]
+	}
+	nonEmpty := 0
+	for _, h := range config.History {
+		if !h.EmptyLayer {
+			nonEmpty++
+		}
+	}
+	match := nonEmpty == len(layers)
+	entries := []HistoryEntry{}
+	layer := 0
+	for _, h := range config.History {
+		entry := HistoryEntry{
+			Created:    h.Created,
+			CreatedBy:  h.CreatedBy,
+			Step:       historyStep(h.CreatedBy),
+			Comment:    h.Comment,
+			EmptyLayer: h.EmptyLayer,
+		}
+		if !h.EmptyLayer && match {
+			entry.Layer = &layers[layer]
+			layer++
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// historyStep reconstructs the Dockerfile-like instruction from the passed 'created_by'
+// value of an image config history entry, like 'docker history' does. The legacy builder
+// records instructions other than RUN as '/bin/sh -c #(nop) INSTRUCTION' and RUN as
+// '/bin/sh -c command'. BuildKit records the instruction with a '# buildkit' comment.
+func historyStep(createdBy string) string {
+	step := strings.TrimSpace(createdBy)
+	if rest, found := strings.CutPrefix(step, "/bin/sh -c #(nop)"); found {
+		return strings.TrimSpace(rest)
+	} else if rest, found := strings.CutPrefix(step, "/bin/sh -c "); found {
+		return "RUN " + strings.TrimSpace(rest)
+	}
+	step = strings.TrimSpace(strings.TrimSuffix(step, "# buildkit"))
+	// BuildKit records the shell form of RUN with the shell
+	if rest, found := strings.CutPrefix(step, "RUN /bin/sh -c "); found {
+		return "RUN " + rest
+	}
+	return step
+}
@@ -0,0 +1,68 @@
+package imgpull
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Tests reconstructing Dockerfile-like steps from legacy builder and BuildKit history.
+func TestHistoryStep(t *testing.T) {
+	tests := []struct {
+		createdBy string
+		expStep   string
+	}{
+		{createdBy: `/bin/sh -c #(nop)  CMD ["/hello"]`, expStep: `CMD ["/hello"]`},
+		{createdBy: `/bin/sh -c #(nop) COPY file:201f8f1849e89d53be9f6aa76937f5e209d745abfd15a8552fcf2ba45ab267f9 in / `, expStep: `COPY file:201f8f1849e89d53be9f6aa76937f5e209d745abfd15a8552fcf2ba45ab267f9 in /`},
+		{createdBy: `/bin/sh -c apt-get update`, expStep: `RUN apt-get update`},
+		{createdBy: `RUN /bin/sh -c apt-get update # buildkit`, expStep: `RUN apt-get update`},
+		{createdBy: `ENV PATH=/usr/local/bin`, expStep: `ENV PATH=/usr/local/bin`},
+		{createdBy: `COPY hello / # buildkit`, expStep: `COPY hello /`},
+		{createdBy: "", expStep: ""},
+	}
+	for _, test := range tests {
+		if step := historyStep(test.createdBy); step != test.expStep {
+			t.Errorf("for %q expected %q, got %q", test.createdBy, test.expStep, step)
+		}
+	}
+}
+
+// Tests that steps that created a layer are matched to the image layers only when
+// the number of those steps is the same as the number of layers.
+func TestHistory(t *testing.T) {
+	imageManifest, err := os.ReadFile(filepath.Join("..", "..", "mock", "testfiles", "imageManifest.json"))
+	if err != nil {
+		t.FailNow()
+	}
+	mh, err := NewManifestHolder(string(types.V1ociManifestMt), imageManifest, digest.FromBytes(imageManifest).Encoded(), "docker.io/hello-world:latest")
+	if err != nil {
+		t.FailNow()
+	}
+	config := ocispec.Image{
+		History: []ocispec.History{
+			{CreatedBy: `/bin/sh -c #(nop) COPY file:abc in / `},
+			{CreatedBy: `/bin/sh -c #(nop)  CMD ["/hello"]`, EmptyLayer: true},
+		},
+	}
+	history := History(mh, config)
+	if len(history) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(history))
+	}
+	if history[0].Step != "COPY file:abc in /" || history[0].Layer == nil || history[0].Layer.Digest != mh.Layers()[0].Digest {
+		t.Errorf("expected the first step to be matched to the first layer, got %+v", history[0])
+	}
+	if history[1].Step != `CMD ["/hello"]` || history[1].Layer != nil || !history[1].EmptyLayer {
+		t.Errorf("expected the second step to have no layer, got %+v", history[1])
+	}
+	config.History[1].EmptyLayer = false
+	for _, entry := range History(mh, config) {
+		if entry.Layer != nil {
+			t.Errorf("expected no layers when the history doesn't match the layers")
+		}
+	}
+}
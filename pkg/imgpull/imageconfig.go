@@ -0,0 +1,111 @@
+package imgpull
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/aceeric/imgpull/internal/util"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func (p *puller) GetConfig(mh ManifestHolder) (config ocispec.Image, err error) {
+	layers := mh.Layers()
+	if !mh.hasConfig() || len(layers) == 0 {
+		return ocispec.Image{}, fmt.Errorf("manifest type %s for %q has no image config", manifestTypeToString[mh.Type], mh.ImageUrl)
+	}
+	tmpDir, err := p.Opts.newWorkDir()
+	if err != nil {
+		return ocispec.Image{}, err
+	}
+	defer func() { err = removeWorkDir(tmpDir, err) }()
+	if _, err := p.pullBlobs(mh, tmpDir, OnlyConfig()); err != nil {
+		return ocispec.Image{}, err
+	}
+	// the config blob is the last element
+	b, err := os.ReadFile(filepath.Join(tmpDir, util.DigestFrom(layers[len(layers)-1].Digest)))
+	if err != nil {
+		return ocispec.Image{}, err
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return ocispec.Image{}, fmt.Errorf("unable to parse image config for %q: %w", mh.ImageUrl, err)
+	}
+	return config, nil
+}
+
+func (p *puller) GetImageConfig(mh ManifestHolder) (ImageConfig, error) {
+	config, err := p.GetConfig(mh)
+	if err != nil {
+		return ImageConfig{}, err
+	}
+	return ImageConfigFrom(config), nil
+}
+
+// ImageConfig has the runtime configuration of an image from its image config, in a
+// form that is simpler to query than the 'ocispec.Image' it comes from. It is returned
+// by 'GetImageConfig' and 'ImageConfigFrom'.
+type ImageConfig struct {
+	// Labels are the image labels. The map is empty if the image has no labels.
+	Labels map[string]string `json:"labels"`
+	// Env has the environment variables parsed from the 'NAME=value' entries in the
+	// config. The map is empty if the image has no environment variables.
+	Env map[string]string `json:"env"`
+	// ExposedPorts are the exposed ports, like '80/tcp', sorted.
+	ExposedPorts []string `json:"exposedPorts"`
+	Entrypoint   []string `json:"entrypoint"`
+	Cmd          []string `json:"cmd"`
+	User         string   `json:"user,omitempty"`
+	WorkingDir   string   `json:"workingDir,omitempty"`
+}
+
+// ImageConfigFrom returns the runtime configuration in the passed image config, e.g.
+// from 'GetConfig'. An environment variable with no '=' has an empty value. If a
+// variable is in the config more than once then the last value is used, which is
+// what a container runtime does.
+func ImageConfigFrom(config ocispec.Image) ImageConfig {
+	ic := ImageConfig{
+		Labels:       map[string]string{},
+		Env:          map[string]string{},
+		ExposedPorts: slices.Sorted(maps.Keys(config.Config.ExposedPorts)),
+		Entrypoint:   config.Config.Entrypoint,
+		Cmd:          config.Config.Cmd,
+		User:         config.Config.User,
+		WorkingDir:   config.Config.WorkingDir,
+	}
+	maps.Copy(ic.Labels, config.Config.Labels)
+	for _, env := range config.Config.Env {
+		key, val, _ := strings.Cut(env, "=")
+		ic.Env[key] = val
+	}
+	if ic.ExposedPorts == nil {
+		ic.ExposedPorts = []string{}
+	}
+	return ic
+}
+
+// Label returns the value of the passed label, and false if the image doesn't have it.
+func (ic ImageConfig) Label(key string) (string, bool) {
+	val, found := ic.Labels[key]
+	return val, found
+}
+
+// Getenv returns the value of the passed environment variable, and false if the image
+// doesn't set it.
+func (ic ImageConfig) Getenv(key string) (string, bool) {
+	val, found := ic.Env[key]
+	return val, found
+}
+
+// Exposes returns true if the image exposes the passed port, like '80/tcp'. A port with
+// no protocol is matched as tcp.
+func (ic ImageConfig) Exposes(port string) bool {
+	if !strings.Contains(port, "/") {
+		port += "/tcp"
+	}
+	return slices.Contains(ic.ExposedPorts, port)
+}
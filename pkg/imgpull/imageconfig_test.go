@@ -0,0 +1,65 @@
+package imgpull
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/aceeric/imgpull/mock"
+)
+
+// Tests getting the labels, environment, exposed ports, entrypoint, and command
+// of an image from its config.
+func TestGetImageConfig(t *testing.T) {
+	reg := mock.NewRegistry()
+	reg.AddImage("frobozz", "v1",
+		[]byte(`{"architecture":"amd64","os":"linux","config":{"Env":["PATH=/bin","FOO=1","EMPTY","FOO=a=b"],"Labels":{"version":"1"},"ExposedPorts":{"8080/tcp":{},"53/udp":{}},"Entrypoint":["/app"],"Cmd":["run"],"User":"1000"}}`),
+		[]byte("base"))
+	reg.AddImage("frobozz", "bare", []byte(`{"architecture":"amd64","os":"linux"}`), []byte("base"))
+	server, url := mock.ServerWith(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}), reg)
+	defer server.Close()
+	configFor := func(tag string) ImageConfig {
+		p, err := NewPullerWith(PullerOpts{
+			Url:      fmt.Sprintf("%s/frobozz:%s", url, tag),
+			OStype:   "linux",
+			ArchType: "amd64",
+			Scheme:   "http",
+		})
+		if err != nil {
+			t.FailNow()
+		}
+		mh, err := p.GetManifestByType(Image)
+		if err != nil {
+			t.FailNow()
+		}
+		ic, err := p.GetImageConfig(mh)
+		if err != nil {
+			t.Fatalf("get image config: %s", err)
+		}
+		return ic
+	}
+	ic := configFor("v1")
+	if !maps.Equal(ic.Env, map[string]string{"PATH": "/bin", "FOO": "a=b", "EMPTY": ""}) {
+		t.Errorf("unexpected env %v", ic.Env)
+	}
+	if val, found := ic.Getenv("FOO"); !found || val != "a=b" {
+		t.Errorf("expected the last value of FOO, got %q", val)
+	}
+	if _, found := ic.Getenv("BAR"); found {
+		t.Errorf("expected BAR to not be set")
+	}
+	if val, found := ic.Label("version"); !found || val != "1" {
+		t.Errorf("expected the version label, got %q", val)
+	}
+	if !slices.Equal(ic.ExposedPorts, []string{"53/udp", "8080/tcp"}) || !ic.Exposes("8080") || !ic.Exposes("53/udp") || ic.Exposes("53") {
+		t.Errorf("unexpected exposed ports %v", ic.ExposedPorts)
+	}
+	if !slices.Equal(ic.Entrypoint, []string{"/app"}) || !slices.Equal(ic.Cmd, []string{"run"}) || ic.User != "1000" {
+		t.Errorf("unexpected entrypoint, cmd, or user %+v", ic)
+	}
+	ic = configFor("bare")
+	if ic.Labels == nil || ic.Env == nil || ic.ExposedPorts == nil || len(ic.Labels)+len(ic.Env)+len(ic.ExposedPorts) != 0 {
+		t.Errorf("expected empty non-nil labels, env, and ports, got %+v", ic)
+	}
+}
@@ -0,0 +1,65 @@
+package imgpull
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aceeric/imgpull/mock"
+)
+
+func TestInsecureHosts(t *testing.T) {
+	certSetup, err := mock.NewCertSetup()
+	if err != nil {
+		t.FailNow()
+	}
+	mp := mock.NewMockParams(mock.NONE, mock.ONEWAY_INSECURE, certSetup)
+	insecureServer, insecureUrl := mock.Server(mp)
+	defer insecureServer.Close()
+	secureServer, secureUrl := mock.Server(mp)
+	defer secureServer.Close()
+	for _, tst := range []struct {
+		url     string
+		succeed bool
+	}{
+		{insecureUrl, true},
+		{secureUrl, false},
+	} {
+		p, err := NewPullerWith(PullerOpts{
+			Url:           fmt.Sprintf("%s/hello-world:latest", tst.url),
+			Scheme:        "https",
+			OStype:        "linux",
+			ArchType:      "amd64",
+			InsecureHosts: []string{insecureUrl},
+		})
+		if err != nil {
+			t.FailNow()
+		}
+		if _, err := p.GetManifest(); (err == nil) != tst.succeed {
+			t.Errorf("%s: expected success %t, got %v", tst.url, tst.succeed, err)
+		}
+	}
+}
+
+func TestIsInsecureHost(t *testing.T) {
+	opts := PullerOpts{InsecureHosts: []string{"my.registry:5000", "other.registry", "10.0.0.0/8"}}
+	for _, tst := range []struct {
+		host     string
+		insecure bool
+	}{
+		{"my.registry:5000", true},
+		{"my.registry:5001", false},
+		{"my.registry", false},
+		{"other.registry", true},
+		{"OTHER.registry:443", true},
+		{"10.1.2.3:5000", true},
+		{"auth.docker.io", false},
+	} {
+		if opts.isInsecureHost(tst.host) != tst.insecure {
+			t.Errorf("%s: expected insecure %t", tst.host, tst.insecure)
+		}
+	}
+	opts = PullerOpts{Url: "foo", Scheme: "https", OStype: "linux", ArchType: "amd64", InsecureHosts: []string{"10.0.0.0/88"}}
+	if opts.validate() == nil {
+		t.Errorf("expected an invalid CIDR to fail validation")
+	}
+}
@@ -0,0 +1,49 @@
+package imgpull
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aceeric/imgpull/internal/tar"
+)
+
+func (p *puller) PullLayout(destDir string) (stats PullStats, err error) {
+	if destDir == "" {
+		return stats, fmt.Errorf("no destination specified for pull of %q", p.Opts.Url)
+	}
+	if p.Opts.Sidecar != NoSidecar || p.Opts.SigningKey != "" || p.Opts.Sign != nil {
+		return stats, fmt.Errorf("sidecars and signatures are only supported for tarballs, not for the layout of %q", p.Opts.Url)
+	}
+	start := time.Now()
+	defer func() { stats.Duration = time.Since(start) }()
+	finished := p.pullStarted()
+	defer func() { finished(err) }()
+	tmpDir, err := p.Opts.newWorkDir()
+	if err != nil {
+		return stats, err
+	}
+	defer func() { err = removeWorkDir(tmpDir, err) }()
+	itb, _, err := p.pull(context.Background(), tmpDir, &stats)
+	if err != nil {
+		return stats, err
+	}
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return stats, err
+	}
+	if err := checkDiskSpace(destDir, layersSize(itb.Layers)); err != nil {
+		return stats, err
+	}
+	writeStart := time.Now()
+	defer func() { stats.WriteDuration = time.Since(writeStart) }()
+	// the layout is written as a tarball in the work directory and extracted, so it
+	// has exactly the content of a tarball pulled with the OCILayout option
+	itb.OCILayout = true
+	tarFile := filepath.Join(tmpDir, "layout.tar")
+	if _, err := itb.ToTar(tarFile); err != nil {
+		return stats, err
+	}
+	return stats, tar.UntarDir(tarFile, destDir)
+}
@@ -0,0 +1,79 @@
+package imgpull
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aceeric/imgpull/mock"
+	"github.com/aceeric/imgpull/pkg/imgpull/v1oci"
+)
+
+// TestPullLayout pulls an image to an OCI image layout directory and checks that
+// index.json references the unchanged image manifest and that every blob is in the
+// layout.
+func TestPullLayout(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	opts := PullerOpts{
+		Url:      fmt.Sprintf("%s/hello-world:latest", url),
+		Scheme:   "http",
+		OStype:   "linux",
+		ArchType: "amd64",
+	}
+	p, err := NewPullerWith(opts)
+	if err != nil {
+		t.FailNow()
+	}
+	dir := filepath.Join(t.TempDir(), "layout")
+	if _, err := p.PullLayout(dir); err != nil {
+		t.FailNow()
+	}
+	if _, err := os.Stat(filepath.Join(dir, "oci-layout")); err != nil {
+		t.Fail()
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		t.FailNow()
+	}
+	idx := v1oci.Index{}
+	if err := json.Unmarshal(b, &idx); err != nil || len(idx.Manifests) != 1 {
+		t.FailNow()
+	}
+	if idx.Manifests[0].Digest != "sha256:e2fc4e5012d16e7fe466f5291c476431beaa1f9b90a5c2125b493ed28e2aba57" {
+		t.Fail()
+	}
+	for _, blob := range []string{
+		"e2fc4e5012d16e7fe466f5291c476431beaa1f9b90a5c2125b493ed28e2aba57",
+		"c1ec31eb59444d78df06a974d155e597c894ab4cda84f08294145e845394988e",
+		"d2c94e258dcb3c5ac2798d32e1249e42ef01cba4841c2234249495f87264ac5a",
+	} {
+		if _, err := os.Stat(filepath.Join(dir, "blobs", "sha256", blob)); err != nil {
+			t.Fail()
+		}
+	}
+	if _, err := p.PullLayout(""); err == nil {
+		t.Fail()
+	}
+	// a layout is never signed or given a sidecar, so asking for one is an error
+	for _, o := range []PullerOpts{
+		{Sidecar: Sha256Sidecar},
+		{SigningKey: "key.pem"},
+		{Sign: func([]byte) ([]byte, error) { return nil, nil }},
+	} {
+		o.Url, o.Scheme, o.OStype, o.ArchType = opts.Url, opts.Scheme, opts.OStype, opts.ArchType
+		p, err := NewPullerWith(o)
+		if err != nil {
+			t.FailNow()
+		}
+		dir := filepath.Join(t.TempDir(), "signed")
+		if _, err := p.PullLayout(dir); err == nil {
+			t.Errorf("expected an error for %+v", o)
+		}
+		if _, err := os.Stat(dir); err == nil {
+			t.Errorf("expected no layout for %+v", o)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package imgpull
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// loggingTransport logs each request to a debug-level logger with the method, the url, and
+// the status and time of the response, or the error. Headers aren't logged because they
+// have credentials.
+type loggingTransport struct {
+	base   http.RoundTripper
+	logger *slog.Logger
+}
+
+// newLoggingTransport returns a transport that logs requests sent with the passed base
+// transport to the passed logger.
+func newLoggingTransport(base http.RoundTripper, logger *slog.Logger) *loggingTransport {
+	return &loggingTransport{base: base, logger: logger}
+}
+
+func (lt *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !lt.logger.Enabled(req.Context(), slog.LevelDebug) {
+		return lt.base.RoundTrip(req)
+	}
+	start := time.Now()
+	resp, err := lt.base.RoundTrip(req)
+	attrs := []slog.Attr{
+		slog.String("method", req.Method),
+		slog.String("url", req.URL.Redacted()),
+		slog.Duration("duration", time.Since(start)),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.Any("error", err))
+	} else {
+		attrs = append(attrs, slog.Int("status", resp.StatusCode))
+	}
+	lt.logger.LogAttrs(req.Context(), slog.LevelDebug, "registry request", attrs...)
+	return resp, err
+}
@@ -0,0 +1,51 @@
+package imgpull
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/aceeric/imgpull/mock"
+)
+
+func TestRequestLogging(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.BEARER, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	var buf bytes.Buffer
+	for _, level := range []slog.Level{slog.LevelDebug, slog.LevelInfo} {
+		buf.Reset()
+		p, err := NewPullerWith(PullerOpts{
+			Url:        fmt.Sprintf("%s/hello-world:latest", url),
+			Scheme:     "http",
+			OStype:     "linux",
+			ArchType:   "amd64",
+			Username:   "foobar",
+			Password:   "frobozz",
+			TokenCache: NewTokenCache(),
+			Logger:     slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: level})),
+		})
+		if err != nil {
+			t.FailNow()
+		}
+		if _, err := p.GetManifest(); err != nil {
+			t.FailNow()
+		}
+		logged := buf.String()
+		if level == slog.LevelInfo {
+			if logged != "" {
+				t.Errorf("expected no logging at info level, got %s", logged)
+			}
+			continue
+		}
+		for _, s := range []string{"method=HEAD", "/v2/hello-world/manifests/latest", "status=401", "/v2/auth?", "status=200", "duration="} {
+			if !strings.Contains(logged, s) {
+				t.Errorf("expected %q to be logged, got %s", s, logged)
+			}
+		}
+		if strings.Contains(logged, "frobozz") {
+			t.Errorf("expected credentials not to be logged")
+		}
+	}
+}
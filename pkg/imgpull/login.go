@@ -0,0 +1,212 @@
+package imgpull
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// credentialsDir is the directory, next to the config file, that 'Login' writes
+// password files to.
+const credentialsDir = "credentials"
+
+// credentialsFileRe matches the characters in a registry that are replaced with
+// underscores in the name of its password file.
+var credentialsFileRe = regexp.MustCompile(`[^A-Za-z0-9.-]`)
+
+// Login stores the passed username and password for the passed registry, like
+// 'my.registry.io:5000', in the config file at the passed path, or in the default config
+// file if the path is empty, so that later pulls from the registry use them. The registry is
+// a host with an optional port - a scheme or a path is an error - and is normalized, so e.g.
+// 'registry-1.docker.io' is 'docker.io'. The config file is created if it doesn't exist, and
+// the rest of the file, including comments, is kept. If the credentials of the registry in
+// the config file have a credential helper then the username and password are stored with
+// the helper. Otherwise, so that the secret is not kept in the config file, the password is
+// written to a file readable only by the current user in the 'credentials' directory next to
+// the config file and the config references it with 'passwordFile'. The credentials are not
+// verified with the registry.
+func Login(configPath string, registry string, username string, password string) error {
+	if registry == "" || username == "" || password == "" {
+		return errors.New("a registry, username, and password are required to log in")
+	}
+	registry, err := normalizeRegistry(registry)
+	if err != nil {
+		return err
+	}
+	configPath, doc, err := loadConfigNode(configPath)
+	if err != nil {
+		return err
+	}
+	registries := mappingValue(doc.Content[0], "registries")
+	creds := mappingValue(mappingValue(registries, registryKey(registries, registry)), "credentials")
+	if helper := scalarValue(creds, "helper"); helper != "" {
+		return credHelperStore(helper, registry, username, password)
+	}
+	dir := filepath.Join(filepath.Dir(configPath), credentialsDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	passwordFile := filepath.Join(dir, credentialsFileRe.ReplaceAllString(registry, "_"))
+	if err := os.WriteFile(passwordFile, []byte(password), 0600); err != nil {
+		return err
+	}
+	for _, key := range []string{"passwordEnv", "tokenEnv", "tokenFile"} {
+		deleteKey(creds, key)
+	}
+	setScalar(creds, "username", username)
+	setScalar(creds, "passwordFile", passwordFile)
+	return saveConfigNode(configPath, doc)
+}
+
+// Logout removes the credentials for the passed registry that were stored by 'Login' from
+// the config file at the passed path, or from the default config file if the path is empty.
+// The registry is validated and normalized as for 'Login'.
+// If the credentials of the registry have a credential helper then the credentials are
+// erased from the helper and the helper is kept in the config file. A password file is only
+// removed if it is in the 'credentials' directory that 'Login' writes to.
+func Logout(configPath string, registry string) error {
+	registry, err := normalizeRegistry(registry)
+	if err != nil {
+		return err
+	}
+	configPath, doc, err := loadConfigNode(configPath)
+	if err != nil {
+		return err
+	}
+	registries := mappingValue(doc.Content[0], "registries")
+	key := registryKey(registries, registry)
+	creds := mappingValue(mappingValue(registries, key), "credentials")
+	if helper := scalarValue(creds, "helper"); helper != "" {
+		return credHelperErase(helper, registry)
+	}
+	if scalarValue(creds, "username") == "" && scalarValue(creds, "passwordFile") == "" {
+		return fmt.Errorf("not logged in to %q", registry)
+	}
+	passwordFile := scalarValue(creds, "passwordFile")
+	if filepath.Dir(passwordFile) == filepath.Join(filepath.Dir(configPath), credentialsDir) {
+		if err := os.Remove(passwordFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	deleteKey(creds, "username")
+	deleteKey(creds, "passwordFile")
+	if len(creds.Content) == 0 {
+		deleteKey(mappingValue(registries, key), "credentials")
+	}
+	if len(mappingValue(registries, key).Content) == 0 {
+		deleteKey(registries, key)
+	}
+	return saveConfigNode(configPath, doc)
+}
+
+// registryKey returns the key in the passed 'registries' mapping node of the config file for
+// the passed normalized registry. The key in the file may not be normalized, e.g. it could be
+// 'registry-1.docker.io' for 'docker.io'. If the registry isn't in the mapping then the
+// passed registry is returned.
+func registryKey(registries *yaml.Node, registry string) string {
+	for i := 0; i+1 < len(registries.Content); i += 2 {
+		if name, err := normalizeRegistry(registries.Content[i].Value); err == nil && name == registry {
+			return registries.Content[i].Value
+		}
+	}
+	return registry
+}
+
+// loadConfigNode loads the config file at the passed path, or the default config file if
+// the path is empty, as a YAML document node so that it can be changed and saved without
+// losing comments. If the file doesn't exist then an empty document is returned. The path
+// of the config file is returned with the document.
+func loadConfigNode(configPath string) (string, *yaml.Node, error) {
+	if configPath == "" {
+		var err error
+		if configPath, err = DefaultConfigPath(); err != nil {
+			return "", nil, err
+		}
+	}
+	doc := &yaml.Node{}
+	b, err := os.ReadFile(configPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", nil, err
+	} else if err := yaml.Unmarshal(b, doc); err != nil {
+		return "", nil, fmt.Errorf("invalid config file %q: %w", configPath, err)
+	}
+	if doc.Kind == 0 {
+		doc = &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	} else if doc.Kind != yaml.DocumentNode || len(doc.Content) != 1 || doc.Content[0].Kind != yaml.MappingNode {
+		return "", nil, fmt.Errorf("invalid config file %q: expected a mapping", configPath)
+	}
+	return configPath, doc, nil
+}
+
+// saveConfigNode writes the passed YAML document to the config file at the passed path,
+// creating the directory of the file if needed.
+func saveConfigNode(configPath string, doc *yaml.Node) error {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(configPath), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(configPath, buf.Bytes(), 0600)
+}
+
+// mappingValue returns the value node of the passed key in the passed mapping node. If
+// the key isn't in the mapping, or its value is empty, then an empty mapping is set as its
+// value and returned.
+func mappingValue(m *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			if v := m.Content[i+1]; v.Kind == yaml.ScalarNode && v.Tag == "!!null" {
+				*v = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			}
+			return m.Content[i+1]
+		}
+	}
+	v := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, v)
+	return v
+}
+
+// scalarValue returns the value of the passed key in the passed mapping node, or the
+// empty string if the key isn't in the mapping.
+func scalarValue(m *yaml.Node, key string) string {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return strings.TrimSpace(m.Content[i+1].Value)
+		}
+	}
+	return ""
+}
+
+// setScalar sets the value of the passed key in the passed mapping node, adding the key
+// if it isn't in the mapping.
+func setScalar(m *yaml.Node, key string, value string) {
+	v := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			m.Content[i+1] = v
+			return
+		}
+	}
+	m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, v)
+}
+
+// deleteKey removes the passed key and its value from the passed mapping node.
+func deleteKey(m *yaml.Node, key string) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			m.Content = append(m.Content[:i], m.Content[i+2:]...)
+			return
+		}
+	}
+}
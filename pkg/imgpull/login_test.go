@@ -0,0 +1,136 @@
+package imgpull
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// TestLoginLogout tests that a login is applied to pulls from the registry, that the
+// rest of the config file is kept, and that logout removes the login.
+func TestLoginLogout(t *testing.T) {
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+	cfgFile := filepath.Join(d, "config.yaml")
+	os.WriteFile(cfgFile, []byte("# my registries\nregistries:\n  localhost:5000:\n    scheme: http\n"), 0644)
+	if err := Login(cfgFile, "my.registry.io:5000", "jqpubli", "frobozz"); err != nil {
+		t.Fatalf("login: %s", err)
+	}
+	b, _ := os.ReadFile(cfgFile)
+	if !strings.Contains(string(b), "# my registries") || strings.Contains(string(b), "frobozz") {
+		t.Errorf("unexpected config file %s", b)
+	}
+	cfg, err := LoadConfig(cfgFile)
+	if err != nil {
+		t.Fatalf("load config: %s", err)
+	}
+	o, err := cfg.Apply(PullerOpts{Url: "my.registry.io:5000/foo:v1"})
+	if err != nil || o.Username != "jqpubli" || o.Password != "frobozz" || cfg.Registries["localhost:5000"].Scheme != "http" {
+		t.Errorf("unexpected options %+v %v", o, err)
+	}
+	passwordFile := cfg.Registries["my.registry.io:5000"].Credentials.PasswordFile
+	if fi, err := os.Stat(passwordFile); err != nil || (runtime.GOOS != "windows" && fi.Mode().Perm() != 0600) {
+		t.Errorf("unexpected password file %q %v", passwordFile, err)
+	}
+	if err := Logout(cfgFile, "my.registry.io:5000"); err != nil {
+		t.Fatalf("logout: %s", err)
+	}
+	if cfg, err = LoadConfig(cfgFile); err != nil {
+		t.Fatalf("load config: %s", err)
+	}
+	if _, found := cfg.Registries["my.registry.io:5000"]; found || cfg.Registries["localhost:5000"].Scheme != "http" {
+		t.Errorf("unexpected config after logout %+v", cfg)
+	}
+	if _, err := os.Stat(passwordFile); err == nil {
+		t.Error("expected logout to remove the password file")
+	}
+	if err := Logout(cfgFile, "my.registry.io:5000"); err == nil {
+		t.Error("expected an error logging out when not logged in")
+	}
+}
+
+// TestLoginCredHelper tests that a login is delegated to the credential helper in the
+// config file, using a fake helper that keeps the credentials in a file.
+func TestLoginCredHelper(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake credential helper is a shell script")
+	}
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+	store := filepath.Join(d, "store")
+	helper := `#!/bin/sh
+case "$1" in
+  store) cat > ` + store + ` ;;
+  get) if [ -f ` + store + ` ]; then cat ` + store + `; else echo "credentials not found in native keychain"; exit 1; fi ;;
+  erase) rm -f ` + store + ` ;;
+esac
+`
+	os.WriteFile(filepath.Join(d, "docker-credential-fake"), []byte(helper), 0755)
+	t.Setenv("PATH", d+string(os.PathListSeparator)+os.Getenv("PATH"))
+	cfgFile := filepath.Join(d, "config.yaml")
+	os.WriteFile(cfgFile, []byte("registries:\n  docker.io:\n    credentials:\n      helper: fake\n"), 0644)
+
+	cfg, _ := LoadConfig(cfgFile)
+	if o, err := cfg.Apply(PullerOpts{Url: "docker.io/hello-world:latest"}); err != nil || o.Username != "" {
+		t.Errorf("expected no credentials before login %+v %v", o, err)
+	}
+	if err := Login(cfgFile, "docker.io", "jqpubli", "frobozz"); err != nil {
+		t.Fatalf("login: %s", err)
+	}
+	if b, _ := os.ReadFile(store); !strings.Contains(string(b), dockerHubServer) {
+		t.Errorf("unexpected stored credentials %s", b)
+	}
+	if o, err := cfg.Apply(PullerOpts{Url: "docker.io/hello-world:latest"}); err != nil || o.Username != "jqpubli" || o.Password != "frobozz" {
+		t.Errorf("unexpected options %+v %v", o, err)
+	}
+	if err := Logout(cfgFile, "docker.io"); err != nil {
+		t.Fatalf("logout: %s", err)
+	}
+	if _, err := os.Stat(store); err == nil {
+		t.Error("expected logout to erase the credentials")
+	}
+}
+
+// TestLoginRegistry tests that the registries passed to login and logout, and in the
+// config file, are normalized, and that a url is rejected.
+func TestLoginRegistry(t *testing.T) {
+	d := t.TempDir()
+	cfgFile := filepath.Join(d, "config.yaml")
+	for _, registry := range []string{"https://my.registry.io", "my.registry.io/v2", "my registry"} {
+		if err := Login(cfgFile, registry, "jqpubli", "frobozz"); err == nil {
+			t.Errorf("expected an error logging in to %q", registry)
+		}
+		if err := Logout(cfgFile, registry); err == nil {
+			t.Errorf("expected an error logging out of %q", registry)
+		}
+	}
+	os.WriteFile(cfgFile, []byte("registries:\n  index.docker.io:\n    scheme: https\n"), 0644)
+	if err := Login(cfgFile, "registry-1.docker.io", "jqpubli", "frobozz"); err != nil {
+		t.Fatalf("login: %s", err)
+	}
+	cfg, err := LoadConfig(cfgFile)
+	if err != nil || len(cfg.Registries) != 1 || cfg.Registries["docker.io"].Scheme != "https" {
+		t.Fatalf("unexpected config %+v %v", cfg, err)
+	}
+	o, err := cfg.Apply(PullerOpts{Url: "docker.io/hello-world:latest"})
+	if err != nil || o.Username != "jqpubli" || o.Password != "frobozz" {
+		t.Errorf("unexpected options %+v %v", o, err)
+	}
+	if err := Logout(cfgFile, "docker.io"); err != nil {
+		t.Fatalf("logout: %s", err)
+	}
+	if cfg, err = LoadConfig(cfgFile); err != nil || cfg.Registries["docker.io"].Credentials.Username != "" {
+		t.Errorf("unexpected config after logout %+v %v", cfg, err)
+	}
+	for _, config := range []string{
+		"registries:\n  https://my.registry.io:\n    scheme: https\n",
+		"registries:\n  docker.io:\n    scheme: https\n  registry-1.docker.io:\n    scheme: https\n",
+	} {
+		os.WriteFile(cfgFile, []byte(config), 0644)
+		if _, err := LoadConfig(cfgFile); err == nil {
+			t.Errorf("expected an error loading %q", config)
+		}
+	}
+}
@@ -1,14 +1,18 @@
 package imgpull
 
 import (
+	"cmp"
 	"encoding/json"
 	"fmt"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/aceeric/imgpull/internal/imgref"
 	"github.com/aceeric/imgpull/internal/tar"
 	"github.com/aceeric/imgpull/internal/util"
 	"github.com/aceeric/imgpull/pkg/imgpull/types"
+	"github.com/aceeric/imgpull/pkg/imgpull/v1docker"
 	"github.com/aceeric/imgpull/pkg/imgpull/v1oci"
 	"github.com/aceeric/imgpull/pkg/imgpull/v2docker"
 )
@@ -22,15 +26,22 @@ const (
 	V1ociIndex
 	V1ociManifest
 	Undefined
+	// V1dockerManifest is the legacy docker schema 1 manifest. It follows Undefined so
+	// that the values of the other types are unchanged.
+	V1dockerManifest
+	// V1ociArtifactManifest is the OCI artifact manifest.
+	V1ociArtifactManifest
 )
 
 // MediaTypeFrom translatest ManifestType which is exported into a media type
 // so the standard media types can be exported from the package.
 var MediaTypeFrom = map[ManifestType]string{
-	V2dockerManifestList: "application/vnd.docker.distribution.manifest.list.v2+json",
-	V2dockerManifest:     "application/vnd.docker.distribution.manifest.v2+json",
-	V1ociIndex:           "application/vnd.oci.image.index.v1+json",
-	V1ociManifest:        "application/vnd.oci.image.manifest.v1+json",
+	V2dockerManifestList:  "application/vnd.docker.distribution.manifest.list.v2+json",
+	V2dockerManifest:      "application/vnd.docker.distribution.manifest.v2+json",
+	V1ociIndex:            "application/vnd.oci.image.index.v1+json",
+	V1ociManifest:         "application/vnd.oci.image.manifest.v1+json",
+	V1dockerManifest:      "application/vnd.docker.distribution.manifest.v1+prettyjws",
+	V1ociArtifactManifest: "application/vnd.oci.artifact.manifest.v1+json",
 }
 
 // ManifestPullType indicates whether to pull an image manifest or an
@@ -50,38 +61,58 @@ var ManifestPullTypeFrom = map[string]ManifestPullType{
 	"list":  ImageList,
 }
 
+// The annotations in an image tarball of an image that was selected from a manifest
+// list: the digest of the manifest list and the digest of the selected image manifest.
+// They are on the image in 'manifest.json' and, with the OCI layout, on the image
+// manifest descriptor in 'index.json'.
+const (
+	AnnotationIndexDigest    = "io.github.aceeric.imgpull.index.digest"
+	AnnotationManifestDigest = "io.github.aceeric.imgpull.manifest.digest"
+)
+
 // manifestTypeToString has string representations for all supported
 // 'ManifestType's.
 var manifestTypeToString = map[ManifestType]string{
-	Undefined:            "Undefined",
-	V2dockerManifestList: "V2dockerManifestList",
-	V2dockerManifest:     "V2dockerManifest",
-	V1ociIndex:           "V1ociIndex",
-	V1ociManifest:        "V1ociManifest",
+	Undefined:             "Undefined",
+	V2dockerManifestList:  "V2dockerManifestList",
+	V2dockerManifest:      "V2dockerManifest",
+	V1ociIndex:            "V1ociIndex",
+	V1ociManifest:         "V1ociManifest",
+	V1dockerManifest:      "V1dockerManifest",
+	V1ociArtifactManifest: "V1ociArtifactManifest",
 }
 
 // ManifestHolder holds one of: v1 oci manifest list, v1 oci manifest, docker v2
-// manifest list, or docker v2 manifest. The original data from the upstream
+// manifest list, docker v2 manifest, legacy docker schema 1 manifest, or OCI artifact
+// manifest. The original data from the upstream
 // is also in the 'Bytes' member of the struct. The 'Bytes' member is the authoritative
 // representation of the upstream data: if you compute a digest from it, the digest
 // will match the 'Digest' field (also from the upstream) The other fields like
 // 'V1ociIndex' are cosmetic and may not produce the same digest as the 'Bytes'
 // field.
 //
+// If the image manifest was selected from a manifest list for a platform, then the
+// 'IndexDigest' field has the digest of the manifest list, so it is possible to trace
+// which multi-arch image the image came from.
+//
 // The struct contains two fields that are not used by this library: Created and Pulled.
 // These are intended for library consumers to be able to track when a manifest was
-// created, or, most recently used.
+// created, or, most recently used. A manifest holder can be saved to a file with 'Save'
+// and loaded with 'LoadManifestHolder' to track manifests over time.
 type ManifestHolder struct {
-	Type                 ManifestType          `json:"type"`
-	Digest               string                `json:"digest"`
-	ImageUrl             string                `json:"imageUrl"`
-	Bytes                []byte                `json:"bytes,omitempty"`
-	V1ociIndex           v1oci.Index           `json:"v1.oci.index"`
-	V1ociManifest        v1oci.Manifest        `json:"v1.oci.manifest"`
-	V2dockerManifestList v2docker.ManifestList `json:"v2.docker.manifestList"`
-	V2dockerManifest     v2docker.Manifest     `json:"v2.docker.manifest"`
-	Created              string                `json:"created"`
-	Pulled               string                `json:"pulled"`
+	Type                  ManifestType           `json:"type"`
+	Digest                string                 `json:"digest"`
+	IndexDigest           string                 `json:"indexDigest,omitempty"`
+	ImageUrl              string                 `json:"imageUrl"`
+	Bytes                 []byte                 `json:"bytes,omitempty"`
+	V1ociIndex            v1oci.Index            `json:"v1.oci.index"`
+	V1ociManifest         v1oci.Manifest         `json:"v1.oci.manifest"`
+	V2dockerManifestList  v2docker.ManifestList  `json:"v2.docker.manifestList"`
+	V2dockerManifest      v2docker.Manifest      `json:"v2.docker.manifest"`
+	V1dockerManifest      v1docker.Manifest      `json:"v1.docker.manifest"`
+	V1ociArtifactManifest v1oci.ArtifactManifest `json:"v1.oci.artifactManifest"`
+	Created               string                 `json:"created"`
+	Pulled                string                 `json:"pulled"`
 }
 
 // ToString renders the manifest held by the receiver into JSON. Only the
@@ -99,6 +130,10 @@ func (mh *ManifestHolder) ToString() (string, error) {
 		marshalled, err = json.MarshalIndent(mh.V1ociIndex, "", "   ")
 	case V1ociManifest:
 		marshalled, err = json.MarshalIndent(mh.V1ociManifest, "", "   ")
+	case V1dockerManifest:
+		marshalled, err = json.MarshalIndent(mh.V1dockerManifest, "", "   ")
+	case V1ociArtifactManifest:
+		marshalled, err = json.MarshalIndent(mh.V1ociArtifactManifest, "", "   ")
 	}
 	return string(marshalled), err
 }
@@ -109,7 +144,7 @@ func NewManifestHolder(mediaType string, bytes []byte, digest string, imageUrl s
 }
 
 // newManifestHolder initializes and returns a ManifestHolder struct for the passed
-// manifest bytes. The manifest bytes will be deserialized into one of the four manifest
+// manifest bytes. The manifest bytes will be deserialized into one of the six manifest
 // variables based on the 'mediaType' arg.
 func newManifestHolder(mediaType types.MediaType, bytes []byte, digest string, imageUrl string) (ManifestHolder, error) {
 	mt := toManifestType(mediaType)
@@ -142,6 +177,10 @@ func toManifestType(mediaType types.MediaType) ManifestType {
 		return V1ociIndex
 	case types.V1ociManifestMt:
 		return V1ociManifest
+	case types.V1dockerManifestMt, types.V1dockerSignedMt:
+		return V1dockerManifest
+	case types.V1ociArtifactMt:
+		return V1ociArtifactManifest
 	default:
 		return Undefined
 	}
@@ -158,6 +197,13 @@ func (mh *ManifestHolder) MediaType() string {
 		return string(types.V1ociIndexMt)
 	case V1ociManifest:
 		return string(types.V1ociManifestMt)
+	case V1dockerManifest:
+		if len(mh.V1dockerManifest.Signatures) != 0 {
+			return string(types.V1dockerSignedMt)
+		}
+		return string(types.V1dockerManifestMt)
+	case V1ociArtifactManifest:
+		return string(types.V1ociArtifactMt)
 	default:
 		return ""
 	}
@@ -176,6 +222,10 @@ func (mh *ManifestHolder) unMarshalManifest(mt ManifestType, bytes []byte) error
 		err = json.Unmarshal(bytes, &mh.V1ociIndex)
 	case V1ociManifest:
 		err = json.Unmarshal(bytes, &mh.V1ociManifest)
+	case V1dockerManifest:
+		err = json.Unmarshal(bytes, &mh.V1dockerManifest)
+	case V1ociArtifactManifest:
+		err = json.Unmarshal(bytes, &mh.V1ociArtifactManifest)
 	default:
 		err = fmt.Errorf("unknown manifest type: %d", mt)
 	}
@@ -194,6 +244,12 @@ func (mh *ManifestHolder) IsImageManifest() bool {
 	return !mh.IsManifestList()
 }
 
+// hasConfig returns true if the manifest held by the ManifestHolder receiver is
+// an image manifest with a config blob.
+func (mh *ManifestHolder) hasConfig() bool {
+	return mh.Type == V2dockerManifest || mh.Type == V1ociManifest
+}
+
 // IsLatest returns true if the manifest held by the ManifestHolder
 // receiver has tag "latest".
 func (mh *ManifestHolder) IsLatest() (bool, error) {
@@ -207,7 +263,9 @@ func (mh *ManifestHolder) IsLatest() (bool, error) {
 
 // Layers returns an array of 'Layer' for the manifest contained by the ManifestHolder
 // receiver. The Config is also returned since that is obtained using the v2/blobs
-// endpoint just like the image Layers.
+// endpoint just like the image Layers. A schema 1 manifest has no config blob so only
+// its layers are returned, ordered from the base layer to the top layer, excluding
+// empty "throwaway" layers. For an OCI artifact manifest, the blobs are returned.
 func (mh *ManifestHolder) Layers() []types.Layer {
 	layers := make([]types.Layer, 0)
 	switch mh.Type {
@@ -241,6 +299,21 @@ func (mh *ManifestHolder) Layers() []types.Layer {
 			Size:      int(mh.V1ociManifest.Config.Size),
 		}
 		layers = append(layers, nl)
+	case V1dockerManifest:
+		m := mh.V1dockerManifest
+		for i := len(m.FSLayers) - 1; i >= 0; i-- {
+			if i < len(m.History) && schema1Throwaway(m.History[i]) {
+				continue
+			}
+			layers = append(layers, types.Layer{
+				Digest:    m.FSLayers[i].BlobSum,
+				MediaType: types.V2dockerLayerGzipMt,
+			})
+		}
+	case V1ociArtifactManifest:
+		for _, b := range mh.V1ociArtifactManifest.Blobs {
+			layers = append(layers, types.NewLayer(types.MediaType(b.MediaType), b.Digest, b.Size))
+		}
 	}
 	return layers
 }
@@ -265,50 +338,210 @@ func (mh *ManifestHolder) ImageManifestDigests() []string {
 	return ims
 }
 
-// GetImageDigestFor looks in the manifest list in the receiver for a manifest in the list
-// matching the passed OS and architecture and if found returns it. Otherwise an error is
-// returned.
-func (mh *ManifestHolder) GetImageDigestFor(os string, arch string) (string, error) {
+// Platform identifies the platform of an image in an image list. The OS version and
+// features are only used by Windows images, which have to match the version of the host.
+type Platform struct {
+	// OS is the operating system, e.g.: 'linux'.
+	OS string
+	// Architecture is the architecture, e.g.: 'amd64'.
+	Architecture string
+	// OSVersion is the operating system version, e.g.: '10.0.17763.5820' for Windows. If
+	// it has fewer than four parts, like '10.0.17763', then it matches any revision.
+	OSVersion string
+	// OSFeatures are the required operating system features, e.g.: 'win32k'.
+	OSFeatures []string
+}
+
+// PlatformManifest is an image manifest in an image list, with its platform.
+type PlatformManifest struct {
+	Platform
+	// Variant is the variant of the architecture, e.g.: 'v8' for 'arm64'.
+	Variant string
+	// MediaType is the media type of the image manifest.
+	MediaType string
+	// Digest is the digest of the image manifest, like 'sha256:abc...'.
+	Digest string
+	// Size is the size of the image manifest in bytes.
+	Size int64
+}
+
+// String returns the platform as 'os/arch', or 'os/arch/variant' if it has a variant,
+// followed by ':os.version' if it has an OS version, e.g. 'windows/amd64:10.0.17763.5820'.
+func (pm PlatformManifest) String() string {
+	s := pm.OS + "/" + pm.Architecture
+	if pm.Variant != "" {
+		s += "/" + pm.Variant
+	}
+	if pm.OSVersion != "" {
+		s += ":" + pm.OSVersion
+	}
+	return s
+}
+
+// Platforms returns the image manifests in the image list manifest in the receiver that
+// have a platform, in the order of the list, so a caller can present a choice of platforms
+// or check that an image supports the platforms it needs. This includes manifests like
+// build attestations that have an 'unknown' OS and architecture. If called for a manifest
+// holder wrapping an image manifest then an empty slice is returned.
+func (mh *ManifestHolder) Platforms() []PlatformManifest {
+	pms := []PlatformManifest{}
 	switch mh.Type {
 	case V2dockerManifestList:
-		for _, mfst := range mh.V2dockerManifestList.Manifests {
-			if mfst.Platform.OS == os && mfst.Platform.Architecture == arch {
-				return mfst.Digest, nil
+		for _, m := range mh.V2dockerManifestList.Manifests {
+			if m.Platform == nil {
+				continue
 			}
+			pms = append(pms, PlatformManifest{
+				Platform: Platform{
+					OS:           m.Platform.OS,
+					Architecture: m.Platform.Architecture,
+					OSVersion:    m.Platform.OSVersion,
+					OSFeatures:   m.Platform.OSFeatures,
+				},
+				Variant:   m.Platform.Variant,
+				MediaType: m.MediaType,
+				Digest:    m.Digest,
+				Size:      m.Size,
+			})
 		}
 	case V1ociIndex:
-		for _, mfst := range mh.V1ociIndex.Manifests {
-			if mfst.Platform.Os == os && mfst.Platform.Architecture == arch {
-				return mfst.Digest, nil
+		for _, m := range mh.V1ociIndex.Manifests {
+			if m.Platform == nil {
+				continue
 			}
+			pms = append(pms, PlatformManifest{
+				Platform: Platform{
+					OS:           m.Platform.Os,
+					Architecture: m.Platform.Architecture,
+					OSVersion:    m.Platform.OsVersion,
+					OSFeatures:   m.Platform.OsFeatures,
+				},
+				Variant:   m.Platform.Variant,
+				MediaType: m.MediaType,
+				Digest:    m.Digest,
+				Size:      m.Size,
+			})
+		}
+	}
+	return pms
+}
+
+// GetImageDigestFor looks in the manifest list in the receiver for a manifest in the list
+// matching the passed OS and architecture and if found returns it. Otherwise an error is
+// returned.
+func (mh *ManifestHolder) GetImageDigestFor(os string, arch string) (string, error) {
+	return mh.GetImageDigestForPlatform(Platform{OS: os, Architecture: arch})
+}
+
+// GetImageDigestForPlatform looks in the manifest list in the receiver for a manifest in
+// the list matching the passed platform and if found returns it. Otherwise an error is
+// returned. If the platform has an OS version, then a manifest with the same version is
+// selected, else the manifest with the same major, minor, and build version that has the
+// highest revision. E.g. '10.0.17763' or '10.0.17763.1' selects '10.0.17763.5820' over
+// '10.0.17763.1879', but never '10.0.20348.2461'. If the platform has OS features, then
+// only manifests with all those features are selected. If the platform has no OS version
+// then the first manifest matching the OS and architecture is selected.
+func (mh *ManifestHolder) GetImageDigestForPlatform(pl Platform) (string, error) {
+	entries := mh.Platforms()
+	var best *PlatformManifest
+	for i, e := range entries {
+		if e.OS != pl.OS || e.Architecture != pl.Architecture || !hasAll(e.OSFeatures, pl.OSFeatures) {
+			continue
+		}
+		if pl.OSVersion == "" || e.OSVersion == pl.OSVersion {
+			return e.Digest, nil
+		}
+		if sameBuild(e.OSVersion, pl.OSVersion) && (best == nil || compareRevision(e.OSVersion, best.OSVersion) > 0) {
+			best = &entries[i]
+		}
+	}
+	if best != nil {
+		return best.Digest, nil
+	}
+	if pl.OSVersion != "" {
+		return "", fmt.Errorf("unable to get manifest SHA for os %q, arch %q, os version %q", pl.OS, pl.Architecture, pl.OSVersion)
+	}
+	return "", fmt.Errorf("unable to get manifest SHA for os %q, arch %q", pl.OS, pl.Architecture)
+}
+
+// hasAll returns true if the 'have' slice has all the elements of the 'want' slice.
+func hasAll(have []string, want []string) bool {
+	for _, w := range want {
+		if !slices.Contains(have, w) {
+			return false
 		}
 	}
-	return "", fmt.Errorf("unable to get manifest SHA for os %q, arch %q", os, arch)
+	return true
+}
+
+// sameBuild returns true if the passed OS versions have the same major, minor, and build
+// version, e.g. '10.0.17763.1879' and '10.0.17763.5820'.
+func sameBuild(v1 string, v2 string) bool {
+	p1, p2 := strings.Split(v1, "."), strings.Split(v2, ".")
+	if len(p1) < 3 || len(p2) < 3 {
+		return false
+	}
+	return slices.Equal(p1[:3], p2[:3])
+}
+
+// compareRevision compares the revisions - the fourth part - of the passed OS versions
+// numerically. A version with no revision is lower than one with a revision.
+func compareRevision(v1 string, v2 string) int {
+	revision := func(v string) int {
+		parts := strings.Split(v, ".")
+		if len(parts) < 4 {
+			return -1
+		}
+		n, err := strconv.Atoi(parts[3])
+		if err != nil {
+			return -1
+		}
+		return n
+	}
+	return cmp.Compare(revision(v1), revision(v2))
 }
 
 // newImageTarball creates an 'imageTarball' struct from the passed receiver and args.
 // The 'sourceDir' arg specifies where the blob files can be found. The function doesn't
 // create the tarball but the struct that is returned has everything needed for the
-// caller to create the tarball.
+// caller to create the tarball. Since a schema 1 manifest has no config blob, one is
+// generated into 'sourceDir' for it.
 func (mh *ManifestHolder) newImageTarball(iref imgref.ImageRef, sourceDir string) (tar.ImageTarball, error) {
 	itb := tar.ImageTarball{
 		SourceDir: sourceDir,
 	}
 	switch mh.Type {
 	case V2dockerManifest:
+		itb.Manifest, itb.ManifestMediaType = mh.Bytes, types.V2dockerManifestMt
 		itb.ConfigDigest = util.DigestFrom(mh.V2dockerManifest.Config.Digest)
-		itb.ImageUrl = iref.UrlWithNs()
 		for _, layer := range mh.V2dockerManifest.Layers {
 			itb.Layers = append(itb.Layers, types.NewLayer(types.MediaType(layer.MediaType), layer.Digest, layer.Size))
 		}
 	case V1ociManifest:
+		itb.Manifest, itb.ManifestMediaType = mh.Bytes, types.V1ociManifestMt
 		itb.ConfigDigest = util.DigestFrom(mh.V1ociManifest.Config.Digest)
-		itb.ImageUrl = iref.UrlWithNs()
 		for _, layer := range mh.V1ociManifest.Layers {
 			itb.Layers = append(itb.Layers, types.NewLayer(types.MediaType(layer.MediaType), layer.Digest, layer.Size))
 		}
+	case V1dockerManifest:
+		configDigest, err := mh.schema1Config(sourceDir)
+		if err != nil {
+			return itb, err
+		}
+		itb.ConfigDigest = configDigest
+		itb.Layers = mh.Layers()
 	default:
 		return itb, fmt.Errorf("can't create docker tar manifest from %q kind of manifest", manifestTypeToString[mh.Type])
 	}
+	if mh.IndexDigest != "" {
+		itb.Annotations = map[string]string{
+			AnnotationIndexDigest:    "sha256:" + mh.IndexDigest,
+			AnnotationManifestDigest: "sha256:" + mh.Digest,
+		}
+	}
+	// an image pulled by digest has no tag, and 'repo@sha256:...' isn't a valid repo tag
+	if !iref.ByDigest() {
+		itb.RepoTags = []string{iref.UrlWithNs()}
+	}
 	return itb, nil
 }
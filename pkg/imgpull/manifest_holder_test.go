@@ -1,6 +1,15 @@
 package imgpull
 
-import "testing"
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+	"github.com/aceeric/imgpull/pkg/imgpull/v1oci"
+)
 
 func TestIsLatest(t *testing.T) {
 	for _, urlTest := range []struct {
@@ -22,3 +31,151 @@ func TestIsLatest(t *testing.T) {
 		}
 	}
 }
+
+func TestAnnotations(t *testing.T) {
+	imageManifest, err := os.ReadFile(filepath.Join("..", "..", "mock", "testfiles", "imageManifest.json"))
+	if err != nil {
+		t.FailNow()
+	}
+	mh, err := NewManifestHolder(string(types.V1ociManifestMt), imageManifest, "", "docker.io/hello-world:latest")
+	if err != nil {
+		t.FailNow()
+	}
+	if len(mh.Annotations()) != 4 || mh.Annotation(v1oci.AnnotationURL) != "https://hub.docker.com/_/hello-world" {
+		t.Fail()
+	}
+	if mh.Annotation("frobozz") != "" || mh.DescriptorAnnotations(mh.Layers()[0].Digest) != nil {
+		t.Fail()
+	}
+	manifestList, err := os.ReadFile(filepath.Join("..", "..", "mock", "testfiles", "manifestList.json"))
+	if err != nil {
+		t.FailNow()
+	}
+	mh, err = NewManifestHolder(string(types.V1ociIndexMt), manifestList, "", "docker.io/hello-world:latest")
+	if err != nil {
+		t.FailNow()
+	}
+	if mh.Annotations() != nil {
+		t.Fail()
+	}
+	da := mh.DescriptorAnnotations("sha256:579b3724a7b189f6dca599a46f16d801a43d5def185de0b7bcd5fb9d1e312c27")
+	if da["vnd.docker.reference.type"] != "attestation-manifest" {
+		t.Fail()
+	}
+}
+
+func TestSubjectAndArtifactType(t *testing.T) {
+	subject := `{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"sha256:e2fc4e5012d16e7fe466f5291c476431beaa1f9b90a5c2125b493ed28e2aba57","size":1035}`
+	config := `{"mediaType":"%s","digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","size":2}`
+	tests := []struct {
+		mediaType    types.MediaType
+		manifest     string
+		artifactType string
+		isReferrer   bool
+	}{
+		{types.V1ociManifestMt, `{"schemaVersion":2,"artifactType":"application/vnd.example.sbom","config":` + fmt.Sprintf(config, types.V1ociEmptyMt) + `,"layers":[],"subject":` + subject + `}`, "application/vnd.example.sbom", true},
+		{types.V1ociManifestMt, `{"schemaVersion":2,"config":` + fmt.Sprintf(config, "application/vnd.example.sig") + `,"layers":[],"subject":` + subject + `}`, "application/vnd.example.sig", true},
+		{types.V1ociManifestMt, `{"schemaVersion":2,"config":` + fmt.Sprintf(config, types.V1ociEmptyMt) + `,"layers":[]}`, "", false},
+		{types.V1ociIndexMt, `{"schemaVersion":2,"artifactType":"application/vnd.example.bundle","manifests":[],"subject":` + subject + `}`, "application/vnd.example.bundle", true},
+		{types.V1ociArtifactMt, `{"mediaType":"application/vnd.oci.artifact.manifest.v1+json","artifactType":"application/vnd.example.sig","subject":` + subject + `}`, "application/vnd.example.sig", true},
+		{types.V2dockerManifestMt, `{"schemaVersion":2,"config":` + fmt.Sprintf(config, "application/vnd.docker.container.image.v1+json") + `,"layers":[]}`, "", false},
+	}
+	for _, test := range tests {
+		mh, err := NewManifestHolder(string(test.mediaType), []byte(test.manifest), "", "quay.io/foo:v1")
+		if err != nil {
+			t.FailNow()
+		}
+		if mh.ArtifactType() != test.artifactType || mh.IsReferrer() != test.isReferrer {
+			t.Errorf("unexpected artifact type %q or referrer %t for %s", mh.ArtifactType(), mh.IsReferrer(), test.manifest)
+		}
+		if test.isReferrer && mh.Subject().Digest != "sha256:e2fc4e5012d16e7fe466f5291c476431beaa1f9b90a5c2125b493ed28e2aba57" {
+			t.Fail()
+		}
+		// the linkage survives serialization
+		if s, err := mh.ToString(); err != nil || test.isReferrer != strings.Contains(s, `"subject"`) {
+			t.Fail()
+		}
+	}
+}
+
+// Tests selecting an image from an image list by OS version and OS features.
+func TestGetImageDigestForPlatform(t *testing.T) {
+	index := `{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.oci.image.index.v1+json",
+  "manifests": [
+    {"mediaType": "application/vnd.oci.image.manifest.v1+json", "size": 1, "digest": "sha256:linux",
+     "platform": {"architecture": "amd64", "os": "linux"}},
+    {"mediaType": "application/vnd.oci.image.manifest.v1+json", "size": 1, "digest": "sha256:1809-old",
+     "platform": {"architecture": "amd64", "os": "windows", "os.version": "10.0.17763.1879"}},
+    {"mediaType": "application/vnd.oci.image.manifest.v1+json", "size": 1, "digest": "sha256:1809",
+     "platform": {"architecture": "amd64", "os": "windows", "os.version": "10.0.17763.5820"}},
+    {"mediaType": "application/vnd.oci.image.manifest.v1+json", "size": 1, "digest": "sha256:ltsc2022",
+     "platform": {"architecture": "amd64", "os": "windows", "os.version": "10.0.20348.2461", "os.features": ["win32k"]}},
+    {"mediaType": "application/vnd.oci.image.manifest.v1+json", "size": 1, "digest": "sha256:arm64",
+     "platform": {"architecture": "arm64", "os": "windows", "os.version": "10.0.26100.1"}},
+    {"mediaType": "application/vnd.oci.image.manifest.v1+json", "size": 1, "digest": "sha256:noplatform"}
+  ]
+}`
+	mh, err := newManifestHolder(types.V1ociIndexMt, []byte(index), "", "")
+	if err != nil {
+		t.FailNow()
+	}
+	for _, tst := range []struct {
+		platform Platform
+		expected string
+	}{
+		{Platform{OS: "linux", Architecture: "amd64"}, "sha256:linux"},
+		{Platform{OS: "windows", Architecture: "amd64"}, "sha256:1809-old"},
+		{Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.1879"}, "sha256:1809-old"},
+		{Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763"}, "sha256:1809"},
+		{Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.1"}, "sha256:1809"},
+		{Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.20348"}, "sha256:ltsc2022"},
+		{Platform{OS: "windows", Architecture: "amd64", OSFeatures: []string{"win32k"}}, "sha256:ltsc2022"},
+		{Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763", OSFeatures: []string{"win32k"}}, ""},
+		{Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.14393"}, ""},
+		{Platform{OS: "windows", Architecture: "amd64", OSVersion: "10"}, ""},
+		{Platform{OS: "windows", Architecture: "arm64"}, "sha256:arm64"},
+	} {
+		digest, err := mh.GetImageDigestForPlatform(tst.platform)
+		if digest != tst.expected || (err == nil) != (tst.expected != "") {
+			t.Errorf("platform %+v: expected %q, got %q (%v)", tst.platform, tst.expected, digest, err)
+		}
+	}
+}
+
+func TestPlatforms(t *testing.T) {
+	list := `{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.docker.distribution.manifest.list.v2+json",
+  "manifests": [
+    {"mediaType": "application/vnd.docker.distribution.manifest.v2+json", "size": 525, "digest": "sha256:amd64",
+     "platform": {"architecture": "amd64", "os": "linux"}},
+    {"mediaType": "application/vnd.docker.distribution.manifest.v2+json", "size": 527, "digest": "sha256:arm64",
+     "platform": {"architecture": "arm64", "os": "linux", "variant": "v8"}},
+    {"mediaType": "application/vnd.docker.distribution.manifest.v2+json", "size": 1125, "digest": "sha256:windows",
+     "platform": {"architecture": "amd64", "os": "windows", "os.version": "10.0.17763.5820"}}
+  ]
+}`
+	mh, err := newManifestHolder(types.V2dockerManifestListMt, []byte(list), "", "")
+	if err != nil {
+		t.FailNow()
+	}
+	pms := mh.Platforms()
+	expected := []string{"linux/amd64", "linux/arm64/v8", "windows/amd64:10.0.17763.5820"}
+	if len(pms) != len(expected) {
+		t.Fatalf("expected %d platforms, got %d", len(expected), len(pms))
+	}
+	for i, pm := range pms {
+		if pm.String() != expected[i] {
+			t.Errorf("expected %q, got %q", expected[i], pm.String())
+		}
+	}
+	if pms[1].Digest != "sha256:arm64" || pms[1].Size != 527 || pms[1].MediaType != string(types.V2dockerManifestMt) {
+		t.Errorf("unexpected platform manifest %+v", pms[1])
+	}
+	image, _ := newManifestHolder(types.V1ociManifestMt, []byte(`{"schemaVersion":2,"layers":[]}`), "", "")
+	if len(image.Platforms()) != 0 {
+		t.Errorf("expected no platforms for an image manifest")
+	}
+}
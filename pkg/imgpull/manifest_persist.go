@@ -0,0 +1,95 @@
+package imgpull
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// savedManifestVersion is the version of the format written by 'Save'. It is
+// incremented if the format changes in a way that older versions can't load.
+const savedManifestVersion = 1
+
+// savedManifest is the format of a manifest holder saved by 'Save'. Only the
+// upstream manifest and the fields that can't be derived from it are saved. The
+// other fields of the manifest holder are unmarshalled from the manifest when it
+// is loaded, so the format doesn't change if those fields change.
+type savedManifest struct {
+	Version     int    `json:"version"`
+	MediaType   string `json:"mediaType"`
+	Digest      string `json:"digest"`
+	IndexDigest string `json:"indexDigest,omitempty"`
+	ImageUrl    string `json:"imageUrl"`
+	Manifest    []byte `json:"manifest"`
+	Created     string `json:"created,omitempty"`
+	Pulled      string `json:"pulled,omitempty"`
+}
+
+// Save writes the receiver to the passed file so it can be loaded later with
+// 'LoadManifestHolder'. The manifest is saved exactly as it was received from
+// the upstream, along with the digests, image url, and the 'Created' and 'Pulled'
+// fields. The file is written to a temp file in the same directory and then renamed,
+// so a partially written file never replaces an existing one.
+func (mh *ManifestHolder) Save(path string) error {
+	if len(mh.Bytes) == 0 {
+		return fmt.Errorf("manifest for %q has no content to save", mh.ImageUrl)
+	}
+	b, err := json.MarshalIndent(savedManifest{
+		Version:     savedManifestVersion,
+		MediaType:   mh.MediaType(),
+		Digest:      mh.Digest,
+		IndexDigest: mh.IndexDigest,
+		ImageUrl:    mh.ImageUrl,
+		Manifest:    mh.Bytes,
+		Created:     mh.Created,
+		Pulled:      mh.Pulled,
+	}, "", "   ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.partial")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// LoadManifestHolder loads a manifest holder saved by 'Save' from the passed file.
+// An error is returned if the saved manifest doesn't match its digest.
+func LoadManifestHolder(path string) (ManifestHolder, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return ManifestHolder{}, err
+	}
+	sm := savedManifest{}
+	if err := json.Unmarshal(b, &sm); err != nil {
+		return ManifestHolder{}, fmt.Errorf("invalid saved manifest %q: %w", path, err)
+	}
+	if sm.Version != savedManifestVersion {
+		return ManifestHolder{}, fmt.Errorf("unsupported saved manifest version %d in %q", sm.Version, path)
+	}
+	if sm.Digest != "" && digest.FromBytes(sm.Manifest).Encoded() != sm.Digest {
+		return ManifestHolder{}, &types.ErrDigestMismatch{Url: sm.ImageUrl, Expected: "sha256:" + sm.Digest, Actual: digest.FromBytes(sm.Manifest).String()}
+	}
+	mh, err := newManifestHolder(types.MediaType(sm.MediaType), sm.Manifest, sm.Digest, sm.ImageUrl)
+	if err != nil {
+		return ManifestHolder{}, fmt.Errorf("invalid saved manifest %q: %w", path, err)
+	}
+	mh.IndexDigest, mh.Created, mh.Pulled = sm.IndexDigest, sm.Created, sm.Pulled
+	return mh, nil
+}
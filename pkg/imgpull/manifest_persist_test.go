@@ -0,0 +1,66 @@
+package imgpull
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Tests that a saved manifest holder is loaded with the same content, that saving
+// twice produces the same file, and that a manifest that doesn't match its digest
+// isn't loaded.
+func TestSaveLoadManifestHolder(t *testing.T) {
+	imageManifest, err := os.ReadFile(filepath.Join("..", "..", "mock", "testfiles", "imageManifest.json"))
+	if err != nil {
+		t.FailNow()
+	}
+	mh, err := NewManifestHolder(string(types.V1ociManifestMt), imageManifest, digest.FromBytes(imageManifest).Encoded(), "docker.io/hello-world:latest")
+	if err != nil {
+		t.FailNow()
+	}
+	mh.IndexDigest = digest.FromString("frobozz").Encoded()
+	mh.Created = "2024-01-02T03:04:05Z"
+	mh.Pulled = "2024-06-07T08:09:10Z"
+	d := t.TempDir()
+	path := filepath.Join(d, "manifest.json")
+	if err := mh.Save(path); err != nil {
+		t.Fatalf("save: %s", err)
+	}
+	saved, err := os.ReadFile(path)
+	if err != nil {
+		t.FailNow()
+	}
+	loaded, err := LoadManifestHolder(path)
+	if err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if !reflect.DeepEqual(mh, loaded) {
+		t.Errorf("expected %+v, got %+v", mh, loaded)
+	}
+	if err := loaded.Save(path); err != nil {
+		t.FailNow()
+	}
+	if resaved, err := os.ReadFile(path); err != nil || string(resaved) != string(saved) {
+		t.Errorf("expected the same file when saved again")
+	}
+	if entries, _ := os.ReadDir(d); len(entries) != 1 {
+		t.Errorf("expected no temp files to be left behind")
+	}
+	tampered := filepath.Join(d, "tampered.json")
+	if os.WriteFile(tampered, []byte(strings.Replace(string(saved), mh.Digest, digest.FromString("fizzbin").Encoded(), 1)), 0644) != nil {
+		t.FailNow()
+	}
+	if _, err := LoadManifestHolder(tampered); !errors.As(err, new(*types.ErrDigestMismatch)) {
+		t.Errorf("expected a digest mismatch, got %v", err)
+	}
+	if err := (&ManifestHolder{}).Save(path); err == nil {
+		t.Errorf("expected an error saving an empty manifest holder")
+	}
+}
@@ -0,0 +1,54 @@
+package imgpull
+
+import (
+	"sync"
+
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+)
+
+// MemoryManifestCache is an in-memory 'types.ManifestCache'. When it is full, the manifest
+// that was cached first is evicted to make room. A MemoryManifestCache is safe for
+// concurrent use.
+type MemoryManifestCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	manifests  map[string]types.CachedManifest
+	// keys has the keys in the order they were added, for eviction
+	keys []string
+}
+
+// NewManifestCache returns an empty in-memory manifest cache that holds up to 'maxEntries'
+// manifests. If 'maxEntries' is zero or less then the number of manifests is not limited.
+func NewManifestCache(maxEntries int) *MemoryManifestCache {
+	return &MemoryManifestCache{
+		maxEntries: maxEntries,
+		manifests:  map[string]types.CachedManifest{},
+	}
+}
+
+func (mc *MemoryManifestCache) Get(key string) (types.CachedManifest, bool) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	cm, found := mc.manifests[key]
+	return cm, found
+}
+
+func (mc *MemoryManifestCache) Put(key string, cm types.CachedManifest) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if _, found := mc.manifests[key]; !found {
+		if mc.maxEntries > 0 && len(mc.keys) >= mc.maxEntries {
+			delete(mc.manifests, mc.keys[0])
+			mc.keys = mc.keys[1:]
+		}
+		mc.keys = append(mc.keys, key)
+	}
+	mc.manifests[key] = cm
+}
+
+// Len returns the number of manifests in the cache.
+func (mc *MemoryManifestCache) Len() int {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return len(mc.manifests)
+}
@@ -0,0 +1,29 @@
+package imgpull
+
+import (
+	"testing"
+
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+)
+
+func TestManifestCache(t *testing.T) {
+	mc := NewManifestCache(2)
+	if _, found := mc.Get("a"); found {
+		t.FailNow()
+	}
+	mc.Put("a", types.CachedManifest{ETag: "1"})
+	mc.Put("b", types.CachedManifest{ETag: "2"})
+	// replacing a manifest doesn't evict
+	mc.Put("a", types.CachedManifest{ETag: "3"})
+	if cm, found := mc.Get("a"); !found || cm.ETag != "3" || mc.Len() != 2 {
+		t.FailNow()
+	}
+	// the first manifest cached is evicted
+	mc.Put("c", types.CachedManifest{ETag: "4"})
+	if _, found := mc.Get("a"); found || mc.Len() != 2 {
+		t.FailNow()
+	}
+	if cm, found := mc.Get("c"); !found || cm.ETag != "4" {
+		t.FailNow()
+	}
+}
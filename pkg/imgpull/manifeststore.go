@@ -0,0 +1,215 @@
+package imgpull
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aceeric/imgpull/internal/util"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// ManifestStore is a directory of saved manifest holders, keyed by image url, with an
+// in-memory index by url and by digest. It is intended for things like a pull-through
+// cache, which looks up manifests by url or digest, and watching tags, which keeps the
+// most recent manifest for each url. The 'Created' and 'Pulled' fields of the stored
+// manifest holders are RFC 3339 timestamps, which are used to prune the store by age.
+// A ManifestStore is safe for concurrent use by multiple goroutines, but the directory
+// must not be shared by more than one store.
+type ManifestStore struct {
+	dir      string
+	mu       sync.Mutex
+	byUrl    map[string]ManifestHolder
+	byDigest map[string][]string
+}
+
+// NewManifestStore returns a store in the passed directory, which is created if it
+// doesn't exist. The manifests already in the directory are loaded into the store.
+func NewManifestStore(dir string) (*ManifestStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &ManifestStore{
+		dir:      dir,
+		byUrl:    map[string]ManifestHolder{},
+		byDigest: map[string][]string{},
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		mh, err := LoadManifestHolder(file)
+		if err != nil {
+			return nil, err
+		}
+		s.index(mh)
+	}
+	return s, nil
+}
+
+// Put adds the passed manifest holder to the store, replacing the manifest for its
+// image url if there is one. If the 'Created' field is empty then it is set to the
+// current time.
+func (s *ManifestStore) Put(mh ManifestHolder) error {
+	if mh.ImageUrl == "" {
+		return fmt.Errorf("manifest with digest %q has no image url", mh.Digest)
+	}
+	if mh.Created == "" {
+		mh.Created = time.Now().UTC().Format(time.RFC3339)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := mh.Save(s.pathFor(mh.ImageUrl)); err != nil {
+		return err
+	}
+	s.unindex(mh.ImageUrl)
+	s.index(mh)
+	return nil
+}
+
+// Get returns the manifest holder for the passed image url, and false if the store
+// doesn't have it.
+func (s *ManifestStore) Get(url string) (ManifestHolder, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mh, found := s.byUrl[url]
+	return mh, found
+}
+
+// GetByDigest returns a manifest holder with the passed digest, with or without the
+// algorithm, and false if the store doesn't have one. If more than one image url has the
+// digest then the manifest holder for the first url in sort order is returned.
+func (s *ManifestStore) GetByDigest(dgst string) (ManifestHolder, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	urls := s.byDigest[util.DigestFrom(dgst)]
+	if len(urls) == 0 {
+		return ManifestHolder{}, false
+	}
+	return s.byUrl[urls[0]], true
+}
+
+// Touch sets the 'Pulled' field of the manifest holder for the passed image url to
+// the current time, so that it isn't pruned. It returns false if the store doesn't
+// have the url.
+func (s *ManifestStore) Touch(url string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mh, found := s.byUrl[url]
+	if !found {
+		return false, nil
+	}
+	mh.Pulled = time.Now().UTC().Format(time.RFC3339)
+	if err := mh.Save(s.pathFor(url)); err != nil {
+		return true, err
+	}
+	s.byUrl[url] = mh
+	return true, nil
+}
+
+// Delete removes the manifest holder for the passed image url from the store. It is
+// not an error if the store doesn't have the url.
+func (s *ManifestStore) Delete(url string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.delete(url)
+}
+
+// List returns the manifest holders in the store sorted by image url.
+func (s *ManifestStore) List() []ManifestHolder {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mhs := make([]ManifestHolder, 0, len(s.byUrl))
+	for _, mh := range s.byUrl {
+		mhs = append(mhs, mh)
+	}
+	slices.SortFunc(mhs, func(a, b ManifestHolder) int {
+		return cmp.Compare(a.ImageUrl, b.ImageUrl)
+	})
+	return mhs
+}
+
+// Prune removes the manifest holders that were last used more than 'maxAge' ago, and
+// returns the image urls that were removed. A manifest holder was last used when it
+// was pulled, or when it was created if it was never pulled. A manifest holder with no
+// valid timestamps is removed.
+func (s *ManifestStore) Prune(maxAge time.Duration) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cutoff := time.Now().Add(-maxAge)
+	pruned := []string{}
+	for url, mh := range s.byUrl {
+		if !lastUsed(mh).Before(cutoff) {
+			continue
+		}
+		if err := s.delete(url); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, url)
+	}
+	slices.Sort(pruned)
+	return pruned, nil
+}
+
+// lastUsed returns the time in the 'Pulled' field of the passed manifest holder, or
+// the time in the 'Created' field if 'Pulled' is empty or invalid. If neither is
+// valid then the zero time is returned.
+func lastUsed(mh ManifestHolder) time.Time {
+	for _, ts := range []string{mh.Pulled, mh.Created} {
+		if t, err := time.Parse(time.RFC3339, ts); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// delete removes the file and the index entries for the passed url. The caller must
+// hold the lock.
+func (s *ManifestStore) delete(url string) error {
+	if _, found := s.byUrl[url]; !found {
+		return nil
+	}
+	if err := os.Remove(s.pathFor(url)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	s.unindex(url)
+	return nil
+}
+
+// index adds the passed manifest holder to the indexes. The caller must hold the
+// lock, except when the store is being created.
+func (s *ManifestStore) index(mh ManifestHolder) {
+	s.byUrl[mh.ImageUrl] = mh
+	urls := append(s.byDigest[mh.Digest], mh.ImageUrl)
+	slices.Sort(urls)
+	s.byDigest[mh.Digest] = urls
+}
+
+// unindex removes the passed url from the indexes. The caller must hold the lock.
+func (s *ManifestStore) unindex(url string) {
+	mh, found := s.byUrl[url]
+	if !found {
+		return
+	}
+	delete(s.byUrl, url)
+	urls := slices.DeleteFunc(s.byDigest[mh.Digest], func(u string) bool { return u == url })
+	if len(urls) == 0 {
+		delete(s.byDigest, mh.Digest)
+	} else {
+		s.byDigest[mh.Digest] = urls
+	}
+}
+
+// pathFor returns the path of the file for the passed image url. The file name is the
+// digest of the url since urls have characters that aren't valid in file names.
+func (s *ManifestStore) pathFor(url string) string {
+	return filepath.Join(s.dir, digest.FromString(url).Encoded()+".json")
+}
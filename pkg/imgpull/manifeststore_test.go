@@ -0,0 +1,79 @@
+package imgpull
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Tests adding, looking up, listing, reloading, and pruning manifests in a store.
+func TestManifestStore(t *testing.T) {
+	imageManifest, err := os.ReadFile(filepath.Join("..", "..", "mock", "testfiles", "imageManifest.json"))
+	if err != nil {
+		t.FailNow()
+	}
+	dgst := digest.FromBytes(imageManifest)
+	byTag, err := NewManifestHolder(string(types.V1ociManifestMt), imageManifest, dgst.Encoded(), "docker.io/hello-world:latest")
+	if err != nil {
+		t.FailNow()
+	}
+	byDigest := byTag
+	byDigest.ImageUrl = "docker.io/hello-world@" + dgst.String()
+	byDigest.Created = time.Now().Add(-48 * time.Hour).UTC().Format(time.RFC3339)
+	d := t.TempDir()
+	s, err := NewManifestStore(d)
+	if err != nil {
+		t.FailNow()
+	}
+	for _, mh := range []ManifestHolder{byTag, byDigest} {
+		if err := s.Put(mh); err != nil {
+			t.Fatalf("put: %s", err)
+		}
+	}
+	if err := s.Put(ManifestHolder{}); err == nil {
+		t.Errorf("expected an error for a manifest with no url")
+	}
+	if mh, found := s.Get(byTag.ImageUrl); !found || mh.Digest != dgst.Encoded() || mh.Created == "" {
+		t.Errorf("expected to get the manifest by url")
+	}
+	if _, found := s.Get("docker.io/frobozz:latest"); found {
+		t.Errorf("expected no manifest for an unknown url")
+	}
+	for _, dg := range []string{dgst.String(), dgst.Encoded()} {
+		if mh, found := s.GetByDigest(dg); !found || mh.ImageUrl != byTag.ImageUrl {
+			t.Errorf("expected to get the manifest by digest %q", dg)
+		}
+	}
+	// reload the store from the directory
+	if s, err = NewManifestStore(d); err != nil {
+		t.Fatalf("reload: %s", err)
+	}
+	list := s.List()
+	if len(list) != 2 || list[0].ImageUrl != byTag.ImageUrl || list[1].ImageUrl != byDigest.ImageUrl {
+		t.Errorf("unexpected list %v", list)
+	}
+	pruned, err := s.Prune(24 * time.Hour)
+	if err != nil || len(pruned) != 1 || pruned[0] != byDigest.ImageUrl {
+		t.Errorf("expected %q to be pruned, got %v", byDigest.ImageUrl, pruned)
+	}
+	if mh, found := s.GetByDigest(dgst.Encoded()); !found || mh.ImageUrl != byTag.ImageUrl {
+		t.Errorf("expected the remaining url for the digest")
+	}
+	if found, err := s.Touch(byTag.ImageUrl); !found || err != nil {
+		t.Errorf("expected to touch %q", byTag.ImageUrl)
+	}
+	if mh, _ := s.Get(byTag.ImageUrl); mh.Pulled == "" {
+		t.Errorf("expected the pulled time to be set")
+	}
+	if err := s.Delete(byTag.ImageUrl); err != nil || len(s.List()) != 0 {
+		t.Errorf("expected an empty store")
+	}
+	if files, _ := os.ReadDir(d); len(files) != 0 {
+		t.Errorf("expected no files in the store directory")
+	}
+}
@@ -0,0 +1,73 @@
+package imgpull
+
+import (
+	"encoding/json"
+	"mime"
+
+	"github.com/aceeric/imgpull/internal/methods"
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+)
+
+// MediaTypeCheck is how a puller handles a manifest whose Content-Type header doesn't
+// match the 'mediaType' field in the manifest, or doesn't match the media type of the
+// descriptor in the image list that the manifest was selected from. By default the
+// header is trusted.
+type MediaTypeCheck string
+
+const (
+	// MediaTypeCheckOff trusts the Content-Type header.
+	MediaTypeCheckOff MediaTypeCheck = ""
+	// MediaTypeCheckWarn trusts the Content-Type header but emits a 'MediaTypeMismatch'
+	// event with a '*types.ErrMediaTypeMismatch' for each mismatch.
+	MediaTypeCheckWarn MediaTypeCheck = "warn"
+	// MediaTypeCheckStrict fails with a '*types.ErrMediaTypeMismatch' on a mismatch.
+	MediaTypeCheckStrict MediaTypeCheck = "strict"
+)
+
+// manifestHolderFrom returns a ManifestHolder for the passed manifest response, checking
+// the media type of the response according to the 'MediaTypeCheck' in the receiver's
+// options. If 'expected' is not empty then it is the media type of the descriptor that
+// the manifest was requested by.
+func (p *puller) manifestHolderFrom(mr methods.ManifestGetResult, imageUrl string, expected types.MediaType) (ManifestHolder, error) {
+	if p.Opts.MediaTypeCheck != MediaTypeCheckOff {
+		if err := checkMediaType(mr, imageUrl, expected); err != nil {
+			if p.Opts.MediaTypeCheck == MediaTypeCheckStrict {
+				return ManifestHolder{}, err
+			}
+			p.emit(Event{Type: MediaTypeMismatch, Digest: "sha256:" + mr.ManifestDigest, MediaType: mr.MediaType, Err: err})
+		}
+	}
+	return newManifestHolder(mr.MediaType, mr.ManifestBytes, mr.ManifestDigest, imageUrl)
+}
+
+// checkMediaType returns a '*types.ErrMediaTypeMismatch' if the Content-Type of the passed
+// manifest response doesn't match the 'mediaType' field in the manifest - which is
+// optional for OCI manifests - or the passed expected media type if it isn't empty.
+func checkMediaType(mr methods.ManifestGetResult, imageUrl string, expected types.MediaType) error {
+	served := mr.MediaType
+	// ignore parameters like '; charset=utf-8'
+	if mt, _, err := mime.ParseMediaType(string(served)); err == nil {
+		served = types.MediaType(mt)
+	}
+	if expected != "" && served != expected {
+		return &types.ErrMediaTypeMismatch{Url: imageUrl, Served: served, Expected: expected, Source: "descriptor"}
+	}
+	m := struct {
+		MediaType types.MediaType `json:"mediaType"`
+	}{}
+	if err := json.Unmarshal(mr.ManifestBytes, &m); err == nil && m.MediaType != "" && served != m.MediaType {
+		return &types.ErrMediaTypeMismatch{Url: imageUrl, Served: served, Expected: m.MediaType, Source: "manifest"}
+	}
+	return nil
+}
+
+// descriptorMediaType returns the media type of the descriptor with the passed digest in
+// the image list in the receiver, or an empty string if it isn't in the list.
+func (mh *ManifestHolder) descriptorMediaType(digest string) types.MediaType {
+	for _, pm := range mh.Platforms() {
+		if pm.Digest == digest {
+			return types.MediaType(pm.MediaType)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,75 @@
+package imgpull
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aceeric/imgpull/mock"
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+)
+
+func TestMediaTypeCheck(t *testing.T) {
+	reg := mock.NewRegistry()
+	config := []byte(`{"architecture":"amd64","os":"linux"}`)
+	manifest := fmt.Appendf(nil, `{"schemaVersion":2,"mediaType":"%s","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"%s","size":%d},"layers":[]}`,
+		types.V1ociManifestMt, reg.AddBlob("frobozz", config), len(config))
+	// served with a docker media type but the manifest says it is OCI
+	reg.AddManifest("frobozz", "mislabeled", string(types.V2dockerManifestMt), manifest)
+	// an index whose descriptor says the image is a docker manifest but it is served as OCI
+	child := reg.AddManifest("frobozz", "", string(types.V1ociManifestMt), manifest)
+	index := fmt.Appendf(nil, `{"schemaVersion":2,"mediaType":"%s","manifests":[{"mediaType":"%s","digest":"%s","size":%d,"platform":{"architecture":"amd64","os":"linux"}}]}`,
+		types.V1ociIndexMt, types.V2dockerManifestMt, child, len(manifest))
+	reg.AddManifest("frobozz", "list", string(types.V1ociIndexMt), index)
+	reg.AddManifest("frobozz", "ok", string(types.V1ociManifestMt), manifest)
+	server, url := mock.ServerWith(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}), reg)
+	defer server.Close()
+	for _, tst := range []struct {
+		tag    string
+		check  MediaTypeCheck
+		source string
+	}{
+		{"mislabeled", MediaTypeCheckOff, ""},
+		{"mislabeled", MediaTypeCheckWarn, "manifest"},
+		{"mislabeled", MediaTypeCheckStrict, "manifest"},
+		{"list", MediaTypeCheckWarn, "descriptor"},
+		{"list", MediaTypeCheckStrict, "descriptor"},
+		{"ok", MediaTypeCheckStrict, ""},
+	} {
+		var events []Event
+		p, err := NewPullerWith(PullerOpts{
+			Url:            fmt.Sprintf("%s/frobozz:%s", url, tst.tag),
+			OStype:         "linux",
+			ArchType:       "amd64",
+			Scheme:         "http",
+			MediaTypeCheck: tst.check,
+			OnEvent: func(e Event) {
+				if e.Type == MediaTypeMismatch {
+					events = append(events, e)
+				}
+			},
+		})
+		if err != nil {
+			t.FailNow()
+		}
+		_, err = p.GetManifestByType(Image)
+		var mismatch *types.ErrMediaTypeMismatch
+		switch {
+		case tst.check == MediaTypeCheckStrict && tst.source != "":
+			if !errors.As(err, &mismatch) || mismatch.Source != tst.source {
+				t.Errorf("%s/%s: expected a %s mismatch error, got %v", tst.tag, tst.check, tst.source, err)
+			}
+		case err != nil:
+			t.Errorf("%s/%s: unexpected error %s", tst.tag, tst.check, err)
+		case tst.check == MediaTypeCheckWarn:
+			if len(events) != 1 || !errors.As(events[0].Err, &mismatch) || mismatch.Source != tst.source {
+				t.Errorf("%s/%s: expected one %s mismatch event, got %+v", tst.tag, tst.check, tst.source, events)
+			}
+		case len(events) != 0:
+			t.Errorf("%s/%s: unexpected events %+v", tst.tag, tst.check, events)
+		}
+	}
+	if _, err := NewPullerWith(PullerOpts{Url: "foo", Scheme: "https", OStype: "linux", ArchType: "amd64", MediaTypeCheck: "x"}); err == nil {
+		t.Errorf("expected an invalid media type check to fail validation")
+	}
+}
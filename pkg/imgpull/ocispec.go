@@ -0,0 +1,78 @@
+package imgpull
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// The functions in this file convert the manifests and layers in the package to the
+// types in github.com/opencontainers/image-spec/specs-go/v1, which are the types used
+// by containerd and many other OCI tools. Docker v2 manifests have the same structure
+// as OCI manifests so they are converted as well. Media types are carried over as is,
+// so a converted Docker manifest still has Docker media types.
+
+// OCIDescriptor returns an OCI descriptor for the manifest in the receiver. The size
+// is the size of the 'Bytes' member of the receiver.
+func (mh *ManifestHolder) OCIDescriptor() ocispec.Descriptor {
+	return ocispec.Descriptor{
+		MediaType: mh.MediaType(),
+		Digest:    digest.NewDigestFromEncoded(digest.SHA256, mh.Digest),
+		Size:      int64(len(mh.Bytes)),
+	}
+}
+
+// OCIManifest converts the image manifest in the receiver to an OCI manifest. An error
+// is returned if the receiver doesn't hold a Docker v2 or OCI image manifest.
+func (mh *ManifestHolder) OCIManifest() (ocispec.Manifest, error) {
+	var from any
+	switch mh.Type {
+	case V2dockerManifest:
+		from = mh.V2dockerManifest
+	case V1ociManifest:
+		from = mh.V1ociManifest
+	default:
+		return ocispec.Manifest{}, fmt.Errorf("cannot convert manifest type %s to an OCI manifest", manifestTypeToString[mh.Type])
+	}
+	m := ocispec.Manifest{}
+	return m, convert(from, &m)
+}
+
+// OCIIndex converts the image list manifest in the receiver to an OCI index. An error
+// is returned if the receiver doesn't hold a Docker v2 manifest list or an OCI index.
+func (mh *ManifestHolder) OCIIndex() (ocispec.Index, error) {
+	var from any
+	switch mh.Type {
+	case V2dockerManifestList:
+		from = mh.V2dockerManifestList
+	case V1ociIndex:
+		from = mh.V1ociIndex
+	default:
+		return ocispec.Index{}, fmt.Errorf("cannot convert manifest type %s to an OCI index", manifestTypeToString[mh.Type])
+	}
+	idx := ocispec.Index{}
+	return idx, convert(from, &idx)
+}
+
+// LayerDescriptor converts the passed layer to an OCI descriptor.
+func LayerDescriptor(layer types.Layer) ocispec.Descriptor {
+	return ocispec.Descriptor{
+		MediaType: string(layer.MediaType),
+		Digest:    digest.Digest(layer.Digest),
+		Size:      int64(layer.Size),
+	}
+}
+
+// convert converts 'from' to 'to' by way of JSON, which works because the manifest
+// structs in the package and in the image-spec have the same JSON representation.
+func convert(from any, to any) error {
+	b, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, to)
+}
@@ -0,0 +1,86 @@
+package imgpull
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Tests converting an OCI index and an OCI image manifest to the image-spec types.
+func TestOCIConversions(t *testing.T) {
+	read := func(name string) []byte {
+		b, err := os.ReadFile(filepath.Join("..", "..", "mock", "testfiles", name))
+		if err != nil {
+			t.FailNow()
+		}
+		return b
+	}
+	list := regexp.MustCompile(`[\r\n\t ]{1}`).ReplaceAll(read("manifestList.json"), []byte{})
+	lmh, err := NewManifestHolder(string(types.V1ociIndexMt), list, digest.FromBytes(list).Encoded(), "docker.io/hello-world:latest")
+	if err != nil {
+		t.FailNow()
+	}
+	idx, err := lmh.OCIIndex()
+	if err != nil {
+		t.Fatalf("convert index: %s", err)
+	}
+	if idx.SchemaVersion != 2 || len(idx.Manifests) != len(lmh.V1ociIndex.Manifests) {
+		t.Errorf("unexpected index %+v", idx)
+	}
+	for i, m := range idx.Manifests {
+		from := lmh.V1ociIndex.Manifests[i]
+		if string(m.Digest) != from.Digest || m.Size != from.Size || m.Platform == nil || m.Platform.Architecture != from.Platform.Architecture {
+			t.Errorf("unexpected descriptor %+v", m)
+		}
+	}
+	if d := lmh.OCIDescriptor(); d.Digest != digest.FromBytes(list) || d.Size != int64(len(list)) || d.MediaType != string(types.V1ociIndexMt) {
+		t.Errorf("unexpected descriptor %+v", d)
+	}
+	if _, err := lmh.OCIManifest(); err == nil {
+		t.Error("expected an error converting an index to a manifest")
+	}
+
+	manifest := read("imageManifest.json")
+	mh, err := NewManifestHolder(string(types.V1ociManifestMt), manifest, digest.FromBytes(manifest).Encoded(), "docker.io/hello-world:latest")
+	if err != nil {
+		t.FailNow()
+	}
+	m, err := mh.OCIManifest()
+	if err != nil {
+		t.Fatalf("convert manifest: %s", err)
+	}
+	if string(m.Config.Digest) != mh.V1ociManifest.Config.Digest || len(m.Layers) != len(mh.V1ociManifest.Layers) {
+		t.Errorf("unexpected manifest %+v", m)
+	}
+	if _, err := mh.OCIIndex(); err == nil {
+		t.Error("expected an error converting a manifest to an index")
+	}
+	for i, layer := range mh.Layers()[:len(m.Layers)] {
+		if d := LayerDescriptor(layer); d.Digest != m.Layers[i].Digest || d.Size != m.Layers[i].Size || d.MediaType != m.Layers[i].MediaType {
+			t.Errorf("unexpected layer descriptor %+v", d)
+		}
+	}
+}
+
+// Tests that a docker v2 manifest is converted with its docker media types.
+func TestOCIManifestFromDocker(t *testing.T) {
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json",` +
+		`"config":{"mediaType":"application/vnd.docker.container.image.v1+json","digest":"sha256:` + digest.FromString("c").Encoded() + `","size":1},` +
+		`"layers":[{"mediaType":"application/vnd.docker.image.rootfs.diff.tar.gzip","digest":"sha256:` + digest.FromString("l").Encoded() + `","size":2}]}`)
+	mh, err := NewManifestHolder(string(types.V2dockerManifestMt), manifest, digest.FromBytes(manifest).Encoded(), "docker.io/foo:v1")
+	if err != nil {
+		t.FailNow()
+	}
+	m, err := mh.OCIManifest()
+	if err != nil {
+		t.Fatalf("convert manifest: %s", err)
+	}
+	if m.MediaType != string(types.V2dockerManifestMt) || m.Layers[0].MediaType != string(types.V2dockerLayerGzipMt) || m.Layers[0].Size != 2 {
+		t.Errorf("unexpected manifest %+v", m)
+	}
+}
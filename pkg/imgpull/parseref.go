@@ -0,0 +1,14 @@
+package imgpull
+
+import (
+	"github.com/aceeric/imgpull/pkg/imgpull/ref"
+)
+
+// Reference has the components of a parsed image reference. See the 'ref' package.
+type Reference = ref.Reference
+
+// ParseRef parses and validates the passed image reference like 'docker.io/hello-world:latest'
+// against the distribution reference grammar. It is the same as 'ref.Parse'.
+func ParseRef(url string) (Reference, error) {
+	return ref.Parse(url)
+}
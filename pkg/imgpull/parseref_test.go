@@ -0,0 +1,32 @@
+package imgpull
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRef(t *testing.T) {
+	dgst := "sha256:" + strings.Repeat("a", 64)
+	for _, tst := range []struct {
+		url       string
+		shouldErr bool
+		expected  Reference
+	}{
+		{"docker.io/hello-world", false, Reference{Registry: "docker.io", Repository: "library/hello-world", Tag: "latest"}},
+		{"quay.io/foo/bar:v1.2.3", false, Reference{Registry: "quay.io", Repository: "foo/bar", Tag: "v1.2.3"}},
+		{"localhost:8080/docker.io/foo/bar@" + dgst, false, Reference{Registry: "localhost:8080", Namespace: "docker.io", Repository: "foo/bar", Digest: dgst}},
+		{"quay.io/foo/bar:v1@" + dgst, false, Reference{Registry: "quay.io", Repository: "foo/bar", Digest: dgst}},
+		{"hello-world", true, Reference{}},
+		{"quay.io/Foo/bar", true, Reference{}},
+		{"quay.io/foo/bar:.v1", true, Reference{}},
+		{"quay.io/foo/bar@sha256:xyz", true, Reference{}},
+	} {
+		ref, err := ParseRef(tst.url)
+		if (err != nil) != tst.shouldErr {
+			t.FailNow()
+		}
+		if ref != tst.expected {
+			t.FailNow()
+		}
+	}
+}
@@ -4,11 +4,36 @@
 //
 //	func NewPuller(url string, opts ...PullOpt) - Returns a new Puller interface
 //	func NewPullerWith(o PullerOpts)            - Returns a new Puller interface with explicit options
+//	func NewPusherWith(o PullerOpts)            - Returns a new Pusher interface with explicit options
+//	func NewDeleterWith(o PullerOpts)           - Returns a new Deleter interface with explicit options
+//	func PullAll(ctx, refs, opts, concurrency)  - Pulls many images to tarballs in parallel, sharing auth and blobs
+//	func Diff(from, to)                         - Compares the layers and config of the images of two pullers
+//	func History(mh, config)                    - Returns the history of an image from its config
+//	func CreateBundle(images, archive, opts)    - Pulls a set of images into a single bundle archive
+//	func PushBundle(archive, registry, opts)    - Pushes all the images in a bundle archive to a registry
+//	func Copy(src, dst, co, opts)               - Copies an image from one registry to another
+//	func ExtractRootfs(mh, blobDir, destDir)    - Flattens pulled image layers into a root filesystem directory
+//	func ExtractLayer(mh, blobDir, layer, dest) - Extracts one pulled image layer into a directory
+//	func FlattenTar(mh, blobDir, dest)          - Flattens pulled image layers into a single tarball
+//	func Login(configPath, registry, user, pass) - Stores credentials for a registry in the config file
+//	func Logout(configPath, registry)           - Removes the credentials for a registry from the config file
+//	func NewDaemon(o DaemonOpts)                - Returns an http.Handler that serves pulls to other processes
+//	func NewManifestStore(dir)                  - Returns a directory-backed store of manifests indexed by url and digest
 //
 // Once you have a Puller, then the main functions in the interface are:
 //
 //	func (p *Puller) PullTar(dest string)                         - Pulls an image to a tarfile
+//	func (p *Puller) PullRootfs(destDir string)                   - Pulls an image and flattens it into a directory
+//	func (p *Puller) PullLayer(layer, destDir string)             - Pulls one image layer and extracts it into a directory
+//	func (p *Puller) PullFlatTar(dest string)                     - Pulls an image and flattens it into a single tarfile
+//	func (p *Puller) PullArtifact(destDir string)                 - Pulls a non-image artifact (e.g. a Helm chart) into a directory
 //	func (p *Puller) PullManifest(mpt ManifestPullType)           - Pulls an image manifest or manifest list and returns it
 //	func (p *Puller) HeadManifest()                               - Heads an image manifest or manifest list and returns it
-//	func (p *Puller) PullBlobs(mh ManifestHolder, blobDir string) - Pulls image blobs to a location on the filesystem
+//	func (p *Puller) Watch(ctx, interval, callback)               - Calls back when the digest of an image tag changes
+//	func (p *Puller) Capabilities()                               - Probes the registry for optional features like the referrers API
+//	func (p *Puller) PullBlobs(mh, blobDir, filters...)           - Pulls image blobs, optionally filtered, to a location on the filesystem
+//	func (p *Puller) Clone()                                      - Copies an authenticated puller
+//	func (p *Puller) WithRef(url string)                          - Copies an authenticated puller for a different image
+//
+// A Puller is safe for concurrent use by multiple goroutines, except for SetUrl.
 package imgpull
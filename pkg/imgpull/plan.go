@@ -0,0 +1,96 @@
+package imgpull
+
+import (
+	"github.com/aceeric/imgpull/internal/methods"
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+)
+
+// PullPlan describes what pulling an image would download, without downloading it. It
+// is returned by 'Plan'.
+type PullPlan struct {
+	// ImageUrl is the url of the image manifest. If the image url in the puller
+	// resolved to an image list then this has the digest of the selected image.
+	ImageUrl string `json:"imageUrl"`
+	// IndexDigest is the digest of the image list manifest, like 'sha256:abc...', if the
+	// image url in the puller resolved to an image list.
+	IndexDigest string `json:"indexDigest,omitempty"`
+	// Digest is the digest of the image manifest, like 'sha256:abc...'.
+	Digest string `json:"digest"`
+	// MediaType is the media type of the image manifest.
+	MediaType string `json:"mediaType"`
+	// Platform is the OS and architecture the image was selected for, like 'linux/amd64'.
+	Platform string `json:"platform"`
+	// Blobs are the layers and config that would be downloaded. A blob that is in the
+	// image more than once is only listed once.
+	Blobs []types.Layer `json:"blobs"`
+	// TotalBytes is the sum of the sizes of the blobs. Schema 1 manifests don't have
+	// blob sizes, so this is zero for those.
+	TotalBytes int64 `json:"totalBytes"`
+}
+
+func (p *puller) Plan() (PullPlan, error) {
+	if err := p.checkRef(); err != nil {
+		return PullPlan{}, err
+	}
+	if err := p.connect(); err != nil {
+		return PullPlan{}, err
+	}
+	mh, list, err := p.resolveImage(p.regCliFrom())
+	if err != nil {
+		return PullPlan{}, err
+	}
+	return p.planFor(mh, list), nil
+}
+
+// planFor returns the plan to pull the passed image manifest, which was selected from the
+// passed image list manifest, or nil if the url resolved to an image manifest.
+func (p *puller) planFor(mh ManifestHolder, list *ManifestHolder) PullPlan {
+	plan := PullPlan{
+		ImageUrl:  mh.ImageUrl,
+		Digest:    "sha256:" + mh.Digest,
+		MediaType: mh.MediaType(),
+		Platform:  p.Opts.OStype + "/" + p.Opts.ArchType,
+		Blobs:     []types.Layer{},
+	}
+	if list != nil {
+		plan.IndexDigest = "sha256:" + list.Digest
+	}
+	seen := map[string]bool{}
+	for _, layer := range mh.Layers() {
+		if seen[layer.Digest] {
+			continue
+		}
+		seen[layer.Digest] = true
+		plan.Blobs = append(plan.Blobs, layer)
+		plan.TotalBytes += int64(layer.Size)
+	}
+	return plan
+}
+
+// resolveImage gets the manifest for the image url in the passed client. If the manifest
+// is an image list then the image manifest for the platform in the receiver is fetched, and
+// returned along with the image list. Otherwise the returned image list is nil.
+func (p *puller) resolveImage(rc methods.RegClient) (ManifestHolder, *ManifestHolder, error) {
+	mr, err := rc.V2Manifests("")
+	if err != nil {
+		return ManifestHolder{}, nil, err
+	}
+	mh, err := p.manifestHolderFrom(mr, rc.ImgRef.Url(), "")
+	if err != nil || !mh.IsManifestList() {
+		return mh, nil, err
+	}
+	digest, err := mh.GetImageDigestForPlatform(p.Opts.platform())
+	if err != nil {
+		return ManifestHolder{}, nil, err
+	}
+	mr, err = rc.V2Manifests(digest)
+	if err != nil {
+		return ManifestHolder{}, nil, err
+	}
+	imh, err := p.manifestHolderFrom(mr, rc.ImgRef.UrlWithDigest(digest), mh.descriptorMediaType(digest))
+	if err != nil {
+		return ManifestHolder{}, nil, err
+	}
+	imh.IndexDigest = mh.Digest
+	return imh, &mh, nil
+}
@@ -0,0 +1,53 @@
+package imgpull
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aceeric/imgpull/mock"
+)
+
+// Tests planning a pull of an image list, and of an image that has the same layer twice.
+func TestPlan(t *testing.T) {
+	reg := mock.NewHelloWorldRegistry()
+	reg.AddImage("frobozz", "latest", []byte(`{"architecture":"amd64"}`), []byte("layer"), []byte("other"), []byte("layer"))
+	server, url := mock.ServerWith(mock.NewMockParams(mock.BEARER, mock.NOTLS, mock.CertSetup{}), reg)
+	defer server.Close()
+	for _, tc := range []struct {
+		image      string
+		digest     string
+		blobs      int
+		totalBytes int64
+	}{
+		{"hello-world:latest", "sha256:e2fc4e5012d16e7fe466f5291c476431beaa1f9b90a5c2125b493ed28e2aba57", 2, 0},
+		{"frobozz:latest", "", 3, int64(len(`{"architecture":"amd64"}`) + len("layer") + len("other"))},
+	} {
+		p, err := NewPullerWith(PullerOpts{
+			Url:      fmt.Sprintf("%s/%s", url, tc.image),
+			OStype:   "linux",
+			ArchType: "amd64",
+			Scheme:   "http",
+		})
+		if err != nil {
+			t.FailNow()
+		}
+		plan, err := p.Plan()
+		if err != nil {
+			t.Fatalf("plan %s: %s", tc.image, err)
+		}
+		if len(plan.Blobs) != tc.blobs || plan.Platform != "linux/amd64" || plan.MediaType == "" {
+			t.Errorf("plan %s: unexpected plan %+v", tc.image, plan)
+		}
+		// only the image list has an index digest
+		if (plan.IndexDigest != "") != (tc.digest != "") || (tc.digest != "" && plan.Digest != tc.digest) {
+			t.Errorf("plan %s: unexpected digests %q %q", tc.image, plan.IndexDigest, plan.Digest)
+		}
+		var sum int64
+		for _, blob := range plan.Blobs {
+			sum += int64(blob.Size)
+		}
+		if plan.TotalBytes != sum || (tc.totalBytes != 0 && plan.TotalBytes != tc.totalBytes) {
+			t.Errorf("plan %s: unexpected total %d", tc.image, plan.TotalBytes)
+		}
+	}
+}
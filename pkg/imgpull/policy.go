@@ -0,0 +1,108 @@
+package imgpull
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ErrImageTooLarge is wrapped by the '*PolicyError' returned when an image is larger than
+// the 'MaxImageBytes' option.
+var ErrImageTooLarge = errors.New("image too large")
+
+// ErrRegistryNotAllowed is wrapped by the '*PolicyError' returned when an image is not in
+// one of the 'AllowedRegistries'.
+var ErrRegistryNotAllowed = errors.New("registry not allowed")
+
+// ErrDigestRequired is wrapped by the '*PolicyError' returned when an image is referenced
+// by tag and the 'RequireDigest' option is set.
+var ErrDigestRequired = errors.New("image must be referenced by digest")
+
+// PrePullInfo describes the image that a pull is about to download. It is passed to the
+// 'PrePullHook' in 'PullerOpts'.
+type PrePullInfo struct {
+	// Url is the image url being pulled.
+	Url string
+	// Digest is the digest of the image manifest, like 'sha256:abc...'.
+	Digest string
+	// IndexDigest is the digest of the image list manifest that the image manifest was
+	// selected from, or empty if the url resolved to an image manifest.
+	IndexDigest string
+	// Platforms are the platforms in the image list manifest, or empty if the url resolved
+	// to an image manifest.
+	Platforms []PlatformManifest
+	// Manifest is the image manifest, so the hook can check e.g. the size of the layers.
+	Manifest ManifestHolder
+}
+
+// PolicyError is returned by a pull when the 'PrePullHook' in the puller options returns
+// an error, so a caller can tell an image that was rejected from one that failed to pull.
+type PolicyError struct {
+	// Url is the image url that was rejected.
+	Url string
+	// Digest is the digest of the rejected image manifest, or empty if the image was
+	// rejected by its url before the manifest was fetched.
+	Digest string
+	Err    error
+}
+
+func (e *PolicyError) Error() string {
+	if e.Digest == "" {
+		return fmt.Sprintf("pull of %q rejected by policy: %s", e.Url, e.Err)
+	}
+	return fmt.Sprintf("pull of %q (%s) rejected by policy: %s", e.Url, e.Digest, e.Err)
+}
+
+func (e *PolicyError) Unwrap() error {
+	return e.Err
+}
+
+// checkRef checks the image url in the receiver against the 'AllowedRegistries' and
+// 'RequireDigest' options, and returns a '*PolicyError' if the url is not allowed. It is
+// called before the registry is contacted. The digest in the error is empty since the
+// manifest isn't fetched.
+func (p *puller) checkRef() error {
+	p.mu.Lock()
+	ir := p.ImgRef
+	p.mu.Unlock()
+	if len(p.Opts.AllowedRegistries) != 0 && !slices.ContainsFunc(p.Opts.AllowedRegistries, func(reg string) bool {
+		return strings.EqualFold(reg, ir.Registry())
+	}) {
+		return &PolicyError{Url: ir.Url(), Err: fmt.Errorf("%w: %s", ErrRegistryNotAllowed, ir.Registry())}
+	}
+	if p.Opts.RequireDigest && !ir.ByDigest() {
+		return &PolicyError{Url: ir.Url(), Err: ErrDigestRequired}
+	}
+	return nil
+}
+
+// prePull checks the passed image manifest, and the image list manifest it was selected
+// from, which is nil if the url resolved to an image manifest, against the 'MaxImageBytes'
+// option of the receiver and then calls the 'PrePullHook', if there is one. If the image is
+// too large or the hook returns an error then a '*PolicyError' is returned.
+func (p *puller) prePull(mh ManifestHolder, list *ManifestHolder) error {
+	if p.Opts.MaxImageBytes > 0 {
+		if size := p.planFor(mh, list).TotalBytes; size > p.Opts.MaxImageBytes {
+			err := fmt.Errorf("%w: %d bytes is more than the maximum of %d bytes", ErrImageTooLarge, size, p.Opts.MaxImageBytes)
+			return &PolicyError{Url: p.GetUrl(), Digest: "sha256:" + mh.Digest, Err: err}
+		}
+	}
+	if p.Opts.PrePullHook == nil {
+		return nil
+	}
+	info := PrePullInfo{
+		Url:       p.GetUrl(),
+		Digest:    "sha256:" + mh.Digest,
+		Platforms: []PlatformManifest{},
+		Manifest:  mh,
+	}
+	if list != nil {
+		info.IndexDigest = "sha256:" + list.Digest
+		info.Platforms = list.Platforms()
+	}
+	if err := p.Opts.PrePullHook(info); err != nil {
+		return &PolicyError{Url: info.Url, Digest: info.Digest, Err: err}
+	}
+	return nil
+}
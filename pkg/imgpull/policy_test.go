@@ -0,0 +1,203 @@
+package imgpull
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aceeric/imgpull/mock"
+)
+
+// Tests that the pre-pull hook gets the resolved image and that an error from the hook
+// aborts the pull before any blobs are downloaded.
+func TestPrePullHook(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+	errDenied := errors.New("denied")
+	var info PrePullInfo
+	blobs := 0
+	p, err := NewPullerWith(PullerOpts{
+		Url:      fmt.Sprintf("%s/hello-world:latest", url),
+		OStype:   "linux",
+		ArchType: "amd64",
+		Scheme:   "http",
+		PrePullHook: func(i PrePullInfo) error {
+			info = i
+			return errDenied
+		},
+		OnEvent: func(e Event) {
+			if e.Type == BlobStarted {
+				blobs++
+			}
+		},
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	tarFile := filepath.Join(d, "hello.tar")
+	_, err = p.PullTar(tarFile)
+	var pe *PolicyError
+	if !errors.As(err, &pe) || !errors.Is(err, errDenied) {
+		t.Fatalf("expected a policy error, got %v", err)
+	}
+	if _, err := os.Stat(tarFile); err == nil || blobs != 0 {
+		t.Errorf("expected nothing to be pulled, got %d blobs", blobs)
+	}
+	if info.Digest != "sha256:e2fc4e5012d16e7fe466f5291c476431beaa1f9b90a5c2125b493ed28e2aba57" || pe.Digest != info.Digest {
+		t.Errorf("unexpected digest %q", info.Digest)
+	}
+	if info.IndexDigest == "" || len(info.Platforms) < 2 || info.Platforms[0].Architecture != "amd64" {
+		t.Errorf("unexpected platforms %+v", info)
+	}
+	if len(info.Manifest.Layers()) != 2 {
+		t.Errorf("expected the image manifest, got %+v", info.Manifest)
+	}
+	if err := p.PullLayer("1", filepath.Join(d, "layer")); !errors.As(err, &pe) {
+		t.Errorf("expected a policy error pulling a layer, got %v", err)
+	}
+}
+
+// Tests that an image larger than the 'MaxImageBytes' option is rejected before any blobs
+// are downloaded, and that an image of exactly the maximum size is pulled.
+func TestMaxImageBytes(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+	// the layer is 2459 bytes and the config is 581 bytes
+	for _, tc := range []struct {
+		max int64
+		ok  bool
+	}{
+		{3039, false},
+		{3040, true},
+	} {
+		p, err := NewPullerWith(PullerOpts{
+			Url:           fmt.Sprintf("%s/hello-world:latest", url),
+			OStype:        "linux",
+			ArchType:      "amd64",
+			Scheme:        "http",
+			MaxImageBytes: tc.max,
+		})
+		if err != nil {
+			t.FailNow()
+		}
+		tarFile := filepath.Join(d, fmt.Sprintf("hello-%d.tar", tc.max))
+		_, err = p.PullTar(tarFile)
+		if tc.ok && err != nil {
+			t.Errorf("max %d: unexpected error %v", tc.max, err)
+		} else if !tc.ok && !errors.Is(err, ErrImageTooLarge) {
+			t.Errorf("max %d: expected an image too large error, got %v", tc.max, err)
+		}
+		if _, err := os.Stat(tarFile); (err == nil) != tc.ok {
+			t.Errorf("max %d: unexpected tarball state %v", tc.max, err)
+		}
+		// PullBlobs is checked the same way, before any blob is pulled
+		mh, err := p.GetManifestByType(Image)
+		if err != nil {
+			t.FailNow()
+		}
+		blobDir := filepath.Join(d, fmt.Sprintf("blobs-%d", tc.max))
+		stats, err := p.PullBlobs(mh, blobDir)
+		if tc.ok && (err != nil || stats.Layers == 0) {
+			t.Errorf("max %d: unexpected PullBlobs error %v", tc.max, err)
+		} else if !tc.ok && (!errors.Is(err, ErrImageTooLarge) || stats.BytesDownloaded != 0) {
+			t.Errorf("max %d: expected PullBlobs to fail with an image too large error, got %v", tc.max, err)
+		}
+	}
+}
+
+// Tests that pulls from registries that aren't allowed, and pulls by tag when a digest
+// is required, are rejected before the registry is contacted.
+func TestAllowedRegistriesAndRequireDigest(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+	byTag := fmt.Sprintf("%s/hello-world:latest", url)
+	byDigest := fmt.Sprintf("%s/hello-world@sha256:e2fc4e5012d16e7fe466f5291c476431beaa1f9b90a5c2125b493ed28e2aba57", url)
+	for i, tc := range []struct {
+		url           string
+		allowed       []string
+		requireDigest bool
+		err           error
+	}{
+		{byTag, []string{"quay.io"}, false, ErrRegistryNotAllowed},
+		{byTag, []string{"quay.io", url}, false, nil},
+		{byTag, nil, true, ErrDigestRequired},
+		{byDigest, []string{url}, true, nil},
+	} {
+		contacted := false
+		p, err := NewPullerWith(PullerOpts{
+			Url:               tc.url,
+			OStype:            "linux",
+			ArchType:          "amd64",
+			Scheme:            "http",
+			AllowedRegistries: tc.allowed,
+			RequireDigest:     tc.requireDigest,
+			OnEvent: func(e Event) {
+				if e.Type == ManifestResolved {
+					contacted = true
+				}
+			},
+		})
+		if err != nil {
+			t.FailNow()
+		}
+		_, err = p.PullTar(filepath.Join(d, fmt.Sprintf("%d.tar", i)))
+		if tc.err == nil && err != nil {
+			t.Errorf("%d: unexpected error %v", i, err)
+		} else if tc.err != nil && (!errors.Is(err, tc.err) || contacted) {
+			t.Errorf("%d: expected %v before the registry is contacted, got %v", i, tc.err, err)
+		}
+	}
+	for _, reg := range []string{"quay.io/foo", "https://quay.io", ""} {
+		if _, err := NewPullerWith(PullerOpts{Url: byTag, AllowedRegistries: []string{reg}}); err == nil {
+			t.Errorf("expected an error for invalid allowed registry %q", reg)
+		}
+	}
+}
+
+// Tests that the allowed registries are normalized, and that they are checked by the
+// methods that get manifests, blobs, and tags, and so by Copy, and not by a pusher.
+func TestAllowedRegistriesMethods(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	opts := PullerOpts{
+		Url:               fmt.Sprintf("%s/hello-world:latest", url),
+		OStype:            "linux",
+		ArchType:          "amd64",
+		Scheme:            "http",
+		AllowedRegistries: []string{"registry-1.docker.io"},
+	}
+	p, err := NewPullerWith(opts)
+	if err != nil {
+		t.FailNow()
+	}
+	if allowed := p.(*puller).Opts.AllowedRegistries; len(allowed) != 1 || allowed[0] != "docker.io" || opts.AllowedRegistries[0] != "registry-1.docker.io" {
+		t.Errorf("unexpected allowed registries %v", allowed)
+	}
+	_, err1 := p.GetManifest()
+	_, err2 := p.GetManifestByType(Image)
+	_, err3 := p.GetManifestByDigest("sha256:e2fc4e5012d16e7fe466f5291c476431beaa1f9b90a5c2125b493ed28e2aba57")
+	_, err4 := p.GetRawManifest("")
+	_, err5 := p.PullBlobs(ManifestHolder{}, t.TempDir())
+	_, err6 := Copy(opts.Url, fmt.Sprintf("%s/hello-world:copy", url), CopyOpts{}, opts)
+	_, err7 := p.Plan()
+	_, err8 := p.Size(false)
+	_, err9 := p.HeadManifest()
+	_, _, err10 := p.Exists()
+	_, err11 := p.ListTags()
+	for i, err := range []error{err1, err2, err3, err4, err5, err6, err7, err8, err9, err10, err11} {
+		if !errors.Is(err, ErrRegistryNotAllowed) {
+			t.Errorf("%d: expected %v, got %v", i, ErrRegistryNotAllowed, err)
+		}
+	}
+	if _, err := NewPusherWith(opts); err != nil {
+		t.Errorf("expected a pusher to ignore the allowed registries, got %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+package imgpull
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pullAllBlobTimeoutSec is how long a goroutine pulling a blob in 'PullAll' waits for
+// another goroutine that is pulling the same blob, if the options don't have a syncer.
+const pullAllBlobTimeoutSec = 600
+
+// tarNameReplacer replaces the characters in an image ref that are replaced when
+// generating a tarball name from the ref.
+var tarNameReplacer = strings.NewReplacer("/", "-", ":", "-", "@", "-")
+
+// PullAllOpts configures 'PullAll'.
+type PullAllOpts struct {
+	// PullerOpts are the options for the puller of each image. The Url is ignored.
+	PullerOpts PullerOpts
+	// DestDir is the directory the image tarballs are written to. It is created if it
+	// doesn't exist.
+	DestDir string
+}
+
+// PullResult is the result of pulling one image with 'PullAll'.
+type PullResult struct {
+	// Url is the image url that was pulled.
+	Url string
+	// TarFile is the path of the image tarball. It is named from the image url, e.g.
+	// 'docker.io/hello-world:latest' is pulled to 'docker.io-hello-world-latest.tar'.
+	TarFile string
+	// Duration is how long the pull took.
+	Duration time.Duration
+	// Stats are the stats of the pull.
+	Stats PullStats
+	// Err is the error if the pull failed, or the context error if the context was done
+	// before the pull started.
+	Err error
+}
+
+// PullAll pulls the images in 'refs' to tarballs in the destination directory in the
+// passed options, with up to 'concurrency' images pulled in parallel. The images in each
+// registry share a 'RegistrySession' so that connections and auth are shared, and all the
+// images share a 'BlobSyncer' so that a layer shared by images is only downloaded once.
+// If the puller options have a session for a registry or a syncer then those are used.
+// A ref that is listed more than once is only pulled once. All the images are attempted
+// even if some fail, and a result for each image is returned in the order of 'refs',
+// along with a '*BatchError' with the url and error of each image that failed. When the
+// context is done no more pulls are started, but pulls in progress run to completion.
+func PullAll(ctx context.Context, refs []string, opts PullAllOpts, concurrency int) ([]PullResult, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if err := os.MkdirAll(opts.DestDir, 0755); err != nil {
+		return nil, err
+	}
+	po := opts.PullerOpts
+	if po.BlobSyncer == nil {
+		po.BlobSyncer = NewBlobSyncer(pullAllBlobTimeoutSec)
+		defer po.BlobSyncer.Close()
+	}
+	sessions := map[string]*RegistrySession{}
+	if po.Session != nil {
+		sessions[po.Session.Registry()] = po.Session
+	}
+	results := []PullResult{}
+	seen := map[string]bool{}
+	for _, ref := range refs {
+		if seen[ref] {
+			continue
+		}
+		seen[ref] = true
+		results = append(results, PullResult{
+			Url:     ref,
+			TarFile: filepath.Join(opts.DestDir, tarNameReplacer.Replace(ref)+".tar"),
+		})
+		r, err := ParseRef(ref)
+		if err != nil || sessions[r.Registry] != nil {
+			// an invalid ref fails when it is pulled
+			continue
+		}
+		if sessions[r.Registry], err = NewRegistrySession(r.Registry, po); err != nil {
+			return nil, err
+		}
+		defer sessions[r.Registry].Close()
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := range results {
+		if results[i].Err = ctx.Err(); results[i].Err != nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			results[i].Err = ctx.Err()
+			continue
+		case sem <- struct{}{}:
+		}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			start := time.Now()
+			results[i].Stats, results[i].Err = pullAllOne(results[i], po, sessions)
+			results[i].Duration = time.Since(start)
+		}()
+	}
+	wg.Wait()
+	var errs []error
+	for _, result := range results {
+		if result.Err != nil {
+			errs = append(errs, &ImageError{Url: result.Url, Err: result.Err})
+		}
+	}
+	if len(errs) != 0 {
+		return results, &BatchError{Kind: "images", Total: len(results), Errs: errs}
+	}
+	return results, nil
+}
+
+// pullAllOne pulls the image in the passed result to its tarball with the passed options
+// and the session for the registry of the image.
+func pullAllOne(result PullResult, po PullerOpts, sessions map[string]*RegistrySession) (PullStats, error) {
+	po.Url = result.Url
+	po.Session = nil
+	if r, err := ParseRef(result.Url); err == nil {
+		po.Session = sessions[r.Registry]
+	}
+	p, err := NewPullerWith(po)
+	if err != nil {
+		return PullStats{}, err
+	}
+	defer p.Close()
+	return p.PullTar(result.TarFile)
+}
@@ -0,0 +1,83 @@
+package imgpull
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aceeric/imgpull/mock"
+)
+
+// blobCounter is a transport that counts blob requests.
+type blobCounter struct {
+	blobs atomic.Int32
+}
+
+func (bc *blobCounter) RoundTrip(req *http.Request) (*http.Response, error) {
+	if strings.Contains(req.URL.Path, "/blobs/") {
+		bc.blobs.Add(1)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// Tests pulling images that share a layer, with a duplicate and a missing image.
+func TestPullAll(t *testing.T) {
+	reg := mock.NewRegistry()
+	reg.AddImage("foo", "latest", []byte(`{"architecture":"amd64"}`), []byte("shared"), []byte("foo"))
+	reg.AddImage("bar", "latest", []byte(`{"architecture":"amd64"}`), []byte("shared"), []byte("bar"))
+	server, url := mock.ServerWith(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}), reg)
+	defer server.Close()
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+	bc := &blobCounter{}
+	refs := []string{
+		fmt.Sprintf("%s/foo:latest", url),
+		fmt.Sprintf("%s/bar:latest", url),
+		fmt.Sprintf("%s/frobozz:latest", url),
+		fmt.Sprintf("%s/foo:latest", url),
+	}
+	opts := PullAllOpts{
+		PullerOpts: PullerOpts{
+			Scheme:    "http",
+			OStype:    "linux",
+			ArchType:  "amd64",
+			Transport: bc,
+		},
+		DestDir: filepath.Join(d, "images"),
+	}
+	results, err := PullAll(context.Background(), refs, opts, 2)
+	if err == nil || len(results) != 3 {
+		t.Fatalf("expected three results and an error, got %v %v", results, err)
+	}
+	for i, result := range results {
+		if result.Url != refs[i] {
+			t.Errorf("unexpected result order %v", results)
+		}
+		if _, statErr := os.Stat(result.TarFile); (i < 2) != (result.Err == nil) || (result.Err == nil) != (statErr == nil) {
+			t.Errorf("unexpected result %+v", result)
+		}
+	}
+	var be *BatchError
+	if !errors.As(err, &be) || be.Total != 3 || len(be.Errs) != 1 {
+		t.Fatalf("expected a batch error with one failed image, got %v", err)
+	}
+	if ie, ok := be.Errs[0].(*ImageError); !ok || ie.Url != refs[2] {
+		t.Errorf("expected the failed image to be %q, got %v", refs[2], be.Errs[0])
+	}
+	// the config is the same for both images, so four distinct blobs are pulled
+	if bc.blobs.Load() != 4 {
+		t.Errorf("expected 4 blob requests, got %d", bc.blobs.Load())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results, err = PullAll(ctx, refs[:1], opts, 1)
+	if !errors.Is(err, context.Canceled) || !errors.Is(results[0].Err, context.Canceled) {
+		t.Errorf("expected the pull to be canceled, got %v", results)
+	}
+}
@@ -1,7 +1,9 @@
 package imgpull
 
 import (
+	"fmt"
 	"net/http"
+	"sync"
 
 	"github.com/aceeric/imgpull/internal/imgref"
 	"github.com/aceeric/imgpull/pkg/imgpull/types"
@@ -19,6 +21,9 @@ type puller struct {
 	// If the upstream requires bearer auth, this is the token received from
 	// the upstream registry
 	Token types.BearerToken
+	// If the upstream requires bearer auth, this is the auth challenge that
+	// the token was obtained with, so that the token can be renewed
+	Challenge types.BearerAuth
 	// If the upstream requires basic auth, this is the encoded user/pass
 	// from 'Opts'
 	Basic types.BasicAuth
@@ -29,6 +34,16 @@ type puller struct {
 	// Indicates that the struct has been used to negotiate a connection to
 	// the upstream OCI distribution server.
 	Connected bool
+	// Actions are the actions requested when negotiating a bearer token. If
+	// empty then "pull" is requested. A Pusher requests "pull,push" and a Deleter
+	// requests "pull,delete".
+	Actions string
+	// caps are the capabilities of the registry once they have been probed by
+	// 'Capabilities'.
+	caps *RegistryCapabilities
+	// mu guards the connection and auth state and the image ref so that the
+	// puller can be used by multiple goroutines.
+	mu sync.Mutex
 }
 
 // PullOpt supports specifying PullerOpts values with variadic args.
@@ -59,22 +74,27 @@ func NewPuller(url string, opts ...PullOpt) (Puller, error) {
 // in the passed PullerOpts MUST begin with a registry reference (e.g. quay.io): it is
 // not inferred - and cannot be inferred - by the function.
 func NewPullerWith(o PullerOpts) (Puller, error) {
+	if o.Config != nil && o.Url != "" {
+		if r, err := ParseRef(o.Url); err == nil {
+			if o, err = o.applyConfig(r.Registry); err != nil {
+				return &puller{}, err
+			}
+		}
+	}
 	if err := o.validate(); err != nil {
 		return &puller{}, err
 	}
-	if ir, err := imgref.NewImageRef(o.Url, o.Scheme, o.Namespace); err != nil {
+	if ir, err := o.imageRef(o.Url); err != nil {
 		return &puller{}, err
 	} else {
-		c := &http.Client{
-			Transport: http.DefaultTransport.(*http.Transport).Clone(),
-		}
-		if o.MaxIdleConnsPerHost != 0 {
-			c.Transport.(*http.Transport).MaxIdleConnsPerHost = o.MaxIdleConnsPerHost
-		}
-		if cfg, err := o.configureTls(); err != nil {
+		var c *http.Client
+		if o.Session != nil {
+			if o.Session.registry != ir.Registry() {
+				return &puller{}, fmt.Errorf("image registry %s must match session registry %s", ir.Registry(), o.Session.registry)
+			}
+			c = o.Session.client
+		} else if c, err = o.newClient(ir.Registry()); err != nil {
 			return &puller{}, err
-		} else if cfg != nil {
-			c.Transport.(*http.Transport).TLSClientConfig = cfg
 		}
 		return &puller{
 			ImgRef: ir,
@@ -84,10 +104,70 @@ func NewPullerWith(o PullerOpts) (Puller, error) {
 	}
 }
 
+// applyConfig returns a copy of the receiver with the settings for the passed registry in
+// the config in the receiver applied, defaulting the scheme to https.
+func (o PullerOpts) applyConfig(registry string) (PullerOpts, error) {
+	o, err := o.Config.applyFor(registry, o)
+	if err != nil {
+		return o, err
+	}
+	if o.Scheme == "" {
+		o.Scheme = "https"
+	}
+	return o, nil
+}
+
+// newClient returns an HTTP client for the passed registry configured from the transport,
+// dial, connection, and TLS options in the receiver.
+func (o PullerOpts) newClient(registry string) (*http.Client, error) {
+	c := &http.Client{
+		Transport:     o.Transport,
+		CheckRedirect: checkRedirect,
+		Timeout:       o.Timeout,
+	}
+	if o.Transport == nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		if o.MaxIdleConnsPerHost != 0 {
+			t.MaxIdleConnsPerHost = o.MaxIdleConnsPerHost
+		}
+		if o.DialContext != nil {
+			t.DialContext = o.DialContext
+		} else if o.SSHJump != "" {
+			t.DialContext = SSHJumpDialer(o.SSHJump)
+		}
+		if o.Proxy != "" {
+			u, err := proxyUrl(o.Proxy)
+			if err != nil {
+				return nil, err
+			}
+			t.Proxy = http.ProxyURL(u)
+		}
+		if o.RegistryOverride != "" {
+			t.DialContext = resolveDialer(registry, o.RegistryOverride, t.DialContext)
+		}
+		if cfg, err := o.configureTls(); err != nil {
+			return nil, err
+		} else if cfg != nil {
+			t.TLSClientConfig = cfg
+		}
+		c.Transport = t
+		if len(o.InsecureHosts) != 0 {
+			c.Transport = newInsecureHostTransport(t, o.isInsecureHost)
+		}
+	}
+	c.Transport = newHeaderTransport(c.Transport, o.ExtraHeaders)
+	if o.Logger != nil {
+		c.Transport = newLoggingTransport(c.Transport, o.Logger)
+	}
+	return c, nil
+}
+
 // authHdr returns a key/value pair to set an auth header based on whether
 // the receiver is configured for supported kinds of auth.
 func (p *puller) authHdr() (string, string) {
-	if p.Token != (types.BearerToken{}) {
+	if p.Opts.AuthHeader != "" {
+		return "Authorization", p.Opts.AuthHeader
+	} else if p.Token != (types.BearerToken{}) {
 		return "Authorization", "Bearer " + p.Token.Token
 	} else if p.ExtToken != (types.ExtToken{}) {
 		return "Authorization", "Basic " + p.ExtToken.Token
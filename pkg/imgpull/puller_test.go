@@ -1,7 +1,14 @@
 package imgpull
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
+
+	"github.com/aceeric/imgpull/mock"
 )
 
 func TestPullerOptfunc(t *testing.T) {
@@ -33,3 +40,81 @@ func TestPullerOptfunc(t *testing.T) {
 		t.Fail()
 	}
 }
+
+// Tests concurrent use of one puller, and fanning it out with Clone and WithRef.
+func TestPullerConcurrency(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.BEARER, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	p, err := NewPullerWith(PullerOpts{
+		Url:        fmt.Sprintf("%s/hello-world:latest", url),
+		Scheme:     "http",
+		OStype:     "linux",
+		ArchType:   "amd64",
+		TokenCache: NewTokenCache(),
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			puller := p
+			if i%2 == 0 {
+				puller = p.Clone()
+			}
+			mh, err := puller.GetManifestByType(Image)
+			if err != nil {
+				t.Fail()
+				return
+			}
+			if _, err := puller.PullBlobs(mh, filepath.Join(d, strconv.Itoa(i))); err != nil {
+				t.Fail()
+			}
+			puller.GetUrl()
+			puller.GetOpts()
+		}()
+	}
+	wg.Wait()
+	// same repository keeps the auth
+	same, err := p.WithRef(fmt.Sprintf("%s/hello-world@sha256:e2fc4e5012d16e7fe466f5291c476431beaa1f9b90a5c2125b493ed28e2aba57", url))
+	if err != nil || !same.(*puller).Connected || same.GetUrl() == p.GetUrl() {
+		t.FailNow()
+	}
+	if _, err := same.GetManifest(); err != nil {
+		t.FailNow()
+	}
+	// a different repository has to authenticate
+	other, err := p.WithRef(fmt.Sprintf("%s/other/image:v1", url))
+	if err != nil || other.(*puller).Connected || other.GetOpts().Url != fmt.Sprintf("%s/other/image:v1", url) {
+		t.FailNow()
+	}
+	if _, err := p.WithRef("quay.io/hello-world:latest"); err == nil {
+		t.FailNow()
+	}
+}
+
+// Tests that the blob syncer in the puller options is used by the puller rather
+// than the process-wide syncer.
+func TestPullerBlobSyncer(t *testing.T) {
+	bs := NewBlobSyncer(10)
+	opts := NewPullerOpts("docker.io/hello-world:latest")
+	opts.BlobSyncer = bs
+	p, err := NewPullerWith(opts)
+	if err != nil {
+		t.FailNow()
+	}
+	if p.(*puller).regClient().Syncer != bs {
+		t.Fail()
+	}
+	p, err = NewPullerWith(NewPullerOpts("docker.io/hello-world:latest"))
+	if err != nil {
+		t.FailNow()
+	}
+	if rc := p.(*puller).regClient(); rc.Syncer == bs {
+		t.Fail()
+	}
+}
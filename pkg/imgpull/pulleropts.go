@@ -1,15 +1,31 @@
 package imgpull
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
 	"runtime"
 	"slices"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/aceeric/imgpull/internal/imgref"
+	"github.com/aceeric/imgpull/internal/methods"
+	"github.com/aceeric/imgpull/internal/util"
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
 )
 
+// osVersionRe matches an OS version like '10.0.17763.5820'.
+var osVersionRe = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*$`)
+
 // PullerOpts defines all the configurables for pulling an image from an
 // upstream OCI distribution server.
 type PullerOpts struct {
@@ -21,12 +37,30 @@ type PullerOpts struct {
 	OStype string
 	// ArchType is the architecture, e.g.: 'amd64'.
 	ArchType string
+	// OSVersion is the operating system version used to select an image from an image
+	// list, e.g.: '10.0.17763' to select the Windows Server 2019 image. See 'Platform'
+	// for how it is matched. If empty then the version is ignored.
+	OSVersion string
+	// OSFeatures are the operating system features that an image selected from an image
+	// list must have, e.g.: 'win32k'. If empty then the features are ignored.
+	OSFeatures []string
 	// Username is the user name for basic auth.
 	Username string
 	// Password is the Password for basic auth.
 	Password string
-	// Token is an externally provided token that the upstream registry will accept.
+	// Token is an externally provided token that the upstream registry will accept, like
+	// the base64-encoded 'user:password' from 'aws ecr get-authorization-token'. It is sent
+	// as basic auth to the registry, or to the token server if the registry requires bearer
+	// auth.
 	Token string
+	// BearerToken is a pre-issued bearer token, e.g. a CI token, that is sent in an
+	// 'Authorization: Bearer' header without the auth handshake. Since the token is issued
+	// externally it is not renewed if the registry rejects it.
+	BearerToken string
+	// AuthHeader is the value of an 'Authorization' header that is sent as is with every
+	// request without the auth handshake, e.g. for a registry fronted by a custom auth
+	// proxy. Like BearerToken, it is not renewed if the registry rejects it.
+	AuthHeader string
 	// TlsCert is the path on the file system to a client pki certificate for mTLS.
 	TlsCert string
 	// TlsKey is the path on the file system to a client pki key for mTLS.
@@ -34,17 +68,225 @@ type PullerOpts struct {
 	// CaCert is the path on the file system to a client CA if the host truststore cannot verify the
 	// server cert.
 	CaCert string
+	// TlsCertPEM is a PEM-encoded client pki certificate for mTLS. Use instead of TlsCert to
+	// provide the certificate in memory.
+	TlsCertPEM []byte
+	// TlsKeyPEM is a PEM-encoded client pki key for mTLS. Use instead of TlsKey to provide the
+	// key in memory.
+	TlsKeyPEM []byte
+	// CaCertPEM is a PEM-encoded CA or CA bundle. Use instead of CaCert to provide the CA in
+	// memory.
+	CaCertPEM []byte
+	// CaDir is the path on the file system to a directory of PEM-encoded CA files with a '.crt'
+	// or '.pem' extension. These are combined with any CA in CaCert or CaCertPEM.
+	CaDir string
+	// AppendSystemCAs causes the CAs from CaCert, CaCertPEM, and CaDir to be added to the host
+	// truststore rather than replacing it, so that servers signed by either can be verified.
+	AppendSystemCAs bool
+	// ReloadCerts causes the client cert and key in TlsCert and TlsKey to be re-read from the
+	// file system whenever either file changes, to support rotating short-lived certs without
+	// creating a new puller. If the changed files can't be loaded (e.g. the rotation is only
+	// half done) the previously loaded cert continues to be used.
+	ReloadCerts bool
 	// TlsCfg supports initializing the puller with an externally-initialized client
 	// TLS Configuration.
 	TlsCfg *tls.Config
 	// Insecure skips server cert validation for the upstream registry (https-only.)
 	Insecure bool
+	// InsecureRegistries lists registries like 'my.registry:5000', or CIDRs like '10.0.0.0/8'
+	// that match registries by IP address, that may be accessed over plain http. Like the
+	// dockerd 'insecure-registries' setting, if the scheme is https and the registry is in
+	// the list then https is tried first and the puller falls back to http if the https
+	// connection fails.
+	InsecureRegistries []string
+	// InsecureHosts lists hosts like 'my.registry:5000', hosts like 'my.registry' that match
+	// any port, or CIDRs like '10.0.0.0/8', whose server certs are not verified (https-only.)
+	// Unlike Insecure, other hosts, like the token realm of the registry, are still verified.
+	InsecureHosts []string
 	// MaxIdleConnsPerHost is the same as http.Transport
 	MaxIdleConnsPerHost int
+	// ExtraHeaders are HTTP headers sent with every request, including token requests and
+	// redirects, e.g. 'X-Forwarded-For' or a corporate auth header. They don't replace the
+	// headers the puller sets, like Accept. A 'User-Agent' header overrides the default of
+	// 'DefaultUserAgent'. Use AuthHeader rather than an 'Authorization' header.
+	ExtraHeaders map[string]string
+	// Timeout, if not zero, is the time limit for each request to the registry, including
+	// reading the response. Since this includes downloading blobs, it has to allow for the
+	// largest blob that will be pulled.
+	Timeout time.Duration
+	// MaxRetryAfter caps the wait when the registry responds with a 429 (too many requests)
+	// or a 503 (service unavailable) and a 'Retry-After' header. The request is retried after
+	// the wait the registry asks for or MaxRetryAfter, whichever is shorter, up to three
+	// times. If zero then the cap is 30 seconds. If negative then the request isn't retried.
+	MaxRetryAfter time.Duration
+	// DialContext, if not nil, creates the network connections to the registry in place of
+	// the default dialer. This supports registries that are only reachable over a unix socket
+	// (see 'UnixSocketDialer') or through custom network plumbing like an SSH tunnel.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	// RegistryOverride, if not empty, is the host or IP address, with an optional port, that
+	// connections to the registry in the image url are made to in place of the registry, like
+	// curl --resolve. E.g. '10.0.0.5' or '10.0.0.5:8443'. The requests, and the TLS server
+	// name, still have the registry host so the registry certificate is still verified. This
+	// supports pulling where DNS for the registry isn't available. Connections to other hosts,
+	// like a token server or storage that blobs are redirected to, aren't overridden.
+	RegistryOverride string
+	// Proxy, if not empty, is the url of the proxy that all requests are made through, with
+	// scheme 'http', 'https', 'socks5', or 'socks5h', e.g. 'socks5://127.0.0.1:1080'. With
+	// 'socks5h' the proxy resolves the registry host. If empty then the proxy is from the
+	// HTTP_PROXY, HTTPS_PROXY, and NO_PROXY environment variables.
+	Proxy string
+	// SSHJump, if not empty, is an SSH jump host like 'user@bastion' or 'user@bastion:2222'
+	// that connections are tunneled through using the ssh client. See 'SSHJumpDialer'. It
+	// can't be specified with DialContext.
+	SSHJump string
+	// Transport, if not nil, is the HTTP transport used for all requests. The TLS options,
+	// MaxIdleConnsPerHost, DialContext, RegistryOverride, Proxy, and SSHJump are ignored
+	// since the transport is expected to be fully configured by the caller.
+	Transport http.RoundTripper
+	// TokenCache, if not nil, caches the bearer tokens obtained by the puller. If nil then
+	// a cache shared by all pullers in the process is used. Tokens are cached per registry,
+	// scope, and credentials, until they expire or the upstream rejects them.
+	TokenCache *TokenCache
+	// ManifestCache, if not nil, caches the manifests fetched by the puller with their
+	// ETags. A cached manifest is fetched with an If-None-Match header, and if the registry
+	// responds 304 Not Modified then the cached manifest is used rather than downloading it
+	// again. This supports polling tags for changes. Use 'NewManifestCache' for an in-memory
+	// cache, or implement the interface to persist the cache.
+	ManifestCache types.ManifestCache
+	// OnEvent, if not nil, is called with an 'Event' for each phase of a pull, e.g. when the
+	// manifest is resolved and when each blob starts and finishes downloading, so that the
+	// pull can be logged or audited. It is called synchronously by the goroutine doing the
+	// pull, so it should return quickly, and must be safe for concurrent use if the puller
+	// is used concurrently.
+	OnEvent func(Event)
+	// PrePullHook, if not nil, is called with the image manifest that a pull resolved to,
+	// its digest, and the platforms in the image list it was selected from, before any of
+	// its blobs are downloaded. If it returns an error then the pull is aborted with a
+	// '*PolicyError', so admission or policy checks like allowed registries, required
+	// signatures, or a maximum size can veto pulls in one place. It is called by the methods
+	// that pull an image, like 'PullTar' and 'PullBlobs', but not by 'GetConfig', which only
+	// pulls the image config. 'PullBlobs' has no image list, so 'IndexDigest' and 'Platforms'
+	// are empty.
+	PrePullHook func(PrePullInfo) error
+	// MaxImageBytes, if not zero, is the largest image that can be pulled, as the sum of
+	// the sizes of its layers and config from the 'Plan' of the image. A larger image is
+	// rejected with a '*PolicyError' wrapping 'ErrImageTooLarge' before any blobs are
+	// downloaded, which protects constrained devices from pulling huge images. It is checked
+	// by the same methods as the 'PrePullHook', and before the hook is called. Schema 1
+	// manifests don't have blob sizes, so they always pass.
+	MaxImageBytes int64
+	// AllowedRegistries, if not empty, lists the registries like 'my.registry:5000' that
+	// images can be pulled from, so a product embedding the library can enforce where
+	// images come from. The registries are normalized like the registry of an image url,
+	// so e.g. 'registry-1.docker.io' is 'docker.io'. Any method that gets manifests, blobs,
+	// or tags from any other registry - the pulls, the 'GetManifest' methods, 'GetRawManifest',
+	// 'HeadManifest', 'Exists', 'ListTags', 'Plan', 'Size', and 'PullBlobs', and so also
+	// 'Watch', 'Copy', and 'CreateBundle' - fails with a '*PolicyError' wrapping
+	// 'ErrRegistryNotAllowed' before the registry is contacted. The registry is the one in
+	// the image url, not the 'Namespace' or 'RegistryOverride'.
+	AllowedRegistries []string
+	// RequireDigest rejects a pull of an image referenced by tag rather than by digest with
+	// a '*PolicyError' wrapping 'ErrDigestRequired' before the registry is contacted, so
+	// that only pinned images can be pulled. It is checked by the same methods as
+	// 'AllowedRegistries'.
+	RequireDigest bool
+	// Logger, if not nil, gets debug-level logging of each HTTP request the puller makes,
+	// including token requests and redirects, with the method, url, response status, and
+	// time taken. This supports diagnosing auth and connection failures.
+	Logger *slog.Logger
+	// MediaTypeCheck is how a manifest is handled if its Content-Type header doesn't match
+	// the media type in the manifest, or in the image list descriptor it was selected by.
+	// By default the header is trusted. See 'MediaTypeCheck'.
+	MediaTypeCheck MediaTypeCheck
+	// Config, if not nil, has registry settings that are applied to the options by
+	// 'NewPullerWith' and 'NewRegistrySession' using 'Config.Apply', so options that are
+	// set take precedence over the config. If the scheme is empty after the config is
+	// applied then https is used. Mirrors in the config are not tried: see 'Config.Mirrors'.
+	Config *Config
+	// Session, if not nil, is a session shared by many pullers for the same registry. The
+	// puller uses the HTTP client of the session, so the transport, dial, and TLS options
+	// are ignored, and shares auth with the other pullers in the session.
+	Session *RegistrySession
+	// BlobSyncer, if not nil, synchronizes concurrent pulls of the same blob by all the
+	// pullers that share it, so only one puller pulls the blob and the others wait. If nil
+	// then the syncer enabled by 'SetConcurrentBlobs' is used, if any.
+	BlobSyncer *BlobSyncer
 	// Namespace supports pull-through and mirroring, i.e. pull 'localhost:5000/hello-world:latest'
 	// with Namespace 'docker.io' to pull from localhost if localhost is a mirror
 	// or a pull-through registry.
 	Namespace string
+	// BasePath is the path that the registry serves the v2 API under, for registries like
+	// Artifactory that don't serve it from the root, e.g. '/artifactory/api/docker/docker-local'
+	// for a registry that serves 'https://host/artifactory/api/docker/docker-local/v2/'. The
+	// image url doesn't include the base path, e.g. 'host/my-image:v1'.
+	BasePath string
+	// VerifyDiffIDs causes each pulled layer to be decompressed so that its diff_id can be
+	// computed and checked against the 'rootfs.diff_ids' in the image config. This catches
+	// corrupted or tampered layers that the digest check on the compressed blob cannot.
+	// Schema 1 and OCI artifact manifests have no config and so are not verified.
+	VerifyDiffIDs bool
+	// WorkDir is the directory that temp directories are created in while pulling, e.g.
+	// when blobs are pulled before being written to a tarball. If empty, then the default
+	// directory for temporary files is used (e.g. $TMPDIR or /tmp.)
+	WorkDir string
+	// FileMode, if not zero, is the permissions of the blobs, tarballs, and archives written
+	// by the puller, regardless of the umask, e.g. 0644 for a cache read by other users.
+	FileMode os.FileMode
+	// FileOwner, if not empty, is the numeric owner of the files written by the puller, as
+	// 'uid:gid', 'uid', or ':gid', like chown. Changing the owner usually requires root.
+	FileOwner string
+	// Sidecar, if not empty, is the kind of sidecar file that 'PullTar' writes next to the
+	// tarball with its digest, so that downstream tooling can verify the tarball. See
+	// 'SidecarType'.
+	Sidecar SidecarType
+	// SigningKey, if not empty, is the path of an unencrypted PEM RSA or ECDSA private key
+	// that 'PullTar' signs the tarball with, for a verifiable hand-off into an air-gapped
+	// environment. The signature of the sha256 digest of the tarball is written to
+	// '<dest>.sig' and can be verified with the public key using 'openssl dgst -sha256
+	// -verify <public key> -signature <dest>.sig <dest>'.
+	SigningKey string
+	// Sign, if not nil, signs tarballs like SigningKey, but by calling the function, e.g. to
+	// sign with a key in an HSM or a cloud KMS. It can't be specified with SigningKey.
+	Sign SignFunc
+	// DecryptionKeys are the paths of unencrypted PEM RSA or ECDSA private keys used to
+	// decrypt the layers of images that were encrypted with OCIcrypt, i.e. layers with a
+	// '+encrypted' media type. The layers are decrypted after they are pulled, and the
+	// image is written with a manifest that references the decrypted layers - which
+	// changes the manifest digest. An image with encrypted layers can't be pulled to a
+	// tarball or flattened without a key for each layer.
+	DecryptionKeys []string
+	// Fsync causes the files written by the puller to be flushed to stable storage before
+	// the pull returns, so another process never reads a file that is lost if the host fails.
+	Fsync bool
+	// Reproducible causes image tarballs to be byte-identical for the same image digest,
+	// by writing every tarball entry with the epoch as its timestamp and with numeric 0:0
+	// ownership rather than the current time and user.
+	Reproducible bool
+	// OCILayout causes image tarballs to have the OCI image layout structure written by
+	// newer versions of 'docker save' - with the blobs in 'blobs/sha256' and an 'index.json'
+	// referencing the image manifest - along with 'manifest.json'. This preserves the
+	// image manifest digest when the tarball is loaded by newer engines.
+	OCILayout bool
+	// RepoTags, if not empty, are the tags of the image in image tarballs, overriding the
+	// image url that was pulled. E.g. to tag an image pulled from a mirror with its
+	// upstream name. Each must be a tag like 'docker.io/hello-world:latest', not a digest.
+	RepoTags []string
+	// NoRepoTags causes image tarballs to have no tags, so the image is untagged when the
+	// tarball is loaded. Images pulled by digest have no tags unless 'RepoTags' is set.
+	NoRepoTags bool
+	// AcceptTypes, if not empty, are the manifest media types that are accepted from the
+	// registry, in the Accept header of manifest requests. By default all the manifest types
+	// the package supports are accepted. Some registries convert manifests based on the
+	// Accept header, so this can restrict pulls to OCI-only, e.g. 'types.V1ociIndexMt' and
+	// 'types.V1ociManifestMt', or docker-only manifests.
+	AcceptTypes []types.MediaType
+	// MaxManifestBytes is the largest manifest that will be accepted from the upstream. If
+	// zero, then manifests up to 4MiB are accepted.
+	MaxManifestBytes int64
+	// MaxBlobBytes is the largest blob that will be accepted from the upstream. If zero,
+	// then blobs of any size are accepted. Blobs are streamed to the file system so large
+	// blobs are not held in memory.
+	MaxBlobBytes int64
 }
 
 // NewPullerOpts is a convenience function that initializes and returns a PullerOpts struct
@@ -59,15 +301,83 @@ func NewPullerOpts(url string) PullerOpts {
 	}
 }
 
+// parseOwner parses the passed owner like 'uid:gid', 'uid', or ':gid', and returns the
+// uid and gid, with -1 for an id that isn't specified. An empty owner returns -1 for both.
+func parseOwner(owner string) (int, int, error) {
+	ids := []int{-1, -1}
+	if owner == "" {
+		return -1, -1, nil
+	}
+	parts := strings.Split(owner, ":")
+	if len(parts) > 2 || owner == ":" {
+		return 0, 0, fmt.Errorf("invalid file owner %q: must be like 'uid:gid', 'uid', or ':gid'", owner)
+	}
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		id, err := strconv.Atoi(part)
+		if err != nil || id < 0 {
+			return 0, 0, fmt.Errorf("invalid file owner %q: ids must be numeric", owner)
+		}
+		ids[i] = id
+	}
+	return ids[0], ids[1], nil
+}
+
+// fileOpts returns the file options in the receiver for the files written by the puller.
+func (o PullerOpts) fileOpts() util.FileOpts {
+	uid, gid, _ := parseOwner(o.FileOwner)
+	return util.FileOpts{
+		Mode:  o.FileMode,
+		Chown: o.FileOwner != "",
+		Uid:   uid,
+		Gid:   gid,
+		Sync:  o.Fsync,
+	}
+}
+
+// finishFile applies the file options in the receiver to the passed file that the puller
+// wrote. If they can't be applied then the file is removed so that it isn't left without
+// the permissions or durability that were asked for.
+func (o PullerOpts) finishFile(path string) error {
+	if err := o.fileOpts().Apply(path); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("unable to apply file options to %q, error: %w", path, err)
+	}
+	return nil
+}
+
 // validate performs option validation and returns an error if any options are
-// invalid.
-func (o PullerOpts) validate() error {
+// invalid. The 'AllowedRegistries' are replaced with a normalized copy so that they
+// match the registry of image urls.
+func (o *PullerOpts) validate() error {
 	if !o.validateOsAndArch() {
 		return fmt.Errorf("operating system %q and/or architecture %q are not valid", o.OStype, o.ArchType)
 	}
+	if o.OSVersion != "" && !osVersionRe.MatchString(o.OSVersion) {
+		return fmt.Errorf("invalid os version %q: must be numbers separated by periods", o.OSVersion)
+	}
 	if o.Url == "" {
 		return fmt.Errorf("url is undefined")
 	}
+	if o.RegistryOverride != "" && !validOverride(o.RegistryOverride) {
+		return fmt.Errorf("invalid registry override %q: must be a host or IP address with an optional port", o.RegistryOverride)
+	}
+	if o.Proxy != "" {
+		if _, err := proxyUrl(o.Proxy); err != nil {
+			return err
+		}
+	}
+	if o.SSHJump != "" && o.DialContext != nil {
+		return fmt.Errorf("an SSH jump host and a dial function cannot both be specified")
+	}
+	if strings.ContainsAny(o.SSHJump, " \t/") || strings.HasPrefix(o.SSHJump, "-") {
+		return fmt.Errorf("invalid SSH jump host %q: must be like 'user@host' or 'user@host:port'", o.SSHJump)
+	}
+	if strings.ContainsAny(o.BasePath, "?# \t") || strings.HasSuffix(strings.TrimRight(o.BasePath, "/"), "/v2") {
+		return fmt.Errorf("invalid base path %q: must be a url path that the v2 API is under, without '/v2'", o.BasePath)
+	}
 	if o.Scheme == "" {
 		return fmt.Errorf("scheme is undefined")
 	} else {
@@ -78,41 +388,119 @@ func (o PullerOpts) validate() error {
 		}
 
 	}
+	if (o.Token != "" && o.BearerToken != "") || (o.AuthHeader != "" && (o.Token != "" || o.BearerToken != "")) {
+		return fmt.Errorf("only one of a token, a bearer token, and an auth header can be specified")
+	}
+	for k := range o.ExtraHeaders {
+		if strings.EqualFold(k, "Authorization") {
+			return fmt.Errorf("the Authorization header cannot be an extra header: use the auth header option")
+		}
+	}
+	for _, mt := range o.AcceptTypes {
+		if !methods.IsManifestType(mt) {
+			return fmt.Errorf("unsupported manifest media type %q", mt)
+		}
+	}
+	if o.TlsCert != "" && len(o.TlsCertPEM) != 0 || o.TlsKey != "" && len(o.TlsKeyPEM) != 0 || o.CaCert != "" && len(o.CaCertPEM) != 0 {
+		return fmt.Errorf("a certificate or key may be specified as a file or as PEM but not both")
+	}
+	if o.ReloadCerts && (o.TlsCert == "" || o.TlsKey == "") {
+		return fmt.Errorf("reloading certs requires the client cert and key to be specified as files")
+	}
+	if o.MaxManifestBytes < 0 || o.MaxBlobBytes < 0 {
+		return fmt.Errorf("maximum manifest and blob sizes cannot be negative")
+	}
+	if o.NoRepoTags && len(o.RepoTags) != 0 {
+		return fmt.Errorf("repo tags cannot be specified when repo tags are omitted")
+	}
+	for _, repoTag := range o.RepoTags {
+		if repoTag == "" || strings.ContainsAny(repoTag, "@ \t") {
+			return fmt.Errorf("invalid repo tag %q: must be an image name and tag like 'docker.io/hello-world:latest'", repoTag)
+		}
+	}
+	if !slices.Contains([]MediaTypeCheck{MediaTypeCheckOff, MediaTypeCheckWarn, MediaTypeCheckStrict}, o.MediaTypeCheck) {
+		return fmt.Errorf("invalid media type check %q: must be \"warn\" or \"strict\"", o.MediaTypeCheck)
+	}
+	if !slices.Contains([]SidecarType{NoSidecar, Sha256Sidecar, JSONSidecar}, o.Sidecar) {
+		return fmt.Errorf("invalid sidecar %q: must be \"sha256\" or \"json\"", o.Sidecar)
+	}
+	if o.SigningKey != "" && o.Sign != nil {
+		return fmt.Errorf("a signing key and a sign function cannot both be specified")
+	}
+	if slices.Contains(o.DecryptionKeys, "") {
+		return fmt.Errorf("decryption key paths cannot be empty")
+	}
+	if o.FileMode&^os.ModePerm != 0 {
+		return fmt.Errorf("invalid file mode %v: must only have permission bits", o.FileMode)
+	}
+	if _, _, err := parseOwner(o.FileOwner); err != nil {
+		return err
+	}
+	for _, reg := range o.InsecureRegistries {
+		if strings.Contains(reg, "/") {
+			if _, _, err := net.ParseCIDR(reg); err != nil {
+				return fmt.Errorf("invalid insecure registry %q: %w", reg, err)
+			}
+		}
+	}
+	if len(o.AllowedRegistries) != 0 {
+		allowed := make([]string, len(o.AllowedRegistries))
+		for i, reg := range o.AllowedRegistries {
+			var err error
+			if allowed[i], err = normalizeRegistry(reg); err != nil {
+				return fmt.Errorf("invalid allowed registry %q: must be a host with an optional port", reg)
+			}
+		}
+		o.AllowedRegistries = allowed
+	}
+	for _, host := range o.InsecureHosts {
+		if strings.Contains(host, "/") {
+			if _, _, err := net.ParseCIDR(host); err != nil {
+				return fmt.Errorf("invalid insecure host %q: %w", host, err)
+			}
+		}
+	}
 	return nil
 }
 
 // configureTls initializes and returns a pointer to a 'tls.Config' struct based
 // on TLS-related variables in the receiver. If there are no TLS-related variables in
-// the receiver then nil is returned.
+// the receiver then nil is returned. The config is returned even if the scheme is http
+// because it is also used for other hosts, like a bearer token realm that requires mTLS.
 func (o PullerOpts) configureTls() (*tls.Config, error) {
 	if o.TlsCfg != nil {
 		return o.TlsCfg, nil
 	}
-	if o.Scheme == "http" {
-		return nil, nil
-	}
 	cfg := &tls.Config{}
 	hasCfg := false
-	if o.TlsCert != "" && o.TlsKey != "" {
+	if o.TlsCert != "" && o.TlsKey != "" && o.ReloadCerts {
+		if cr, err := newCertReloader(o.TlsCert, o.TlsKey); err != nil {
+			return nil, err
+		} else {
+			cfg.GetClientCertificate = cr.getClientCertificate
+			hasCfg = true
+		}
+	} else if o.TlsCert != "" && o.TlsKey != "" {
 		if cert, err := tls.LoadX509KeyPair(o.TlsCert, o.TlsKey); err != nil {
 			return nil, err
 		} else {
 			cfg.Certificates = []tls.Certificate{cert}
 			hasCfg = true
 		}
-	}
-	if o.CaCert != "" {
-		if caCert, err := os.ReadFile(o.CaCert); err != nil {
+	} else if len(o.TlsCertPEM) != 0 && len(o.TlsKeyPEM) != 0 {
+		if cert, err := tls.X509KeyPair(o.TlsCertPEM, o.TlsKeyPEM); err != nil {
 			return nil, err
 		} else {
-			cp := x509.NewCertPool()
-			if !cp.AppendCertsFromPEM(caCert) {
-				return nil, err
-			}
-			cfg.RootCAs = cp
+			cfg.Certificates = []tls.Certificate{cert}
 			hasCfg = true
 		}
 	}
+	if cp, err := o.certPool(); err != nil {
+		return nil, err
+	} else if cp != nil {
+		cfg.RootCAs = cp
+		hasCfg = true
+	}
 	if o.Insecure {
 		cfg.InsecureSkipVerify = true
 		hasCfg = true
@@ -124,20 +512,82 @@ func (o PullerOpts) configureTls() (*tls.Config, error) {
 	return nil, nil
 }
 
+// certPool returns a cert pool with the CAs from the CaCert, CaCertPEM and CaDir
+// fields in the receiver, added to the host truststore if AppendSystemCAs is set. If
+// there are no CAs in the receiver then nil is returned.
+func (o PullerOpts) certPool() (*x509.CertPool, error) {
+	caCerts := [][]byte{}
+	if len(o.CaCertPEM) != 0 {
+		caCerts = append(caCerts, o.CaCertPEM)
+	}
+	if o.CaCert != "" {
+		if caCert, err := os.ReadFile(o.CaCert); err != nil {
+			return nil, err
+		} else {
+			caCerts = append(caCerts, caCert)
+		}
+	}
+	if o.CaDir != "" {
+		entries, err := os.ReadDir(o.CaDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if ext := filepath.Ext(entry.Name()); entry.IsDir() || (ext != ".crt" && ext != ".pem") {
+				continue
+			}
+			if caCert, err := os.ReadFile(filepath.Join(o.CaDir, entry.Name())); err != nil {
+				return nil, err
+			} else {
+				caCerts = append(caCerts, caCert)
+			}
+		}
+	}
+	if len(caCerts) == 0 {
+		return nil, nil
+	}
+	cp := x509.NewCertPool()
+	if o.AppendSystemCAs {
+		var err error
+		if cp, err = x509.SystemCertPool(); err != nil {
+			return nil, fmt.Errorf("unable to load the system cert pool: %w", err)
+		}
+	}
+	for _, caCert := range caCerts {
+		if !cp.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no valid PEM certificates found in the CA cert")
+		}
+	}
+	return cp, nil
+}
+
+// platform returns the platform in the receiver for selecting an image from an image list.
+func (o PullerOpts) platform() Platform {
+	return Platform{
+		OS:           o.OStype,
+		Architecture: o.ArchType,
+		OSVersion:    o.OSVersion,
+		OSFeatures:   o.OSFeatures,
+	}
+}
+
 // validateOsAndArch validates the OS and architecture in the receiver as well as
 // their combination together.
 func (o PullerOpts) validateOsAndArch() bool {
 	validOsArch := map[string][]string{
-		"android":   {"arm"},
+		"aix":       {"ppc64"},
+		"android":   {"386", "amd64", "arm", "arm64"},
 		"darwin":    {"386", "amd64", "arm", "arm64"},
 		"dragonfly": {"amd64"},
-		"freebsd":   {"386", "amd64", "arm"},
-		"linux":     {"386", "amd64", "arm", "arm64", "ppc64", "ppc64le", "mips64", "mips64le", "s390x", "riscv64"},
-		"netbsd":    {"386", "amd64", "arm"},
-		"openbsd":   {"386", "amd64", "arm"},
+		"freebsd":   {"386", "amd64", "arm", "arm64", "riscv64"},
+		"illumos":   {"amd64"},
+		"linux":     {"386", "amd64", "arm", "arm64", "loong64", "ppc64", "ppc64le", "mips", "mipsle", "mips64", "mips64le", "s390x", "riscv64"},
+		"netbsd":    {"386", "amd64", "arm", "arm64"},
+		"openbsd":   {"386", "amd64", "arm", "arm64", "riscv64"},
 		"plan9":     {"386", "amd64"},
 		"solaris":   {"amd64"},
-		"windows":   {"386", "amd64"}}
+		"wasip1":    {"wasm"},
+		"windows":   {"386", "amd64", "arm", "arm64"}}
 	for os, archs := range validOsArch {
 		if os == o.OStype {
 			return slices.Contains(archs, o.ArchType)
@@ -145,3 +595,46 @@ func (o PullerOpts) validateOsAndArch() bool {
 	}
 	return false
 }
+
+// imageRef parses the passed image url with the scheme, namespace, and base path in
+// the receiver.
+func (o PullerOpts) imageRef(url string) (imgref.ImageRef, error) {
+	ir, err := imgref.NewImageRef(url, o.Scheme, o.Namespace)
+	if err != nil {
+		return imgref.ImageRef{}, err
+	}
+	return ir.WithBasePath(o.BasePath), nil
+}
+
+// isInsecureRegistry returns true if the passed registry like 'my.registry:5000' is
+// in the 'InsecureRegistries' list in the receiver, either by name or because the
+// registry is an IP address within one of the CIDRs in the list.
+func (o PullerOpts) isInsecureRegistry(registry string) bool {
+	return hostMatches(o.InsecureRegistries, registry, false)
+}
+
+// isInsecureHost returns true if the passed host like 'my.registry:5000' is in the
+// 'InsecureHosts' list in the receiver, by name with or without the port, or because
+// the host is an IP address within one of the CIDRs in the list.
+func (o PullerOpts) isInsecureHost(host string) bool {
+	return hostMatches(o.InsecureHosts, host, true)
+}
+
+// hostMatches returns true if the passed host like 'my.registry:5000' matches one of the
+// passed entries, either by name or because the host is an IP address within a CIDR
+// entry. If anyPort is true then an entry without a port matches the host on any port.
+func hostMatches(entries []string, host string, anyPort bool) bool {
+	name := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name = h
+	}
+	ip := net.ParseIP(strings.Trim(name, "[]"))
+	for _, entry := range entries {
+		if strings.EqualFold(entry, host) || (anyPort && strings.EqualFold(entry, name)) {
+			return true
+		} else if _, cidr, err := net.ParseCIDR(entry); err == nil && ip != nil && cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,7 +1,13 @@
 package imgpull
 
 import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/aceeric/imgpull/mock"
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
 )
 
 func TestPullerOpts(t *testing.T) {
@@ -25,6 +31,28 @@ func TestValidate(t *testing.T) {
 		{opts: PullerOpts{Url: "foo", Scheme: "x", OStype: "linux", ArchType: "amd64"}, valid: false},
 		{opts: PullerOpts{Url: "foo", Scheme: "https", OStype: "x", ArchType: "amd64"}, valid: false},
 		{opts: PullerOpts{Url: "foo", Scheme: "https", OStype: "linux", ArchType: "x"}, valid: false},
+		{opts: PullerOpts{Url: "foo", Scheme: "https", OStype: "linux", ArchType: "amd64", MaxBlobBytes: 1}, valid: true},
+		{opts: PullerOpts{Url: "foo", Scheme: "https", OStype: "linux", ArchType: "amd64", MaxBlobBytes: -1}, valid: false},
+		{opts: PullerOpts{Url: "foo", Scheme: "https", OStype: "linux", ArchType: "amd64", MaxManifestBytes: -1}, valid: false},
+		{opts: PullerOpts{Url: "foo", Scheme: "https", OStype: "linux", ArchType: "amd64", RepoTags: []string{"foo:v1", "bar"}}, valid: true},
+		{opts: PullerOpts{Url: "foo", Scheme: "https", OStype: "linux", ArchType: "amd64", RepoTags: []string{"foo@sha256:abc"}}, valid: false},
+		{opts: PullerOpts{Url: "foo", Scheme: "https", OStype: "linux", ArchType: "amd64", RepoTags: []string{""}}, valid: false},
+		{opts: PullerOpts{Url: "foo", Scheme: "https", OStype: "linux", ArchType: "amd64", RepoTags: []string{"foo:v1"}, NoRepoTags: true}, valid: false},
+		{opts: PullerOpts{Url: "foo", Scheme: "https", OStype: "windows", ArchType: "arm64"}, valid: true},
+		{opts: PullerOpts{Url: "foo", Scheme: "https", OStype: "windows", ArchType: "amd64", OSVersion: "10.0.17763.5820"}, valid: true},
+		{opts: PullerOpts{Url: "foo", Scheme: "https", OStype: "windows", ArchType: "amd64", OSVersion: "10.0.x"}, valid: false},
+		{opts: PullerOpts{Url: "foo", Scheme: "https", OStype: "wasip1", ArchType: "wasm"}, valid: true},
+		{opts: PullerOpts{Url: "foo", Scheme: "https", OStype: "linux", ArchType: "amd64", AcceptTypes: []types.MediaType{types.V1ociManifestMt}}, valid: true},
+		{opts: PullerOpts{Url: "foo", Scheme: "https", OStype: "linux", ArchType: "amd64", AcceptTypes: []types.MediaType{types.V1ociLayerMt}}, valid: false},
+		{opts: PullerOpts{Url: "foo", Scheme: "https", OStype: "linux", ArchType: "amd64", Proxy: "socks5://127.0.0.1:1080"}, valid: true},
+		{opts: PullerOpts{Url: "foo", Scheme: "https", OStype: "linux", ArchType: "amd64", Proxy: "http://proxy.corp:3128"}, valid: true},
+		{opts: PullerOpts{Url: "foo", Scheme: "https", OStype: "linux", ArchType: "amd64", Proxy: "ftp://proxy.corp"}, valid: false},
+		{opts: PullerOpts{Url: "foo", Scheme: "https", OStype: "linux", ArchType: "amd64", Proxy: "127.0.0.1:1080"}, valid: false},
+		{opts: PullerOpts{Url: "foo", Scheme: "https", OStype: "linux", ArchType: "amd64", SSHJump: "jqpubli@bastion:2222"}, valid: true},
+		{opts: PullerOpts{Url: "foo", Scheme: "https", OStype: "linux", ArchType: "amd64", SSHJump: "-oProxyCommand=x"}, valid: false},
+		{opts: PullerOpts{Url: "foo", Scheme: "https", OStype: "linux", ArchType: "amd64", SSHJump: "bastion", DialContext: UnixSocketDialer("x")}, valid: false},
+		{opts: PullerOpts{Url: "foo", Scheme: "https", OStype: "linux", ArchType: "amd64", DecryptionKeys: []string{"key.pem"}}, valid: true},
+		{opts: PullerOpts{Url: "foo", Scheme: "https", OStype: "linux", ArchType: "amd64", DecryptionKeys: []string{"key.pem", ""}}, valid: false},
 	} {
 		err := po.opts.validate()
 		if po.valid && err != nil {
@@ -35,3 +63,123 @@ func TestValidate(t *testing.T) {
 		}
 	}
 }
+
+func TestParseOwner(t *testing.T) {
+	for _, tst := range []struct {
+		owner string
+		uid   int
+		gid   int
+		valid bool
+	}{
+		{"", -1, -1, true},
+		{"1000:2000", 1000, 2000, true},
+		{"1000", 1000, -1, true},
+		{":2000", -1, 2000, true},
+		{"1000:", 1000, -1, true},
+		{":", 0, 0, false},
+		{"jqpubli", 0, 0, false},
+		{"1:2:3", 0, 0, false},
+		{"-1:2", 0, 0, false},
+	} {
+		uid, gid, err := parseOwner(tst.owner)
+		if (err == nil) != tst.valid || uid != tst.uid || gid != tst.gid {
+			t.Errorf("owner %q: got %d %d %v", tst.owner, uid, gid, err)
+		}
+	}
+	opts := PullerOpts{Url: "foo", Scheme: "https", OStype: "linux", ArchType: "amd64", FileMode: os.ModeSetuid | 0755}
+	if opts.validate() == nil {
+		t.Errorf("expected a file mode with more than permissions to be invalid")
+	}
+}
+
+func TestIsInsecureRegistry(t *testing.T) {
+	opts := PullerOpts{InsecureRegistries: []string{"my.registry:5000", "10.0.0.0/8", "fd00::/8"}}
+	for _, tst := range []struct {
+		registry string
+		insecure bool
+	}{
+		{"my.registry:5000", true},
+		{"MY.registry:5000", true},
+		{"my.registry", false},
+		{"my.registry:5001", false},
+		{"10.1.2.3:5000", true},
+		{"10.1.2.3", true},
+		{"11.1.2.3:5000", false},
+		{"[fd00::1]:5000", true},
+		{"quay.io", false},
+	} {
+		if opts.isInsecureRegistry(tst.registry) != tst.insecure {
+			t.Fail()
+		}
+	}
+	opts = PullerOpts{Url: "foo", Scheme: "https", OStype: "linux", ArchType: "amd64", InsecureRegistries: []string{"10.0.0.0/88"}}
+	if opts.validate() == nil {
+		t.Fail()
+	}
+}
+
+func TestValidateCerts(t *testing.T) {
+	for _, po := range []struct {
+		opts  PullerOpts
+		valid bool
+	}{
+		{PullerOpts{TlsCert: "c", TlsKey: "k"}, true},
+		{PullerOpts{TlsCertPEM: []byte("c"), TlsKeyPEM: []byte("k")}, true},
+		{PullerOpts{TlsCert: "c", TlsCertPEM: []byte("c")}, false},
+		{PullerOpts{CaCert: "ca", CaCertPEM: []byte("ca")}, false},
+		{PullerOpts{TlsCert: "c", TlsKey: "k", ReloadCerts: true}, true},
+		{PullerOpts{TlsCertPEM: []byte("c"), TlsKeyPEM: []byte("k"), ReloadCerts: true}, false},
+	} {
+		po.opts.Url, po.opts.Scheme, po.opts.OStype, po.opts.ArchType = "foo", "https", "linux", "amd64"
+		if (po.opts.validate() == nil) != po.valid {
+			t.Fail()
+		}
+	}
+}
+
+func TestCertPool(t *testing.T) {
+	cs1, err := mock.NewCertSetup()
+	if err != nil {
+		t.FailNow()
+	}
+	cs2, err := mock.NewCertSetup()
+	if err != nil {
+		t.FailNow()
+	}
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+	cs1.CaToFile(d, "ca1.crt")
+	cs2.CaToFile(d, "ca2.pem")
+	os.WriteFile(filepath.Join(d, "README"), []byte("not a cert"), 0644)
+	verifies := func(cp *x509.CertPool, cs mock.CertSetup) bool {
+		cert, err := x509.ParseCertificate(cs.ServerCert.Certificate[0])
+		if err != nil {
+			return false
+		}
+		_, err = cert.Verify(x509.VerifyOptions{Roots: cp})
+		return err == nil
+	}
+	cp, err := PullerOpts{CaDir: d}.certPool()
+	if err != nil || !verifies(cp, cs1) || !verifies(cp, cs2) {
+		t.FailNow()
+	}
+	cp, err = PullerOpts{CaCertPEM: cs1.CaPEM.Bytes()}.certPool()
+	if err != nil || !verifies(cp, cs1) || verifies(cp, cs2) {
+		t.FailNow()
+	}
+	sys, err := x509.SystemCertPool()
+	if err != nil {
+		t.Skip("no system cert pool")
+	}
+	cp, err = PullerOpts{CaCertPEM: cs1.CaPEM.Bytes(), AppendSystemCAs: true}.certPool()
+	if err != nil || !verifies(cp, cs1) {
+		t.FailNow()
+	}
+	sys.AppendCertsFromPEM(cs1.CaPEM.Bytes())
+	if !cp.Equal(sys) {
+		t.FailNow()
+	}
+	if cp, err := (PullerOpts{}).certPool(); err != nil || cp != nil {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,54 @@
+package imgpull
+
+import (
+	"os"
+	"time"
+
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+)
+
+// PullStats reports what a pull downloaded and how long each phase of the pull took, so a
+// caller can log and report the efficiency of its pulls. It is returned by 'PullTar' and
+// 'PullBlobs'. If the pull fails then the stats cover the part of the pull that was done.
+type PullStats struct {
+	// Layers is the number of layers pulled, not counting the image config.
+	Layers int `json:"layers"`
+	// Blobs is the number of blobs pulled, including the image config.
+	Blobs int `json:"blobs"`
+	// BytesDownloaded is the size of the blobs that were downloaded from the registry.
+	BytesDownloaded int64 `json:"bytesDownloaded"`
+	// BytesReused is the size of the blobs that were not downloaded because they were
+	// already in the destination, e.g. from an interrupted pull, or because the 'BlobSyncer'
+	// had them, e.g. from a pull of another image with the same layers.
+	BytesReused int64 `json:"bytesReused"`
+	// ResolveDuration is how long it took to get the manifests. It is zero for 'PullBlobs'
+	// since the manifest is passed to it.
+	ResolveDuration time.Duration `json:"resolveDuration"`
+	// DownloadDuration is how long it took to pull the blobs.
+	DownloadDuration time.Duration `json:"downloadDuration"`
+	// WriteDuration is how long it took to write the tarball and its sidecars. It is zero
+	// for 'PullBlobs'.
+	WriteDuration time.Duration `json:"writeDuration"`
+	// Duration is how long the whole pull took.
+	Duration time.Duration `json:"duration"`
+}
+
+// addBlob adds the passed blob, which was pulled to the passed file, to the receiver. If
+// the blob has no size, as in schema 1 manifests, then the size of the file is used.
+func (s *PullStats) addBlob(mh ManifestHolder, layer types.Layer, toFile string, downloaded bool) {
+	size := int64(layer.Size)
+	if size == 0 {
+		if fi, err := os.Stat(toFile); err == nil {
+			size = fi.Size()
+		}
+	}
+	s.Blobs++
+	if !mh.hasConfig() || mh.Layers()[len(mh.Layers())-1].Digest != layer.Digest {
+		s.Layers++
+	}
+	if downloaded {
+		s.BytesDownloaded += size
+	} else {
+		s.BytesReused += size
+	}
+}
@@ -0,0 +1,61 @@
+package imgpull
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aceeric/imgpull/mock"
+)
+
+// Tests the stats returned by PullTar and PullBlobs, including blobs reused from an
+// earlier pull into the same directory and from a blob syncer.
+func TestPullStats(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+	syncer := NewBlobSyncer(60)
+	defer syncer.Close()
+	p, err := NewPullerWith(PullerOpts{
+		Url:        fmt.Sprintf("%s/hello-world:latest", url),
+		OStype:     "linux",
+		ArchType:   "amd64",
+		Scheme:     "http",
+		BlobSyncer: syncer,
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	// the layer is 2459 bytes and the config is 581 bytes
+	stats, err := p.PullTar(filepath.Join(d, "hello.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Layers != 1 || stats.Blobs != 2 || stats.BytesDownloaded != 3040 || stats.BytesReused != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if stats.ResolveDuration == 0 || stats.DownloadDuration == 0 || stats.WriteDuration == 0 || stats.Duration < stats.DownloadDuration {
+		t.Errorf("unexpected durations %+v", stats)
+	}
+	mh, err := p.GetManifestByType(Image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the syncer staged the blobs during the tarball pull
+	blobDir := filepath.Join(d, "blobs")
+	if stats, err = p.PullBlobs(mh, blobDir, OnlyConfig()); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Layers != 0 || stats.Blobs != 1 || stats.BytesDownloaded != 0 || stats.BytesReused != 581 || stats.ResolveDuration != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	// the config is already in the directory
+	if stats, err = p.PullBlobs(mh, blobDir); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Layers != 1 || stats.Blobs != 2 || stats.BytesReused != 3040 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,105 @@
+package imgpull
+
+import (
+	"runtime"
+
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+)
+
+// Pusher is the interface to the package for pushing image blobs and manifests
+// to a registry. It supports loading images into a registry, for example on the
+// disconnected side of an air gap.
+type Pusher interface {
+	// BlobExists returns true if the blob with the passed digest already exists in
+	// the repository of the image url in the receiver.
+	BlobExists(digest string) (bool, error)
+	// PushBlob uploads the blob described by the passed 'layer' from the passed file
+	// unless the blob already exists in the upstream.
+	PushBlob(layer types.Layer, fromFile string) error
+	// PushManifest uploads the passed manifest bytes with the passed media type. The
+	// 'ref' arg is a tag or a digest. If empty then the ref from the image url in the
+	// receiver is used.
+	PushManifest(ref string, mediaType string, manifest []byte) error
+	// TagManifest tags the manifest with the passed 'ref' (a tag or a digest) that already
+	// exists in the repository of the image url in the receiver with the passed 'tag'. If
+	// 'ref' is empty then the ref from the image url in the receiver is used. The manifest
+	// is fetched and put back unchanged under the new tag, so no blobs are moved and the
+	// digest stays the same. This supports promoting an image, e.g. from a 'staging' tag
+	// to a 'prod' tag. The digest of the tagged manifest is returned.
+	TagManifest(ref string, tag string) (string, error)
+	// Capabilities probes the registry for its optional features, like 'Puller.Capabilities',
+	// including whether it accepts chunked blob uploads.
+	Capabilities() (RegistryCapabilities, error)
+	// GetUrl returns the image ref from the receiver
+	GetUrl() string
+	// SetUrl supports reusing a pusher with a different image ref.
+	SetUrl(url string) error
+	// Close closes the pusher
+	Close()
+}
+
+// pusher implements the Pusher interface. It re-uses the puller's connection and
+// auth handling, requesting push as well as pull access if the upstream requires
+// bearer auth.
+type pusher struct {
+	*puller
+}
+
+// NewPusherWith initializes and returns a Pusher from the passed options. The options
+// are interpreted exactly as for 'NewPullerWith' except that the OS and architecture
+// are irrelevant and so default to the values for your system if not provided, and that
+// 'AllowedRegistries' and 'RequireDigest' are ignored since they limit where images come
+// from rather than where they are pushed.
+func NewPusherWith(o PullerOpts) (Pusher, error) {
+	if o.OStype == "" && o.ArchType == "" {
+		o.OStype, o.ArchType = runtime.GOOS, runtime.GOARCH
+	}
+	o.AllowedRegistries, o.RequireDigest = nil, false
+	p, err := NewPullerWith(o)
+	if err != nil {
+		return &pusher{puller: &puller{}}, err
+	}
+	p.(*puller).Actions = "pull,push"
+	return &pusher{puller: p.(*puller)}, nil
+}
+
+func (p *pusher) BlobExists(digest string) (bool, error) {
+	if err := p.connect(); err != nil {
+		return false, err
+	}
+	return p.regCliFrom().V2BlobsExists(digest)
+}
+
+func (p *pusher) PushBlob(layer types.Layer, fromFile string) error {
+	if exists, err := p.BlobExists(layer.Digest); err != nil {
+		return err
+	} else if exists {
+		return nil
+	}
+	return p.regCliFrom().V2BlobsUpload(layer, fromFile)
+}
+
+func (p *pusher) PushManifest(ref string, mediaType string, manifest []byte) error {
+	if err := p.connect(); err != nil {
+		return err
+	}
+	return p.regCliFrom().V2ManifestsPut(ref, types.MediaType(mediaType), manifest)
+}
+
+func (p *pusher) TagManifest(ref string, tag string) (string, error) {
+	r, err := ParseRef(p.GetUrl())
+	if err != nil {
+		return "", err
+	}
+	if _, err := r.WithTag(tag); err != nil {
+		return "", err
+	}
+	rm, err := p.GetRawManifest(ref)
+	if err != nil {
+		return "", err
+	}
+	if err := p.regCliFrom().V2ManifestsPut(tag, rm.MediaType, rm.Bytes); err != nil {
+		return "", err
+	}
+	return rm.Digest, nil
+}
@@ -0,0 +1,56 @@
+package imgpull
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/aceeric/imgpull/internal/testhelpers"
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Tests promoting a manifest to a new tag by tag and by digest, and that the manifest
+// is put back unchanged.
+func TestTagManifest(t *testing.T) {
+	pr, server, url := testhelpers.NewPushRegistry()
+	defer server.Close()
+	// the formatting is kept so the digest doesn't change
+	manifest := []byte("{\n  \"schemaVersion\": 2\n}")
+	dgst := digest.FromBytes(manifest).String()
+	pr.Manifests["frobozz"] = map[string][]byte{"staging": manifest, dgst: manifest}
+	pr.MediaTypes["frobozz"] = map[string]string{"staging": string(types.V1ociManifestMt), dgst: string(types.V1ociManifestMt)}
+	p, err := NewPusherWith(PullerOpts{
+		Url:    fmt.Sprintf("%s/frobozz:staging", url),
+		Scheme: "http",
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	defer p.Close()
+	for _, tc := range []struct {
+		ref string
+		tag string
+		ok  bool
+	}{
+		{"", "prod", true},
+		{dgst, "v1.0.0", true},
+		{"staging", "-invalid", false},
+		{"missing", "prod", false},
+		{digest.FromString("xyzzy").String(), "prod", false},
+	} {
+		tagged, err := p.TagManifest(tc.ref, tc.tag)
+		if (err == nil) != tc.ok {
+			t.Errorf("ref %q tag %q: unexpected result %v", tc.ref, tc.tag, err)
+			continue
+		}
+		if !tc.ok {
+			continue
+		}
+		b, mt, found := pr.Manifest("frobozz", tc.tag)
+		if tagged != dgst || !found || !bytes.Equal(b, manifest) || mt != string(types.V1ociManifestMt) {
+			t.Errorf("ref %q tag %q: unexpected manifest %s %q %s", tc.ref, tc.tag, tagged, b, mt)
+		}
+	}
+}
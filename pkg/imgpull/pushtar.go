@@ -0,0 +1,204 @@
+package imgpull
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/aceeric/imgpull/internal/tar"
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+	"github.com/aceeric/imgpull/pkg/imgpull/v1oci"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// ociConfigMt is the media type of the image config in the image manifest that 'PushTar'
+// creates for a 'docker save' tarball.
+const ociConfigMt = "application/vnd.oci.image.config.v1+json"
+
+// PushTar pushes the image in the passed image tarball, or OCI image layout directory, to
+// the image url in the passed options, e.g. 'my.registry.io:5000/hello-world:latest'. If the
+// source is an OCI image layout - a tarball pulled with the 'OCILayout' option or a directory
+// from 'PullLayout' - then its image manifest is pushed unchanged, so the digest is the same
+// as the image that was pulled. Otherwise the source must be a 'docker save' tarball, and an
+// OCI image manifest is created from its 'manifest.json' file, so the digest differs from the
+// image that was pulled. Blobs that already exist in the destination repository are not
+// pushed. The function returns the digest of the pushed image manifest.
+func PushTar(src string, opts PullerOpts) (dgst string, err error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return "", err
+	}
+	dir := src
+	if !info.IsDir() {
+		workDir, err := opts.newWorkDir()
+		if err != nil {
+			return "", err
+		}
+		defer func() { err = removeWorkDir(workDir, err) }()
+		if err := tar.UntarDir(src, workDir); err != nil {
+			return "", err
+		}
+		dir = workDir
+	}
+	var mediaType string
+	var manifest []byte
+	var blobs map[string]string
+	if _, err := os.Stat(filepath.Join(dir, "index.json")); err == nil {
+		mediaType, manifest, blobs, err = layoutManifest(dir)
+	} else {
+		mediaType, manifest, blobs, err = dockerSaveManifest(dir)
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to get the image manifest from %q: %w", src, err)
+	}
+	dgst = digest.FromBytes(manifest).String()
+	mh, err := NewManifestHolder(mediaType, manifest, digest.Digest(dgst).Encoded(), opts.Url)
+	if err != nil {
+		return "", err
+	}
+	if !mh.IsImageManifest() {
+		return "", fmt.Errorf("%q doesn't have an image manifest", src)
+	}
+	ps, err := NewPusherWith(opts)
+	if err != nil {
+		return "", err
+	}
+	defer ps.Close()
+	for _, layer := range mh.Layers() {
+		path, found := blobs[layer.Digest]
+		if !found {
+			return "", fmt.Errorf("blob %s is not in %q", layer.Digest, src)
+		}
+		if err := ps.PushBlob(layer, path); err != nil {
+			return "", err
+		}
+	}
+	return dgst, ps.PushManifest("", mediaType, manifest)
+}
+
+// layoutManifest returns the media type and the content of the image manifest in the OCI
+// image layout in the passed directory, and a map of blob digests to the files in the
+// layout. The layout's 'index.json' must reference exactly one manifest.
+func layoutManifest(dir string) (string, []byte, map[string]string, error) {
+	b, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return "", nil, nil, err
+	}
+	idx := v1oci.Index{}
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return "", nil, nil, fmt.Errorf("invalid index.json: %w", err)
+	}
+	if len(idx.Manifests) != 1 {
+		return "", nil, nil, fmt.Errorf("index.json has %d manifests, expected one", len(idx.Manifests))
+	}
+	blobPath := func(dgst string) (string, error) {
+		d, err := digest.Parse(dgst)
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(dir, "blobs", d.Algorithm().String(), d.Encoded()), nil
+	}
+	desc := idx.Manifests[0]
+	path, err := blobPath(desc.Digest)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	manifest, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	m := v1oci.Manifest{}
+	if err := json.Unmarshal(manifest, &m); err != nil {
+		return "", nil, nil, fmt.Errorf("invalid image manifest: %w", err)
+	}
+	blobs := map[string]string{}
+	for _, d := range append(m.Layers, m.Config) {
+		if blobs[d.Digest], err = blobPath(d.Digest); err != nil {
+			return "", nil, nil, err
+		}
+	}
+	return desc.MediaType, manifest, blobs, nil
+}
+
+// dockerSaveManifest creates an OCI image manifest for the image in the 'docker save'
+// tarball extracted into the passed directory, from the config and layer files in its
+// 'manifest.json'. The layer media types are from the compression of each layer file. The
+// function returns the media type and the content of the manifest, and a map of blob
+// digests to the files in the directory.
+func dockerSaveManifest(dir string) (string, []byte, map[string]string, error) {
+	b, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return "", nil, nil, err
+	}
+	dtms := []struct {
+		Config string
+		Layers []string
+	}{}
+	if err := json.Unmarshal(b, &dtms); err != nil {
+		return "", nil, nil, fmt.Errorf("invalid manifest.json: %w", err)
+	}
+	if len(dtms) != 1 {
+		return "", nil, nil, fmt.Errorf("manifest.json has %d images, expected one", len(dtms))
+	}
+	blobs := map[string]string{}
+	descriptorFor := func(name string, mediaType string) (v1oci.Descriptor, error) {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if !filepath.IsLocal(filepath.FromSlash(name)) {
+			return v1oci.Descriptor{}, fmt.Errorf("invalid path %q in manifest.json", name)
+		}
+		sum, size, err := fileDigest(path)
+		if err != nil {
+			return v1oci.Descriptor{}, err
+		}
+		if mediaType == "" {
+			if mediaType, err = layerMediaType(path); err != nil {
+				return v1oci.Descriptor{}, err
+			}
+		}
+		d := v1oci.Descriptor{MediaType: mediaType, Digest: "sha256:" + hex.EncodeToString(sum), Size: size}
+		blobs[d.Digest] = path
+		return d, nil
+	}
+	m := v1oci.Manifest{
+		SchemaVersion: 2,
+		MediaType:     string(types.V1ociManifestMt),
+	}
+	if m.Config, err = descriptorFor(dtms[0].Config, ociConfigMt); err != nil {
+		return "", nil, nil, err
+	}
+	for _, layer := range dtms[0].Layers {
+		d, err := descriptorFor(layer, "")
+		if err != nil {
+			return "", nil, nil, err
+		}
+		m.Layers = append(m.Layers, d)
+	}
+	manifest, err := json.Marshal(m)
+	return m.MediaType, manifest, blobs, err
+}
+
+// layerMediaType returns the OCI layer media type for the passed layer file from the
+// magic number of its compression, if it is compressed.
+func layerMediaType(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return string(types.V1ociLayerGzipMt), nil
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return string(types.V1ociLayerZstdMt), nil
+	}
+	return string(types.V1ociLayerMt), nil
+}
@@ -0,0 +1,73 @@
+package imgpull
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/aceeric/imgpull/internal/testhelpers"
+	"github.com/aceeric/imgpull/mock"
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// TestPushTar pushes an OCI image layout directory, a tarball with the OCI image
+// layout, and a 'docker save' tarball to an in-memory registry. The first two keep
+// the digest of the pulled image, and the last gets a new OCI image manifest.
+func TestPushTar(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	pr, pushServer, pushUrl := testhelpers.NewPushRegistry()
+	defer pushServer.Close()
+
+	const imageDigest = "sha256:e2fc4e5012d16e7fe466f5291c476431beaa1f9b90a5c2125b493ed28e2aba57"
+	dir := t.TempDir()
+	for _, ociLayout := range []bool{true, false} {
+		p, err := NewPullerWith(PullerOpts{
+			Url:       fmt.Sprintf("%s/hello-world:latest", url),
+			Scheme:    "http",
+			OStype:    "linux",
+			ArchType:  "amd64",
+			OCILayout: ociLayout,
+		})
+		if err != nil {
+			t.FailNow()
+		}
+		tarFile := filepath.Join(dir, fmt.Sprintf("hello-world-%t.tar", ociLayout))
+		if _, err := p.PullTar(tarFile); err != nil {
+			t.FailNow()
+		}
+		dgst, err := PushTar(tarFile, PullerOpts{Url: fmt.Sprintf("%s/hello-world:%t", pushUrl, ociLayout), Scheme: "http"})
+		if err != nil || (dgst == imageDigest) != ociLayout {
+			t.FailNow()
+		}
+		b, mt, found := pr.Manifest("hello-world", fmt.Sprint(ociLayout))
+		if !found || mt != string(types.V1ociManifestMt) || digest.FromBytes(b).String() != dgst {
+			t.FailNow()
+		}
+		if ociLayout {
+			layoutDir := filepath.Join(dir, "layout")
+			if _, err := p.PullLayout(layoutDir); err != nil {
+				t.FailNow()
+			}
+			dgst, err := PushTar(layoutDir, PullerOpts{Url: fmt.Sprintf("%s/from-layout:latest", pushUrl), Scheme: "http"})
+			if err != nil || dgst != imageDigest {
+				t.FailNow()
+			}
+		}
+	}
+	for _, blob := range []string{
+		"sha256:c1ec31eb59444d78df06a974d155e597c894ab4cda84f08294145e845394988e",
+		"sha256:d2c94e258dcb3c5ac2798d32e1249e42ef01cba4841c2234249495f87264ac5a",
+	} {
+		for _, repo := range []string{"hello-world", "from-layout"} {
+			if _, found := pr.Blob(repo, blob); !found {
+				t.Fail()
+			}
+		}
+	}
+	if _, err := PushTar(filepath.Join(dir, "missing.tar"), PullerOpts{Url: fmt.Sprintf("%s/hello-world:latest", pushUrl)}); err == nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,27 @@
+package imgpull
+
+import (
+	"errors"
+	"net/http"
+)
+
+// maxRedirects is the most redirects that are followed for one request. It is the same
+// as the default of the net/http client.
+const maxRedirects = 10
+
+// checkRedirect is the redirect policy of the puller's HTTP client. Registries commonly
+// redirect blob requests to external storage (e.g. S3 or GCS) using a pre-signed URL,
+// which is followed as-is. If a redirect goes to a different host (or port) than the
+// original request then the Authorization header is removed: the registry credentials
+// are not for the other host, and some storage services reject requests that have both
+// a pre-signed URL and an Authorization header. The net/http client only removes the
+// header when the host name changes, not the port or a subdomain.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return errors.New("stopped after 10 redirects")
+	}
+	if req.URL.Host != via[0].URL.Host {
+		req.Header.Del("Authorization")
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package imgpull
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/aceeric/imgpull/mock"
+)
+
+// Tests that the Authorization header is only kept on redirects to the same host.
+func TestCheckRedirect(t *testing.T) {
+	orig, _ := http.NewRequest(http.MethodGet, "http://localhost:5000/v2/foo/blobs/sha256:abc", nil)
+	for _, tc := range []struct {
+		url      string
+		stripped bool
+	}{
+		{"http://localhost:5000/other/path", false},
+		{"http://localhost:5001/storage?sig=x", true},
+		{"https://s3.amazonaws.com/bucket/blob?X-Amz-Signature=x", true},
+		{"http://cdn.localhost:5000/blob", true},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, tc.url, nil)
+		req.Header.Set("Authorization", "Bearer FROBOZZ")
+		if checkRedirect(req, []*http.Request{orig}) != nil {
+			t.Fail()
+		}
+		if (req.Header.Get("Authorization") == "") != tc.stripped {
+			t.Fail()
+		}
+	}
+	via := make([]*http.Request, maxRedirects)
+	for i := range via {
+		via[i] = orig
+	}
+	if checkRedirect(orig, via) == nil {
+		t.Fail()
+	}
+}
+
+// Tests pulling blobs that the registry redirects to external storage with pre-signed
+// URLs. The storage server is on the same host name as the registry but a different port,
+// and rejects requests with an Authorization header, like S3.
+func TestBlobRedirect(t *testing.T) {
+	reg := mock.NewHelloWorldRegistry()
+	server, url := mock.ServerWith(mock.NewMockParams(mock.BASIC, mock.NOTLS, mock.CertSetup{}), reg)
+	defer server.Close()
+	storage, storageUrl := mock.StorageServer(reg)
+	defer storage.Close()
+	reg.RedirectBlobs(storageUrl)
+
+	opts := NewPullerOpts(fmt.Sprintf("%s/hello-world:latest", url))
+	opts.Scheme, opts.OStype, opts.ArchType = "http", "linux", "amd64"
+	opts.Username, opts.Password = "foo", "bar"
+	opts.VerifyDiffIDs = true
+	p, err := NewPullerWith(opts)
+	if err != nil {
+		t.FailNow()
+	}
+	mh, err := p.GetManifestByType(Image)
+	if err != nil {
+		t.FailNow()
+	}
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+	if _, err := p.PullBlobs(mh, d); err != nil {
+		t.Fail()
+	}
+}
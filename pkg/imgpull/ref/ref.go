@@ -0,0 +1,91 @@
+// Package ref parses, validates, and manipulates image references like
+// docker.io/hello-world:latest so that library consumers can normalize
+// references the same way the puller does.
+package ref
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aceeric/imgpull/internal/imgref"
+)
+
+// Reference has the components of a parsed image reference. A reference is either
+// by tag or by digest, so exactly one of Tag and Digest is non-empty.
+type Reference struct {
+	// Registry is the registry hostname and optional port, e.g. 'quay.io' or 'localhost:8080'.
+	// The DockerHub API hosts like 'index.docker.io' are normalized to 'docker.io'.
+	Registry string
+	// Namespace is the namespace if the reference was provided with the namespace in the
+	// path for a mirror or pull-through registry like 'localhost:8080/docker.io/hello-world'.
+	Namespace string
+	// Repository is the repository as it is used in upstream API calls, e.g. 'library/hello-world'
+	// for 'docker.io/hello-world'.
+	Repository string
+	// Tag is the tag, or the empty string if the reference is by digest.
+	Tag string
+	// Digest is the digest like 'sha256:abc...', or the empty string if the reference is by tag.
+	Digest string
+}
+
+// Parse parses and validates the passed image reference like 'docker.io/hello-world:latest'
+// against the distribution reference grammar. The reference must begin with a registry hostname.
+// If the reference has neither a tag nor a digest then the tag is 'latest'. If it has both then
+// the tag is ignored. An error is returned describing the first invalid component found.
+func Parse(url string) (Reference, error) {
+	ir, err := imgref.NewImageRef(url, "", "")
+	if err != nil {
+		return Reference{}, err
+	}
+	r := Reference{
+		Registry:   ir.Registry(),
+		Repository: ir.Repository(),
+	}
+	if ir.NsInPath() {
+		r.Namespace = ir.Namespace()
+	}
+	if ir.ByDigest() {
+		r.Digest = ir.Ref()
+	} else {
+		r.Tag = ir.Ref()
+	}
+	return r, nil
+}
+
+// String returns the normalized reference in the receiver, e.g. 'docker.io/library/hello-world:latest'.
+// The result can always be passed back to 'Parse'.
+func (r Reference) String() string {
+	name := r.Registry
+	if r.Namespace != "" {
+		name += "/" + r.Namespace
+	}
+	name += "/" + r.Repository
+	if r.Digest != "" {
+		return name + "@" + r.Digest
+	}
+	return name + ":" + r.Tag
+}
+
+// WithTag returns a copy of the receiver referencing the passed tag rather than the tag
+// or digest in the receiver. An error is returned if the tag is invalid.
+func (r Reference) WithTag(tag string) (Reference, error) {
+	r.Tag = tag
+	r.Digest = ""
+	return Parse(r.String())
+}
+
+// WithDigest returns a copy of the receiver referencing the passed digest rather than the
+// tag or digest in the receiver. The digest can be like 'sha256:abc...' or just the hex
+// part in which case sha256 is assumed. An error is returned if the digest is invalid.
+func (r Reference) WithDigest(digest string) (Reference, error) {
+	if !strings.Contains(digest, ":") {
+		digest = "sha256:" + digest
+	}
+	r.Tag = ""
+	r.Digest = digest
+	if nr, err := Parse(r.String()); err != nil {
+		return Reference{}, fmt.Errorf("unable to set digest %q: %w", digest, err)
+	} else {
+		return nr, nil
+	}
+}
@@ -0,0 +1,72 @@
+package ref
+
+import (
+	"strings"
+	"testing"
+)
+
+// the digest matcher in the url parser needs a 64-position digest
+var dgst = "sha256:" + strings.Repeat("a", 64)
+
+func TestParse(t *testing.T) {
+	for _, tst := range []struct {
+		url       string
+		shouldErr bool
+		expected  Reference
+		str       string
+	}{
+		{"docker.io/hello-world", false, Reference{Registry: "docker.io", Repository: "library/hello-world", Tag: "latest"}, "docker.io/library/hello-world:latest"},
+		{"quay.io/foo/bar:v1.2.3", false, Reference{Registry: "quay.io", Repository: "foo/bar", Tag: "v1.2.3"}, "quay.io/foo/bar:v1.2.3"},
+		{"localhost:8080/docker.io/foo/bar@" + dgst, false, Reference{Registry: "localhost:8080", Namespace: "docker.io", Repository: "foo/bar", Digest: dgst}, "localhost:8080/docker.io/foo/bar@" + dgst},
+		{"quay.io/foo/bar:v1@" + dgst, false, Reference{Registry: "quay.io", Repository: "foo/bar", Digest: dgst}, "quay.io/foo/bar@" + dgst},
+		{"[::1]:5000/foo/bar:v1", false, Reference{Registry: "[::1]:5000", Repository: "foo/bar", Tag: "v1"}, "[::1]:5000/foo/bar:v1"},
+		{"localhost:8080/[2001:db8::1]/foo@" + dgst, false, Reference{Registry: "localhost:8080", Namespace: "[2001:db8::1]", Repository: "foo", Digest: dgst}, "localhost:8080/[2001:db8::1]/foo@" + dgst},
+		{"[::1:5000/foo", true, Reference{}, ""},
+		{"localhost:70000/foo", true, Reference{}, ""},
+		{"hello-world", true, Reference{}, ""},
+		{"quay.io/Foo/bar", true, Reference{}, ""},
+	} {
+		r, err := Parse(tst.url)
+		if (err != nil) != tst.shouldErr {
+			t.FailNow()
+		}
+		if r != tst.expected {
+			t.FailNow()
+		}
+		if err != nil {
+			continue
+		}
+		if r.String() != tst.str {
+			t.FailNow()
+		}
+		// String must round-trip
+		if again, err := Parse(r.String()); err != nil || again != r {
+			t.FailNow()
+		}
+	}
+}
+
+func TestWithTagAndDigest(t *testing.T) {
+	r, err := Parse("quay.io/foo/bar:v1")
+	if err != nil {
+		t.FailNow()
+	}
+	byDigest, err := r.WithDigest(strings.Repeat("a", 64))
+	if err != nil || byDigest.String() != "quay.io/foo/bar@"+dgst || byDigest.Tag != "" {
+		t.FailNow()
+	}
+	byTag, err := byDigest.WithTag("v2")
+	if err != nil || byTag.String() != "quay.io/foo/bar:v2" || byTag.Digest != "" {
+		t.FailNow()
+	}
+	// receiver is unchanged
+	if r.Tag != "v1" {
+		t.FailNow()
+	}
+	if _, err := r.WithTag("-bad"); err == nil {
+		t.FailNow()
+	}
+	if _, err := r.WithDigest("sha256:xyz"); err == nil {
+		t.FailNow()
+	}
+}
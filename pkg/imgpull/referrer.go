@@ -0,0 +1,49 @@
+package imgpull
+
+import (
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+	"github.com/aceeric/imgpull/pkg/imgpull/v1oci"
+)
+
+// Subject returns the subject descriptor of the manifest in the receiver. The subject
+// links a referrer artifact (e.g. a signature or an SBOM) to the manifest it refers
+// to. Only OCI manifests, indexes, and artifact manifests have a subject. If the
+// manifest has no subject then nil is returned.
+func (mh *ManifestHolder) Subject() *v1oci.Descriptor {
+	switch mh.Type {
+	case V1ociManifest:
+		return mh.V1ociManifest.Subject
+	case V1ociIndex:
+		return mh.V1ociIndex.Subject
+	case V1ociArtifactManifest:
+		return mh.V1ociArtifactManifest.Subject
+	}
+	return nil
+}
+
+// ArtifactType returns the artifact type of the manifest in the receiver. As with the
+// OCI referrers API, if an OCI image manifest has no 'artifactType' then the media
+// type of its config is the artifact type - unless the config is the OCI empty
+// descriptor. The empty string is returned for manifests that don't have an artifact
+// type.
+func (mh *ManifestHolder) ArtifactType() string {
+	switch mh.Type {
+	case V1ociManifest:
+		if mh.V1ociManifest.ArtifactType != "" {
+			return mh.V1ociManifest.ArtifactType
+		} else if mh.V1ociManifest.Config.MediaType != string(types.V1ociEmptyMt) {
+			return mh.V1ociManifest.Config.MediaType
+		}
+	case V1ociIndex:
+		return mh.V1ociIndex.ArtifactType
+	case V1ociArtifactManifest:
+		return mh.V1ociArtifactManifest.ArtifactType
+	}
+	return ""
+}
+
+// IsReferrer returns true if the manifest in the receiver refers to another manifest
+// through its subject, i.e. it is an artifact attached to an image.
+func (mh *ManifestHolder) IsReferrer() bool {
+	return mh.Subject() != nil
+}
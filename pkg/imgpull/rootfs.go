@@ -0,0 +1,201 @@
+package imgpull
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/aceeric/imgpull/internal/rootfs"
+	"github.com/aceeric/imgpull/internal/util"
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+)
+
+// ExtractRootfs applies the layers of the image manifest in the passed ManifestHolder
+// in order into the 'destDir' directory to produce the flattened root filesystem of the
+// image. The layer blobs must already be in 'blobDir' (e.g. from a call to 'PullBlobs'.)
+// Whiteouts in each layer delete the corresponding content from the layers below it.
+// Layers can be uncompressed, gzip, or zstd compressed, and the digest of each
+// uncompressed layer is verified against the 'rootfs.diff_ids' in the image config
+// which must also be in 'blobDir'.
+func ExtractRootfs(mh ManifestHolder, blobDir string, destDir string) error {
+	layers, err := rootfsLayersFor(mh, blobDir)
+	if err != nil {
+		return err
+	}
+	return rootfs.ApplyLayers(layers, destDir)
+}
+
+// FlattenTar is like ExtractRootfs except that the flattened root filesystem is
+// written as a single uncompressed tarball to 'dest'.
+func FlattenTar(mh ManifestHolder, blobDir string, dest string) error {
+	layers, err := rootfsLayersFor(mh, blobDir)
+	if err != nil {
+		return err
+	}
+	return rootfs.FlattenToTar(layers, dest)
+}
+
+// ExtractLayer is like ExtractRootfs except that only the one layer selected by 'layer'
+// is applied into 'destDir', to see what that layer adds to the image. The 'layer' arg is
+// either the digest of the layer or its position counting from 1 for the bottom layer.
+// Only the selected layer and the image config have to be in 'blobDir'.
+func ExtractLayer(mh ManifestHolder, blobDir string, layer string, destDir string) error {
+	i, err := layerIndex(mh, layer)
+	if err != nil {
+		return err
+	}
+	layers, err := rootfsLayersFor(mh, blobDir)
+	if err != nil {
+		return err
+	}
+	return rootfs.ApplyLayers(layers[i:i+1], destDir)
+}
+
+func (p *puller) PullRootfs(destDir string) error {
+	return p.pullAndFlatten(destDir, rootfs.ApplyLayers)
+}
+
+func (p *puller) PullFlatTar(dest string) error {
+	return p.pullAndFlatten(dest, func(layers []rootfs.Layer, dest string) error {
+		if err := rootfs.FlattenToTar(layers, dest); err != nil {
+			return err
+		}
+		return p.Opts.finishFile(dest)
+	})
+}
+
+func (p *puller) PullLayer(layer string, destDir string) (err error) {
+	if destDir == "" {
+		return fmt.Errorf("no destination specified for pull of %q", p.Opts.Url)
+	}
+	finished := p.pullStarted()
+	defer func() { finished(err) }()
+	if err := p.checkRef(); err != nil {
+		return err
+	}
+	if err := p.connect(); err != nil {
+		return err
+	}
+	mh, list, err := p.resolveImage(p.regCliFrom())
+	if err != nil {
+		return err
+	}
+	if err := p.prePull(mh, list); err != nil {
+		return err
+	}
+	i, err := layerIndex(mh, layer)
+	if err != nil {
+		return err
+	}
+	digest := mh.Layers()[i].Digest
+	tmpDir, err := p.Opts.newWorkDir()
+	if err != nil {
+		return err
+	}
+	defer func() { err = removeWorkDir(tmpDir, err) }()
+	if _, err := p.pullBlobs(mh, tmpDir, func(l types.Layer, isConfig bool) bool {
+		return isConfig || l.Digest == digest
+	}); err != nil {
+		return err
+	}
+	return ExtractLayer(mh, tmpDir, layer, destDir)
+}
+
+// pullAndFlatten pulls the image in the receiver to a temp directory and then calls the
+// passed 'flatten' function with the layers of the image and the passed 'dest'.
+func (p *puller) pullAndFlatten(dest string, flatten func([]rootfs.Layer, string) error) (err error) {
+	if dest == "" {
+		return fmt.Errorf("no destination specified for pull of %q", p.Opts.Url)
+	}
+	finished := p.pullStarted()
+	defer func() { finished(err) }()
+	tmpDir, err := p.Opts.newWorkDir()
+	if err != nil {
+		return err
+	}
+	defer func() { err = removeWorkDir(tmpDir, err) }()
+	itb, _, err := p.pull(context.Background(), tmpDir, &PullStats{})
+	if err != nil {
+		return err
+	}
+	layers, err := rootfsLayers(itb.Layers, filepath.Join(tmpDir, itb.ConfigDigest), tmpDir)
+	if err != nil {
+		return err
+	}
+	return flatten(layers, dest)
+}
+
+// rootfsLayersFor returns the layers to flatten for the image manifest in the passed
+// ManifestHolder, from the base layer to the top layer, with the blobs in 'blobDir'.
+func rootfsLayersFor(mh ManifestHolder, blobDir string) ([]rootfs.Layer, error) {
+	layers := mh.Layers()
+	if mh.Type == V1dockerManifest {
+		// schema 1 has no config and so no diff_ids to verify
+		return rootfsLayers(layers, "", blobDir)
+	} else if !mh.hasConfig() {
+		return nil, fmt.Errorf("can't extract layers from %q kind of manifest", manifestTypeToString[mh.Type])
+	}
+	// the config blob is the last element
+	config := layers[len(layers)-1]
+	return rootfsLayers(layers[:len(layers)-1], filepath.Join(blobDir, util.DigestFrom(config.Digest)), blobDir)
+}
+
+// layerIndex returns the index in the layers of the image manifest in the passed
+// ManifestHolder of the layer selected by 'layer', which is either the digest of the
+// layer or its position counting from 1 for the bottom layer.
+func layerIndex(mh ManifestHolder, layer string) (int, error) {
+	layers := mh.Layers()
+	if mh.hasConfig() {
+		layers = layers[:len(layers)-1]
+	}
+	if n, err := strconv.Atoi(layer); err == nil {
+		if n < 1 || n > len(layers) {
+			return 0, fmt.Errorf("layer %d is out of range for an image with %d layers", n, len(layers))
+		}
+		return n - 1, nil
+	}
+	for i, l := range layers {
+		if l.Digest == layer {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("image has no layer %q", layer)
+}
+
+// rootfsLayers pairs the passed layers in 'blobDir' with the diff_ids from the passed
+// image config file. If there is no config file, or the config has no diff_ids, then the
+// layers are not verified.
+func rootfsLayers(layers []types.Layer, configFile string, blobDir string) ([]rootfs.Layer, error) {
+	config := struct {
+		Rootfs struct {
+			DiffIds []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}{}
+	if configFile != "" {
+		b, err := os.ReadFile(configFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &config); err != nil {
+			return nil, fmt.Errorf("unable to parse image config %q: %w", filepath.Base(configFile), err)
+		}
+	}
+	diffIds := config.Rootfs.DiffIds
+	if len(diffIds) != 0 && len(diffIds) != len(layers) {
+		return nil, fmt.Errorf("image config has %d diff_ids but the manifest has %d layers", len(diffIds), len(layers))
+	}
+	rl := make([]rootfs.Layer, len(layers))
+	for i, layer := range layers {
+		if layer.MediaType.IsEncrypted() {
+			return nil, fmt.Errorf("layer %s is encrypted and must be decrypted with a decryption key", layer.Digest)
+		}
+		rl[i].File = filepath.Join(blobDir, util.DigestFrom(layer.Digest))
+		if len(diffIds) != 0 {
+			rl[i].DiffID = diffIds[i]
+		}
+	}
+	return rl, nil
+}
@@ -0,0 +1,82 @@
+package imgpull
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aceeric/imgpull/internal/rootfs"
+	"github.com/aceeric/imgpull/internal/util"
+	"github.com/aceeric/imgpull/pkg/imgpull/v1docker"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// schema1Throwaway returns true if the passed schema 1 history entry is for an empty
+// layer that is not part of the image file system.
+func schema1Throwaway(h v1docker.History) bool {
+	v1c := v1docker.V1Compatibility{}
+	if err := json.Unmarshal([]byte(h.V1Compatibility), &v1c); err != nil {
+		return false
+	}
+	return v1c.Throwaway
+}
+
+// schema1Config builds an image config for the schema 1 manifest in the receiver, which
+// doesn't have one, and writes it into 'blobDir' by its digest. The layers of the manifest
+// must already be in 'blobDir' since the diff_ids in the config are computed from them. The
+// config is the legacy image config of the top layer with the legacy ids removed, plus the
+// 'rootfs' and 'history' from all the layers. The function returns the bare digest of the
+// config.
+func (mh *ManifestHolder) schema1Config(blobDir string) (string, error) {
+	m := mh.V1dockerManifest
+	if len(m.History) == 0 || len(m.History) != len(m.FSLayers) {
+		return "", fmt.Errorf("schema 1 manifest for %q has %d layers and %d history entries", mh.ImageUrl, len(m.FSLayers), len(m.History))
+	}
+	config := map[string]any{}
+	if err := json.Unmarshal([]byte(m.History[0].V1Compatibility), &config); err != nil {
+		return "", fmt.Errorf("invalid schema 1 history for %q: %w", mh.ImageUrl, err)
+	}
+	for _, key := range []string{"id", "parent", "Size", "parent_id", "layer_id", "throwaway"} {
+		delete(config, key)
+	}
+	diffIds := []string{}
+	for _, layer := range mh.Layers() {
+		diffId, err := rootfs.DiffID(filepath.Join(blobDir, util.DigestFrom(layer.Digest)))
+		if err != nil {
+			return "", err
+		}
+		diffIds = append(diffIds, diffId)
+	}
+	history := []map[string]any{}
+	for i := len(m.History) - 1; i >= 0; i-- {
+		v1c := v1docker.V1Compatibility{}
+		if err := json.Unmarshal([]byte(m.History[i].V1Compatibility), &v1c); err != nil {
+			return "", fmt.Errorf("invalid schema 1 history for %q: %w", mh.ImageUrl, err)
+		}
+		h := map[string]any{
+			"created":    v1c.Created,
+			"created_by": strings.Join(v1c.ContainerConfig.Cmd, " "),
+		}
+		if v1c.Author != "" {
+			h["author"] = v1c.Author
+		}
+		if v1c.Comment != "" {
+			h["comment"] = v1c.Comment
+		}
+		if v1c.Throwaway {
+			h["empty_layer"] = true
+		}
+		history = append(history, h)
+	}
+	config["rootfs"] = map[string]any{"type": "layers", "diff_ids": diffIds}
+	config["history"] = history
+	b, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	configDigest := digest.FromBytes(b).Hex()
+	return configDigest, os.WriteFile(filepath.Join(blobDir, configDigest), b, 0644)
+}
@@ -0,0 +1,115 @@
+package imgpull
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aceeric/imgpull/internal/tar"
+	"github.com/aceeric/imgpull/internal/testhelpers"
+	"github.com/aceeric/imgpull/pkg/imgpull/v1docker"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// schema1Registry starts a registry serving a schema 1 manifest for 'hello:v1' with two
+// layers and an empty throwaway layer between them.
+func schema1Registry(t *testing.T) (*testhelpers.PushRegistry, func(), string) {
+	pr, server, url := testhelpers.NewPushRegistry()
+	base := testhelpers.MakeLayer(map[string]string{"etc/os-release": "frobozz"})
+	empty := testhelpers.MakeLayer(map[string]string{})
+	top := testhelpers.MakeLayer(map[string]string{"hello": "hello world"})
+	pr.Blobs["hello"] = map[string][]byte{}
+	for _, b := range [][]byte{base, empty, top} {
+		pr.Blobs["hello"][digest.FromBytes(b).String()] = b
+	}
+	m := v1docker.Manifest{
+		SchemaVersion: 1,
+		Name:          "hello",
+		Tag:           "v1",
+		Architecture:  "amd64",
+		FSLayers: []v1docker.FSLayer{
+			{BlobSum: digest.FromBytes(top).String()},
+			{BlobSum: digest.FromBytes(empty).String()},
+			{BlobSum: digest.FromBytes(base).String()},
+		},
+		History: []v1docker.History{
+			{V1Compatibility: `{"id":"c","parent":"b","architecture":"amd64","os":"linux","config":{"Cmd":["/hello"]},"created":"2020-01-03T00:00:00Z","container_config":{"Cmd":["/bin/sh","-c","#(nop) COPY hello /"]}}`},
+			{V1Compatibility: `{"id":"b","parent":"a","created":"2020-01-02T00:00:00Z","container_config":{"Cmd":["/bin/sh","-c","#(nop) ENV FOO=bar"]},"throwaway":true}`},
+			{V1Compatibility: `{"id":"a","created":"2020-01-01T00:00:00Z","container_config":{"Cmd":["/bin/sh","-c","#(nop) ADD os-release /etc"]}}`},
+		},
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.FailNow()
+	}
+	pr.Manifests["hello"] = map[string][]byte{"v1": b}
+	pr.MediaTypes["hello"] = map[string]string{"v1": "application/vnd.docker.distribution.manifest.v1+json"}
+	return pr, server.Close, url
+}
+
+func TestSchema1PullTar(t *testing.T) {
+	_, closer, url := schema1Registry(t)
+	defer closer()
+	p, err := NewPullerWith(PullerOpts{
+		Url:      fmt.Sprintf("%s/hello:v1", url),
+		OStype:   "linux",
+		ArchType: "amd64",
+		Scheme:   "http",
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	mh, err := p.GetManifest()
+	if err != nil || mh.Type != V1dockerManifest || len(mh.Layers()) != 2 {
+		t.FailNow()
+	}
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+	tarball := filepath.Join(d, "test.tar")
+	if _, err := p.PullTar(tarball); err != nil {
+		t.FailNow()
+	}
+	if testhelpers.UntarFile(tarball) != nil {
+		t.FailNow()
+	}
+	b, err := os.ReadFile(filepath.Join(d, "manifest.json.extracted"))
+	if err != nil {
+		t.FailNow()
+	}
+	dtm := []tar.DockerTarManifest{}
+	if json.Unmarshal(b, &dtm) != nil || len(dtm) != 1 || len(dtm[0].Layers) != 2 {
+		t.FailNow()
+	}
+	b, err = os.ReadFile(filepath.Join(d, dtm[0].Config+".extracted"))
+	if err != nil {
+		t.FailNow()
+	}
+	config := struct {
+		Os     string `json:"os"`
+		Id     string `json:"id"`
+		Rootfs struct {
+			DiffIds []string `json:"diff_ids"`
+		} `json:"rootfs"`
+		History []map[string]any `json:"history"`
+	}{}
+	if json.Unmarshal(b, &config) != nil {
+		t.FailNow()
+	}
+	if config.Os != "linux" || config.Id != "" || len(config.Rootfs.DiffIds) != 2 || len(config.History) != 3 {
+		t.Fail()
+	}
+	if config.History[1]["empty_layer"] != true || config.History[0]["created_by"] != "/bin/sh -c #(nop) ADD os-release /etc" {
+		t.Fail()
+	}
+	if err := p.PullRootfs(filepath.Join(d, "rootfs")); err != nil {
+		t.FailNow()
+	}
+	for _, file := range []string{"hello", "etc/os-release"} {
+		if _, err := os.Stat(filepath.Join(d, "rootfs", file)); err != nil {
+			t.Fail()
+		}
+	}
+}
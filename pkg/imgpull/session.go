@@ -0,0 +1,93 @@
+package imgpull
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/aceeric/imgpull/internal/imgref"
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+)
+
+// RegistrySession holds the HTTP client and the auth negotiated with one registry so
+// that it can be shared by many Pullers (and Pushers) for images in that registry, for
+// example when mirroring many images. Sharing the session means sharing the connection
+// pool, so TLS handshakes are not repeated for each image, and each repository is only
+// authenticated once. A session is safe for concurrent use by multiple Pullers.
+type RegistrySession struct {
+	registry string
+	client   *http.Client
+	mu       sync.Mutex
+	auth     map[sessionKey]sessionAuth
+}
+
+// sessionKey identifies auth in a session. Bearer tokens are scoped to a repository
+// and the requested actions, so auth is shared per repository and actions.
+type sessionKey struct {
+	repository string
+	actions    string
+}
+
+// sessionAuth is the auth negotiated by a puller, as well as the scheme and server since
+// the puller may have fallen back to http for an insecure registry, or to another DockerHub
+// API host.
+type sessionAuth struct {
+	scheme   string
+	server   string
+	token    types.BearerToken
+	basic    types.BasicAuth
+	extToken types.ExtToken
+}
+
+// NewRegistrySession creates a session for the passed registry like 'quay.io' or
+// 'localhost:8080'. DockerHub API hosts like 'index.docker.io' are the same registry as
+// 'docker.io'. The transport is configured from the TLS, dial, and connection
+// options in the passed PullerOpts exactly as 'NewPullerWith' would configure it.
+// The Url in the options is ignored. Pullers use the session when it is set in the
+// 'Session' field of their PullerOpts.
+func NewRegistrySession(registry string, o PullerOpts) (*RegistrySession, error) {
+	if registry == "" {
+		return nil, fmt.Errorf("registry is undefined")
+	}
+	registry = imgref.NormalizeRegistry(registry)
+	if o.Config != nil {
+		var err error
+		if o, err = o.applyConfig(registry); err != nil {
+			return nil, err
+		}
+	}
+	c, err := o.newClient(registry)
+	if err != nil {
+		return nil, err
+	}
+	return &RegistrySession{
+		registry: registry,
+		client:   c,
+		auth:     map[sessionKey]sessionAuth{},
+	}, nil
+}
+
+// Registry returns the registry of the session.
+func (s *RegistrySession) Registry() string {
+	return s.registry
+}
+
+// Close closes the idle connections of the session.
+func (s *RegistrySession) Close() {
+	s.client.CloseIdleConnections()
+}
+
+// getAuth returns the auth previously saved in the session for the passed key.
+func (s *RegistrySession) getAuth(key sessionKey) (sessionAuth, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sa, found := s.auth[key]
+	return sa, found
+}
+
+// setAuth saves auth in the session for the passed key.
+func (s *RegistrySession) setAuth(key sessionKey, sa sessionAuth) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.auth[key] = sa
+}
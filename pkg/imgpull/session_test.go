@@ -0,0 +1,79 @@
+package imgpull
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/aceeric/imgpull/mock"
+)
+
+// pathCountingTransport counts round trips by URL path.
+type pathCountingTransport struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (ct *pathCountingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ct.mu.Lock()
+	ct.counts[r.URL.Path]++
+	ct.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// Tests that pullers sharing a session share the client and only authenticate once.
+func TestRegistrySession(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.BEARER, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	rt := &pathCountingTransport{counts: map[string]int{}}
+	s, err := NewRegistrySession(url, PullerOpts{Transport: rt})
+	if err != nil {
+		t.FailNow()
+	}
+	defer s.Close()
+	opts := PullerOpts{
+		Url:      fmt.Sprintf("%s/hello-world:latest", url),
+		Scheme:   "http",
+		OStype:   "linux",
+		ArchType: "amd64",
+		Session:  s,
+	}
+	var wg sync.WaitGroup
+	for range 2 {
+		p, err := NewPullerWith(opts)
+		if err != nil {
+			t.FailNow()
+		}
+		if p.(*puller).Client != s.client {
+			t.FailNow()
+		}
+		if _, err := p.GetManifestByType(Image); err != nil {
+			t.FailNow()
+		}
+		p.Close()
+	}
+	// concurrent pullers in the session
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p, err := NewPullerWith(opts)
+			if err != nil {
+				t.Fail()
+				return
+			}
+			if _, err := p.GetManifestByType(Image); err != nil {
+				t.Fail()
+			}
+		}()
+	}
+	wg.Wait()
+	if rt.counts["/v2/auth"] != 1 {
+		t.Fail()
+	}
+	opts.Url = "quay.io/hello-world:latest"
+	if _, err := NewPullerWith(opts); err == nil {
+		t.Fail()
+	}
+}
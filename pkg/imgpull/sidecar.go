@@ -0,0 +1,136 @@
+package imgpull
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/aceeric/imgpull/internal/tar"
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+)
+
+// SidecarType is the kind of sidecar file that 'PullTar' writes next to the tarball so that
+// downstream transfer tooling can verify the tarball.
+type SidecarType string
+
+const (
+	// NoSidecar means no sidecar file is written.
+	NoSidecar SidecarType = ""
+	// Sha256Sidecar is a '<dest>.sha256' file with the digest of the tarball in the format
+	// of 'sha256sum', so the tarball can be verified with 'sha256sum -c'.
+	Sha256Sidecar SidecarType = "sha256"
+	// JSONSidecar is a '<dest>.json' file with a 'TarballDescriptor' for the tarball.
+	JSONSidecar SidecarType = "json"
+)
+
+// TarballDescriptor describes an image tarball written by 'PullTar'. It is the content of
+// the JSON sidecar file.
+type TarballDescriptor struct {
+	// Tarball is the file name of the tarball, without the directory.
+	Tarball string `json:"tarball"`
+	// Digest is the digest of the tarball, like 'sha256:abc...'.
+	Digest string `json:"digest"`
+	// Size is the size of the tarball in bytes.
+	Size int64 `json:"size"`
+	// Image is the url of the image that was pulled.
+	Image string `json:"image"`
+	// ImageDigest is the digest of the image manifest.
+	ImageDigest string `json:"imageDigest"`
+	// IndexDigest is the digest of the image list manifest that the image was selected
+	// from, if the image was pulled from an image list.
+	IndexDigest string `json:"indexDigest,omitempty"`
+	// ConfigDigest is the digest of the image config.
+	ConfigDigest string `json:"configDigest"`
+	// Layers are the layers of the image, from the base layer to the top layer.
+	Layers []types.Layer `json:"layers"`
+}
+
+// sidecarPath returns the path of the passed sidecar type for the passed tarball.
+func sidecarPath(dest string, sidecar SidecarType) string {
+	return dest + "." + string(sidecar)
+}
+
+// writeSidecars writes the detached signature and the sidecar file for the passed tarball
+// if the receiver options have them. The tarball was written from the passed ManifestHolder
+// and ImageTarball. If either file can't be written then neither is left behind.
+func (p *puller) writeSidecars(dest string, mh ManifestHolder, itb tar.ImageTarball, sign SignFunc) (err error) {
+	if p.Opts.Sidecar == NoSidecar && sign == nil {
+		return nil
+	}
+	sum, size, err := fileDigest(dest)
+	if err != nil {
+		return err
+	}
+	written := []string{}
+	defer func() {
+		if err != nil {
+			for _, path := range written {
+				os.Remove(path)
+			}
+		}
+	}()
+	if sign != nil {
+		sig, err := sign(sum)
+		if err != nil {
+			return fmt.Errorf("unable to sign %q, error: %w", dest, err)
+		}
+		if err := p.Opts.writeFile(signaturePath(dest), sig); err != nil {
+			return err
+		}
+		written = append(written, signaturePath(dest))
+	}
+	dgst := hex.EncodeToString(sum)
+	var b []byte
+	switch p.Opts.Sidecar {
+	case NoSidecar:
+		return nil
+	case Sha256Sidecar:
+		b = fmt.Appendf(nil, "%s  %s\n", dgst, filepath.Base(dest))
+	case JSONSidecar:
+		td := TarballDescriptor{
+			Tarball:      filepath.Base(dest),
+			Digest:       "sha256:" + dgst,
+			Size:         size,
+			Image:        p.GetUrl(),
+			ImageDigest:  "sha256:" + mh.Digest,
+			ConfigDigest: "sha256:" + itb.ConfigDigest,
+			Layers:       itb.Layers,
+		}
+		if mh.IndexDigest != "" {
+			td.IndexDigest = "sha256:" + mh.IndexDigest
+		}
+		if b, err = json.MarshalIndent(td, "", "   "); err != nil {
+			return err
+		}
+	}
+	return p.Opts.writeFile(sidecarPath(dest, p.Opts.Sidecar), b)
+}
+
+// writeFile writes the passed content to the passed path and applies the file options
+// in the receiver. If the file can't be written then it is removed.
+func (o PullerOpts) writeFile(path string, b []byte) error {
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		os.Remove(path)
+		return err
+	}
+	return o.finishFile(path)
+}
+
+// fileDigest returns the sha256 digest and the size of the passed file.
+func fileDigest(path string) ([]byte, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return nil, 0, err
+	}
+	return h.Sum(nil), size, nil
+}
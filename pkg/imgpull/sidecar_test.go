@@ -0,0 +1,74 @@
+package imgpull
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aceeric/imgpull/mock"
+)
+
+// Tests writing the sha256sum and JSON sidecar files with PullTar.
+func TestPullTarSidecar(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	d := t.TempDir()
+	for _, sidecar := range []SidecarType{Sha256Sidecar, JSONSidecar} {
+		p, err := NewPullerWith(PullerOpts{
+			Url:      fmt.Sprintf("%s/hello-world:latest", url),
+			OStype:   "linux",
+			ArchType: "amd64",
+			Scheme:   "http",
+			Sidecar:  sidecar,
+		})
+		if err != nil {
+			t.FailNow()
+		}
+		tarball := filepath.Join(d, "hello-world-"+string(sidecar)+".tar")
+		if _, err := p.PullTar(tarball); err != nil {
+			t.Fatalf("pull tar: %s", err)
+		}
+		b, err := os.ReadFile(tarball)
+		if err != nil {
+			t.FailNow()
+		}
+		sum := sha256.Sum256(b)
+		dgst := hex.EncodeToString(sum[:])
+		content, err := os.ReadFile(tarball + "." + string(sidecar))
+		if err != nil {
+			t.Fatalf("expected a %s sidecar: %s", sidecar, err)
+		}
+		if sidecar == Sha256Sidecar {
+			if string(content) != dgst+"  "+filepath.Base(tarball)+"\n" {
+				t.Errorf("unexpected sha256 sidecar %q", content)
+			}
+			continue
+		}
+		mh, err := p.GetManifestByType(Image)
+		if err != nil {
+			t.FailNow()
+		}
+		td := TarballDescriptor{}
+		if err := json.Unmarshal(content, &td); err != nil {
+			t.Fatalf("unmarshal: %s", err)
+		}
+		if td.Tarball != filepath.Base(tarball) || td.Digest != "sha256:"+dgst || td.Size != int64(len(b)) {
+			t.Errorf("unexpected tarball in descriptor %+v", td)
+		}
+		if td.ImageDigest != "sha256:"+mh.Digest || td.IndexDigest == "" || td.Image != p.GetUrl() {
+			t.Errorf("unexpected image in descriptor %+v", td)
+		}
+		layers := mh.Layers()
+		if len(td.Layers) != len(layers)-1 || td.Layers[0].Digest != layers[0].Digest || td.ConfigDigest != layers[len(layers)-1].Digest {
+			t.Errorf("unexpected layers in descriptor %+v", td)
+		}
+	}
+	opts := PullerOpts{Url: "foo", Scheme: "https", OStype: "linux", ArchType: "amd64", Sidecar: "md5"}
+	if opts.validate() == nil {
+		t.Errorf("expected an invalid sidecar type to be rejected")
+	}
+}
@@ -0,0 +1,71 @@
+package imgpull
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+)
+
+// SignFunc signs the passed sha256 digest of a tarball and returns the detached signature,
+// e.g. with a key in an HSM or a cloud KMS.
+type SignFunc func(digest []byte) ([]byte, error)
+
+// signaturePath returns the path of the detached signature of the passed tarball.
+func signaturePath(dest string) string {
+	return dest + ".sig"
+}
+
+// signer returns the function that signs tarballs per the receiver, or nil if tarballs
+// aren't signed. The key is loaded here so that a bad key fails a pull before anything
+// is downloaded.
+func (o PullerOpts) signer() (SignFunc, error) {
+	if o.Sign != nil || o.SigningKey == "" {
+		return o.Sign, nil
+	}
+	key, err := loadPrivateKey(o.SigningKey)
+	if err != nil {
+		return nil, err
+	}
+	return func(digest []byte) ([]byte, error) {
+		return key.Sign(rand.Reader, digest, crypto.SHA256)
+	}, nil
+}
+
+// loadPrivateKey loads the unencrypted PEM private key in the passed file. The key can be
+// PKCS #8, PKCS #1 (RSA), or SEC 1 (EC), and must be an RSA or ECDSA key since those sign
+// a digest, which is what 'openssl dgst -sign' and '-verify' expect, and those are the
+// keys that OCIcrypt wraps layer keys for.
+func loadPrivateKey(path string) (crypto.Signer, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM private key found in %q", path)
+	}
+	var key any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse private key in %q, error: %w", path, err)
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case *ecdsa.PrivateKey:
+		return k, nil
+	}
+	return nil, fmt.Errorf("unsupported private key type %T in %q: must be RSA or ECDSA", key, path)
+}
@@ -0,0 +1,123 @@
+package imgpull
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aceeric/imgpull/mock"
+)
+
+// Tests signing a tarball with ECDSA and RSA keys in PEM files, and with a sign function.
+func TestPullTarSign(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	d := t.TempDir()
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecDER, _ := x509.MarshalECPrivateKey(ecKey)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	pkcs8DER, _ := x509.MarshalPKCS8PrivateKey(rsaKey)
+	keys := map[string]*pem.Block{
+		"ec.pem":  {Type: "EC PRIVATE KEY", Bytes: ecDER},
+		"rsa.pem": {Type: "PRIVATE KEY", Bytes: pkcs8DER},
+	}
+	for name, block := range keys {
+		if err := os.WriteFile(filepath.Join(d, name), pem.EncodeToMemory(block), 0600); err != nil {
+			t.FailNow()
+		}
+	}
+	signed := []byte{}
+	for _, tst := range []struct {
+		key    string
+		sign   SignFunc
+		verify func(digest, sig []byte) bool
+	}{
+		{key: "ec.pem", verify: func(digest, sig []byte) bool { return ecdsa.VerifyASN1(&ecKey.PublicKey, digest, sig) }},
+		{key: "rsa.pem", verify: func(digest, sig []byte) bool {
+			return rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, digest, sig) == nil
+		}},
+		{
+			sign: func(digest []byte) ([]byte, error) {
+				signed = digest
+				return []byte("signature"), nil
+			},
+			verify: func(digest, sig []byte) bool { return string(sig) == "signature" && string(signed) == string(digest) },
+		},
+	} {
+		opts := PullerOpts{
+			Url:      fmt.Sprintf("%s/hello-world:latest", url),
+			OStype:   "linux",
+			ArchType: "amd64",
+			Scheme:   "http",
+			Sign:     tst.sign,
+		}
+		if tst.key != "" {
+			opts.SigningKey = filepath.Join(d, tst.key)
+		}
+		p, err := NewPullerWith(opts)
+		if err != nil {
+			t.FailNow()
+		}
+		tarball := filepath.Join(d, "hello-world.tar")
+		if _, err := p.PullTar(tarball); err != nil {
+			t.Fatalf("pull tar: %s", err)
+		}
+		b, _ := os.ReadFile(tarball)
+		sig, err := os.ReadFile(tarball + ".sig")
+		if err != nil {
+			t.Fatalf("expected a signature: %s", err)
+		}
+		digest := sha256.Sum256(b)
+		if !tst.verify(digest[:], sig) {
+			t.Errorf("signature with %q didn't verify", tst.key)
+		}
+	}
+}
+
+// Tests that a pull with a key that can't sign fails before pulling, and that a failed
+// signature doesn't leave the tarball behind.
+func TestPullTarSignErrors(t *testing.T) {
+	server, url := mock.Server(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}))
+	defer server.Close()
+	d := t.TempDir()
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	edDER, _ := x509.MarshalPKCS8PrivateKey(edKey)
+	os.WriteFile(filepath.Join(d, "ed.pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: edDER}), 0600)
+	os.WriteFile(filepath.Join(d, "junk.pem"), []byte("junk"), 0600)
+	tarball := filepath.Join(d, "hello-world.tar")
+	for _, opts := range []PullerOpts{
+		{SigningKey: filepath.Join(d, "ed.pem")},
+		{SigningKey: filepath.Join(d, "junk.pem")},
+		{SigningKey: filepath.Join(d, "nosuch.pem")},
+		{Sign: func([]byte) ([]byte, error) { return nil, errors.New("hsm unavailable") }},
+	} {
+		opts.Url, opts.OStype, opts.ArchType, opts.Scheme = fmt.Sprintf("%s/hello-world:latest", url), "linux", "amd64", "http"
+		p, err := NewPullerWith(opts)
+		if err != nil {
+			t.FailNow()
+		}
+		if _, err := p.PullTar(tarball); err == nil {
+			t.Errorf("expected an error signing with %+v", opts)
+		}
+		for _, file := range []string{tarball, tarball + ".sig"} {
+			if _, err := os.Stat(file); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("expected %q to be removed", file)
+			}
+		}
+	}
+	opts := PullerOpts{Url: "foo", Scheme: "https", OStype: "linux", ArchType: "amd64", SigningKey: "key.pem", Sign: func([]byte) ([]byte, error) { return nil, nil }}
+	if opts.validate() == nil {
+		t.Errorf("expected a signing key and a sign function to be rejected")
+	}
+}
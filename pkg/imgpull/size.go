@@ -0,0 +1,101 @@
+package imgpull
+
+import (
+	"path/filepath"
+
+	"github.com/aceeric/imgpull/internal/rootfs"
+	"github.com/aceeric/imgpull/internal/util"
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+)
+
+// ImageSize has the sizes of an image. It is returned by 'Size'.
+type ImageSize struct {
+	// ImageUrl is the url of the image manifest. If the image url in the puller
+	// resolved to an image list then this has the digest of the selected image.
+	ImageUrl string `json:"imageUrl"`
+	// Digest is the digest of the image manifest, like 'sha256:abc...'.
+	Digest string `json:"digest"`
+	// Platform is the OS and architecture the image was selected for, like 'linux/amd64'.
+	Platform string `json:"platform"`
+	// Config is the image config blob. It is empty for schema 1 manifests, which don't
+	// have a config.
+	Config types.Layer `json:"config"`
+	// Layers are the layers of the image from the bottom layer to the top layer.
+	Layers []LayerSize `json:"layers"`
+	// CompressedBytes is the sum of the sizes of the layers.
+	CompressedBytes int64 `json:"compressedBytes"`
+	// DownloadBytes is the sum of the sizes of the blobs that a pull downloads: the
+	// config, and each layer once even if it is in the image more than once.
+	DownloadBytes int64 `json:"downloadBytes"`
+	// UncompressedBytes is the sum of the uncompressed sizes of the layers, if they
+	// were requested.
+	UncompressedBytes int64 `json:"uncompressedBytes,omitempty"`
+}
+
+// LayerSize has the sizes of one layer of an image.
+type LayerSize struct {
+	Digest    string          `json:"digest"`
+	MediaType types.MediaType `json:"mediaType"`
+	// Size is the size of the layer blob, which is usually compressed. Schema 1
+	// manifests don't have blob sizes, so this is zero for those.
+	Size int64 `json:"size"`
+	// UncompressedSize is the size of the uncompressed layer, if it was requested.
+	UncompressedSize int64 `json:"uncompressedSize,omitempty"`
+}
+
+func (p *puller) Size(uncompressed bool) (size ImageSize, err error) {
+	if err := p.checkRef(); err != nil {
+		return ImageSize{}, err
+	}
+	if err := p.connect(); err != nil {
+		return ImageSize{}, err
+	}
+	mh, _, err := p.resolveImage(p.regCliFrom())
+	if err != nil {
+		return ImageSize{}, err
+	}
+	size = ImageSize{
+		ImageUrl: mh.ImageUrl,
+		Digest:   "sha256:" + mh.Digest,
+		Platform: p.Opts.OStype + "/" + p.Opts.ArchType,
+		Layers:   []LayerSize{},
+	}
+	layers := mh.Layers()
+	// the config is always the last element returned by Layers except for schema 1
+	// manifests which don't have a config
+	if mh.hasConfig() && len(layers) != 0 {
+		size.Config = layers[len(layers)-1]
+		layers = layers[:len(layers)-1]
+		size.DownloadBytes += int64(size.Config.Size)
+	}
+	seen := map[string]bool{}
+	for _, layer := range layers {
+		size.Layers = append(size.Layers, LayerSize{Digest: layer.Digest, MediaType: layer.MediaType, Size: int64(layer.Size)})
+		size.CompressedBytes += int64(layer.Size)
+		if !seen[layer.Digest] {
+			seen[layer.Digest] = true
+			size.DownloadBytes += int64(layer.Size)
+		}
+	}
+	if !uncompressed {
+		return size, nil
+	}
+	tmpDir, err := p.Opts.newWorkDir()
+	if err != nil {
+		return ImageSize{}, err
+	}
+	defer func() { err = removeWorkDir(tmpDir, err) }()
+	notConfig := func(_ types.Layer, isConfig bool) bool { return !isConfig }
+	if _, err := p.PullBlobs(mh, tmpDir, notConfig); err != nil {
+		return ImageSize{}, err
+	}
+	for i, layer := range size.Layers {
+		n, err := rootfs.UncompressedSize(filepath.Join(tmpDir, util.DigestFrom(layer.Digest)))
+		if err != nil {
+			return ImageSize{}, err
+		}
+		size.Layers[i].UncompressedSize = n
+		size.UncompressedBytes += n
+	}
+	return size, nil
+}
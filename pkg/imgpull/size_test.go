@@ -0,0 +1,55 @@
+package imgpull
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"testing"
+
+	"github.com/aceeric/imgpull/mock"
+)
+
+// Tests the sizes of an image that has the same compressed layer twice, with and
+// without the uncompressed sizes.
+func TestSize(t *testing.T) {
+	content := bytes.Repeat([]byte("frobozz"), 1000)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(content)
+	zw.Close()
+	config := []byte(`{"architecture":"amd64"}`)
+	reg := mock.NewRegistry()
+	reg.AddImage("frobozz", "latest", config, gz.Bytes(), []byte("other"), gz.Bytes())
+	server, url := mock.ServerWith(mock.NewMockParams(mock.NONE, mock.NOTLS, mock.CertSetup{}), reg)
+	defer server.Close()
+	p, err := NewPullerWith(PullerOpts{
+		Url:      fmt.Sprintf("%s/frobozz:latest", url),
+		OStype:   "linux",
+		ArchType: "amd64",
+		Scheme:   "http",
+		WorkDir:  t.TempDir(),
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	layerBytes := int64(2*gz.Len() + len("other"))
+	for _, uncompressed := range []bool{false, true} {
+		size, err := p.Size(uncompressed)
+		if err != nil {
+			t.Fatalf("size: %s", err)
+		}
+		if len(size.Layers) != 3 || size.Config.Size != len(config) || size.CompressedBytes != layerBytes {
+			t.Errorf("unexpected size %+v", size)
+		}
+		if size.DownloadBytes != layerBytes-int64(gz.Len())+int64(len(config)) {
+			t.Errorf("expected a duplicate layer to be downloaded once, got %d", size.DownloadBytes)
+		}
+		var expected, expectedLayer int64
+		if uncompressed {
+			expected, expectedLayer = int64(2*len(content)+len("other")), int64(len(content))
+		}
+		if size.UncompressedBytes != expected || size.Layers[0].UncompressedSize != expectedLayer {
+			t.Errorf("expected %d uncompressed bytes, got %+v", expected, size)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package imgpull
+
+import (
+	"cmp"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// semver is a parsed semantic version tag. The minor and patch versions are optional in
+// a tag so 'v1' and 'v1.2' are parsed like 'v1.0.0' and 'v1.2.0'.
+type semver struct {
+	major, minor, patch uint64
+	prerelease          []string
+}
+
+// FilterTags returns the tags in the passed slice that match the passed regular expression,
+// in the same order. The expression is not anchored, so use e.g. '^v1\.2\.' to match tags
+// starting with 'v1.2.'.
+func FilterTags(tags []string, pattern string) ([]string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tag pattern %q: %w", pattern, err)
+	}
+	filtered := []string{}
+	for _, tag := range tags {
+		if re.MatchString(tag) {
+			filtered = append(filtered, tag)
+		}
+	}
+	return filtered, nil
+}
+
+// SortTagsBySemver returns the tags in the passed slice that are semantic versions, sorted
+// from lowest to highest by semantic version precedence. Tags that are not semantic versions,
+// like 'latest', are omitted. A tag may have a leading 'v' and may omit the minor and patch
+// versions. Build metadata (e.g. '+build.1') is ignored for precedence, and tags with the
+// same precedence keep their order.
+func SortTagsBySemver(tags []string) []string {
+	type parsed struct {
+		tag string
+		ver semver
+	}
+	versions := []parsed{}
+	for _, tag := range tags {
+		if ver, ok := parseSemver(tag); ok {
+			versions = append(versions, parsed{tag, ver})
+		}
+	}
+	slices.SortStableFunc(versions, func(a, b parsed) int {
+		return compareSemver(a.ver, b.ver)
+	})
+	sorted := make([]string, len(versions))
+	for i, v := range versions {
+		sorted[i] = v.tag
+	}
+	return sorted
+}
+
+// LatestTag returns the highest semantic version tag in the passed slice that matches the
+// passed regular expression. E.g. the pattern '^v1\.2\.' returns the newest 'v1.2.x' tag.
+// An error is returned if no semantic version tag matches.
+func LatestTag(tags []string, pattern string) (string, error) {
+	filtered, err := FilterTags(tags, pattern)
+	if err != nil {
+		return "", err
+	}
+	sorted := SortTagsBySemver(filtered)
+	if len(sorted) == 0 {
+		return "", fmt.Errorf("no semantic version tag matches %q", pattern)
+	}
+	return sorted[len(sorted)-1], nil
+}
+
+// parseSemver parses the passed tag as a semantic version, returning false if it isn't
+// one.
+func parseSemver(tag string) (semver, bool) {
+	s := strings.TrimPrefix(tag, "v")
+	s, _, _ = strings.Cut(s, "+")
+	s, pre, hasPre := strings.Cut(s, "-")
+	ver := semver{}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return semver{}, false
+	}
+	nums := []*uint64{&ver.major, &ver.minor, &ver.patch}
+	for i, part := range parts {
+		if !isNumeric(part) {
+			return semver{}, false
+		}
+		n, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return semver{}, false
+		}
+		*nums[i] = n
+	}
+	if hasPre {
+		ver.prerelease = strings.Split(pre, ".")
+		for _, id := range ver.prerelease {
+			if id == "" {
+				return semver{}, false
+			}
+		}
+	}
+	return ver, true
+}
+
+// compareSemver compares the passed versions by semantic version precedence: major,
+// minor, and patch numerically, then a version with a prerelease is lower than one
+// without, then the prerelease identifiers are compared in order. Numeric identifiers
+// compare numerically and are lower than alphanumeric identifiers, which compare
+// lexically, and a shorter set of identifiers is lower if all the preceding are equal.
+func compareSemver(a, b semver) int {
+	if c := cmp.Compare(a.major, b.major); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(a.minor, b.minor); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(a.patch, b.patch); c != 0 {
+		return c
+	}
+	switch {
+	case len(a.prerelease) == 0 && len(b.prerelease) == 0:
+		return 0
+	case len(a.prerelease) == 0:
+		return 1
+	case len(b.prerelease) == 0:
+		return -1
+	}
+	for i := 0; i < len(a.prerelease) && i < len(b.prerelease); i++ {
+		ida, idb := a.prerelease[i], b.prerelease[i]
+		na, nb := isNumeric(ida), isNumeric(idb)
+		var c int
+		switch {
+		case na && nb:
+			// compare numerically without overflow on long identifiers
+			ida, idb = strings.TrimLeft(ida, "0"), strings.TrimLeft(idb, "0")
+			c = cmp.Compare(len(ida), len(idb))
+			if c == 0 {
+				c = strings.Compare(ida, idb)
+			}
+		case na:
+			c = -1
+		case nb:
+			c = 1
+		default:
+			c = strings.Compare(ida, idb)
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(a.prerelease), len(b.prerelease))
+}
+
+// isNumeric returns true if the passed string is not empty and only has the digits 0-9.
+func isNumeric(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
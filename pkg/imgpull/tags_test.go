@@ -0,0 +1,102 @@
+package imgpull
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aceeric/imgpull/mock"
+)
+
+// Tests filtering tags by regular expression.
+func TestFilterTags(t *testing.T) {
+	tags := []string{"v1.2.0", "v1.2.10", "v1.3.0", "latest", "v1.2.3-alpine"}
+	for _, tc := range []struct {
+		pattern  string
+		expected string
+		ok       bool
+	}{
+		{`^v1\.2\.`, "v1.2.0,v1.2.10,v1.2.3-alpine", true},
+		{`alpine$`, "v1.2.3-alpine", true},
+		{`^nope`, "", true},
+		{`(`, "", false},
+	} {
+		filtered, err := FilterTags(tags, tc.pattern)
+		if (err == nil) != tc.ok {
+			t.Errorf("pattern %q: unexpected result %v", tc.pattern, err)
+		} else if strings.Join(filtered, ",") != tc.expected {
+			t.Errorf("pattern %q: expected %q, got %v", tc.pattern, tc.expected, filtered)
+		}
+	}
+}
+
+// Tests sorting tags by semantic version precedence.
+func TestSortTagsBySemver(t *testing.T) {
+	for _, tc := range []struct {
+		tags     []string
+		expected string
+	}{
+		{[]string{"v1.10.0", "v1.2.0", "v1.9.1"}, "v1.2.0,v1.9.1,v1.10.0"},
+		{[]string{"1.2", "1", "1.1.1"}, "1,1.1.1,1.2"},
+		{[]string{"latest", "v1.0.0", "v1.0.0.1", "stable", "v1..0", "v1.0.0-"}, "v1.0.0"},
+		{[]string{"1.0.0", "1.0.0-rc.1", "1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-beta.11", "1.0.0-beta.2", "1.0.0-alpha.beta", "1.0.0-beta"},
+			"1.0.0-alpha,1.0.0-alpha.1,1.0.0-alpha.beta,1.0.0-beta,1.0.0-beta.2,1.0.0-beta.11,1.0.0-rc.1,1.0.0"},
+		{[]string{"1.0.0+b", "1.0.0+a"}, "1.0.0+b,1.0.0+a"},
+		{nil, ""},
+	} {
+		if sorted := SortTagsBySemver(tc.tags); strings.Join(sorted, ",") != tc.expected {
+			t.Errorf("expected %q, got %v", tc.expected, sorted)
+		}
+	}
+}
+
+// Tests getting the latest tag matching a pattern.
+func TestLatestTag(t *testing.T) {
+	tags := []string{"v1.2.9", "v1.2.10", "v1.3.0-rc.1", "v1.3.0", "latest", "v1.2.11-rc.1"}
+	for _, tc := range []struct {
+		pattern  string
+		expected string
+		ok       bool
+	}{
+		{`^v1\.2\.`, "v1.2.11-rc.1", true},
+		{`^v1\.2\.\d+$`, "v1.2.10", true},
+		{``, "v1.3.0", true},
+		{`^latest$`, "", false},
+		{`[`, "", false},
+	} {
+		latest, err := LatestTag(tags, tc.pattern)
+		if (err == nil) != tc.ok || latest != tc.expected {
+			t.Errorf("pattern %q: expected %q, got %q (%v)", tc.pattern, tc.expected, latest, err)
+		}
+	}
+}
+
+// Tests listing the tags in a repository with bearer auth, ignoring the tag in the
+// image URL.
+func TestListTags(t *testing.T) {
+	reg := mock.NewRegistry()
+	for _, tag := range []string{"v1.0.0", "v1.1.0", "latest"} {
+		reg.AddImage("frobozz", tag, []byte(`{"architecture":"`+tag+`"}`), []byte(tag))
+	}
+	server, url := mock.ServerWith(mock.NewMockParams(mock.BEARER, mock.NOTLS, mock.CertSetup{}), reg)
+	defer server.Close()
+	p, err := NewPullerWith(PullerOpts{
+		Url:      fmt.Sprintf("%s/frobozz:nonexistent", url),
+		OStype:   "linux",
+		ArchType: "amd64",
+		Scheme:   "http",
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	tags, err := p.ListTags()
+	if err != nil {
+		t.Fatalf("list tags: %s", err)
+	}
+	if strings.Join(tags, ",") != "latest,v1.0.0,v1.1.0" {
+		t.Errorf("unexpected tags %v", tags)
+	}
+	if latest, err := LatestTag(tags, `^v1\.`); err != nil || latest != "v1.1.0" {
+		t.Errorf("expected v1.1.0, got %q", latest)
+	}
+}
@@ -0,0 +1,86 @@
+package imgpull
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"maps"
+	"sync"
+
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+)
+
+// TokenCache caches bearer tokens until they expire, so that pulls from the same
+// repository by different pullers don't have to re-authenticate each time. Tokens are
+// keyed by registry, token endpoint, service, scope, and credentials so a token is only
+// ever re-used for exactly the request that obtained it. A TokenCache is safe for
+// concurrent use.
+type TokenCache struct {
+	mu     sync.Mutex
+	tokens map[tokenKey]types.BearerToken
+}
+
+// tokenKey identifies a token in the cache. Credentials are hashed so that they
+// aren't retained in the cache.
+type tokenKey struct {
+	registry string
+	realm    string
+	service  string
+	scope    string
+	creds    string
+}
+
+// defaultTokenCache is used by pullers that don't have a TokenCache in their options.
+var defaultTokenCache = NewTokenCache()
+
+// NewTokenCache returns an empty token cache.
+func NewTokenCache() *TokenCache {
+	return &TokenCache{
+		tokens: map[tokenKey]types.BearerToken{},
+	}
+}
+
+// newTokenKey returns a token key from the passed args.
+func newTokenKey(registry string, ba types.BearerAuth, scope string, encoded string) tokenKey {
+	creds := ""
+	if encoded != "" {
+		sum := sha256.Sum256([]byte(encoded))
+		creds = hex.EncodeToString(sum[:])
+	}
+	return tokenKey{
+		registry: registry,
+		realm:    ba.Realm,
+		service:  ba.Service,
+		scope:    scope,
+		creds:    creds,
+	}
+}
+
+// get returns the token for the passed key if it is in the cache and has not expired.
+func (tc *TokenCache) get(key tokenKey) (types.BearerToken, bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	bt, found := tc.tokens[key]
+	if found && bt.Expired() {
+		delete(tc.tokens, key)
+		return types.BearerToken{}, false
+	}
+	return bt, found
+}
+
+// put adds the passed token to the cache. Expired tokens are removed first, so that a
+// long-lived cache like 'defaultTokenCache' doesn't grow with every scope it has seen.
+func (tc *TokenCache) put(key tokenKey, bt types.BearerToken) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	maps.DeleteFunc(tc.tokens, func(_ tokenKey, bt types.BearerToken) bool {
+		return bt.Expired()
+	})
+	tc.tokens[key] = bt
+}
+
+// remove removes the token for the passed key, e.g. because the upstream rejected it.
+func (tc *TokenCache) remove(key tokenKey) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	delete(tc.tokens, key)
+}
@@ -0,0 +1,231 @@
+package imgpull
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aceeric/imgpull/mock"
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+)
+
+func TestTokenExpiry(t *testing.T) {
+	now := time.Now()
+	for _, tst := range []struct {
+		bt      types.BearerToken
+		expires time.Time
+		expired bool
+	}{
+		{types.BearerToken{}, now.Add(60 * time.Second), false},
+		{types.BearerToken{ExpiresIn: 300}, now.Add(300 * time.Second), false},
+		{types.BearerToken{ExpiresIn: 300, IssuedAt: now.Add(-time.Hour).Format(time.RFC3339)}, now.Add(-time.Hour).Add(300 * time.Second).Truncate(time.Second), true},
+		{types.BearerToken{ExpiresIn: 3, IssuedAt: "garbage"}, now.Add(3 * time.Second), true},
+	} {
+		tst.bt.SetExpiry(now)
+		if !tst.bt.Expires.Equal(tst.expires) || tst.bt.Expired() != tst.expired {
+			t.Fail()
+		}
+	}
+	if (types.BearerToken{Token: "x"}).Expired() {
+		t.Fail()
+	}
+}
+
+func TestTokenCache(t *testing.T) {
+	tc := NewTokenCache()
+	ba := types.BearerAuth{Realm: "https://auth.io/token", Service: "registry.io"}
+	key := newTokenKey("registry.io", ba, "repository:foo:pull", "")
+	if _, found := tc.get(key); found {
+		t.FailNow()
+	}
+	tc.put(key, types.BearerToken{Token: "a", Expires: time.Now().Add(time.Minute)})
+	if bt, found := tc.get(key); !found || bt.Token != "a" {
+		t.FailNow()
+	}
+	// other scopes and credentials are different keys
+	if _, found := tc.get(newTokenKey("registry.io", ba, "repository:bar:pull", "")); found {
+		t.FailNow()
+	}
+	if _, found := tc.get(newTokenKey("registry.io", ba, "repository:foo:pull", "Zm9vOmJhcg==")); found {
+		t.FailNow()
+	}
+	tc.put(key, types.BearerToken{Token: "a", Expires: time.Now()})
+	if _, found := tc.get(key); found {
+		t.FailNow()
+	}
+	tc.put(key, types.BearerToken{Token: "a"})
+	tc.remove(key)
+	if _, found := tc.get(key); found {
+		t.FailNow()
+	}
+	// expired tokens are swept when a token is added
+	for i := range 10 {
+		tc.put(newTokenKey("registry.io", ba, fmt.Sprintf("repository:foo%d:pull", i), ""), types.BearerToken{Token: "a", Expires: time.Now()})
+	}
+	tc.put(key, types.BearerToken{Token: "a", Expires: time.Now().Add(time.Minute)})
+	if len(tc.tokens) != 1 {
+		t.Errorf("expected expired tokens to be swept, got %d tokens", len(tc.tokens))
+	}
+}
+
+// tokenServer is a bearer auth registry that serves one image manifest, issues a new
+// token for each token request, and only accepts the most recently issued token.
+type tokenServer struct {
+	mu      sync.Mutex
+	issued  int
+	current string
+}
+
+func (ts *tokenServer) handler(t *testing.T) http.HandlerFunc {
+	manifest, err := os.ReadFile(filepath.Join("..", "..", "mock", "testfiles", "imageManifest.json"))
+	if err != nil {
+		t.FailNow()
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+		if r.URL.Path == "/token" {
+			ts.issued++
+			ts.current = fmt.Sprintf("token-%d", ts.issued)
+			fmt.Fprintf(w, `{"access_token":%q,"expires_in":300}`, ts.current)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer "+ts.current || ts.current == "" {
+			w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="test"`, r.Host))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", string(types.V1ociManifestMt))
+		w.Write(manifest)
+	}
+}
+
+// revoke invalidates the current token.
+func (ts *tokenServer) revoke() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.current = "revoked"
+}
+
+func TestTokenCacheReuseAndReauth(t *testing.T) {
+	ts := &tokenServer{}
+	server := httptest.NewServer(ts.handler(t))
+	defer server.Close()
+	url := strings.TrimPrefix(server.URL, "http://")
+	tc := NewTokenCache()
+	getManifest := func(user string) error {
+		p, err := NewPullerWith(PullerOpts{
+			Url:        fmt.Sprintf("%s/hello-world:latest", url),
+			Scheme:     "http",
+			OStype:     "linux",
+			ArchType:   "amd64",
+			Username:   user,
+			Password:   user,
+			TokenCache: tc,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = p.GetManifestByType(Image)
+		return err
+	}
+	for range 3 {
+		if err := getManifest(""); err != nil {
+			t.FailNow()
+		}
+	}
+	if ts.issued != 1 {
+		t.FailNow()
+	}
+	// a rejected token is discarded and a new one obtained
+	ts.revoke()
+	if err := getManifest(""); err != nil || ts.issued != 2 {
+		t.FailNow()
+	}
+	if err := getManifest(""); err != nil || ts.issued != 2 {
+		t.FailNow()
+	}
+	// different credentials don't share tokens
+	if err := getManifest("someone"); err != nil || ts.issued != 3 {
+		t.FailNow()
+	}
+}
+
+// Tests that a pull survives tokens being revoked mid-pull and a 401 on a blob, and
+// that tokens are renewed when they expire, using the mock server's token validation.
+func TestTokenRenewalMidPull(t *testing.T) {
+	reg := mock.NewHelloWorldRegistry()
+	params := mock.NewMockParams(mock.BEARER, mock.NOTLS, mock.CertSetup{})
+	params.TokenTTL = time.Hour
+	params.ValidateScope = true
+	server, url := mock.ServerWith(params, reg)
+	defer server.Close()
+	opts := NewPullerOpts(fmt.Sprintf("%s/hello-world:latest", url))
+	opts.Scheme, opts.OStype, opts.ArchType = "http", "linux", "amd64"
+	opts.TokenCache = NewTokenCache()
+	p, err := NewPullerWith(opts)
+	if err != nil {
+		t.FailNow()
+	}
+	mh, err := p.GetManifestByType(Image)
+	if err != nil || reg.TokenRequests() != 1 {
+		t.FailNow()
+	}
+	d, _ := os.MkdirTemp("", "")
+	defer os.RemoveAll(d)
+	// the upstream revokes the token
+	reg.RevokeTokens()
+	if _, err := p.PullBlobs(mh, filepath.Join(d, "revoked")); err != nil {
+		t.FailNow()
+	}
+	if reg.TokenRequests() != 2 {
+		t.Fail()
+	}
+	// the upstream rejects a valid token once
+	reg.AddFault(mock.Fault{Match: "/blobs/", Status: http.StatusUnauthorized, Count: 1})
+	if _, err := p.PullBlobs(mh, filepath.Join(d, "rejected")); err != nil {
+		t.FailNow()
+	}
+	if reg.TokenRequests() != 3 {
+		t.Fail()
+	}
+}
+
+// Tests that a puller moved to a different repository with SetUrl gets a token for that
+// repository rather than sending the token for the first repository, and that going back
+// to the first repository reuses its cached token.
+func TestTokenScopeAcrossRepositories(t *testing.T) {
+	reg := mock.NewRegistry()
+	config := []byte(`{"architecture":"amd64","os":"linux"}`)
+	reg.AddImage("frobozz", "v1", config)
+	reg.AddImage("xyzzy", "v1", config)
+	params := mock.NewMockParams(mock.BEARER, mock.NOTLS, mock.CertSetup{})
+	params.TokenTTL = time.Hour
+	params.ValidateScope = true
+	server, url := mock.ServerWith(params, reg)
+	defer server.Close()
+	opts := NewPullerOpts(fmt.Sprintf("%s/frobozz:v1", url))
+	opts.Scheme, opts.OStype, opts.ArchType = "http", "linux", "amd64"
+	opts.TokenCache = NewTokenCache()
+	p, err := NewPullerWith(opts)
+	if err != nil {
+		t.FailNow()
+	}
+	for i, repo := range []string{"frobozz", "xyzzy", "frobozz"} {
+		if err := p.SetUrl(fmt.Sprintf("%s/%s:v1", url, repo)); err != nil {
+			t.FailNow()
+		}
+		if _, err := p.GetManifest(); err != nil {
+			t.Fatalf("%s: %s", repo, err)
+		}
+		if expect := min(i+1, 2); reg.TokenRequests() != expect {
+			t.Errorf("%s: expected %d token requests, got %d", repo, expect, reg.TokenRequests())
+		}
+	}
+}
@@ -1,5 +1,12 @@
 package types
 
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
 type MediaType string
 
 // media types
@@ -8,6 +15,10 @@ const (
 	V2dockerManifestMt     MediaType = "application/vnd.docker.distribution.manifest.v2+json"
 	V1ociIndexMt           MediaType = "application/vnd.oci.image.index.v1+json"
 	V1ociManifestMt        MediaType = "application/vnd.oci.image.manifest.v1+json"
+	V1ociArtifactMt        MediaType = "application/vnd.oci.artifact.manifest.v1+json"
+	V1ociEmptyMt           MediaType = "application/vnd.oci.empty.v1+json"
+	V1dockerManifestMt     MediaType = "application/vnd.docker.distribution.manifest.v1+json"
+	V1dockerSignedMt       MediaType = "application/vnd.docker.distribution.manifest.v1+prettyjws"
 	V2dockerLayerMt        MediaType = "application/vnd.docker.image.rootfs.diff.tar"
 	V2dockerLayerGzipMt    MediaType = "application/vnd.docker.image.rootfs.diff.tar.gzip"
 	V2dockerLayerZstdMt    MediaType = "application/vnd.docker.image.rootfs.diff.tar.zstd"
@@ -25,6 +36,118 @@ type ManifestDescriptor struct {
 	Size      int       `json:"size"`
 }
 
+// RawManifest is a manifest as provided by an OCI distribution server, without
+// being parsed. The digest is like 'sha256:abc...'.
+type RawManifest struct {
+	MediaType MediaType `json:"mediaType"`
+	Digest    string    `json:"digest"`
+	Bytes     []byte    `json:"bytes"`
+}
+
+// CachedManifest is a manifest response held by a ManifestCache. The ETag is sent in
+// an If-None-Match header when the manifest is fetched again, and if the server responds
+// 304 Not Modified then the cached manifest is used.
+type CachedManifest struct {
+	ETag      string
+	MediaType MediaType
+	// Digest is the Docker-Content-Digest header of the response, if it had one.
+	Digest string
+	Bytes  []byte
+}
+
+// ManifestCache caches manifest responses by key, which is derived from the manifest
+// url and the accepted media types. Implementations must be safe for concurrent use.
+// Since the server is asked whether the cached manifest is current on each fetch, which
+// requires auth, a cache can be shared by pullers with different credentials.
+type ManifestCache interface {
+	// Get returns the cached manifest for the passed key, and true if it was found.
+	Get(key string) (CachedManifest, bool)
+	// Put caches the passed manifest with the passed key.
+	Put(key string, cm CachedManifest)
+}
+
+// ErrDigestMismatch is returned when the digest of a manifest or blob provided by an OCI
+// distribution server doesn't match the digest it was requested by, or the digest in the
+// Docker-Content-Digest header. Use 'errors.As' to check for it. It protects against
+// mirrors and caches that return the wrong content for a digest.
+type ErrDigestMismatch struct {
+	// Url is the manifest or blob url.
+	Url string
+	// Expected is the requested digest, like 'sha256:abc...'.
+	Expected string
+	// Actual is the digest computed from the manifest content.
+	Actual string
+}
+
+func (e *ErrDigestMismatch) Error() string {
+	return fmt.Sprintf("digest mismatch for %q: expected %s, got %s", e.Url, e.Expected, e.Actual)
+}
+
+// ErrStatus is returned when an OCI distribution server or token server responds to a
+// request with an unexpected status, so that callers can tell e.g. an image that doesn't
+// exist (404) or rejected credentials (401 or 403) from other failures. Use 'errors.As'
+// to check for it.
+type ErrStatus struct {
+	// Op is the request that failed, e.g. "get manifests".
+	Op string
+	// Url is the request url.
+	Url string
+	// StatusCode is the HTTP status of the response.
+	StatusCode int
+}
+
+func (e *ErrStatus) Error() string {
+	return fmt.Sprintf("%s for %q failed with status %d", e.Op, e.Url, e.StatusCode)
+}
+
+// ErrTransient is the category of network errors that might not happen if the request is
+// retried, like a refused or reset connection, a timeout, or a DNS server that didn't answer.
+// Use 'errors.Is' to check for it.
+var ErrTransient = errors.New("transient network error")
+
+// ErrPermanent is the category of network errors that will happen again if the request is
+// retried, like a host that doesn't exist or a certificate that isn't trusted. Use
+// 'errors.Is' to check for it.
+var ErrPermanent = errors.New("permanent network error")
+
+// ErrNetwork is returned when a request to an OCI distribution server or token server fails
+// without a response, or the response body can't be read. Its category is either
+// 'ErrTransient' or 'ErrPermanent' so that callers can use 'errors.Is' to decide whether
+// retrying makes sense. The underlying error, e.g. a 'net.Error', is also unwrapped.
+type ErrNetwork struct {
+	// Category is ErrTransient or ErrPermanent.
+	Category error
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *ErrNetwork) Error() string {
+	return fmt.Sprintf("%s: %s", e.Category, e.Err)
+}
+
+func (e *ErrNetwork) Unwrap() []error {
+	return []error{e.Category, e.Err}
+}
+
+// ErrMediaTypeMismatch is returned with a strict media type check when the Content-Type
+// of a manifest provided by an OCI distribution server doesn't match the 'mediaType' field
+// in the manifest, or the media type of the descriptor the manifest was selected by. Use
+// 'errors.As' to check for it.
+type ErrMediaTypeMismatch struct {
+	// Url is the manifest url.
+	Url string
+	// Served is the Content-Type of the response.
+	Served MediaType
+	// Expected is the media type in the manifest or in the descriptor.
+	Expected MediaType
+	// Source is where the expected media type came from: "manifest" or "descriptor".
+	Source string
+}
+
+func (e *ErrMediaTypeMismatch) Error() string {
+	return fmt.Sprintf("media type mismatch for %q: served as %q but the %s has %q", e.Url, e.Served, e.Source, e.Expected)
+}
+
 // Layer has the parts of the 'Descriptor' struct that minimally describe a
 // layer. Since the Descriptor is a different type for Docker vs OCI with overlap, the other
 // option was to embed the original struct here and then have getters based on
@@ -40,7 +163,17 @@ type Layer struct {
 
 // IsImageManifest returns true if the descriptor is an image manifest
 func (md ManifestDescriptor) IsImageManifest() bool {
-	return md.MediaType == V2dockerManifestMt || md.MediaType == V1ociManifestMt
+	switch md.MediaType {
+	case V2dockerManifestMt, V1ociManifestMt, V1dockerManifestMt, V1dockerSignedMt:
+		return true
+	}
+	return false
+}
+
+// IsEncrypted returns true if the media type is a layer that was encrypted with
+// OCIcrypt, e.g. 'application/vnd.oci.image.layer.v1.tar+gzip+encrypted'.
+func (mt MediaType) IsEncrypted() bool {
+	return strings.HasSuffix(string(mt), "+encrypted")
 }
 
 // NewLayer returns a new 'Layer' struct from the passed args
@@ -60,9 +193,42 @@ type BearerAuth struct {
 	Scope   string
 }
 
-// BearerToken holds the bearer token value returned from the upstream.
+// BearerToken holds the bearer token value returned from the upstream. Per the
+// distribution token spec, 'access_token' is an alternative to 'token', 'expires_in'
+// is in seconds and defaults to 60, and 'issued_at' is an RFC3339 time.
 type BearerToken struct {
-	Token string
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token,omitempty"`
+	ExpiresIn   int    `json:"expires_in,omitempty"`
+	IssuedAt    string `json:"issued_at,omitempty"`
+	// Expires is computed from the other fields when the token is received.
+	Expires time.Time `json:"-"`
+}
+
+// defaultTokenLifetime is the token lifetime if the token server does not provide one.
+const defaultTokenLifetime = 60 * time.Second
+
+// expiryMargin expires tokens a little early so they don't expire in flight.
+const expiryMargin = 5 * time.Second
+
+// SetExpiry computes the expiry of the token in the receiver from the 'expires_in' and
+// 'issued_at' fields, using the passed time if the token does not have an issue time.
+func (bt *BearerToken) SetExpiry(received time.Time) {
+	issued := received
+	if t, err := time.Parse(time.RFC3339, bt.IssuedAt); err == nil {
+		issued = t
+	}
+	lifetime := defaultTokenLifetime
+	if bt.ExpiresIn > 0 {
+		lifetime = time.Duration(bt.ExpiresIn) * time.Second
+	}
+	bt.Expires = issued.Add(lifetime)
+}
+
+// Expired returns true if the token in the receiver has expired or is about to. A token
+// with no expiry never expires.
+func (bt BearerToken) Expired() bool {
+	return !bt.Expires.IsZero() && time.Now().After(bt.Expires.Add(-expiryMargin))
 }
 
 // BasicAuth holds the encoded username and password.
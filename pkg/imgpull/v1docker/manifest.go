@@ -0,0 +1,43 @@
+package v1docker
+
+// Manifest is the legacy docker image manifest, schema version 1. The FSLayers and
+// History are ordered from the top layer to the base layer. Signatures are only present
+// in the signed 'prettyjws' form of the manifest.
+type Manifest struct {
+	SchemaVersion int64       `json:"schemaVersion"`
+	Name          string      `json:"name"`
+	Tag           string      `json:"tag"`
+	Architecture  string      `json:"architecture"`
+	FSLayers      []FSLayer   `json:"fsLayers"`
+	History       []History   `json:"history"`
+	Signatures    []Signature `json:"signatures,omitempty"`
+}
+
+type FSLayer struct {
+	BlobSum string `json:"blobSum"`
+}
+
+// History has a JSON-encoded legacy image config for the corresponding layer.
+type History struct {
+	V1Compatibility string `json:"v1Compatibility"`
+}
+
+type Signature struct {
+	Header    map[string]any `json:"header"`
+	Signature string         `json:"signature"`
+	Protected string         `json:"protected"`
+}
+
+// V1Compatibility has the parts of the 'History.V1Compatibility' JSON used to build
+// an image config from a schema 1 manifest.
+type V1Compatibility struct {
+	ID              string `json:"id"`
+	Parent          string `json:"parent,omitempty"`
+	Created         string `json:"created"`
+	Author          string `json:"author,omitempty"`
+	Comment         string `json:"comment,omitempty"`
+	Throwaway       bool   `json:"throwaway,omitempty"`
+	ContainerConfig struct {
+		Cmd []string `json:"Cmd"`
+	} `json:"container_config"`
+}
@@ -31,8 +31,51 @@ type Platform struct {
 type Manifest struct {
 	SchemaVersion int64             `json:"schemaVersion"`
 	MediaType     string            `json:"mediaType,omitempty"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
 	Config        Descriptor        `json:"config"`
 	Layers        []Descriptor      `json:"layers"`
 	Annotations   map[string]string `json:"annotations,omitempty"`
 	Subject       *Descriptor       `json:"subject,omitempty"`
 }
+
+// ArtifactManifest is the OCI artifact manifest, which was briefly part of the
+// image-spec (1.1 release candidates) and is still served by some registries.
+type ArtifactManifest struct {
+	MediaType    string            `json:"mediaType"`
+	ArtifactType string            `json:"artifactType"`
+	Blobs        []Descriptor      `json:"blobs,omitempty"`
+	Subject      *Descriptor       `json:"subject,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// Pre-defined annotation keys from the OCI image-spec.
+const (
+	// AnnotationCreated is the date and time the image was built (RFC 3339)
+	AnnotationCreated = "org.opencontainers.image.created"
+	// AnnotationAuthors is the contact details of the people or organization responsible for the image
+	AnnotationAuthors = "org.opencontainers.image.authors"
+	// AnnotationURL is the URL to find more information on the image
+	AnnotationURL = "org.opencontainers.image.url"
+	// AnnotationDocumentation is the URL to get documentation on the image
+	AnnotationDocumentation = "org.opencontainers.image.documentation"
+	// AnnotationSource is the URL to get source code for building the image
+	AnnotationSource = "org.opencontainers.image.source"
+	// AnnotationVersion is the version of the packaged software
+	AnnotationVersion = "org.opencontainers.image.version"
+	// AnnotationRevision is the source control revision identifier for the packaged software
+	AnnotationRevision = "org.opencontainers.image.revision"
+	// AnnotationVendor is the name of the distributing entity, organization or individual
+	AnnotationVendor = "org.opencontainers.image.vendor"
+	// AnnotationLicenses is the license(s) under which contained software is distributed
+	AnnotationLicenses = "org.opencontainers.image.licenses"
+	// AnnotationRefName is the name of the reference for a target
+	AnnotationRefName = "org.opencontainers.image.ref.name"
+	// AnnotationTitle is the human-readable title of the image or blob - typically a file name
+	AnnotationTitle = "org.opencontainers.image.title"
+	// AnnotationDescription is the human-readable description of the software packaged in the image
+	AnnotationDescription = "org.opencontainers.image.description"
+	// AnnotationBaseImageDigest is the digest of the image's base image
+	AnnotationBaseImageDigest = "org.opencontainers.image.base.digest"
+	// AnnotationBaseImageName is the image reference of the image's base image
+	AnnotationBaseImageName = "org.opencontainers.image.base.name"
+)
@@ -0,0 +1,239 @@
+package imgpull
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+	"github.com/aceeric/imgpull/pkg/imgpull/v1oci"
+	"github.com/aceeric/imgpull/pkg/imgpull/v2docker"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// mediaTypeRe validates the format of a media type per RFC 6838.
+var mediaTypeRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9!#$&^_.+-]{0,126}/[A-Za-z0-9][A-Za-z0-9!#$&^_.+-]{0,126}$`)
+
+// ValidationError describes one problem found by 'Validate'. Field is the path to the
+// offending field in the manifest JSON, e.g. 'layers[0].digest'.
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return e.Field + ": " + e.Message
+}
+
+// ValidationErrors is the error returned by 'Validate' with every problem found.
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, ve := range e {
+		msgs[i] = ve.Error()
+	}
+	return "invalid manifest: " + strings.Join(msgs, "; ")
+}
+
+// validator accumulates validation errors.
+type validator struct {
+	errs ValidationErrors
+}
+
+func (v *validator) add(field, format string, args ...any) {
+	v.errs = append(v.errs, ValidationError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Validate checks the manifest in the receiver against the OCI image-spec (or the docker
+// manifest spec for docker manifests): required fields are present, digests and media
+// types are well-formed, and the media type in the manifest is consistent with the media
+// type the manifest was served as. If the receiver has manifest bytes and a digest, the
+// digest is also checked against the bytes. If the manifest is valid then nil is returned,
+// otherwise a 'ValidationErrors' with every problem found.
+func (mh *ManifestHolder) Validate() error {
+	v := &validator{}
+	if mh.Digest != "" {
+		if err := digest.NewDigestFromEncoded(digest.Canonical, mh.Digest).Validate(); err != nil {
+			v.add("", "invalid manifest digest %q: %s", mh.Digest, err)
+		} else if len(mh.Bytes) != 0 && mh.Type != V1dockerManifest && digest.FromBytes(mh.Bytes).Encoded() != mh.Digest {
+			v.add("", "manifest digest %q does not match the manifest content", mh.Digest)
+		}
+	}
+	switch mh.Type {
+	case V2dockerManifestList:
+		m := mh.V2dockerManifestList
+		v.schemaVersion(m.SchemaVersion, 2)
+		v.mediaType("mediaType", m.MediaType, types.V2dockerManifestListMt, true)
+		if m.Manifests == nil {
+			v.add("manifests", "is required")
+		}
+		for i, d := range m.Manifests {
+			field := fmt.Sprintf("manifests[%d]", i)
+			v.v2Descriptor(field, d)
+			if d.Platform == nil {
+				v.add(field+".platform", "is required")
+			} else {
+				v.platform(field+".platform", d.Platform.OS, d.Platform.Architecture)
+			}
+		}
+	case V2dockerManifest:
+		m := mh.V2dockerManifest
+		v.schemaVersion(m.SchemaVersion, 2)
+		v.mediaType("mediaType", m.MediaType, types.V2dockerManifestMt, true)
+		v.v2Descriptor("config", m.Config)
+		if m.Layers == nil {
+			v.add("layers", "is required")
+		}
+		for i, d := range m.Layers {
+			v.v2Descriptor(fmt.Sprintf("layers[%d]", i), d)
+		}
+	case V1ociIndex:
+		m := mh.V1ociIndex
+		v.schemaVersion(m.SchemaVersion, 2)
+		v.mediaType("mediaType", m.MediaType, types.V1ociIndexMt, false)
+		if m.Manifests == nil {
+			v.add("manifests", "is required")
+		}
+		for i, d := range m.Manifests {
+			field := fmt.Sprintf("manifests[%d]", i)
+			v.ociDescriptor(field, d)
+			if d.Platform != nil {
+				v.platform(field+".platform", d.Platform.Os, d.Platform.Architecture)
+			}
+		}
+		v.subject(m.Subject)
+	case V1ociManifest:
+		m := mh.V1ociManifest
+		v.schemaVersion(m.SchemaVersion, 2)
+		v.mediaType("mediaType", m.MediaType, types.V1ociManifestMt, false)
+		v.ociDescriptor("config", m.Config)
+		if m.Config.MediaType == string(types.V1ociEmptyMt) && m.ArtifactType == "" {
+			v.add("artifactType", "is required when the config is the empty descriptor")
+		}
+		if m.ArtifactType != "" && !mediaTypeRe.MatchString(m.ArtifactType) {
+			v.add("artifactType", "invalid media type %q", m.ArtifactType)
+		}
+		if m.Layers == nil {
+			v.add("layers", "is required")
+		}
+		for i, d := range m.Layers {
+			v.ociDescriptor(fmt.Sprintf("layers[%d]", i), d)
+		}
+		v.subject(m.Subject)
+	case V1ociArtifactManifest:
+		m := mh.V1ociArtifactManifest
+		v.mediaType("mediaType", m.MediaType, types.V1ociArtifactMt, true)
+		if m.ArtifactType == "" {
+			v.add("artifactType", "is required")
+		} else if !mediaTypeRe.MatchString(m.ArtifactType) {
+			v.add("artifactType", "invalid media type %q", m.ArtifactType)
+		}
+		for i, d := range m.Blobs {
+			v.ociDescriptor(fmt.Sprintf("blobs[%d]", i), d)
+		}
+		v.subject(m.Subject)
+	case V1dockerManifest:
+		m := mh.V1dockerManifest
+		v.schemaVersion(m.SchemaVersion, 1)
+		if len(m.FSLayers) == 0 {
+			v.add("fsLayers", "is required")
+		}
+		if len(m.History) != len(m.FSLayers) {
+			v.add("history", "has %d entries but there are %d fsLayers", len(m.History), len(m.FSLayers))
+		}
+		for i, l := range m.FSLayers {
+			v.digest(fmt.Sprintf("fsLayers[%d].blobSum", i), l.BlobSum)
+		}
+		for i, h := range m.History {
+			if !json.Valid([]byte(h.V1Compatibility)) {
+				v.add(fmt.Sprintf("history[%d].v1Compatibility", i), "is not valid JSON")
+			}
+		}
+	default:
+		v.add("", "unknown manifest type %d", mh.Type)
+	}
+	if len(v.errs) != 0 {
+		return v.errs
+	}
+	return nil
+}
+
+// schemaVersion validates the manifest schema version.
+func (v *validator) schemaVersion(actual, expected int64) {
+	if actual != expected {
+		v.add("schemaVersion", "must be %d, got %d", expected, actual)
+	}
+}
+
+// mediaType validates that the media type in a manifest is consistent with the type of
+// manifest. For OCI manifests the media type is optional.
+func (v *validator) mediaType(field, actual string, expected types.MediaType, required bool) {
+	if actual == "" {
+		if required {
+			v.add(field, "is required")
+		}
+	} else if actual != string(expected) {
+		v.add(field, "%q does not match the manifest type %q", actual, expected)
+	}
+}
+
+// ociDescriptor validates an OCI descriptor.
+func (v *validator) ociDescriptor(field string, d v1oci.Descriptor) {
+	v.descriptor(field, d.MediaType, d.Digest, d.Size)
+	if d.ArtifactType != "" && !mediaTypeRe.MatchString(d.ArtifactType) {
+		v.add(field+".artifactType", "invalid media type %q", d.ArtifactType)
+	}
+	if len(d.Data) != 0 && int64(len(d.Data)) != d.Size {
+		v.add(field+".data", "has %d bytes but the size is %d", len(d.Data), d.Size)
+	}
+}
+
+// v2Descriptor validates a docker descriptor.
+func (v *validator) v2Descriptor(field string, d v2docker.Descriptor) {
+	v.descriptor(field, d.MediaType, d.Digest, d.Size)
+}
+
+// descriptor validates the fields common to all descriptors.
+func (v *validator) descriptor(field, mediaType, dgst string, size int64) {
+	if mediaType == "" {
+		v.add(field+".mediaType", "is required")
+	} else if !mediaTypeRe.MatchString(mediaType) {
+		v.add(field+".mediaType", "invalid media type %q", mediaType)
+	}
+	v.digest(field+".digest", dgst)
+	if size < 0 {
+		v.add(field+".size", "must not be negative")
+	}
+}
+
+// digest validates a digest like 'sha256:abc...'.
+func (v *validator) digest(field, dgst string) {
+	if dgst == "" {
+		v.add(field, "is required")
+	} else if _, err := digest.Parse(dgst); err != nil {
+		v.add(field, "invalid digest %q: %s", dgst, err)
+	}
+}
+
+// platform validates a platform.
+func (v *validator) platform(field, os, arch string) {
+	if os == "" {
+		v.add(field+".os", "is required")
+	}
+	if arch == "" {
+		v.add(field+".architecture", "is required")
+	}
+}
+
+// subject validates a subject descriptor if there is one.
+func (v *validator) subject(d *v1oci.Descriptor) {
+	if d != nil {
+		v.ociDescriptor("subject", *d)
+	}
+}
@@ -0,0 +1,94 @@
+package imgpull
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestValidateManifest(t *testing.T) {
+	imageManifest, err := os.ReadFile(filepath.Join("..", "..", "mock", "testfiles", "imageManifest.json"))
+	if err != nil {
+		t.FailNow()
+	}
+	manifestList, err := os.ReadFile(filepath.Join("..", "..", "mock", "testfiles", "manifestList.json"))
+	if err != nil {
+		t.FailNow()
+	}
+	im := string(imageManifest)
+	ml := string(manifestList)
+	for _, tst := range []struct {
+		mt       types.MediaType
+		manifest string
+		fields   []string
+	}{
+		{types.V1ociManifestMt, im, nil},
+		{types.V1ociIndexMt, ml, nil},
+		{types.V1ociManifestMt, strings.Replace(im, `"schemaVersion": 2`, `"schemaVersion": 3`, 1), []string{"schemaVersion"}},
+		{types.V1ociManifestMt, strings.Replace(im, `"sha256:d2c94e`, `"sha256:XYZ`, 1), []string{"config.digest"}},
+		{types.V1ociManifestMt, strings.Replace(im, `"size": 2459`, `"size": -1`, 1), []string{"layers[0].size"}},
+		{types.V1ociManifestMt, strings.Replace(im, `"application/vnd.oci.image.layer.v1.tar+gzip"`, `"gzip"`, 1), []string{"layers[0].mediaType"}},
+		{types.V1ociManifestMt, strings.Replace(im, `"mediaType": "application/vnd.oci.image.manifest.v1+json"`, `"mediaType": "application/vnd.oci.image.index.v1+json"`, 1), []string{"mediaType"}},
+		{types.V1ociIndexMt, strings.Replace(ml, `"os": "linux"`, `"os": ""`, 1), []string{"manifests[0].platform.os"}},
+		{types.V1ociIndexMt, `{"schemaVersion": 2}`, []string{"manifests"}},
+		{types.V2dockerManifestMt, `{"schemaVersion": 2, "config": {}}`, []string{"mediaType", "config.mediaType", "config.digest", "layers"}},
+		{types.V1ociArtifactMt, `{"mediaType": "application/vnd.oci.artifact.manifest.v1+json"}`, []string{"artifactType"}},
+		{types.V1dockerManifestMt, `{"schemaVersion": 1, "fsLayers": [{"blobSum": "sha256:abc"}], "history": []}`, []string{"history", "fsLayers[0].blobSum"}},
+	} {
+		mh, err := newManifestHolder(tst.mt, []byte(tst.manifest), "", "")
+		if err != nil {
+			t.FailNow()
+		}
+		err = mh.Validate()
+		if tst.fields == nil {
+			if err != nil {
+				t.Fail()
+			}
+			continue
+		}
+		var verrs ValidationErrors
+		if !errors.As(err, &verrs) {
+			t.FailNow()
+		}
+		fields := []string{}
+		for _, verr := range verrs {
+			fields = append(fields, verr.Field)
+		}
+		slices.Sort(fields)
+		slices.Sort(tst.fields)
+		if !slices.Equal(fields, tst.fields) {
+			t.Fail()
+		}
+	}
+}
+
+func TestValidateManifestDigest(t *testing.T) {
+	imageManifest, err := os.ReadFile(filepath.Join("..", "..", "mock", "testfiles", "imageManifest.json"))
+	if err != nil {
+		t.FailNow()
+	}
+	dgst := digest.FromBytes(imageManifest).Encoded()
+	for _, tst := range []struct {
+		digest string
+		valid  bool
+	}{
+		{dgst, true},
+		{"", true},
+		{strings.Repeat("0", 64), false},
+		{"abc", false},
+	} {
+		mh, err := newManifestHolder(types.V1ociManifestMt, imageManifest, tst.digest, "")
+		if err != nil {
+			t.FailNow()
+		}
+		if (mh.Validate() == nil) != tst.valid {
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package imgpull
+
+import (
+	"context"
+	"time"
+
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+)
+
+// WatchFunc is called by 'Watch' when the digest of the watched tag changes. 'prev' is
+// the manifest the tag referenced before the change, and 'cur' is the manifest it
+// references now.
+type WatchFunc func(prev, cur types.ManifestDescriptor)
+
+func (p *puller) Watch(ctx context.Context, interval time.Duration, callback WatchFunc) error {
+	prev, err := p.HeadManifest()
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		cur, err := p.HeadManifest()
+		if err != nil {
+			return err
+		}
+		if cur.Digest != prev.Digest {
+			callback(prev, cur)
+			prev = cur
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package imgpull
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aceeric/imgpull/pkg/imgpull/types"
+	"github.com/opencontainers/go-digest"
+)
+
+// Tests that the callback is called once for each change of the digest of the tag.
+func TestWatch(t *testing.T) {
+	var heads atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		// the tag moves on the third and fifth HEAD request
+		n := heads.Add(1)
+		version := 1
+		if n >= 5 {
+			version = 3
+		} else if n >= 3 {
+			version = 2
+		}
+		w.Header().Set("Content-Type", string(types.V1ociManifestMt))
+		w.Header().Set("Docker-Content-Digest", digest.FromString(fmt.Sprint(version)).String())
+		w.Header().Set("Content-Length", "10")
+	}))
+	defer server.Close()
+	p, err := NewPullerWith(PullerOpts{
+		Url:      fmt.Sprintf("%s/hello-world:latest", strings.TrimPrefix(server.URL, "http://")),
+		Scheme:   "http",
+		OStype:   "linux",
+		ArchType: "amd64",
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var changes []string
+	err = p.Watch(ctx, time.Millisecond, func(prev, cur types.ManifestDescriptor) {
+		changes = append(changes, prev.Digest+">"+cur.Digest)
+		if len(changes) == 2 {
+			cancel()
+		}
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the watch to be canceled, got %v", err)
+	}
+	d1, d2, d3 := digest.FromString("1").String(), digest.FromString("2").String(), digest.FromString("3").String()
+	if len(changes) != 2 || changes[0] != d1+">"+d2 || changes[1] != d2+">"+d3 {
+		t.Errorf("unexpected changes %v", changes)
+	}
+}